@@ -0,0 +1,373 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"github.com/toblrne/ZephyrusDBv2/webhook"
+)
+
+// statsResponse is the body of GET /stats
+type statsResponse struct {
+	db.Stats
+	Panics      uint64      `json:"panics"` // requests that panicked and were answered with a 500
+	Replication interface{} `json:"replication,omitempty"`
+}
+
+// Stats serves GET /stats with the driver's counters and, on a replica, how
+// far it is behind its primary
+func (h *Handler) Stats(w http.ResponseWriter, r *http.Request) {
+	resp := statsResponse{Stats: h.driver.Stats(), Panics: h.panics.Load()}
+	if h.Replication != nil {
+		resp.Replication = h.Replication()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Ready serves GET /readyz: 200 while the server takes writes, and 503
+// with the reason while the driver refuses them for lack of disk space.
+// Reads are served either way. A replica, read-only by design, is ready.
+// With Options.MaxKeys set, the number of keys and the limit are included.
+func (h *Handler) Ready(w http.ResponseWriter, r *http.Request) {
+	resp := jsonObject{"status": "ok"}
+	if count, max := h.driver.KeyCount(); max > 0 {
+		resp["keys"], resp["max_keys"] = count, max
+	}
+	if reason, full := h.driver.DiskFull(); full {
+		resp["status"], resp["reason"] = "disk_full", reason
+		writeJSON(w, http.StatusServiceUnavailable, resp)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Rebalance serves POST /admin/rebalance, moving keys to the data directory
+// the hash ring places them on. Progress is streamed as NDJSON
+// db.RebalanceProgress lines, the last of which has "done": true; an error
+// after streaming started ends the stream with an {"error": ...} line.
+func (h *Handler) Rebalance(w http.ResponseWriter, r *http.Request) {
+	h.streamProgress(w, r, func(report func(interface{})) error {
+		_, err := h.driver.Rebalance(r.Context(), func(p db.RebalanceProgress) { report(p) })
+		return err
+	})
+}
+
+// streamProgress answers 200 and runs a long admin operation, streaming each
+// progress report as an NDJSON line. An error, which comes after the status
+// was sent, ends the stream with an {"error": ...} line.
+func (h *Handler) streamProgress(w http.ResponseWriter, r *http.Request, run func(report func(interface{})) error) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	err := run(func(p interface{}) {
+		enc.Encode(p)
+		flush(w)
+	})
+	if err != nil {
+		h.logStreamError(r, err)
+		enc.Encode(jsonObject{"error": errorBody{Code: CodeInternal, Message: scrubMessage(err), RequestID: requestIDFrom(r)}})
+	}
+}
+
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// SetLogLevel serves PUT /admin/loglevel with {"level": "debug"}, changing
+// how much the driver logs until the server restarts
+func (h *Handler) SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, `body must be {"level": "debug|info|warn|error"}`)
+		return
+	}
+	level, err := db.ParseLogLevel(req.Level)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if err := h.driver.SetLogLevel(level); err != nil {
+		if errors.Is(err, db.ErrLogLevelUnsupported) {
+			writeError(w, r, http.StatusNotImplemented, CodeBadRequest, err.Error())
+			return
+		}
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"level": level.String()})
+}
+
+// Compact serves POST /admin/compact, removing leftover temp files and
+// unused blobs and answering 204. With ?progress=true progress is streamed
+// instead, as NDJSON db.CompactProgress lines the way Rebalance does.
+func (h *Handler) Compact(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("progress") == "true" {
+		h.streamProgress(w, r, func(report func(interface{})) error {
+			_, err := h.driver.CompactContext(r.Context(), func(p db.CompactProgress) { report(p) })
+			return err
+		})
+		return
+	}
+	if _, err := h.driver.CompactContext(r.Context(), nil); err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PauseCompaction serves POST /admin/compact/pause, holding running
+// compactions before their next batch and keeping the schedule from
+// starting new ones until resumed, across restarts. It answers with the
+// db.CompactionStats.
+func (h *Handler) PauseCompaction(w http.ResponseWriter, r *http.Request) {
+	if err := h.driver.PauseCompaction(); err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.driver.CompactionStats())
+}
+
+// ResumeCompaction serves POST /admin/compact/resume, letting paused
+// compactions go on. It answers with the db.CompactionStats.
+func (h *Handler) ResumeCompaction(w http.ResponseWriter, r *http.Request) {
+	if err := h.driver.ResumeCompaction(); err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.driver.CompactionStats())
+}
+
+// Verify serves POST /admin/verify, reading back every value and returning
+// {"corrupt": [...]} with those no longer matching their content hash
+func (h *Handler) Verify(w http.ResponseWriter, r *http.Request) {
+	corrupt, err := h.driver.Verify(r.Context())
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"corrupt": corrupt})
+}
+
+// startupReport is the body of GET /admin/startup-report
+type startupReport struct {
+	OpenedAt           time.Time         `json:"opened_at"`
+	DurationSeconds    float64           `json:"duration_seconds"`
+	Keys               int               `json:"keys"`
+	CleanShutdown      bool              `json:"clean_shutdown"`
+	SnapshotLoaded     bool              `json:"snapshot_loaded"`
+	SnapshotAgeSeconds float64           `json:"snapshot_age_seconds"`
+	ReconcileAdded     int               `json:"reconcile_added"`
+	ReconcileRemoved   int               `json:"reconcile_removed"`
+	OplogSeq           uint64            `json:"oplog_seq"`
+	OplogTornBytes     int64             `json:"oplog_torn_bytes"`
+	TempFilesRemoved   int               `json:"temp_files_removed"`
+	TempBytesRemoved   int64             `json:"temp_bytes_removed"`
+	Quarantined        []string          `json:"quarantined"`
+	Verified           bool              `json:"verified"`
+	Corrupt            []db.CorruptValue `json:"corrupt"`
+	CorruptFiles       int               `json:"corrupt_files"`
+}
+
+// StartupReport serves GET /admin/startup-report with what the driver found
+// and did when it was opened, see db.StartupReport
+func (h *Handler) StartupReport(w http.ResponseWriter, r *http.Request) {
+	rep := h.driver.StartupReport()
+	resp := startupReport{
+		OpenedAt:           rep.OpenedAt.UTC(),
+		DurationSeconds:    rep.Duration.Seconds(),
+		Keys:               rep.Keys,
+		CleanShutdown:      rep.CleanShutdown,
+		SnapshotLoaded:     rep.SnapshotLoaded,
+		SnapshotAgeSeconds: rep.SnapshotAge.Seconds(),
+		ReconcileAdded:     rep.ReconcileAdded,
+		ReconcileRemoved:   rep.ReconcileRemoved,
+		OplogSeq:           rep.OplogSeq,
+		OplogTornBytes:     rep.OplogTornBytes,
+		TempFilesRemoved:   rep.TempFilesRemoved,
+		TempBytesRemoved:   rep.TempBytesRemoved,
+		Quarantined:        rep.Quarantined,
+		Verified:           rep.Verified,
+		Corrupt:            rep.Corrupt,
+		CorruptFiles:       rep.CorruptFiles(),
+	}
+	if resp.Quarantined == nil {
+		resp.Quarantined = []string{}
+	}
+	if resp.Corrupt == nil {
+		resp.Corrupt = []db.CorruptValue{}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Schemas serves GET /admin/schemas with the JSON Schemas set, by key prefix
+func (h *Handler) Schemas(w http.ResponseWriter, r *http.Request) {
+	schemas := make(map[string]json.RawMessage)
+	for prefix, schema := range h.driver.Schemas() {
+		schemas[prefix] = schema
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"schemas": schemas})
+}
+
+// SetSchema serves PUT /admin/schemas?prefix=users: with a JSON Schema as
+// the body, which values of keys starting with the prefix must then match
+func (h *Handler) SetSchema(w http.ResponseWriter, r *http.Request) {
+	schema, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "failed to read the schema")
+		return
+	}
+	if err := h.driver.SetSchema(r.URL.Query().Get("prefix"), schema); err != nil {
+		if errors.Is(err, db.ErrInvalidSchema) {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteSchema serves DELETE /admin/schemas?prefix=users:, removing the
+// schema set for that prefix
+func (h *Handler) DeleteSchema(w http.ResponseWriter, r *http.Request) {
+	if err := h.driver.SetSchema(r.URL.Query().Get("prefix"), nil); err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Quotas serves GET /admin/quotas with the quota and usage of every
+// namespace that has one
+func (h *Handler) Quotas(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jsonObject{"quotas": h.driver.Quotas()})
+}
+
+// SetQuota serves PUT /admin/quotas?namespace=users with a body such as
+// {"max_bytes": 1048576, "max_keys": 1000}, limiting the keys starting with
+// users:. A limit of 0 is no limit.
+func (h *Handler) SetQuota(w http.ResponseWriter, r *http.Request) {
+	var quota db.Quota
+	if err := decodeJSON(r, &quota); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "invalid quota: "+err.Error())
+		return
+	}
+	if err := h.driver.SetQuota(r.URL.Query().Get("namespace"), quota.MaxBytes, quota.MaxKeys); err != nil {
+		if errors.Is(err, db.ErrInvalidQuota) {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteQuota serves DELETE /admin/quotas?namespace=users, removing the
+// quota of that namespace
+func (h *Handler) DeleteQuota(w http.ResponseWriter, r *http.Request) {
+	if err := h.driver.SetQuota(r.URL.Query().Get("namespace"), 0, 0); err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webhooks returns the Dispatcher behind /admin/webhooks, answering 404 and
+// returning nil when there is none
+func (h *Handler) webhooks(w http.ResponseWriter, r *http.Request) *webhook.Dispatcher {
+	if h.Webhooks == nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "webhooks are not enabled")
+	}
+	return h.Webhooks
+}
+
+// ListWebhooks serves GET /admin/webhooks with every webhook, without its
+// secret, and its delivery stats
+func (h *Handler) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	if d := h.webhooks(w, r); d != nil {
+		writeJSON(w, http.StatusOK, jsonObject{"webhooks": d.List()})
+	}
+}
+
+// AddWebhook serves POST /admin/webhooks with a body such as
+// {"url": "https://example.com/hook", "prefixes": ["users:"]}, answering 201
+// with the webhook registered, including its ID and, when the body had none,
+// the secret generated for it
+func (h *Handler) AddWebhook(w http.ResponseWriter, r *http.Request) {
+	d := h.webhooks(w, r)
+	if d == nil {
+		return
+	}
+	var hook webhook.Webhook
+	if err := decodeJSON(r, &hook); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "invalid webhook: "+err.Error())
+		return
+	}
+	hook, err := d.Register(hook)
+	if errors.Is(err, webhook.ErrInvalid) {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// DeleteWebhook serves DELETE /admin/webhooks?id=, removing that webhook
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	d := h.webhooks(w, r)
+	if d == nil {
+		return
+	}
+	err := d.Remove(r.URL.Query().Get("id"))
+	if errors.Is(err, webhook.ErrNotFound) {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Snapshots serves GET /admin/snapshots with the archived B-tree snapshots,
+// newest first, with their size and number of keys
+func (h *Handler) Snapshots(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := h.driver.Snapshots()
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"snapshots": snapshots})
+}
+
+// RestoreSnapshot serves POST /admin/snapshots/:name/restore?confirm=true,
+// replacing the index with an archived snapshot. Without confirm=true it
+// answers 400, as the expiries and labels set since are lost.
+func (h *Handler) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("confirm") != "true" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "restoring a snapshot replaces the index, pass confirm=true")
+		return
+	}
+	name := r.PathValue("name")
+	err := h.driver.RestoreSnapshot(name)
+	if errors.Is(err, db.ErrSnapshotNotFound) {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"restored": name})
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Role is the level of access granted to an API key. Each role includes the
+// ones below it.
+type Role int
+
+const (
+	RoleRead Role = iota + 1
+	RoleWrite
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleRead:
+		return "read"
+	case RoleWrite:
+		return "write"
+	case RoleAdmin:
+		return "admin"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole parses "read", "write" or "admin"
+func ParseRole(s string) (Role, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "read":
+		return RoleRead, nil
+	case "write":
+		return RoleWrite, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return 0, fmt.Errorf("unknown role %q", s)
+}
+
+// MarshalText writes the role by name, as in API key files
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses the role as ParseRole does
+func (r *Role) UnmarshalText(text []byte) error {
+	role, err := ParseRole(string(text))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// ParseAPIKeys parses a comma-separated list of key:role pairs, as accepted by
+// the -api-keys flag
+func ParseAPIKeys(spec string) (map[string]Role, error) {
+	keys := make(map[string]Role)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, roleName, ok := strings.Cut(pair, ":")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid API key entry %q, want key:role", pair)
+		}
+		role, err := ParseRole(roleName)
+		if err != nil {
+			return nil, err
+		}
+		keys[key] = role
+	}
+	return keys, nil
+}
+
+// Auth checks API keys sent as "Authorization: Bearer <key>" or in the
+// X-API-Key header. A nil *Auth, or one without keys, allows every request,
+// except that one loaded from a file never does.
+type Auth struct {
+	// Keys are stored hashed so lookups do not compare secrets byte by byte
+	keys atomic.Pointer[map[[sha256.Size]byte]grant]
+
+	path      string     // the key file, empty for keys given to NewAuth
+	reloading sync.Mutex // held while the file is read
+	modTime   time.Time
+	fileSize  int64
+}
+
+// grant is what an API key allows
+type grant struct {
+	role  Role
+	scope scope // nil for every key
+}
+
+// NewAuth creates an Auth accepting the given keys, none of them scoped
+func NewAuth(keys map[string]Role) *Auth {
+	grants := make(map[[sha256.Size]byte]grant, len(keys))
+	for key, role := range keys {
+		grants[sha256.Sum256([]byte(key))] = grant{role: role}
+	}
+	a := &Auth{}
+	a.keys.Store(&grants)
+	return a
+}
+
+// Enabled reports whether requests must carry an API key
+func (a *Auth) Enabled() bool {
+	return a != nil && (a.path != "" || len(*a.keys.Load()) > 0)
+}
+
+// Role returns the role granted to an API key, and false for unknown keys.
+// Keys scoped to namespaces are only accepted by the HTTP API, which alone
+// confines them, so Role reports them as unknown too.
+func (a *Auth) Role(token string) (Role, bool) {
+	g, ok := a.grant(token)
+	if !ok || g.scope != nil {
+		return 0, false
+	}
+	return g.role, true
+}
+
+// grant returns what an API key allows, and false for unknown keys
+func (a *Auth) grant(token string) (grant, bool) {
+	if token == "" {
+		return grant{}, false
+	}
+	g, ok := (*a.keys.Load())[sha256.Sum256([]byte(token))]
+	return g, ok
+}
+
+// apiKey returns the API key presented with the request, empty for none
+func apiKey(r *http.Request) string {
+	token := r.Header.Get("X-API-Key")
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	return token
+}
+
+// require returns middleware rejecting requests whose key lacks the role.
+// Admin routes also need a key that is not scoped to namespaces. The scope
+// of a scoped key is kept in the context for the handlers to enforce.
+func (h *Handler) require(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !h.Auth.Enabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			got, ok := h.Auth.grant(apiKey(r))
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="zephyrus"`)
+				writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "a valid API key is required")
+				return
+			}
+			if got.role < role {
+				writeError(w, r, http.StatusForbidden, CodeForbidden, fmt.Sprintf("%s role required", role))
+				return
+			}
+			if got.scope != nil {
+				if role == RoleAdmin {
+					writeError(w, r, http.StatusForbidden, CodeForbidden, "an API key not scoped to namespaces is required")
+					return
+				}
+				r = withValue(r, scopeKey, got.scope)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// maxBatchKeys caps how many keys one multi-get request may ask for
+const maxBatchKeys = 100
+
+// batchValue is a value in a multi-get response. JSON values are inlined and
+// everything else is base64 encoded.
+type batchValue struct {
+	Encoding string      `json:"encoding"`
+	Value    interface{} `json:"value"`
+}
+
+// MultiGet serves GET /keys/multi?keys=a,b,c
+func (h *Handler) MultiGet(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	if raw := r.URL.Query().Get("keys"); raw != "" {
+		keys = strings.Split(raw, ",")
+	}
+	h.multiGet(w, r, keys)
+}
+
+// MultiGetPost serves POST /mget with a JSON array of keys in the body, for
+// key lists too long for a URL
+func (h *Handler) MultiGetPost(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	if err := json.NewDecoder(r.Body).Decode(&keys); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "body must be a JSON array of keys")
+		return
+	}
+	h.multiGet(w, r, keys)
+}
+
+func (h *Handler) multiGet(w http.ResponseWriter, r *http.Request, keys []string) {
+	if len(keys) == 0 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "at least one key is required")
+		return
+	}
+	if len(keys) > maxBatchKeys {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("at most %d keys may be requested at once", maxBatchKeys))
+		return
+	}
+	for _, key := range keys {
+		if err := db.ValidateKey(key); err != nil {
+			writeDriverError(w, r, err)
+			return
+		}
+		if !checkScope(w, r, key) {
+			return
+		}
+	}
+
+	found, err := h.driver.GetBatch(keys)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+
+	values := make(map[string]batchValue, len(found))
+	missing := []string{}
+	for _, key := range keys {
+		if _, done := values[key]; done {
+			continue
+		}
+		value, ok := found[key]
+		if !ok {
+			if !containsString(missing, key) {
+				missing = append(missing, key)
+			}
+			continue
+		}
+		if json.Valid(value) {
+			values[key] = batchValue{Encoding: "json", Value: json.RawMessage(value)}
+		} else {
+			values[key] = batchValue{Encoding: "base64", Value: base64.StdEncoding.EncodeToString(value)}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, jsonObject{"values": values, "missing": missing})
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CachePolicy chooses the Cache-Control header of GET /key responses, for
+// downstream HTTP caches. Last-Modified, If-Modified-Since and the ETag
+// validators are handled by GetValue regardless.
+type CachePolicy struct {
+	// Default is sent for keys matching no prefix; empty sends no header
+	Default string
+	// Prefixes overrides Default for the keys starting with each prefix, the
+	// longest matching one winning, such as "public, max-age=31536000,
+	// immutable" for content-addressed keys
+	Prefixes map[string]string
+}
+
+// For returns the Cache-Control header for key, empty for none
+func (p CachePolicy) For(key string) string {
+	policy, longest := p.Default, -1
+	for prefix, directives := range p.Prefixes {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			policy, longest = directives, len(prefix)
+		}
+	}
+	return policy
+}
+
+// ParseCachePrefixes parses a semicolon-separated list of "prefix
+// directives" entries, as accepted by the -cache-control-prefixes flag, such
+// as "blob: public, max-age=31536000, immutable; session: no-store". Keys
+// cannot contain whitespace, so the prefix ends at the first space.
+func ParseCachePrefixes(spec string) (map[string]string, error) {
+	prefixes := make(map[string]string)
+	for _, entry := range strings.Split(spec, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		prefix, directives, _ := strings.Cut(entry, " ")
+		if directives = strings.TrimSpace(directives); directives == "" {
+			return nil, fmt.Errorf("invalid cache control entry %q, want prefix and directives", entry)
+		}
+		if _, dup := prefixes[prefix]; dup {
+			return nil, fmt.Errorf("cache control prefix %q is given twice", prefix)
+		}
+		prefixes[prefix] = directives
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// parseSince reads the ?since= sequence number, 0 when it is not given
+func parseSince(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	since, err := strconv.ParseUint(queryDefault(r, "since", "0"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "since must be a sequence number")
+		return 0, false
+	}
+	return since, true
+}
+
+// abortWithOplogError reports an error reading the operation log
+func writeOplogError(w http.ResponseWriter, r *http.Request, since uint64, err error) {
+	switch {
+	case errors.Is(err, db.ErrOplogDisabled):
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "the operation log is disabled on this server")
+	case errors.Is(err, db.ErrChangesTruncated):
+		writeError(w, r, http.StatusGone, CodeResyncRequired,
+			fmt.Sprintf("changes after %d are no longer in the log, resync from /replication/snapshot", since))
+	default:
+		writeDriverError(w, r, err)
+	}
+}
+
+// Changes serves GET /changes?since=N&limit= with the changes made after
+// change N, oldest first, from the operation log. "next" is the since value
+// for the following page. A since older than the log's retention gets 410
+// RESYNC_REQUIRED.
+func (h *Handler) Changes(w http.ResponseWriter, r *http.Request) {
+	since, ok := parseSince(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultChangesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxChangesLimit {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxChangesLimit))
+			return
+		}
+		limit = n
+	}
+
+	changes, _, err := h.driver.Oplog(since, limit)
+	if err != nil {
+		writeOplogError(w, r, since, err)
+		return
+	}
+
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+	if changes == nil {
+		changes = []db.Change{}
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"changes": changes, "next": next})
+}
+
+// ChangeStream serves GET /changes/stream?since=N as a long-lived NDJSON
+// stream of the operation log from change N on. Idle streams get a
+// {"seq": N} line without an op every heartbeat.
+func (h *Handler) ChangeStream(w http.ResponseWriter, r *http.Request) {
+	since, ok := parseSince(w, r)
+	if !ok {
+		return
+	}
+
+	changes, wake, err := h.driver.Oplog(since, maxChangesLimit)
+	if err != nil {
+		writeOplogError(w, r, since, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	enc := json.NewEncoder(w)
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		for _, change := range changes {
+			if err := enc.Encode(change); err != nil {
+				return
+			}
+			since = change.Seq
+		}
+		flush(w)
+
+		if len(changes) == 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-h.shutdown:
+				return
+			case <-wake:
+			case <-heartbeat.C:
+				if err := enc.Encode(db.Change{Seq: h.driver.Seq(), Time: time.Now()}); err != nil {
+					return
+				}
+				flush(w)
+			}
+		}
+
+		// A consumer too slow for retention loses its place; the stream
+		// ends and reconnecting reports RESYNC_REQUIRED
+		changes, wake, err = h.driver.Oplog(since, maxChangesLimit)
+		if err != nil {
+			h.logStreamError(r, err)
+			return
+		}
+	}
+}
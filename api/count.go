@@ -0,0 +1,26 @@
+package api
+
+import (
+	"context"
+	"net/http"
+)
+
+// Count serves GET /count?prefix=, returning {"count": N}, of the keys the
+// API key may use. It answers 503 if the count cannot finish within
+// ScanTimeout.
+func (h *Handler) Count(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.ScanTimeout)
+	defer cancel()
+
+	count := 0
+	for _, prefix := range requestScope(r).narrow(r.URL.Query().Get("prefix")) {
+		n, err := h.driver.Count(ctx, prefix)
+		if err != nil {
+			writeDriverError(w, r, err)
+			return
+		}
+		count += n
+	}
+
+	writeJSON(w, http.StatusOK, jsonObject{"count": count})
+}
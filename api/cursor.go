@@ -0,0 +1,56 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// cursorVersion starts every cursor, so that the format can change without
+// misreading cursors handed out before
+const cursorVersion = 1
+
+// cursorMACSize is how much of the HMAC a cursor carries
+const cursorMACSize = 16
+
+// errInvalidCursor is returned for cursors this server did not hand out for
+// the listing they are used with
+var errInvalidCursor = errors.New("invalid cursor")
+
+// encodeCursor returns the opaque cursor resuming a listing of prefix, in
+// descending order or not, after key
+func (h *Handler) encodeCursor(prefix string, desc bool, key string) string {
+	payload := append([]byte{cursorVersion, orderByte(desc)}, key...)
+	return base64.RawURLEncoding.EncodeToString(append(payload, h.cursorMAC(prefix, payload)...))
+}
+
+// decodeCursor returns the key a cursor resumes after, checking that it was
+// handed out for a listing of prefix in the same order
+func (h *Handler) decodeCursor(cursor, prefix string, desc bool) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) < 2+cursorMACSize {
+		return "", errInvalidCursor
+	}
+	payload, mac := raw[:len(raw)-cursorMACSize], raw[len(raw)-cursorMACSize:]
+	if payload[0] != cursorVersion || payload[1] != orderByte(desc) || !hmac.Equal(mac, h.cursorMAC(prefix, payload)) {
+		return "", errInvalidCursor
+	}
+	return string(payload[2:]), nil
+}
+
+// cursorMAC signs a cursor together with the prefix it lists
+func (h *Handler) cursorMAC(prefix string, payload []byte) []byte {
+	m := hmac.New(sha256.New, h.CursorSecret)
+	fmt.Fprintf(m, "%d:%s", len(prefix), prefix)
+	m.Write(payload)
+	return m.Sum(nil)[:cursorMACSize]
+}
+
+func orderByte(desc bool) byte {
+	if desc {
+		return 'd'
+	}
+	return 'a'
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// Machine-readable error codes returned in the error envelope
+const (
+	CodeBadRequest       = "BAD_REQUEST"
+	CodeInvalidValue     = "INVALID_VALUE"
+	CodeInvalidTTL       = "INVALID_TTL"
+	CodeInvalidKey       = "INVALID_KEY"
+	CodeInvalidLabels    = "INVALID_LABELS"
+	CodeInvalidFilter    = "INVALID_FILTER"
+	CodeKeyNotFound      = "KEY_NOT_FOUND"
+	CodeKeyExists        = "KEY_EXISTS"
+	CodeRevisionMismatch = "REVISION_MISMATCH"
+	CodeValueTooLarge    = "VALUE_TOO_LARGE"
+	CodeSchemaViolation  = "SCHEMA_VIOLATION"
+	CodeQuotaExceeded    = "QUOTA_EXCEEDED"
+	CodeTooManyKeys      = "TOO_MANY_KEYS"
+	CodeUnauthorized     = "UNAUTHORIZED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeReadOnly         = "READ_ONLY"
+	CodeDiskFull         = "DISK_FULL"
+	CodeResyncRequired   = "RESYNC_REQUIRED"
+	CodeNotFound         = "NOT_FOUND"
+	CodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	CodeUnavailable      = "UNAVAILABLE"
+	CodeLoadFailed       = "LOAD_FAILED"
+	CodeMirrorFailed     = "MIRROR_FAILED"
+	CodeTimeout          = "TIMEOUT"
+	CodeInternal         = "INTERNAL"
+)
+
+// RequestIDHeader carries the request ID in both directions
+const RequestIDHeader = "X-Request-ID"
+
+// errorBody is the "error" member of the error envelope
+type errorBody struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+
+	// Details lists what failed, for SCHEMA_VIOLATION
+	Details []db.SchemaViolation `json:"details,omitempty"`
+
+	// Quota holds the namespace's limits and what it would have stored, for
+	// QUOTA_EXCEEDED
+	Quota *db.QuotaError `json:"quota,omitempty"`
+
+	// Position is the byte offset in the filter where parsing failed, for
+	// INVALID_FILTER
+	Position *int `json:"position,omitempty"`
+
+	// TTLSeconds is how long the holder has left, -1 for never, for
+	// LOCK_HELD
+	TTLSeconds *int64 `json:"ttl_seconds,omitempty"`
+}
+
+// requestID is middleware that tags each request with an ID, reusing the
+// one sent by the client when present
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, withValue(r, requestIDKey, id))
+	})
+}
+
+// writeError writes the error envelope. Middleware writing one does not
+// call the next handler.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeJSON(w, status, jsonObject{"error": errorBody{
+		Code:      code,
+		Message:   message,
+		RequestID: requestIDFrom(r),
+	}})
+}
+
+// writeDriverError maps an error returned by the Driver to its status and
+// code and writes the envelope, with the details of a schema violation, a
+// quota exceeded, a filter that does not parse or a lock held by another
+func writeDriverError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	body := errorBody{
+		Code:      code,
+		Message:   scrubMessage(err),
+		RequestID: requestIDFrom(r),
+	}
+	var schemaErr *db.SchemaError
+	if errors.As(err, &schemaErr) {
+		body.Details = schemaErr.Violations
+	}
+	var quotaErr *db.QuotaError
+	if errors.As(err, &quotaErr) {
+		body.Quota = quotaErr
+	}
+	var filterErr *db.FilterError
+	if errors.As(err, &filterErr) {
+		body.Position = &filterErr.Pos
+	}
+	var heldErr *db.LockHeldError
+	if errors.As(err, &heldErr) {
+		ttl := lockHeldSeconds(heldErr)
+		body.TTLSeconds = &ttl
+		if ttl > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(ttl, 10))
+		}
+	}
+	writeJSON(w, status, jsonObject{"error": body})
+}
+
+// logStreamError logs an error ending a response whose status was already
+// sent, which the client only sees as a body cut short
+func (h *Handler) logStreamError(r *http.Request, err error) {
+	h.driver.Logger().Warn("Serving %s %s failed after the response started (request %s): %v", r.Method, routeFrom(r), requestIDFrom(r), err)
+}
+
+// errorStatus maps Driver sentinel errors to HTTP statuses and codes
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, db.ErrKeyNotFound):
+		return http.StatusNotFound, CodeKeyNotFound
+	case errors.Is(err, db.ErrKeyExists):
+		return http.StatusConflict, CodeKeyExists
+	case errors.Is(err, db.ErrLockHeld):
+		return http.StatusConflict, CodeLockHeld
+	case errors.Is(err, db.ErrLockNotHeld):
+		return http.StatusConflict, CodeLockNotHeld
+	case errors.Is(err, db.ErrNotList):
+		return http.StatusUnprocessableEntity, CodeNotList
+	case errors.Is(err, db.ErrNotObject):
+		return http.StatusUnprocessableEntity, CodeNotObject
+	case errors.Is(err, db.ErrFieldNotFound):
+		return http.StatusNotFound, CodeFieldNotFound
+	case errors.Is(err, db.ErrEmpty):
+		return http.StatusConflict, CodeListEmpty
+	case errors.Is(err, db.ErrInvalidElement):
+		return http.StatusBadRequest, CodeInvalidValue
+	case errors.Is(err, db.ErrRevisionMismatch):
+		return http.StatusPreconditionFailed, CodeRevisionMismatch
+	case errors.Is(err, db.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge, CodeValueTooLarge
+	case errors.Is(err, db.ErrSchemaViolation):
+		return http.StatusUnprocessableEntity, CodeSchemaViolation
+	case errors.Is(err, db.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, CodeQuotaExceeded
+	case errors.Is(err, db.ErrTooManyKeys):
+		return http.StatusInsufficientStorage, CodeTooManyKeys
+	case errors.Is(err, db.ErrInvalidTTL):
+		return http.StatusBadRequest, CodeInvalidTTL
+	case errors.Is(err, db.ErrInvalidKey):
+		return http.StatusBadRequest, CodeInvalidKey
+	case errors.Is(err, db.ErrInvalidLabels):
+		return http.StatusBadRequest, CodeInvalidLabels
+	case errors.Is(err, db.ErrInvalidFilter):
+		return http.StatusBadRequest, CodeInvalidFilter
+	case errors.Is(err, db.ErrDiskFull):
+		return http.StatusServiceUnavailable, CodeDiskFull
+	case errors.Is(err, db.ErrReadOnly):
+		return http.StatusForbidden, CodeReadOnly
+	case errors.Is(err, db.ErrClosed):
+		return http.StatusServiceUnavailable, CodeUnavailable
+	case errors.Is(err, db.ErrLoadFailed):
+		return http.StatusBadGateway, CodeLoadFailed
+	case errors.Is(err, db.ErrMirrorFailed):
+		return http.StatusBadGateway, CodeMirrorFailed
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable, CodeTimeout
+	}
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// scrubMessage returns the error text without filesystem paths, which would
+// reveal the layout of the server to clients
+func scrubMessage(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return fmt.Sprintf("%s: %v", pathErr.Op, pathErr.Err)
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return fmt.Sprintf("%s: %v", linkErr.Op, linkErr.Err)
+	}
+	return err.Error()
+}
+
+// noRoute returns the handler answering unknown paths with the error
+// envelope. A path under basePath+"/key/" with more segments than any route
+// is taken for a key with slashes, which keys cannot have.
+func noRoute(basePath string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, basePath)
+		for _, prefix := range []string{"/key/", key64Prefix} {
+			if rest, ok := strings.CutPrefix(path, prefix); ok && strings.Contains(strings.Trim(rest, "/"), "/") {
+				writeDriverError(w, r, db.ValidateKey(rest))
+				return
+			}
+		}
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "no route for "+r.URL.Path)
+	}
+}
+
+// noMethod answers known paths requested with the wrong method
+func noMethod(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+}
+
+// validKey is middleware rejecting requests whose key parameter breaks the
+// Driver's key rules, is in a namespace the server keeps for itself, or is
+// outside the scope of the API key, before any handler runs
+func validKey(next http.Handler) http.Handler {
+	return checkedKey(db.ValidateKey, next)
+}
+
+// validKey64 is validKey for the /key64 routes, which take any key the
+// driver can store: with db.Options.EncodeFileNames that includes binary
+// keys and keys with whitespace, which no file name could hold
+func (h *Handler) validKey64(next http.Handler) http.Handler {
+	return checkedKey(h.driver.CheckKey, next)
+}
+
+// checkedKey is validKey with check as the key rule
+func checkedKey(check func(string) error, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.PathValue("key")
+		if err := check(key); err != nil {
+			writeDriverError(w, r, err)
+			return
+		}
+		if db.Reserved(key) {
+			ns, _, _ := strings.Cut(key, db.NamespaceSeparator)
+			writeError(w, r, http.StatusBadRequest, CodeInvalidKey, "the "+ns+" namespace is reserved")
+			return
+		}
+		if checkScope(w, r, key) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
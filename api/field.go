@@ -0,0 +1,58 @@
+package api
+
+import (
+	"io"
+	"net/http"
+)
+
+// Error codes of the field endpoints
+const (
+	CodeNotObject     = "NOT_AN_OBJECT"
+	CodeFieldNotFound = "FIELD_NOT_FOUND"
+)
+
+// SetField serves PUT /key/:key/field/:field with a JSON value as the body,
+// setting that field of the JSON object stored at the key and answering 201
+// when the field is new and 200 when it was replaced. A missing key is
+// created; a value that is not an object gets 422 NOT_AN_OBJECT.
+func (h *Handler) SetField(w http.ResponseWriter, r *http.Request) {
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidValue, "failed to read the request body")
+		return
+	}
+	created, err := h.driver.FieldSet(r.PathValue("key"), r.PathValue("field"), value)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetField serves GET /key/:key/field/:field, answering with the value of
+// that field of the JSON object stored at the key, or 404 FIELD_NOT_FOUND
+func (h *Handler) GetField(w http.ResponseWriter, r *http.Request) {
+	value, err := h.driver.FieldGet(r.PathValue("key"), r.PathValue("field"))
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(value)
+}
+
+// DeleteField serves DELETE /key/:key/field/:field, removing that field of
+// the JSON object stored at the key and answering 204. Removing the last
+// field leaves the key holding {}.
+func (h *Handler) DeleteField(w http.ResponseWriter, r *http.Request) {
+	if err := h.driver.FieldDelete(r.PathValue("key"), r.PathValue("field")); err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,69 @@
+//go:build !nogin
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WithEngine registers the routes onto engine instead of a new one. The
+// engine's own settings, logger and handlers for unknown routes are left
+// alone; set UseRawPath on it so that a key with an escaped slash is
+// refused instead of being split.
+func WithEngine(engine *gin.Engine) RouterOption {
+	return func(o *routerOptions) { o.engine = engine }
+}
+
+// InitRouter initializes and returns the Gin Engine with configured routes,
+// a new one unless WithEngine gives one
+func InitRouter(handler *Handler, opts ...RouterOption) *gin.Engine {
+	o := newRouterOptions(opts)
+	if engine, ok := o.engine.(*gin.Engine); ok {
+		register(&engine.RouterGroup, handler, o)
+		return engine
+	}
+
+	// gin's own recovery writes a bare 500 and prints the stack to stderr,
+	// so it is left out for the one answering with the error envelope
+	router := gin.New()
+	router.Use(gin.Logger())
+	router.HandleMethodNotAllowed = true
+	// Match routes against the raw path so that an escaped slash stays part
+	// of the key, where validation rejects it, instead of splitting the path
+	router.UseRawPath = true
+	router.NoRoute(ginHandler(handler.wrap(noRoute(o.basePath))))
+	router.NoMethod(ginHandler(handler.wrap(http.HandlerFunc(noMethod))))
+	register(&router.RouterGroup, handler, o)
+	return router
+}
+
+// Register adds the routes to parent, a group of an application's own
+// engine, as WithEngine does; WithEngine is ignored
+func Register(parent *gin.RouterGroup, handler *Handler, opts ...RouterOption) {
+	register(parent, handler, newRouterOptions(opts))
+}
+
+// register adds the routes selected by o to a group of parent
+func register(parent *gin.RouterGroup, handler *Handler, o routerOptions) {
+	router := parent.Group(o.basePath)
+	for _, rt := range handler.routes(o.routes) {
+		router.Handle(rt.method, rt.path, ginHandler(handler.wrap(chain(rt.handler, o.middleware...))))
+	}
+}
+
+// ginHandler serves a request gin routed with handler, passing on the path
+// parameters and the route it matched
+func ginHandler(handler http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r := c.Request
+		for _, p := range c.Params {
+			r.SetPathValue(p.Key, p.Value)
+		}
+		if route := c.FullPath(); route != "" {
+			r = withValue(r, routeKey, route)
+		}
+		handler.ServeHTTP(c.Writer, r)
+	}
+}
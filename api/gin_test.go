@@ -0,0 +1,39 @@
+//go:build !nogin
+
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+	adapters = append([]adapter{
+		{"gin", func(h *Handler, opts ...RouterOption) http.Handler { return InitRouter(h, opts...) }},
+	}, adapters...)
+}
+
+func TestRegisterOnEngine(t *testing.T) {
+	_, driver := setupRouter(t)
+	handler := NewHandler(driver)
+
+	// Registered onto an application's own engine, whose routes are kept
+	engine := gin.New()
+	engine.GET("/health", func(c *gin.Context) { c.String(http.StatusOK, "up") })
+	Register(engine.Group("/api"), handler, WithBasePath("/db"), WithRoutes(MetricsRoutes))
+	if w := doRequest(engine, http.MethodGet, "/health", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /health = %d, want 200", w.Code)
+	}
+	if w := doRequest(engine, http.MethodGet, "/api/db/stats", "", ""); w.Code != http.StatusOK || w.Header().Get(RequestIDHeader) == "" {
+		t.Errorf("GET /api/db/stats = %d with request ID %q, want 200 with one", w.Code, w.Header().Get(RequestIDHeader))
+	}
+	if w := doRequest(engine, http.MethodGet, "/api/db/key/a", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /api/db/key/a = %d, want 404", w.Code)
+	}
+	if InitRouter(handler, WithEngine(engine), WithRoutes(AdminRoutes)) != engine {
+		t.Errorf("InitRouter with WithEngine did not return that engine")
+	}
+}
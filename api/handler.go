@@ -1,79 +1,210 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/toblrne/ZephyrusDBv2/db"
-	"github.com/gin-gonic/gin"
+	"github.com/toblrne/ZephyrusDBv2/webhook"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Handler struct {
 	driver *db.Driver
+
+	// MaxWatchers caps concurrent /watch streams; further requests get 503
+	MaxWatchers int
+	// Heartbeat is how often idle /watch streams send a keep-alive comment
+	Heartbeat time.Duration
+	// ScanTimeout bounds how long a request walking the index may run
+	ScanTimeout time.Duration
+	// ReadTimeout bounds GET /key requests, and WriteTimeout PUT and DELETE
+	// ones; 0 leaves them unbounded. See timeout for what a timed out
+	// request leaves behind.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// IdempotencyWindow is how long the response to a PUT or import sent
+	// with an Idempotency-Key is replayed for retries; 0 ignores the header
+	IdempotencyWindow time.Duration
+	// Auth restricts routes to API keys with the right role; nil disables it
+	Auth *Auth
+	// Replication reports a replica's progress under "replication" in
+	// /stats; nil on a primary
+	Replication func() interface{}
+	// TracerProvider, when set, traces every request; pass the same one to
+	// the Driver so its spans join the request's trace
+	TracerProvider trace.TracerProvider
+	// CursorSecret signs the cursors of /keys listings. Servers sharing it
+	// accept each other's cursors; NewHandler picks a random one.
+	CursorSecret []byte
+	// CacheControl sets the Cache-Control header of GET /key responses
+	CacheControl CachePolicy
+	// Webhooks are managed under /admin/webhooks; nil answers those routes
+	// with 404
+	Webhooks *webhook.Dispatcher
+
+	watchers atomic.Int32
+	panics   atomic.Uint64 // requests that panicked, see recovery
+
+	idempotencyLocks idempotencyLocks
+	shutdown         chan struct{}
+	shutdownOnce     sync.Once
 }
 
 func NewHandler(driver *db.Driver) *Handler {
-	return &Handler{driver: driver}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &Handler{
+		driver:            driver,
+		MaxWatchers:       100,
+		Heartbeat:         15 * time.Second,
+		ScanTimeout:       10 * time.Second,
+		IdempotencyWindow: 24 * time.Hour,
+		CursorSecret:      secret,
+		shutdown:          make(chan struct{}),
+	}
+}
+
+// Shutdown ends long-lived /watch and /ws streams so that http.Server's
+// graceful shutdown does not wait on them. Register it with
+// http.Server.RegisterOnShutdown.
+func (h *Handler) Shutdown() {
+	h.shutdownOnce.Do(func() { close(h.shutdown) })
 }
 
-func (h *Handler) PutValue(c *gin.Context) {
-	key := c.Param("key")
+func (h *Handler) PutValue(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
 
-	// Read the content type of the incoming request
-	contentType := c.GetHeader("Content-Type")
+	ttl, err := parseTTLHeader(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidTTL, err.Error())
+		return
+	}
+	rev, etag, err := parsePreconditions(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
 
-	var value []byte
-	var err error
+	// The body is streamed to disk, so read errors surface from PutReader
+	var body io.Reader = &requestBody{r: r.Body}
 
-	// If the content type is JSON, use the JSON binding
-	if contentType == "application/json" {
-		var jsonValue interface{}
-		if err = c.BindJSON(&jsonValue); err == nil {
-			value, err = db.MarshalJson(jsonValue)
-		}
-	} else {
-		// For all other content types, read the body as raw bytes
-		value, err = c.GetRawData()
+	// If the content type is JSON, validate it while it streams through
+	if contentType(r) == "application/json" {
+		pr, pw := io.Pipe()
+		defer pr.Close() // unblocks the validator if PutReader gives up early
+		go func(r io.Reader) {
+			pw.CloseWithError(validateJSON(json.NewDecoder(io.TeeReader(r, pw))))
+		}(body)
+		body = pr
 	}
 
+	var created bool
+	since, unmodified := parseIfUnmodifiedSince(r)
+	switch {
+	case etag != "":
+		created, rev, err = h.driver.PutReaderIfMatch(r.Context(), key, body, ttl, etag)
+	case unmodified:
+		created, rev, err = h.driver.PutReaderIfUnmodifiedSince(r.Context(), key, body, ttl, since)
+	default:
+		created, rev, err = h.driver.PutReaderIfRevision(r.Context(), key, body, ttl, rev)
+	}
+	if errors.Is(err, errInvalidJSON) || errors.As(err, new(*bodyError)) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidValue, "Invalid value")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid value"})
+		writeDriverError(w, r, err)
 		return
 	}
 
-	err = h.driver.Put(key, value)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Tell the client whether the key was created or an existing value replaced
+	setRevisionHeader(w, rev)
+	if created {
+		w.Header().Set("Location", keyLocation(r, key))
+		w.WriteHeader(http.StatusCreated)
 		return
 	}
 
-	c.Status(http.StatusOK)
+	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) GetValue(c *gin.Context) {
-	key := c.Param("key")
-	value, err := h.driver.Get(key)
+func (h *Handler) GetValue(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	value, err := h.driver.GetReaderContext(r.Context(), key)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		writeDriverError(w, r, err)
 		return
 	}
+	defer value.Close()
+	value = withDeadline(r.Context(), value)
 
 	// Respond with the content type that the value is stored in
+	contentType, err := sniffContentType(value, value.Size())
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+
+	// ServeContent streams the value, sets Last-Modified and handles Range
+	// and the conditional headers, If-None-Match taking precedence over
+	// If-Modified-Since as RFC 7232 requires. Cache-Control is kept on 304s.
+	w.Header().Set("Content-Type", contentType)
+	if etag := value.ETag(); etag != "" {
+		w.Header().Set("ETag", quoteETag(etag))
+	}
+	if policy := h.CacheControl.For(key); policy != "" {
+		w.Header().Set("Cache-Control", policy)
+	}
+	setRevisionHeader(w, value.Revision())
+	http.ServeContent(w, r, "", value.ModTime(), value)
+}
+
+// detectContentType guesses the content type of a stored value. JSON is
+// checked first because http.DetectContentType reports it as plain text.
+func detectContentType(value []byte) string {
+	if json.Valid(value) {
+		return "application/json"
+	}
+
 	contentType := http.DetectContentType(value)
-	if contentType == "application/json" {
-		// If the content type is JSON, send it as JSON
-		c.Data(http.StatusOK, contentType, value)
-	} else {
-		// Otherwise, send it as raw data
-		c.Data(http.StatusOK, "application/octet-stream", value)
+	if strings.HasPrefix(contentType, "text/") {
+		return contentType
 	}
+
+	// Otherwise, send it as raw data
+	return "application/octet-stream"
 }
 
-func (h *Handler) DeleteValue(c *gin.Context) {
-	key := c.Param("key")
-	err := h.driver.Delete(key)
+func (h *Handler) DeleteValue(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	rev, etag, err := parsePreconditions(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+		return
+	}
+	since, unmodified := parseIfUnmodifiedSince(r)
+	switch {
+	case etag != "":
+		err = h.driver.DeleteIfMatchContext(r.Context(), key, etag)
+	case rev != db.AnyRevision:
+		err = h.driver.DeleteIfRevisionContext(r.Context(), key, rev)
+	case unmodified:
+		err = h.driver.DeleteIfUnmodifiedSinceContext(r.Context(), key, since)
+	default:
+		err = h.driver.DeleteContext(r.Context(), key)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeDriverError(w, r, err)
 		return
 	}
 
-	c.Status(http.StatusOK)
+	w.WriteHeader(http.StatusOK)
 }
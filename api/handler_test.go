@@ -0,0 +1,2250 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"github.com/toblrne/ZephyrusDBv2/webhook"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// adapter serves the routes in the tests, which TestMain runs once with each
+type adapter struct {
+	name      string
+	newRouter func(*Handler, ...RouterOption) http.Handler
+}
+
+var adapters = []adapter{
+	{"mux", func(h *Handler, opts ...RouterOption) http.Handler { return NewMux(h, opts...) }},
+}
+
+// newRouter is the adapter the tests are running with
+var newRouter func(*Handler, ...RouterOption) http.Handler
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// The fuzzing engine drives a single run of the test binary
+	if f := flag.Lookup("test.fuzz"); f != nil && f.Value.String() != "" {
+		adapters = adapters[:1]
+	}
+	for _, a := range adapters {
+		newRouter = a.newRouter
+		if code := m.Run(); code != 0 {
+			fmt.Fprintf(os.Stderr, "FAIL with the %s adapter\n", a.name)
+			os.Exit(code)
+		}
+	}
+	os.Exit(0)
+}
+
+func setupRouter(t testing.TB) (http.Handler, *db.Driver) {
+	dir, err := os.MkdirTemp("", "api_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	driver, err := db.New(dir, nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+
+	return newRouter(NewHandler(driver)), driver
+}
+
+func doRequest(router http.Handler, method, target, contentType, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestGetContentType(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	tests := []struct {
+		key   string
+		value []byte
+		want  string
+	}{
+		{"json-object", []byte(`{"name":"zephyrus"}`), "application/json"},
+		{"json-array", []byte(` [1, 2, 3]`), "application/json"},
+		{"text", []byte("hello world"), "text/plain; charset=utf-8"},
+		{"binary", []byte{0x00, 0x01, 0xfe, 0xff}, "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		if err := driver.Put(tt.key, tt.value); err != nil {
+			t.Fatalf("Put(%s) failed: %s", tt.key, err)
+		}
+
+		w := doRequest(router, http.MethodGet, "/key/"+tt.key, "", "")
+		if w.Code != http.StatusOK {
+			t.Errorf("GET %s status = %d, want %d", tt.key, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("GET %s Content-Type = %q, want %q", tt.key, got, tt.want)
+		}
+		if got := w.Body.String(); got != string(tt.value) {
+			t.Errorf("GET %s body = %q, want %q", tt.key, got, tt.value)
+		}
+	}
+}
+
+func TestPutCreatedAndUpdated(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	w := doRequest(router, http.MethodPut, "/key/greeting", "text/plain", "hello")
+	if w.Code != http.StatusCreated {
+		t.Errorf("first PUT status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got, want := w.Header().Get("Location"), "/key/greeting"; got != want {
+		t.Errorf("first PUT Location = %q, want %q", got, want)
+	}
+
+	w = doRequest(router, http.MethodPut, "/key/greeting", "text/plain", "hi")
+	if w.Code != http.StatusOK {
+		t.Errorf("second PUT status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestDeleteMissingKey(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	w := doRequest(router, http.MethodDelete, "/key/missing", "", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("DELETE missing status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// patternReader produces an endless stream of bytes without allocating
+type patternReader struct{}
+
+func (patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte('a' + i%26)
+	}
+	return len(p), nil
+}
+
+// discardWriter is a ResponseWriter that counts and drops the body
+type discardWriter struct {
+	header http.Header
+	code   int
+	n      int64
+}
+
+func (w *discardWriter) Header() http.Header  { return w.header }
+func (w *discardWriter) WriteHeader(code int) { w.code = code }
+func (w *discardWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestStreamingLargeValue(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large transfer in short mode")
+	}
+
+	const size = 64 << 20
+	router, _ := setupRouter(t)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	req := httptest.NewRequest(http.MethodPut, "/key/big", io.LimitReader(patternReader{}, size))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+	}
+
+	dw := &discardWriter{header: http.Header{}}
+	router.ServeHTTP(dw, httptest.NewRequest(http.MethodGet, "/key/big", nil))
+	if dw.code != http.StatusOK || dw.n != size {
+		t.Fatalf("GET status = %d with %d bytes, want %d with %d bytes", dw.code, dw.n, http.StatusOK, size)
+	}
+
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4<<20 {
+		t.Errorf("transferring %d bytes allocated %d bytes, want under %d", size, alloc, 4<<20)
+	}
+
+	// Range requests come for free with ServeContent
+	req = httptest.NewRequest(http.MethodGet, "/key/big", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "abcdefghij" {
+		t.Errorf("ranged GET = %d %q, want %d %q", w.Code, w.Body.String(), http.StatusPartialContent, "abcdefghij")
+	}
+}
+
+func TestPutInvalidJSON(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	for _, body := range []string{``, `{"a":`, `{"a":1} trailing`, `[1,]`} {
+		w := doRequest(router, http.MethodPut, "/key/doc", "application/json", body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %q status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Nothing was stored by the rejected requests
+	if _, err := driver.Get("doc"); err == nil {
+		t.Errorf("Get(doc) succeeded after invalid PUTs")
+	}
+
+	w := doRequest(router, http.MethodPut, "/key/doc", "application/json; charset=utf-8", `{"a": [1, 2]}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("PUT valid JSON status = %d, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestMultiGet(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	driver.Put("doc", []byte(`{"n":1}`))
+	driver.Put("bin", []byte{0xff, 0x00})
+
+	check := func(w *httptest.ResponseRecorder) {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		want := `{"missing":["nope"],"values":{"bin":{"encoding":"base64","value":"/wA="},"doc":{"encoding":"json","value":{"n":1}}}}`
+		if got := w.Body.String(); got != want {
+			t.Errorf("body = %s, want %s", got, want)
+		}
+	}
+
+	check(doRequest(router, http.MethodGet, "/keys/multi?keys=doc,bin,nope", "", ""))
+	check(doRequest(router, http.MethodPost, "/mget", "application/json", `["doc","bin","nope"]`))
+
+	tooMany := strings.Repeat("k,", maxBatchKeys) + "k"
+	if w := doRequest(router, http.MethodGet, "/keys/multi?keys="+tooMany, "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("too many keys status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTTLEndpoints(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/key/session", strings.NewReader("token"))
+	req.Header.Set(TTLHeader, "3600")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT with TTL status = %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	w = doRequest(router, http.MethodGet, "/key/session/ttl", "", "")
+	if w.Code != http.StatusOK || w.Body.String() != `{"ttl_seconds":3600}` {
+		t.Errorf("GET ttl = %d %s, want 200 {\"ttl_seconds\":3600}", w.Code, w.Body.String())
+	}
+
+	w = doRequest(router, http.MethodPost, "/key/session/expire", "application/json", `{"ttl_seconds": 0}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("POST expire status = %d, want %d", w.Code, http.StatusOK)
+	}
+	w = doRequest(router, http.MethodGet, "/key/session/ttl", "", "")
+	if w.Body.String() != `{"ttl_seconds":-1}` {
+		t.Errorf("GET ttl after clearing = %s, want {\"ttl_seconds\":-1}", w.Body.String())
+	}
+
+	for _, body := range []string{`{"ttl_seconds": -5}`, `{"ttl_seconds": "soon"}`, `{}`} {
+		if w := doRequest(router, http.MethodPost, "/key/session/expire", "application/json", body); w.Code != http.StatusBadRequest {
+			t.Errorf("POST expire %s status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPut, "/key/session", strings.NewReader("token"))
+	req.Header.Set(TTLHeader, "abc")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with invalid TTL status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if w := doRequest(router, http.MethodPost, "/key/missing/expire", "application/json", `{"ttl_seconds": 10}`); w.Code != http.StatusNotFound {
+		t.Errorf("POST expire on missing key status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestListPushPop(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	w := doRequest(router, http.MethodPost, "/key/queue/push", "application/json", `{"job": 1}`)
+	if w.Code != http.StatusOK || w.Body.String() != `{"length":1}` {
+		t.Errorf("POST push = %d %s, want 200 {\"length\":1}", w.Code, w.Body)
+	}
+	doRequest(router, http.MethodPost, "/key/queue/push", "application/json", `2`)
+	if w := doRequest(router, http.MethodPost, "/key/queue/push?front=true", "application/json", `"first"`); w.Body.String() != `{"length":3}` {
+		t.Errorf("POST push?front=true = %s, want {\"length\":3}", w.Body)
+	}
+
+	w = doRequest(router, http.MethodPost, "/key/queue/pop?front=true", "", "")
+	if w.Code != http.StatusOK || w.Body.String() != `"first"` || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("POST pop?front=true = %d %s, want 200 \"first\"", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPost, "/key64/"+encodeKey64("queue")+"/pop", "", ""); w.Body.String() != "2" {
+		t.Errorf("POST /key64 pop = %d %s, want 2", w.Code, w.Body)
+	}
+	doRequest(router, http.MethodPost, "/key/queue/pop", "", "")
+
+	tests := []struct {
+		target, body, code string
+		want               int
+	}{
+		{"/key/queue/pop", "", CodeListEmpty, http.StatusConflict},
+		{"/key/missing/pop", "", CodeKeyNotFound, http.StatusNotFound},
+		{"/key/queue/push", "not json", CodeInvalidValue, http.StatusBadRequest},
+		{"/key/text/push", "1", CodeNotList, http.StatusUnprocessableEntity},
+		{"/key/text/pop", "", CodeNotList, http.StatusUnprocessableEntity},
+	}
+	doRequest(router, http.MethodPut, "/key/text", "text/plain", "hello")
+	for _, tt := range tests {
+		w := doRequest(router, http.MethodPost, tt.target, "application/json", tt.body)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+			t.Errorf("POST %s %q = %d %s, want %d %s", tt.target, tt.body, w.Code, w.Body, tt.want, tt.code)
+		}
+	}
+}
+
+func TestSetOps(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	for _, tt := range []struct{ body, want string }{
+		{`"a"`, `{"added":true}`},
+		{`{"id": 1}`, `{"added":true}`},
+		{`"a"`, `{"added":false}`},
+	} {
+		if w := doRequest(router, http.MethodPost, "/key/members/add", "application/json", tt.body); w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("POST add %s = %d %s, want 200 %s", tt.body, w.Code, w.Body, tt.want)
+		}
+	}
+	if w := doRequest(router, http.MethodGet, "/key/members/contains?member="+url.QueryEscape(`{"id":1}`), "", ""); w.Body.String() != `{"contains":true}` {
+		t.Errorf("GET contains = %d %s, want {\"contains\":true}", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPost, "/key/members/remove", "application/json", `"a"`); w.Body.String() != `{"removed":true}` {
+		t.Errorf("POST remove = %d %s, want {\"removed\":true}", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodGet, "/key64/"+encodeKey64("members")+"/contains?member=%22a%22", "", ""); w.Body.String() != `{"contains":false}` {
+		t.Errorf("GET /key64 contains after removing = %d %s, want {\"contains\":false}", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodGet, "/key/members", "", ""); w.Body.String() != `[{"id":1}]` {
+		t.Errorf("GET members = %s, want [{\"id\":1}]", w.Body)
+	}
+
+	doRequest(router, http.MethodPut, "/key/text", "text/plain", "hello")
+	for _, tt := range []struct {
+		method, target, body string
+		want                 int
+	}{
+		{http.MethodPost, "/key/text/add", `1`, http.StatusUnprocessableEntity},
+		{http.MethodPost, "/key/members/add", `not json`, http.StatusBadRequest},
+		{http.MethodGet, "/key/members/contains", "", http.StatusBadRequest},
+	} {
+		if w := doRequest(router, tt.method, tt.target, "application/json", tt.body); w.Code != tt.want {
+			t.Errorf("%s %s %q = %d %s, want %d", tt.method, tt.target, tt.body, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestFieldOps(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	if w := doRequest(router, http.MethodPut, "/key/user/field/name", "application/json", `"Ada"`); w.Code != http.StatusCreated {
+		t.Errorf("PUT a new field = %d %s, want 201", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPut, "/key/user/field/name", "application/json", `"Grace"`); w.Code != http.StatusOK {
+		t.Errorf("PUT an existing field = %d %s, want 200", w.Code, w.Body)
+	}
+	doRequest(router, http.MethodPut, "/key64/"+encodeKey64("user")+"/field/age", "application/json", `36`)
+	w := doRequest(router, http.MethodGet, "/key/user/field/name", "", "")
+	if w.Code != http.StatusOK || w.Body.String() != `"Grace"` || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("GET field = %d %s, want 200 \"Grace\"", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodGet, "/key/user", "", ""); w.Body.String() != `{"name":"Grace","age":36}` {
+		t.Errorf("GET user = %s, want {\"name\":\"Grace\",\"age\":36}", w.Body)
+	}
+
+	if w := doRequest(router, http.MethodDelete, "/key/user/field/name", "", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE field = %d %s, want 204", w.Code, w.Body)
+	}
+	doRequest(router, http.MethodDelete, "/key/user/field/age", "", "")
+	if w := doRequest(router, http.MethodGet, "/key/user", "", ""); w.Code != http.StatusOK || w.Body.String() != "{}" {
+		t.Errorf("GET user after deleting every field = %d %s, want 200 {}", w.Code, w.Body)
+	}
+
+	doRequest(router, http.MethodPut, "/key/list", "application/json", `[1, 2]`)
+	tests := []struct {
+		method, target, body, code string
+		want                       int
+	}{
+		{http.MethodGet, "/key/user/field/name", "", CodeFieldNotFound, http.StatusNotFound},
+		{http.MethodDelete, "/key/user/field/name", "", CodeFieldNotFound, http.StatusNotFound},
+		{http.MethodGet, "/key/missing/field/name", "", CodeKeyNotFound, http.StatusNotFound},
+		{http.MethodPut, "/key/list/field/name", `1`, CodeNotObject, http.StatusUnprocessableEntity},
+		{http.MethodGet, "/key/list/field/name", "", CodeNotObject, http.StatusUnprocessableEntity},
+		{http.MethodPut, "/key/user/field/name", `not json`, CodeInvalidValue, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := doRequest(router, tt.method, tt.target, "application/json", tt.body)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+			t.Errorf("%s %s %q = %d %s, want %d %s", tt.method, tt.target, tt.body, w.Code, w.Body, tt.want, tt.code)
+		}
+	}
+}
+
+func TestLocks(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	w := doRequest(router, http.MethodPost, "/locks/jobs", "application/json", `{"ttl_seconds": 60}`)
+	var acquired struct {
+		Token      string `json:"token"`
+		TTLSeconds int64  `json:"ttl_seconds"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &acquired)
+	if w.Code != http.StatusCreated || acquired.Token == "" || acquired.TTLSeconds != 60 {
+		t.Fatalf("POST /locks/jobs = %d %s, want 201 with a token", w.Code, w.Body)
+	}
+
+	w = doRequest(router, http.MethodPost, "/locks/jobs", "application/json", `{"ttl_seconds": 60}`)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"code":"LOCK_HELD"`) ||
+		!strings.Contains(w.Body.String(), `"ttl_seconds":60`) || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("POST /locks/jobs while held = %d %s (Retry-After %q), want 409 LOCK_HELD with 60 seconds left",
+			w.Code, w.Body, w.Header().Get("Retry-After"))
+	}
+
+	stale := `{"token": "stale", "ttl_seconds": 60}`
+	for _, target := range []string{"/locks/jobs/renew", "/locks/jobs/release"} {
+		if w := doRequest(router, http.MethodPost, target, "application/json", stale); w.Code != http.StatusConflict ||
+			!strings.Contains(w.Body.String(), `"code":"LOCK_NOT_HELD"`) {
+			t.Errorf("POST %s with the wrong token = %d %s, want 409 LOCK_NOT_HELD", target, w.Code, w.Body)
+		}
+	}
+	body := `{"token": "` + acquired.Token + `", "ttl_seconds": 120}`
+	if w := doRequest(router, http.MethodPost, "/locks/jobs/renew", "application/json", body); w.Code != http.StatusNoContent {
+		t.Errorf("POST /locks/jobs/renew = %d %s, want 204", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPost, "/locks/jobs/release", "application/json", body); w.Code != http.StatusNoContent {
+		t.Errorf("POST /locks/jobs/release = %d %s, want 204", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPost, "/locks/jobs", "application/json", `{"ttl_seconds": 60}`); w.Code != http.StatusCreated {
+		t.Errorf("POST /locks/jobs after releasing = %d %s, want 201", w.Code, w.Body)
+	}
+
+	// The lock keys cannot be written around the token checks, nor their
+	// tokens read
+	if w := doRequest(router, http.MethodDelete, "/key/"+db.LockNamespace+":jobs", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("DELETE of a lock key = %d, want 400", w.Code)
+	}
+	for _, tt := range []struct{ method, target, body string }{
+		{http.MethodPost, "/mget", `["` + db.LockNamespace + `:jobs"]`},
+		{http.MethodGet, "/keys/multi?keys=" + db.LockNamespace + ":jobs", ""},
+		{http.MethodGet, "/keys", ""},
+		{http.MethodGet, "/count", ""},
+		{http.MethodGet, "/export", ""},
+	} {
+		w := doRequest(router, tt.method, tt.target, "application/json", tt.body)
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "token") || strings.Contains(w.Body.String(), `"count":1`) {
+			t.Errorf("%s %s = %d %s, want the lock and its token left out", tt.method, tt.target, w.Code, w.Body)
+		}
+	}
+
+	// Nor planted by an import, with a token of the importer's choosing
+	w = doRequest(router, http.MethodPost, "/import?mode=overwrite", "", `{"key":"`+db.LockNamespace+`:forged","value":{"token":"mine"}}`)
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), `{"imported":0,"skipped":0,"failed":1,`) {
+		t.Errorf("POST /import of a lock key = %d %s, want it failed", w.Code, w.Body)
+	}
+	if err := driver.ReleaseLock("forged", "mine"); !errors.Is(err, db.ErrLockNotHeld) {
+		t.Errorf("ReleaseLock with the imported token = %v, want ErrLockNotHeld", err)
+	}
+
+	for _, tt := range []struct{ target, body string }{
+		{"/locks/jobs", `{"ttl_seconds": 0}`},
+		{"/locks/jobs", `{}`},
+		{"/locks/jobs/renew", `{"ttl_seconds": 60}`},
+		{"/locks/jobs/release", `{}`},
+		{"/locks/a%20b", `{"ttl_seconds": 60}`},
+	} {
+		if w := doRequest(router, http.MethodPost, tt.target, "application/json", tt.body); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s %s = %d %s, want 400", tt.target, tt.body, w.Code, w.Body)
+		}
+	}
+}
+
+func TestExpiring(t *testing.T) {
+	router, driver := setupRouter(t)
+	driver.Put("forever", []byte("x"))
+	driver.PutWithTTL("soon", []byte("x"), 30*time.Second)
+	driver.PutWithTTL("sooner", []byte("x"), 10*time.Second)
+	driver.PutWithTTL("later", []byte("x"), 2*time.Hour)
+
+	w := doRequest(router, http.MethodGet, "/expiring?within=1h", "", "")
+	want := `{"keys":[{"key":"sooner","key_b64":"c29vbmVy","ttl_seconds":10},{"key":"soon","key_b64":"c29vbg","ttl_seconds":30}]}`
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("GET /expiring?within=1h = %d %s, want 200 %s", w.Code, w.Body, want)
+	}
+	w = doRequest(router, http.MethodGet, "/expiring?within=3h&limit=1", "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"sooner"`) || strings.Contains(w.Body.String(), `"soon"`) {
+		t.Errorf("GET /expiring with limit=1 = %d %s, want only sooner", w.Code, w.Body)
+	}
+
+	// Removing an expiry takes the key off the list
+	driver.Expire("sooner", 0)
+	w = doRequest(router, http.MethodGet, "/expiring?within=1h", "", "")
+	if !strings.Contains(w.Body.String(), `"soon"`) || strings.Contains(w.Body.String(), `"sooner"`) {
+		t.Errorf("GET /expiring after removing an expiry = %s, want only soon", w.Body)
+	}
+
+	for _, target := range []string{"/expiring", "/expiring?within=soon", "/expiring?within=-1h", "/expiring?within=1h&limit=0", "/expiring?within=1h&limit=5000"} {
+		if w := doRequest(router, http.MethodGet, target, "", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDefaultTTLHeader(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), &db.Options{DefaultTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	router := newRouter(NewHandler(driver))
+
+	doRequest(router, http.MethodPut, "/key/cached", "text/plain", "v")
+	if ttl, _ := driver.TTL("cached"); ttl <= 0 {
+		t.Errorf("TTL of a PUT without %s = %s, want the default", TTLHeader, ttl)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/key/kept", strings.NewReader("v"))
+	req.Header.Set(TTLHeader, "0")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if ttl, _ := driver.TTL("kept"); ttl != db.NoTTL {
+		t.Errorf("TTL of a PUT with %s: 0 = %s, want none", TTLHeader, ttl)
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), &db.Options{MaxKeys: 1})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	router := newRouter(NewHandler(driver))
+
+	// The response kept for the Idempotency-Key is not a key of its own
+	if w := doIdempotent(router, http.MethodPut, "/key/a", "k1", "1"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT of the first key = %d: %s", w.Code, w.Body)
+	}
+	w := doRequest(router, http.MethodPut, "/key/b", "text/plain", "2")
+	var body struct {
+		Error errorBody `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusInsufficientStorage || body.Error.Code != CodeTooManyKeys {
+		t.Errorf("PUT over the limit = %d %s, want 507 %s", w.Code, w.Body, CodeTooManyKeys)
+	}
+
+	w = doRequest(router, http.MethodGet, "/readyz", "", "")
+	var ready struct {
+		Keys    int `json:"keys"`
+		MaxKeys int `json:"max_keys"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &ready)
+	if w.Code != http.StatusOK || ready.Keys != 1 || ready.MaxKeys != 1 {
+		t.Errorf("GET /readyz = %d %s, want 200 with 1 of 1 keys", w.Code, w.Body)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	router := newRouter(NewHandler(driver))
+
+	driver.PutWithLabels("a", []byte("1"), map[string]string{"env": "prod", "owner": "team-x"})
+	driver.PutWithLabels("b", []byte("2"), map[string]string{"env": "prod"})
+	driver.PutWithLabels("c", []byte("3"), map[string]string{"env": "dev"})
+
+	list := func(query string) (int, []string, string) {
+		w := doRequest(router, http.MethodGet, "/keys?"+query, "", "")
+		var body struct {
+			Keys []listedKey `json:"keys"`
+			Next string      `json:"next"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		var keys []string
+		for _, k := range body.Keys {
+			keys = append(keys, k.Key)
+		}
+		return w.Code, keys, body.Next
+	}
+	if code, keys, _ := list("label=env%3Dprod"); code != http.StatusOK || !slices.Equal(keys, []string{"a", "b"}) {
+		t.Errorf("GET /keys?label=env=prod = %d %v, want [a b]", code, keys)
+	}
+	if _, keys, _ := list("label=env%3Dprod,owner%3Dteam-x"); !slices.Equal(keys, []string{"a"}) {
+		t.Errorf("GET /keys with two labels = %v, want [a]", keys)
+	}
+	if _, keys, _ := list("label=env%3Dprod&order=desc"); !slices.Equal(keys, []string{"b", "a"}) {
+		t.Errorf("GET /keys with a label in descending order = %v, want [b a]", keys)
+	}
+	_, keys, next := list("label=env%3Dprod&limit=1")
+	if _, more, _ := list("label=env%3Dprod&limit=1&cursor=" + next); !slices.Equal(keys, []string{"a"}) || !slices.Equal(more, []string{"b"}) {
+		t.Errorf("GET /keys with a label in pages of 1 = %v then %v, want [a] then [b]", keys, more)
+	}
+	if code, _, _ := list("label=env"); code != http.StatusBadRequest {
+		t.Errorf("GET /keys with a label without a value = %d, want 400", code)
+	}
+
+	w := doRequest(router, http.MethodGet, "/key/a/meta", "", "")
+	var meta keyMeta
+	json.Unmarshal(w.Body.Bytes(), &meta)
+	if meta.Labels["env"] != "prod" || meta.Labels["owner"] != "team-x" {
+		t.Errorf("labels in GET /key/a/meta = %v, want env=prod and owner=team-x", meta.Labels)
+	}
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	handler := NewHandler(driver)
+	router := newRouter(handler)
+	if w := doRequest(router, http.MethodGet, "/admin/webhooks", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/webhooks without a dispatcher = %d, want 404", w.Code)
+	}
+
+	if handler.Webhooks, err = webhook.New(driver, 16); err != nil {
+		t.Fatalf("webhook.New failed: %s", err)
+	}
+	w := doRequest(router, http.MethodPost, "/admin/webhooks", "application/json", `{"url": "https://example.com/hook", "prefixes": ["users:"]}`)
+	var added webhook.Webhook
+	json.Unmarshal(w.Body.Bytes(), &added)
+	if w.Code != http.StatusCreated || added.ID == "" || added.Secret == "" {
+		t.Fatalf("POST /admin/webhooks = %d %s, want 201 with an ID and a secret", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPost, "/admin/webhooks", "application/json", `{"url": "not a url"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /admin/webhooks with a bad URL = %d, want 400", w.Code)
+	}
+
+	w = doRequest(router, http.MethodGet, "/admin/webhooks", "", "")
+	var list struct {
+		Webhooks []webhook.Info `json:"webhooks"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Webhooks) != 1 || list.Webhooks[0].ID != added.ID || list.Webhooks[0].Secret != "" {
+		t.Errorf("GET /admin/webhooks = %s, want the webhook without its secret", w.Body)
+	}
+
+	if w := doRequest(router, http.MethodDelete, "/admin/webhooks?id="+added.ID, "", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE /admin/webhooks = %d, want 204", w.Code)
+	}
+	if w := doRequest(router, http.MethodDelete, "/admin/webhooks?id="+added.ID, "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE /admin/webhooks of a removed webhook = %d, want 404", w.Code)
+	}
+}
+
+func TestSnapshotRoutes(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	router := newRouter(NewHandler(driver))
+	driver.Put("a", []byte("1"))
+	snap, err := driver.ArchiveSnapshot()
+	if err != nil {
+		t.Fatalf("ArchiveSnapshot failed: %s", err)
+	}
+
+	w := doRequest(router, http.MethodGet, "/admin/snapshots", "", "")
+	var list struct {
+		Snapshots []db.SnapshotFile `json:"snapshots"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != http.StatusOK || len(list.Snapshots) != 1 || list.Snapshots[0].Name != snap.Name || list.Snapshots[0].Items != 1 {
+		t.Errorf("GET /admin/snapshots = %d %s, want %s with 1 key", w.Code, w.Body, snap.Name)
+	}
+
+	restore := "/admin/snapshots/" + snap.Name + "/restore"
+	if w := doRequest(router, http.MethodPost, restore, "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("POST %s without confirm = %d, want 400", restore, w.Code)
+	}
+	if w := doRequest(router, http.MethodPost, restore+"?confirm=true", "", ""); w.Code != http.StatusOK {
+		t.Errorf("POST %s = %d %s, want 200", restore, w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPost, "/admin/snapshots/btree-20000101T000000.snapshot/restore?confirm=true", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("restoring a missing snapshot = %d, want 404", w.Code)
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	handler := NewHandler(driver)
+	handler.CacheControl = CachePolicy{
+		Default:  "no-cache",
+		Prefixes: map[string]string{"blob:": "public, max-age=60", "blob:sha256:": "public, max-age=31536000, immutable"},
+	}
+	router := newRouter(handler)
+
+	driver.Put("plain", []byte("v"))
+	driver.Put("blob:sha256:ab", []byte("v"))
+	driver.Put("blob:other", []byte("v"))
+
+	w := doRequest(router, http.MethodGet, "/key/plain", "", "")
+	lastModified, etag := w.Header().Get("Last-Modified"), w.Header().Get("ETag")
+	if modified, err := http.ParseTime(lastModified); err != nil || time.Since(modified) > time.Minute {
+		t.Errorf("Last-Modified = %q, %v, want the time of the write", lastModified, err)
+	}
+	for key, want := range map[string]string{
+		"plain":          "no-cache",
+		"blob:other":     "public, max-age=60",
+		"blob:sha256:ab": "public, max-age=31536000, immutable",
+	} {
+		if got := doRequest(router, http.MethodGet, "/key/"+key, "", "").Header().Get("Cache-Control"); got != want {
+			t.Errorf("Cache-Control of %s = %q, want %q", key, got, want)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   int
+	}{
+		{"not modified since", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}, http.StatusOK},
+		{"etag matches", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		// If-None-Match is evaluated instead of If-Modified-Since
+		{"etag differs, not modified since", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}, http.StatusOK},
+		{"etag matches, modified since", map[string]string{"If-None-Match": etag, "If-Modified-Since": time.Unix(0, 0).UTC().Format(http.TimeFormat)}, http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/key/plain", nil)
+		for name, value := range tt.header {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-cache" {
+			t.Errorf("%s: Cache-Control = %q, want it on every response", tt.name, got)
+		}
+	}
+}
+
+func TestRouterOptions(t *testing.T) {
+	_, driver := setupRouter(t)
+	handler := NewHandler(driver)
+	tagged := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Company", "yes")
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	router := newRouter(handler, WithBasePath("/db/"), WithMiddleware(tagged), WithRoutes(DataRoutes))
+	w := doRequest(router, http.MethodPut, "/db/key/a", "text/plain", "1")
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/db/key/a" || w.Header().Get("X-Company") != "yes" {
+		t.Errorf("PUT /db/key/a = %d, Location %q, X-Company %q", w.Code, w.Header().Get("Location"), w.Header().Get("X-Company"))
+	}
+	if w := doRequest(router, http.MethodPut, "/db/key64/Yg", "text/plain", "2"); w.Header().Get("Location") != "/db/key64/Yg" {
+		t.Errorf("PUT /db/key64/Yg Location = %q", w.Header().Get("Location"))
+	}
+	for path, want := range map[string]int{
+		"/key/a":           http.StatusNotFound,
+		"/db/stats":        http.StatusNotFound,
+		"/db/key/a/b":      http.StatusBadRequest,
+		"/db/readyz":       http.StatusNotFound,
+		"/db/key/a":        http.StatusOK,
+		"/db/keys":         http.StatusOK,
+		"/db/admin/quotas": http.StatusNotFound,
+	} {
+		if w := doRequest(router, http.MethodGet, path, "", ""); w.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+func TestWatchStream(t *testing.T) {
+	router, driver := setupRouter(t)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/watch?prefix=user:&values=true", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /watch failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	driver.Put("other", []byte("x"))
+	driver.Put("user:1", []byte(`{"name":"alice"}`))
+
+	scanner := bufio.NewScanner(resp.Body)
+	var lines []string
+	for scanner.Scan() && len(lines) < 2 {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 2 || lines[0] != "event: put" || !strings.Contains(lines[1], `"key":"user:1"`) || !strings.Contains(lines[1], `"value":{"name":"alice"}`) {
+		t.Errorf("unexpected event lines: %q", lines)
+	}
+
+	// An expired key removed by its next write shows up as an expiry
+	driver.PutWithTTL("user:2", []byte("x"), time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	driver.Put("user:2", []byte("y"))
+	lines = nil
+	for scanner.Scan() && len(lines) < 4 {
+		if line := scanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 4 || lines[2] != "event: expire" || !strings.Contains(lines[3], `"key":"user:2"`) || !strings.Contains(lines[3], `"expires_at":`) {
+		t.Errorf("unexpected expire event lines: %q", lines)
+	}
+}
+
+func TestWatchLimit(t *testing.T) {
+	router, driver := setupRouter(t)
+	handler := NewHandler(driver)
+	handler.MaxWatchers = 0
+	router = newRouter(handler)
+
+	if w := doRequest(router, http.MethodGet, "/watch", "", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("GET /watch over the limit status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestWebSocketSubscribe(t *testing.T) {
+	_, driver := setupRouter(t)
+	handler := NewHandler(driver)
+	srv := httptest.NewServer(newRouter(handler))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	read := func() wsMessage {
+		t.Helper()
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("ReadJSON failed: %s", err)
+		}
+		return msg
+	}
+
+	conn.WriteJSON(wsRequest{Action: "subscribe", Prefix: "user:"})
+	if msg := read(); msg.Type != "subscribed" || msg.Prefix != "user:" {
+		t.Fatalf("got %+v, want subscribed to user:", msg)
+	}
+
+	driver.Put("other", []byte("x"))
+	driver.Put("user:1", []byte("alice"))
+	if msg := read(); msg.Type != "event" || msg.Event == nil || msg.Event.Key != "user:1" || msg.Event.Op != db.OpPut {
+		t.Fatalf("got %+v, want put event for user:1", msg)
+	}
+
+	conn.WriteJSON(wsRequest{Action: "unsubscribe", Prefix: "user:"})
+	if msg := read(); msg.Type != "unsubscribed" {
+		t.Fatalf("got %+v, want unsubscribed", msg)
+	}
+
+	// Graceful shutdown closes the connection with "going away"
+	handler.Shutdown()
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("ReadMessage after Shutdown error = %v, want close 1001", err)
+	}
+}
+
+func TestImportEndpoint(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("{\"key\":\"a\",\"value\":1}\n{\"key\":\"b\",\"value\":2}\nbroken\n"))
+	gz.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/import?mode=overwrite", &buf)
+	req.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /import status = %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Body.String(), `{"imported":2,"skipped":0,"failed":1,`) {
+		t.Errorf("POST /import body = %s", w.Body.String())
+	}
+	if v, _ := driver.Get("b"); string(v) != "2" {
+		t.Errorf("Get(b) = %q, want 2", v)
+	}
+
+	if w := doRequest(router, http.MethodPost, "/import?mode=merge", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /import with bad mode status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAuthRoles(t *testing.T) {
+	_, driver := setupRouter(t)
+	handler := NewHandler(driver)
+	handler.Auth = NewAuth(map[string]Role{"reader": RoleRead, "writer": RoleWrite})
+	router := newRouter(handler)
+
+	tests := []struct {
+		method, target, key string
+		want                int
+	}{
+		{http.MethodGet, "/key/a", "", http.StatusUnauthorized},
+		{http.MethodGet, "/key/a", "wrong", http.StatusUnauthorized},
+		{http.MethodPut, "/key/a", "reader", http.StatusForbidden},
+		{http.MethodPut, "/key/a", "writer", http.StatusCreated},
+		{http.MethodGet, "/key/a", "reader", http.StatusOK},
+		{http.MethodPost, "/import", "reader", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader("v"))
+		if tt.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s with key %q status = %d, want %d", tt.method, tt.target, tt.key, w.Code, tt.want)
+		}
+	}
+}
+
+func TestScopedAPIKeys(t *testing.T) {
+	_, driver := setupRouter(t)
+	for _, key := range []string{"billing:1", "billing:2", "ops:1", "shared:billing:x", "shared:ops:y"} {
+		driver.Put(key, []byte(`"v"`))
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	os.WriteFile(path, []byte(`[
+		{"key": "root", "role": "admin"},
+		{"key": "team", "role": "write", "namespaces": ["billing"], "prefixes": ["shared:billing:"]}
+	]`), 0600)
+	auth, err := LoadAuthFile(path)
+	if err != nil {
+		t.Fatalf("LoadAuthFile failed: %s", err)
+	}
+	handler := NewHandler(driver)
+	handler.Auth = auth
+	router := newRouter(handler)
+	do := func(method, target, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		method, target, key string
+		want                int
+	}{
+		{http.MethodGet, "/key/billing:1", "team", http.StatusOK},
+		{http.MethodPut, "/key/shared:billing:z", "team", http.StatusCreated},
+		{http.MethodGet, "/key/ops:1", "team", http.StatusForbidden},
+		{http.MethodDelete, "/key/ops:1", "team", http.StatusForbidden},
+		{http.MethodGet, "/key64/" + encodeKey64("ops:1"), "team", http.StatusForbidden},
+		{http.MethodGet, "/keys/multi?keys=billing:1,ops:1", "team", http.StatusForbidden},
+		{http.MethodGet, "/watch?prefix=shared:", "team", http.StatusForbidden},
+		{http.MethodGet, "/changes", "team", http.StatusForbidden},
+		{http.MethodGet, "/expiring?within=1h", "team", http.StatusForbidden},
+		{http.MethodPost, "/locks/ops:jobs", "team", http.StatusForbidden},
+		{http.MethodGet, "/stats", "team", http.StatusForbidden},
+		{http.MethodGet, "/admin/quotas", "team", http.StatusForbidden},
+		{http.MethodGet, "/admin/quotas", "root", http.StatusOK},
+		{http.MethodGet, "/key/ops:1", "root", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := do(tt.method, tt.target, tt.key, "v"); w.Code != tt.want {
+			t.Errorf("%s %s with key %q status = %d, want %d", tt.method, tt.target, tt.key, w.Code, tt.want)
+		}
+	}
+
+	// Listings, counts and exports are confined to the key's prefixes
+	listed := func(target string) []string {
+		var resp struct {
+			Keys []listedKey `json:"keys"`
+			Next string      `json:"next"`
+		}
+		json.Unmarshal(do(http.MethodGet, target, "team", "").Body.Bytes(), &resp)
+		var keys []string
+		for _, k := range resp.Keys {
+			keys = append(keys, k.Key)
+		}
+		return keys
+	}
+	if got := strings.Join(listed("/keys"), ","); got != "billing:1,billing:2,shared:billing:x,shared:billing:z" {
+		t.Errorf("GET /keys = %s, want the key's own prefixes", got)
+	}
+	if got := strings.Join(listed("/keys?order=desc&limit=3"), ","); got != "shared:billing:z,shared:billing:x,billing:2" {
+		t.Errorf("GET /keys?order=desc = %s", got)
+	}
+	if got := listed("/keys?prefix=ops:"); len(got) != 0 {
+		t.Errorf("GET /keys?prefix=ops: = %v, want none", got)
+	}
+	if w := do(http.MethodGet, "/count?prefix=shared:", "team", ""); !strings.Contains(w.Body.String(), `"count":2`) {
+		t.Errorf("GET /count?prefix=shared: = %s, want 2", w.Body)
+	}
+	if w := do(http.MethodGet, "/export", "team", ""); strings.Contains(w.Body.String(), "ops:") || !strings.Contains(w.Body.String(), `"count":4`) {
+		t.Errorf("GET /export = %s, want the 4 keys in scope", w.Body)
+	}
+	w := do(http.MethodPost, "/import", "team", `{"key":"billing:3","value":"x"}`+"\n"+`{"key":"ops:2","value":"x"}`)
+	if !strings.Contains(w.Body.String(), `"imported":1`) || !strings.Contains(w.Body.String(), `"failed":1`) {
+		t.Errorf("POST /import = %s, want the key outside the scope to fail", w.Body)
+	}
+
+	// Edits to the file are picked up, and a broken file keeps the old keys
+	os.WriteFile(path, []byte(`[{"key": "team", "role": "read", "namespaces": ["ops"]}]`), 0600)
+	if err := auth.Reload(); err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+	if w := do(http.MethodGet, "/key/ops:1", "team", ""); w.Code != http.StatusOK {
+		t.Errorf("GET in the new scope after a reload = %d, want 200", w.Code)
+	}
+	if w := do(http.MethodGet, "/key/ops:1", "root", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET with a key removed from the file = %d, want 401", w.Code)
+	}
+	os.WriteFile(path, []byte(`[{"key": "team", "role": "owner"}]`), 0600)
+	if err := auth.Reload(); err == nil {
+		t.Error("Reload of an invalid file succeeded")
+	}
+	if w := do(http.MethodGet, "/key/ops:1", "team", ""); w.Code != http.StatusOK {
+		t.Errorf("GET after a failed reload = %d, want the previous keys kept", w.Code)
+	}
+
+	// Other protocols do not confine keys, so they refuse scoped ones
+	if _, ok := auth.Role("team"); ok {
+		t.Error("Role accepted a scoped key")
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	router, driver := setupRouter(t)
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("2"))
+
+	w := doRequest(router, http.MethodGet, "/export?gzip=true", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /export status = %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", got)
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("response is not gzip: %s", err)
+	}
+	body, _ := io.ReadAll(gz)
+	body = regexp.MustCompile(`,"created_at":"[^"]+","updated_at":"[^"]+"`).ReplaceAll(body, nil)
+	want := "{\"key\":\"a\",\"value\":1}\n{\"key\":\"b\",\"value\":2}\n{\"summary\":{\"count\":2}}\n"
+	if string(body) != want {
+		t.Errorf("export body = %q, want %q", body, want)
+	}
+}
+
+func TestGetMeta(t *testing.T) {
+	router, driver := setupRouter(t)
+	driver.PutWithTTL("doc", []byte(`{"a":1}`), time.Hour)
+
+	w := doRequest(router, http.MethodGet, "/key/doc/meta", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET meta status = %d", w.Code)
+	}
+
+	var meta keyMeta
+	if err := json.Unmarshal(w.Body.Bytes(), &meta); err != nil {
+		t.Fatalf("invalid meta body %s: %s", w.Body.String(), err)
+	}
+	if meta.Size != 7 || meta.TTLSeconds != 3600 || !meta.Cached || meta.LastModified == nil || meta.ETag == "" {
+		t.Errorf("unexpected meta %+v", meta)
+	}
+
+	// The ETag matches the one sent with the value and enables 304s
+	w = doRequest(router, http.MethodGet, "/key/doc", "", "")
+	if got := w.Header().Get("ETag"); got != meta.ETag {
+		t.Errorf("GET ETag = %q, meta ETag = %q", got, meta.ETag)
+	}
+	if meta.CreatedAt == nil || meta.UpdatedAt == nil || w.Header().Get("Last-Modified") != meta.UpdatedAt.Format(http.TimeFormat) {
+		t.Errorf("GET Last-Modified = %q, meta times %v, %v", w.Header().Get("Last-Modified"), meta.CreatedAt, meta.UpdatedAt)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/key/doc", nil)
+	req.Header.Set("If-None-Match", meta.ETag)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("conditional GET status = %d, want %d", w.Code, http.StatusNotModified)
+	}
+
+	if w := doRequest(router, http.MethodGet, "/key/missing/meta", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET meta for missing key status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestCountEndpoint(t *testing.T) {
+	router, driver := setupRouter(t)
+	driver.Put("user:1", []byte("a"))
+	driver.Put("user:2", []byte("b"))
+	driver.Put("order:1", []byte("c"))
+
+	if w := doRequest(router, http.MethodGet, "/count?prefix=user:", "", ""); w.Body.String() != `{"count":2}` {
+		t.Errorf("GET /count?prefix=user: = %s, want {\"count\":2}", w.Body.String())
+	}
+	if w := doRequest(router, http.MethodGet, "/count", "", ""); w.Body.String() != `{"count":3}` {
+		t.Errorf("GET /count = %s, want {\"count\":3}", w.Body.String())
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	decode := func(t *testing.T, w *httptest.ResponseRecorder) errorBody {
+		t.Helper()
+		var resp struct {
+			Error errorBody `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to decode error body %q: %s", w.Body.String(), err)
+		}
+		return resp.Error
+	}
+
+	tests := []struct {
+		method, target string
+		status         int
+		code           string
+	}{
+		{http.MethodGet, "/key/missing", http.StatusNotFound, CodeKeyNotFound},
+		{http.MethodDelete, "/key/missing", http.StatusNotFound, CodeKeyNotFound},
+		{http.MethodGet, "/nowhere", http.StatusNotFound, CodeNotFound},
+		{http.MethodPatch, "/key/foo", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{http.MethodGet, "/keys/multi", http.StatusBadRequest, CodeBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := doRequest(router, tt.method, tt.target, "", "")
+		if w.Code != tt.status {
+			t.Errorf("%s %s status = %d, want %d", tt.method, tt.target, w.Code, tt.status)
+		}
+		e := decode(t, w)
+		if e.Code != tt.code {
+			t.Errorf("%s %s code = %q, want %q", tt.method, tt.target, e.Code, tt.code)
+		}
+		if e.Message == "" || e.RequestID == "" {
+			t.Errorf("%s %s envelope incomplete: %+v", tt.method, tt.target, e)
+		}
+		if e.RequestID != w.Header().Get(RequestIDHeader) {
+			t.Errorf("%s %s request_id = %q, header = %q", tt.method, tt.target, e.RequestID, w.Header().Get(RequestIDHeader))
+		}
+	}
+
+	// An incoming request ID is echoed back
+	req := httptest.NewRequest(http.MethodGet, "/key/missing", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if got := decode(t, w).RequestID; got != "abc-123" {
+		t.Errorf("request_id = %q, want abc-123", got)
+	}
+}
+
+func TestScrubMessage(t *testing.T) {
+	_, err := os.Open("/srv/zephyrus/data/secret")
+	got := scrubMessage(err)
+	if strings.Contains(got, "/srv") {
+		t.Errorf("scrubMessage(%v) = %q, leaks path", err, got)
+	}
+	if got != "open: no such file or directory" {
+		t.Errorf("scrubMessage(%v) = %q", err, got)
+	}
+}
+
+func TestKeyValidation(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	if err := driver.Put("a", []byte("inside")); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{"escaped slash", "/key/a%2Fb"},
+		{"escaped dot dot", "/key/%2E%2E"},
+		{"escaped traversal", "/key/..%2Fetc%2Fpasswd"},
+		{"escaped absolute path", "/key/%2Fetc%2Fpasswd"},
+		{"escaped backslash traversal", "/key/..%5C..%5Csecret"},
+		{"dotfile", "/key/.hidden"},
+		{"space", "/key/a%20b"},
+		{"control character", "/key/a%00b"},
+		{"too long", "/key/" + strings.Repeat("k", 4096)},
+		{"temp suffix", "/key/upload.tmp"},
+	}
+
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodPut, http.MethodGet, http.MethodDelete} {
+			w := doRequest(router, method, tt.target, "", "value")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: %s status = %d, want %d", tt.name, method, w.Code, http.StatusBadRequest)
+				continue
+			}
+			if !strings.Contains(w.Body.String(), CodeInvalidKey) {
+				t.Errorf("%s: %s body = %s, want code %s", tt.name, method, w.Body.String(), CodeInvalidKey)
+			}
+		}
+	}
+
+	// Dots inside a key are ordinary characters
+	if w := doRequest(router, http.MethodPut, "/key/a.b", "", "value"); w.Code != http.StatusCreated {
+		t.Errorf("PUT a.b status = %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	// Keys with unescaped slashes are refused with the same error
+	for _, method := range []string{http.MethodPut, http.MethodGet, http.MethodDelete} {
+		w := doRequest(router, method, "/key/users/42/profile", "", "value")
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), CodeInvalidKey) {
+			t.Errorf("%s users/42/profile = %d %s, want %d %s", method, w.Code, w.Body, http.StatusBadRequest, CodeInvalidKey)
+		}
+	}
+	if w := doRequest(router, http.MethodGet, "/key/a/ttl", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET a/ttl = %d %s, want the TTL route", w.Code, w.Body)
+	}
+}
+
+func TestKey64Routes(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	b64 := encodeKey64("user:42")
+	w := doRequest(router, http.MethodPut, "/key64/"+b64, "", "hello")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got := w.Header().Get("Location"); got != "/key64/"+b64 {
+		t.Errorf("Location = %q, want /key64/%s", got, b64)
+	}
+
+	// The key is stored as the decoded bytes and visible on the plain routes
+	if value, err := driver.Get("user:42"); err != nil || string(value) != "hello" {
+		t.Errorf("Get(user:42) = %q, %v, want hello", value, err)
+	}
+	if w := doRequest(router, http.MethodGet, "/key64/"+b64+"==", "", ""); w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("GET padded = %d %q, want 200 hello", w.Code, w.Body.String())
+	}
+	if w := doRequest(router, http.MethodGet, "/key/user:42", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET plain status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Malformed base64 and decoded keys that break the key rules are rejected
+	if w := doRequest(router, http.MethodGet, "/key64/!!!", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET invalid base64 status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := doRequest(router, http.MethodPut, "/key64/"+encodeKey64("../x"), "", "v"); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT ../x status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if w := doRequest(router, http.MethodDelete, "/key64/"+b64, "", ""); w.Code != http.StatusOK {
+		t.Errorf("DELETE status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Binary keys and keys with spaces make no file name of their own
+	binary, spaced := "\xff\x00\x01", "my key"
+	for _, key := range []string{binary, spaced} {
+		if w := doRequest(router, http.MethodPut, "/key64/"+encodeKey64(key), "", "v"); w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %q without encoded file names = %d, want %d", key, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// but are stored under encoded ones, and survive a restart
+	dir := t.TempDir()
+	encoded, err := db.Open(dir, &db.Options{EncodeFileNames: true})
+	if err != nil {
+		t.Fatalf("Open failed: %s", err)
+	}
+	router = newRouter(NewHandler(encoded))
+	for _, key := range []string{binary, spaced} {
+		if w := doRequest(router, http.MethodPut, "/key64/"+encodeKey64(key), "", key); w.Code != http.StatusCreated {
+			t.Fatalf("PUT %q = %d %s, want %d", key, w.Code, w.Body, http.StatusCreated)
+		}
+	}
+	var page struct {
+		Keys []listedKey `json:"keys"`
+	}
+	w = doRequest(router, http.MethodGet, "/keys", "", "")
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if len(page.Keys) != 2 || page.Keys[0].Key != spaced || page.Keys[1].Key != `\xff\x00\x01` || page.Keys[1].KeyB64 != encodeKey64(binary) {
+		t.Errorf("GET /keys = %s, want %q and the escaped binary key", w.Body, spaced)
+	}
+	encoded.Close()
+
+	encoded, err = db.Open(dir, &db.Options{EncodeFileNames: true})
+	if err != nil {
+		t.Fatalf("reopen failed: %s", err)
+	}
+	defer encoded.Close()
+	router = newRouter(NewHandler(encoded))
+	for _, key := range []string{binary, spaced} {
+		if w := doRequest(router, http.MethodGet, "/key64/"+encodeKey64(key), "", ""); w.Code != http.StatusOK || w.Body.String() != key {
+			t.Errorf("GET %q after reopening = %d %q", key, w.Code, w.Body)
+		}
+	}
+	if w := doRequest(router, http.MethodPut, "/key64/"+encodeKey64(".hidden"), "", "v"); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT .hidden = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestFilteredScans(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	driver.Put("u:1", []byte(`{"status": "active", "age": 31}`))
+	driver.Put("u:2", []byte(`{"status": "active", "age": 25}`))
+	driver.Put("u:3", []byte(`{"status": "gone", "age": 40}`))
+	driver.Put("u:4", []byte(`{"status": "active", "age": 52}`))
+	driver.Put("u:5", []byte("active, 60"))
+	driver.Put("u:6", []byte(`{"status": "active", "age": 33}`))
+	driver.Put("u:7", []byte(`{"status": "active", "age": 34}`))
+	filter := url.QueryEscape(`json.status == "active" && json.age > 30`)
+
+	// Pages fill up with matches, and the cursor carries on after them
+	w := doRequest(router, http.MethodGet, "/keys?prefix=u:&limit=2&filter="+filter, "", "")
+	var page struct {
+		Keys []listedKey `json:"keys"`
+		Next string      `json:"next"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if w.Code != http.StatusOK || len(page.Keys) != 2 || page.Keys[0].Key != "u:1" || page.Keys[1].Key != "u:4" {
+		t.Fatalf("GET /keys with a filter = %d %s", w.Code, w.Body)
+	}
+	w = doRequest(router, http.MethodGet, "/keys?prefix=u:&limit=2&filter="+filter+"&cursor="+page.Next, "", "")
+	if !strings.Contains(w.Body.String(), `"u:6"`) || !strings.Contains(w.Body.String(), `"u:7"`) {
+		t.Errorf("GET /keys second page = %s, want u:6 and u:7", w.Body)
+	}
+
+	w = doRequest(router, http.MethodGet, "/export?prefix=u:&filter="+filter, "", "")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, `"count":4`) || strings.Contains(body, `"u:2"`) || strings.Contains(body, `"u:5"`) {
+		t.Errorf("GET /export with a filter = %d %s", w.Code, body)
+	}
+	w = doRequest(router, http.MethodGet, "/export.csv?prefix=u:&fields=age&filter="+filter, "", "")
+	if want := "key,age\nu:1,31\nu:4,52\nu:6,33\nu:7,34\n"; w.Body.String() != want {
+		t.Errorf("GET /export.csv with a filter = %q, want %q", w.Body, want)
+	}
+
+	for _, target := range []string{"/keys", "/export", "/export.csv"} {
+		w := doRequest(router, http.MethodGet, target+"?filter="+url.QueryEscape(`json.age >> 3`), "", "")
+		var resp struct {
+			Error errorBody `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusBadRequest || resp.Error.Code != CodeInvalidFilter || resp.Error.Position == nil || *resp.Error.Position != 10 {
+			t.Errorf("GET %s with an invalid filter = %d %s, want 400 at position 10", target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	for _, key := range []string{"a:1", "a:2", "a:3", "b:1"} {
+		driver.Put(key, []byte("v"))
+	}
+
+	type page struct {
+		Keys []listedKey `json:"keys"`
+		Next string      `json:"next"`
+	}
+	list := func(target string) page {
+		t.Helper()
+		w := doRequest(router, http.MethodGet, target, "", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d, want %d", target, w.Code, http.StatusOK)
+		}
+		var p page
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+			t.Fatalf("Failed to decode %s: %s", w.Body.String(), err)
+		}
+		return p
+	}
+
+	p := list("/keys?prefix=a:&limit=2")
+	if len(p.Keys) != 2 || p.Keys[0].Key != "a:1" || p.Keys[1].Key != "a:2" || p.Next == "" {
+		t.Fatalf("first page = %+v", p)
+	}
+	if p.Keys[0].KeyB64 != encodeKey64("a:1") {
+		t.Errorf("key_b64 = %q, want %q", p.Keys[0].KeyB64, encodeKey64("a:1"))
+	}
+
+	first := p.Next
+	driver.Delete("a:2")
+	p = list("/keys?prefix=a:&limit=2&cursor=" + first)
+	if len(p.Keys) != 1 || p.Keys[0].Key != "a:3" || p.Next != "" {
+		t.Errorf("second page after deleting the cursor's key = %+v", p)
+	}
+	driver.Put("a:2", []byte("v"))
+
+	p = list("/keys?prefix=a:&limit=2&order=desc")
+	if len(p.Keys) != 2 || p.Keys[0].Key != "a:3" || p.Keys[1].Key != "a:2" || p.Next == "" {
+		t.Fatalf("first descending page = %+v", p)
+	}
+	p = list("/keys?prefix=a:&limit=2&order=desc&cursor=" + p.Next)
+	if len(p.Keys) != 1 || p.Keys[0].Key != "a:1" {
+		t.Errorf("second descending page = %+v", p)
+	}
+	p = list("/keys?order=desc&after=" + encodeKey64("a:3"))
+	if len(p.Keys) != 2 || p.Keys[0].Key != "a:2" {
+		t.Errorf("descending listing after a:3 = %+v", p)
+	}
+
+	// Cursors are only accepted unaltered, for the listing they came from
+	tampered := first[:len(first)-1] + "A"
+	if tampered == first {
+		tampered = first[:len(first)-1] + "B"
+	}
+	for _, target := range []string{
+		"/keys?prefix=a:&cursor=" + encodeKey64("a:2"),
+		"/keys?prefix=a:&cursor=" + tampered,
+		"/keys?prefix=a:&order=desc&cursor=" + first,
+		"/keys?prefix=b:&cursor=" + first,
+		"/keys?prefix=a:&cursor=" + first + "&after=" + encodeKey64("a:1"),
+		"/keys?order=sideways",
+	} {
+		if w := doRequest(router, http.MethodGet, target, "", ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s status = %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	if w := doRequest(router, http.MethodGet, "/keys?limit=0", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0 status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if got := displayKey("a\x00b"); got != `a\x00b` {
+		t.Errorf("displayKey = %q, want escaped", got)
+	}
+}
+
+func TestStatsAndCompact(t *testing.T) {
+	router, driver := setupRouter(t)
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("2"))
+
+	w := doRequest(router, http.MethodGet, "/stats", "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /stats status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var stats db.Stats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %s", err)
+	}
+	if stats.Keys != 2 || stats.CacheCapacity != 128 || len(stats.Shards) != 1 || stats.Shards[0].Files != 2 {
+		t.Errorf("stats = %+v, want 2 keys in one shard and capacity 128", stats)
+	}
+	if stats.Index.Items != 2 || stats.Index.Degree != 2 || stats.Index.ValueBytes != 2 {
+		t.Errorf("stats.Index = %+v, want 2 items of 1 byte", stats.Index)
+	}
+	if stats.Ops.Puts != 2 || stats.Ops.BytesWritten != 2 {
+		t.Errorf("stats.Ops = %+v, want 2 puts of 1 byte", stats.Ops)
+	}
+
+	w = doRequest(router, http.MethodGet, "/metrics", "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\nzephyrus_cache_evictions_total 0\n") || !strings.Contains(w.Body.String(), "\nzephyrus_puts_total 2\n") {
+		t.Errorf("GET /metrics = %d %s, want the eviction counter", w.Code, w.Body)
+	}
+
+	if w := doRequest(router, http.MethodPut, "/admin/loglevel", "application/json", `{"level":"warn"}`); w.Code != http.StatusOK || w.Body.String() != `{"level":"warn"}` {
+		t.Errorf("PUT /admin/loglevel = %d %s, want 200 warn", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPut, "/admin/loglevel", "application/json", `{"level":"loud"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT /admin/loglevel with an unknown level status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = doRequest(router, http.MethodPost, "/admin/rebalance", "", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"total":2,"scanned":2,"moved":0,"done":true}` {
+		t.Errorf("POST /admin/rebalance = %d %s, want one final progress line", w.Code, w.Body)
+	}
+
+	if w := doRequest(router, http.MethodPost, "/admin/compact", "", ""); w.Code != http.StatusNoContent {
+		t.Errorf("POST /admin/compact status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	os.WriteFile(filepath.Join(stats.Shards[0].Dir, "left.tmp"), []byte("over"), 0644)
+	w = doRequest(router, http.MethodPost, "/admin/compact?progress=true", "", "")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"total":1,"scanned":1,"removed":1,"bytes":4,"done":false}`+"\n"+`{"total":1,"scanned":1,"removed":1,"bytes":4,"done":true}` {
+		t.Errorf("POST /admin/compact?progress=true = %d %s, want a progress line per batch and a final one", w.Code, w.Body)
+	}
+
+	var compaction db.CompactionStats
+	w = doRequest(router, http.MethodPost, "/admin/compact/pause", "", "")
+	if json.Unmarshal(w.Body.Bytes(), &compaction); w.Code != http.StatusOK || !compaction.Paused || compaction.Runs != 2 || compaction.BytesReclaimed != 4 {
+		t.Errorf("POST /admin/compact/pause = %d %s, want paused after 2 runs reclaiming 4 bytes", w.Code, w.Body)
+	}
+	w = doRequest(router, http.MethodPost, "/admin/compact/resume", "", "")
+	if json.Unmarshal(w.Body.Bytes(), &compaction); w.Code != http.StatusOK || compaction.Paused {
+		t.Errorf("POST /admin/compact/resume = %d %s, want resumed", w.Code, w.Body)
+	}
+
+	w = doRequest(router, http.MethodGet, "/admin/startup-report", "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"clean_shutdown":true`) || !strings.Contains(w.Body.String(), `"quarantined":[],"verified":false,"corrupt":[],"corrupt_files":0`) {
+		t.Errorf("GET /admin/startup-report = %d %s, want a fresh start with nothing corrupt", w.Code, w.Body)
+	}
+}
+
+func TestReadOnlyReplica(t *testing.T) {
+	router, driver := setupRouter(t)
+	driver.Put("a", []byte("1"))
+	driver.SetReadOnly(true)
+
+	w := doRequest(router, http.MethodPut, "/key/a", "text/plain", "2")
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), CodeReadOnly) {
+		t.Errorf("PUT on a replica = %d %s, want 403 %s", w.Code, w.Body, CodeReadOnly)
+	}
+	if w := doRequest(router, http.MethodGet, "/key/a", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET on a replica status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Feeds from an earlier run of the primary cannot be resumed
+	w = doRequest(router, http.MethodGet, "/replication/feed?after=1&id=other", "", "")
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), CodeResyncRequired) {
+		t.Errorf("feed with a stale ID = %d %s, want 410 %s", w.Code, w.Body, CodeResyncRequired)
+	}
+
+	w = doRequest(router, http.MethodGet, "/replication/snapshot", "", "")
+	if w.Code != http.StatusOK || w.Header().Get(ReplicationIDHeader) != driver.ReplicationID() {
+		t.Fatalf("GET /replication/snapshot = %d, ID %q", w.Code, w.Header().Get(ReplicationIDHeader))
+	}
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"key":"a"`) || !strings.HasPrefix(lines[1], `{"seq":1,`) {
+		t.Errorf("snapshot body = %q, want one put and the final seq", w.Body)
+	}
+}
+
+func TestChangesEndpoint(t *testing.T) {
+	router, _ := setupRouter(t)
+	if w := doRequest(router, http.MethodGet, "/changes", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /changes without an oplog status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	dir := t.TempDir()
+	driver, err := db.Open(dir, &db.Options{CacheSize: 128, Degree: 2, OplogSize: 4})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	router = newRouter(NewHandler(driver))
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("2"))
+	driver.Delete("a")
+
+	w := doRequest(router, http.MethodGet, "/changes?since=1&limit=1", "", "")
+	var page struct {
+		Changes []db.Change `json:"changes"`
+		Next    uint64      `json:"next"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET /changes = %d %s", w.Code, w.Body)
+	}
+	if len(page.Changes) != 1 || page.Changes[0].Key != "b" || page.Next != 2 {
+		t.Errorf("GET /changes?since=1&limit=1 = %+v, want change 2 and next 2", page)
+	}
+
+	if w := doRequest(router, http.MethodGet, "/changes?since=x", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid since status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	for i := 0; i < 10; i++ {
+		driver.Put("k", []byte(strconv.Itoa(i)))
+	}
+	w = doRequest(router, http.MethodGet, "/changes?since=0", "", "")
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), CodeResyncRequired) {
+		t.Errorf("truncated since = %d %s, want 410 %s", w.Code, w.Body, CodeResyncRequired)
+	}
+}
+
+func TestChangeStream(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), &db.Options{CacheSize: 128, Degree: 2, OplogSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	handler := NewHandler(driver)
+	server := httptest.NewServer(newRouter(handler))
+	defer server.Close()
+	defer handler.Shutdown()
+
+	driver.Put("a", []byte("1"))
+	resp, err := http.Get(server.URL + "/changes/stream?since=0")
+	if err != nil {
+		t.Fatalf("GET /changes/stream failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	var change db.Change
+	if err := dec.Decode(&change); err != nil || change.Seq != 1 || change.Key != "a" {
+		t.Fatalf("first streamed change = %+v, %v", change, err)
+	}
+	driver.Delete("a")
+	if err := dec.Decode(&change); err != nil || change.Seq != 2 || change.Op != db.OpDelete {
+		t.Errorf("second streamed change = %+v, %v, want the delete", change, err)
+	}
+}
+
+func TestValueTooLarge(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), &db.Options{CacheSize: 128, Degree: 2, MaxValueSize: 4})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	router := newRouter(NewHandler(driver))
+
+	if w := doRequest(router, http.MethodPut, "/key/k", "text/plain", "1234"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT at the limit = %d: %s", w.Code, w.Body)
+	}
+	w := doRequest(router, http.MethodPut, "/key/k", "text/plain", "12345")
+	if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), CodeValueTooLarge) {
+		t.Errorf("PUT over the limit = %d %s, want 413 %s", w.Code, w.Body, CodeValueTooLarge)
+	}
+	if value, _ := driver.Get("k"); string(value) != "1234" {
+		t.Errorf("value after a rejected PUT = %q, want it untouched", value)
+	}
+}
+
+func TestSchemaViolation(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	schema := `{"type": "object", "properties": {"age": {"type": "integer"}}}`
+	if w := doRequest(router, http.MethodPut, "/admin/schemas?prefix=user:", "application/json", schema); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT /admin/schemas = %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPut, "/admin/schemas?prefix=x:", "application/json", `{"type": 5}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid schema = %d, want 400", w.Code)
+	}
+
+	w := doRequest(router, http.MethodPut, "/key/user:1", "application/json", `{"age": "old"}`)
+	var body struct {
+		Error errorBody `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusUnprocessableEntity || body.Error.Code != CodeSchemaViolation {
+		t.Fatalf("PUT of a value failing the schema = %d %s, want 422 %s", w.Code, w.Body, CodeSchemaViolation)
+	}
+	if len(body.Error.Details) != 1 || body.Error.Details[0].Path != "/age" {
+		t.Errorf("details = %+v, want one at /age", body.Error.Details)
+	}
+	if w := doRequest(router, http.MethodPut, "/key/user:1", "application/json", `{"age": 3}`); w.Code != http.StatusCreated {
+		t.Errorf("PUT of a matching value = %d: %s", w.Code, w.Body)
+	}
+
+	if w := doRequest(router, http.MethodDelete, "/admin/schemas?prefix=user:", "", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /admin/schemas = %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodGet, "/admin/schemas", "", ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "user:") {
+		t.Errorf("GET /admin/schemas after DELETE = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	driver, err := db.Open(t.TempDir(), &db.Options{CacheSize: 128, Degree: 2, TracerProvider: tp})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	handler := NewHandler(driver)
+	handler.TracerProvider = tp
+	router := newRouter(handler)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPut, "/key/a", strings.NewReader("hello"))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT /key/a status = %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans.Ended() {
+		byName[s.Name()] = s
+		if got := s.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %s trace ID = %s, want the one from traceparent", s.Name(), got)
+		}
+	}
+	request, put := byName["PUT /key/:key"], byName["db.put"]
+	if request == nil || put == nil || byName["db.lock"] == nil || byName["db.io"] == nil {
+		t.Fatalf("spans = %v, want the request, db.put, db.lock and db.io", byName)
+	}
+	if put.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("db.put is not a child of the request span")
+	}
+	if byName["db.io"].Parent().SpanID() != put.SpanContext().SpanID() {
+		t.Errorf("db.io is not a child of db.put")
+	}
+	attrs := make(map[string]string)
+	for _, kv := range put.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["zephyrus.key"] != "a" || attrs["zephyrus.size"] != "5" {
+		t.Errorf("db.put attributes = %v, want key a and size 5", attrs)
+	}
+
+	// Operations outside a traced request are not traced
+	ended := len(spans.Ended())
+	driver.Put("b", []byte("1"))
+	if n := len(spans.Ended()) - ended; n != 0 {
+		t.Errorf("untraced Put made %d spans", n)
+	}
+}
+
+func TestRevisionHeaders(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	w := doRequest(router, http.MethodPut, "/key/doc", "text/plain", "v1")
+	rev := w.Header().Get(RevisionHeader)
+	if w.Code != http.StatusCreated || rev == "" {
+		t.Fatalf("PUT = %d with revision %q", w.Code, rev)
+	}
+	if w := doRequest(router, http.MethodGet, "/key/doc", "", ""); w.Header().Get(RevisionHeader) != rev {
+		t.Errorf("GET revision = %q, want %q", w.Header().Get(RevisionHeader), rev)
+	}
+
+	put := func(rev, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/key/doc", strings.NewReader(body))
+		req.Header.Set(IfMatchRevisionHeader, rev)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := put(rev, "v2"); w.Code != http.StatusOK || w.Header().Get(RevisionHeader) == rev {
+		t.Fatalf("conditional PUT at the current revision = %d with revision %q", w.Code, w.Header().Get(RevisionHeader))
+	}
+	w = put(rev, "v3")
+	var body struct {
+		Error errorBody `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusPreconditionFailed || body.Error.Code != CodeRevisionMismatch {
+		t.Errorf("conditional PUT at a stale revision = %d %s, want 412 %s", w.Code, w.Body, CodeRevisionMismatch)
+	}
+	if w := put("soon", "v3"); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with an invalid revision = %d, want 400", w.Code)
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	del := func(key, header, value string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/key/"+key, nil)
+		req.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	doRequest(router, http.MethodPut, "/key/doc", "text/plain", "v1")
+	etag := doRequest(router, http.MethodGet, "/key/doc", "", "").Header().Get("ETag")
+	doRequest(router, http.MethodPut, "/key/doc", "text/plain", "v2")
+	if code := del("doc", "If-Match", etag); code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale ETag = %d, want 412", code)
+	}
+	etag = doRequest(router, http.MethodGet, "/key/doc", "", "").Header().Get("ETag")
+	if code := del("doc", "If-Match", etag); code != http.StatusOK {
+		t.Errorf("DELETE with the current ETag = %d, want 200", code)
+	}
+	if code := del("doc", "If-Match", etag); code != http.StatusNotFound {
+		t.Errorf("DELETE of a deleted key with If-Match = %d, want 404", code)
+	}
+
+	doRequest(router, http.MethodPut, "/key/doc", "text/plain", "v3")
+	for _, want := range []int{http.StatusOK, http.StatusNotFound} {
+		if code := del("doc", "If-Match", "*"); code != want {
+			t.Errorf("DELETE with If-Match: * = %d, want %d", code, want)
+		}
+	}
+	if code := del("doc", "If-Match", "W/"+etag); code != http.StatusBadRequest {
+		t.Errorf("DELETE with a weak ETag = %d, want 400", code)
+	}
+}
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	send := func(method, key string, headers ...string) int {
+		req := httptest.NewRequest(method, "/key/"+key, strings.NewReader("v"))
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	date := func(t time.Time) string { return t.UTC().Format(http.TimeFormat) }
+	past, future := date(time.Now().Add(-time.Hour)), date(time.Now().Add(time.Hour))
+
+	doRequest(router, http.MethodPut, "/key/doc", "text/plain", "v1")
+	get := doRequest(router, http.MethodGet, "/key/doc", "", "")
+	lastModified, etag := get.Header().Get("Last-Modified"), get.Header().Get("ETag")
+	tests := []struct {
+		name    string
+		method  string
+		key     string
+		headers []string
+		want    int
+	}{
+		{"PUT unmodified since Last-Modified", http.MethodPut, "doc", []string{"If-Unmodified-Since", lastModified}, http.StatusOK},
+		{"PUT modified since", http.MethodPut, "doc", []string{"If-Unmodified-Since", past}, http.StatusPreconditionFailed},
+		{"PUT of a missing key", http.MethodPut, "new", []string{"If-Unmodified-Since", future}, http.StatusPreconditionFailed},
+		{"PUT with an invalid date", http.MethodPut, "doc", []string{"If-Unmodified-Since", "yesterday"}, http.StatusOK},
+		{"If-Match fails first", http.MethodPut, "doc", []string{"If-Match", etag, "If-Unmodified-Since", future}, http.StatusPreconditionFailed},
+		{"DELETE modified since", http.MethodDelete, "doc", []string{"If-Unmodified-Since", past}, http.StatusPreconditionFailed},
+		{"DELETE of a missing key", http.MethodDelete, "new", []string{"If-Unmodified-Since", future}, http.StatusNotFound},
+		{"DELETE unmodified since", http.MethodDelete, "doc", []string{"If-Unmodified-Since", future}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := send(tt.method, tt.key, tt.headers...); code != tt.want {
+			t.Errorf("%s = %d, want %d", tt.name, code, tt.want)
+		}
+	}
+
+	// If-Match passing means If-Unmodified-Since is not looked at
+	doRequest(router, http.MethodPut, "/key/doc", "text/plain", "v2")
+	etag = doRequest(router, http.MethodGet, "/key/doc", "", "").Header().Get("ETag")
+	if code := send(http.MethodPut, "doc", "If-Match", etag, "If-Unmodified-Since", past); code != http.StatusOK {
+		t.Errorf("PUT with the current ETag and a past date = %d, want 200", code)
+	}
+	if code := send(http.MethodPut, "missing", "If-Match", "*"); code != http.StatusPreconditionFailed {
+		t.Errorf("PUT of a missing key with If-Match: * = %d, want 412", code)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	router, _ := setupRouter(t)
+
+	if w := doRequest(router, http.MethodPut, "/admin/quotas?namespace=user", "application/json", `{"max_bytes": 10}`); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT /admin/quotas = %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPut, "/admin/quotas?namespace=user", "application/json", `{"max_keys": -1}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT of a negative quota = %d, want 400", w.Code)
+	}
+	if w := doRequest(router, http.MethodPut, "/key/user:1", "text/plain", "12345678"); w.Code != http.StatusCreated {
+		t.Fatalf("PUT within the quota = %d: %s", w.Code, w.Body)
+	}
+
+	w := doRequest(router, http.MethodPut, "/key/user:2", "text/plain", "12345")
+	var body struct {
+		Error errorBody `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusInsufficientStorage || body.Error.Code != CodeQuotaExceeded {
+		t.Fatalf("PUT over the quota = %d %s, want 507 %s", w.Code, w.Body, CodeQuotaExceeded)
+	}
+	if q := body.Error.Quota; q == nil || q.Namespace != "user" || q.MaxBytes != 10 || q.Bytes != 13 {
+		t.Errorf("quota details = %+v, want 13 of 10 bytes in user", q)
+	}
+
+	w = doRequest(router, http.MethodGet, "/stats", "", "")
+	var stats db.Stats
+	json.Unmarshal(w.Body.Bytes(), &stats)
+	if u := stats.Namespaces["user"]; u.Bytes != 8 || u.Keys != 1 {
+		t.Errorf("usage in /stats = %+v, want 8 bytes in 1 key", u)
+	}
+
+	if w := doRequest(router, http.MethodDelete, "/admin/quotas?namespace=user", "", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /admin/quotas = %d: %s", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodGet, "/admin/quotas", "", ""); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "user") {
+		t.Errorf("GET /admin/quotas after DELETE = %d %s", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodPut, "/key/user:2", "text/plain", "12345"); w.Code != http.StatusCreated {
+		t.Errorf("PUT after removing the quota = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	if w := doRequest(router, http.MethodGet, "/search?q=refund", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET /search without an index = %d, want 404", w.Code)
+	}
+	driver.EnableTextIndex([]string{"title"})
+	doRequest(router, http.MethodPut, "/key/ticket:1", "application/json", `{"title": "Refund please"}`)
+	doRequest(router, http.MethodPut, "/key/ticket:2", "application/json", `{"title": "Login"}`)
+
+	w := doRequest(router, http.MethodGet, "/search?q=refund", "", "")
+	var body struct {
+		Keys []listedKey `json:"keys"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusOK || len(body.Keys) != 1 || body.Keys[0].Key != "ticket:1" {
+		t.Errorf("GET /search?q=refund = %d %s, want ticket:1", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodGet, "/search?q=refund&limit=0", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("limit=0 status = %d, want 400", w.Code)
+	}
+}
+
+// slowReader returns its data a byte at a time, after a pause before each
+type slowReader struct {
+	data  string
+	pause time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.EOF
+	}
+	time.Sleep(r.pause)
+	p[0], r.data = r.data[0], r.data[1:]
+	return 1, nil
+}
+
+func TestTimeouts(t *testing.T) {
+	_, driver := setupRouter(t)
+	handler := NewHandler(driver)
+	handler.ReadTimeout, handler.WriteTimeout = time.Nanosecond, 20*time.Millisecond
+	router := newRouter(handler)
+	driver.Put("a", []byte("1"))
+
+	// A GET whose deadline passed before the value was opened fails
+	w := doRequest(router, http.MethodGet, "/key/a", "", "")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), CodeTimeout) {
+		t.Errorf("GET past its deadline = %d %s, want 503 %s", w.Code, w.Body, CodeTimeout)
+	}
+	handler.ReadTimeout = time.Second
+	if w := doRequest(router, http.MethodGet, "/key/a", "", ""); w.Code != http.StatusOK || w.Body.String() != "1" {
+		t.Errorf("GET within its deadline = %d %s, want 200 1", w.Code, w.Body)
+	}
+
+	// A PUT whose body is still streaming at the deadline fails and keeps
+	// the old value
+	req := httptest.NewRequest(http.MethodPut, "/key/a", &slowReader{data: "22222", pause: 10 * time.Millisecond})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), CodeTimeout) {
+		t.Errorf("PUT with a slow body = %d %s, want 503 %s", w.Code, w.Body, CodeTimeout)
+	}
+	if v, _ := driver.Get("a"); string(v) != "1" {
+		t.Errorf("value after a timed out PUT = %q, want 1", v)
+	}
+
+	// Writes that finish after their deadline still succeed, as they cannot
+	// be taken back
+	driver.OnPut(func(string, []byte) { time.Sleep(50 * time.Millisecond) })
+	driver.OnDelete(func(string) { time.Sleep(50 * time.Millisecond) })
+	if w := doRequest(router, http.MethodPut, "/key/a", "text/plain", "3"); w.Code != http.StatusOK {
+		t.Errorf("PUT committed past its deadline = %d %s, want 200", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodDelete, "/key/a", "", ""); w.Code != http.StatusOK {
+		t.Errorf("DELETE committed past its deadline = %d %s, want 200", w.Code, w.Body)
+	}
+
+	// A DELETE whose deadline passed before it got the lock deletes nothing
+	driver.Put("b", []byte("1"))
+	handler.WriteTimeout = time.Nanosecond
+	if w := doRequest(router, http.MethodDelete, "/key/b", "", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("DELETE past its deadline = %d %s, want 503", w.Code, w.Body)
+	}
+	if ok, _ := driver.Has("b"); !ok {
+		t.Errorf("DELETE past its deadline removed the key")
+	}
+}
+
+func TestDiskFull(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("free space is only known on Linux and macOS")
+	}
+	driver, err := db.Open(t.TempDir(), &db.Options{MinFreeSpace: 1 << 62})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	router := newRouter(NewHandler(driver))
+
+	w := doRequest(router, http.MethodPut, "/key/a", "text/plain", "1")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), CodeDiskFull) || !strings.Contains(w.Body.String(), "bytes free") {
+		t.Errorf("PUT on a full disk = %d %s, want 503 %s with the reason", w.Code, w.Body, CodeDiskFull)
+	}
+	if w := doRequest(router, http.MethodGet, "/key/a", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET on a full disk = %d, want reads served", w.Code)
+	}
+	w = doRequest(router, http.MethodGet, "/readyz", "", "")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"disk_full"`) {
+		t.Errorf("GET /readyz on a full disk = %d %s, want 503", w.Code, w.Body)
+	}
+	w = doRequest(router, http.MethodGet, "/stats", "", "")
+	if !strings.Contains(w.Body.String(), `"disk_full":"a data directory has`) {
+		t.Errorf("GET /stats on a full disk = %s, want disk_full", w.Body)
+	}
+
+	router, _ = setupRouter(t)
+	if w := doRequest(router, http.MethodGet, "/readyz", "", ""); w.Code != http.StatusOK {
+		t.Errorf("GET /readyz = %d %s, want 200", w.Code, w.Body)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		switch key {
+		case "missing":
+			return nil, db.ErrKeyNotFound
+		case "broken":
+			return nil, fmt.Errorf("upstream is down")
+		}
+		return []byte(`{"loaded":true}`), nil
+	}
+	driver, err := db.Open(t.TempDir(), &db.Options{Loader: loader})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	router := newRouter(NewHandler(driver))
+
+	if w := doRequest(router, http.MethodGet, "/key/a", "", ""); w.Code != http.StatusOK || w.Body.String() != `{"loaded":true}` {
+		t.Errorf("GET of a key to load = %d %s, want the loaded value", w.Code, w.Body)
+	}
+	if ok, _ := driver.Has("a"); !ok {
+		t.Errorf("loaded value was not stored")
+	}
+	if w := doRequest(router, http.MethodGet, "/key/missing", "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET of a key the loader lacks = %d, want 404", w.Code)
+	}
+	w := doRequest(router, http.MethodGet, "/key/broken", "", "")
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), CodeLoadFailed) {
+		t.Errorf("GET with a failing loader = %d %s, want 502 %s", w.Code, w.Body, CodeLoadFailed)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	var logs bytes.Buffer
+	logger := db.NewSlogLogger(slog.New(slog.NewJSONHandler(&logs, nil)), nil)
+	driver, err := db.Open(t.TempDir(), &db.Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	boom := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/key/boom" {
+				panic("boom")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	router := newRouter(NewHandler(driver), WithMiddleware(boom))
+
+	logs.Reset()
+	w := doRequest(router, http.MethodGet, "/key/boom", "", "")
+	var body struct {
+		Error errorBody `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusInternalServerError || body.Error.Code != CodeInternal || body.Error.RequestID == "" {
+		t.Errorf("GET /key/boom = %d %s, want 500 %s with a request ID", w.Code, w.Body, CodeInternal)
+	}
+
+	// The stack is one entry, tagged with the request ID
+	var entry map[string]string
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) != 1 || json.Unmarshal([]byte(lines[0]), &entry) != nil {
+		t.Fatalf("logs = %q, want one JSON entry", logs.String())
+	}
+	if entry["panic"] != "boom" || entry["request_id"] != body.Error.RequestID || !strings.Contains(entry["stack"], "TestPanicRecovery") {
+		t.Errorf("log entry = %v, want the panic, request ID and stack", entry)
+	}
+
+	// The server carries on and counts the panic
+	if w := doRequest(router, http.MethodPut, "/key/a", "text/plain", "1"); w.Code != http.StatusCreated {
+		t.Errorf("PUT after a panic = %d %s", w.Code, w.Body)
+	}
+	if w := doRequest(router, http.MethodGet, "/metrics", "", ""); !strings.Contains(w.Body.String(), "\nzephyrus_panics_total 1\n") {
+		t.Errorf("GET /metrics = %s, want one panic", w.Body)
+	}
+}
+
+// doIdempotent sends a request with an Idempotency-Key
+func doIdempotent(router http.Handler, method, target, idemKey, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set(IdempotencyKeyHeader, idemKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	router, driver := setupRouter(t)
+
+	w := doIdempotent(router, http.MethodPut, "/key/a", "k1", "1")
+	if w.Code != http.StatusCreated || w.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Fatalf("first PUT = %d %v", w.Code, w.Header())
+	}
+	rev := w.Header().Get(RevisionHeader)
+
+	// A retry after another write is replayed rather than applied again
+	driver.Put("a", []byte("2"))
+	w = doIdempotent(router, http.MethodPut, "/key/a", "k1", "1")
+	if w.Code != http.StatusCreated || w.Header().Get(IdempotentReplayedHeader) != "true" || w.Header().Get(RevisionHeader) != rev {
+		t.Errorf("retried PUT = %d %v, want the first response replayed", w.Code, w.Header())
+	}
+	if v, _ := driver.Get("a"); string(v) != "2" {
+		t.Errorf("value after a retry = %q, want the later write kept", v)
+	}
+
+	// Reusing the key for another body, or another key, is refused
+	if w := doIdempotent(router, http.MethodPut, "/key/a", "k1", "3"); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), CodeIdempotencyMismatch) {
+		t.Errorf("PUT reusing the key with another body = %d %s, want 422", w.Code, w.Body)
+	}
+	if w := doIdempotent(router, http.MethodPut, "/key/b", "k1", "1"); w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("PUT reusing the key for another key = %d, want 422", w.Code)
+	}
+
+	// Batch imports are replayed the same way
+	body := `{"key":"c","value":"x"}`
+	first := doIdempotent(router, http.MethodPost, "/import", "k2", body)
+	driver.Put("c", []byte("y"))
+	if w := doIdempotent(router, http.MethodPost, "/import", "k2", body); w.Code != first.Code || w.Body.String() != first.Body.String() {
+		t.Errorf("retried import = %d %s, want %d %s", w.Code, w.Body, first.Code, first.Body)
+	}
+	if v, _ := driver.Get("c"); string(v) != "y" {
+		t.Errorf("value after a retried import = %q, want the later write kept", v)
+	}
+
+	// The responses are kept with a TTL in a namespace clients can neither
+	// use nor see
+	scope := sha256.Sum256([]byte("\nk1"))
+	record := IdempotencyNamespace + db.NamespaceSeparator + hex.EncodeToString(scope[:])
+	if ttl, err := driver.TTL(record); err != nil || ttl <= 0 {
+		t.Errorf("TTL of a record = %s, %v, want one", ttl, err)
+	}
+	if w := doRequest(router, http.MethodGet, "/key/"+record, "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("GET of a record = %d, want 400", w.Code)
+	}
+	for _, tt := range []struct{ method, target, body string }{
+		{http.MethodPost, "/mget", `["` + record + `"]`},
+		{http.MethodGet, "/keys", ""},
+		{http.MethodGet, "/count", ""},
+		{http.MethodGet, "/export", ""},
+	} {
+		w := doRequest(router, tt.method, tt.target, "application/json", tt.body)
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"status"`) || strings.Contains(w.Body.String(), IdempotencyNamespace+db.NamespaceSeparator) && tt.target != "/mget" {
+			t.Errorf("%s %s = %d %s, want the records left out", tt.method, tt.target, w.Code, w.Body)
+		}
+	}
+	if n, _ := driver.Count(context.Background(), ""); n != 2 {
+		t.Errorf("Count = %d, want the 2 keys written and not the records", n)
+	}
+	changes, _, _ := driver.Changes(0, 100)
+	for _, c := range changes {
+		if db.Reserved(c.Key) {
+			t.Errorf("change log holds %s of %s", c.Op, c.Key)
+		}
+	}
+	forged := `{"key":"` + IdempotencyNamespace + db.NamespaceSeparator + `x","value":"{}"}`
+	if w := doRequest(router, http.MethodPost, "/import", "application/x-ndjson", forged); w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "reserved") {
+		t.Errorf("import of a record = %d %s, want it refused", w.Code, w.Body)
+	}
+	if _, err := driver.GetReserved(IdempotencyNamespace + db.NamespaceSeparator + "x"); !errors.Is(err, db.ErrKeyNotFound) {
+		t.Errorf("GetReserved of an imported record = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func FuzzPutValue(f *testing.F) {
+	for _, seed := range []struct{ contentType, body string }{
+		{"application/json", `{"name":"zephyrus"}`},
+		{"application/json", `{"name":`},
+		{"application/json", `[1, 2] 3`},
+		{"application/json; charset=utf-8", `"\u0000"`},
+		{"Application/JSON", `not json`},
+		{"text/plain", "hello"},
+		{"", "\x00\xff\xfe"},
+		{"multipart/form-data; boundary=x", "--x--"},
+		{";;;", ""},
+	} {
+		f.Add(seed.contentType, []byte(seed.body))
+	}
+
+	router, _ := setupRouter(f)
+	f.Fuzz(func(t *testing.T, contentType string, body []byte) {
+		req := httptest.NewRequest(http.MethodPut, "/key/fuzz", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		switch w.Code {
+		case http.StatusOK, http.StatusCreated:
+		case http.StatusBadRequest:
+			// Only a JSON body that does not parse is refused
+			if !strings.Contains(w.Body.String(), CodeInvalidValue) || json.Valid(body) {
+				t.Fatalf("PUT with %q = 400 %s for body %q", contentType, w.Body, body)
+			}
+			return
+		default:
+			t.Fatalf("PUT with %q = %d %s", contentType, w.Code, w.Body)
+		}
+
+		w = doRequest(router, http.MethodGet, "/key/fuzz", "", "")
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), body) {
+			t.Fatalf("GET after PUT with %q = %d %q, want %q", contentType, w.Code, w.Body, body)
+		}
+	})
+}
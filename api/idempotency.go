@@ -0,0 +1,205 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// IdempotencyKeyHeader names a write, so that a client retrying it gets the
+// first attempt's response instead of applying it again
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on responses replayed for a retry
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// IdempotencyNamespace is the namespace the responses to requests with an
+// Idempotency-Key are kept in. It is reserved, see db.Reserved, so clients
+// can neither use its keys nor see them listed.
+const IdempotencyNamespace = db.IdempotencyNamespace
+
+// CodeIdempotencyMismatch is returned when an Idempotency-Key is reused for
+// a different request
+const CodeIdempotencyMismatch = "IDEMPOTENCY_KEY_REUSED"
+
+// CodeIdempotencyInFlight is returned for a retry made while the first
+// request with its Idempotency-Key is still being served
+const CodeIdempotencyInFlight = "IDEMPOTENCY_KEY_IN_USE"
+
+// maxIdempotencyKeyLen caps the Idempotency-Key header
+const maxIdempotencyKeyLen = 255
+
+// idempotencyRecord is the response to a request with an Idempotency-Key,
+// as stored in IdempotencyNamespace
+type idempotencyRecord struct {
+	Request string      `json:"request"` // hash of the method, path and body
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+}
+
+// idempotencyLocks holds the Idempotency-Keys of the requests being served
+type idempotencyLocks struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// acquire claims key, reporting false when a request holding it is still
+// being served
+func (l *idempotencyLocks) acquire(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.keys == nil {
+		l.keys = make(map[string]struct{})
+	}
+	if _, busy := l.keys[key]; busy {
+		return false
+	}
+	l.keys[key] = struct{}{}
+	return true
+}
+
+func (l *idempotencyLocks) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+}
+
+// recordingWriter keeps a copy of the response as it is written
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// hashingBody hashes a request body as the handler streams it
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	eof  bool // the body was read to the end
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// finish reports whether the whole body went through the hash, reading the
+// end of the body when the handler stopped just short of it
+func (b *hashingBody) finish() bool {
+	if !b.eof {
+		io.CopyN(io.Discard, b, 1)
+	}
+	return b.eof
+}
+
+// idempotent is middleware making writes sent with an Idempotency-Key
+// safe to retry. The response to the first request with a key is kept for
+// IdempotencyWindow, through the Driver with a TTL, and sent again for
+// every retry with the same key, method, path and body; a retry with
+// anything else gets 422, and one made while the first is still being
+// served gets 409. Server errors are not kept, so that the retry runs
+// again. Keys are scoped to the API key presented. The body is hashed as the
+// handler streams it, so the response to a request whose body the handler
+// did not read to the end is not kept either.
+func (h *Handler) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idemKey := r.Header.Get(IdempotencyKeyHeader)
+		if idemKey == "" || h.IdempotencyWindow <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(idemKey) > maxIdempotencyKeyLen {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, IdempotencyKeyHeader+" is too long")
+			return
+		}
+
+		request := sha256.New()
+		io.WriteString(request, r.Method+" "+r.URL.RequestURI()+"\n")
+
+		scope := sha256.Sum256([]byte(apiKey(r) + "\n" + idemKey))
+		key := IdempotencyNamespace + db.NamespaceSeparator + hex.EncodeToString(scope[:])
+		if !h.idempotencyLocks.acquire(key) {
+			writeError(w, r, http.StatusConflict, CodeIdempotencyInFlight, "a request with this "+IdempotencyKeyHeader+" is still being served")
+			return
+		}
+		defer h.idempotencyLocks.release(key)
+
+		stored, err := h.driver.GetReserved(key)
+		switch {
+		case err == nil:
+			var rec idempotencyRecord
+			if err := json.Unmarshal(stored, &rec); err != nil {
+				writeDriverError(w, r, err)
+				return
+			}
+			if _, err := io.Copy(request, r.Body); err != nil {
+				writeError(w, r, http.StatusBadRequest, CodeInvalidValue, "failed to read the request body")
+				return
+			}
+			if rec.Request != hex.EncodeToString(request.Sum(nil)) {
+				writeError(w, r, http.StatusUnprocessableEntity, CodeIdempotencyMismatch, IdempotencyKeyHeader+" was already used for a different request")
+				return
+			}
+			for name, values := range rec.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+			return
+		case !errors.Is(err, db.ErrKeyNotFound):
+			writeDriverError(w, r, err)
+			return
+		}
+
+		body := &hashingBody{ReadCloser: r.Body, hash: request}
+		r.Body = body
+		rw := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= http.StatusInternalServerError || !body.finish() {
+			return
+		}
+		rec := idempotencyRecord{Request: hex.EncodeToString(request.Sum(nil)), Status: status, Header: w.Header().Clone(), Body: rw.body.Bytes()}
+		rec.Header.Del(RequestIDHeader)
+		value, _ := json.Marshal(rec)
+		if err := h.driver.PutReserved(key, value, h.IdempotencyWindow); err != nil {
+			// The write itself went through; only its replay is lost
+			h.driver.Logger().Warn("Failed to keep the response for %s: %v", IdempotencyKeyHeader, err)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// key64Prefix is the route prefix for keys given as URL-safe base64
+const key64Prefix = "/key64/"
+
+// decodeKey64 decodes a URL-safe base64 key, with or without padding
+func decodeKey64(s string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// encodeKey64 encodes a key in unpadded URL-safe base64
+func encodeKey64(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// displayKey returns a printable form of a key. Keys that are printable UTF-8
+// are returned as they are; anything else is escaped like a Go string literal.
+func displayKey(key string) string {
+	if utf8.ValidString(key) && strings.IndexFunc(key, func(r rune) bool { return !unicode.IsPrint(r) }) < 0 {
+		return key
+	}
+	quoted := strconv.Quote(key)
+	return quoted[1 : len(quoted)-1]
+}
+
+// key64 is middleware decoding the base64 key parameter of /key64 routes
+// in place, so the regular key handlers and validKey see the raw key
+func key64(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := decodeKey64(r.PathValue("key"))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidKey, "key is not valid URL-safe base64")
+			return
+		}
+		r.SetPathValue("key", key)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// keyLocation returns the URL of a key on the same family of routes the
+// request used, under the same base path
+func keyLocation(r *http.Request, key string) string {
+	route := routeFrom(r)
+	if base, ok := strings.CutSuffix(route, key64Prefix+":key"); ok {
+		return base + key64Prefix + encodeKey64(key)
+	}
+	return strings.TrimSuffix(route, "/key/:key") + "/key/" + url.PathEscape(key)
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// APIKey is one entry of an API key file. A key with neither Namespaces nor
+// Prefixes may use every key; one with either may only use the keys in them,
+// cannot use admin routes and is refused by the gRPC and RESP servers.
+type APIKey struct {
+	Key        string   `json:"key"`
+	Role       Role     `json:"role"`
+	Namespaces []string `json:"namespaces,omitempty"` // each allows the keys "<namespace>:*"
+	Prefixes   []string `json:"prefixes,omitempty"`   // each allows the keys starting with it
+}
+
+// ReadAPIKeyFile reads an API key file, a JSON array of APIKey entries such
+// as [{"key": "s3cret", "role": "write", "namespaces": ["billing"]}]
+func ReadAPIKeyFile(path string) ([]APIKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid API key file %s: %w", path, err)
+	}
+	if _, err := grants(keys); err != nil {
+		return nil, fmt.Errorf("invalid API key file %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// grants checks API key file entries and turns them into what Auth looks up
+func grants(keys []APIKey) (map[[sha256.Size]byte]grant, error) {
+	out := make(map[[sha256.Size]byte]grant, len(keys))
+	for i, k := range keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("entry %d has no key", i+1)
+		}
+		if k.Role == 0 {
+			return nil, fmt.Errorf("entry %d has no role", i+1)
+		}
+		hash := sha256.Sum256([]byte(k.Key))
+		if _, dup := out[hash]; dup {
+			return nil, fmt.Errorf("entry %d repeats an earlier key", i+1)
+		}
+
+		g := grant{role: k.Role}
+		if len(k.Namespaces) > 0 || len(k.Prefixes) > 0 {
+			prefixes := append([]string{}, k.Prefixes...)
+			for _, ns := range k.Namespaces {
+				if ns == "" || strings.Contains(ns, db.NamespaceSeparator) {
+					return nil, fmt.Errorf("entry %d has invalid namespace %q", i+1, ns)
+				}
+				prefixes = append(prefixes, ns+db.NamespaceSeparator)
+			}
+			for _, p := range prefixes {
+				if p == "" {
+					return nil, fmt.Errorf("entry %d has an empty prefix; leave out prefixes for a key that may use every key", i+1)
+				}
+			}
+			g.scope = newScope(prefixes)
+		}
+		out[hash] = g
+	}
+	return out, nil
+}
+
+// LoadAuthFile creates an Auth accepting the keys in an API key file, as
+// read by ReadAPIKeyFile. Unlike NewAuth's, it requires an API key even
+// while the file lists none.
+func LoadAuthFile(path string) (*Auth, error) {
+	a := &Auth{path: path}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reload reads the API key file again, keeping the keys loaded before when
+// it cannot be read or is invalid. Requests already authorized are not
+// affected.
+func (a *Auth) Reload() error {
+	a.reloading.Lock()
+	defer a.reloading.Unlock()
+	return a.reload()
+}
+
+// reload is Reload with a.reloading held
+func (a *Auth) reload() error {
+	if a.path == "" {
+		return fmt.Errorf("API keys were not loaded from a file")
+	}
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	keys, err := ReadAPIKeyFile(a.path)
+	if err != nil {
+		return err
+	}
+	loaded, _ := grants(keys) // checked by ReadAPIKeyFile
+	a.keys.Store(&loaded)
+	a.modTime, a.fileSize = info.ModTime(), info.Size()
+	return nil
+}
+
+// WatchFile reloads the API key file whenever its modification time or size
+// changes, checking every interval until ctx is done. Reloads and the
+// errors of failed ones are logged.
+func (a *Auth) WatchFile(ctx context.Context, every time.Duration, log db.Logger) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	var failing string // the last error logged, to log it once
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		a.reloading.Lock()
+		info, err := os.Stat(a.path)
+		if err == nil && (!info.ModTime().Equal(a.modTime) || info.Size() != a.fileSize) {
+			if err = a.reload(); err == nil {
+				log.Info("Reloaded %d API keys from %s", len(*a.keys.Load()), a.path)
+			}
+		}
+		a.reloading.Unlock()
+		if err != nil && err.Error() != failing {
+			log.Error("Failed to reload API keys, keeping the previous ones: %v", err)
+		}
+		failing = ""
+		if err != nil {
+			failing = err.Error()
+		}
+	}
+}
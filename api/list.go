@@ -0,0 +1,199 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listedKey is one entry of a key listing. Key is meant for display; KeyB64
+// is the exact key and can be used with the /key64 routes.
+type listedKey struct {
+	Key    string `json:"key"`
+	KeyB64 string `json:"key_b64"`
+}
+
+// ListKeys serves GET /keys?prefix=&limit=&order=&cursor=, returning keys in
+// key order, or reverse key order with order=desc. When more keys may follow,
+// "next" holds an opaque cursor for the following page; keys written after
+// the listing began may or may not appear on later pages. To start part way
+// through, after= takes a key in URL-safe base64, as in key_b64. With
+// label=name=value, repeated or comma-separated, only the keys having every
+// label given are listed, and with filter= only those whose values match
+// the filter expression, see db.Filter.
+func (h *Handler) ListKeys(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+			return
+		}
+		limit = n
+	}
+
+	var desc bool
+	switch r.URL.Query().Get("order") {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "order must be asc or desc")
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	var after string
+	cursor, start := r.URL.Query().Get("cursor"), r.URL.Query().Get("after")
+	switch {
+	case cursor != "" && start != "":
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "cursor and after cannot be combined")
+		return
+	case cursor != "":
+		key, err := h.decodeCursor(cursor, prefix, desc)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, err.Error())
+			return
+		}
+		after = key
+	case start != "":
+		key, err := decodeKey64(start)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "after must be a key in URL-safe base64")
+			return
+		}
+		after = key
+	}
+
+	// A scoped API key only sees its own prefixes, listed one after another
+	prefixes := requestScope(r).narrow(prefix)
+	if selectors := r.URL.Query()["label"]; len(selectors) > 0 {
+		keys, err := h.labelKeys(prefixes, selectors, after, desc, limit, filter)
+		if err != nil {
+			writeDriverError(w, r, err)
+			return
+		}
+		h.writeKeys(w, r, keys, prefix, desc, limit)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.ScanTimeout)
+	defer cancel()
+
+	keys := []string{}
+	if desc {
+		slices.Reverse(prefixes)
+	}
+	for _, p := range prefixes {
+		var more []string
+		var err error
+		if desc {
+			more, err = h.driver.ListDescMatching(ctx, p, after, limit-len(keys), filter)
+		} else {
+			more, err = h.driver.ListMatching(ctx, p, after, limit-len(keys), filter)
+		}
+		if err != nil {
+			writeDriverError(w, r, err)
+			return
+		}
+		if keys = append(keys, more...); len(keys) == limit {
+			break
+		}
+	}
+	h.writeKeys(w, r, keys, prefix, desc, limit)
+}
+
+// writeKeys writes a page of a key listing, with a cursor for the next one
+// when it is full
+func (h *Handler) writeKeys(w http.ResponseWriter, r *http.Request, keys []string, prefix string, desc bool, limit int) {
+	listed := make([]listedKey, len(keys))
+	for i, key := range keys {
+		listed[i] = listedKey{Key: displayKey(key), KeyB64: encodeKey64(key)}
+	}
+	resp := jsonObject{"keys": listed}
+	if len(keys) == limit {
+		resp["next"] = h.encodeCursor(prefix, desc, keys[len(keys)-1])
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// labelKeys returns up to limit keys, in the order of the listing, having
+// every label selectors give, starting with one of prefixes and with values
+// filter matches, after after unless it is empty
+func (h *Handler) labelKeys(prefixes, selectors []string, after string, desc bool, limit int, filter *db.Filter) ([]string, error) {
+	selector, err := parseSelector(selectors)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := h.driver.QueryByLabel(selector, 0)
+	if err != nil {
+		return nil, err
+	}
+	if desc {
+		slices.Reverse(matches)
+	}
+
+	keys := []string{}
+	for _, key := range matches {
+		if after != "" && (key == after || (key < after) != desc) {
+			continue
+		}
+		if !slices.ContainsFunc(prefixes, func(p string) bool { return strings.HasPrefix(key, p) }) {
+			continue
+		}
+		if ok, err := h.driver.Matches(key, filter); err != nil {
+			return nil, err
+		} else if !ok {
+			continue
+		}
+		if keys = append(keys, key); len(keys) == limit {
+			break
+		}
+	}
+	return keys, nil
+}
+
+// parseFilter parses the filter= query parameter of a scan, returning nil
+// when there is none
+func parseFilter(r *http.Request) (*db.Filter, error) {
+	expr := r.URL.Query().Get("filter")
+	if expr == "" {
+		return nil, nil
+	}
+	return db.ParseFilter(expr)
+}
+
+// parseSelector parses label= query values, each holding one or more
+// comma-separated name=value labels
+func parseSelector(selectors []string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, s := range selectors {
+		for _, label := range strings.Split(s, ",") {
+			name, value, ok := strings.Cut(label, "=")
+			if !ok {
+				return nil, fmt.Errorf("%w: label %q must be name=value", db.ErrInvalidLabels, label)
+			}
+			if v, dup := selector[name]; dup && v != value {
+				return nil, fmt.Errorf("%w: label %q is given twice", db.ErrInvalidLabels, name)
+			}
+			selector[name] = value
+		}
+	}
+	return selector, nil
+}
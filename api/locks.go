@@ -0,0 +1,113 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// Error codes of the lock endpoints
+const (
+	CodeLockHeld    = "LOCK_HELD"
+	CodeLockNotHeld = "LOCK_NOT_HELD"
+)
+
+type lockRequest struct {
+	Token      string `json:"token"`
+	TTLSeconds *int64 `json:"ttl_seconds"`
+}
+
+// lockLease reads the lease of a lock request, answering 400 when it is
+// missing or not positive, and reports whether it was valid
+func lockLease(w http.ResponseWriter, r *http.Request, req lockRequest) (time.Duration, bool) {
+	if req.TTLSeconds == nil || *req.TTLSeconds <= 0 {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidTTL, "ttl_seconds must be a positive integer")
+		return 0, false
+	}
+	return time.Duration(*req.TTLSeconds) * time.Second, true
+}
+
+// AcquireLock serves POST /locks/:name with {"ttl_seconds": N}, taking the
+// lock for N seconds and answering 201 with the token that renews and
+// releases it. A lock someone else holds is not waited for: it answers 409
+// LOCK_HELD, with the seconds the holder has left in ttl_seconds and
+// Retry-After.
+func (h *Handler) AcquireLock(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !checkScope(w, r, name) {
+		return
+	}
+	var req lockRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "the body must be {\"ttl_seconds\": N}")
+		return
+	}
+	ttl, ok := lockLease(w, r, req)
+	if !ok {
+		return
+	}
+
+	token, err := h.driver.AcquireLock(name, ttl)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, jsonObject{"name": name, "token": token, "ttl_seconds": *req.TTLSeconds})
+}
+
+// RenewLock serves POST /locks/:name/renew with {"token": T, "ttl_seconds":
+// N}, extending the lease of the lock held with T to N seconds from now. It
+// answers 409 LOCK_NOT_HELD when the lock is not held with T.
+func (h *Handler) RenewLock(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !checkScope(w, r, name) {
+		return
+	}
+	var req lockRequest
+	if err := decodeJSON(r, &req); err != nil || req.Token == "" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "the body must be {\"token\": T, \"ttl_seconds\": N}")
+		return
+	}
+	ttl, ok := lockLease(w, r, req)
+	if !ok {
+		return
+	}
+
+	if err := h.driver.RenewLock(name, req.Token, ttl); err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReleaseLock serves POST /locks/:name/release with {"token": T}, freeing
+// the lock held with T. It answers 409 LOCK_NOT_HELD when the lock is not
+// held with T, as when its lease ran out and someone else took it.
+func (h *Handler) ReleaseLock(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !checkScope(w, r, name) {
+		return
+	}
+	var req lockRequest
+	if err := decodeJSON(r, &req); err != nil || req.Token == "" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "the body must be {\"token\": T}")
+		return
+	}
+
+	if err := h.driver.ReleaseLock(name, req.Token); err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lockHeldSeconds returns the whole seconds a held lock has left, rounded
+// up, or -1 for a lock that does not expire
+func lockHeldSeconds(e *db.LockHeldError) int64 {
+	if e.TTL == db.NoTTL {
+		return -1
+	}
+	return int64(math.Ceil(e.TTL.Seconds()))
+}
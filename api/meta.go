@@ -0,0 +1,71 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// keyMeta is the JSON body of GET /key/:key/meta
+type keyMeta struct {
+	Key          string     `json:"key"`
+	Size         int64      `json:"size"`
+	ContentType  string     `json:"content_type,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+	ETag         string     `json:"etag"`
+	Revision     uint64     `json:"revision"`
+	TTLSeconds   int64      `json:"ttl_seconds"` // -1 when the key does not expire
+	Cached       bool       `json:"cached"`
+
+	Labels map[string]string `json:"labels,omitempty"` // see db.Driver.PutWithLabels
+}
+
+// quoteETag formats a content hash as an HTTP entity tag
+func quoteETag(hash string) string {
+	return `"` + hash + `"`
+}
+
+// utcOrNil returns t in UTC, or nil for the zero time
+func utcOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// GetMeta serves GET /key/:key/meta, describing a value without sending it
+func (h *Handler) GetMeta(w http.ResponseWriter, r *http.Request) {
+	info, err := h.driver.Stat(r.PathValue("key"))
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+
+	meta := keyMeta{
+		Key:         info.Key,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		ETag:        quoteETag(info.ETag),
+		Revision:    info.Revision,
+		TTLSeconds:  -1,
+		Cached:      info.Cached,
+		Labels:      info.Labels,
+	}
+	meta.CreatedAt = utcOrNil(info.CreatedAt)
+	meta.UpdatedAt = utcOrNil(info.UpdatedAt)
+	meta.LastModified = meta.UpdatedAt
+	if meta.LastModified == nil {
+		meta.LastModified = utcOrNil(info.ModTime)
+	}
+	if info.TTL != db.NoTTL {
+		meta.TTLSeconds = int64(math.Ceil(info.TTL.Seconds()))
+	}
+
+	setRevisionHeader(w, info.Revision)
+	writeJSON(w, http.StatusOK, meta)
+}
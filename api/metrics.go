@@ -0,0 +1,35 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Metrics serves GET /metrics in the Prometheus text format. Only counters
+// that are cheap to read are included, so it can be scraped often; /stats
+// has the rest.
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	cache := h.driver.CacheStats()
+	ops := h.driver.OpStats()
+
+	var b strings.Builder
+	metric := func(name, typ, help string, value interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+	}
+	metric("zephyrus_cache_values", "gauge", "Values held in the LRU cache.", cache.Values)
+	metric("zephyrus_cache_capacity", "gauge", "Values the LRU cache can hold.", cache.Capacity)
+	metric("zephyrus_cache_evictions_total", "counter", "Values evicted from the LRU cache to make room for others.", cache.Evictions)
+	metric("zephyrus_cache_evicted_bytes_total", "counter", "Bytes of values evicted from the LRU cache.", cache.EvictedBytes)
+	metric("zephyrus_puts_total", "counter", "Keys written.", ops.Puts)
+	metric("zephyrus_gets_total", "counter", "Keys read.", ops.Gets)
+	metric("zephyrus_deletes_total", "counter", "Keys deleted.", ops.Deletes)
+	metric("zephyrus_bytes_written_total", "counter", "Bytes of values written.", ops.BytesWritten)
+	metric("zephyrus_bytes_read_total", "counter", "Bytes of values read.", ops.BytesRead)
+	metric("zephyrus_panics_total", "counter", "Requests that panicked and were answered with a 500.", h.panics.Load())
+	metric("zephyrus_seq", "counter", "Sequence number of the latest change.", h.driver.Seq())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
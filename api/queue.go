@@ -0,0 +1,46 @@
+package api
+
+import (
+	"io"
+	"net/http"
+)
+
+// Error codes of the list endpoints
+const (
+	CodeNotList   = "NOT_A_LIST"
+	CodeListEmpty = "LIST_EMPTY"
+)
+
+// ListPush serves POST /key/:key/push with a JSON value as the body, adding
+// it to the end of the JSON array stored at the key, or to its start with
+// front=true, and answering {"length": N}. A missing key is created; a value
+// that is not an array gets 422 NOT_A_LIST.
+func (h *Handler) ListPush(w http.ResponseWriter, r *http.Request) {
+	element, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidValue, "failed to read the request body")
+		return
+	}
+
+	n, err := h.driver.ListPush(r.PathValue("key"), element, r.URL.Query().Get("front") == "true")
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"length": n})
+}
+
+// ListPop serves POST /key/:key/pop, removing the last element of the JSON
+// array stored at the key, or its first with front=true, and answering with
+// it as the body. An empty array gets 409 LIST_EMPTY and a value that is not
+// an array 422 NOT_A_LIST.
+func (h *Handler) ListPop(w http.ResponseWriter, r *http.Request) {
+	element, err := h.driver.ListPop(r.PathValue("key"), r.URL.Query().Get("front") == "true")
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(element)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"fmt"
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"net/http"
+	"runtime/debug"
+)
+
+// recovery returns middleware that turns a panic in a handler, or in the
+// Driver call it made, into a 500 with the error envelope, so that one bad
+// request cannot take the server down. The panic and its stack are logged
+// through the driver's logger as one entry and counted in /stats and
+// /metrics.
+func (h *Handler) recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := newResponseWriter(w)
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// Raised on purpose to drop the connection
+				panic(p)
+			}
+			h.panics.Add(1)
+
+			id := requestIDFrom(r)
+			stack := string(debug.Stack())
+			log := h.driver.Logger()
+			if fl, ok := log.(db.FieldLogger); ok {
+				fl.LogFields(db.LevelError, "Recovered from a panic", "request_id", id, "method", r.Method, "route", routeFrom(r), "panic", fmt.Sprint(p), "stack", stack)
+			} else {
+				log.Error("Recovered from a panic serving %s %s (request %s): %v\n%s", r.Method, routeFrom(r), id, p, stack)
+			}
+
+			// Once the response has started there is no envelope to send
+			if rw.Written() {
+				return
+			}
+			writeError(rw, r, http.StatusInternalServerError, CodeInternal, "internal error")
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// Headers describing the change log a feed or snapshot belongs to
+const (
+	ReplicationIDHeader  = "X-Replication-ID"
+	ReplicationSeqHeader = "X-Replication-Seq"
+)
+
+// feedBatch is how many changes are read from the log at a time
+const feedBatch = 500
+
+// ChangeFeed serves GET /replication/feed?after=N&id=ID as an NDJSON stream
+// of db.Change records, starting after change N and following new changes
+// as they are made. Idle streams get a {"seq": N} line carrying the latest
+// sequence number every heartbeat. When id is not this server's replication
+// ID, or the changes after N have been dropped from the log, the response is
+// 410 and the replica has to load /replication/snapshot first.
+func (h *Handler) ChangeFeed(w http.ResponseWriter, r *http.Request) {
+	after, err := strconv.ParseUint(queryDefault(r, "after", "0"), 10, 64)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "after must be a sequence number")
+		return
+	}
+	if id := r.URL.Query().Get("id"); id != "" && id != h.driver.ReplicationID() {
+		writeError(w, r, http.StatusGone, CodeResyncRequired, "replication ID changed, load a snapshot")
+		return
+	}
+
+	changes, wake, err := h.driver.Changes(after, feedBatch)
+	if errors.Is(err, db.ErrChangesTruncated) {
+		writeError(w, r, http.StatusGone, CodeResyncRequired, "changes are no longer available, load a snapshot")
+		return
+	}
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set(ReplicationIDHeader, h.driver.ReplicationID())
+	w.Header().Set(ReplicationSeqHeader, strconv.FormatUint(h.driver.Seq(), 10))
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	enc := json.NewEncoder(w)
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		for _, change := range changes {
+			if err := enc.Encode(change); err != nil {
+				return
+			}
+			after = change.Seq
+		}
+		flush(w)
+
+		if len(changes) == 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-h.shutdown:
+				return
+			case <-wake:
+			case <-heartbeat.C:
+				if err := enc.Encode(db.Change{Seq: h.driver.Seq(), Time: time.Now()}); err != nil {
+					return
+				}
+				flush(w)
+			}
+		}
+
+		// Once streaming has started errors can only end the stream; the
+		// replica reconnects and asks again
+		changes, wake, err = h.driver.Changes(after, feedBatch)
+		if err != nil {
+			h.logStreamError(r, err)
+			return
+		}
+	}
+}
+
+// Snapshot serves GET /replication/snapshot as an NDJSON stream with a put
+// for every key, ending in a {"seq": N} line. Once it has loaded the
+// snapshot, the replica follows the change feed from N with the replication
+// ID given in the response headers. A stream without the final line was cut
+// short.
+func (h *Handler) Snapshot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(ReplicationIDHeader, h.driver.ReplicationID())
+	w.WriteHeader(http.StatusOK)
+
+	out := &flushWriter{w: w, resp: w}
+	enc := json.NewEncoder(out)
+	seq, err := h.driver.Snapshot(func(change db.Change) error {
+		return enc.Encode(change)
+	})
+	if err != nil {
+		h.logStreamError(r, err)
+		return
+	}
+	if err := enc.Encode(db.Change{Seq: seq, Time: time.Now()}); err != nil {
+		h.logStreamError(r, err)
+	}
+}
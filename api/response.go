@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// jsonObject is a JSON object built on the fly for a response
+type jsonObject map[string]interface{}
+
+// contextKey keys the values the middleware keeps in a request's context
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota // the request ID, see requestID
+	scopeKey                       // the scope of a scoped API key, see require
+	routeKey                       // the route matched, such as "/key/:key"
+)
+
+// requestIDFrom returns the request's ID, empty outside the middleware
+func requestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// routeFrom returns the route the request matched, under its base path and
+// with parameters written as :name, empty for unknown routes
+func routeFrom(r *http.Request) string {
+	route, _ := r.Context().Value(routeKey).(string)
+	return route
+}
+
+// withValue returns r with key set to value in its context
+func withValue(r *http.Request, key contextKey, value interface{}) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), key, value))
+}
+
+// writeJSON writes v as the JSON body of a response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// decodeJSON decodes the JSON body of a request into v
+func decodeJSON(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return errors.New("missing request body")
+	}
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// contentType returns the media type of the request body, without its
+// parameters
+func contentType(r *http.Request) string {
+	mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";")
+	return strings.TrimSpace(mediaType)
+}
+
+// queryDefault returns the query parameter name, or def when it is absent.
+// A parameter given empty is returned as it is.
+func queryDefault(r *http.Request, name, def string) string {
+	if values, ok := r.URL.Query()[name]; ok {
+		return values[0]
+	}
+	return def
+}
+
+// flush sends what has been written of the response so far
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// responseWriter records the status of a response, for the middleware
+// reporting on it once the handler returns
+type responseWriter struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if !w.written {
+		w.status, w.written = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Status returns the status sent, 200 when none was set explicitly
+func (w *responseWriter) Status() int { return w.status }
+
+// Written reports whether the status has been sent
+func (w *responseWriter) Written() bool { return w.written }
+
+func (w *responseWriter) Flush() {
+	w.written = true
+	flush(w.ResponseWriter)
+}
+
+// Hijack hands the connection over for /ws
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// Unwrap gives http.ResponseController the writer underneath
+func (w *responseWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
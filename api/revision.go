@@ -0,0 +1,81 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// RevisionHeader carries the revision of a key in responses to GET and PUT
+const RevisionHeader = "X-Zephyrus-Revision"
+
+// IfMatchRevisionHeader makes PUT and DELETE fail with 412 unless the key is
+// at the revision given, 0 for a key that must not exist
+const IfMatchRevisionHeader = "If-Match-Revision"
+
+// parseRevisionHeader reads the If-Match-Revision header, returning
+// db.AnyRevision when it is absent
+func parseRevisionHeader(r *http.Request) (uint64, error) {
+	raw := r.Header.Get(IfMatchRevisionHeader)
+	if raw == "" {
+		return db.AnyRevision, nil
+	}
+	rev, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || rev == db.AnyRevision {
+		return 0, fmt.Errorf("%s must be a revision number", IfMatchRevisionHeader)
+	}
+	return rev, nil
+}
+
+// parseIfMatch reads the If-Match header, giving the content hash its entity
+// tag names or db.AnyETag for "*", and "" when it is absent. Only one strong
+// entity tag is taken, as ETags are only ever sent one at a time.
+func parseIfMatch(r *http.Request) (string, error) {
+	raw := strings.TrimSpace(r.Header.Get("If-Match"))
+	if raw == "" || raw == db.AnyETag {
+		return raw, nil
+	}
+	if len(raw) < 3 || raw[0] != '"' || raw[len(raw)-1] != '"' || strings.ContainsAny(raw[1:len(raw)-1], `",`) {
+		return "", fmt.Errorf("If-Match must be \"*\" or a single quoted ETag")
+	}
+	return raw[1 : len(raw)-1], nil
+}
+
+// parsePreconditions reads the If-Match-Revision and If-Match headers of a
+// write, which cannot both be given
+func parsePreconditions(r *http.Request) (uint64, string, error) {
+	rev, err := parseRevisionHeader(r)
+	if err != nil {
+		return 0, "", err
+	}
+	etag, err := parseIfMatch(r)
+	if err != nil {
+		return 0, "", err
+	}
+	if etag != "" && rev != db.AnyRevision {
+		return 0, "", fmt.Errorf("If-Match and %s cannot be used together", IfMatchRevisionHeader)
+	}
+	return rev, etag, nil
+}
+
+// parseIfUnmodifiedSince reads the If-Unmodified-Since header. As RFC 7232
+// requires, it is ignored when it is not a valid HTTP date, and when the
+// request has If-Match, or If-Match-Revision, which validates more exactly.
+func parseIfUnmodifiedSince(r *http.Request) (time.Time, bool) {
+	if r.Header.Get("If-Match") != "" || r.Header.Get(IfMatchRevisionHeader) != "" {
+		return time.Time{}, false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+	return since, err == nil
+}
+
+// setRevisionHeader reports a key's revision, when it is known
+func setRevisionHeader(w http.ResponseWriter, rev uint64) {
+	if rev != 0 {
+		w.Header().Set(RevisionHeader, strconv.FormatUint(rev, 10))
+	}
+}
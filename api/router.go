@@ -1,16 +1,227 @@
 package api
 
 import (
-	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
 )
 
-// InitRouter initializes and returns the Gin Engine with configured routes
-func InitRouter(handler *Handler) *gin.Engine {
-	router := gin.Default()
+// RouteGroups selects which routes are registered, see WithRoutes
+type RouteGroups uint8
 
-	router.PUT("/key/:key", handler.PutValue)
-	router.GET("/key/:key", handler.GetValue)
-	router.DELETE("/key/:key", handler.DeleteValue)
+const (
+	// DataRoutes are the routes reading and writing keys, including the
+	// change feeds, import and export
+	DataRoutes RouteGroups = 1 << iota
+	// AdminRoutes are the routes under /admin/
+	AdminRoutes
+	// MetricsRoutes are /readyz, /stats and /metrics
+	MetricsRoutes
 
-	return router
+	AllRoutes = DataRoutes | AdminRoutes | MetricsRoutes
+)
+
+// RouterOption changes what NewMux, InitRouter and Register set up
+type RouterOption func(*routerOptions)
+
+type routerOptions struct {
+	engine     http.Handler // a *gin.Engine, see WithEngine
+	basePath   string
+	middleware []func(http.Handler) http.Handler
+	routes     RouteGroups
+}
+
+// WithBasePath mounts the routes under path, such as "/db"
+func WithBasePath(path string) RouterOption {
+	return func(o *routerOptions) { o.basePath = strings.TrimSuffix(path, "/") }
+}
+
+// WithMiddleware runs middleware on every route, after the request ID,
+// panic recovery and tracing and before authentication. The first one given
+// runs first.
+func WithMiddleware(middleware ...func(http.Handler) http.Handler) RouterOption {
+	return func(o *routerOptions) { o.middleware = append(o.middleware, middleware...) }
+}
+
+// WithRoutes registers only the given groups of routes, by default all
+func WithRoutes(groups RouteGroups) RouterOption {
+	return func(o *routerOptions) { o.routes = groups }
+}
+
+func newRouterOptions(opts []RouterOption) routerOptions {
+	o := routerOptions{routes: AllRoutes}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// NewMux returns a ServeMux serving the routes, for applications without
+// gin. It answers as the gin engine of InitRouter does, the error envelope
+// included; WithEngine is ignored. Build with the nogin tag to leave gin out
+// of the binary altogether.
+//
+// ServeMux cleans paths before matching them, so a path with a literal "."
+// or ".." segment is redirected instead of being refused as a key, as it
+// would be escaped.
+func NewMux(handler *Handler, opts ...RouterOption) *http.ServeMux {
+	o := newRouterOptions(opts)
+	mux := http.NewServeMux()
+	paths := make(map[string]bool)
+	for _, rt := range handler.routes(o.routes) {
+		route := o.basePath + rt.path
+		pattern := muxPattern(route)
+		mux.Handle(rt.method+" "+pattern, withRoute(route, handler.wrap(chain(rt.handler, o.middleware...))))
+
+		// A pattern without a method catches the methods not registered
+		if !paths[pattern] {
+			paths[pattern] = true
+			mux.Handle(pattern, handler.wrap(http.HandlerFunc(noMethod)))
+		}
+	}
+	mux.Handle("/", handler.wrap(noRoute(o.basePath)))
+	return mux
+}
+
+// muxPattern rewrites the :name parameters of a route as ServeMux's {name}
+func muxPattern(route string) string {
+	segments := strings.Split(route, "/")
+	for i, s := range segments {
+		if name, ok := strings.CutPrefix(s, ":"); ok {
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// withRoute tells the middleware and handlers which route a request matched
+func withRoute(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, withValue(r, routeKey, route))
+	})
+}
+
+// wrap puts handler behind the middleware every request goes through, known
+// route or not: the request ID, panic recovery and tracing
+func (h *Handler) wrap(handler http.Handler) http.Handler {
+	if h.TracerProvider != nil {
+		handler = tracing(h.TracerProvider)(handler)
+	}
+	return requestID(h.recovery(handler))
+}
+
+// chain puts handler behind middleware, the first of which runs first
+func chain(handler http.Handler, middleware ...func(http.Handler) http.Handler) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// route is one endpoint, its path written with :name parameters as gin does
+type route struct {
+	method  string
+	path    string
+	handler http.Handler
+}
+
+// routes returns the routes in groups, each behind its own middleware, for
+// the adapters to register
+func (h *Handler) routes(groups RouteGroups) []route {
+	var routes []route
+	handle := func(method, path string, handler http.HandlerFunc, middleware ...func(http.Handler) http.Handler) {
+		routes = append(routes, route{method: method, path: path, handler: chain(handler, middleware...)})
+	}
+	read := h.require(RoleRead)
+	write := h.require(RoleWrite)
+	admin := h.require(RoleAdmin)
+	readTimeout := h.timeout(false)
+	writeTimeout := h.timeout(true)
+
+	if groups&DataRoutes != 0 {
+		handle(http.MethodPut, "/key/:key", h.PutValue, write, writeTimeout, validKey, h.idempotent)
+		handle(http.MethodGet, "/key/:key", h.GetValue, read, readTimeout, validKey)
+		handle(http.MethodDelete, "/key/:key", h.DeleteValue, write, writeTimeout, validKey)
+		handle(http.MethodPost, "/key/:key/expire", h.Expire, write, validKey)
+		handle(http.MethodGet, "/key/:key/ttl", h.GetTTL, read, validKey)
+		handle(http.MethodGet, "/key/:key/meta", h.GetMeta, read, validKey)
+		handle(http.MethodPost, "/key/:key/push", h.ListPush, write, writeTimeout, validKey)
+		handle(http.MethodPost, "/key/:key/pop", h.ListPop, write, writeTimeout, validKey)
+		handle(http.MethodPost, "/key/:key/add", h.SetAdd, write, writeTimeout, validKey)
+		handle(http.MethodPost, "/key/:key/remove", h.SetRemove, write, writeTimeout, validKey)
+		handle(http.MethodGet, "/key/:key/contains", h.SetContains, read, readTimeout, validKey)
+		handle(http.MethodPut, "/key/:key/field/:field", h.SetField, write, writeTimeout, validKey)
+		handle(http.MethodGet, "/key/:key/field/:field", h.GetField, read, readTimeout, validKey)
+		handle(http.MethodDelete, "/key/:key/field/:field", h.DeleteField, write, writeTimeout, validKey)
+
+		// The same routes with the key given as URL-safe base64, for keys that
+		// cannot be written in a path, binary keys included when the driver
+		// encodes file names.
+		handle(http.MethodPut, "/key64/:key", h.PutValue, write, writeTimeout, key64, h.validKey64, h.idempotent)
+		handle(http.MethodGet, "/key64/:key", h.GetValue, read, readTimeout, key64, h.validKey64)
+		handle(http.MethodDelete, "/key64/:key", h.DeleteValue, write, writeTimeout, key64, h.validKey64)
+		handle(http.MethodPost, "/key64/:key/expire", h.Expire, write, key64, h.validKey64)
+		handle(http.MethodGet, "/key64/:key/ttl", h.GetTTL, read, key64, h.validKey64)
+		handle(http.MethodGet, "/key64/:key/meta", h.GetMeta, read, key64, h.validKey64)
+		handle(http.MethodPost, "/key64/:key/push", h.ListPush, write, writeTimeout, key64, h.validKey64)
+		handle(http.MethodPost, "/key64/:key/pop", h.ListPop, write, writeTimeout, key64, h.validKey64)
+		handle(http.MethodPost, "/key64/:key/add", h.SetAdd, write, writeTimeout, key64, h.validKey64)
+		handle(http.MethodPost, "/key64/:key/remove", h.SetRemove, write, writeTimeout, key64, h.validKey64)
+		handle(http.MethodGet, "/key64/:key/contains", h.SetContains, read, readTimeout, key64, h.validKey64)
+		handle(http.MethodPut, "/key64/:key/field/:field", h.SetField, write, writeTimeout, key64, h.validKey64)
+		handle(http.MethodGet, "/key64/:key/field/:field", h.GetField, read, readTimeout, key64, h.validKey64)
+		handle(http.MethodDelete, "/key64/:key/field/:field", h.DeleteField, write, writeTimeout, key64, h.validKey64)
+
+		handle(http.MethodGet, "/keys", h.ListKeys, read)
+		handle(http.MethodGet, "/keys/multi", h.MultiGet, read)
+		handle(http.MethodGet, "/count", h.Count, read)
+		handle(http.MethodGet, "/search", h.Search, read)
+		handle(http.MethodPost, "/mget", h.MultiGetPost, read)
+
+		handle(http.MethodGet, "/watch", h.Watch, read)
+		handle(http.MethodGet, "/ws", h.WebSocket, read)
+
+		handle(http.MethodPost, "/locks/:name", h.AcquireLock, write)
+		handle(http.MethodPost, "/locks/:name/renew", h.RenewLock, write)
+		handle(http.MethodPost, "/locks/:name/release", h.ReleaseLock, write)
+
+		handle(http.MethodPost, "/import", h.Import, write, h.idempotent)
+		handle(http.MethodGet, "/export", h.Export, read)
+		handle(http.MethodGet, "/export.csv", h.ExportCSV, read)
+
+		// These reach every key, so scoped API keys cannot use them
+		handle(http.MethodGet, "/changes", h.Changes, read, unscoped)
+		handle(http.MethodGet, "/changes/stream", h.ChangeStream, read, unscoped)
+		handle(http.MethodGet, "/replication/feed", h.ChangeFeed, read, unscoped)
+		handle(http.MethodGet, "/replication/snapshot", h.Snapshot, read, unscoped)
+		handle(http.MethodGet, "/expiring", h.Expiring, read, unscoped)
+	}
+
+	if groups&MetricsRoutes != 0 {
+		// Probes run without an API key
+		handle(http.MethodGet, "/readyz", h.Ready)
+		handle(http.MethodGet, "/stats", h.Stats, read, unscoped)
+		handle(http.MethodGet, "/metrics", h.Metrics, read, unscoped)
+	}
+
+	if groups&AdminRoutes != 0 {
+		handle(http.MethodPost, "/admin/compact", h.Compact, admin)
+		handle(http.MethodPost, "/admin/compact/pause", h.PauseCompaction, admin)
+		handle(http.MethodPost, "/admin/compact/resume", h.ResumeCompaction, admin)
+		handle(http.MethodPost, "/admin/rebalance", h.Rebalance, admin)
+		handle(http.MethodPost, "/admin/verify", h.Verify, admin)
+		handle(http.MethodGet, "/admin/startup-report", h.StartupReport, admin)
+		handle(http.MethodPut, "/admin/loglevel", h.SetLogLevel, admin)
+		handle(http.MethodGet, "/admin/schemas", h.Schemas, admin)
+		handle(http.MethodPut, "/admin/schemas", h.SetSchema, admin)
+		handle(http.MethodDelete, "/admin/schemas", h.DeleteSchema, admin)
+		handle(http.MethodGet, "/admin/quotas", h.Quotas, admin)
+		handle(http.MethodPut, "/admin/quotas", h.SetQuota, admin)
+		handle(http.MethodDelete, "/admin/quotas", h.DeleteQuota, admin)
+		handle(http.MethodGet, "/admin/webhooks", h.ListWebhooks, admin)
+		handle(http.MethodPost, "/admin/webhooks", h.AddWebhook, admin)
+		handle(http.MethodDelete, "/admin/webhooks", h.DeleteWebhook, admin)
+		handle(http.MethodGet, "/admin/snapshots", h.Snapshots, admin)
+		handle(http.MethodPost, "/admin/snapshots/:name/restore", h.RestoreSnapshot, admin)
+	}
+	return routes
 }
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// scope is the sorted key prefixes an API key may use, none a prefix of
+// another
+type scope []string
+
+func newScope(prefixes []string) scope {
+	sort.Strings(prefixes)
+	s := scope{}
+	for _, p := range prefixes {
+		// Sorting puts a prefix right before the ones it covers
+		if len(s) > 0 && strings.HasPrefix(p, s[len(s)-1]) {
+			continue
+		}
+		s = append(s, p)
+	}
+	return s
+}
+
+// allows reports whether a key is in the scope
+func (s scope) allows(key string) bool {
+	for _, p := range s {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// narrow returns the prefixes to scan for the keys starting with prefix that
+// are in the scope, in key order: prefix itself when the scope holds all of
+// them, otherwise the scope's prefixes that start with it, possibly none
+func (s scope) narrow(prefix string) []string {
+	if s == nil || s.allows(prefix) {
+		return []string{prefix}
+	}
+	var out []string
+	for _, p := range s {
+		if strings.HasPrefix(p, prefix) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// requestScope returns the scope of the request's API key, nil when it may
+// use every key
+func requestScope(r *http.Request) scope {
+	s, _ := r.Context().Value(scopeKey).(scope)
+	return s
+}
+
+// checkScope answers 403 when the request's API key may not use key, and
+// reports whether it may
+func checkScope(w http.ResponseWriter, r *http.Request, key string) bool {
+	if s := requestScope(r); s != nil && !s.allows(key) {
+		writeError(w, r, http.StatusForbidden, CodeForbidden, "the API key may not use this key")
+		return false
+	}
+	return true
+}
+
+// checkPrefixScope answers 403 unless the request's API key may use every
+// key starting with prefix, and reports whether it may
+func checkPrefixScope(w http.ResponseWriter, r *http.Request, prefix string) bool {
+	if s := requestScope(r); s != nil && !s.allows(prefix) {
+		writeError(w, r, http.StatusForbidden, CodeForbidden, "the API key may not use every key with this prefix")
+		return false
+	}
+	return true
+}
+
+// unscoped is middleware for routes that reach every key, such as the
+// change feed, rejecting API keys scoped to namespaces with 403
+func unscoped(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestScope(r) != nil {
+			writeError(w, r, http.StatusForbidden, CodeForbidden, "an API key not scoped to namespaces is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// Search serves GET /search?q=refund&limit=, returning the keys whose
+// indexed fields hold every word of q, best matches first, leaving out
+// those outside the scope of the API key. It answers 404 when the server
+// has no text index.
+func (h *Handler) Search(w http.ResponseWriter, r *http.Request) {
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+			return
+		}
+		limit = n
+	}
+
+	keys, err := h.driver.Search(r.URL.Query().Get("q"), limit)
+	if errors.Is(err, db.ErrNoTextIndex) {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "no text index; start the server with -text-index-fields")
+		return
+	}
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+
+	listed := make([]listedKey, 0, len(keys))
+	s := requestScope(r)
+	for _, key := range keys {
+		if s == nil || s.allows(key) {
+			listed = append(listed, listedKey{Key: displayKey(key), KeyB64: encodeKey64(key)})
+		}
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"keys": listed})
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"io"
+	"net/http"
+)
+
+// SetAdd serves POST /key/:key/add with a JSON value as the body, adding it
+// to the set kept at the key as a JSON array unless it is already there,
+// and answering {"added": true} or {"added": false}. A missing key is
+// created; a value that is not an array gets 422 NOT_A_LIST.
+func (h *Handler) SetAdd(w http.ResponseWriter, r *http.Request) {
+	member, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidValue, "failed to read the request body")
+		return
+	}
+	added, err := h.driver.SetAdd(r.PathValue("key"), member)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"added": added})
+}
+
+// SetRemove serves POST /key/:key/remove with a JSON value as the body,
+// removing it from the set kept at the key and answering {"removed": true}
+// or {"removed": false}
+func (h *Handler) SetRemove(w http.ResponseWriter, r *http.Request) {
+	member, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidValue, "failed to read the request body")
+		return
+	}
+	removed, err := h.driver.SetRemove(r.PathValue("key"), member)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"removed": removed})
+}
+
+// SetContains serves GET /key/:key/contains?member=<JSON>, answering
+// {"contains": true} when the set kept at the key holds the member
+func (h *Handler) SetContains(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("member") {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "member is required")
+		return
+	}
+	ok, err := h.driver.SetContains(r.PathValue("key"), []byte(r.URL.Query().Get("member")))
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"contains": ok})
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// sniffLen is how much of a value is inspected to guess its content type
+const sniffLen = 512
+
+var errInvalidJSON = errors.New("invalid JSON value")
+
+// bodyError marks a failure to read the request body, as opposed to a
+// failure to store it
+type bodyError struct {
+	err error
+}
+
+func (e *bodyError) Error() string { return "reading request body: " + e.err.Error() }
+func (e *bodyError) Unwrap() error { return e.err }
+
+type requestBody struct {
+	r io.Reader
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &bodyError{err: err}
+	}
+	return n, err
+}
+
+// validateJSON walks the token stream to check that it holds exactly one JSON
+// value, without decoding the value into memory
+func validateJSON(dec *json.Decoder) error {
+	depth, values := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			if values == 1 {
+				return nil
+			}
+			return errInvalidJSON
+		}
+		if err != nil {
+			var be *bodyError
+			if errors.As(err, &be) {
+				return err
+			}
+			return errInvalidJSON
+		}
+
+		// Anything after the first complete value is trailing garbage
+		if values == 1 {
+			return errInvalidJSON
+		}
+
+		if delim, ok := tok.(json.Delim); ok {
+			if delim == '{' || delim == '[' {
+				depth++
+			} else {
+				depth--
+			}
+		}
+		if depth == 0 {
+			values++
+		}
+	}
+}
+
+// sniffContentType guesses the content type of a value from its first bytes
+// and rewinds it. Small values are checked with json.Valid; larger ones are
+// treated as JSON when they start with an object or array.
+func sniffContentType(r io.ReadSeeker, size int64) (string, error) {
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	buf = buf[:n]
+
+	if size <= sniffLen {
+		return detectContentType(buf), nil
+	}
+
+	if trimmed := bytes.TrimLeft(buf, " \t\r\n"); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return "application/json", nil
+	}
+	return detectContentType(buf), nil
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// timeout returns middleware giving the request's context a deadline of
+// ReadTimeout, or WriteTimeout for write routes, when it is set. The Driver
+// gives up on an operation whose deadline has passed, and the handler
+// answers 503 TIMEOUT through abortWithDriverError.
+//
+// What a timeout leaves behind depends on the verb:
+//   - GET fails when the deadline passes before the value is opened. Once
+//     the value is being sent the status is out, so the body is cut short
+//     instead, which the client sees as a dropped connection.
+//   - PUT fails while the body is streaming in or the write lock is awaited,
+//     and the previous value is kept. Once the value is committed the PUT
+//     succeeds, however late, since the write cannot be taken back.
+//   - DELETE fails when the deadline passes before the write lock is taken,
+//     and nothing is deleted; after that it succeeds.
+func (h *Handler) timeout(write bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := h.ReadTimeout
+			if write {
+				d = h.WriteTimeout
+			}
+			if d <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// deadlineValue is a value whose reads fail once ctx is done, so that a
+// value read from a slow disk stops being sent at the request's deadline
+type deadlineValue struct {
+	db.ValueReader
+	ctx context.Context
+}
+
+func (v deadlineValue) Read(p []byte) (int, error) {
+	if err := v.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return v.ValueReader.Read(p)
+}
+
+// withDeadline returns value with reads bounded by ctx's deadline, or value
+// itself when ctx has none
+func withDeadline(ctx context.Context, value db.ValueReader) db.ValueReader {
+	if _, ok := ctx.Deadline(); !ok {
+		return value
+	}
+	return deadlineValue{ValueReader: value, ctx: ctx}
+}
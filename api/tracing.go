@@ -0,0 +1,50 @@
+package api
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// tracerName identifies the spans the router creates
+const tracerName = "github.com/toblrne/ZephyrusDBv2/api"
+
+// tracing starts a span for every request, continuing the trace named by a
+// W3C traceparent header. Handlers pass the request's context on to the
+// Driver, whose spans become its children.
+func tracing(tp trace.TracerProvider) func(http.Handler) http.Handler {
+	tracer := tp.Tracer(tracerName)
+	propagator := propagation.TraceContext{}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+			// Name the span after the route, not the path, to keep keys out of it
+			route := routeFrom(r)
+			name := r.Method
+			if route != "" {
+				name += " " + route
+			}
+			ctx, span := tracer.Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("http.route", route),
+					attribute.String("zephyrus.request_id", requestIDFrom(r)),
+				))
+			defer span.End()
+
+			rw := newResponseWriter(w)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+
+			status := rw.Status()
+			span.SetAttributes(attribute.Int("http.response.status_code", status))
+			if status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(status))
+			}
+		})
+	}
+}
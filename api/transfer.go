@@ -0,0 +1,154 @@
+package api
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// Import serves POST /import. The body is NDJSON, one {"key", "value"} or
+// {"key", "value_base64"} record per line, optionally gzip-encoded, and is
+// processed as it arrives. ?mode=skip keeps existing keys; the default
+// overwrites them. Records outside the scope of the API key fail.
+func (h *Handler) Import(w http.ResponseWriter, r *http.Request) {
+	var mode db.ImportMode
+	switch queryDefault(r, "mode", "overwrite") {
+	case "overwrite":
+		mode = db.ImportOverwrite
+	case "skip":
+		mode = db.ImportSkip
+	default:
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "mode must be overwrite or skip")
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "invalid gzip body")
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	// Reserved keys hold lock tokens and stored responses, which an import
+	// could forge
+	s := requestScope(r)
+	check := func(key string) error {
+		if db.Reserved(key) {
+			return errors.New("the key is in a reserved namespace")
+		}
+		if s != nil && !s.allows(key) {
+			return errors.New("the API key may not use this key")
+		}
+		return nil
+	}
+	stats, err := h.driver.ImportChecked(body, mode, check)
+	if errors.Is(err, db.ErrReadOnly) {
+		writeDriverError(w, r, err)
+		return
+	}
+	if err != nil {
+		// The upload broke off; report what was imported before it did
+		writeJSON(w, http.StatusBadRequest, jsonObject{
+			"error": errorBody{Code: CodeBadRequest, Message: scrubMessage(err), RequestID: requestIDFrom(r)},
+			"stats": stats,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// exportFlushEvery is how many records are written between flushes
+const exportFlushEvery = 100
+
+// flushWriter flushes the response every few records so the export streams
+// with chunked encoding instead of collecting in a buffer
+type flushWriter struct {
+	w    io.Writer
+	resp http.ResponseWriter // flushed every exportFlushEvery writes
+	n    int
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if f.n++; f.n%exportFlushEvery == 0 {
+		if gz, ok := f.w.(*gzip.Writer); ok {
+			gz.Flush()
+		}
+		flush(f.resp)
+	}
+	return n, err
+}
+
+// Export serves GET /export?prefix= as a streamed application/x-ndjson body
+// ending in a {"summary": {"count": N}} line. Keys outside the scope of the
+// API key are left out. The body is gzip-compressed
+// when ?gzip=true is given or the client accepts gzip.
+func (h *Handler) Export(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	compress := r.URL.Query().Get("gzip") == "true" || strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	var out io.Writer = w
+	if compress {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// Once streaming has started the status can no longer change; a missing
+	// summary line tells the client the export was cut short
+	prefixes := requestScope(r).narrow(r.URL.Query().Get("prefix"))
+	if _, err := h.driver.ExportMatching(&flushWriter{w: out, resp: w}, prefixes, filter); err != nil {
+		h.logStreamError(r, err)
+	}
+}
+
+// SkippedHeader is sent as a trailer after a CSV export with the number of
+// values left out because they are not JSON objects
+const SkippedHeader = "X-Zephyrus-Skipped"
+
+// ExportCSV serves GET /export.csv?prefix=&fields=name,email as a streamed
+// text/csv body with a header row, a key column and one column per field.
+// The number of values skipped for not being JSON objects follows the body
+// in the SkippedHeader trailer.
+func (h *Handler) ExportCSV(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	var fields []string
+	if raw := r.URL.Query().Get("fields"); raw != "" {
+		fields = strings.Split(raw, ",")
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Trailer", SkippedHeader)
+	w.WriteHeader(http.StatusOK)
+
+	// As with Export, a failure after streaming started can only cut the
+	// body short
+	prefixes := requestScope(r).narrow(r.URL.Query().Get("prefix"))
+	stats, err := h.driver.ExportCSVMatching(&flushWriter{w: w, resp: w}, prefixes, fields, filter)
+	if err != nil {
+		h.logStreamError(r, err)
+		return
+	}
+	w.Header().Set(SkippedHeader, strconv.Itoa(stats.Skipped))
+}
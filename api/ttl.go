@@ -0,0 +1,113 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// TTLHeader sets the time-to-live, in seconds, of a value stored with PUT.
+// 0 stores it without an expiry, even when the server has a default TTL.
+const TTLHeader = "X-Zephyrus-TTL"
+
+// parseTTLHeader reads the TTL header, returning 0, for the default TTL,
+// when it is absent and db.NoTTL when it is 0
+func parseTTLHeader(r *http.Request) (time.Duration, error) {
+	raw := r.Header.Get(TTLHeader)
+	if raw == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative number of seconds", TTLHeader)
+	}
+	if seconds == 0 {
+		return db.NoTTL, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+type expireRequest struct {
+	TTLSeconds *int64 `json:"ttl_seconds"`
+}
+
+// Expire serves POST /key/:key/expire with {"ttl_seconds": N}. A ttl of 0
+// removes the expiry.
+func (h *Handler) Expire(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	var req expireRequest
+	if err := decodeJSON(r, &req); err != nil || req.TTLSeconds == nil || *req.TTLSeconds < 0 {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidTTL, "ttl_seconds must be a non-negative integer")
+		return
+	}
+
+	err := h.driver.Expire(key, time.Duration(*req.TTLSeconds)*time.Second)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetTTL serves GET /key/:key/ttl, reporting the remaining time-to-live in
+// seconds or -1 for keys that do not expire
+func (h *Handler) GetTTL(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	ttl, err := h.driver.TTL(key)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+
+	if ttl == db.NoTTL {
+		writeJSON(w, http.StatusOK, jsonObject{"ttl_seconds": -1})
+		return
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"ttl_seconds": int64(math.Ceil(ttl.Seconds()))})
+}
+
+// expiringKey is one entry of GET /expiring
+type expiringKey struct {
+	Key        string `json:"key"`
+	KeyB64     string `json:"key_b64"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+// Expiring serves GET /expiring?within=1h&limit=100, listing the keys that
+// expire within the duration given, soonest first, with their remaining
+// time-to-live in seconds. Keys without an expiry are never listed.
+func (h *Handler) Expiring(w http.ResponseWriter, r *http.Request) {
+	within, err := time.ParseDuration(r.URL.Query().Get("within"))
+	if err != nil || within <= 0 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "within must be a positive duration, such as 90s or 1h")
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+			return
+		}
+		limit = n
+	}
+
+	keys, err := h.driver.ExpiringWithin(within, limit)
+	if err != nil {
+		writeDriverError(w, r, err)
+		return
+	}
+	listed := make([]expiringKey, len(keys))
+	for i, k := range keys {
+		listed[i] = expiringKey{Key: displayKey(k.Key), KeyB64: encodeKey64(k.Key), TTLSeconds: int64(math.Ceil(k.TTL.Seconds()))}
+	}
+	writeJSON(w, http.StatusOK, jsonObject{"keys": listed})
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// watchEvent is the JSON payload of a server-sent change event
+type watchEvent struct {
+	Op        db.Op       `json:"op"`
+	Key       string      `json:"key"`
+	Time      time.Time   `json:"time"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+	Value     *batchValue `json:"value,omitempty"`
+}
+
+func newWatchEvent(ev db.Event, withValue bool) watchEvent {
+	out := watchEvent{Op: ev.Op, Key: ev.Key, Time: ev.Time}
+	if !ev.ExpiresAt.IsZero() {
+		out.ExpiresAt = &ev.ExpiresAt
+	}
+	if withValue && ev.Value != nil {
+		if json.Valid(ev.Value) {
+			out.Value = &batchValue{Encoding: "json", Value: json.RawMessage(ev.Value)}
+		} else {
+			out.Value = &batchValue{Encoding: "base64", Value: base64.StdEncoding.EncodeToString(ev.Value)}
+		}
+	}
+	return out
+}
+
+// Watch serves GET /watch?prefix=foo as a Server-Sent Events stream with one
+// event per Put, Delete or expiry of a matching key. Pass values=true to include new
+// values in put events. A scoped API key may only watch a prefix within its
+// scope.
+func (h *Handler) Watch(w http.ResponseWriter, r *http.Request) {
+	if int(h.watchers.Add(1)) > h.MaxWatchers {
+		h.watchers.Add(-1)
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "too many concurrent watchers")
+		return
+	}
+	defer h.watchers.Add(-1)
+
+	if !checkPrefixScope(w, r, r.URL.Query().Get("prefix")) {
+		return
+	}
+	withValue := r.URL.Query().Get("values") == "true"
+	watcher := h.driver.Watch(r.URL.Query().Get("prefix"))
+	defer watcher.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			// The client went away; the deferred Close unsubscribes
+			return
+
+		case <-h.shutdown:
+			return
+
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				// The driver dropped us for falling behind; the client should reconnect
+				fmt.Fprintf(w, "event: error\ndata: %q\n\n", watcher.Err())
+				flush(w)
+				return
+			}
+			if db.Reserved(ev.Key) {
+				continue
+			}
+			data, err := json.Marshal(newWatchEvent(ev, withValue))
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Op, data)
+			flush(w)
+
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flush(w)
+		}
+	}
+}
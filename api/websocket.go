@@ -0,0 +1,224 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// wsQueueSize bounds the events waiting to be written to one WebSocket
+// client. A client that lets its queue fill up is disconnected with close code
+// 1013 (try again later) rather than having events silently dropped, so a
+// client that reconnects knows it may have missed changes.
+const wsQueueSize = 256
+
+// wsWriteTimeout bounds how long a single frame write may block
+const wsWriteTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsRequest is a control message sent by the client
+type wsRequest struct {
+	Action string `json:"action"` // "subscribe" or "unsubscribe"
+	Prefix string `json:"prefix"`
+}
+
+// wsMessage is a message pushed to the client
+type wsMessage struct {
+	Type   string      `json:"type"` // "event", "subscribed", "unsubscribed" or "error"
+	Prefix string      `json:"prefix,omitempty"`
+	Error  string      `json:"error,omitempty"`
+	Event  *watchEvent `json:"event,omitempty"`
+}
+
+// wsClient is one WebSocket connection and its prefix subscriptions
+type wsClient struct {
+	conn *websocket.Conn
+	out  chan wsMessage
+	done chan struct{}
+
+	mu        sync.Mutex
+	subs      map[string]*db.Watcher
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+}
+
+// close stops the client, sending the given close frame before the
+// connection is torn down. Only the first call has an effect.
+func (c *wsClient) close(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closeCode, c.closeText = code, text
+		for _, w := range c.subs {
+			w.Close()
+		}
+		c.subs = nil
+		c.mu.Unlock()
+		close(c.done)
+	})
+}
+
+// enqueue queues a message for the writer, disconnecting the client when its
+// queue is full
+func (c *wsClient) enqueue(msg wsMessage) {
+	select {
+	case c.out <- msg:
+	case <-c.done:
+	default:
+		c.close(websocket.CloseTryAgainLater, "client too slow")
+	}
+}
+
+func (c *wsClient) subscribe(driver *db.Driver, prefix string) {
+	c.mu.Lock()
+	if c.subs == nil {
+		// Already closed
+		c.mu.Unlock()
+		return
+	}
+	if _, ok := c.subs[prefix]; ok {
+		c.mu.Unlock()
+		c.enqueue(wsMessage{Type: "subscribed", Prefix: prefix})
+		return
+	}
+	watcher := driver.Watch(prefix)
+	c.subs[prefix] = watcher
+	c.mu.Unlock()
+
+	c.enqueue(wsMessage{Type: "subscribed", Prefix: prefix})
+
+	go func() {
+		for ev := range watcher.Events() {
+			if db.Reserved(ev.Key) {
+				continue
+			}
+			e := newWatchEvent(ev, true)
+			c.enqueue(wsMessage{Type: "event", Prefix: prefix, Event: &e})
+		}
+		// The channel also closes on unsubscribe, which is not an error
+		if err := watcher.Err(); err != nil {
+			c.close(websocket.CloseTryAgainLater, err.Error())
+		}
+	}()
+}
+
+func (c *wsClient) unsubscribe(prefix string) {
+	c.mu.Lock()
+	if w, ok := c.subs[prefix]; ok {
+		w.Close()
+		delete(c.subs, prefix)
+	}
+	c.mu.Unlock()
+
+	c.enqueue(wsMessage{Type: "unsubscribed", Prefix: prefix})
+}
+
+// writeLoop owns all writes to the connection
+func (c *wsClient) writeLoop(heartbeat time.Duration) {
+	ping := time.NewTicker(heartbeat)
+	defer ping.Stop()
+
+	for {
+		select {
+		case msg := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+			}
+		case <-ping.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+			}
+		case <-c.done:
+			if c.closeCode != websocket.CloseAbnormalClosure {
+				msg := websocket.FormatCloseMessage(c.closeCode, c.closeText)
+				c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			}
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// WebSocket serves GET /ws. Clients send {"action": "subscribe", "prefix":
+// "foo"} or "unsubscribe" messages and receive change events for every key
+// matching one of their prefixes. A scoped API key may only subscribe to
+// prefixes within its scope.
+func (h *Handler) WebSocket(w http.ResponseWriter, r *http.Request) {
+	if int(h.watchers.Add(1)) > h.MaxWatchers {
+		h.watchers.Add(-1)
+		writeError(w, r, http.StatusServiceUnavailable, CodeUnavailable, "too many concurrent watchers")
+		return
+	}
+	defer h.watchers.Add(-1)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		return
+	}
+
+	client := &wsClient{
+		conn: conn,
+		out:  make(chan wsMessage, wsQueueSize),
+		done: make(chan struct{}),
+		subs: make(map[string]*db.Watcher),
+	}
+
+	s := requestScope(r)
+	writerDone := make(chan struct{})
+	go func() {
+		client.writeLoop(h.Heartbeat)
+		close(writerDone)
+	}()
+
+	// Close the client when the server shuts down
+	go func() {
+		select {
+		case <-h.shutdown:
+			client.close(websocket.CloseGoingAway, "server shutting down")
+		case <-client.done:
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*websocket.CloseError); ok {
+				client.close(websocket.CloseNormalClosure, "")
+			} else {
+				client.close(websocket.CloseAbnormalClosure, "")
+			}
+			break
+		}
+
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			client.enqueue(wsMessage{Type: "error", Error: "invalid message: " + err.Error()})
+			continue
+		}
+
+		switch req.Action {
+		case "subscribe":
+			if s != nil && !s.allows(req.Prefix) {
+				client.enqueue(wsMessage{Type: "error", Prefix: req.Prefix, Error: "the API key may not use every key with this prefix"})
+				continue
+			}
+			client.subscribe(h.driver, req.Prefix)
+		case "unsubscribe":
+			client.unsubscribe(req.Prefix)
+		default:
+			client.enqueue(wsMessage{Type: "error", Error: "unknown action " + req.Action})
+		}
+	}
+
+	<-writerDone
+}
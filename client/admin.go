@@ -0,0 +1,336 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stats mirrors the server's GET /stats response
+type Stats struct {
+	Keys          int `json:"keys"`
+	CachedValues  int `json:"cached_values"`
+	CacheCapacity int `json:"cache_capacity"`
+	Watchers      int `json:"watchers"`
+
+	// Values evicted from the cache to make room for others
+	CacheEvictions    uint64 `json:"cache_evictions"`
+	CacheEvictedBytes uint64 `json:"cache_evicted_bytes"`
+
+	Seq         uint64 `json:"seq"`
+	DirtyValues int    `json:"dirty_values"` // writes the server's -write-back has not put on disk yet
+
+	Shards []ShardStats `json:"shards"`
+	Index  IndexStats   `json:"index"`
+
+	// Snapshots saved by the server's -snapshot-every, and failed attempts
+	Snapshots        uint64 `json:"snapshots"`
+	SnapshotFailures uint64 `json:"snapshot_failures"`
+
+	// Keys the server found on disk but not in its snapshot at startup,
+	// and keys in the snapshot whose files were gone
+	ReconcileAdded   int `json:"reconcile_added"`
+	ReconcileRemoved int `json:"reconcile_removed"`
+
+	ExpiredSwept uint64 `json:"expired_swept"` // expired keys removed by the server's -sweep-every
+
+	Namespaces map[string]NamespaceUsage `json:"namespaces,omitempty"` // namespaces with a quota
+	TextIndex  *TextIndexStats           `json:"text_index,omitempty"` // nil without -text-index-fields
+
+	// Operations slower than the server's -slow-op-threshold
+	SlowOps     uint64            `json:"slow_ops"`
+	SlowOpsByOp map[string]uint64 `json:"slow_ops_by_op"`
+
+	// Replication is only reported by replicas
+	Replication *ReplicationStatus `json:"replication,omitempty"`
+}
+
+// ShardStats describes one of the server's data directories
+type ShardStats struct {
+	Dir       string `json:"dir"`
+	Files     int    `json:"files"`
+	DiskTotal uint64 `json:"disk_total"`
+	DiskFree  uint64 `json:"disk_free"`
+}
+
+// NamespaceUsage is what a namespace with a quota stores, and its quota. A
+// limit of 0 is no limit.
+type NamespaceUsage struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxKeys  int   `json:"max_keys"`
+	Bytes    int64 `json:"bytes"`
+	Keys     int   `json:"keys"`
+}
+
+// TextIndexStats describes the index behind /search
+type TextIndexStats struct {
+	Fields   []string `json:"fields"`
+	Keys     int      `json:"keys"`
+	Terms    int      `json:"terms"`
+	Postings int      `json:"postings"`
+}
+
+// IndexStats describes the server's in-memory index
+type IndexStats struct {
+	Items          int   `json:"items"`
+	Degree         int   `json:"degree"`
+	ResidentValues int   `json:"resident_values"`
+	KeyBytes       int64 `json:"key_bytes"`
+	ValueBytes     int64 `json:"value_bytes"`
+	ApproxBytes    int64 `json:"approx_bytes"`
+	CachedBytes    int64 `json:"cached_bytes"`
+}
+
+// RebalanceProgress reports how far a rebalance has got
+type RebalanceProgress struct {
+	Total   int  `json:"total"`
+	Scanned int  `json:"scanned"`
+	Moved   int  `json:"moved"`
+	Done    bool `json:"done"`
+}
+
+// CompactProgress reports how far a compaction has got
+type CompactProgress struct {
+	Total   int   `json:"total"`
+	Scanned int   `json:"scanned"`
+	Removed int   `json:"removed"`
+	Bytes   int64 `json:"bytes"`
+	Done    bool  `json:"done"`
+}
+
+// ReplicationStatus describes how far a replica is behind its primary
+type ReplicationStatus struct {
+	Primary       string    `json:"primary"`
+	Connected     bool      `json:"connected"`
+	ReplicationID string    `json:"replication_id,omitempty"`
+	AppliedSeq    uint64    `json:"applied_seq"`
+	PrimarySeq    uint64    `json:"primary_seq"`
+	LagOps        uint64    `json:"lag_ops"`
+	LagSeconds    float64   `json:"lag_seconds"`
+	Snapshots     int       `json:"snapshots"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastContact   time.Time `json:"last_contact,omitempty"`
+}
+
+// ImportError describes a record the server could not import
+type ImportError struct {
+	Line  int    `json:"line"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+// ImportStats summarizes an Import
+type ImportStats struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// Count returns the number of keys starting with prefix
+func (c *Client) Count(ctx context.Context, prefix string) (int, error) {
+	var resp struct {
+		Count int `json:"count"`
+	}
+	if err := c.getJSON(ctx, "/count", url.Values{"prefix": {prefix}}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// Stats returns the server's counters
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := c.getJSON(ctx, "/stats", nil, &stats)
+	return stats, err
+}
+
+// Compact asks the server to clean up its data directory. It needs an admin
+// key when auth is enabled.
+func (c *Client) Compact(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodPost, "/admin/compact", nil, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// CompactWithProgress is Compact, calling progress, if not nil, as the
+// server reports it. The client timeout covers the whole compaction, so
+// large stores need a longer one.
+func (c *Client) CompactWithProgress(ctx context.Context, progress func(CompactProgress)) (CompactProgress, error) {
+	query := url.Values{"progress": {"true"}}
+	resp, err := c.do(ctx, http.MethodPost, "/admin/compact", query, nil, nil, false)
+	if err != nil {
+		return CompactProgress{}, err
+	}
+	defer resp.Body.Close()
+
+	var last CompactProgress
+	err = readProgress(resp, "compaction", func(line json.RawMessage) (bool, error) {
+		if err := json.Unmarshal(line, &last); err != nil {
+			return false, err
+		}
+		if progress != nil {
+			progress(last)
+		}
+		return last.Done, nil
+	})
+	return last, err
+}
+
+// SetLogLevel changes how much the server logs: "debug", "info", "warn" or
+// "error". It needs an admin key when auth is enabled.
+func (c *Client) SetLogLevel(ctx context.Context, level string) error {
+	body, err := json.Marshal(map[string]string{"level": level})
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	resp, err := c.do(ctx, http.MethodPut, "/admin/loglevel", nil, header, body, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rebalance moves the server's keys to the data directories they belong on,
+// calling progress, if not nil, as the server reports it. The client timeout
+// covers the whole rebalance, so large stores need a longer one.
+func (c *Client) Rebalance(ctx context.Context, progress func(RebalanceProgress)) (RebalanceProgress, error) {
+	resp, err := c.do(ctx, http.MethodPost, "/admin/rebalance", nil, nil, nil, false)
+	if err != nil {
+		return RebalanceProgress{}, err
+	}
+	defer resp.Body.Close()
+
+	var last RebalanceProgress
+	err = readProgress(resp, "rebalance", func(line json.RawMessage) (bool, error) {
+		if err := json.Unmarshal(line, &last); err != nil {
+			return false, err
+		}
+		if progress != nil {
+			progress(last)
+		}
+		return last.Done, nil
+	})
+	return last, err
+}
+
+// readProgress reads the NDJSON progress lines an admin operation streams,
+// passing each to line until it reports the operation done. An error line
+// is returned as an *Error.
+func readProgress(resp *http.Response, what string, line func(json.RawMessage) (bool, error)) error {
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("%s ended before it was done", what)
+			}
+			return err
+		}
+		var failed struct {
+			Error *struct {
+				Code      string `json:"code"`
+				Message   string `json:"message"`
+				RequestID string `json:"request_id"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(raw, &failed) == nil && failed.Error != nil {
+			// The failure came after the 200 status was sent
+			e := failed.Error
+			return &Error{StatusCode: resp.StatusCode, Code: e.Code, Message: e.Message, RequestID: e.RequestID}
+		}
+		done, err := line(raw)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// Export streams the keys starting with prefix to w as NDJSON, in the format
+// Import reads
+func (c *Client) Export(ctx context.Context, w io.Writer, prefix string) error {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/export", query, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// ExportCSV writes the keys starting with prefix whose values are JSON
+// objects to w as CSV, with a key column and a column for each of fields,
+// and returns how many values the server skipped for not being JSON objects
+func (c *Client) ExportCSV(ctx context.Context, w io.Writer, prefix string, fields []string) (int, error) {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if len(fields) > 0 {
+		query.Set("fields", strings.Join(fields, ","))
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/export.csv", query, nil, nil, true)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return 0, err
+	}
+
+	// The trailer is only there once the whole body was read, and missing
+	// when the export was cut short
+	skipped, err := strconv.Atoi(resp.Trailer.Get("X-Zephyrus-Skipped"))
+	if err != nil {
+		return 0, fmt.Errorf("CSV export ended before it was done")
+	}
+	return skipped, nil
+}
+
+// Import streams NDJSON records from r to the server. With skipExisting,
+// keys that already exist are left alone. The body is streamed, so Import
+// is never retried.
+func (c *Client) Import(ctx context.Context, r io.Reader, skipExisting bool) (ImportStats, error) {
+	mode := "overwrite"
+	if skipExisting {
+		mode = "skip"
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/import", url.Values{"mode": {mode}}, http.Header{"Content-Type": {"application/x-ndjson"}}, nil)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	req.Body = io.NopCloser(r)
+
+	// Large imports outlive any per-request timeout
+	hc := *c.httpClient
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return ImportStats{}, readError(resp)
+	}
+
+	var stats ImportStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return ImportStats{}, fmt.Errorf("invalid import response: %w", err)
+	}
+	return stats, nil
+}
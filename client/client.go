@@ -0,0 +1,371 @@
+// Package client is a Go client for the ZephyrusDB HTTP API. Its methods
+// mirror the Driver: Put, Get, Delete, List, GetBatch and Watch. A Ring
+// spreads keys over several independent servers.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBatchKeys is the most keys the server accepts in one multi-get
+const maxBatchKeys = 100
+
+// Client talks to one ZephyrusDB server. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	apiKey     string
+	token      string
+	retries    int
+	backoff    time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http.Client
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithTimeout bounds each HTTP attempt. Watch streams are not affected.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.httpClient.Timeout = d }
+}
+
+// WithAPIKey sends key in the X-API-Key header
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithBearerToken sends token as "Authorization: Bearer <token>", for API
+// keys or JWTs issued by a gateway in front of the server
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries retries idempotent requests up to n more times after network
+// errors and 502, 503 or 504 responses, waiting backoff, then twice as long
+// and so on, with jitter
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = n, backoff }
+}
+
+// New returns a Client for the server at baseURL, e.g. "http://localhost:8080",
+// or "unix:///var/run/zephyrus.sock" for a server listening on a Unix domain
+// socket. By default requests time out after 30 seconds and are retried
+// twice.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	switch u.Scheme {
+	case "http", "https":
+		u.Path = strings.TrimSuffix(u.Path, "/")
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid base URL %q: missing socket path", baseURL)
+		}
+		socket := u.Path
+		httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		// Requests still need an HTTP URL; the host is only used in headers
+		u = &url.URL{Scheme: "http", Host: "unix"}
+	default:
+		return nil, fmt.Errorf("invalid base URL %q: scheme must be http, https or unix", baseURL)
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: httpClient,
+		retries:    2,
+		backoff:    100 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// NoTTL, given to PutWithTTL, stores a key without an expiry even when the
+// server has a default TTL
+const NoTTL time.Duration = -1
+
+// Put stores the value for a key
+func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+	_, err := c.PutWithTTL(ctx, key, value, 0)
+	return err
+}
+
+// PutWithTTL stores the value for a key that expires after ttl, rounded up
+// to whole seconds, and reports whether the key was created. A ttl of 0
+// gives the key the server's default TTL, which is no expiry unless set,
+// and NoTTL stores it without an expiry.
+func (c *Client) PutWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	switch {
+	case ttl == NoTTL:
+		header.Set("X-Zephyrus-TTL", "0")
+	case ttl > 0:
+		seconds := (ttl + time.Second - 1) / time.Second
+		header.Set("X-Zephyrus-TTL", strconv.FormatInt(int64(seconds), 10))
+	}
+
+	resp, err := c.do(ctx, http.MethodPut, keyPath(key), nil, header, value, true)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
+// Get retrieves the value for a key. Missing keys return an error matching
+// ErrKeyNotFound.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyPath(key), nil, nil, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Delete removes a key. Missing keys return an error matching
+// ErrKeyNotFound; note that a retried Delete whose first attempt succeeded
+// also reports the key as missing.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, keyPath(key), nil, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns up to limit keys starting with prefix, in key order,
+// beginning after the key after. A limit <= 0 returns every matching key,
+// fetching as many pages as needed.
+func (c *Client) List(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	keys := []string{}
+	cursor := ""
+	for {
+		query := url.Values{}
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		} else if after != "" {
+			query.Set("after", base64.RawURLEncoding.EncodeToString([]byte(after)))
+		}
+		pageSize := 1000
+		if limit > 0 && limit-len(keys) < pageSize {
+			pageSize = limit - len(keys)
+		}
+		query.Set("limit", strconv.Itoa(pageSize))
+
+		var page struct {
+			Keys []struct {
+				KeyB64 string `json:"key_b64"`
+			} `json:"keys"`
+			Next string `json:"next"`
+		}
+		if err := c.getJSON(ctx, "/keys", query, &page); err != nil {
+			return nil, err
+		}
+		for _, k := range page.Keys {
+			raw, err := base64.RawURLEncoding.DecodeString(k.KeyB64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key in listing: %w", err)
+			}
+			keys = append(keys, string(raw))
+		}
+
+		if page.Next == "" || (limit > 0 && len(keys) >= limit) {
+			return keys, nil
+		}
+		cursor = page.Next
+	}
+}
+
+// GetBatch retrieves the values for several keys. Keys that do not exist are
+// left out of the returned map. JSON values are returned re-encoded by the
+// server, so insignificant whitespace may differ from what was stored.
+func (c *Client) GetBatch(ctx context.Context, keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	for len(keys) > 0 {
+		chunk := keys
+		if len(chunk) > maxBatchKeys {
+			chunk = chunk[:maxBatchKeys]
+		}
+		keys = keys[len(chunk):]
+
+		body, err := json.Marshal(chunk)
+		if err != nil {
+			return nil, err
+		}
+		header := http.Header{"Content-Type": {"application/json"}}
+		resp, err := c.do(ctx, http.MethodPost, "/mget", nil, header, body, true)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Values map[string]struct {
+				Encoding string          `json:"encoding"`
+				Value    json.RawMessage `json:"value"`
+			} `json:"values"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid batch response: %w", err)
+		}
+
+		for key, v := range result.Values {
+			value, err := decodeValue(v.Encoding, v.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// decodeValue decodes a value as encoded in batch responses and watch events
+func decodeValue(encoding string, raw json.RawMessage) ([]byte, error) {
+	switch encoding {
+	case "json":
+		return raw, nil
+	case "base64":
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
+
+func keyPath(key string) string {
+	return "/key/" + url.PathEscape(key)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, query, nil, nil, true)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", path, err)
+	}
+	return nil
+}
+
+// newRequest builds a request for path relative to the base URL
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u := *c.baseURL
+	u.RawPath = c.baseURL.EscapedPath() + path
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = query.Encode()
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends a request, retrying idempotent ones, and turns non-2xx responses
+// into *Error. The caller closes the body of the returned response.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte, idempotent bool) (*http.Response, error) {
+	attempts := 1
+	if idempotent {
+		attempts += c.retries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleep(ctx, c.backoff<<(attempt-1)); err != nil {
+				return nil, lastErr
+			}
+		}
+
+		req, err := c.newRequest(ctx, method, path, query, header, body)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		lastErr = readError(resp)
+		resp.Body.Close()
+		if !retryable(resp.StatusCode) {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+func retryable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// sleep waits for d plus up to 50% jitter, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	if d > 0 {
+		d += time.Duration(rand.Int63n(int64(d)/2 + 1))
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
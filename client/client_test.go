@@ -0,0 +1,381 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// setupServer starts the real API against a temp dir
+func setupServer(t *testing.T, auth *api.Auth) (*httptest.Server, *db.Driver) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := os.MkdirTemp("", "client_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	driver, err := db.New(dir, nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+
+	handler := api.NewHandler(driver)
+	handler.Auth = auth
+	server := httptest.NewServer(api.InitRouter(handler))
+	t.Cleanup(func() {
+		handler.Shutdown()
+		server.Close()
+	})
+	return server, driver
+}
+
+func TestClient(t *testing.T) {
+	server, driver := setupServer(t, nil)
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "user:1", []byte("alice")); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	if value, err := driver.Get("user:1"); err != nil || string(value) != "alice" {
+		t.Errorf("driver.Get = %q, %v, want alice", value, err)
+	}
+
+	created, err := c.PutWithTTL(ctx, "user:2", []byte(`{"name":"bob"}`), time.Minute)
+	if err != nil || !created {
+		t.Errorf("PutWithTTL = %v, %v, want created", created, err)
+	}
+	if ttl, _ := driver.TTL("user:2"); ttl <= 0 {
+		t.Errorf("TTL after PutWithTTL = %s, want positive", ttl)
+	}
+
+	if value, err := c.Get(ctx, "user:1"); err != nil || string(value) != "alice" {
+		t.Errorf("Get = %q, %v, want alice", value, err)
+	}
+
+	_, err = c.Get(ctx, "missing")
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get missing error = %v, want ErrKeyNotFound", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.RequestID == "" {
+		t.Errorf("Get missing error = %#v, want *Error with status and request ID", err)
+	}
+
+	for i := 0; i < 150; i++ {
+		driver.Put(fmt.Sprintf("item:%03d", i), []byte("v"))
+	}
+	keys, err := c.List(ctx, "item:", "", 0)
+	if err != nil || len(keys) != 150 {
+		t.Errorf("List = %d keys, %v, want 150", len(keys), err)
+	}
+	keys, err = c.List(ctx, "item:", "item:009", 3)
+	if err != nil || fmt.Sprint(keys) != "[item:010 item:011 item:012]" {
+		t.Errorf("List after item:009 = %v, %v", keys, err)
+	}
+
+	batchKeys := []string{"user:1", "user:2", "missing"}
+	for i := 0; i < 150; i++ {
+		batchKeys = append(batchKeys, fmt.Sprintf("item:%03d", i))
+	}
+	values, err := c.GetBatch(ctx, batchKeys)
+	if err != nil {
+		t.Fatalf("GetBatch failed: %s", err)
+	}
+	if len(values) != 152 || string(values["user:1"]) != "alice" || string(values["user:2"]) != `{"name":"bob"}` {
+		t.Errorf("GetBatch returned %d values, user:1 = %q, user:2 = %q", len(values), values["user:1"], values["user:2"])
+	}
+
+	if err := c.Delete(ctx, "user:1"); err != nil {
+		t.Errorf("Delete failed: %s", err)
+	}
+	if err := c.Delete(ctx, "user:1"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("second Delete error = %v, want ErrKeyNotFound", err)
+	}
+
+	os.WriteFile(filepath.Join(driver.Stats().Shards[0].Dir, "left.tmp"), []byte("over"), 0644)
+	reports := 0
+	p, err := c.CompactWithProgress(ctx, func(CompactProgress) { reports++ })
+	if err != nil || p != (CompactProgress{Total: 1, Scanned: 1, Removed: 1, Bytes: 4, Done: true}) || reports != 2 {
+		t.Errorf("CompactWithProgress = %+v, %v after %d reports, want 1 file removed", p, err, reports)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server, driver := setupServer(t, nil)
+	c, _ := New(server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	w, err := c.Watch(ctx, "user:")
+	if err != nil {
+		t.Fatalf("Watch failed: %s", err)
+	}
+	defer w.Close()
+
+	driver.Put("other", []byte("x"))
+	driver.Put("user:1", []byte{0xff, 0x00})
+	driver.Delete("user:1")
+
+	for _, want := range []Event{{Op: OpPut, Key: "user:1", Value: []byte{0xff, 0x00}}, {Op: OpDelete, Key: "user:1"}} {
+		select {
+		case ev := <-w.Events():
+			if ev.Op != want.Op || ev.Key != want.Key || string(ev.Value) != string(want.Value) {
+				t.Errorf("event = %+v, want %+v", ev, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for %s event", want.Op)
+		}
+	}
+
+	w.Close()
+	for range w.Events() {
+	}
+	if err := w.Err(); err != nil {
+		t.Errorf("Err after Close = %v, want nil", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	server, _ := setupServer(t, api.NewAuth(map[string]api.Role{"s3cret": api.RoleWrite}))
+	ctx := context.Background()
+
+	anon, _ := New(server.URL)
+	var apiErr *Error
+	if err := anon.Put(ctx, "k", []byte("v")); !errors.As(err, &apiErr) || apiErr.Code != "UNAUTHORIZED" {
+		t.Errorf("Put without key error = %v, want UNAUTHORIZED", err)
+	}
+
+	for _, opt := range []Option{WithAPIKey("s3cret"), WithBearerToken("s3cret")} {
+		c, _ := New(server.URL, opt)
+		if err := c.Put(ctx, "k", []byte("v")); err != nil {
+			t.Errorf("Put with key failed: %s", err)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("value"))
+	}))
+	defer server.Close()
+
+	c, _ := New(server.URL, WithRetries(2, time.Millisecond))
+	if value, err := c.Get(context.Background(), "k"); err != nil || string(value) != "value" {
+		t.Errorf("Get = %q, %v, want value after retries", value, err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("server saw %d calls, want 3", got)
+	}
+
+	calls.Store(0)
+	c, _ = New(server.URL, WithRetries(0, time.Millisecond))
+	var apiErr *Error
+	if _, err := c.Get(context.Background(), "k"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Get without retries error = %v, want 503", err)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	driver, err := db.New(dir, nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+
+	// Keep the path short; socket paths are limited to about 100 bytes
+	socketDir, err := os.MkdirTemp("", "zs")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(socketDir)
+	socket := socketDir + "/z.sock"
+
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	server := &http.Server{Handler: api.InitRouter(api.NewHandler(driver))}
+	go server.Serve(lis)
+	defer server.Close()
+
+	c, err := New("unix://" + socket)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	if err := c.Put(context.Background(), "k", []byte("v")); err != nil {
+		t.Fatalf("Put over socket failed: %s", err)
+	}
+	if value, err := c.Get(context.Background(), "k"); err != nil || string(value) != "v" {
+		t.Errorf("Get over socket = %q, %v, want v", value, err)
+	}
+}
+
+func TestRing(t *testing.T) {
+	var servers []*httptest.Server
+	drivers := make(map[string]*db.Driver)
+	var endpoints []string
+	for i := 0; i < 3; i++ {
+		server, driver := setupServer(t, nil)
+		servers = append(servers, server)
+		drivers[server.URL] = driver
+		endpoints = append(endpoints, server.URL)
+	}
+	r, err := NewRing(endpoints, WithHealthCheck(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewRing failed: %s", err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	var entries []KeyValue
+	var keys []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		keys = append(keys, key)
+		entries = append(entries, KeyValue{Key: key, Value: []byte(key)})
+	}
+	for i, err := range r.PutBatch(ctx, entries) {
+		if err != nil {
+			t.Fatalf("PutBatch of %s failed: %s", entries[i].Key, err)
+		}
+	}
+
+	// Each key is stored on its owner only, and the placement does not
+	// depend on the order of the endpoints
+	reversed, err := NewRing([]string{endpoints[2], endpoints[1], endpoints[0] + "/"})
+	if err != nil {
+		t.Fatalf("NewRing failed: %s", err)
+	}
+	owners := make(map[string]int)
+	for _, key := range keys {
+		owner := r.Owner(key)
+		owners[owner]++
+		if reversed.Owner(key) != owner {
+			t.Errorf("Owner(%s) depends on the order of the endpoints", key)
+		}
+		for endpoint, driver := range drivers {
+			if _, err := driver.Get(key); (err == nil) != (endpoint == owner) {
+				t.Errorf("%s on %s: %v, want it only on %s", key, endpoint, err, owner)
+			}
+		}
+	}
+	if len(owners) != 3 {
+		t.Errorf("keys went to %d endpoints, want 3", len(owners))
+	}
+
+	values, err := r.GetBatch(ctx, append(keys, "missing"))
+	if err != nil || len(values) != len(keys) || string(values["k07"]) != "k07" {
+		t.Errorf("GetBatch = %d values, %v, want %d", len(values), err, len(keys))
+	}
+	if listed, err := r.List(ctx, "k", "k04", 5); err != nil || fmt.Sprint(listed) != "[k05 k06 k07 k08 k09]" {
+		t.Errorf("List = %v, %v, want k05 to k09", listed, err)
+	}
+
+	// A dead endpoint is ejected; its writes fail and, with failover, its
+	// reads go to the next endpoint
+	dead := r.Owner("k00")
+	for _, server := range servers {
+		if server.URL == dead {
+			server.Close()
+		}
+	}
+	ejected := func() bool {
+		for _, node := range r.Nodes() {
+			if node.Endpoint == dead {
+				return !node.Healthy
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !ejected() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s was not ejected: %+v", dead, r.Nodes())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := r.Put(ctx, "k00", []byte("v")); !errors.Is(err, ErrNodeDown) {
+		t.Errorf("Put to an ejected endpoint = %v, want ErrNodeDown", err)
+	}
+	if _, err := r.Get(ctx, "k00"); !errors.Is(err, ErrNodeDown) {
+		t.Errorf("Get from an ejected endpoint = %v, want ErrNodeDown", err)
+	}
+	if _, err := r.List(ctx, "", "", 0); !errors.Is(err, ErrNodeDown) {
+		t.Errorf("List with an ejected endpoint = %v, want ErrNodeDown", err)
+	}
+	failover, err := NewRing(endpoints, WithReadFailover(), WithNodeOptions(WithRetries(0, 0)))
+	if err != nil {
+		t.Fatalf("NewRing failed: %s", err)
+	}
+	if _, err := failover.Get(ctx, "k00"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get with failover = %v, want ErrKeyNotFound from the next endpoint", err)
+	}
+}
+
+func TestMirror(t *testing.T) {
+	server, remote := setupServer(t, nil)
+	c, err := New(server.URL)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	driver, err := db.Open(t.TempDir(), &db.Options{Mirror: NewMirror(c), MirrorSync: true})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+
+	if err := driver.Put("a:b", []byte("1")); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	if _, err := driver.PutWithTTL("ttl", []byte("x"), time.Hour); err != nil {
+		t.Fatalf("PutWithTTL failed: %s", err)
+	}
+	if v, err := remote.Get("a:b"); err != nil || string(v) != "1" {
+		t.Errorf("remote a:b = %q, %v, want 1", v, err)
+	}
+	if ttl, _ := remote.TTL("ttl"); ttl <= 0 {
+		t.Errorf("remote TTL of ttl = %s, want an expiry", ttl)
+	}
+	if err := driver.Delete("ttl"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if _, err := remote.Get("ttl"); !errors.Is(err, db.ErrKeyNotFound) {
+		t.Errorf("remote ttl after Delete: err = %v, want ErrKeyNotFound", err)
+	}
+
+	// The ETags from GET /key/:key/meta match the driver's
+	remote.Put("extra", []byte("x"))
+	stats, err := driver.ResyncMirror(context.Background())
+	if err != nil {
+		t.Fatalf("ResyncMirror failed: %s", err)
+	}
+	if stats != (db.ResyncStats{Checked: 1, Removed: 1}) {
+		t.Errorf("ResyncMirror = %+v, want 1 checked and 1 removed", stats)
+	}
+}
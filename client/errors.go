@@ -0,0 +1,64 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrKeyNotFound is matched by errors.Is for requests on missing keys
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrNodeDown is returned, wrapped with the endpoint, for requests a Ring
+// does not send because the endpoint they go to is ejected
+var ErrNodeDown = errors.New("node is down")
+
+// Error is a failed request, carrying the server's error envelope
+type Error struct {
+	StatusCode int
+	Code       string // machine-readable code such as "KEY_NOT_FOUND"
+	Message    string
+	RequestID  string
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("zephyrus: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	if e.RequestID != "" {
+		msg += " (request " + e.RequestID + ")"
+	}
+	return msg
+}
+
+// Is makes errors.Is(err, ErrKeyNotFound) work for not-found responses
+func (e *Error) Is(target error) bool {
+	return target == ErrKeyNotFound && e.Code == "KEY_NOT_FOUND"
+}
+
+// readError builds an *Error from a non-2xx response
+func readError(resp *http.Response) error {
+	e := &Error{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+
+	var envelope struct {
+		Error struct {
+			Code      string `json:"code"`
+			Message   string `json:"message"`
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(body, &envelope) == nil && envelope.Error.Code != "" {
+		e.Code = envelope.Error.Code
+		e.Message = envelope.Error.Message
+		if envelope.Error.RequestID != "" {
+			e.RequestID = envelope.Error.RequestID
+		}
+		return e
+	}
+
+	// Not from the API itself, e.g. a proxy in between
+	e.Code = http.StatusText(resp.StatusCode)
+	e.Message = string(body)
+	return e
+}
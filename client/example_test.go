@@ -0,0 +1,36 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/client"
+)
+
+func Example() {
+	c, err := client.New("http://localhost:8080",
+		client.WithAPIKey("s3cret"),
+		client.WithTimeout(5*time.Second),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := c.Put(ctx, "greeting", []byte("hello")); err != nil {
+		log.Fatal(err)
+	}
+
+	value, err := c.Get(ctx, "greeting")
+	if errors.Is(err, client.ErrKeyNotFound) {
+		fmt.Println("not found")
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(value))
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Mirror makes a server the mirror of a db.Driver, implementing db.Mirror
+// over a Client: set it as db.Options.Mirror to copy every write there
+type Mirror struct {
+	c *Client
+}
+
+// NewMirror returns a Mirror writing through c
+func NewMirror(c *Client) *Mirror {
+	return &Mirror{c: c}
+}
+
+// Put stores value at key for ttl, rounded up to whole seconds, or without
+// an expiry for NoTTL
+func (m *Mirror) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := m.c.PutWithTTL(ctx, key, value, ttl)
+	return err
+}
+
+// Delete removes key, returning nil when the server does not have it
+func (m *Mirror) Delete(ctx context.Context, key string) error {
+	if err := m.c.Delete(ctx, key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+// Keys returns every key on the server
+func (m *Mirror) Keys(ctx context.Context) ([]string, error) {
+	return m.c.List(ctx, "", "", 0)
+}
+
+// ETag returns the content hash of the value at key from GET /key/:key/meta,
+// without the quotes of the HTTP entity tag, or "" when there is no such key
+func (m *Mirror) ETag(ctx context.Context, key string) (string, error) {
+	var meta struct {
+		ETag string `json:"etag"`
+	}
+	err := m.c.getJSON(ctx, keyPath(key)+"/meta", nil, &meta)
+	if errors.Is(err, ErrKeyNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(meta.ETag, `"`), nil
+}
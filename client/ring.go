@@ -0,0 +1,432 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// DefaultVirtualNodes is how many points each endpoint gets on a Ring's hash
+// ring unless WithVirtualNodes says otherwise. More points spread keys more
+// evenly.
+const DefaultVirtualNodes = 128
+
+// ringNode is one endpoint of a Ring
+type ringNode struct {
+	endpoint string
+	client   *Client
+	down     atomic.Bool // ejected by the health check
+}
+
+type ringPoint struct {
+	hash uint64
+	node *ringNode
+}
+
+// Ring spreads keys over several independent servers by consistent hashing
+// of the key, so adding a server only moves the keys that now belong to it.
+// Placement depends only on the endpoints and the number of virtual nodes,
+// not on their order, so it stays the same across restarts as long as they
+// do. The servers know nothing of each other: each key is stored on its
+// owner alone. It is safe for concurrent use.
+type Ring struct {
+	nodes        []*ringNode
+	points       []ringPoint
+	virtualNodes int
+	failover     bool
+	healthEvery  time.Duration
+	nodeOpts     []Option
+
+	stop      chan struct{}
+	done      sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// RingOption configures a Ring
+type RingOption func(*Ring)
+
+// WithVirtualNodes gives each endpoint n points on the hash ring. Changing
+// it moves keys between endpoints.
+func WithVirtualNodes(n int) RingOption {
+	return func(r *Ring) { r.virtualNodes = n }
+}
+
+// WithNodeOptions configures the Client of every endpoint
+func WithNodeOptions(opts ...Option) RingOption {
+	return func(r *Ring) { r.nodeOpts = append(r.nodeOpts, opts...) }
+}
+
+// WithHealthCheck checks every endpoint's /readyz this often, ejecting those
+// that do not answer until they do again. Writes to keys of an ejected
+// endpoint fail with ErrNodeDown without being sent.
+func WithHealthCheck(every time.Duration) RingOption {
+	return func(r *Ring) { r.healthEvery = every }
+}
+
+// WithReadFailover sends reads of keys whose owner is ejected or
+// unreachable to the next endpoint on the ring instead of failing. That
+// endpoint only has the key if the application wrote it there too, so
+// without such copies reads get ErrKeyNotFound rather than ErrNodeDown,
+// which suits caches.
+func WithReadFailover() RingOption {
+	return func(r *Ring) { r.failover = true }
+}
+
+// NewRing returns a Ring over the servers at endpoints, each given as to New
+func NewRing(endpoints []string, opts ...RingOption) (*Ring, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("a ring needs at least one endpoint")
+	}
+	r := &Ring{virtualNodes: DefaultVirtualNodes, stop: make(chan struct{})}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.virtualNodes < 1 {
+		return nil, fmt.Errorf("virtual nodes must be at least 1, got %d", r.virtualNodes)
+	}
+
+	seen := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		if seen[endpoint] {
+			return nil, fmt.Errorf("endpoint %s is listed twice", endpoint)
+		}
+		seen[endpoint] = true
+		c, err := New(endpoint, r.nodeOpts...)
+		if err != nil {
+			return nil, err
+		}
+		node := &ringNode{endpoint: endpoint, client: c}
+		r.nodes = append(r.nodes, node)
+		for i := 0; i < r.virtualNodes; i++ {
+			r.points = append(r.points, ringPoint{hash: hash64(endpoint + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+
+	if r.healthEvery > 0 {
+		r.done.Add(1)
+		go r.healthLoop()
+	}
+	return r, nil
+}
+
+// Close stops the health checks
+func (r *Ring) Close() {
+	r.closeOnce.Do(func() { close(r.stop) })
+	r.done.Wait()
+}
+
+// hash64 hashes a key or ring point, the way the server places keys on its
+// data directories: FNV-1a mixed with the splitmix64 finalizer, which keeps
+// similar strings from landing close together
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// successors returns the distinct endpoints from the owner of key on,
+// clockwise round the ring
+func (r *Ring) successors(key string) []*ringNode {
+	h := hash64(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	nodes := make([]*ringNode, 0, len(r.nodes))
+	seen := make(map[*ringNode]bool, len(r.nodes))
+	for i := 0; i < len(r.points) && len(nodes) < len(r.nodes); i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// owner returns the endpoint a key belongs on
+func (r *Ring) owner(key string) *ringNode {
+	h := hash64(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Owner returns the endpoint a key belongs on
+func (r *Ring) Owner(key string) string {
+	return r.owner(key).endpoint
+}
+
+// Node returns the Client of the endpoint a key belongs on, for the calls
+// Ring does not wrap
+func (r *Ring) Node(key string) *Client {
+	return r.owner(key).client
+}
+
+// NodeStatus is an endpoint of a Ring and whether the health check has
+// ejected it
+type NodeStatus struct {
+	Endpoint string
+	Healthy  bool
+}
+
+// Nodes returns the endpoints of the ring, in the order given to NewRing
+func (r *Ring) Nodes() []NodeStatus {
+	nodes := make([]NodeStatus, len(r.nodes))
+	for i, node := range r.nodes {
+		nodes[i] = NodeStatus{Endpoint: node.endpoint, Healthy: !node.down.Load()}
+	}
+	return nodes
+}
+
+// writeNode returns the owner of key, failing with ErrNodeDown when it is
+// ejected
+func (r *Ring) writeNode(key string) (*Client, error) {
+	node := r.owner(key)
+	if node.down.Load() {
+		return nil, fmt.Errorf("%w: %s", ErrNodeDown, node.endpoint)
+	}
+	return node.client, nil
+}
+
+// readNodes returns the endpoints a read of key is tried on, in order: its
+// owner, then with WithReadFailover the others round the ring. Ejected
+// endpoints are left out, so there may be none.
+func (r *Ring) readNodes(key string) []*ringNode {
+	nodes := []*ringNode{r.owner(key)}
+	if r.failover {
+		nodes = r.successors(key)
+	}
+	healthy := nodes[:0]
+	for _, node := range nodes {
+		if !node.down.Load() {
+			healthy = append(healthy, node)
+		}
+	}
+	return healthy
+}
+
+// read calls fn with the Client of each endpoint readNodes returns until one
+// answers, failing with ErrNodeDown when none is left to try
+func (r *Ring) read(key string, fn func(*Client) error) error {
+	err := fmt.Errorf("%w: %s", ErrNodeDown, r.Owner(key))
+	for _, node := range r.readNodes(key) {
+		if err = fn(node.client); !unreachable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// unreachable reports whether err means the endpoint did not answer, as
+// opposed to answering with an error
+func unreachable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		// From a proxy in front of an endpoint that is gone
+		return apiErr.StatusCode == http.StatusBadGateway || apiErr.StatusCode == http.StatusGatewayTimeout
+	}
+	return true
+}
+
+// Put stores the value for a key on its owner
+func (r *Ring) Put(ctx context.Context, key string, value []byte) error {
+	_, err := r.PutWithTTL(ctx, key, value, 0)
+	return err
+}
+
+// PutWithTTL stores the value for a key on its owner, as Client.PutWithTTL
+// does
+func (r *Ring) PutWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	c, err := r.writeNode(key)
+	if err != nil {
+		return false, err
+	}
+	return c.PutWithTTL(ctx, key, value, ttl)
+}
+
+// Get retrieves the value for a key from its owner, or with
+// WithReadFailover the next endpoint answering
+func (r *Ring) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := r.read(key, func(c *Client) error {
+		var err error
+		value, err = c.Get(ctx, key)
+		return err
+	})
+	return value, err
+}
+
+// Delete removes a key from its owner
+func (r *Ring) Delete(ctx context.Context, key string) error {
+	c, err := r.writeNode(key)
+	if err != nil {
+		return err
+	}
+	return c.Delete(ctx, key)
+}
+
+// GetBatch retrieves the values for several keys, as Client.GetBatch does,
+// with one batch per endpoint, all sent at once. It fails if any does.
+func (r *Ring) GetBatch(ctx context.Context, keys []string) (map[string][]byte, error) {
+	byNode := make(map[*ringNode][]string)
+	for _, key := range keys {
+		nodes := r.readNodes(key)
+		if len(nodes) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrNodeDown, r.Owner(key))
+		}
+		byNode[nodes[0]] = append(byNode[nodes[0]], key)
+	}
+
+	var mu sync.Mutex
+	values := make(map[string][]byte, len(keys))
+	g, ctx := errgroup.WithContext(ctx)
+	for node, keys := range byNode {
+		node, keys := node, keys
+		g.Go(func() error {
+			got, err := node.client.GetBatch(ctx, keys)
+			if err != nil {
+				return fmt.Errorf("%s: %w", node.endpoint, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for key, value := range got {
+				values[key] = value
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// KeyValue is a key and its value, for Ring.PutBatch
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// PutBatch stores several values, each on the owner of its key. The writes
+// to each endpoint are made one after the other, and those to different
+// endpoints at once. It returns the error of each write, nil for those that
+// succeeded, in the order of entries.
+func (r *Ring) PutBatch(ctx context.Context, entries []KeyValue) []error {
+	errs := make([]error, len(entries))
+	byNode := make(map[*ringNode][]int)
+	for i, entry := range entries {
+		node := r.owner(entry.Key)
+		byNode[node] = append(byNode[node], i)
+	}
+
+	var wg sync.WaitGroup
+	for node, indexes := range byNode {
+		wg.Add(1)
+		go func(node *ringNode, indexes []int) {
+			defer wg.Done()
+			for _, i := range indexes {
+				if node.down.Load() {
+					errs[i] = fmt.Errorf("%w: %s", ErrNodeDown, node.endpoint)
+					continue
+				}
+				errs[i] = node.client.Put(ctx, entries[i].Key, entries[i].Value)
+			}
+		}(node, indexes)
+	}
+	wg.Wait()
+	return errs
+}
+
+// List returns up to limit keys starting with prefix, after the key after,
+// merged in key order from every endpoint, as Client.List does. It fails
+// with ErrNodeDown while any endpoint is ejected, since its keys would be
+// missing.
+func (r *Ring) List(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	for _, node := range r.nodes {
+		if node.down.Load() {
+			return nil, fmt.Errorf("%w: %s", ErrNodeDown, node.endpoint)
+		}
+	}
+
+	lists := make([][]string, len(r.nodes))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, node := range r.nodes {
+		i, node := i, node
+		g.Go(func() error {
+			keys, err := node.client.List(ctx, prefix, after, limit)
+			if err != nil {
+				return fmt.Errorf("%s: %w", node.endpoint, err)
+			}
+			lists[i] = keys
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, list := range lists {
+		keys = append(keys, list...)
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys, nil
+}
+
+// healthLoop checks the endpoints every healthEvery until Close
+func (r *Ring) healthLoop() {
+	defer r.done.Done()
+
+	ticker := time.NewTicker(r.healthEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		r.checkHealth()
+	}
+}
+
+// checkHealth checks every endpoint at once, ejecting those that do not
+// answer /readyz within healthEvery and readmitting those that do. A server
+// answering 503 because its disk is full is up, and still serves reads.
+func (r *Ring) checkHealth() {
+	var wg sync.WaitGroup
+	for _, node := range r.nodes {
+		wg.Add(1)
+		go func(node *ringNode) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), r.healthEvery)
+			defer cancel()
+			resp, err := node.client.do(ctx, http.MethodGet, "/readyz", nil, nil, nil, false)
+			if err == nil {
+				resp.Body.Close()
+			}
+			node.down.Store(unreachable(err))
+		}(node)
+	}
+	wg.Wait()
+}
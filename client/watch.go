@@ -0,0 +1,175 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op is the kind of change reported by a watch event
+type Op string
+
+const (
+	OpPut    Op = "put"
+	OpDelete Op = "delete"
+	OpExpire Op = "expire" // removed because its expiry passed
+)
+
+// Event is a change to a watched key
+type Event struct {
+	Op        Op
+	Key       string
+	Value     []byte    // new value for puts
+	ExpiresAt time.Time // new expiry of a put, or the one that passed; zero for none
+	Time      time.Time
+}
+
+// Watcher receives change events from the server's /watch stream
+type Watcher struct {
+	events chan Event
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// Events returns the channel events are delivered on. It is closed when the
+// stream ends; Err then tells why.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns the error that ended the stream, or nil if it was closed by
+// Close or by canceling the context passed to Watch
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops the stream
+func (w *Watcher) Close() {
+	w.cancel()
+}
+
+// Watch streams changes to keys starting with prefix, including new values.
+// The stream runs until Close is called, ctx is done or the connection
+// fails; it is not retried.
+func (c *Client) Watch(ctx context.Context, prefix string) (*Watcher, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	query := url.Values{"prefix": {prefix}, "values": {"true"}}
+	req, err := c.newRequest(ctx, http.MethodGet, "/watch", query, http.Header{"Accept": {"text/event-stream"}}, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The stream outlives any per-request timeout
+	hc := *c.httpClient
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer cancel()
+		defer resp.Body.Close()
+		return nil, readError(resp)
+	}
+
+	w := &Watcher{events: make(chan Event, 64), cancel: cancel}
+	go w.read(ctx, resp.Body)
+	return w, nil
+}
+
+// read parses the Server-Sent Events stream until it ends
+func (w *Watcher) read(ctx context.Context, body io.ReadCloser) {
+	defer close(w.events)
+	defer body.Close()
+
+	var event, data string
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && event != "":
+			if err := w.dispatch(ctx, event, data); err != nil {
+				w.setErr(err)
+				return
+			}
+			event, data = "", ""
+		}
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+	if err := scanner.Err(); err != nil {
+		w.setErr(err)
+		return
+	}
+	w.setErr(io.ErrUnexpectedEOF)
+}
+
+func (w *Watcher) dispatch(ctx context.Context, event, data string) error {
+	if event == "error" {
+		return fmt.Errorf("watch ended by server: %s", strings.Trim(data, `"`))
+	}
+
+	var payload struct {
+		Op        Op         `json:"op"`
+		Key       string     `json:"key"`
+		Time      time.Time  `json:"time"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		Value     *struct {
+			Encoding string          `json:"encoding"`
+			Value    json.RawMessage `json:"value"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return fmt.Errorf("invalid watch event: %w", err)
+	}
+
+	ev := Event{Op: payload.Op, Key: payload.Key, Time: payload.Time}
+	if payload.ExpiresAt != nil {
+		ev.ExpiresAt = *payload.ExpiresAt
+	}
+	if payload.Value != nil {
+		value, err := decodeValue(payload.Value.Encoding, payload.Value.Value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %w", payload.Key, err)
+		}
+		ev.Value = value
+	}
+
+	select {
+	case w.events <- ev:
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (w *Watcher) setErr(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workload describes the operations the benchmark sends
+type workload struct {
+	Workers      int     `json:"workers"`
+	Keys         int     `json:"keys"`
+	Distribution string  `json:"distribution"` // "uniform" or "zipfian"
+	ZipfS        float64 `json:"zipf_s,omitempty"`
+	ValueSize    int     `json:"value_size"`
+	ReadRatio    float64 `json:"read_ratio"`
+	Duration     string  `json:"duration,omitempty"` // how long to run, when Ops is 0
+	Ops          int64   `json:"ops,omitempty"`      // how many operations to send, 0 to run for Duration
+	Seed         int64   `json:"seed"`
+
+	duration time.Duration
+}
+
+// Operation types, in the order they are reported
+const (
+	opGet = iota
+	opPut
+	numOps
+)
+
+var opNames = [numOps]string{"get", "put"}
+
+// samples holds what one worker saw of one operation type
+type samples struct {
+	latencies []time.Duration
+	errors    int64
+	misses    int64
+	lastErr   error
+}
+
+func (s *samples) add(o *samples) {
+	s.latencies = append(s.latencies, o.latencies...)
+	s.errors += o.errors
+	s.misses += o.misses
+	if o.lastErr != nil {
+		s.lastErr = o.lastErr
+	}
+}
+
+// keyName returns the key of the ith of the workload's keys
+func keyName(i int) string {
+	return fmt.Sprintf("bench:%08d", i)
+}
+
+// keyPicker returns a function choosing a key index for w's distribution.
+// With zipfian the lowest indexes are the most popular.
+func keyPicker(w workload, r *rand.Rand) func() int {
+	if w.Distribution == "zipfian" {
+		z := rand.NewZipf(r, w.ZipfS, 1, uint64(w.Keys-1))
+		return func() int { return int(z.Uint64()) }
+	}
+	return func() int { return r.Intn(w.Keys) }
+}
+
+// preload writes every key once, so that reads find values from the start
+func preload(ctx context.Context, t target, w workload) error {
+	var next atomic.Int64
+	errs := make(chan error, w.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < w.Workers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			value := make([]byte, w.ValueSize)
+			rand.New(rand.NewSource(seed)).Read(value)
+			for k := int(next.Add(1) - 1); k < w.Keys; k = int(next.Add(1) - 1) {
+				if err := t.Put(ctx, keyName(k), value); err != nil {
+					errs <- fmt.Errorf("failed to preload %s: %w", keyName(k), err)
+					return
+				}
+			}
+		}(w.Seed + int64(i))
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// runWorkload sends operations from w.Workers goroutines until the
+// duration has passed or the operations are all sent, returning the samples
+// of each operation type and how long it ran
+func runWorkload(ctx context.Context, t target, w workload) ([numOps]samples, time.Duration) {
+	if w.Ops == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.duration)
+		defer cancel()
+	}
+
+	var sent atomic.Int64
+	results := make([][numOps]samples, w.Workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(w.Seed + int64(i)))
+			pick := keyPicker(w, r)
+			value := make([]byte, w.ValueSize)
+			r.Read(value)
+			own := &results[i]
+			for ctx.Err() == nil && (w.Ops == 0 || sent.Add(1) <= w.Ops) {
+				op, key := opPut, keyName(pick())
+				if r.Float64() < w.ReadRatio {
+					op = opGet
+				}
+
+				opStart := time.Now()
+				var err error
+				if op == opGet {
+					err = t.Get(ctx, key)
+				} else {
+					err = t.Put(ctx, key, value)
+				}
+				elapsed := time.Since(opStart)
+
+				// An operation cut short by the end of the run is not counted
+				if ctx.Err() != nil && err != nil {
+					return
+				}
+				s := &own[op]
+				s.latencies = append(s.latencies, elapsed)
+				switch {
+				case errors.Is(err, errMiss):
+					s.misses++
+				case err != nil:
+					s.errors++
+					s.lastErr = err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var merged [numOps]samples
+	for i := range results {
+		for op := range merged {
+			merged[op].add(&results[i][op])
+		}
+	}
+	return merged, elapsed
+}
+
+// opReport sums up one operation type, with latencies in milliseconds
+type opReport struct {
+	Op         string  `json:"op"`
+	Count      int     `json:"count"`
+	Errors     int64   `json:"errors"`
+	Misses     int64   `json:"misses,omitempty"` // gets of keys that did not exist
+	Throughput float64 `json:"ops_per_sec"`
+	P50        float64 `json:"p50_ms"`
+	P95        float64 `json:"p95_ms"`
+	P99        float64 `json:"p99_ms"`
+	Max        float64 `json:"max_ms"`
+	LastError  string  `json:"last_error,omitempty"`
+}
+
+func summarize(op string, s samples, elapsed time.Duration) opReport {
+	r := opReport{Op: op, Count: len(s.latencies), Errors: s.errors, Misses: s.misses}
+	if s.lastErr != nil {
+		r.LastError = s.lastErr.Error()
+	}
+	if r.Count == 0 {
+		return r
+	}
+	slices.Sort(s.latencies)
+	r.Throughput = float64(r.Count) / elapsed.Seconds()
+	r.P50 = millis(percentile(s.latencies, 50))
+	r.P95 = millis(percentile(s.latencies, 95))
+	r.P99 = millis(percentile(s.latencies, 99))
+	r.Max = millis(s.latencies[len(s.latencies)-1])
+	return r
+}
+
+// percentile returns the pth percentile of sorted latencies by the
+// nearest-rank method
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
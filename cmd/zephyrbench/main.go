@@ -0,0 +1,264 @@
+// Command zephyrbench measures how much load a ZephyrusDB server, or with
+// -direct the storage engine alone, takes: it sends a mix of gets and puts
+// from a number of workers and reports the throughput and latency of each,
+// with the server's counters before and after.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes
+const (
+	exitOK     = 0
+	exitFailed = 1 // the run completed but some operations failed
+	exitError  = 2
+	exitUsage  = 64
+)
+
+const usage = `Usage: zephyrbench [flags]
+
+Sends gets and puts of -keys keys to -server, or to a driver opened on
+-data-dir with -direct, for -duration or until -ops operations are sent, and
+reports the throughput and the p50, p95 and p99 latencies of each.
+
+Exit status is 0 on success, 1 when some operations failed, 2 on other
+errors and 64 on usage errors.
+
+Flags:
+`
+
+// report is the outcome of a run, as printed with -json
+type report struct {
+	Target   string     `json:"target"`
+	Workload workload   `json:"workload"`
+	Elapsed  float64    `json:"elapsed_sec"`
+	Ops      []opReport `json:"ops"` // each operation type, then "total"
+
+	// The target's GET /stats, or Driver.Stats with -direct
+	StatsBefore json.RawMessage `json:"stats_before"`
+	StatsAfter  json.RawMessage `json:"stats_after"`
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	var w workload
+	fs := flag.NewFlagSet("zephyrbench", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", envOr("ZEPHYRUS_URL", "http://localhost:8080"), "server URL (env ZEPHYRUS_URL)")
+	apiKey := fs.String("api-key", os.Getenv("ZEPHYRUS_API_KEY"), "API key (env ZEPHYRUS_API_KEY)")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout for each request")
+	direct := fs.Bool("direct", false, "open a driver in this process instead of using a server")
+	dataDir := fs.String("data-dir", "", "data directory for -direct, a temporary one when empty; must not be in use by a server")
+	fs.IntVar(&w.Workers, "workers", 8, "concurrent workers")
+	fs.IntVar(&w.Keys, "keys", 10000, "number of distinct keys")
+	fs.StringVar(&w.Distribution, "distribution", "uniform", "how keys are chosen: uniform or zipfian")
+	fs.Float64Var(&w.ZipfS, "zipf-s", 1.1, "skew of the zipfian distribution, above 1")
+	fs.IntVar(&w.ValueSize, "value-size", 256, "size of each value written, in bytes")
+	fs.Float64Var(&w.ReadRatio, "read-ratio", 0.9, "fraction of operations that are gets, from 0 to 1")
+	fs.DurationVar(&w.duration, "duration", 10*time.Second, "how long to run")
+	fs.Int64Var(&w.Ops, "ops", 0, "send this many operations instead of running for -duration")
+	fs.Int64Var(&w.Seed, "seed", time.Now().UnixNano(), "seed for choosing keys and operations")
+	noPreload := fs.Bool("no-preload", false, "do not write every key before the run")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if err := w.check(); err != nil || fs.NArg() > 0 {
+		if err == nil {
+			err = fmt.Errorf("unexpected arguments %q", fs.Args())
+		}
+		fmt.Fprintln(stderr, "zephyrbench:", err)
+		return exitUsage
+	}
+	if w.Ops == 0 {
+		w.Duration = w.duration.String()
+	}
+	if w.Distribution != "zipfian" {
+		w.ZipfS = 0
+	}
+
+	var t target
+	var err error
+	name := *server
+	if *direct {
+		name = "direct"
+		t, err = newDirect(*dataDir)
+	} else {
+		t, err = newRemote(*server, *apiKey, w.Workers, *timeout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "zephyrbench:", err)
+		return exitError
+	}
+
+	rep, err := bench(context.Background(), t, name, w, !*noPreload)
+	if closeErr := t.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "zephyrbench:", err)
+		return exitError
+	}
+
+	if *asJSON {
+		err = json.NewEncoder(stdout).Encode(rep)
+	} else {
+		err = printReport(stdout, rep)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "zephyrbench:", err)
+		return exitError
+	}
+	if total := rep.Ops[len(rep.Ops)-1]; total.Errors > 0 {
+		fmt.Fprintf(stderr, "zephyrbench: %d of %d operations failed\n", total.Errors, total.Count)
+		return exitFailed
+	}
+	return exitOK
+}
+
+func envOr(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
+
+// check reports the first setting of w that is out of range
+func (w workload) check() error {
+	switch {
+	case w.Workers < 1:
+		return errors.New("-workers must be at least 1")
+	case w.Keys < 1:
+		return errors.New("-keys must be at least 1")
+	case w.Distribution != "uniform" && w.Distribution != "zipfian":
+		return fmt.Errorf("-distribution must be uniform or zipfian, not %q", w.Distribution)
+	case w.Distribution == "zipfian" && w.ZipfS <= 1:
+		return errors.New("-zipf-s must be above 1")
+	case w.ValueSize < 0:
+		return errors.New("-value-size must not be negative")
+	case w.ReadRatio < 0 || w.ReadRatio > 1:
+		return errors.New("-read-ratio must be from 0 to 1")
+	case w.Ops < 0:
+		return errors.New("-ops must not be negative")
+	case w.Ops == 0 && w.duration <= 0:
+		return errors.New("-duration must be positive")
+	}
+	return nil
+}
+
+// bench preloads the keys, if asked to, and runs the workload against t
+func bench(ctx context.Context, t target, name string, w workload, load bool) (report, error) {
+	rep := report{Target: name, Workload: w}
+	if load {
+		if err := preload(ctx, t, w); err != nil {
+			return rep, err
+		}
+	}
+
+	var err error
+	if rep.StatsBefore, err = t.Stats(ctx); err != nil {
+		return rep, fmt.Errorf("failed to read the stats: %w", err)
+	}
+	results, elapsed := runWorkload(ctx, t, w)
+	if rep.StatsAfter, err = t.Stats(ctx); err != nil {
+		return rep, fmt.Errorf("failed to read the stats: %w", err)
+	}
+
+	rep.Elapsed = elapsed.Seconds()
+	var total samples
+	for op, s := range results {
+		rep.Ops = append(rep.Ops, summarize(opNames[op], s, elapsed))
+		total.add(&s)
+	}
+	rep.Ops = append(rep.Ops, summarize("total", total, elapsed))
+	return rep, nil
+}
+
+// printReport writes rep as a table, followed by the counters of the stats
+// that changed during the run
+func printReport(out io.Writer, rep report) error {
+	w := rep.Workload
+	fmt.Fprintf(out, "target: %s, %d workers, %d keys (%s), %d-byte values, %.0f%% reads\n",
+		rep.Target, w.Workers, w.Keys, w.Distribution, w.ValueSize, w.ReadRatio*100)
+	fmt.Fprintf(out, "ran for %.2fs\n\n", rep.Elapsed)
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\tcount\terrors\tmisses\tops/s\tp50 ms\tp95 ms\tp99 ms\tmax ms\t")
+	for _, r := range rep.Ops {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.0f\t%.3f\t%.3f\t%.3f\t%.3f\t\n",
+			r.Op, r.Count, r.Errors, r.Misses, r.Throughput, r.P50, r.P95, r.P99, r.Max)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, r := range rep.Ops {
+		if r.LastError != "" {
+			fmt.Fprintf(out, "last %s error: %s\n", r.Op, r.LastError)
+		}
+	}
+
+	changed := statsChanges(rep.StatsBefore, rep.StatsAfter)
+	if len(changed) > 0 {
+		fmt.Fprintln(out, "\nstats:")
+		for _, line := range changed {
+			fmt.Fprintln(out, "  "+line)
+		}
+	}
+	return nil
+}
+
+// statsChanges lists the numeric counters, nested ones as a.b, that differ
+// between two stats responses, as "name: before -> after"
+func statsChanges(before, after json.RawMessage) []string {
+	var b, a map[string]interface{}
+	if json.Unmarshal(before, &b) != nil || json.Unmarshal(after, &a) != nil {
+		return nil
+	}
+	var lines []string
+	var walk func(prefix string, b, a map[string]interface{})
+	walk = func(prefix string, b, a map[string]interface{}) {
+		for name, av := range a {
+			switch av := av.(type) {
+			case float64:
+				if bv, _ := b[name].(float64); bv != av {
+					lines = append(lines, fmt.Sprintf("%s%s: %s -> %s", prefix, name, number(bv), number(av)))
+				}
+			case map[string]interface{}:
+				bv, _ := b[name].(map[string]interface{})
+				walk(prefix+name+".", bv, av)
+			}
+		}
+	}
+	walk("", b, a)
+	slices.SortFunc(lines, func(x, y string) int {
+		return strings.Compare(x[:strings.Index(x, ":")], y[:strings.Index(y, ":")])
+	})
+	return lines
+}
+
+// number formats a JSON number without an exponent
+func number(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
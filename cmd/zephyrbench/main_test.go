@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// runBench runs zephyrbench and returns its exit code and output
+func runBench(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// checkReport decodes a -json report and checks that it adds up
+func checkReport(t *testing.T, out string, ops int) report {
+	t.Helper()
+	var rep report
+	if err := json.Unmarshal([]byte(out), &rep); err != nil {
+		t.Fatalf("Report is not JSON: %s\n%s", err, out)
+	}
+	if len(rep.Ops) != numOps+1 {
+		t.Fatalf("Report has %d op rows, want %d", len(rep.Ops), numOps+1)
+	}
+	get, put, total := rep.Ops[opGet], rep.Ops[opPut], rep.Ops[numOps]
+	if total.Op != "total" || total.Count != ops || get.Count+put.Count != ops {
+		t.Errorf("Counts get %d + put %d = total %d, want %d", get.Count, put.Count, total.Count, ops)
+	}
+	if get.Count == 0 || put.Count == 0 {
+		t.Errorf("Expected both gets and puts at a read ratio of 0.5, got %d and %d", get.Count, put.Count)
+	}
+	for _, r := range rep.Ops {
+		if r.Errors != 0 || r.Misses != 0 {
+			t.Errorf("%s had %d errors and %d misses, want none after the preload", r.Op, r.Errors, r.Misses)
+		}
+		if !(r.P50 <= r.P95 && r.P95 <= r.P99 && r.P99 <= r.Max) || r.Throughput <= 0 {
+			t.Errorf("%s percentiles out of order or no throughput: %+v", r.Op, r)
+		}
+	}
+	if len(rep.StatsBefore) == 0 || len(rep.StatsAfter) == 0 {
+		t.Errorf("Report is missing the stats")
+	}
+	return rep
+}
+
+func TestDirect(t *testing.T) {
+	code, out, stderr := runBench(t, "-direct", "-data-dir", t.TempDir(), "-json", "-ops", "500",
+		"-keys", "50", "-workers", "4", "-read-ratio", "0.5", "-distribution", "zipfian", "-value-size", "32")
+	if code != exitOK {
+		t.Fatalf("exit = %d, want 0 (stderr %q)", code, stderr)
+	}
+	rep := checkReport(t, out, 500)
+	if rep.Target != "direct" || rep.Workload.Distribution != "zipfian" || rep.Workload.Duration != "" {
+		t.Errorf("Report workload = %s %+v", rep.Target, rep.Workload)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	driver, err := db.New(t.TempDir(), nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	server := httptest.NewServer(api.NewMux(api.NewHandler(driver)))
+	defer server.Close()
+
+	code, out, stderr := runBench(t, "-server", server.URL, "-json", "-ops", "300", "-keys", "20", "-read-ratio", "0.5")
+	if code != exitOK {
+		t.Fatalf("exit = %d, want 0 (stderr %q)", code, stderr)
+	}
+	checkReport(t, out, 300)
+	if n, _ := driver.KeyCount(); n != 20 {
+		t.Errorf("Server holds %d keys, want the 20 preloaded", n)
+	}
+
+	// The text report has a row per operation type and the stats that moved
+	code, out, _ = runBench(t, "-server", server.URL, "-duration", "50ms", "-keys", "20")
+	for _, want := range []string{"target: " + server.URL, "get", "put", "total", "p99 ms", "stats:"} {
+		if code != exitOK || !strings.Contains(out, want) {
+			t.Errorf("Text report (exit %d) is missing %q:\n%s", code, want, out)
+		}
+	}
+
+	// Failed operations are reported and set the exit status
+	server.Close()
+	code, _, stderr = runBench(t, "-server", server.URL, "-ops", "10", "-no-preload")
+	if code != exitError {
+		t.Errorf("exit against a stopped server = %d, want %d (stderr %q)", code, exitError, stderr)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"-workers", "0"},
+		{"-distribution", "normal"},
+		{"-distribution", "zipfian", "-zipf-s", "1"},
+		{"-read-ratio", "1.5"},
+		{"-duration", "0"},
+		{"extra"},
+	} {
+		if code, _, _ := runBench(t, args...); code != exitUsage {
+			t.Errorf("%v exit = %d, want %d", args, code, exitUsage)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jcelliott/lumber"
+	"github.com/toblrne/ZephyrusDBv2/client"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// errMiss is returned by targets for a get of a key that does not exist,
+// which is counted but is not an error
+var errMiss = errors.New("key not found")
+
+// target is what the benchmark drives, a running server or a driver opened
+// in the same process
+type target interface {
+	Get(ctx context.Context, key string) error
+	Put(ctx context.Context, key string, value []byte) error
+	Stats(ctx context.Context) (json.RawMessage, error)
+	Close() error
+}
+
+// remoteTarget sends requests to a server through the client library
+type remoteTarget struct {
+	c *client.Client
+}
+
+func newRemote(server, apiKey string, workers int, timeout time.Duration) (*remoteTarget, error) {
+	// Keep a connection per worker rather than opening new ones once the
+	// default two idle connections are in use
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = workers
+	opts := []client.Option{
+		client.WithHTTPClient(&http.Client{Transport: transport}),
+		client.WithTimeout(timeout),
+		client.WithRetries(0, 0),
+	}
+	if apiKey != "" {
+		opts = append(opts, client.WithAPIKey(apiKey))
+	}
+	c, err := client.New(server, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteTarget{c: c}, nil
+}
+
+func (t *remoteTarget) Get(ctx context.Context, key string) error {
+	_, err := t.c.Get(ctx, key)
+	if errors.Is(err, client.ErrKeyNotFound) {
+		return errMiss
+	}
+	return err
+}
+
+func (t *remoteTarget) Put(ctx context.Context, key string, value []byte) error {
+	return t.c.Put(ctx, key, value)
+}
+
+func (t *remoteTarget) Stats(ctx context.Context) (json.RawMessage, error) {
+	stats, err := t.c.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(stats)
+}
+
+func (t *remoteTarget) Close() error {
+	return nil
+}
+
+// directTarget calls a driver opened in the same process, measuring the
+// storage engine without HTTP
+type directTarget struct {
+	driver  *db.Driver
+	tempDir string // removed on Close, when no data directory was given
+}
+
+func newDirect(dir string) (*directTarget, error) {
+	t := &directTarget{}
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "zephyrbench"); err != nil {
+			return nil, err
+		}
+		t.tempDir = dir
+	}
+
+	// Keep driver logging off stdout, which carries the report
+	driver, err := db.Open(dir, &db.Options{Logger: lumber.NewBasicLogger(os.Stderr, lumber.WARN)})
+	if err != nil {
+		if t.tempDir != "" {
+			os.RemoveAll(t.tempDir)
+		}
+		return nil, err
+	}
+	t.driver = driver
+	return t, nil
+}
+
+func (t *directTarget) Get(ctx context.Context, key string) error {
+	_, err := t.driver.GetContext(ctx, key)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return errMiss
+	}
+	return err
+}
+
+func (t *directTarget) Put(ctx context.Context, key string, value []byte) error {
+	return t.driver.PutContext(ctx, key, value)
+}
+
+func (t *directTarget) Stats(ctx context.Context) (json.RawMessage, error) {
+	return json.Marshal(t.driver.Stats())
+}
+
+func (t *directTarget) Close() error {
+	err := t.driver.Close()
+	if t.tempDir != "" {
+		os.RemoveAll(t.tempDir)
+	}
+	return err
+}
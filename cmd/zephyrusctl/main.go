@@ -0,0 +1,479 @@
+// Command zephyrusctl reads and writes a ZephyrusDB database, either through
+// a running server or, with -data-dir, by opening the data directory
+// directly.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/client"
+	"github.com/toblrne/ZephyrusDBv2/config"
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"github.com/toblrne/ZephyrusDBv2/migrate"
+)
+
+// Exit codes
+const (
+	exitOK       = 0
+	exitNotFound = 1
+	exitError    = 2
+	exitUsage    = 64
+)
+
+const usage = `Usage: zephyrusctl [flags] <command> [args]
+
+Commands:
+  get <key>                      print the value of a key
+  put <key> [value]              store a value; read from -file or stdin when value is omitted
+  del <key>                      delete a key
+  ls [-prefix p] [-limit n]      list keys
+  count [-prefix p]              count keys
+  export [-prefix p]             write keys as NDJSON to stdout
+  export-csv [-prefix p] -fields a,b
+                                 write the named fields of JSON values as CSV
+                                 to stdout
+  import [-skip] [file]          read NDJSON records from file or stdin
+  import-bolt [-buckets b=ns,...] <file>
+                                 copy buckets of a bbolt file into namespaces;
+                                 needs -data-dir
+  migrate redis -source <url> [-pattern p] [-structures] [-rate n] [-resume file]
+                                 copy keys and their TTLs from a Redis server
+  compact                        remove leftover temp files and unused blobs
+  rebalance                      move keys to the data directory they belong on
+  restore -at <time> <snapshot> <oplog-dir>
+                                 rewind -data-dir to an RFC 3339 time from a
+                                 /replication/snapshot file and a copy of the oplog
+  migrate-layout --from flat --to encoded-v1 <data-dir>
+                                 rename the key files of a stopped server's data
+                                 directory, and of -shard-dirs, to another
+                                 layout; run it again to finish one interrupted
+  stats                          print server counters
+
+Exit status is 0 on success, 1 when the key was not found, 2 on other
+errors and 64 on usage errors.
+
+Flags:
+`
+
+// cli holds the global flags
+type cli struct {
+	server   string
+	dataDir  string
+	snapshot string
+	shards   string
+	apiKey   string
+	timeout  time.Duration
+	json     bool
+
+	encodeNames bool // -data-dir keeps keys under encoded file names
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{stdin: stdin, stdout: stdout, stderr: stderr}
+
+	fs := flag.NewFlagSet("zephyrusctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.server, "server", envOr("ZEPHYRUS_URL", "http://localhost:8080"), "server URL (env ZEPHYRUS_URL)")
+	fs.StringVar(&c.dataDir, "data-dir", "", "open this data directory directly instead of using a server; the server must be stopped")
+	fs.StringVar(&c.snapshot, "snapshot-path", "", "B-tree snapshot used with -data-dir, defaults to <data-dir>/.zephyrus/btree.json")
+	fs.StringVar(&c.shards, "shard-dirs", "", "comma-separated extra data directories used with -data-dir, as given to the server")
+	fs.BoolVar(&c.encodeNames, "encode-file-names", false, "the -data-dir keeps keys under encoded file names, as with the server's -encode-file-names")
+	fs.StringVar(&c.apiKey, "api-key", os.Getenv("ZEPHYRUS_API_KEY"), "API key (env ZEPHYRUS_API_KEY)")
+	fs.DurationVar(&c.timeout, "timeout", 30*time.Second, "timeout for each request")
+	fs.BoolVar(&c.json, "json", false, "print JSON instead of plain text")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	// The migration works on the files, without opening the data
+	// directory, which Open refuses while it is half migrated
+	if fs.Arg(0) == "migrate-layout" {
+		return c.migrateLayout(fs.Args()[1:])
+	}
+
+	s, err := c.open()
+	if err != nil {
+		fmt.Fprintln(stderr, "zephyrusctl:", err)
+		return exitError
+	}
+
+	code := c.dispatch(s, fs.Arg(0), fs.Args()[1:])
+	if err := s.Close(); err != nil {
+		fmt.Fprintln(stderr, "zephyrusctl:", err)
+		if code == exitOK {
+			code = exitError
+		}
+	}
+	return code
+}
+
+func envOr(name, fallback string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return fallback
+}
+
+func (c *cli) open() (store, error) {
+	if c.dataDir != "" {
+		return openLocal(c.dataDir, c.snapshot, config.SplitList(c.shards), c.encodeNames)
+	}
+	opts := []client.Option{client.WithTimeout(c.timeout)}
+	if c.apiKey != "" {
+		opts = append(opts, client.WithAPIKey(c.apiKey))
+	}
+	cl, err := client.New(c.server, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return remoteStore{c: cl}, nil
+}
+
+// dispatch runs one subcommand and returns the exit code
+func (c *cli) dispatch(s store, name string, args []string) int {
+	ctx := context.Background()
+
+	fs := flag.NewFlagSet("zephyrusctl "+name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	prefix := fs.String("prefix", "", "only keys starting with this prefix")
+	limit := fs.Int("limit", 0, "maximum number of keys, 0 for all")
+	file := fs.String("file", "", "read the value from this file")
+	skip := fs.Bool("skip", false, "keep keys that already exist")
+	fields := fs.String("fields", "", "comma-separated JSON fields, e.g. name,address.city")
+	source := fs.String("source", "", "server to migrate from, e.g. redis://host:6379")
+	pattern := fs.String("pattern", "*", "keys to migrate, as for Redis SCAN MATCH")
+	structures := fs.Bool("structures", false, "also migrate hashes, lists, sets and sorted sets as JSON")
+	rate := fs.Int("rate", 0, "most keys migrated per second, 0 for no limit")
+	resume := fs.String("resume", "", "record progress in this file and continue from it")
+	buckets := fs.String("buckets", "", "comma-separated buckets to import, as bucket=namespace or bucket for a namespace of the same name; every bucket when empty")
+	at := fs.String("at", "", "time to restore to, e.g. 2024-05-01T14:32:00Z")
+	if name == "migrate" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		// Let the flags follow the source type, as in "migrate redis -source ..."
+		args = append(args[1:], args[0])
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	args = fs.Args()
+
+	want := func(n int, what string) bool {
+		if len(args) != n {
+			fmt.Fprintf(c.stderr, "usage: zephyrusctl %s %s\n", name, what)
+			return false
+		}
+		return true
+	}
+
+	var err error
+	switch name {
+	case "get":
+		if !want(1, "<key>") {
+			return exitUsage
+		}
+		var value []byte
+		if value, err = s.Get(ctx, args[0]); err == nil {
+			if c.json {
+				err = c.printJSON(db.NewRecord(args[0], value))
+			} else {
+				_, err = c.stdout.Write(value)
+			}
+		}
+
+	case "put":
+		if len(args) < 1 || len(args) > 2 {
+			fmt.Fprintln(c.stderr, "usage: zephyrusctl put [-file f] <key> [value]")
+			return exitUsage
+		}
+		var value []byte
+		switch {
+		case len(args) == 2:
+			value = []byte(args[1])
+		case *file != "":
+			value, err = os.ReadFile(*file)
+		default:
+			value, err = io.ReadAll(c.stdin)
+		}
+		if err == nil {
+			var created bool
+			if created, err = s.Put(ctx, args[0], value); err == nil {
+				c.print(map[string]interface{}{"key": args[0], "created": created}, createdText(created))
+			}
+		}
+
+	case "del":
+		if !want(1, "<key>") {
+			return exitUsage
+		}
+		if err = s.Delete(ctx, args[0]); err == nil {
+			c.print(map[string]interface{}{"key": args[0], "deleted": true}, "deleted")
+		}
+
+	case "ls":
+		if !want(0, "[-prefix p] [-limit n]") {
+			return exitUsage
+		}
+		var keys []string
+		if keys, err = s.List(ctx, *prefix, *limit); err == nil {
+			c.print(map[string]interface{}{"keys": keys}, strings.Join(keys, "\n"))
+		}
+
+	case "count":
+		if !want(0, "[-prefix p]") {
+			return exitUsage
+		}
+		var n int
+		if n, err = s.Count(ctx, *prefix); err == nil {
+			c.print(map[string]interface{}{"count": n}, fmt.Sprint(n))
+		}
+
+	case "export":
+		if !want(0, "[-prefix p]") {
+			return exitUsage
+		}
+		err = s.Export(ctx, c.stdout, *prefix)
+
+	case "export-csv":
+		if len(args) != 0 || *fields == "" {
+			fmt.Fprintln(c.stderr, "usage: zephyrusctl export-csv [-prefix p] -fields a,b")
+			return exitUsage
+		}
+		var skipped int
+		if skipped, err = s.ExportCSV(ctx, c.stdout, *prefix, strings.Split(*fields, ",")); err == nil && skipped > 0 {
+			fmt.Fprintf(c.stderr, "zephyrusctl: skipped %d values that are not JSON objects\n", skipped)
+		}
+
+	case "import":
+		if len(args) > 1 {
+			fmt.Fprintln(c.stderr, "usage: zephyrusctl import [-skip] [file]")
+			return exitUsage
+		}
+		in := c.stdin
+		if len(args) == 1 {
+			f, openErr := os.Open(args[0])
+			if openErr != nil {
+				fmt.Fprintln(c.stderr, "zephyrusctl:", openErr)
+				return exitError
+			}
+			defer f.Close()
+			in = f
+		}
+		var stats interface{}
+		if stats, err = s.Import(ctx, in, *skip); err == nil {
+			err = c.printStats(stats)
+		}
+
+	case "migrate":
+		if len(args) != 1 || args[0] != "redis" || *source == "" {
+			fmt.Fprintln(c.stderr, "usage: zephyrusctl migrate redis -source <url> [-pattern p] [-structures] [-rate n] [-resume file]")
+			return exitUsage
+		}
+		var stats migrate.RedisStats
+		stats, err = migrate.FromRedis(ctx, s, migrate.RedisOptions{
+			Source:     *source,
+			Pattern:    *pattern,
+			Structures: *structures,
+			Rate:       *rate,
+			ResumeFile: *resume,
+			Progress: func(p migrate.RedisStats) {
+				if !c.json {
+					fmt.Fprintf(c.stderr, "scanned %d keys, copied %d, skipped %d\n", p.Scanned, p.Copied, p.Skipped)
+				}
+			},
+		})
+		if err == nil {
+			err = c.printStats(stats)
+		}
+
+	case "import-bolt":
+		if !want(1, "[-buckets b=ns,...] <file>") {
+			return exitUsage
+		}
+		mapping := make(map[string]string)
+		for _, pair := range config.SplitList(*buckets) {
+			bucket, ns, found := strings.Cut(pair, "=")
+			if !found {
+				ns = bucket
+			}
+			mapping[bucket] = ns
+		}
+		var stats interface{}
+		if stats, err = s.ImportBolt(ctx, args[0], mapping); err == nil {
+			err = c.printStats(stats)
+		}
+
+	case "compact":
+		if !want(0, "") {
+			return exitUsage
+		}
+		var result interface{}
+		result, err = s.Compact(ctx, func(scanned, total, removed int) {
+			if !c.json {
+				fmt.Fprintf(c.stderr, "checked %d of %d files, removed %d\n", scanned, total, removed)
+			}
+		})
+		if err == nil {
+			err = c.printStats(result)
+		}
+
+	case "rebalance":
+		if !want(0, "") {
+			return exitUsage
+		}
+		var result interface{}
+		result, err = s.Rebalance(ctx, func(scanned, total, moved int) {
+			if !c.json {
+				fmt.Fprintf(c.stderr, "checked %d of %d keys, moved %d\n", scanned, total, moved)
+			}
+		})
+		if err == nil {
+			err = c.printStats(result)
+		}
+
+	case "restore":
+		if !want(2, "-at <time> <snapshot> <oplog-dir>") {
+			return exitUsage
+		}
+		t, parseErr := time.Parse(time.RFC3339, *at)
+		if parseErr != nil {
+			fmt.Fprintln(c.stderr, "zephyrusctl: -at must be an RFC 3339 time, e.g. 2024-05-01T14:32:00Z")
+			return exitUsage
+		}
+		if err = s.Restore(ctx, args[0], args[1], t); err == nil {
+			c.print(map[string]interface{}{"restored": true, "at": t}, "restored to "+t.Format(time.RFC3339))
+		}
+
+	case "stats":
+		if !want(0, "") {
+			return exitUsage
+		}
+		var stats interface{}
+		if stats, err = s.Stats(ctx); err == nil {
+			err = c.printStats(stats)
+		}
+
+	default:
+		fmt.Fprintf(c.stderr, "zephyrusctl: unknown command %q\n", name)
+		return exitUsage
+	}
+
+	if errors.Is(err, errNotFound) {
+		fmt.Fprintln(c.stderr, "zephyrusctl: key not found")
+		return exitNotFound
+	}
+	if err != nil {
+		fmt.Fprintln(c.stderr, "zephyrusctl:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// migrateLayout runs the migrate-layout command and returns the exit code
+func (c *cli) migrateLayout(args []string) int {
+	fs := flag.NewFlagSet("zephyrusctl migrate-layout", flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	from := fs.String("from", string(db.LayoutFlat), "layout the data directory is in")
+	to := fs.String("to", string(db.LayoutEncodedV1), "layout to migrate it to")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	fromLayout, fromErr := db.ParseLayout(*from)
+	toLayout, toErr := db.ParseLayout(*to)
+	if fs.NArg() != 1 || fromErr != nil || toErr != nil {
+		fmt.Fprintln(c.stderr, "usage: zephyrusctl migrate-layout --from flat|encoded-v1 --to flat|encoded-v1 <data-dir>")
+		return exitUsage
+	}
+
+	stats, err := db.MigrateLayout(context.Background(), fs.Arg(0), db.MigrateLayoutOptions{
+		From: fromLayout,
+		To:   toLayout,
+		Dirs: config.SplitList(c.shards),
+		Progress: func(p db.LayoutStats) {
+			if !c.json {
+				fmt.Fprintf(c.stderr, "copied %d of %d files, removed %d\n", p.Copied, p.Files, p.Removed)
+			}
+		},
+	})
+	if err == nil {
+		err = c.printStats(stats)
+	}
+	if err != nil {
+		fmt.Fprintln(c.stderr, "zephyrusctl:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+func createdText(created bool) string {
+	if created {
+		return "created"
+	}
+	return "updated"
+}
+
+// print writes v as JSON with -json, or text otherwise
+func (c *cli) print(v interface{}, text string) {
+	if c.json {
+		c.printJSON(v)
+		return
+	}
+	if text != "" {
+		fmt.Fprintln(c.stdout, text)
+	}
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	return enc.Encode(v)
+}
+
+// printStats prints a struct as JSON with -json, or as "field: value" lines
+func (c *cli) printStats(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		_, err = fmt.Fprintln(c.stdout, string(data))
+		return err
+	}
+
+	// Keep the struct's field order by decoding into an ordered token stream
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.Token() // {
+	for dec.More() {
+		key, _ := dec.Token()
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "%s: %s\n", key, value)
+	}
+	return nil
+}
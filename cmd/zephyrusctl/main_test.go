@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"github.com/toblrne/ZephyrusDBv2/resp"
+)
+
+// ctl runs zephyrusctl and returns its exit code and output
+func ctl(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRemote(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	driver, err := db.New(dir, nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	server := httptest.NewServer(api.InitRouter(api.NewHandler(driver)))
+	defer server.Close()
+
+	tests := []struct {
+		stdin string
+		args  []string
+		code  int
+		out   string
+	}{
+		{"", []string{"put", "user:1", "alice"}, exitOK, "created\n"},
+		{"bob", []string{"put", "user:2"}, exitOK, "created\n"},
+		{"", []string{"put", "user:2", "bobby"}, exitOK, "updated\n"},
+		{"", []string{"get", "user:2"}, exitOK, "bobby"},
+		{"", []string{"-json", "get", "user:1"}, exitOK, `{"key":"user:1","value_base64":"YWxpY2U="}` + "\n"},
+		{"", []string{"get", "missing"}, exitNotFound, ""},
+		{"", []string{"ls", "-prefix", "user:"}, exitOK, "user:1\nuser:2\n"},
+		{"", []string{"-json", "count"}, exitOK, `{"count":2}` + "\n"},
+		{"", []string{"del", "user:1"}, exitOK, "deleted\n"},
+		{"", []string{"del", "user:1"}, exitNotFound, ""},
+		{"", []string{"stats"}, exitOK, "keys: 1\n"},
+		{"", []string{"frobnicate"}, exitUsage, ""},
+	}
+	for _, tt := range tests {
+		code, out, stderr := ctl(t, tt.stdin, append([]string{"-server", server.URL}, tt.args...)...)
+		if code != tt.code {
+			t.Errorf("%v exit = %d, want %d (stderr %q)", tt.args, code, tt.code, stderr)
+		}
+		if !strings.HasPrefix(out, tt.out) {
+			t.Errorf("%v output = %q, want prefix %q", tt.args, out, tt.out)
+		}
+	}
+
+	// Export and re-import round trip
+	_, exported, _ := ctl(t, "", "-server", server.URL, "export")
+	ctl(t, "", "-server", server.URL, "del", "user:2")
+	if code, out, _ := ctl(t, exported, "-server", server.URL, "import"); code != exitOK || !strings.Contains(out, "imported: 1") {
+		t.Errorf("import = %d %q, want imported: 1", code, out)
+	}
+
+	// CSV export quotes awkward cells and counts values that are not objects
+	ctl(t, "", "-server", server.URL, "put", "user:3", `{"name": "Smith, \"Al\"\nJr", "age": 40}`)
+	code, out, stderr := ctl(t, "", "-server", server.URL, "export-csv", "-prefix", "user:", "-fields", "name,age,email")
+	want := "key,name,age,email\nuser:3,\"Smith, \"\"Al\"\"\nJr\",40,\n"
+	if code != exitOK || out != want || !strings.Contains(stderr, "skipped 1 ") {
+		t.Errorf("export-csv = %d %q %q, want %q", code, out, stderr, want)
+	}
+	if code, _, _ := ctl(t, "", "-server", server.URL, "export-csv"); code != exitUsage {
+		t.Errorf("export-csv without -fields exit = %d, want %d", code, exitUsage)
+	}
+
+	// Errors other than not found get their own exit code
+	if code, _, _ := ctl(t, "", "-server", "http://127.0.0.1:1", "-timeout", "1s", "get", "k"); code != exitError {
+		t.Errorf("unreachable server exit = %d, want %d", code, exitError)
+	}
+}
+
+func TestOffline(t *testing.T) {
+	dir := t.TempDir()
+
+	if code, _, stderr := ctl(t, "", "-data-dir", dir, "put", "k", "v"); code != exitOK {
+		t.Fatalf("offline put exit = %d: %s", code, stderr)
+	}
+	if _, err := os.Stat(dir + "/.zephyrus/btree.json"); err != nil {
+		t.Errorf("offline put did not save the snapshot: %s", err)
+	}
+	if code, out, _ := ctl(t, "", "-data-dir", dir, "get", "k"); code != exitOK || out != "v" {
+		t.Errorf("offline get = %d %q, want v", code, out)
+	}
+	if code, out, _ := ctl(t, "", "-data-dir", dir, "ls"); code != exitOK || out != "k\n" {
+		t.Errorf("offline ls = %d %q, want k", code, out)
+	}
+	shard := t.TempDir()
+	if code, out, stderr := ctl(t, "", "-data-dir", dir, "-shard-dirs", shard, "rebalance"); code != exitOK || !strings.Contains(out, "scanned: 1\n") {
+		t.Errorf("offline rebalance = %d %q: %s", code, out, stderr)
+	}
+	if code, out, _ := ctl(t, "", "-data-dir", dir, "-shard-dirs", shard, "get", "k"); code != exitOK || out != "v" {
+		t.Errorf("get after rebalance = %d %q, want v", code, out)
+	}
+	os.WriteFile(filepath.Join(dir, "left.tmp"), []byte("over"), 0644)
+	if code, out, stderr := ctl(t, "", "-data-dir", dir, "compact"); code != exitOK || !strings.Contains(out, "done: true\n") {
+		t.Errorf("offline compact = %d %q: %s", code, out, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "left.tmp")); !os.IsNotExist(err) {
+		t.Errorf("left.tmp after an offline compact: %v, want it removed", err)
+	}
+	if code, _, _ := ctl(t, "", "-data-dir", dir, "restore", "-at", "yesterday", "snap", "oplog"); code != exitUsage {
+		t.Errorf("restore with a bad -at exit = %d, want %d", code, exitUsage)
+	}
+	if code, _, _ := ctl(t, "", "-data-dir", dir+"/missing", "get", "k"); code != exitError {
+		t.Errorf("missing data dir exit = %d, want %d", code, exitError)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	source, err := db.New(t.TempDir(), nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer source.Close()
+	source.Put("app:1", []byte("one"))
+	source.Put("app:2", []byte("two"))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	server := resp.NewServer(source)
+	go server.Serve(lis)
+	defer server.Close()
+
+	dir := t.TempDir()
+	if code, _, _ := ctl(t, "", "-data-dir", dir, "migrate", "redis"); code != exitUsage {
+		t.Errorf("migrate without -source exit = %d, want %d", code, exitUsage)
+	}
+	code, out, stderr := ctl(t, "", "-data-dir", dir, "migrate", "redis", "--source", "redis://"+lis.Addr().String(), "--pattern", "app:*")
+	if code != exitOK || !strings.Contains(out, "copied: 2\n") {
+		t.Fatalf("migrate = %d %q: %s", code, out, stderr)
+	}
+	if code, out, _ := ctl(t, "", "-data-dir", dir, "get", "app:2"); code != exitOK || out != "two" {
+		t.Errorf("get after migrate = %d %q, want two", code, out)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	dir := t.TempDir()
+	if code, _, stderr := ctl(t, "", "-data-dir", dir, "put", "User:1", "v"); code != exitOK {
+		t.Fatalf("offline put exit = %d: %s", code, stderr)
+	}
+	if code, _, _ := ctl(t, "", "migrate-layout", "--from", "flat", "--to", "nested", dir); code != exitUsage {
+		t.Errorf("migrate-layout to an unknown layout exit = %d, want %d", code, exitUsage)
+	}
+	code, out, stderr := ctl(t, "", "migrate-layout", "--from", "flat", "--to", "encoded-v1", dir)
+	if code != exitOK || !strings.Contains(out, "copied: 1\n") || !strings.Contains(out, "removed: 1\n") {
+		t.Fatalf("migrate-layout = %d %q: %s", code, out, stderr)
+	}
+	if code, _, stderr := ctl(t, "", "-data-dir", dir, "get", "User:1"); code != exitError || !strings.Contains(stderr, "layout") {
+		t.Errorf("get without -encode-file-names after migrate-layout = %d: %s, want a layout error", code, stderr)
+	}
+	if code, out, _ := ctl(t, "", "-data-dir", dir, "-encode-file-names", "get", "User:1"); code != exitOK || out != "v" {
+		t.Errorf("get after migrate-layout = %d %q, want v", code, out)
+	}
+}
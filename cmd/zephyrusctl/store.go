@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jcelliott/lumber"
+	"github.com/toblrne/ZephyrusDBv2/client"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// errNotFound is returned by stores for missing keys
+var errNotFound = errors.New("key not found")
+
+// store is what the subcommands need, served either by a running server or
+// by a data directory opened directly
+type store interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Put(ctx context.Context, key string, value []byte) (bool, error)
+	PutBatch(ctx context.Context, entries []db.BatchEntry) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string, limit int) ([]string, error)
+	Count(ctx context.Context, prefix string) (int, error)
+	Export(ctx context.Context, w io.Writer, prefix string) error
+	ExportCSV(ctx context.Context, w io.Writer, prefix string, fields []string) (int, error)
+	Import(ctx context.Context, r io.Reader, skipExisting bool) (interface{}, error)
+	ImportBolt(ctx context.Context, path string, buckets map[string]string) (interface{}, error)
+	Compact(ctx context.Context, progress func(scanned, total, removed int)) (interface{}, error)
+	Rebalance(ctx context.Context, progress func(scanned, total, moved int)) (interface{}, error)
+	Restore(ctx context.Context, snapshot, oplog string, at time.Time) error
+	Stats(ctx context.Context) (interface{}, error)
+	Close() error
+}
+
+// remoteStore talks to a server through the client library
+type remoteStore struct {
+	c *client.Client
+}
+
+func (s remoteStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.c.Get(ctx, key)
+	if errors.Is(err, client.ErrKeyNotFound) {
+		return nil, errNotFound
+	}
+	return value, err
+}
+
+func (s remoteStore) Put(ctx context.Context, key string, value []byte) (bool, error) {
+	return s.c.PutWithTTL(ctx, key, value, 0)
+}
+
+// PutBatch writes the entries one request at a time, as the server has no
+// batch write
+func (s remoteStore) PutBatch(ctx context.Context, entries []db.BatchEntry) error {
+	for _, e := range entries {
+		if _, err := s.c.PutWithTTL(ctx, e.Key, e.Value, e.TTL); err != nil {
+			return fmt.Errorf("failed to write %s: %w", e.Key, err)
+		}
+	}
+	return nil
+}
+
+func (s remoteStore) Delete(ctx context.Context, key string) error {
+	err := s.c.Delete(ctx, key)
+	if errors.Is(err, client.ErrKeyNotFound) {
+		return errNotFound
+	}
+	return err
+}
+
+func (s remoteStore) List(ctx context.Context, prefix string, limit int) ([]string, error) {
+	return s.c.List(ctx, prefix, "", limit)
+}
+
+func (s remoteStore) Count(ctx context.Context, prefix string) (int, error) {
+	return s.c.Count(ctx, prefix)
+}
+
+func (s remoteStore) Export(ctx context.Context, w io.Writer, prefix string) error {
+	return s.c.Export(ctx, w, prefix)
+}
+
+func (s remoteStore) ExportCSV(ctx context.Context, w io.Writer, prefix string, fields []string) (int, error) {
+	return s.c.ExportCSV(ctx, w, prefix, fields)
+}
+
+func (s remoteStore) Import(ctx context.Context, r io.Reader, skipExisting bool) (interface{}, error) {
+	return s.c.Import(ctx, r, skipExisting)
+}
+
+func (s remoteStore) ImportBolt(ctx context.Context, path string, buckets map[string]string) (interface{}, error) {
+	return nil, errors.New("import-bolt writes to a stopped server's data directory; use -data-dir")
+}
+
+func (s remoteStore) Compact(ctx context.Context, progress func(scanned, total, removed int)) (interface{}, error) {
+	return s.c.CompactWithProgress(ctx, func(p client.CompactProgress) {
+		progress(p.Scanned, p.Total, p.Removed)
+	})
+}
+
+func (s remoteStore) Rebalance(ctx context.Context, progress func(scanned, total, moved int)) (interface{}, error) {
+	return s.c.Rebalance(ctx, func(p client.RebalanceProgress) {
+		progress(p.Scanned, p.Total, p.Moved)
+	})
+}
+
+func (s remoteStore) Restore(ctx context.Context, snapshot, oplog string, at time.Time) error {
+	return errors.New("restore works on a stopped server's data directory; use -data-dir")
+}
+
+func (s remoteStore) Stats(ctx context.Context) (interface{}, error) {
+	return s.c.Stats(ctx)
+}
+
+func (s remoteStore) Close() error {
+	return nil
+}
+
+// localStore opens a data directory directly. The server must not be running
+// on the same directory. The driver loads the B-tree snapshot on open and,
+// if anything was written, saves it again on Close.
+type localStore struct {
+	driver *db.Driver
+}
+
+func openLocal(dir, snapshot string, shardDirs []string, encodeNames bool) (*localStore, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	// Keep driver logging off stdout, which carries command output
+	driver, err := db.Open(dir, &db.Options{
+		Logger:    lumber.NewBasicLogger(os.Stderr, lumber.WARN),
+		CacheSize: 25,
+		Degree:    16,
+		ShardDirs: shardDirs,
+
+		SnapshotPath:    snapshot,
+		EncodeFileNames: encodeNames,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &localStore{driver: driver}, nil
+}
+
+func (s *localStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.driver.Get(key)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return nil, errNotFound
+	}
+	return value, err
+}
+
+func (s *localStore) Put(ctx context.Context, key string, value []byte) (bool, error) {
+	return s.driver.Upsert(key, value)
+}
+
+func (s *localStore) PutBatch(ctx context.Context, entries []db.BatchEntry) error {
+	_, err := s.driver.PutBatch(entries)
+	return err
+}
+
+func (s *localStore) Delete(ctx context.Context, key string) error {
+	err := s.driver.Delete(key)
+	if errors.Is(err, db.ErrKeyNotFound) {
+		return errNotFound
+	}
+	return err
+}
+
+func (s *localStore) List(ctx context.Context, prefix string, limit int) ([]string, error) {
+	return s.driver.List(ctx, prefix, "", limit)
+}
+
+func (s *localStore) Count(ctx context.Context, prefix string) (int, error) {
+	return s.driver.Count(ctx, prefix)
+}
+
+func (s *localStore) Export(ctx context.Context, w io.Writer, prefix string) error {
+	_, err := s.driver.Export(w, prefix)
+	return err
+}
+
+func (s *localStore) ExportCSV(ctx context.Context, w io.Writer, prefix string, fields []string) (int, error) {
+	stats, err := s.driver.ExportCSV(w, prefix, fields)
+	return stats.Skipped, err
+}
+
+func (s *localStore) Import(ctx context.Context, r io.Reader, skipExisting bool) (interface{}, error) {
+	mode := db.ImportOverwrite
+	if skipExisting {
+		mode = db.ImportSkip
+	}
+	return s.driver.Import(r, mode)
+}
+
+func (s *localStore) ImportBolt(ctx context.Context, path string, buckets map[string]string) (interface{}, error) {
+	return s.driver.ImportBolt(path, buckets)
+}
+
+func (s *localStore) Compact(ctx context.Context, progress func(scanned, total, removed int)) (interface{}, error) {
+	return s.driver.CompactContext(ctx, func(p db.CompactProgress) {
+		progress(p.Scanned, p.Total, p.Removed)
+	})
+}
+
+func (s *localStore) Rebalance(ctx context.Context, progress func(scanned, total, moved int)) (interface{}, error) {
+	return s.driver.Rebalance(ctx, func(p db.RebalanceProgress) {
+		progress(p.Scanned, p.Total, p.Moved)
+	})
+}
+
+func (s *localStore) Restore(ctx context.Context, snapshot, oplog string, at time.Time) error {
+	return s.driver.RestoreToTime(snapshot, oplog, at)
+}
+
+func (s *localStore) Stats(ctx context.Context) (interface{}, error) {
+	return s.driver.Stats(), nil
+}
+
+func (s *localStore) Close() error {
+	return s.driver.Close()
+}
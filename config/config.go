@@ -0,0 +1,644 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcelliott/lumber"
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// Environment variables consulted when the corresponding flag is not set
+const (
+	EnvAddr            = "ZEPHYRUS_ADDR"
+	EnvGRPCAddr        = "ZEPHYRUS_GRPC_ADDR"
+	EnvRESPAddr        = "ZEPHYRUS_RESP_ADDR"
+	EnvDataDir         = "ZEPHYRUS_DATA_DIR"
+	EnvShardDirs       = "ZEPHYRUS_SHARD_DIRS"
+	EnvColdDir         = "ZEPHYRUS_COLD_DIR"
+	EnvDemoteAfter     = "ZEPHYRUS_DEMOTE_AFTER"
+	EnvPromoteOnRead   = "ZEPHYRUS_PROMOTE_ON_READ"
+	EnvCacheSize       = "ZEPHYRUS_CACHE_SIZE"
+	EnvDegree          = "ZEPHYRUS_BTREE_DEGREE"
+	EnvSnapshotPath    = "ZEPHYRUS_SNAPSHOT_PATH"
+	EnvSnapshotEvery   = "ZEPHYRUS_SNAPSHOT_EVERY"
+	EnvSnapshotArchive = "ZEPHYRUS_SNAPSHOT_ARCHIVE"
+	EnvSnapshotCodec   = "ZEPHYRUS_SNAPSHOT_CODEC"
+	EnvSkipReconcile   = "ZEPHYRUS_SKIP_RECONCILE"
+	EnvVerifyOnOpen    = "ZEPHYRUS_VERIFY_ON_OPEN"
+	EnvCorruptLimit    = "ZEPHYRUS_CORRUPT_LIMIT"
+	EnvEncodeFileNames = "ZEPHYRUS_ENCODE_FILE_NAMES"
+	EnvWriteBack       = "ZEPHYRUS_WRITE_BACK"
+	EnvDefaultTTL      = "ZEPHYRUS_DEFAULT_TTL"
+	EnvSweepEvery      = "ZEPHYRUS_SWEEP_EVERY"
+	EnvSweepBatch      = "ZEPHYRUS_SWEEP_BATCH"
+	EnvSweepRate       = "ZEPHYRUS_SWEEP_RATE"
+	EnvCompactRate     = "ZEPHYRUS_COMPACT_RATE"
+	EnvCompactBytes    = "ZEPHYRUS_COMPACT_BYTES_RATE"
+	EnvCompactWindow   = "ZEPHYRUS_COMPACT_WINDOW"
+	EnvSchemaAdvisory  = "ZEPHYRUS_SCHEMA_ADVISORY"
+	EnvDedupThreshold  = "ZEPHYRUS_DEDUP_THRESHOLD"
+	EnvMinFreeSpace    = "ZEPHYRUS_MIN_FREE_SPACE"
+	EnvTextIndexFields = "ZEPHYRUS_TEXT_INDEX_FIELDS"
+	EnvShutdownTimeout = "ZEPHYRUS_SHUTDOWN_TIMEOUT"
+	EnvReadTimeout     = "ZEPHYRUS_READ_TIMEOUT"
+	EnvWriteTimeout    = "ZEPHYRUS_WRITE_TIMEOUT"
+	EnvIdempotency     = "ZEPHYRUS_IDEMPOTENCY_WINDOW"
+	EnvMaxWatchers     = "ZEPHYRUS_MAX_WATCHERS"
+	EnvWebhookWorkers  = "ZEPHYRUS_WEBHOOK_WORKERS"
+	EnvWebhookQueue    = "ZEPHYRUS_WEBHOOK_QUEUE"
+	EnvMaxValueSize    = "ZEPHYRUS_MAX_VALUE_SIZE"
+	EnvMaxKeyLen       = "ZEPHYRUS_MAX_KEY_LEN"
+	EnvMaxKeys         = "ZEPHYRUS_MAX_KEYS"
+	EnvAPIKeys         = "ZEPHYRUS_API_KEYS"
+	EnvAPIKeyFile      = "ZEPHYRUS_API_KEY_FILE"
+	EnvCursorSecret    = "ZEPHYRUS_CURSOR_SECRET"
+	EnvCacheControl    = "ZEPHYRUS_CACHE_CONTROL"
+	EnvCachePrefixes   = "ZEPHYRUS_CACHE_CONTROL_PREFIXES"
+	EnvSocketMode      = "ZEPHYRUS_SOCKET_MODE"
+	EnvReplicaOf       = "ZEPHYRUS_REPLICA_OF"
+	EnvOplogSize       = "ZEPHYRUS_OPLOG_SIZE"
+	EnvOplogMaxAge     = "ZEPHYRUS_OPLOG_MAX_AGE"
+	EnvOplogValues     = "ZEPHYRUS_OPLOG_VALUES"
+	EnvReplicaAPIKey   = "ZEPHYRUS_REPLICA_API_KEY"
+	EnvLogFormat       = "ZEPHYRUS_LOG_FORMAT"
+	EnvLogLevel        = "ZEPHYRUS_LOG_LEVEL"
+	EnvSlowOpThreshold = "ZEPHYRUS_SLOW_OP_THRESHOLD"
+)
+
+// Config holds the settings needed to start the server
+type Config struct {
+	Addr            string // host:port, or unix:///path for a Unix domain socket
+	GRPCAddr        string // empty disables the gRPC listener
+	RESPAddr        string // empty disables the Redis protocol listener
+	DataDir         string
+	ShardDirs       string // comma-separated extra data directories
+	ColdDir         string // directory for keys unused for DemoteAfter
+	DemoteAfter     time.Duration
+	PromoteOnRead   bool
+	CacheSize       int
+	Degree          int
+	SnapshotPath    string
+	SnapshotEvery   time.Duration // 0 saves the snapshot only on shutdown
+	SnapshotArchive string        // every:keep retention of timestamped snapshots, empty for none
+	SnapshotCodec   string        // "json" or "gob"
+	SkipReconcile   bool          // trust the snapshot without listing the data directories
+	VerifyOnOpen    bool          // read back every value on start, checking its content hash
+	CorruptLimit    int           // refuse to start once this many corrupt files are found, 0 to always start
+	EncodeFileNames bool          // store keys under names safe on Windows and case-insensitive filesystems
+	WriteBack       time.Duration // 0 writes values to disk before acknowledging them
+	DefaultTTL      time.Duration // expiry of keys written without a TTL, 0 for none
+	SweepEvery      time.Duration // 0 removes expired keys only when they are next used
+	SweepBatch      int           // expired keys removed under the write lock at a time
+	SweepRate       int           // expired keys removed per second, 0 for no cap
+	CompactRate     int           // unused files compaction removes per second, 0 for no cap
+	CompactBytes    int           // bytes compaction removes per second, 0 for no cap
+	CompactWindow   string        // HH:MM-HH:MM local time to compact in daily, empty for never
+	SchemaAdvisory  bool          // log values failing their schema instead of refusing them
+	DedupThreshold  int           // bytes from which identical values are stored once, 0 to store every value apart
+	MinFreeSpace    int           // bytes each data directory keeps free by refusing writes, 0 to only stop on a full disk
+	TextIndexFields string        // comma-separated JSON fields searched by /search, empty for none
+	ShutdownTimeout time.Duration
+	ReadTimeout     time.Duration // bounds GET /key requests, 0 for no bound
+	WriteTimeout    time.Duration // bounds PUT and DELETE /key requests, 0 for no bound
+	Idempotency     time.Duration // how long responses to requests with an Idempotency-Key are replayed, 0 to ignore the header
+	MaxWatchers     int
+	WebhookWorkers  int    // webhook deliveries made at once
+	WebhookQueue    int    // webhook notifications waiting for delivery, beyond which they are dropped
+	MaxValueSize    int    // bytes, 0 for no limit
+	MaxKeyLen       int    // bytes, 0 for db.MaxKeyLen
+	MaxKeys         int    // 0 for no limit
+	APIKeys         string // comma-separated key:role pairs, empty disables auth
+	APIKeyFile      string // JSON file of API keys, possibly scoped to namespaces, reloaded when it changes
+	CursorSecret    string // signs /keys cursors, random when empty
+	CacheControl    string // Cache-Control of GET /key responses, empty for none
+	CachePrefixes   string // semicolon-separated "prefix directives" overrides of CacheControl
+	SocketMode      os.FileMode
+	ReplicaOf       string        // primary URL to follow, empty to run as a primary
+	ReplicaAPIKey   string        // API key sent to the primary
+	OplogSize       int           // changes kept in the operation log
+	OplogMaxAge     time.Duration // 0 keeps changes regardless of age
+	OplogValues     bool          // keep values in the operation log for point-in-time restores
+	LogFormat       string        // "console", or "json" or "text" for structured logs
+	LogLevel        string        // debug, info, warn or error
+	SlowOpThreshold time.Duration // 0 disables slow operation logging
+	Tracing         bool          // export traces over OTLP, set by the standard OTEL_* variables
+}
+
+// Default returns the configuration used when nothing is overridden
+func Default() *Config {
+	return &Config{
+		Addr:            ":8080",
+		GRPCAddr:        ":9090",
+		DataDir:         "./data",
+		CacheSize:       25,
+		Degree:          16,
+		ShutdownTimeout: 5 * time.Second,
+		Idempotency:     24 * time.Hour,
+		MaxWatchers:     100,
+		WebhookWorkers:  4,
+		WebhookQueue:    1024,
+		SocketMode:      0660,
+		OplogSize:       100000,
+		SnapshotCodec:   "json",
+		SweepEvery:      time.Minute,
+		SweepBatch:      100,
+		SweepRate:       1000,
+		LogFormat:       "console",
+		LogLevel:        "info",
+		SlowOpThreshold: time.Second,
+	}
+}
+
+// Load builds a Config from command-line arguments, falling back to
+// environment variables and then to the defaults. Flags beat environment
+// variables, which beat defaults. flag.ErrHelp is returned when -help is given.
+func Load(args []string, output io.Writer) (*Config, error) {
+	return load(args, os.LookupEnv, output)
+}
+
+func load(args []string, lookupEnv func(string) (string, bool), output io.Writer) (*Config, error) {
+	cfg := Default()
+
+	// Apply the environment on top of the defaults so that it becomes the
+	// flag default, which lets an explicit flag win
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+
+	fs := flag.NewFlagSet("zephyrus", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "HTTP listen address, or unix:///path for a Unix domain socket (env "+EnvAddr+")")
+	fs.StringVar(&cfg.GRPCAddr, "grpc-addr", cfg.GRPCAddr, "gRPC listen address, empty to disable (env "+EnvGRPCAddr+")")
+	fs.StringVar(&cfg.RESPAddr, "resp-addr", cfg.RESPAddr, "Redis protocol (RESP) listen address, e.g. :6380; empty to disable (env "+EnvRESPAddr+")")
+	fs.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory holding the database files (env "+EnvDataDir+")")
+	fs.StringVar(&cfg.ShardDirs, "shard-dirs", cfg.ShardDirs, "comma-separated extra data directories to spread keys across, e.g. on other disks (env "+EnvShardDirs+")")
+	fs.StringVar(&cfg.ColdDir, "cold-dir", cfg.ColdDir, "directory, e.g. on a bigger, slower disk, that keys unused for -demote-after are moved to; reads find them there (env "+EnvColdDir+")")
+	fs.DurationVar(&cfg.DemoteAfter, "demote-after", cfg.DemoteAfter, "move keys not read or written for this long to -cold-dir, 0 to leave them (env "+EnvDemoteAfter+")")
+	fs.BoolVar(&cfg.PromoteOnRead, "promote-on-read", cfg.PromoteOnRead, "move keys read from -cold-dir back to the data directories (env "+EnvPromoteOnRead+")")
+	fs.IntVar(&cfg.CacheSize, "cache-size", cfg.CacheSize, "number of values kept in the LRU cache, 0 for 1024 (env "+EnvCacheSize+")")
+	fs.IntVar(&cfg.Degree, "btree-degree", cfg.Degree, "degree of the in-memory B-tree, at least 2 (env "+EnvDegree+")")
+	fs.StringVar(&cfg.SnapshotPath, "snapshot-path", cfg.SnapshotPath, "B-tree snapshot loaded on start and saved on shutdown, defaults to <data-dir>/.zephyrus/btree.json (env "+EnvSnapshotPath+")")
+	fs.StringVar(&cfg.SnapshotCodec, "snapshot-codec", cfg.SnapshotCodec, "encoding of the snapshots written, json or gob; either can be loaded (env "+EnvSnapshotCodec+")")
+	fs.DurationVar(&cfg.SnapshotEvery, "snapshot-every", cfg.SnapshotEvery, "also save the snapshot this often when anything changed, 0 for only on shutdown (env "+EnvSnapshotEvery+")")
+	fs.StringVar(&cfg.SnapshotArchive, "snapshot-archive", cfg.SnapshotArchive, "keep timestamped snapshots by comma-separated every:keep rules, e.g. 1h:24h,24h:720h for hourly ones for a day and daily ones for a month (env "+EnvSnapshotArchive+")")
+	fs.BoolVar(&cfg.VerifyOnOpen, "verify-on-open", cfg.VerifyOnOpen, "read back every value on start and report those not matching their content hash in /admin/startup-report; start-up takes as long as reading the whole database (env "+EnvVerifyOnOpen+")")
+	fs.IntVar(&cfg.CorruptLimit, "corrupt-limit", cfg.CorruptLimit, "refuse to start when the start-up checks find at least this many corrupt files, 0 to always start (env "+EnvCorruptLimit+")")
+	fs.BoolVar(&cfg.SkipReconcile, "skip-reconcile", cfg.SkipReconcile, "trust the snapshot on start instead of checking it against the files in the data directories (env "+EnvSkipReconcile+")")
+	fs.BoolVar(&cfg.EncodeFileNames, "encode-file-names", cfg.EncodeFileNames, "store keys with upper-case or non-ASCII letters, ':' or names Windows reserves under encoded file names, so the data directory can be used on Windows and macOS; must not change for an existing data directory (env "+EnvEncodeFileNames+")")
+	fs.DurationVar(&cfg.SweepEvery, "sweep-every", cfg.SweepEvery, "remove expired keys in the background this often, 0 to leave them until next used (env "+EnvSweepEvery+")")
+	fs.IntVar(&cfg.SweepBatch, "sweep-batch", cfg.SweepBatch, "expired keys removed under the write lock at a time (env "+EnvSweepBatch+")")
+	fs.IntVar(&cfg.SweepRate, "sweep-rate", cfg.SweepRate, "most expired keys removed per second, 0 for no limit (env "+EnvSweepRate+")")
+	fs.IntVar(&cfg.CompactRate, "compact-rate", cfg.CompactRate, "most temp files and unused blobs compaction removes per second, 0 for no limit (env "+EnvCompactRate+")")
+	fs.IntVar(&cfg.CompactBytes, "compact-bytes-rate", cfg.CompactBytes, "most bytes of temp files and unused blobs compaction removes per second, 0 for no limit (env "+EnvCompactBytes+")")
+	fs.StringVar(&cfg.CompactWindow, "compact-window", cfg.CompactWindow, "compact once a day within this window of local time, such as 02:00-04:00, stopping when it closes; empty to only compact on request (env "+EnvCompactWindow+")")
+	fs.DurationVar(&cfg.WriteBack, "write-back", cfg.WriteBack, "hold writes in memory and write them to disk in the background within this long; a crash loses up to this much, 0 writes before acknowledging (env "+EnvWriteBack+")")
+	fs.DurationVar(&cfg.DefaultTTL, "default-ttl", cfg.DefaultTTL, "expire keys written without a TTL after this long, 0 to keep them; an X-Zephyrus-TTL of 0 still keeps a key (env "+EnvDefaultTTL+")")
+	fs.StringVar(&cfg.TextIndexFields, "text-index-fields", cfg.TextIndexFields, "comma-separated JSON string fields, such as title,body or author.name, whose words /search finds; the index is built at startup (env "+EnvTextIndexFields+")")
+	fs.IntVar(&cfg.DedupThreshold, "dedup-threshold", cfg.DedupThreshold, "store values of at least this many bytes once per data directory, however many keys hold them, with hard links; Linux and macOS only, 0 to store every value apart (env "+EnvDedupThreshold+")")
+	fs.IntVar(&cfg.MinFreeSpace, "min-free-space", cfg.MinFreeSpace, "refuse writes with 503 DISK_FULL while a data directory has fewer bytes free, until there is room again; a full disk does the same regardless (env "+EnvMinFreeSpace+")")
+	fs.BoolVar(&cfg.SchemaAdvisory, "schema-advisory", cfg.SchemaAdvisory, "log values that fail the schema for their key prefix instead of refusing them (env "+EnvSchemaAdvisory+")")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "time allowed for in-flight requests on shutdown (env "+EnvShutdownTimeout+")")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", cfg.ReadTimeout, "time allowed for a GET /key request before it fails with 503 TIMEOUT, 0 for no limit (env "+EnvReadTimeout+")")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", cfg.WriteTimeout, "time allowed for a PUT or DELETE /key request before it fails with 503 TIMEOUT, unless it was already written; 0 for no limit (env "+EnvWriteTimeout+")")
+	fs.DurationVar(&cfg.Idempotency, "idempotency-window", cfg.Idempotency, "how long the response to a PUT or import sent with an Idempotency-Key is replayed for retries, 0 to ignore the header (env "+EnvIdempotency+")")
+	fs.IntVar(&cfg.MaxValueSize, "max-value-size", cfg.MaxValueSize, "largest value accepted in bytes, 0 for no limit (env "+EnvMaxValueSize+")")
+	fs.IntVar(&cfg.MaxKeyLen, "max-key-len", cfg.MaxKeyLen, fmt.Sprintf("longest key accepted in bytes, at most and by default %d (env %s)", db.MaxKeyLen, EnvMaxKeyLen))
+	fs.IntVar(&cfg.MaxKeys, "max-keys", cfg.MaxKeys, "most keys stored, 0 for no limit; writes of new keys past it fail with 507 TOO_MANY_KEYS (env "+EnvMaxKeys+")")
+	fs.IntVar(&cfg.MaxWatchers, "max-watchers", cfg.MaxWatchers, "maximum concurrent /watch streams (env "+EnvMaxWatchers+")")
+	fs.IntVar(&cfg.WebhookWorkers, "webhook-workers", cfg.WebhookWorkers, "webhook deliveries made at once (env "+EnvWebhookWorkers+")")
+	fs.IntVar(&cfg.WebhookQueue, "webhook-queue", cfg.WebhookQueue, "webhook notifications waiting for delivery before further ones are dropped (env "+EnvWebhookQueue+")")
+	fs.Var((*fileMode)(&cfg.SocketMode), "socket-mode", "permissions of Unix domain sockets, in octal (env "+EnvSocketMode+")")
+	fs.IntVar(&cfg.OplogSize, "oplog-size", cfg.OplogSize, "changes kept in the operation log served at /changes (env "+EnvOplogSize+")")
+	fs.DurationVar(&cfg.OplogMaxAge, "oplog-max-age", cfg.OplogMaxAge, "drop operation log changes older than this, 0 to keep them; the log is disabled when this and -oplog-size are 0 (env "+EnvOplogMaxAge+")")
+	fs.BoolVar(&cfg.OplogValues, "oplog-values", cfg.OplogValues, "also keep the value of every write in the operation log, so zephyrusctl restore can replay it (env "+EnvOplogValues+")")
+	fs.StringVar(&cfg.ReplicaOf, "replica-of", cfg.ReplicaOf, "run as a read-only replica of the primary at this URL, e.g. http://primary:8080 (env "+EnvReplicaOf+")")
+	fs.StringVar(&cfg.ReplicaAPIKey, "replica-api-key", cfg.ReplicaAPIKey, "API key with the read role on the primary (env "+EnvReplicaAPIKey+")")
+	fs.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "console, or json or text for structured logs with fields (env "+EnvLogFormat+")")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "debug, info, warn or error; can be changed at runtime with PUT /admin/loglevel (env "+EnvLogLevel+")")
+	fs.DurationVar(&cfg.SlowOpThreshold, "slow-op-threshold", cfg.SlowOpThreshold, "log a warning for operations taking this long, 0 to disable (env "+EnvSlowOpThreshold+")")
+	fs.StringVar(&cfg.APIKeys, "api-keys", cfg.APIKeys, "comma-separated key:role pairs (roles: read, write, admin); empty disables auth (env "+EnvAPIKeys+")")
+	fs.StringVar(&cfg.APIKeyFile, "api-key-file", cfg.APIKeyFile, "JSON file of API keys with their roles and the namespaces or key prefixes they are confined to, reloaded when it changes; replaces -api-keys (env "+EnvAPIKeyFile+")")
+	fs.StringVar(&cfg.CursorSecret, "cursor-secret", cfg.CursorSecret, "secret signing the cursors of /keys listings, so they stay valid across restarts and between servers sharing it; random when empty (env "+EnvCursorSecret+")")
+	fs.StringVar(&cfg.CacheControl, "cache-control", cfg.CacheControl, "Cache-Control header of GET /key responses, such as \"max-age=60\"; empty sends none (env "+EnvCacheControl+")")
+	fs.StringVar(&cfg.CachePrefixes, "cache-control-prefixes", cfg.CachePrefixes, "Cache-Control headers for keys with given prefixes, overriding -cache-control, as \"prefix directives\" entries separated by semicolons, such as \"blob: public, max-age=31536000, immutable\" (env "+EnvCachePrefixes+")")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: zephyrus [flags]\n\nEvery flag may also be set through the environment variable named in its description.\nTraces are exported over OTLP when %s or %s is set.\n\nFlags:\n", EnvOTLPEndpoint, EnvTracesExporter+"=otlp")
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	env := &envReader{lookup: lookupEnv}
+	env.string(EnvAddr, &c.Addr)
+	env.string(EnvGRPCAddr, &c.GRPCAddr)
+	env.string(EnvRESPAddr, &c.RESPAddr)
+	env.string(EnvDataDir, &c.DataDir)
+	env.string(EnvShardDirs, &c.ShardDirs)
+	env.string(EnvColdDir, &c.ColdDir)
+	env.duration(EnvDemoteAfter, &c.DemoteAfter)
+	env.bool(EnvPromoteOnRead, &c.PromoteOnRead)
+	env.string(EnvSnapshotPath, &c.SnapshotPath)
+	env.duration(EnvSnapshotEvery, &c.SnapshotEvery)
+	env.string(EnvSnapshotArchive, &c.SnapshotArchive)
+	env.string(EnvSnapshotCodec, &c.SnapshotCodec)
+	env.bool(EnvSkipReconcile, &c.SkipReconcile)
+	env.bool(EnvVerifyOnOpen, &c.VerifyOnOpen)
+	env.int(EnvCorruptLimit, &c.CorruptLimit)
+	env.bool(EnvEncodeFileNames, &c.EncodeFileNames)
+	env.duration(EnvWriteBack, &c.WriteBack)
+	env.duration(EnvDefaultTTL, &c.DefaultTTL)
+	env.duration(EnvSweepEvery, &c.SweepEvery)
+	env.int(EnvSweepBatch, &c.SweepBatch)
+	env.int(EnvSweepRate, &c.SweepRate)
+	env.int(EnvCompactRate, &c.CompactRate)
+	env.int(EnvCompactBytes, &c.CompactBytes)
+	env.string(EnvCompactWindow, &c.CompactWindow)
+	env.bool(EnvSchemaAdvisory, &c.SchemaAdvisory)
+	env.int(EnvDedupThreshold, &c.DedupThreshold)
+	env.int(EnvMinFreeSpace, &c.MinFreeSpace)
+	env.string(EnvTextIndexFields, &c.TextIndexFields)
+	env.string(EnvAPIKeys, &c.APIKeys)
+	env.string(EnvAPIKeyFile, &c.APIKeyFile)
+	env.string(EnvCursorSecret, &c.CursorSecret)
+	env.string(EnvCacheControl, &c.CacheControl)
+	env.string(EnvCachePrefixes, &c.CachePrefixes)
+	env.string(EnvReplicaOf, &c.ReplicaOf)
+	env.string(EnvReplicaAPIKey, &c.ReplicaAPIKey)
+	env.string(EnvLogFormat, &c.LogFormat)
+	env.string(EnvLogLevel, &c.LogLevel)
+	env.int(EnvCacheSize, &c.CacheSize)
+	env.int(EnvDegree, &c.Degree)
+	env.int(EnvMaxWatchers, &c.MaxWatchers)
+	env.int(EnvWebhookWorkers, &c.WebhookWorkers)
+	env.int(EnvWebhookQueue, &c.WebhookQueue)
+	env.int(EnvMaxValueSize, &c.MaxValueSize)
+	env.int(EnvMaxKeyLen, &c.MaxKeyLen)
+	env.int(EnvMaxKeys, &c.MaxKeys)
+	env.int(EnvOplogSize, &c.OplogSize)
+	env.duration(EnvOplogMaxAge, &c.OplogMaxAge)
+	env.bool(EnvOplogValues, &c.OplogValues)
+	env.duration(EnvShutdownTimeout, &c.ShutdownTimeout)
+	env.duration(EnvReadTimeout, &c.ReadTimeout)
+	env.duration(EnvWriteTimeout, &c.WriteTimeout)
+	env.duration(EnvIdempotency, &c.Idempotency)
+	env.duration(EnvSlowOpThreshold, &c.SlowOpThreshold)
+	env.mode(EnvSocketMode, &c.SocketMode)
+	if env.err == nil {
+		c.Tracing, env.err = tracingFromEnv(lookupEnv)
+	}
+	return env.err
+}
+
+// envReader copies environment variables into settings, remembering the
+// first value that fails to parse
+type envReader struct {
+	lookup func(string) (string, bool)
+	err    error
+}
+
+func (e *envReader) string(name string, dst *string) {
+	if v, ok := e.lookup(name); ok {
+		*dst = v
+	}
+}
+
+func (e *envReader) int(name string, dst *int) {
+	v, ok := e.lookup(name)
+	if !ok || e.err != nil {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.err = fmt.Errorf("invalid %s %q: %v", name, v, err)
+		return
+	}
+	*dst = n
+}
+
+func (e *envReader) bool(name string, dst *bool) {
+	v, ok := e.lookup(name)
+	if !ok || e.err != nil {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.err = fmt.Errorf("invalid %s %q: %v", name, v, err)
+		return
+	}
+	*dst = b
+}
+
+func (e *envReader) duration(name string, dst *time.Duration) {
+	v, ok := e.lookup(name)
+	if !ok || e.err != nil {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.err = fmt.Errorf("invalid %s %q: %v", name, v, err)
+		return
+	}
+	*dst = d
+}
+
+func (e *envReader) mode(name string, dst *os.FileMode) {
+	v, ok := e.lookup(name)
+	if !ok || e.err != nil {
+		return
+	}
+	if err := (*fileMode)(dst).Set(v); err != nil {
+		e.err = fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+}
+
+// fileMode is a flag.Value for permissions written in octal
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *fileMode) Set(s string) error {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 0777 {
+		return fmt.Errorf("want octal permissions such as 0660")
+	}
+	*m = fileMode(n)
+	return nil
+}
+
+// Validate reports the first setting that is out of range
+func (c *Config) Validate() error {
+	if c.Addr == "" {
+		return fmt.Errorf("addr is required")
+	}
+	for _, addr := range []string{c.Addr, c.GRPCAddr, c.RESPAddr} {
+		if path, ok := SocketPath(addr); ok && path == "" {
+			return fmt.Errorf("unix address %q needs a socket path", addr)
+		}
+	}
+	if c.DataDir == "" {
+		return fmt.Errorf("data dir is required")
+	}
+	if c.CacheSize < 0 {
+		return fmt.Errorf("cache size must be >= 0, got %d", c.CacheSize)
+	}
+	if c.Degree < 2 {
+		return fmt.Errorf("btree degree must be >= 2, got %d", c.Degree)
+	}
+	if c.MaxValueSize < 0 {
+		return fmt.Errorf("max value size must be >= 0, got %d", c.MaxValueSize)
+	}
+	if c.MinFreeSpace < 0 {
+		return fmt.Errorf("min free space must be >= 0, got %d", c.MinFreeSpace)
+	}
+	if c.DedupThreshold < 0 {
+		return fmt.Errorf("dedup threshold must be >= 0, got %d", c.DedupThreshold)
+	}
+	if c.MaxKeyLen < 0 || c.MaxKeyLen > db.MaxKeyLen {
+		return fmt.Errorf("max key length must be between 0 and %d, got %d", db.MaxKeyLen, c.MaxKeyLen)
+	}
+	if c.MaxKeys < 0 {
+		return fmt.Errorf("max keys must be >= 0, got %d", c.MaxKeys)
+	}
+	if c.MaxWatchers < 0 {
+		return fmt.Errorf("max watchers must be >= 0, got %d", c.MaxWatchers)
+	}
+	if c.WebhookWorkers < 1 {
+		return fmt.Errorf("webhook workers must be >= 1, got %d", c.WebhookWorkers)
+	}
+	if c.WebhookQueue < 1 {
+		return fmt.Errorf("webhook queue must be >= 1, got %d", c.WebhookQueue)
+	}
+	if _, err := api.ParseAPIKeys(c.APIKeys); err != nil {
+		return fmt.Errorf("invalid api keys: %v", err)
+	}
+	if c.APIKeyFile != "" {
+		if c.APIKeys != "" {
+			return fmt.Errorf("api keys and an api key file cannot both be given")
+		}
+		if _, err := api.ReadAPIKeyFile(c.APIKeyFile); err != nil {
+			return err
+		}
+	}
+	if _, err := api.ParseCachePrefixes(c.CachePrefixes); err != nil {
+		return fmt.Errorf("invalid cache control prefixes: %v", err)
+	}
+	if c.OplogSize < 0 {
+		return fmt.Errorf("oplog size must be >= 0, got %d", c.OplogSize)
+	}
+	if c.OplogMaxAge < 0 {
+		return fmt.Errorf("oplog max age must be >= 0, got %s", c.OplogMaxAge)
+	}
+	if c.ReplicaOf != "" {
+		u, err := url.Parse(c.ReplicaOf)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("replica-of must be an http or https URL, got %q", c.ReplicaOf)
+		}
+	}
+	if c.LogFormat != "console" && c.LogFormat != "json" && c.LogFormat != "text" {
+		return fmt.Errorf("log format must be console, json or text, got %q", c.LogFormat)
+	}
+	if _, err := db.ParseLogLevel(c.LogLevel); err != nil {
+		return err
+	}
+	if c.snapshotCodec() == nil {
+		return fmt.Errorf("snapshot codec must be json or gob, got %q", c.SnapshotCodec)
+	}
+	if c.WriteBack < 0 {
+		return fmt.Errorf("write-back window must be >= 0, got %s", c.WriteBack)
+	}
+	if c.DefaultTTL < 0 {
+		return fmt.Errorf("default TTL must be >= 0, got %s", c.DefaultTTL)
+	}
+	if c.DemoteAfter < 0 {
+		return fmt.Errorf("demote after must be >= 0, got %s", c.DemoteAfter)
+	}
+	if c.ColdDir == "" && (c.DemoteAfter > 0 || c.PromoteOnRead) {
+		return fmt.Errorf("demote after and promote on read need a cold dir")
+	}
+	if c.SweepEvery < 0 {
+		return fmt.Errorf("sweep interval must be >= 0, got %s", c.SweepEvery)
+	}
+	if c.SweepBatch < 1 {
+		return fmt.Errorf("sweep batch must be at least 1, got %d", c.SweepBatch)
+	}
+	if c.SweepRate < 0 {
+		return fmt.Errorf("sweep rate must be >= 0, got %d", c.SweepRate)
+	}
+	if c.CompactRate < 0 {
+		return fmt.Errorf("compact rate must be >= 0, got %d", c.CompactRate)
+	}
+	if c.CorruptLimit < 0 {
+		return fmt.Errorf("corrupt limit must be >= 0, got %d", c.CorruptLimit)
+	}
+	if c.CompactBytes < 0 {
+		return fmt.Errorf("compact bytes rate must be >= 0, got %d", c.CompactBytes)
+	}
+	if w, err := db.ParseCompactWindow(c.CompactWindow); err != nil {
+		return err
+	} else if w != nil && w.Start == w.End {
+		return fmt.Errorf("compact window %s must start and end at different times", c.CompactWindow)
+	}
+	if c.SnapshotEvery < 0 {
+		return fmt.Errorf("snapshot interval must be >= 0, got %s", c.SnapshotEvery)
+	}
+	rules, err := db.ParseSnapshotRetention(c.SnapshotArchive)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Every < time.Second || rule.Keep <= 0 {
+			return fmt.Errorf("snapshot archive rule %s:%s must archive at least a second apart and keep for more than 0", rule.Every, rule.Keep)
+		}
+	}
+	if c.SlowOpThreshold < 0 {
+		return fmt.Errorf("slow op threshold must be >= 0, got %s", c.SlowOpThreshold)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown timeout must be >= 0, got %s", c.ShutdownTimeout)
+	}
+	if c.ReadTimeout < 0 {
+		return fmt.Errorf("read timeout must be >= 0, got %s", c.ReadTimeout)
+	}
+	if c.WriteTimeout < 0 {
+		return fmt.Errorf("write timeout must be >= 0, got %s", c.WriteTimeout)
+	}
+	if c.Idempotency < 0 {
+		return fmt.Errorf("idempotency window must be >= 0, got %s", c.Idempotency)
+	}
+	return nil
+}
+
+// Auth returns the API key checker for the configured keys, failing when
+// the key file can no longer be read
+func (c *Config) Auth() (*api.Auth, error) {
+	if c.APIKeyFile != "" {
+		return api.LoadAuthFile(c.APIKeyFile)
+	}
+	keys, _ := api.ParseAPIKeys(c.APIKeys) // checked by Validate
+	return api.NewAuth(keys), nil
+}
+
+// CachePolicy returns the Cache-Control policy of GET /key responses
+func (c *Config) CachePolicy() api.CachePolicy {
+	prefixes, _ := api.ParseCachePrefixes(c.CachePrefixes) // checked by Validate
+	return api.CachePolicy{Default: c.CacheControl, Prefixes: prefixes}
+}
+
+// Logger returns the logger for the configured format and level
+func (c *Config) Logger() db.Logger {
+	level, _ := db.ParseLogLevel(c.LogLevel) // checked by Validate
+	if c.LogFormat == "console" {
+		return lumber.NewConsoleLogger(lumber.DEBUG + int(level))
+	}
+
+	// The handler shares the adapter's level so SetLogLevel can lower it
+	levelVar := new(slog.LevelVar)
+	opts := &slog.HandlerOptions{Level: levelVar}
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, opts)
+	if c.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	logger := db.NewSlogLogger(slog.New(handler), levelVar)
+	logger.SetLevel(level)
+	return logger
+}
+
+// DBOptions returns the db.Options matching this configuration
+func (c *Config) DBOptions() *db.Options {
+	return &db.Options{
+		Logger:       c.Logger(),
+		ShardDirs:    SplitList(c.ShardDirs),
+		CacheSize:    c.CacheSize,
+		MaxValueSize: int64(c.MaxValueSize),
+		MaxKeyLen:    c.MaxKeyLen,
+		MaxKeys:      c.MaxKeys,
+		Degree:       c.Degree,
+		OplogSize:    c.OplogSize,
+		OplogMaxAge:  c.OplogMaxAge,
+		OplogValues:  c.OplogValues,
+
+		ColdDir:       c.ColdDir,
+		DemoteAfter:   c.DemoteAfter,
+		PromoteOnRead: c.PromoteOnRead,
+
+		SnapshotPath:    c.SnapshotPath,
+		SnapshotEvery:   c.SnapshotEvery,
+		SnapshotArchive: c.snapshotArchive(),
+		SnapshotCodec:   c.snapshotCodec(),
+		SkipReconcile:   c.SkipReconcile,
+		VerifyOnOpen:    c.VerifyOnOpen,
+		CorruptLimit:    c.CorruptLimit,
+		EncodeFileNames: c.EncodeFileNames,
+		WriteBack:       c.WriteBack,
+		DefaultTTL:      c.DefaultTTL,
+		SweepEvery:      c.SweepEvery,
+		SweepBatch:      c.SweepBatch,
+		SweepRate:       c.SweepRate,
+		SchemaAdvisory:  c.SchemaAdvisory,
+		DedupThreshold:  int64(c.DedupThreshold),
+		MinFreeSpace:    int64(c.MinFreeSpace),
+		SlowOpThreshold: c.SlowOpThreshold,
+
+		CompactRate:      c.CompactRate,
+		CompactBytesRate: int64(c.CompactBytes),
+		CompactWindow:    c.compactWindow(),
+	}
+}
+
+// snapshotCodec returns the codec named by SnapshotCodec, or nil for an
+// unknown one
+func (c *Config) snapshotCodec() db.SnapshotCodec {
+	switch c.SnapshotCodec {
+	case "json":
+		return db.JSONCodec{}
+	case "gob":
+		return db.GobCodec{}
+	}
+	return nil
+}
+
+// snapshotArchive returns the retention rules of SnapshotArchive, nil when
+// it is empty or invalid
+func (c *Config) snapshotArchive() []db.SnapshotRetention {
+	rules, _ := db.ParseSnapshotRetention(c.SnapshotArchive)
+	return rules
+}
+
+// compactWindow returns the window of CompactWindow, nil when it is empty
+// or invalid
+func (c *Config) compactWindow() *db.CompactWindow {
+	w, _ := db.ParseCompactWindow(c.CompactWindow)
+	return w
+}
+
+// SplitList splits a comma-separated setting, dropping empty entries
+func SplitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,249 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+func envFrom(m map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) {
+		v, ok := m[k]
+		return v, ok
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := load(nil, envFrom(nil), &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+
+	want := Default()
+	if *cfg != *want {
+		t.Errorf("load() = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	env := envFrom(map[string]string{
+		EnvAddr:            ":9000",
+		EnvCacheSize:       "64",
+		EnvDegree:          "8",
+		EnvShutdownTimeout: "10s",
+	})
+
+	cfg, err := load([]string{"-addr", ":9100", "-btree-degree", "4"}, env, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+
+	// Flag beats env
+	if got, want := cfg.Addr, ":9100"; got != want {
+		t.Errorf("Addr = %q, want %q", got, want)
+	}
+	if got, want := cfg.Degree, 4; got != want {
+		t.Errorf("Degree = %d, want %d", got, want)
+	}
+
+	// Env beats default
+	if got, want := cfg.CacheSize, 64; got != want {
+		t.Errorf("CacheSize = %d, want %d", got, want)
+	}
+	if got, want := cfg.ShutdownTimeout, 10*time.Second; got != want {
+		t.Errorf("ShutdownTimeout = %s, want %s", got, want)
+	}
+
+	// Default when neither is set
+	if got, want := cfg.DataDir, "./data"; got != want {
+		t.Errorf("DataDir = %q, want %q", got, want)
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{"degree too small", []string{"-btree-degree", "1"}, nil},
+		{"negative cache", []string{"-cache-size", "-1"}, nil},
+		{"bad env int", nil, map[string]string{EnvCacheSize: "lots"}},
+		{"bad env duration", nil, map[string]string{EnvShutdownTimeout: "soon"}},
+		{"negative snapshot interval", []string{"-snapshot-every", "-1m"}, nil},
+		{"snapshot archive without keep", []string{"-snapshot-archive", "1h"}, nil},
+		{"negative write-back window", nil, map[string]string{EnvWriteBack: "-1s"}},
+		{"empty sweep batch", []string{"-sweep-batch", "0"}, nil},
+		{"negative sweep rate", nil, map[string]string{EnvSweepRate: "-5"}},
+		{"negative compact rate", []string{"-compact-rate", "-1"}, nil},
+		{"negative corrupt limit", nil, map[string]string{EnvCorruptLimit: "-1"}},
+		{"compact window without an end", []string{"-compact-window", "02:00"}, nil},
+		{"empty compact window", nil, map[string]string{EnvCompactWindow: "02:00-02:00"}},
+		{"unknown snapshot codec", nil, map[string]string{EnvSnapshotCodec: "xml"}},
+		{"key length over the file name limit", []string{"-max-key-len", "255"}, nil},
+		{"negative write timeout", nil, map[string]string{EnvWriteTimeout: "-1s"}},
+		{"negative idempotency window", nil, map[string]string{EnvIdempotency: "-1s"}},
+		{"negative default TTL", []string{"-default-ttl", "-1h"}, nil},
+		{"negative max keys", nil, map[string]string{EnvMaxKeys: "-1"}},
+		{"demoting without a cold dir", []string{"-demote-after", "24h"}, nil},
+		{"no webhook workers", []string{"-webhook-workers", "0"}, nil},
+		{"cache control prefix without directives", []string{"-cache-control-prefixes", "blob:"}, nil},
+		{"missing api key file", []string{"-api-key-file", "/nonexistent/keys.json"}, nil},
+		{"api keys and a key file", []string{"-api-keys", "a:read"}, map[string]string{EnvAPIKeyFile: "keys.json"}},
+	}
+
+	for _, tt := range tests {
+		if _, err := load(tt.args, envFrom(tt.env), &bytes.Buffer{}); err == nil {
+			t.Errorf("%s: load succeeded, want error", tt.name)
+		}
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	var out bytes.Buffer
+	_, err := load([]string{"-help"}, envFrom(nil), &out)
+	if !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("load(-help) error = %v, want flag.ErrHelp", err)
+	}
+	if !strings.Contains(out.String(), EnvDataDir) {
+		t.Errorf("help output does not mention %s:\n%s", EnvDataDir, out.String())
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "zs")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "z.sock")
+	addr := "unix://" + path
+
+	// A socket left behind by a process that died is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	lis, err := Listen(addr, 0600)
+	if err != nil {
+		t.Fatalf("Listen over a stale socket failed: %s", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v, want 0600", info.Mode().Perm(), err)
+	}
+
+	// A live socket is left alone
+	if _, err := Listen(addr, 0600); err == nil {
+		t.Errorf("Listen on a socket in use succeeded")
+	}
+
+	lis.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after Close: %v", err)
+	}
+
+	// Regular files are never removed
+	os.WriteFile(path, []byte("data"), 0644)
+	if _, err := Listen(addr, 0600); err == nil {
+		t.Errorf("Listen over a regular file succeeded")
+	}
+}
+
+func TestSocketModeSetting(t *testing.T) {
+	cfg, err := load([]string{"-socket-mode", "0600"}, envFrom(nil), &bytes.Buffer{})
+	if err != nil || cfg.SocketMode != 0600 {
+		t.Errorf("-socket-mode 0600 = %v, %v", cfg.SocketMode, err)
+	}
+	if _, err := load(nil, envFrom(map[string]string{EnvSocketMode: "rw"}), &bytes.Buffer{}); err == nil {
+		t.Errorf("invalid %s accepted", EnvSocketMode)
+	}
+	if _, err := load([]string{"-addr", "unix://"}, envFrom(nil), &bytes.Buffer{}); err == nil {
+		t.Errorf("unix address without a path accepted")
+	}
+}
+
+func TestOplogValuesSetting(t *testing.T) {
+	cfg, err := load(nil, envFrom(map[string]string{EnvOplogValues: "true"}), &bytes.Buffer{})
+	if err != nil || !cfg.DBOptions().OplogValues {
+		t.Errorf("%s=true gave OplogValues %v, %v", EnvOplogValues, cfg.DBOptions().OplogValues, err)
+	}
+	if _, err := load(nil, envFrom(map[string]string{EnvOplogValues: "maybe"}), &bytes.Buffer{}); err == nil {
+		t.Errorf("%s=maybe accepted", EnvOplogValues)
+	}
+}
+
+func TestLogSettings(t *testing.T) {
+	cfg, err := load([]string{"--log-format=json", "--log-level=debug"}, envFrom(nil), &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if _, ok := cfg.Logger().(*db.SlogLogger); !ok {
+		t.Errorf("Logger() for json = %T, want *db.SlogLogger", cfg.Logger())
+	}
+	for _, args := range [][]string{{"--log-format=xml"}, {"--log-level=loud"}} {
+		if _, err := load(args, envFrom(nil), &bytes.Buffer{}); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
+
+func TestShardDirsSetting(t *testing.T) {
+	cfg, err := load(nil, envFrom(map[string]string{EnvShardDirs: "/mnt/a, /mnt/b,"}), &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if dirs := cfg.DBOptions().ShardDirs; len(dirs) != 2 || dirs[0] != "/mnt/a" || dirs[1] != "/mnt/b" {
+		t.Errorf("ShardDirs = %q, want [/mnt/a /mnt/b]", dirs)
+	}
+}
+
+func TestReplicaOfSetting(t *testing.T) {
+	cfg, err := load([]string{"--replica-of=http://primary:8080"}, envFrom(nil), &bytes.Buffer{})
+	if err != nil || cfg.ReplicaOf != "http://primary:8080" {
+		t.Errorf("--replica-of = %q, %v", cfg.ReplicaOf, err)
+	}
+	if _, err := load(nil, envFrom(map[string]string{EnvReplicaOf: "primary:8080"}), &bytes.Buffer{}); err == nil {
+		t.Errorf("%s without a scheme accepted", EnvReplicaOf)
+	}
+}
+
+func TestTracingSettings(t *testing.T) {
+	cfg, err := load(nil, envFrom(map[string]string{EnvOTLPEndpoint: "http://collector:4318"}), &bytes.Buffer{})
+	if err != nil || !cfg.Tracing {
+		t.Fatalf("%s set gave Tracing %v, %v", EnvOTLPEndpoint, cfg.Tracing, err)
+	}
+	tp, err := cfg.TracerProvider(context.Background())
+	if err != nil || tp == nil {
+		t.Fatalf("TracerProvider() = %v, %v", tp, err)
+	}
+	tp.Shutdown(context.Background())
+
+	for _, env := range []map[string]string{
+		{EnvOTLPEndpoint: "http://collector:4318", EnvTracesExporter: "none"},
+		{EnvOTLPEndpoint: "http://collector:4318", EnvSDKDisabled: "true"},
+	} {
+		if cfg, err := load(nil, envFrom(env), &bytes.Buffer{}); err != nil || cfg.Tracing {
+			t.Errorf("%v gave Tracing %v, %v, want it off", env, cfg.Tracing, err)
+		}
+	}
+	for _, env := range []map[string]string{
+		{EnvTracesExporter: "zipkin"},
+		{EnvOTLPEndpoint: "http://collector:4317", EnvOTLPProtocol: "grpc"},
+	} {
+		if _, err := load(nil, envFrom(env), &bytes.Buffer{}); err == nil {
+			t.Errorf("%v accepted", env)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Standard OpenTelemetry environment variables that turn tracing on. The
+// exporter reads the rest of the OTEL_EXPORTER_OTLP_* settings itself, and
+// the SDK reads OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG.
+const (
+	EnvOTLPEndpoint       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	EnvOTLPTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	EnvOTLPProtocol       = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	EnvOTLPTracesProtocol = "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"
+	EnvTracesExporter     = "OTEL_TRACES_EXPORTER"
+	EnvSDKDisabled        = "OTEL_SDK_DISABLED"
+)
+
+// tracingFromEnv reports whether traces should be exported: when an OTLP
+// endpoint is set or OTEL_TRACES_EXPORTER asks for otlp, unless the SDK is
+// disabled. Only OTLP over HTTP is supported.
+func tracingFromEnv(lookupEnv func(string) (string, bool)) (bool, error) {
+	get := func(name string) string {
+		v, _ := lookupEnv(name)
+		return strings.TrimSpace(v)
+	}
+
+	if v := get(EnvSDKDisabled); v != "" {
+		disabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s %q: %v", EnvSDKDisabled, v, err)
+		}
+		if disabled {
+			return false, nil
+		}
+	}
+
+	enabled := get(EnvOTLPEndpoint) != "" || get(EnvOTLPTracesEndpoint) != ""
+	switch exporter := get(EnvTracesExporter); exporter {
+	case "":
+	case "otlp":
+		enabled = true
+	case "none":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%s %q is not supported, want otlp or none", EnvTracesExporter, exporter)
+	}
+
+	protocol := get(EnvOTLPTracesProtocol)
+	if protocol == "" {
+		protocol = get(EnvOTLPProtocol)
+	}
+	if enabled && protocol != "" && protocol != "http/protobuf" {
+		return false, fmt.Errorf("OTLP protocol %q is not supported, want http/protobuf", protocol)
+	}
+	return enabled, nil
+}
+
+// TracerProvider returns a provider exporting spans over OTLP/HTTP, or nil
+// when tracing is off. Shut it down before exiting to flush the spans still
+// buffered.
+func (c *Config) TracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if !c.Tracing {
+		return nil, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the OTLP exporter: %v", err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "zephyrus")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trace resource: %v", err)
+	}
+
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/btree"
+)
+
+const (
+	// archiveDir holds the timestamped snapshots of Options.SnapshotArchive,
+	// in the metadata directory
+	archiveDir = "snapshots"
+	// archiveLayout is the time in the name of an archived snapshot, as in
+	// btree-20240501T120000.snapshot
+	archiveLayout = "20060102T150405"
+	archivePrefix = "btree-"
+	archiveSuffix = ".snapshot"
+)
+
+// ErrSnapshotNotFound is returned by RestoreSnapshot for a name that is not
+// an archived snapshot
+var ErrSnapshotNotFound = errors.New("no such snapshot")
+
+// SnapshotRetention keeps one archived snapshot for each Every, the oldest
+// taken in it, of the last Keep. With {time.Hour, 24 * time.Hour} and
+// {24 * time.Hour, 30 * 24 * time.Hour} there is one an hour for a day and
+// one a day for a month.
+type SnapshotRetention struct {
+	Every time.Duration
+	Keep  time.Duration
+}
+
+// ParseSnapshotRetention parses a comma-separated list of every:keep
+// durations, as accepted by the -snapshot-archive flag, such as
+// "1h:24h,24h:720h"
+func ParseSnapshotRetention(spec string) ([]SnapshotRetention, error) {
+	var rules []SnapshotRetention
+	for _, entry := range strings.Split(spec, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		every, keep, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid snapshot retention %q, want every:keep", entry)
+		}
+		var rule SnapshotRetention
+		var err error
+		if rule.Every, err = time.ParseDuration(every); err != nil {
+			return nil, fmt.Errorf("invalid snapshot retention %q: %w", entry, err)
+		}
+		if rule.Keep, err = time.ParseDuration(keep); err != nil {
+			return nil, fmt.Errorf("invalid snapshot retention %q: %w", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// archiveInterval returns how often snapshots are archived for rules: as
+// often as the shortest Every
+func archiveInterval(rules []SnapshotRetention) time.Duration {
+	var every time.Duration
+	for _, rule := range rules {
+		if every == 0 || rule.Every < every {
+			every = rule.Every
+		}
+	}
+	return every
+}
+
+// SnapshotFile describes an archived snapshot
+type SnapshotFile struct {
+	Name  string    `json:"name"`
+	Time  time.Time `json:"time"`
+	Size  int64     `json:"size"`
+	Items int       `json:"items"` // keys in the snapshot, -1 when it cannot be read
+}
+
+// archivePath returns the path of the archived snapshot with name
+func (d *Driver) archivePath(name string) string {
+	return filepath.Join(d.dir, metaDir, archiveDir, name)
+}
+
+// archiveTime returns the time in the name of an archived snapshot, and
+// false for names of other files
+func archiveTime(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, archivePrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	if stamp, ok = strings.CutSuffix(stamp, archiveSuffix); !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(archiveLayout, stamp)
+	return t, err == nil
+}
+
+// ArchiveSnapshot writes the B-tree to a timestamped snapshot next to the
+// driver's own, then prunes the archived snapshots that
+// Options.SnapshotArchive no longer keeps. The driver does this in the
+// background as often as the shortest Every of the retention rules.
+func (d *Driver) ArchiveSnapshot() (SnapshotFile, error) {
+	if err := d.checkOpen(); err != nil {
+		return SnapshotFile{}, err
+	}
+	var items []Item
+	d.snapshotTree().Ascend(func(i btree.Item) bool {
+		items = append(items, *(i.(*Item)))
+		return true
+	})
+
+	now := time.Now().UTC()
+	name := archivePrefix + now.Format(archiveLayout) + archiveSuffix
+	var data bytes.Buffer
+	if err := encodeSnapshot(&data, d.codec, items); err != nil {
+		return SnapshotFile{}, err
+	}
+	path := d.archivePath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return SnapshotFile{}, err
+	}
+	if err := d.writeFile(path, data.Bytes()); err != nil {
+		return SnapshotFile{}, err
+	}
+	d.log.Info("Archived the B-tree snapshot as %s, %d keys", name, len(items))
+
+	if err := d.pruneArchive(now); err != nil {
+		return SnapshotFile{}, err
+	}
+	return SnapshotFile{Name: name, Time: now.Truncate(time.Second), Size: int64(data.Len()), Items: len(items)}, nil
+}
+
+// listArchive returns the names and times of the archived snapshots, oldest
+// first
+func (d *Driver) listArchive() ([]SnapshotFile, error) {
+	entries, err := os.ReadDir(filepath.Join(d.dir, metaDir, archiveDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []SnapshotFile
+	for _, entry := range entries {
+		if t, ok := archiveTime(entry.Name()); ok && !entry.IsDir() {
+			files = append(files, SnapshotFile{Name: entry.Name(), Time: t})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Time.Before(files[j].Time) })
+	return files, nil
+}
+
+// pruneArchive removes the archived snapshots no retention rule keeps, as of
+// now. The newest one is always kept, and without rules every one is.
+func (d *Driver) pruneArchive(now time.Time) error {
+	if len(d.archive) == 0 {
+		return nil
+	}
+	files, err := d.listArchive()
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	keep := map[string]bool{files[len(files)-1].Name: true}
+	for _, rule := range d.archive {
+		taken := make(map[time.Time]bool)
+		for _, f := range files {
+			bucket := f.Time.Truncate(rule.Every)
+			if now.Sub(f.Time) < rule.Keep && !taken[bucket] {
+				taken[bucket] = true
+				keep[f.Name] = true
+			}
+		}
+	}
+
+	removed := 0
+	for _, f := range files {
+		if keep[f.Name] {
+			continue
+		}
+		if err := os.Remove(d.archivePath(f.Name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		d.log.Info("Pruned %d archived snapshots past their retention", removed)
+	}
+	return nil
+}
+
+// Snapshots returns the archived snapshots, newest first, with the number of
+// keys each holds, which takes reading them all
+func (d *Driver) Snapshots() ([]SnapshotFile, error) {
+	files, err := d.listArchive()
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		files[i].Items = -1
+		path := d.archivePath(files[i].Name)
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files[i].Size = fi.Size()
+		if items, err := d.readArchive(path); err == nil {
+			files[i].Items = len(items)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Time.After(files[j].Time) })
+	return files, nil
+}
+
+// readArchive decodes an archived snapshot
+func (d *Driver) readArchive(path string) ([]Item, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSnapshot(bytes.NewReader(data), d.codec)
+}
+
+// RestoreSnapshot loads the archived snapshot name into the index. Values
+// stay as they are in the data directories: what is restored is what the
+// index holds of each key, its expiry, labels and times. Keys written since
+// are kept without them, and keys deleted since stay deleted. The snapshot
+// is decoded and the new B-tree built in full before it replaces the live
+// one under the write lock, so readers see either the old index or the
+// restored one. Every key is given a new revision.
+func (d *Driver) RestoreSnapshot(name string) error {
+	if _, ok := archiveTime(name); !ok || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	items, err := d.readArchive(d.archivePath(name))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %s: %w", name, err)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+	// Values held back by write-back are not on disk for reconcile to find
+	if err := d.flushLocked(); err != nil {
+		return err
+	}
+
+	// The values, content hashes and locations of the live index describe
+	// the files as they are now, so they are kept
+	tree := btree.New(d.degree)
+	for i := range items {
+		it := &items[i]
+		if live, ok := d.tree.Get(it).(*Item); ok {
+			it.Value, it.Hash, it.Dir = live.Value, live.Hash, live.Dir
+		} else {
+			it.Value, it.Hash = nil, ""
+		}
+		tree.ReplaceOrInsert(it)
+	}
+
+	d.tree = tree
+	d.indexExpiries()
+	d.rebuildLabels()
+	if err := d.reconcile(); err != nil {
+		return err
+	}
+	if _, err := d.renumber(true); err != nil {
+		return err
+	}
+	d.snapshotStale = true
+	d.log.Info("Restored the index from snapshot %s, %d keys", name, d.tree.Len())
+	return nil
+}
+
+// archiveLoop archives the snapshot every interval, give or take a tenth,
+// until Close
+func (d *Driver) archiveLoop(every time.Duration) {
+	defer d.background.Done()
+
+	timer := time.NewTimer(jitter(every))
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-timer.C:
+		}
+		if _, err := d.ArchiveSnapshot(); err != nil && !d.closed.Load() {
+			d.snapshotFails.Add(1)
+			d.log.Error("Failed to archive the B-tree snapshot, retrying on the next tick: %v", err)
+		}
+		timer.Reset(jitter(every))
+	}
+}
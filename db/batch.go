@@ -0,0 +1,126 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// BatchEntry is one value written by PutBatch
+type BatchEntry struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration // 0 for Options.DefaultTTL, NoTTL for no expiry
+}
+
+// GetBatch retrieves the values for several keys while taking the lock once.
+// Keys that do not exist, and reserved keys, are left out of the returned
+// map.
+func (d *Driver) GetBatch(keys []string) (_ map[string][]byte, err error) {
+	defer d.ops.done(&d.ops.gets, len(keys), &err)
+	for _, key := range keys {
+		if err := d.checkKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	t := d.startOp(context.Background(), "get_batch", "")
+	defer d.finishOp(t)
+	d.rlock(t)
+	defer d.mutex.RUnlock()
+
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if _, seen := values[key]; seen || Reserved(key) {
+			continue
+		}
+
+		value, ok, err := d.lookup(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if ok {
+			values[key] = value
+			t.addSize(int64(len(value)))
+			d.ops.bytesRead.Add(uint64(len(value)))
+			continue
+		}
+
+		// Values read from disk are cached but not added to the B-tree, which
+		// would need the write lock
+		ioStart := t.ioStart()
+		value, err = os.ReadFile(d.keyPath(key))
+		t.ioDone(ioStart)
+		t.addSize(int64(len(value)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			d.log.Error("Failed to read file: %v", err)
+			return nil, err
+		}
+		d.ops.readDisk(int64(len(value)))
+		d.cache.Add(key, value)
+		values[key] = value
+	}
+
+	d.log.Info("Get batch: %d of %d keys found", len(values), len(keys))
+	return values, nil
+}
+
+// PutBatch stores several values while taking the write lock once, and
+// reports for each entry whether it created its key. Every key, size, TTL,
+// schema and quota is checked before anything is written. The batch is not atomic: if a write
+// fails, the entries before it stay written and the error names the failing
+// key.
+func (d *Driver) PutBatch(entries []BatchEntry) (_ []bool, err error) {
+	defer d.ops.done(&d.ops.puts, len(entries), &err)
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+	expiries := make([]int64, len(entries))
+	for i, e := range entries {
+		if err := d.checkKey(e.Key); err != nil {
+			return nil, err
+		}
+		if err := d.checkSize(e.Key, int64(len(e.Value))); err != nil {
+			return nil, err
+		}
+		if err := d.checkSchema(e.Key, e.Value); err != nil {
+			return nil, err
+		}
+		expiresAt, err := d.writeExpiry(e.TTL)
+		if err != nil {
+			return nil, err
+		}
+		expiries[i] = expiresAt
+	}
+
+	t := d.startOp(context.Background(), "put_batch", "")
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+	if err := d.checkBatchQuota(entries); err != nil {
+		return nil, err
+	}
+	if err := d.checkBatchKeys(entries); err != nil {
+		return nil, err
+	}
+
+	created := make([]bool, len(entries))
+	for i, e := range entries {
+		ok, err := d.putLocked(e.Key, e.Value, expiries[i], t)
+		if err != nil {
+			return created[:i], fmt.Errorf("put %s: %w", e.Key, err)
+		}
+		created[i] = ok
+	}
+
+	d.log.Info("Put batch: %d keys", len(entries))
+	return created, nil
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+// With Options.EncodeFileNames a key may be binary data, which a JSON string
+// cannot carry: encoding/json would replace its invalid bytes. The JSON forms
+// of Item, Change and Record therefore hold such a key base64 encoded in a
+// field of its own, leaving the usual key field empty.
+
+// itemFields, changeFields and recordFields are Item, Change and Record
+// without their methods, so that their marshalers do not call themselves
+type (
+	itemFields   Item
+	changeFields Change
+	recordFields Record
+)
+
+// MarshalJSON writes a key that is not valid UTF-8 in KeyBase64
+func (i Item) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(i.Key) {
+		return json.Marshal(itemFields(i))
+	}
+	key := []byte(i.Key)
+	i.Key = ""
+	return json.Marshal(struct {
+		itemFields
+		KeyBase64 []byte
+	}{itemFields(i), key})
+}
+
+// UnmarshalJSON reads the key from KeyBase64 when MarshalJSON put it there
+func (i *Item) UnmarshalJSON(data []byte) error {
+	var v struct {
+		itemFields
+		KeyBase64 []byte
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*i = Item(v.itemFields)
+	if v.KeyBase64 != nil {
+		i.Key = string(v.KeyBase64)
+	}
+	return nil
+}
+
+// MarshalJSON writes a key that is not valid UTF-8 in key_base64
+func (c Change) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(c.Key) {
+		return json.Marshal(changeFields(c))
+	}
+	key := []byte(c.Key)
+	c.Key = ""
+	return json.Marshal(struct {
+		changeFields
+		KeyBase64 []byte `json:"key_base64"`
+	}{changeFields(c), key})
+}
+
+// UnmarshalJSON reads the key from key_base64 when MarshalJSON put it there
+func (c *Change) UnmarshalJSON(data []byte) error {
+	var v struct {
+		changeFields
+		KeyBase64 []byte `json:"key_base64"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*c = Change(v.changeFields)
+	if v.KeyBase64 != nil {
+		c.Key = string(v.KeyBase64)
+	}
+	return nil
+}
+
+// MarshalJSON writes a key that is not valid UTF-8 in key_base64
+func (r Record) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(r.Key) {
+		return json.Marshal(recordFields(r))
+	}
+	key := []byte(r.Key)
+	r.Key = ""
+	return json.Marshal(struct {
+		recordFields
+		KeyBase64 []byte `json:"key_base64"`
+	}{recordFields(r), key})
+}
+
+// UnmarshalJSON reads the key from key_base64 when MarshalJSON put it there
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var v struct {
+		recordFields
+		KeyBase64 []byte `json:"key_base64"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*r = Record(v.recordFields)
+	if v.KeyBase64 != nil {
+		r.Key = string(v.KeyBase64)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBatchSize is how many keys ImportBolt writes with each PutBatch
+const boltBatchSize = 100
+
+// boltVerifySample is how many imported values ImportBolt reads back
+const boltVerifySample = 100
+
+// binaryKeyMarker starts a key segment that EncodeKeySegment had to encode
+const binaryKeyMarker = "~"
+
+// EncodeKeySegment returns a part of a key, such as a bbolt key or bucket
+// name, as it can be stored after prefix. Segments that are valid there are
+// kept as they are; anything else, binary data included, is encoded as
+// binaryKeyMarker followed by its unpadded URL-safe base64, which
+// DecodeKeySegment reverses.
+func EncodeKeySegment(prefix string, segment []byte) string {
+	s := string(segment)
+	if utf8.Valid(segment) && !strings.HasPrefix(s, binaryKeyMarker) && ValidateKey(prefix+s) == nil {
+		return s
+	}
+	return binaryKeyMarker + base64.RawURLEncoding.EncodeToString(segment)
+}
+
+// DecodeKeySegment returns the bytes a segment built by EncodeKeySegment
+// stands for
+func DecodeKeySegment(segment string) ([]byte, error) {
+	if !strings.HasPrefix(segment, binaryKeyMarker) {
+		return []byte(segment), nil
+	}
+	return base64.RawURLEncoding.DecodeString(segment[len(binaryKeyMarker):])
+}
+
+// ImportBolt copies the buckets of a bbolt database file into the store.
+// bucketToNamespace maps the name of each top-level bucket to import to the
+// namespace its keys go in, so key 42 of bucket users mapped to accounts is
+// stored as accounts:42; an empty namespace stores the keys as they are,
+// and a nil or empty map imports every bucket into the namespace of its own
+// name. Nested buckets add their names to the prefix, as in
+// accounts:archived:42. Names and keys that cannot be stored as they are,
+// such as binary ones, are encoded with EncodeKeySegment. The file is opened
+// read-only, values are written in batches, overwriting existing keys, and
+// a sample of them is read back once all are written; a value that does
+// not match fails the import.
+func (d *Driver) ImportBolt(path string, bucketToNamespace map[string]string) (ImportStats, error) {
+	stats := ImportStats{Errors: []ImportError{}}
+	if err := d.writable(); err != nil {
+		return stats, err
+	}
+	start := time.Now()
+
+	bdb, err := bolt.Open(path, 0400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return stats, fmt.Errorf("failed to open bbolt file %s: %w", path, err)
+	}
+	defer bdb.Close()
+
+	imp := &boltImport{d: d, stats: &stats}
+	err = bdb.View(func(tx *bolt.Tx) error {
+		names := bucketToNamespace
+		if len(names) == 0 {
+			names = make(map[string]string)
+			tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				names[string(name)] = string(name)
+				return nil
+			})
+		}
+		buckets := make([]string, 0, len(names))
+		for name := range names {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("bbolt file %s has no bucket %q", path, name)
+			}
+			buckets = append(buckets, name)
+		}
+		sort.Strings(buckets)
+
+		for _, name := range buckets {
+			prefix := ""
+			if ns := names[name]; ns != "" {
+				prefix = ns + NamespaceSeparator
+			}
+			if err := imp.bucket(tx.Bucket([]byte(name)), prefix); err != nil {
+				return err
+			}
+		}
+		return imp.flush()
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if err := imp.verify(); err != nil {
+		return stats, err
+	}
+	d.log.Info("Imported %d keys from bbolt file %s (%d failed) in %s", stats.Imported, path, stats.Failed, time.Since(start))
+	return stats, nil
+}
+
+// boltImport is the state of an ImportBolt
+type boltImport struct {
+	d       *Driver
+	stats   *ImportStats
+	n       int // records seen, numbering them in errors
+	pending []BatchEntry
+	lines   []int        // the number of each pending record
+	sample  []BatchEntry // reservoir of the values written, to read back
+	written int
+}
+
+// bucket queues the keys of a bucket and its nested buckets
+func (imp *boltImport) bucket(b *bolt.Bucket, prefix string) error {
+	return b.ForEach(func(k, v []byte) error {
+		key := prefix + EncodeKeySegment(prefix, k)
+		if v == nil {
+			// A nested bucket
+			return imp.bucket(b.Bucket(k), key+NamespaceSeparator)
+		}
+
+		imp.n++
+		if err := imp.d.checkKey(key); err != nil {
+			imp.stats.fail(imp.n, key, err)
+			return nil
+		}
+		// bbolt's memory is only valid during the transaction
+		imp.pending = append(imp.pending, BatchEntry{Key: key, Value: bytes.Clone(v)})
+		imp.lines = append(imp.lines, imp.n)
+		if len(imp.pending) == boltBatchSize {
+			return imp.flush()
+		}
+		return nil
+	})
+}
+
+// flush writes the queued keys. When the batch is refused, as for a key
+// over its quota, the keys are written one at a time so that only the
+// failing ones are left out.
+func (imp *boltImport) flush() error {
+	if len(imp.pending) == 0 {
+		return nil
+	}
+	if _, err := imp.d.PutBatch(imp.pending); err == nil {
+		for _, e := range imp.pending {
+			imp.written++
+			imp.keep(e)
+		}
+		imp.stats.Imported += len(imp.pending)
+	} else {
+		for i, e := range imp.pending {
+			if err := imp.d.Put(e.Key, e.Value); err != nil {
+				imp.stats.fail(imp.lines[i], e.Key, err)
+				continue
+			}
+			imp.written++
+			imp.keep(e)
+			imp.stats.Imported++
+		}
+	}
+	imp.pending, imp.lines = imp.pending[:0], imp.lines[:0]
+	return nil
+}
+
+// keep adds a written entry to the sample, each with the same chance
+func (imp *boltImport) keep(e BatchEntry) {
+	if len(imp.sample) < boltVerifySample {
+		imp.sample = append(imp.sample, e)
+	} else if i := rand.Intn(imp.written); i < boltVerifySample {
+		imp.sample[i] = e
+	}
+}
+
+// verify reads the sample back from the store, bypassing the cache
+func (imp *boltImport) verify() error {
+	for _, e := range imp.sample {
+		value, ok, err := imp.d.readUncached(e.Key)
+		if err != nil {
+			return fmt.Errorf("failed to read back %s: %w", e.Key, err)
+		}
+		if !ok || !bytes.Equal(value, e.Value) {
+			return fmt.Errorf("imported value of %s does not match the bbolt file", e.Key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// CacheStats describes the LRU cache of values
+type CacheStats struct {
+	Values       int    `json:"values"`   // values held
+	Capacity     int    `json:"capacity"` // values it can hold
+	Bytes        int64  `json:"bytes"`    // size of the values held
+	Evictions    uint64 `json:"evictions"`
+	EvictedBytes uint64 `json:"evicted_bytes"`
+}
+
+// valueCache is the LRU cache of values. It evicts the least recently used
+// value itself to make room for a new one, so that evictions can be counted
+// apart from the removal of deleted keys.
+type valueCache struct {
+	mu           sync.Mutex
+	lru          *simplelru.LRU
+	size         int
+	bytes        int64 // size of the values held
+	evictions    uint64
+	evictedBytes uint64
+
+	// onEvict, if set, is called with the key of each value evicted, after
+	// the cache is unlocked
+	onEvict func(key string)
+}
+
+func newValueCache(size int) (*valueCache, error) {
+	l, err := simplelru.NewLRU(size, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &valueCache{lru: l, size: size}, nil
+}
+
+// Add caches the value for a key, evicting the least recently used value when
+// the cache is full
+func (c *valueCache) Add(key string, value []byte) {
+	c.mu.Lock()
+	var evicted interface{}
+	if old, ok := c.lru.Peek(key); ok {
+		c.bytes -= int64(len(old.([]byte)))
+	} else if c.lru.Len() >= c.size {
+		if oldKey, old, ok := c.lru.RemoveOldest(); ok {
+			c.bytes -= int64(len(old.([]byte)))
+			c.evictions++
+			c.evictedBytes += uint64(len(old.([]byte)))
+			evicted = oldKey
+		}
+	}
+	c.lru.Add(key, value)
+	c.bytes += int64(len(value))
+	c.mu.Unlock()
+
+	if evicted != nil && c.onEvict != nil {
+		c.onEvict(evicted.(string))
+	}
+}
+
+// Get returns the cached value for a key and marks it recently used
+func (c *valueCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	value, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.([]byte), true
+}
+
+// Contains reports whether a key is cached without marking it used
+func (c *valueCache) Contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Contains(key)
+}
+
+// Remove drops a key, which does not count as an eviction
+func (c *valueCache) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.lru.Peek(key); ok {
+		c.bytes -= int64(len(old.([]byte)))
+		c.lru.Remove(key)
+	}
+}
+
+// Len returns how many values are cached
+func (c *valueCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// CacheStats returns the size of the cache and how much it has evicted
+func (d *Driver) CacheStats() CacheStats {
+	d.cache.mu.Lock()
+	defer d.cache.mu.Unlock()
+	return CacheStats{
+		Values:       d.cache.lru.Len(),
+		Capacity:     d.cache.size,
+		Bytes:        d.cache.bytes,
+		Evictions:    d.cache.evictions,
+		EvictedBytes: d.cache.evictedBytes,
+	}
+}
@@ -0,0 +1,92 @@
+package db
+
+import "errors"
+
+// ErrClosed is returned by operations on a Driver after Close
+var ErrClosed = errors.New("driver is closed")
+
+// Close shuts the driver down: it stops periodic snapshots, waits for
+// operations in progress and async hooks, writes the values held back by
+// write-back mode, saves the B-tree snapshot if
+// anything changed since Open loaded it, records that the revisions in it are
+// current, syncs and closes the operation log,
+// ends every Watcher with ErrClosed and unlocks the data directory. Reads and writes afterwards fail with ErrClosed. Calling
+// Close again returns the result of the first call.
+func (d *Driver) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		d.background.Wait()
+
+		d.mutex.Lock()
+		d.closed.Store(true)
+		var errs []error
+		if d.writeBack > 0 {
+			errs = append(errs, d.flushLocked())
+		}
+		if d.snapshotDirty() {
+			errs = append(errs, d.saveSnapshot())
+		}
+		// The snapshot now holds every revision, which the next Open can trust
+		if errors.Join(errs...) == nil {
+			errs = append(errs, d.saveRevisions(d.rev, true))
+		}
+		d.mutex.Unlock()
+
+		// No write can queue a hook once closed is set under the lock
+		d.hookWG.Wait()
+
+		d.logMu.Lock()
+		if d.oplog != nil {
+			errs = append(errs, d.oplog.close())
+		}
+		d.logMu.Unlock()
+
+		d.watchMu.Lock()
+		for w := range d.watchers {
+			w.closeLocked(ErrClosed)
+		}
+		d.watchMu.Unlock()
+
+		errs = append(errs, d.dirLock.release())
+
+		d.closeErr = errors.Join(errs...)
+		if d.closeErr != nil {
+			d.log.Error("Failed to close the database: %v", d.closeErr)
+		} else {
+			d.log.Info("Closed the database at '%s'", d.dir)
+		}
+	})
+	return d.closeErr
+}
+
+// checkOpen returns ErrClosed once the driver is closed
+func (d *Driver) checkOpen() error {
+	if d.closed.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// writable returns ErrClosed once the driver is closed, ErrReadOnly on a
+// replica and ErrDiskFull while there is no room for writes
+func (d *Driver) writable() error {
+	if err := d.deletable(); err != nil {
+		return err
+	}
+	if reason, full := d.DiskFull(); full {
+		return &diskFullError{reason}
+	}
+	return nil
+}
+
+// deletable is writable for deletes, which are taken on a full disk as they
+// free space
+func (d *Driver) deletable() error {
+	if d.closed.Load() {
+		return ErrClosed
+	}
+	if d.ReadOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
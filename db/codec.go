@@ -0,0 +1,103 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SnapshotCodec encodes the B-tree saved in snapshot files. A codec can wrap
+// another to compress or encrypt its output; it then needs a name of its
+// own.
+type SnapshotCodec interface {
+	// Name identifies the codec in the header of the snapshots it writes
+	Name() string
+	Encode(w io.Writer, items []Item) error
+	Decode(r io.Reader) ([]Item, error)
+}
+
+// JSONCodec writes snapshots as a JSON array. It is the default.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string { return "json" }
+
+func (JSONCodec) Encode(w io.Writer, items []Item) error {
+	return json.NewEncoder(w).Encode(items)
+}
+
+func (JSONCodec) Decode(r io.Reader) ([]Item, error) {
+	var items []Item
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// GobCodec writes snapshots with encoding/gob, which is smaller and faster
+// to load than JSON for large values
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Encode(w io.Writer, items []Item) error {
+	return gob.NewEncoder(w).Encode(items)
+}
+
+func (GobCodec) Decode(r io.Reader) ([]Item, error) {
+	var items []Item
+	if err := gob.NewDecoder(r).Decode(&items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// snapshotMagic starts the header line of a snapshot, followed by the name
+// of the codec that wrote it
+const snapshotMagic = "zephyrus-snapshot "
+
+// errUnknownCodec is returned for a snapshot written by a codec the driver
+// does not have, which is not the same as a corrupt one
+var errUnknownCodec = errors.New("snapshot written by unknown codec")
+
+// snapshotCodecs are the codecs a snapshot can be read with besides the
+// driver's own
+var snapshotCodecs = []SnapshotCodec{JSONCodec{}, GobCodec{}}
+
+// encodeSnapshot writes a snapshot header naming codec, then items
+func encodeSnapshot(w io.Writer, codec SnapshotCodec, items []Item) error {
+	if _, err := io.WriteString(w, snapshotMagic+codec.Name()+"\n"); err != nil {
+		return err
+	}
+	return codec.Encode(w, items)
+}
+
+// decodeSnapshot reads a snapshot with the codec its header names, which is
+// own or one of snapshotCodecs. A snapshot without a header was written
+// before there were codecs and is JSON.
+func decodeSnapshot(r io.Reader, own SnapshotCodec) ([]Item, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(snapshotMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(head, []byte(snapshotMagic)) {
+		return JSONCodec{}.Decode(br)
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading the snapshot header: %w", err)
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(line, snapshotMagic))
+	for _, codec := range append([]SnapshotCodec{own}, snapshotCodecs...) {
+		if codec != nil && codec.Name() == name {
+			return codec.Decode(br)
+		}
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownCodec, name)
+}
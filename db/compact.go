@@ -0,0 +1,193 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// compactBatch is how many files Compact checks and removes under the write
+// lock at a time
+const compactBatch = 64
+
+// CompactProgress reports how far a Compact has got
+type CompactProgress struct {
+	Total   int   `json:"total"`   // temp files and unused blobs found when listing the data directories
+	Scanned int   `json:"scanned"` // of those, checked again under the lock so far
+	Removed int   `json:"removed"` // still unused when checked, and removed
+	Bytes   int64 `json:"bytes"`   // size of the files removed
+	Done    bool  `json:"done"`
+}
+
+// compactCandidate is a file that looked unused when the data directories
+// were listed
+type compactCandidate struct {
+	path string
+	blob bool // a blob of Options.DedupThreshold, or a temp file among them
+}
+
+// Compact cleans up the data directories, removing leftover temp files and
+// the blobs of Options.DedupThreshold that no key uses any more
+func (d *Driver) Compact() error {
+	_, err := d.CompactContext(context.Background(), nil)
+	return err
+}
+
+// CompactContext is Compact, reporting its progress and stopping early when
+// ctx is cancelled. The data directories are listed without any lock; the
+// files found are then checked again and removed compactBatch at a time
+// under the write lock, which is released in between so that reads and
+// writes are only held up briefly. Options.CompactRate and
+// CompactBytesRate cap how many files and bytes it removes a second, and
+// PauseCompaction holds it between batches. progress, if not nil, is called
+// after every batch and once more when done. Its progress and what it
+// reclaims are recorded in CompactionStats.
+func (d *Driver) CompactContext(ctx context.Context, progress func(CompactProgress)) (_ CompactProgress, err error) {
+	if err := d.checkOpen(); err != nil {
+		return CompactProgress{}, err
+	}
+	var p CompactProgress
+	d.compactStarted()
+	defer func() { d.compactFinished(p, err) }()
+
+	var candidates []compactCandidate
+	for _, shard := range d.dirs {
+		found, err := d.compactCandidates(shard)
+		if err != nil {
+			return p, err
+		}
+		candidates = append(candidates, found...)
+	}
+
+	p.Total = len(candidates)
+	for len(candidates) > 0 {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		if err := d.compactPaused(ctx); err != nil {
+			return p, err
+		}
+		batch := candidates[:min(compactBatch, len(candidates))]
+		candidates = candidates[len(batch):]
+
+		removed, bytes, err := d.compactFiles(batch)
+		p.Scanned += len(batch)
+		p.Removed += removed
+		p.Bytes += bytes
+		d.compactProgressed(p, removed, bytes)
+		if err != nil {
+			return p, err
+		}
+		if progress != nil {
+			progress(p)
+		}
+		if err := d.compactWait(ctx, removed, bytes); err != nil {
+			return p, err
+		}
+	}
+
+	p.Done = true
+	if progress != nil {
+		progress(p)
+	}
+	if p.Removed > 0 {
+		d.log.Info("Compaction removed %d unused files, %d bytes", p.Removed, p.Bytes)
+	}
+	return p, nil
+}
+
+// compactCandidates lists the files of a data directory that look unused:
+// temp files other than uploads in progress, and in its blobs, temp files
+// and blobs no key links to. They are checked again under the lock before
+// being removed.
+func (d *Driver) compactCandidates(shard string) ([]compactCandidate, error) {
+	entries, err := os.ReadDir(shard)
+	if err != nil {
+		d.log.Error("Failed to list directory for compaction: %v", err)
+		return nil, err
+	}
+	var candidates []compactCandidate
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".tmp" && !entry.IsDir() {
+			candidates = append(candidates, compactCandidate{path: filepath.Join(shard, entry.Name())})
+		}
+	}
+
+	entries, err = os.ReadDir(filepath.Join(shard, blobDir))
+	if os.IsNotExist(err) {
+		return candidates, nil
+	}
+	if err != nil {
+		d.log.Error("Failed to list directory for compaction: %v", err)
+		return nil, err
+	}
+	for _, entry := range entries {
+		if fi, err := entry.Info(); err == nil && (filepath.Ext(entry.Name()) == ".tmp" || linkCount(fi) == 1) {
+			candidates = append(candidates, compactCandidate{path: filepath.Join(shard, blobDir, entry.Name()), blob: true})
+		}
+	}
+	return candidates, nil
+}
+
+// compactFiles removes those of a batch of candidates that are still unused,
+// under the write lock, and returns how many it removed and their size
+func (d *Driver) compactFiles(batch []compactCandidate) (int, int64, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	d.blobMu.Lock()
+	defer d.blobMu.Unlock()
+
+	removed, bytes := 0, int64(0)
+	for _, c := range batch {
+		if _, uploading := d.uploads.Load(c.path); uploading {
+			continue
+		}
+		// Writes of keys and blobs finish under the locks held here, so a
+		// temp file still there is left over; a blob may have been linked
+		// to since it was listed
+		fi, err := os.Lstat(c.path)
+		if err != nil {
+			continue
+		}
+		if c.blob && filepath.Ext(c.path) != ".tmp" && linkCount(fi) != 1 {
+			continue
+		}
+		if err := os.Remove(c.path); err != nil {
+			d.log.Error("Failed to remove unused file during compaction: %v", err)
+			continue
+		}
+		d.log.Debug("Removed unused file during compaction: %s", c.path)
+		removed++
+		bytes += fi.Size()
+	}
+	return removed, bytes, nil
+}
+
+// compactWait waits after removing files of bytes in all long enough to
+// keep to Options.CompactRate and CompactBytesRate, or until ctx is done
+func (d *Driver) compactWait(ctx context.Context, removed int, bytes int64) error {
+	var wait time.Duration
+	if d.compactRate > 0 {
+		wait = time.Duration(removed) * time.Second / time.Duration(d.compactRate)
+	}
+	if d.compactBytesRate > 0 {
+		wait = max(wait, time.Duration(float64(bytes)/float64(d.compactBytesRate)*float64(time.Second)))
+	}
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.stop:
+		return ErrClosed
+	}
+}
@@ -0,0 +1,288 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// compactFile holds CompactionStats across restarts, in the metadata
+// directory
+const compactFile = "compact.json"
+
+// compactCheckEvery is how often the scheduler of Options.CompactWindow
+// checks whether a compaction is due
+const compactCheckEvery = time.Minute
+
+// CompactWindow is a daily window of local time in which Options.CompactWindow
+// runs Compact. Start and End are times of day, as offsets from midnight; a
+// window whose End is before its Start runs over midnight.
+type CompactWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseCompactWindow parses a window given as HH:MM-HH:MM in local time, as
+// accepted by the -compact-window flag, such as "02:00-04:00". An empty
+// spec returns nil, no window.
+func ParseCompactWindow(spec string) (*CompactWindow, error) {
+	if spec = strings.TrimSpace(spec); spec == "" {
+		return nil, nil
+	}
+	start, end, ok := strings.Cut(spec, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid compaction window %q, want HH:MM-HH:MM", spec)
+	}
+	var w CompactWindow
+	var err error
+	if w.Start, err = parseTimeOfDay(start); err != nil {
+		return nil, fmt.Errorf("invalid compaction window %q: %w", spec, err)
+	}
+	if w.End, err = parseTimeOfDay(end); err != nil {
+		return nil, fmt.Errorf("invalid compaction window %q: %w", spec, err)
+	}
+	return &w, nil
+}
+
+// parseTimeOfDay parses HH:MM as the time since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// String formats the window as ParseCompactWindow reads it
+func (w CompactWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	return clock(w.Start) + "-" + clock(w.End)
+}
+
+// valid reports whether both ends are times of day and differ
+func (w CompactWindow) valid() bool {
+	return w.Start >= 0 && w.Start < 24*time.Hour && w.End >= 0 && w.End < 24*time.Hour && w.Start != w.End
+}
+
+// at returns when the window around t opened and when it closes, and
+// whether t is in the window at all
+func (w CompactWindow) at(t time.Time) (opens, closes time.Time, ok bool) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if w.Start < w.End {
+		opens, closes = midnight.Add(w.Start), midnight.Add(w.End)
+	} else if since := t.Sub(midnight); since >= w.Start {
+		opens, closes = midnight.Add(w.Start), midnight.AddDate(0, 0, 1).Add(w.End)
+	} else {
+		opens, closes = midnight.AddDate(0, 0, -1).Add(w.Start), midnight.Add(w.End)
+	}
+	return opens, closes, !t.Before(opens) && t.Before(closes)
+}
+
+// CompactionStats tells how compaction has gone: its schedule, whether it
+// is paused or running, and what it reclaimed. All but Window and Running
+// are kept across restarts.
+type CompactionStats struct {
+	Window  string `json:"window,omitempty"` // Options.CompactWindow, empty without one
+	Paused  bool   `json:"paused"`           // see PauseCompaction
+	Running bool   `json:"running"`
+
+	LastStart time.Time       `json:"last_start"`
+	LastEnd   time.Time       `json:"last_end"` // before LastStart while running
+	LastError string          `json:"last_error,omitempty"`
+	Progress  CompactProgress `json:"progress"` // of the running compaction, or the last one
+
+	// Interrupted tells that the last compaction was stopped by Close; the
+	// scheduler starts another when the window is still open
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	// Compactions finished or stopped, and the files and bytes they removed
+	Runs           uint64 `json:"runs"`
+	FilesReclaimed uint64 `json:"files_reclaimed"`
+	BytesReclaimed uint64 `json:"bytes_reclaimed"`
+}
+
+// CompactionStats returns the state of compaction, as Stats reports it
+func (d *Driver) CompactionStats() CompactionStats {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	stats := d.compaction
+	stats.Running = d.compacting > 0
+	if d.compactWindow != nil {
+		stats.Window = d.compactWindow.String()
+	}
+	return stats
+}
+
+// PauseCompaction stops compaction until ResumeCompaction: a compaction
+// running stops before its next batch and waits, as does one started
+// meanwhile, and the scheduler of Options.CompactWindow starts none. The
+// pause is kept across restarts.
+func (d *Driver) PauseCompaction() error {
+	return d.setCompactionPaused(true)
+}
+
+// ResumeCompaction lets compactions paused by PauseCompaction go on
+func (d *Driver) ResumeCompaction() error {
+	return d.setCompactionPaused(false)
+}
+
+func (d *Driver) setCompactionPaused(paused bool) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	if d.compaction.Paused == paused {
+		return nil
+	}
+	d.compaction.Paused = paused
+	if paused {
+		d.compactResumed = make(chan struct{})
+		d.log.Info("Paused compaction")
+	} else {
+		close(d.compactResumed)
+		d.log.Info("Resumed compaction")
+	}
+	return d.saveCompactionLocked()
+}
+
+// compactPaused waits while compaction is paused, until it is resumed, ctx
+// is done or the driver closes
+func (d *Driver) compactPaused(ctx context.Context) error {
+	d.compactMu.Lock()
+	paused, resumed := d.compaction.Paused, d.compactResumed
+	d.compactMu.Unlock()
+	if !paused {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.stop:
+		return ErrClosed
+	}
+}
+
+// compactStarted records the start of a compaction
+func (d *Driver) compactStarted() {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	d.compacting++
+	d.compaction.LastStart = time.Now()
+	d.compaction.LastError = ""
+	d.compaction.Interrupted = false
+	d.compaction.Progress = CompactProgress{}
+	d.saveCompactionLocked()
+}
+
+// compactProgressed records a batch of a compaction, which removed files
+// of bytes in all
+func (d *Driver) compactProgressed(p CompactProgress, files int, bytes int64) {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	d.compaction.Progress = p
+	d.compaction.FilesReclaimed += uint64(files)
+	d.compaction.BytesReclaimed += uint64(bytes)
+	d.saveCompactionLocked()
+}
+
+// compactFinished records the end of a compaction, with the error that
+// stopped it if any
+func (d *Driver) compactFinished(p CompactProgress, err error) {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	d.compacting--
+	d.compaction.Runs++
+	d.compaction.LastEnd = time.Now()
+	d.compaction.Progress = p
+	d.compaction.Interrupted = errors.Is(err, ErrClosed)
+	if err != nil {
+		d.compaction.LastError = err.Error()
+	}
+	d.saveCompactionLocked()
+}
+
+// loadCompaction reads the CompactionStats saved before the last restart
+func (d *Driver) loadCompaction() error {
+	d.compactResumed = make(chan struct{})
+	data, err := os.ReadFile(filepath.Join(d.dir, metaDir, compactFile))
+	if os.IsNotExist(err) {
+		close(d.compactResumed)
+		return nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &d.compaction)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load the compaction state: %w", err)
+	}
+	if !d.compaction.Paused {
+		close(d.compactResumed)
+	}
+	return nil
+}
+
+// saveCompactionLocked writes the CompactionStats to compactFile, logging a
+// failure, as losing them loses no data. The caller must hold compactMu.
+func (d *Driver) saveCompactionLocked() error {
+	data, err := json.Marshal(d.compaction)
+	if err == nil {
+		path := filepath.Join(d.dir, metaDir, compactFile)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err == nil {
+			err = d.writeFile(path, data)
+		}
+	}
+	if err != nil {
+		d.log.Error("Failed to save the compaction state: %v", err)
+	}
+	return err
+}
+
+// compactLoop runs a compaction in each Options.CompactWindow until Close
+func (d *Driver) compactLoop() {
+	defer d.background.Done()
+	ticker := time.NewTicker(compactCheckEvery)
+	defer ticker.Stop()
+	for {
+		d.compactIfDue(time.Now())
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// compactIfDue runs a compaction when now is in the window, no compaction
+// has started since it opened unless Close stopped it, and compaction is
+// neither paused nor running. It is stopped when the window closes, to go
+// on in the next one.
+func (d *Driver) compactIfDue(now time.Time) {
+	opens, closes, ok := d.compactWindow.at(now)
+	if !ok {
+		return
+	}
+	stats := d.CompactionStats()
+	if stats.Paused || stats.Running || (!stats.LastStart.Before(opens) && !stats.Interrupted) {
+		return
+	}
+
+	d.log.Info("Starting the scheduled compaction, until %s", closes.Format(time.Kitchen))
+	ctx, cancel := context.WithTimeout(context.Background(), closes.Sub(now))
+	defer cancel()
+	switch _, err := d.CompactContext(ctx, nil); {
+	case errors.Is(err, context.DeadlineExceeded):
+		d.log.Info("Compaction window closed, stopped the scheduled compaction")
+	case err != nil && !errors.Is(err, ErrClosed):
+		d.log.Error("Scheduled compaction failed: %v", err)
+	}
+}
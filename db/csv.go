@@ -0,0 +1,116 @@
+package db
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CSVStats counts what ExportCSV wrote
+type CSVStats struct {
+	Rows    int `json:"rows"`
+	Skipped int `json:"skipped"` // values that are not JSON objects
+}
+
+// ExportCSV writes every key starting with prefix whose value is a JSON
+// object to w as CSV, one row per key in key order. The header row is "key"
+// followed by fields, each naming a member of the object or, with dots, a
+// nested one as in "address.city". Strings are written as they are,
+// numbers and booleans as in JSON and nested objects and arrays as compact
+// JSON; missing and null fields are left blank. Values that are not JSON
+// objects are skipped and counted. Like Export it reads one value at a time
+// and writes each row as soon as it is built.
+func (d *Driver) ExportCSV(w io.Writer, prefix string, fields []string) (CSVStats, error) {
+	return d.ExportCSVPrefixes(w, []string{prefix}, fields)
+}
+
+// ExportCSVPrefixes is ExportCSV of the keys starting with any of prefixes,
+// which writes only the header row when there are none
+func (d *Driver) ExportCSVPrefixes(w io.Writer, prefixes []string, fields []string) (CSVStats, error) {
+	return d.ExportCSVMatching(w, prefixes, fields, nil)
+}
+
+// ExportCSVMatching is ExportCSVPrefixes of only the keys whose values
+// filter matches, or every key when filter is nil. Values left out by the
+// filter are not counted as skipped.
+func (d *Driver) ExportCSVMatching(w io.Writer, prefixes []string, fields []string, filter *Filter) (CSVStats, error) {
+	prefix := strings.Join(prefixes, " ") // for the log
+	var stats CSVStats
+	names, err := d.keyFiles()
+	if err != nil {
+		return stats, err
+	}
+
+	paths := make([][]string, len(fields))
+	for i, f := range fields {
+		paths[i] = strings.Split(f, ".")
+	}
+
+	cw := csv.NewWriter(w)
+	row := append([]string{"key"}, fields...)
+	if err := writeCSVRow(cw, row); err != nil {
+		return stats, err
+	}
+	for _, name := range names {
+		if !hasAnyPrefix(name, prefixes) || Reserved(name) {
+			continue
+		}
+
+		value, ok, err := d.readUncached(name)
+		if err != nil {
+			return stats, err
+		}
+		if !ok || !filter.Match(value) {
+			// Deleted or expired since the directory was listed, or left out
+			continue
+		}
+		doc := parseDoc(value)
+		if doc == nil {
+			stats.Skipped++
+			continue
+		}
+
+		row[0] = name
+		for i, path := range paths {
+			row[i+1] = csvCell(fieldValue(doc, path))
+		}
+		if err := writeCSVRow(cw, row); err != nil {
+			return stats, err
+		}
+		stats.Rows++
+	}
+
+	if stats.Skipped > 0 {
+		d.log.Warn("CSV export of prefix %q skipped %d values that are not JSON objects", prefix, stats.Skipped)
+	}
+	d.log.Info("Exported %d keys with prefix %q as CSV", stats.Rows, prefix)
+	return stats, nil
+}
+
+// writeCSVRow writes a row and passes it on to the underlying writer at once
+func writeCSVRow(cw *csv.Writer, row []string) error {
+	if err := cw.Write(row); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvCell formats a JSON field as a CSV cell
+func csvCell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// blobDir is the directory, in each data directory, holding the values
+// stored once for every key with the same content, named by content hash
+const blobDir = ".blobs"
+
+// deduped reports whether a value of size bytes is stored as a blob
+func (d *Driver) deduped(size int64) bool {
+	return d.dedup > 0 && size >= d.dedup
+}
+
+// blobPath returns the blob for a content hash in the data directory
+// holding filePath
+func blobPath(filePath, hash string) string {
+	return filepath.Join(filepath.Dir(filePath), blobDir, hash)
+}
+
+// writeValue writes the value of a key to its file, as writeFile does, or
+// for a value stored as a blob makes the file a hard link to the blob,
+// writing the blob first if no key holds that content yet
+func (d *Driver) writeValue(filePath string, value []byte) error {
+	if !d.deduped(int64(len(value))) {
+		return d.writeFile(filePath, value)
+	}
+
+	d.blobMu.Lock()
+	defer d.blobMu.Unlock()
+	blob := blobPath(filePath, hashValue(value))
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return err
+		}
+		if err := d.writeFile(blob, value); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return d.linkBlob(blob, filePath)
+}
+
+// placeValue moves a value streamed to tempPath into place at filePath, or
+// for a value stored as a blob into the blob for its content hash, which
+// filePath is then linked to
+func (d *Driver) placeValue(tempPath, filePath, hash string, size int64) error {
+	if err := d.failpoint(fpBeforeRename); err != nil {
+		return err
+	}
+	if !d.deduped(size) {
+		return replaceFile(tempPath, filePath)
+	}
+
+	d.blobMu.Lock()
+	defer d.blobMu.Unlock()
+	blob := blobPath(filePath, hash)
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+			return err
+		}
+		if err := replaceFile(tempPath, blob); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else {
+		os.Remove(tempPath)
+	}
+	return d.linkBlob(blob, filePath)
+}
+
+// linkBlob replaces the file at filePath with a hard link to blob. The
+// caller must hold blobMu.
+func (d *Driver) linkBlob(blob, filePath string) error {
+	// Renaming a link over another link to the same blob would do nothing
+	// and leave the temp link behind
+	blobInfo, err := os.Stat(blob)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(filePath); err == nil && os.SameFile(fi, blobInfo) {
+		return nil
+	}
+
+	tempPath := filePath + ".tmp"
+	os.Remove(tempPath)
+	if err := os.Link(blob, tempPath); err != nil {
+		d.log.Error("Failed to link blob: %v", err)
+		return err
+	}
+	if err := replaceFile(tempPath, filePath); err != nil {
+		d.log.Error("Failed to rename temp file: %v", err)
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// releaseBlob removes the blob for a content hash once no key's file links
+// to it any more. It is called after a key holding that content is
+// rewritten or deleted; blobs it cannot tell about, as for keys whose hash
+// was not known, are left for Compact.
+func (d *Driver) releaseBlob(hash string) {
+	if d.dedup == 0 || hash == "" {
+		return
+	}
+	d.blobMu.Lock()
+	defer d.blobMu.Unlock()
+	for _, shard := range d.dirs {
+		blob := filepath.Join(shard, blobDir, hash)
+		if fi, err := os.Stat(blob); err == nil && linkCount(fi) == 1 {
+			if err := os.Remove(blob); err != nil {
+				d.log.Error("Failed to remove unused blob %s: %v", hash, err)
+			}
+		}
+	}
+}
+
+// CorruptValue is a key whose stored value no longer matches its content
+// hash, as found by Verify
+type CorruptValue struct {
+	Key   string `json:"key"`
+	Blob  string `json:"blob,omitempty"` // the shared blob the key's file links to, if any
+	Error string `json:"error"`
+}
+
+// Verify reads back the value of every key whose content hash is known and
+// returns those that no longer match it, or whose file is gone. A corrupt
+// blob is reported for every key sharing it. Keys are read one at a time
+// under the read lock, so writers are only held up briefly; values written
+// since Verify started are checked as they are when reached.
+func (d *Driver) Verify(ctx context.Context) ([]CorruptValue, error) {
+	var keys []string
+	err := ascendPrefix(ctx, d.snapshotTree(), "", func(it *Item) bool {
+		if it.Hash != "" {
+			keys = append(keys, it.Key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	blobSums := make(map[string]string) // blob hash to the hash of its content
+	corrupt := []CorruptValue{}
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if c, bad := d.verifyKey(key, blobSums); bad {
+			corrupt = append(corrupt, c)
+		}
+	}
+	if len(corrupt) > 0 {
+		d.log.Error("Verify found %d corrupt values among %d keys", len(corrupt), len(keys))
+	}
+	return corrupt, nil
+}
+
+// verifyKey checks the value of one key against its content hash, reading
+// each blob only once
+func (d *Driver) verifyKey(key string, blobSums map[string]string) (CorruptValue, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	it, ok := d.tree.Get(&Item{Key: key}).(*Item)
+	if !ok || it.Hash == "" || it.expired(time.Now()) || d.isDirty(key) {
+		return CorruptValue{}, false
+	}
+
+	path := d.keyPath(key)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return CorruptValue{Key: key, Error: err.Error()}, true
+	}
+	var blob string
+	if d.dedup > 0 && linkCount(fi) > 1 {
+		blob = it.Hash
+	}
+	sum, seen := blobSums[blob]
+	if blob == "" || !seen {
+		if sum, err = hashFile(path); err != nil {
+			return CorruptValue{Key: key, Blob: blob, Error: err.Error()}, true
+		}
+		if blob != "" {
+			blobSums[blob] = sum
+		}
+	}
+	if sum != it.Hash {
+		return CorruptValue{Key: key, Blob: blob, Error: "content hash is " + sum + ", want " + it.Hash}, true
+	}
+	return CorruptValue{}, false
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package db
+
+import "os"
+
+// diskUsage is not supported on this platform and reports nothing
+func diskUsage(dir string) (total, free uint64, err error) {
+	return 0, 0, nil
+}
+
+// hardLinks is false where linkCount cannot count the names of a file, which
+// Options.DedupThreshold needs
+const hardLinks = false
+
+// linkCount is not supported on this platform and reports 0
+func linkCount(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,29 @@
+//go:build linux || darwin
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// diskUsage returns the size of the filesystem holding dir and the bytes
+// available on it
+func diskUsage(dir string) (total, free uint64, err error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, 0, err
+	}
+	return fs.Blocks * uint64(fs.Bsize), fs.Bavail * uint64(fs.Bsize), nil
+}
+
+// hardLinks is true where linkCount can tell how many names a file has
+const hardLinks = true
+
+// linkCount returns how many names the file described by fi has
+func linkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 0
+}
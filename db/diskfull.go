@@ -0,0 +1,113 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// ErrDiskFull is returned for writes refused while the driver is read-only
+// because a data directory ran out of space. It also matches ErrReadOnly.
+var ErrDiskFull = errors.New("disk is full")
+
+// defaultSpaceCheckEvery is how often free space is checked when
+// Options.SpaceCheckEvery is not set
+const defaultSpaceCheckEvery = 10 * time.Second
+
+// minRecoverSpace is the least free space every data directory needs for a
+// driver that ran out of space to take writes again
+const minRecoverSpace = 1 << 20
+
+// diskFullError is the error of a write refused for lack of space
+type diskFullError struct {
+	reason string
+}
+
+func (e *diskFullError) Error() string {
+	return fmt.Sprintf("%v, read-only until space is freed: %s", ErrDiskFull, e.reason)
+}
+
+func (e *diskFullError) Is(target error) bool {
+	return target == ErrDiskFull || target == ErrReadOnly
+}
+
+// DiskFull reports whether the driver is refusing writes for lack of disk
+// space, and why. Reads and deletes still work, and writes are taken again
+// once the space check finds room.
+func (d *Driver) DiskFull() (string, bool) {
+	if reason := d.diskFull.Load(); reason != nil {
+		return *reason, true
+	}
+	return "", false
+}
+
+// setDiskFull turns the driver read-only for lack of space, or writable
+// again with an empty reason, logging the change
+func (d *Driver) setDiskFull(reason string) {
+	if reason == "" {
+		if d.diskFull.Swap(nil) != nil {
+			d.log.Info("Disk space is available again, taking writes")
+		}
+		return
+	}
+	if d.diskFull.Swap(&reason) == nil {
+		d.log.Error("Refusing writes until disk space is freed: %s", reason)
+	}
+}
+
+// noteWriteError turns the driver read-only when err says a disk is full,
+// and returns err
+func (d *Driver) noteWriteError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		d.setDiskFull("no space left on device")
+	}
+	return err
+}
+
+// spaceLoop checks the free space of the data directories every interval
+// until Close
+func (d *Driver) spaceLoop(every time.Duration) {
+	defer d.background.Done()
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.checkSpace()
+	}
+}
+
+// checkSpace turns the driver read-only when a data directory has less than
+// Options.MinFreeSpace free, and writable again once every one has enough.
+// Directories whose free space cannot be told, as on Windows, count as
+// having room, so that writes are tried again and fail anew if they must.
+func (d *Driver) checkSpace() {
+	_, full := d.DiskFull()
+	need := uint64(d.minFree)
+	if full && need < minRecoverSpace {
+		need = minRecoverSpace
+	}
+	if need == 0 {
+		return
+	}
+
+	for _, shard := range d.dirs {
+		total, free, err := d.diskUsage(shard)
+		if err != nil || total == 0 {
+			continue
+		}
+		if free < need {
+			if !full {
+				d.log.Warn("Data directory %s has %d bytes free, below the %d required", shard, free, need)
+			}
+			d.setDiskFull(fmt.Sprintf("a data directory has %d bytes free, below the %d required", free, need))
+			return
+		}
+	}
+	d.setDiskFull("")
+}
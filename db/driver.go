@@ -2,19 +2,229 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/btree"
-	lru "github.com/hashicorp/golang-lru"
 	"github.com/jcelliott/lumber"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
+// ErrKeyNotFound is returned when the requested key does not exist
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKeyExists is returned by Create when the key already exists
+var ErrKeyExists = errors.New("key already exists")
+
+// ErrValueTooLarge is returned by writes of values over
+// Options.MaxValueSize
+var ErrValueTooLarge = errors.New("value too large")
+
+// ErrInvalidOption is returned by Open and New, wrapped with the parameter
+// that is out of range
+var ErrInvalidOption = errors.New("invalid option")
+
+// Sizes used by Open when Options leaves them at 0
+const (
+	DefaultCacheSize = 1024
+	DefaultDegree    = 32
+)
+
+// Options configures a Driver opened with Open
 type Options struct {
-	Logger Logger
+	Logger    Logger
+	CacheSize int // number of values held in the LRU cache; 0 uses DefaultCacheSize
+	Degree    int // degree of the in-memory B-tree, at least 2; 0 uses DefaultDegree
+
+	// MaxValueSize is the largest value accepted, in bytes; writes of
+	// larger ones fail with ErrValueTooLarge. 0 allows any size.
+	MaxValueSize int64
+
+	// MaxKeyLen is the longest key accepted, in bytes, at most and by
+	// default MaxKeyLen. Longer keys fail with ErrInvalidKey.
+	MaxKeyLen int
+
+	// MaxKeys caps the number of keys in the in-memory index, which grows
+	// with each one; writes of new keys past it fail with ErrTooManyKeys,
+	// and deletes make room again. Expired keys count until they are
+	// removed. 0 allows any number.
+	MaxKeys int
+
+	// ChangeLogSize is how many changes are kept for replicas to catch up
+	// on; 0 keeps 10000
+	ChangeLogSize int
+
+	// ShardDirs are more data directories to spread keys across, by
+	// consistent hashing, along with the one passed to Open. Snapshots and
+	// the operation log stay in that one.
+	ShardDirs []string
+
+	// ColdDir is a directory for keys not used for DemoteAfter, typically
+	// on a bigger, slower disk. The data directory and ShardDirs form the
+	// hot tier, where new writes land, and reads find a key in either.
+	// PromoteOnRead moves a key read from ColdDir back to the hot tier.
+	ColdDir       string
+	DemoteAfter   time.Duration // 0 leaves keys where they are
+	PromoteOnRead bool
+
+	// OplogSize and OplogMaxAge bound the operation log kept on disk for
+	// external consumers. It is disabled when both are 0.
+	OplogSize   int
+	OplogMaxAge time.Duration
+
+	// OplogValues keeps the value of every put in the operation log too, so
+	// that RestoreToTime can replay it
+	OplogValues bool
+
+	// SlowOpThreshold logs a warning for every operation that takes at least
+	// this long, with the time spent waiting for the lock and on disk I/O.
+	// 0 disables it.
+	SlowOpThreshold time.Duration
+
+	// SnapshotPath is where Open loads the B-tree from and Close saves it
+	// to; empty uses <dir>/.zephyrus/btree.json
+	SnapshotPath string
+
+	// SnapshotCodec encodes the snapshots the driver writes; nil uses
+	// JSONCodec. Snapshots written by JSONCodec, GobCodec or this codec
+	// can all be loaded, whichever is set.
+	SnapshotCodec SnapshotCodec
+
+	// SnapshotEvery also saves the snapshot about this often, when
+	// anything changed, so that less is lost to a crash. 0 saves it only
+	// on Close.
+	SnapshotEvery time.Duration
+
+	// SnapshotArchive also writes timestamped snapshots, as often as the
+	// shortest Every, and prunes those no rule keeps; see
+	// Driver.Snapshots and Driver.RestoreSnapshot. Empty archives none.
+	SnapshotArchive []SnapshotRetention
+
+	// SkipReconcile skips checking the loaded B-tree against the data
+	// directories on Open. Keys added or removed while the driver was
+	// closed are then missing from List and Count, or listed without a
+	// value, until they are next written. It saves listing every file in
+	// very large directories.
+	SkipReconcile bool
+
+	// EncodeFileNames stores keys that are not lower-case ASCII, or that
+	// Windows reserves, under encoded file names, so that the data
+	// directory works the same on Windows and on case-insensitive
+	// filesystems such as macOS's. A data directory must always be opened
+	// with the same setting.
+	EncodeFileNames bool
+
+	// WriteBack, when above 0, holds written values in memory and writes
+	// them to disk in the background, the longest held first, so that
+	// bursts of writes cost no disk I/O. A value is on disk within about
+	// WriteBack of being written, or sooner if the cache evicts it, so a
+	// crash loses at most the writes of the last WriteBack. Reads always
+	// see the newest value. Flush and Close write everything held back.
+	WriteBack time.Duration
+
+	// DefaultTTL, when above 0, is the time-to-live of keys written without
+	// one, as by Put, Create or Import; a TTL of NoTTL stores a key without
+	// an expiry regardless. Keys written before it was set keep their
+	// expiry until rewritten.
+	DefaultTTL time.Duration
+
+	// SweepEvery removes expired keys in the background about this often,
+	// so that keys nobody reads again do not stay on disk, with an OpExpire
+	// event for each. 0 leaves them until they are next read or written.
+	SweepEvery time.Duration
+
+	// SweepBatch is how many expired keys a sweep removes under the write
+	// lock at a time; 0 removes 100. SweepRate caps how many it removes a
+	// second, so that a large backlog does not hog the disk; 0 is no cap.
+	SweepBatch int
+	SweepRate  int
+
+	// CompactRate caps how many unused files Compact removes a second, so
+	// that cleaning up a large backlog does not hog the disk; 0 is no cap.
+	// CompactBytesRate caps the bytes it removes a second the same way.
+	CompactRate      int
+	CompactBytesRate int64
+
+	// CompactWindow, when set, runs Compact in the background once a day
+	// within the window, stopping it when the window closes, so that it
+	// stays out of busy hours. PauseCompaction holds it off.
+	CompactWindow *CompactWindow
+
+	// SchemaAdvisory logs values that fail the schema set for their key
+	// with SetSchema instead of refusing them, for migrating data to a new
+	// schema
+	SchemaAdvisory bool
+
+	// DedupThreshold, when above 0, stores values of at least this many
+	// bytes once per data directory, under their content hash, with the
+	// files of every key holding them hard links to that copy. It needs a
+	// platform with hard links, Linux or macOS.
+	DedupThreshold int64
+
+	// MinFreeSpace, when above 0, makes the driver refuse writes with
+	// ErrDiskFull while a data directory has less than this many bytes
+	// free, so that it never fills the disk. Running out of space while
+	// writing does the same whatever it is set to. Either way the driver
+	// takes writes again once every directory has this much free, and at
+	// least 1 MiB; reads and deletes work throughout.
+	MinFreeSpace int64
+
+	// SpaceCheckEvery is how often free space is checked; 0 checks every 10
+	// seconds
+	SpaceCheckEvery time.Duration
+
+	// TracerProvider, when set, traces the operations called with a context
+	// holding a span, such as PutContext, with child spans for the lock wait
+	// and disk I/O
+	TracerProvider trace.TracerProvider
+
+	// Loader, when set, makes Get and GetReader, and so GET /key, fetch a
+	// key they cannot find from elsewhere, such as a slow upstream service,
+	// and store it before returning it. It is called once for any number
+	// of concurrent misses of the same key. A loader returning
+	// ErrKeyNotFound makes the read report a miss; any other error is
+	// returned wrapped in ErrLoadFailed. SkipLoader turns it off for a call.
+	Loader func(ctx context.Context, key string) ([]byte, error)
+
+	// LoaderTTL is the time-to-live of the values Loader fetches; 0 gives
+	// them DefaultTTL, and NoTTL no expiry
+	LoaderTTL time.Duration
+
+	// Mirror, when set, gets a copy of every write once it is applied
+	// here, including expiries, as a standby on another disk or host. By
+	// default the writes are queued and forwarded in the background,
+	// retried a few times when the mirror fails them; Stats.Mirror tells
+	// how far it lags and what it lost, and ResyncMirror catches it up.
+	Mirror Mirror
+
+	// MirrorSync forwards each write before returning, with the write lock
+	// held, and fails it with ErrMirrorFailed when the mirror refuses it.
+	// Writes then take as long as the mirror does.
+	MirrorSync bool
+
+	// MirrorQueue bounds the writes waiting for the mirror; 0 queues up to
+	// 10000. Writes that do not fit are dropped and counted.
+	MirrorQueue int
+
+	// VerifyOnOpen makes Open read back every value whose content hash is
+	// recorded and report those that do not match it in the StartupReport,
+	// as Verify does. Open takes as long as reading the whole database.
+	VerifyOnOpen bool
+
+	// CorruptLimit makes Open fail with ErrTooCorrupt when its checks find
+	// at least this many corrupt files, counted by
+	// StartupReport.CorruptFiles; 0 always opens
+	CorruptLimit int
 }
 
 type Logger interface {
@@ -26,25 +236,272 @@ type Logger interface {
 }
 
 type Driver struct {
-	mutex sync.RWMutex
-	dir   string
-	log   Logger
-	cache *lru.Cache
-	tree  *btree.BTree
+	mutex    sync.RWMutex
+	dir      string
+	shards   []string // data directories, starting with dir
+	ring     *hashRing
+	log      Logger
+	cache    *valueCache
+	tree     *btree.BTree
+	expiries *btree.BTree // expiryEntry items, for the keys with an expiry
+	degree   int
+	maxValue int64    // 0 for no limit
+	maxKey   int      // longest key accepted, in bytes
+	maxKeys  int      // keys the index may hold, 0 for no limit
+	encoded  bool     // keys are stored under encodeFileName names
+	uploads  sync.Map // temp files being written by PutReader
+	internal sync.Map // names of snapshot files kept in the data directory
+
+	watchMu  sync.Mutex
+	watchers map[*Watcher]struct{}
+
+	hookMu       sync.Mutex
+	hooks        []*hook
+	pendingHooks []hookCall // synchronous hook calls for the holder of the write lock
+	hookWG       sync.WaitGroup
+
+	logMu     sync.Mutex
+	changes   changeLog
+	oplog     *oplog
+	readOnly  atomic.Bool
+	following atomic.Bool // a Follow is applying changes
+
+	// Why writes are refused for lack of space, nil while they are not, and
+	// the free space to keep, see Options.MinFreeSpace
+	diskFull  atomic.Pointer[string]
+	minFree   int64
+	diskUsage func(dir string) (total, free uint64, err error)
+
+	failHook func(failpoint string) error // nil outside crash tests, see failpoint.go
+
+	slowOp  time.Duration // operations taking this long are logged, 0 for none
+	slowMu  sync.Mutex
+	slowOps map[string]uint64
+
+	tracer trace.Tracer // nil when tracing is off
+
+	schemaMu       sync.RWMutex
+	schemas        map[string]*keySchema // by key prefix
+	schemaAdvisory bool
+
+	defaultTTL time.Duration // of writes without a TTL, 0 for none
+
+	// Options.Loader and its TTL, and the loads in progress by key
+	loader    func(ctx context.Context, key string) ([]byte, error)
+	loaderTTL time.Duration
+	loads     singleflight.Group
+
+	mirror *mirror // nil without Options.Mirror
+
+	startup StartupReport // filled in by Open
+
+	// The directories holding keys, the shards then the cold tier, and
+	// what Options.ColdDir and its settings give
+	dirs        []string
+	cold        string // empty without a cold tier
+	demoteAfter time.Duration
+	promotions  chan string // keys read from the cold tier, nil unless promoting
+	accessMu    sync.Mutex
+	accessed    map[string]int64 // unix nanoseconds of the last read, by key
+	opened      int64            // unix nanoseconds, the floor of every key's last use
+	demoted     atomic.Uint64
+	promoted    atomic.Uint64
+
+	writeBack time.Duration // 0 writes values to disk before a Put returns
+	dirtyMu   sync.Mutex
+	dirty     map[string]dirtyValue // values not written to disk yet
+
+	quotaMu sync.Mutex
+	quotas  map[string]*NamespaceUsage // by namespace, for those with a quota
+
+	indexMu sync.RWMutex
+	text    *textIndex             // nil until EnableTextIndex
+	numeric map[string]*rangeIndex // by name, see CreateNumericIndex
+
+	// Keys by the "name=value" of each of their labels, guarded by mutex
+	labels map[string]map[string]struct{}
+
+	dedup  int64      // values of at least this many bytes are stored as blobs, 0 for none
+	blobMu sync.Mutex // serializes creating, linking and removing blobs
+
+	compactRate int // see Options.CompactRate
+
+	// Options.CompactBytesRate and CompactWindow, and the CompactionStats
+	// saved in compactFile, the compactions running and a channel closed
+	// when compaction is not paused
+	compactBytesRate int64
+	compactWindow    *CompactWindow
+	compactMu        sync.Mutex
+	compaction       CompactionStats
+	compacting       int
+	compactResumed   chan struct{}
+
+	txnMu sync.Mutex
+	txns  map[*ReadTxn]struct{} // open read transactions, see ReadTxn
+
+	rev         uint64 // the last revision handed out
+	revReserved uint64 // revisions up to this are reserved in the revision file
+
+	reconcileAdded   int // keys found on disk but not in the loaded B-tree
+	reconcileRemoved int // keys in the loaded B-tree without a file
+
+	dirLock        *dirLock
+	snapshotPath   string // where Open loads the B-tree and Close saves it
+	snapshotSeq    uint64 // the change the B-tree was last saved or loaded at
+	snapshotStale  bool   // the B-tree changed without a new change, as by Rebalance
+	legacySnapshot string // snapshot loaded from the old default path, removed once saved
+	codec          SnapshotCodec
+	archive        []SnapshotRetention // see Options.SnapshotArchive
+	snapshots      atomic.Uint64
+	snapshotFails  atomic.Uint64
+	expiredSwept   atomic.Uint64
+	ops            opCounters
+	stop           chan struct{} // closed by Close to stop background goroutines
+	background     sync.WaitGroup
+	closed         atomic.Bool
+	closeOnce      sync.Once
+	closeErr       error
+}
+
+// Item is an entry in the B-tree, as saved in snapshots. A nil Value means
+// the value is not held in memory and has to be read from disk.
+type Item struct {
+	Key       string
+	Value     []byte
+	ExpiresAt int64  `json:",omitempty"` // unix nanoseconds, 0 for no expiry
+	Hash      string `json:",omitempty"` // content hash used as the ETag
+	Dir       string `json:",omitempty"` // shard holding the file, empty when not known
+	Rev       uint64 `json:",omitempty"` // revision of the key, see Driver.PutIfRevision
+	CreatedAt int64  `json:",omitempty"` // unix nanoseconds, 0 when not known
+	UpdatedAt int64  `json:",omitempty"` // unix nanoseconds of the last Put, 0 when not known
+
+	Labels map[string]string `json:",omitempty"` // see PutWithLabels
+}
+
+// Less implements the btree.Item interface for *Item
+func (i *Item) Less(than btree.Item) bool {
+	return i.Key < than.(*Item).Key
 }
 
-type item struct {
-	Key   string
-	Value []byte
+// withDefaults checks the options and returns a copy with the sizes left at 0
+// set to their defaults
+func (o Options) withDefaults() (Options, error) {
+	switch {
+	case o.CacheSize < 0:
+		return o, fmt.Errorf("%w: cache size must not be negative, got %d", ErrInvalidOption, o.CacheSize)
+	case o.Degree < 0 || o.Degree == 1:
+		return o, fmt.Errorf("%w: degree must be at least 2, got %d", ErrInvalidOption, o.Degree)
+	case o.MaxKeyLen < 0 || o.MaxKeyLen > MaxKeyLen:
+		return o, fmt.Errorf("%w: max key length must be between 1 and %d, got %d", ErrInvalidOption, MaxKeyLen, o.MaxKeyLen)
+	case o.MaxKeys < 0:
+		return o, fmt.Errorf("%w: max keys must not be negative, got %d", ErrInvalidOption, o.MaxKeys)
+	case o.MaxValueSize < 0:
+		return o, fmt.Errorf("%w: max value size must not be negative, got %d", ErrInvalidOption, o.MaxValueSize)
+	case o.ChangeLogSize < 0:
+		return o, fmt.Errorf("%w: change log size must not be negative, got %d", ErrInvalidOption, o.ChangeLogSize)
+	case o.OplogSize < 0:
+		return o, fmt.Errorf("%w: oplog size must not be negative, got %d", ErrInvalidOption, o.OplogSize)
+	case o.OplogMaxAge < 0:
+		return o, fmt.Errorf("%w: oplog max age must not be negative, got %s", ErrInvalidOption, o.OplogMaxAge)
+	case o.SnapshotEvery < 0:
+		return o, fmt.Errorf("%w: snapshot interval must not be negative, got %s", ErrInvalidOption, o.SnapshotEvery)
+	case o.SweepEvery < 0:
+		return o, fmt.Errorf("%w: sweep interval must not be negative, got %s", ErrInvalidOption, o.SweepEvery)
+	case o.SweepBatch < 0:
+		return o, fmt.Errorf("%w: sweep batch must not be negative, got %d", ErrInvalidOption, o.SweepBatch)
+	case o.SweepRate < 0:
+		return o, fmt.Errorf("%w: sweep rate must not be negative, got %d", ErrInvalidOption, o.SweepRate)
+	case o.CompactRate < 0:
+		return o, fmt.Errorf("%w: compact rate must not be negative, got %d", ErrInvalidOption, o.CompactRate)
+	case o.CompactBytesRate < 0:
+		return o, fmt.Errorf("%w: compact bytes rate must not be negative, got %d", ErrInvalidOption, o.CompactBytesRate)
+	case o.CompactWindow != nil && !o.CompactWindow.valid():
+		return o, fmt.Errorf("%w: compaction window must start and end at different times of day, got %s to %s", ErrInvalidOption, o.CompactWindow.Start, o.CompactWindow.End)
+	case o.LoaderTTL < 0 && o.LoaderTTL != NoTTL:
+		return o, fmt.Errorf("%w: loader TTL must not be negative, got %s", ErrInvalidOption, o.LoaderTTL)
+	case o.CorruptLimit < 0:
+		return o, fmt.Errorf("%w: corrupt limit must not be negative, got %d", ErrInvalidOption, o.CorruptLimit)
+	case o.MirrorQueue < 0:
+		return o, fmt.Errorf("%w: mirror queue must not be negative, got %d", ErrInvalidOption, o.MirrorQueue)
+	case o.DefaultTTL < 0:
+		return o, fmt.Errorf("%w: default TTL must not be negative, got %s", ErrInvalidOption, o.DefaultTTL)
+	case o.WriteBack < 0:
+		return o, fmt.Errorf("%w: write-back window must not be negative, got %s", ErrInvalidOption, o.WriteBack)
+	case o.SlowOpThreshold < 0:
+		return o, fmt.Errorf("%w: slow op threshold must not be negative, got %s", ErrInvalidOption, o.SlowOpThreshold)
+	case o.MinFreeSpace < 0:
+		return o, fmt.Errorf("%w: min free space must not be negative, got %d", ErrInvalidOption, o.MinFreeSpace)
+	case o.SpaceCheckEvery < 0:
+		return o, fmt.Errorf("%w: space check interval must not be negative, got %s", ErrInvalidOption, o.SpaceCheckEvery)
+	case o.DedupThreshold < 0:
+		return o, fmt.Errorf("%w: dedup threshold must not be negative, got %d", ErrInvalidOption, o.DedupThreshold)
+	case o.DemoteAfter < 0:
+		return o, fmt.Errorf("%w: demote after must not be negative, got %s", ErrInvalidOption, o.DemoteAfter)
+	case o.ColdDir == "" && (o.DemoteAfter > 0 || o.PromoteOnRead):
+		return o, fmt.Errorf("%w: demoting and promoting keys need a cold dir", ErrInvalidOption)
+	case o.DedupThreshold > 0 && !hardLinks:
+		return o, fmt.Errorf("%w: deduplication needs hard links, which this platform lacks", ErrInvalidOption)
+	}
+	for i, shard := range o.ShardDirs {
+		if shard == "" {
+			return o, fmt.Errorf("%w: shard dir %d is empty", ErrInvalidOption, i)
+		}
+	}
+	for _, rule := range o.SnapshotArchive {
+		if rule.Every < time.Second || rule.Keep <= 0 {
+			return o, fmt.Errorf("%w: snapshot retention must archive at least a second apart and keep for longer than 0, got every %s for %s", ErrInvalidOption, rule.Every, rule.Keep)
+		}
+	}
+
+	if o.CacheSize == 0 {
+		o.CacheSize = DefaultCacheSize
+	}
+	if o.Degree == 0 {
+		o.Degree = DefaultDegree
+	}
+	if o.MaxKeyLen == 0 {
+		o.MaxKeyLen = MaxKeyLen
+	}
+	if o.SnapshotCodec == nil {
+		o.SnapshotCodec = JSONCodec{}
+	}
+	if o.SweepBatch == 0 {
+		o.SweepBatch = defaultSweepBatch
+	}
+	if o.SpaceCheckEvery == 0 {
+		o.SpaceCheckEvery = defaultSpaceCheckEvery
+	}
+	return o, nil
 }
 
-// Less implements the btree.Item interface for *item
-func (i *item) Less(than btree.Item) bool {
-	return i.Key < than.(*item).Key
+// New creates a new Driver instance. Keys are spread across dir and any
+// shardDirs given. A cacheSize or degree of 0 uses DefaultCacheSize or
+// DefaultDegree.
+func New(dir string, logger Logger, cacheSize int, degree int, shardDirs ...string) (*Driver, error) {
+	return Open(dir, &Options{Logger: logger, CacheSize: cacheSize, Degree: degree, ShardDirs: shardDirs})
 }
 
-// New creates a new Driver instance
-func New(dir string, logger Logger, cacheSize int, degree int) (*Driver, error) {
+// Open creates a new Driver instance configured by opts. Options out of range
+// fail with ErrInvalidOption before anything is created on disk. The data
+// directory is locked until Close; Open fails with ErrLocked while another
+// process has it open. The B-tree is loaded from the snapshot Close last
+// saved, if there is one. A directory that MigrateLayout has not finished
+// with fails with ErrMigrationIncomplete. What Open found is logged and kept
+// in the StartupReport.
+func Open(dir string, opts *Options) (*Driver, error) {
+	start := time.Now()
+	if opts == nil {
+		opts = &Options{}
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("%w: data directory is required", ErrInvalidOption)
+	}
+	checked, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	opts = &checked
+	logger := opts.Logger
 	dir = filepath.Clean(dir)
 
 	// Initialize logger if not provided
@@ -62,132 +519,708 @@ func New(dir string, logger Logger, cacheSize int, degree int) (*Driver, error)
 		logger.Info("Using '%s' (database already exists)\n", dir)
 	}
 
-	// Initialize the cache with an eviction callback
-	cache, err := lru.NewWithEvict(cacheSize, func(key interface{}, value interface{}) {
-		logger.Info("Evicted key: %v", key)
-	})
+	// Only one process may use a data directory at a time
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	opened := false
+	defer func() {
+		if !opened {
+			lock.release()
+		}
+	}()
+	if err := checkLayout(dir, opts.EncodeFileNames); err != nil {
+		return nil, err
+	}
+
+	shards := []string{dir}
+	for _, shard := range opts.ShardDirs {
+		shard = filepath.Clean(shard)
+		if slices.Contains(shards, shard) {
+			continue
+		}
+		if err := os.MkdirAll(shard, 0755); err != nil {
+			return nil, err
+		}
+		shards = append(shards, shard)
+	}
+	dirs := shards
+	if opts.ColdDir != "" {
+		cold := filepath.Clean(opts.ColdDir)
+		if slices.Contains(shards, cold) {
+			return nil, fmt.Errorf("%w: the cold dir %s is also a data directory", ErrInvalidOption, cold)
+		}
+		if err := os.MkdirAll(cold, 0755); err != nil {
+			return nil, err
+		}
+		dirs = append(slices.Clip(shards), cold)
+	}
+
+	cache, err := newValueCache(opts.CacheSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LRU cache: %v", err)
 	}
 
 	// Create the Driver with the initialized cache
 	driver := &Driver{
-		dir:   dir,
-		log:   logger,
-		cache: cache,
-		tree:  btree.New(degree),
+		dir:      dir,
+		shards:   shards,
+		ring:     newHashRing(shards),
+		log:      logger,
+		cache:    cache,
+		tree:     btree.New(opts.Degree),
+		expiries: btree.New(opts.Degree),
+		degree:   opts.Degree,
+		maxValue: opts.MaxValueSize,
+		maxKey:   opts.MaxKeyLen,
+		maxKeys:  opts.MaxKeys,
+		changes:  newChangeLog(opts.ChangeLogSize),
+		slowOp:   opts.SlowOpThreshold,
+		slowOps:  make(map[string]uint64),
+		dirLock:  lock,
+		stop:     make(chan struct{}),
+		codec:    opts.SnapshotCodec,
+		encoded:  opts.EncodeFileNames,
+	}
+	if opts.TracerProvider != nil {
+		driver.tracer = opts.TracerProvider.Tracer(tracerName)
+	}
+	driver.schemaAdvisory = opts.SchemaAdvisory
+	driver.defaultTTL = opts.DefaultTTL
+	driver.loader, driver.loaderTTL = opts.Loader, opts.LoaderTTL
+	if opts.Mirror != nil {
+		driver.mirror = &mirror{to: opts.Mirror, sync: opts.MirrorSync}
+		if !opts.MirrorSync {
+			size := opts.MirrorQueue
+			if size == 0 {
+				size = defaultMirrorQueue
+			}
+			driver.mirror.queue = make(chan mirrorOp, size)
+		}
+	}
+	driver.dirs, driver.demoteAfter = dirs, opts.DemoteAfter
+	if opts.ColdDir != "" {
+		driver.cold = dirs[len(dirs)-1]
+		driver.accessed = make(map[string]int64)
+		driver.opened = time.Now().UnixNano()
+	}
+	if opts.PromoteOnRead {
+		driver.promotions = make(chan string, promotionQueue)
+	}
+	driver.dedup = opts.DedupThreshold
+	driver.compactRate = opts.CompactRate
+	driver.compactBytesRate, driver.compactWindow = opts.CompactBytesRate, opts.CompactWindow
+	driver.minFree, driver.diskUsage = opts.MinFreeSpace, diskUsage
+	driver.txns = make(map[*ReadTxn]struct{})
+	if err := driver.loadSchemas(); err != nil {
+		return nil, err
+	}
+	if opts.WriteBack > 0 {
+		driver.writeBack = opts.WriteBack
+		driver.dirty = make(map[string]dirtyValue)
+		cache.onEvict = driver.evicted
+	}
+
+	// Sequence numbers carry on from the operation log, if there is one
+	if opts.OplogSize > 0 || opts.OplogMaxAge > 0 {
+		driver.oplog, driver.changes.seq, err = openOplog(filepath.Join(dir, oplogDir), opts.OplogSize, opts.OplogMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the oplog: %v", err)
+		}
+		driver.oplog.keepValues = opts.OplogValues
+		driver.oplog.failpoint = driver.failpoint
+	}
+
+	if err := driver.loadSnapshot(opts.SnapshotPath); err != nil {
+		return nil, err
+	}
+	if !opts.SkipReconcile {
+		if err := driver.reconcile(); err != nil {
+			return nil, err
+		}
+	}
+	if err := driver.loadRevisions(); err != nil {
+		return nil, err
+	}
+	if err := driver.loadQuotas(); err != nil {
+		return nil, err
+	}
+	if err := driver.loadCompaction(); err != nil {
+		return nil, err
+	}
+	if err := driver.checkStartup(opts, start); err != nil {
+		return nil, err
+	}
+	if opts.SnapshotEvery > 0 {
+		driver.background.Add(1)
+		go driver.snapshotLoop(opts.SnapshotEvery)
+	}
+	if len(opts.SnapshotArchive) > 0 {
+		driver.archive = opts.SnapshotArchive
+		driver.background.Add(1)
+		go driver.archiveLoop(archiveInterval(opts.SnapshotArchive))
+	}
+	if opts.WriteBack > 0 {
+		driver.background.Add(1)
+		go driver.flushLoop(opts.WriteBack)
+	}
+	if opts.SweepEvery > 0 {
+		driver.background.Add(1)
+		go driver.sweepLoop(opts.SweepEvery, opts.SweepBatch, opts.SweepRate)
+	}
+	if opts.DemoteAfter > 0 {
+		driver.background.Add(1)
+		go driver.demoteLoop(demoteInterval(opts.DemoteAfter))
+	}
+	if opts.PromoteOnRead {
+		driver.background.Add(1)
+		go driver.promoteLoop()
 	}
+	if opts.CompactWindow != nil {
+		driver.background.Add(1)
+		go driver.compactLoop()
+	}
+	if driver.mirror != nil && !opts.MirrorSync {
+		driver.background.Add(1)
+		go driver.mirrorLoop()
+	}
+	driver.checkSpace()
+	driver.background.Add(1)
+	go driver.spaceLoop(opts.SpaceCheckEvery)
 
+	opened = true
 	return driver, nil
 }
 
+// Put stores the value for a key
 func (d *Driver) Put(key string, value []byte) error {
-	if key == "" {
-		return fmt.Errorf("key is required")
+	_, err := d.Upsert(key, value)
+	return err
+}
+
+// PutContext is Put as part of the trace in ctx. The context does not cancel
+// the write.
+func (d *Driver) PutContext(ctx context.Context, key string, value []byte) error {
+	_, err := d.putWithTTL(ctx, key, value, 0)
+	return err
+}
+
+// Upsert stores the value for a key and reports whether the key was created
+// (true) or an existing value was replaced (false)
+func (d *Driver) Upsert(key string, value []byte) (bool, error) {
+	return d.PutWithTTL(key, value, 0)
+}
+
+// PutWithTTL stores the value for a key that expires after ttl and reports
+// whether the key was created. A ttl of 0 gives the key Options.DefaultTTL,
+// which is no expiry unless set, and NoTTL stores it without an expiry.
+func (d *Driver) PutWithTTL(key string, value []byte, ttl time.Duration) (bool, error) {
+	return d.putWithTTL(context.Background(), key, value, ttl)
+}
+
+func (d *Driver) putWithTTL(ctx context.Context, key string, value []byte, ttl time.Duration) (_ bool, err error) {
+	defer d.ops.done(&d.ops.puts, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return false, err
+	}
+	if err := d.writable(); err != nil {
+		return false, err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return false, err
+	}
+	if err := d.checkSchema(key, value); err != nil {
+		return false, err
+	}
+	expiresAt, err := d.writeExpiry(ttl)
+	if err != nil {
+		return false, err
 	}
 
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	t := d.startOp(ctx, "put", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	return d.putLocked(key, value, expiresAt, t)
+}
+
+// Create stores the value for a key that must not exist yet, failing with
+// ErrKeyExists otherwise. Expired keys count as absent.
+func (d *Driver) Create(key string, value []byte) (err error) {
+	defer d.ops.done(&d.ops.puts, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	if err := d.checkSchema(key, value); err != nil {
+		return err
+	}
+
+	t := d.startOp(context.Background(), "create", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	exists, err := d.existsLocked(key)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("%w: %s", ErrKeyExists, key)
+	}
+	expiresAt, _ := d.writeExpiry(0)
+	_, err = d.putLocked(key, value, expiresAt, t)
+	return err
+}
+
+// checkSize returns ErrValueTooLarge for a value of size bytes over the limit
+func (d *Driver) checkSize(key string, size int64) error {
+	if d.maxValue > 0 && size > d.maxValue {
+		return fmt.Errorf("%w: %s is %d bytes, at most %d allowed", ErrValueTooLarge, key, size, d.maxValue)
+	}
+	return nil
+}
+
+// putLocked writes a value with the write lock held, timing the disk I/O
+// against t
+func (d *Driver) putLocked(key string, value []byte, expiresAt int64, t *opTimer) (bool, error) {
+	start := time.Now()
+	if err := d.checkOpen(); err != nil {
+		return false, err
+	}
+
+	// A nil value in the tree means "not resident", so never store one
+	if value == nil {
+		value = []byte{}
+	}
+
+	// Expired keys are treated as absent
+	existingItem, ok := d.tree.Get(&Item{Key: key}).(*Item)
+	expired := ok && existingItem.expired(time.Now())
+	ok = ok && !expired
 
 	// Check if the value is different before replacing in the tree or writing to disk
-	existingItem, ok := d.tree.Get(&item{Key: key}).(*item)
-	if ok && bytes.Equal(existingItem.Value, value) {
-		// The key exists and the value is the same, so there's nothing to do.
-		return nil
+	if ok && existingItem.Value != nil && bytes.Equal(existingItem.Value, value) {
+		// The key exists and the value is the same, so at most the expiry changes
+		if existingItem.ExpiresAt != expiresAt {
+			rev, err := d.nextRev()
+			if err != nil {
+				return false, err
+			}
+			d.tree.ReplaceOrInsert(&Item{Key: key, Value: value, ExpiresAt: expiresAt, Hash: existingItem.Hash, Dir: existingItem.Dir, Rev: rev,
+				CreatedAt: existingItem.CreatedAt, UpdatedAt: time.Now().UnixNano(), Labels: existingItem.Labels})
+			d.indexExpiry(key, existingItem.ExpiresAt, expiresAt)
+			d.record(OpPut, key, value, existingItem.Hash, expiresAt)
+			return false, d.mirrorLocked(OpPut, key, value, expiresAt)
+		}
+		return false, nil
 	}
 
+	dir, stale := d.writeDir(key)
+	filePath := filepath.Join(dir, d.fileName(key))
+
+	// The key may exist on disk without having been loaded into the tree yet
+	ioStart := t.ioStart()
+	defer t.ioDone(ioStart)
+	t.addSize(int64(len(value)))
+
+	created := !ok
+	if created && !expired {
+		if _, err := os.Stat(filePath); err == nil || stale != "" {
+			created = false
+		}
+	}
+
+	usage, err := d.usageChange(key, int64(len(value)))
+	if err != nil {
+		return false, err
+	}
+	if err := d.checkQuota(key, usage); err != nil {
+		return false, err
+	}
+	if existingItem == nil {
+		if err := d.checkKeyCount(key, 1); err != nil {
+			return false, err
+		}
+	}
+	rev, err := d.nextRev()
+	if err != nil {
+		return false, err
+	}
+
+	// Write the value to disk, as it has changed or is new. Memory is only
+	// updated once it is there, so a failed write leaves the old value. In
+	// write-back mode the flusher writes it later.
+	d.retain(key)
+	if d.writeBack > 0 {
+		d.markDirty(key, value)
+	} else if err := d.writeValue(filePath, value); err != nil {
+		return false, err
+	} else if err := d.failpoint(fpRenamed); err != nil {
+		return false, err
+	}
+	d.ops.bytesWritten.Add(uint64(len(value)))
+	d.removeStale(stale)
+
 	// Update the cache with the new value (cache Add is thread-safe already so we don't need to lock around it)
 	d.cache.Add(key, value)
 
 	// Replace or insert the new item into the B-tree
-	d.tree.ReplaceOrInsert(&item{Key: key, Value: value})
+	hash := hashValue(value)
+	item := &Item{Key: key, Value: value, ExpiresAt: expiresAt, Hash: hash, Dir: dir, Rev: rev}
+	item.stamp(existingItem, ok, created)
+	d.tree.ReplaceOrInsert(item)
+	if expired {
+		d.unindexLabels(existingItem)
+	}
+	d.indexExpiry(key, expiryOf(existingItem), expiresAt)
+	d.applyUsage(usage)
+	if existingItem != nil && existingItem.Hash != hash {
+		d.releaseBlob(existingItem.Hash)
+	}
+
+	if expired {
+		d.reportExpired(existingItem)
+	}
+	d.record(OpPut, key, value, hash, expiresAt)
+	d.notify(OpPut, key, value, expiresAt)
+	d.logOp(LevelInfo, "put", key, start, "Put key: %s", key)
+	return created, d.mirrorLocked(OpPut, key, value, expiresAt)
+}
 
-	// Write the value to disk, as it has changed or is new
-	filePath := filepath.Join(d.dir, key)
+// writeFile writes a value to filePath through a temp file, so that the file
+// holds either the old value or the new one in full
+func (d *Driver) writeFile(filePath string, value []byte) error {
 	tempPath := filePath + ".tmp"
-	if err := os.WriteFile(tempPath, value, 0644); err != nil {
+	err := os.WriteFile(tempPath, value, 0644)
+	if err == nil {
+		err = d.failpoint(fpTempWritten)
+	}
+	if err != nil {
 		d.log.Error("Failed to write to temp file: %v", err)
-		return err
+		os.Remove(tempPath)
+		return d.noteWriteError(err)
 	}
 
-	if err := os.Rename(tempPath, filePath); err != nil {
+	err = d.failpoint(fpBeforeRename)
+	if err == nil {
+		err = replaceFile(tempPath, filePath)
+	}
+	if err != nil {
 		d.log.Error("Failed to rename temp file: %v", err)
+		os.Remove(tempPath)
 		return err
 	}
-
-	d.log.Info("Put key: %s", key)
 	return nil
 }
 
 // Get retrieves the value for a key
 func (d *Driver) Get(key string) ([]byte, error) {
+	return d.GetContext(context.Background(), key)
+}
 
-	if key == "" {
-		return nil, fmt.Errorf("key is required")
+// GetContext is Get as part of the trace in ctx. A key that is missing is
+// fetched with Options.Loader, if set, unless ctx comes from SkipLoader.
+func (d *Driver) GetContext(ctx context.Context, key string) (_ []byte, err error) {
+	defer d.ops.done(&d.ops.gets, 1, &err)
+	value, err := d.get(ctx, key)
+	if errors.Is(err, ErrKeyNotFound) && d.loader != nil && ctx.Value(skipLoaderKey{}) == nil {
+		return d.load(ctx, key)
 	}
+	return value, err
+}
 
-	d.mutex.RLock() // Use read lock to allow concurrent reads
-	defer d.mutex.RUnlock()
+// get looks key up in memory and then on disk
+func (d *Driver) get(ctx context.Context, key string) (_ []byte, err error) {
+	start := time.Now()
 
-	if value, ok := d.cache.Get(key); ok {
-		d.log.Info("Get key (cache hit): %s", key)
-		return value.([]byte), nil
+	if err := d.checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := d.checkOpen(); err != nil {
+		return nil, err
 	}
 
-	if item, ok := d.tree.Get(&item{Key: key}).(*item); ok {
-		d.cache.Add(key, item.Value) // Cache the value
-		d.log.Info("Get key (B-tree hit): %s", key)
-		return item.Value, nil
+	t := d.startOp(ctx, "get", key)
+	defer d.finishOp(t)
+
+	// Use read lock to allow concurrent reads, released even if the lookup
+	// panics so that a recovered panic does not leave the driver locked
+	value, ok, err := func() ([]byte, bool, error) {
+		d.rlock(t)
+		defer d.mutex.RUnlock()
+		value, ok, err := d.lookup(key)
+		if ok {
+			d.touch(key)
+		}
+		return value, ok, err
+	}()
+	if ok || err != nil {
+		t.addSize(int64(len(value)))
+		d.ops.bytesRead.Add(uint64(len(value)))
+		return value, err
+	}
+
+	// Loading from disk inserts into the B-tree, which needs the write lock
+	d.lock(t)
+	defer d.mutex.Unlock()
+
+	// Another caller may have loaded the key while we waited for the lock
+	if value, ok, err := d.lookup(key); ok || err != nil {
+		if ok {
+			d.touch(key)
+		}
+		d.ops.bytesRead.Add(uint64(len(value)))
+		return value, err
 	}
 
 	// If not in cache or B-tree, read from disk
-	filePath := filepath.Join(d.dir, key)
-	value, err := os.ReadFile(filePath)
+	ioStart := t.ioStart()
+	dir := d.shardFor(key)
+	filePath := filepath.Join(dir, d.fileName(key))
+	value, err = os.ReadFile(filePath)
+	t.ioDone(ioStart)
+	t.addSize(int64(len(value)))
 	if err != nil {
 		if os.IsNotExist(err) {
-			d.log.Debug("Get key not found: %s", key)
-			return nil, fmt.Errorf("key not found")
+			d.logOp(LevelDebug, "get", key, start, "Get key not found: %s", key)
+			return nil, ErrKeyNotFound
 		}
 		d.log.Error("Failed to read file: %v", err)
 		return nil, err
 	}
 
+	d.ops.readDisk(int64(len(value)))
+
+	// Keep the expiry, revision and times of a non-resident item loaded
+	// from disk
+	item := &Item{Key: key}
+	if existing, ok := d.tree.Get(&Item{Key: key}).(*Item); ok {
+		*item = *existing
+	} else if item.Rev, err = d.nextRev(); err != nil {
+		return nil, err
+	}
+	item.Value, item.Hash, item.Dir = value, hashValue(value), dir
+
 	// Add the read value to the cache and B-tree
 	d.cache.Add(key, value)
-	d.tree.ReplaceOrInsert(&item{Key: key, Value: value})
-	d.log.Info("Get key: %s", key)
+	d.tree.ReplaceOrInsert(item)
+	d.touch(key)
+	d.logOp(LevelInfo, "get", key, start, "Get key: %s", key)
 
 	return value, nil
 }
 
+// Has reports whether a key exists without reading its value
+func (d *Driver) Has(key string) (bool, error) {
+	if err := d.checkKey(key); err != nil {
+		return false, err
+	}
+	if err := d.checkOpen(); err != nil {
+		return false, err
+	}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.existsLocked(key)
+}
+
+// existsLocked reports whether a key exists. The caller must hold the mutex.
+func (d *Driver) existsLocked(key string) (bool, error) {
+	if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok {
+		return !it.expired(time.Now()), nil
+	}
+
+	if _, err := os.Stat(d.keyPath(key)); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		d.log.Error("Failed to stat file: %v", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// markInternal records that a file the driver manages lives in the data
+// directory, so that it is never mistaken for a key
+func (d *Driver) markInternal(path string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	dir, err := filepath.Abs(d.dir)
+	if err != nil {
+		return
+	}
+	if filepath.Dir(abs) == dir {
+		d.internal.Store(filepath.Base(abs), struct{}{})
+	}
+}
+
+// isInternalFile reports whether a file in the data directory holds driver
+// state rather than a key: temp files, dotfiles, snapshots and the lock file
+func (d *Driver) isInternalFile(name string) bool {
+	if strings.HasPrefix(name, ".") || filepath.Ext(name) == ".tmp" || name == lockFile {
+		return true
+	}
+	_, ok := d.internal.Load(name)
+	return ok
+}
+
+// lookup returns a value held in memory by the cache or the B-tree. When the
+// key is not in memory it returns false and a nil error, and the caller should
+// consult the disk. Expired keys return ErrKeyNotFound. The caller must hold
+// the mutex.
+func (d *Driver) lookup(key string) ([]byte, bool, error) {
+	it, inTree := d.tree.Get(&Item{Key: key}).(*Item)
+	if inTree && it.expired(time.Now()) {
+		d.logOp(LevelDebug, "get", key, time.Time{}, "Get key expired: %s", key)
+		return nil, false, ErrKeyNotFound
+	}
+
+	if value, ok := d.cache.Get(key); ok {
+		d.ops.cacheHits.Add(1)
+		d.logOp(LevelInfo, "get", key, time.Time{}, "Get key (cache hit): %s", key)
+		return value, true, nil
+	}
+
+	// Items written by PutReader are not resident and must be read from disk
+	if inTree && it.Value != nil {
+		d.cache.Add(key, it.Value) // Cache the value
+		d.ops.treeHits.Add(1)
+		d.logOp(LevelInfo, "get", key, time.Time{}, "Get key (B-tree hit): %s", key)
+		return it.Value, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// readLocked returns the value of a key and when it expires, with exists
+// false for a key that is missing or expired, reading the disk when the key
+// is not in memory. The caller must hold the mutex.
+func (d *Driver) readLocked(key string, t *opTimer) (_ []byte, expiresAt int64, exists bool, _ error) {
+	it, inTree := d.tree.Get(&Item{Key: key}).(*Item)
+	if inTree && it.expired(time.Now()) {
+		return nil, 0, false, nil
+	}
+	value, ok, err := d.lookup(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if !ok {
+		ioStart := t.ioStart()
+		value, err = os.ReadFile(d.keyPath(key))
+		t.ioDone(ioStart)
+		if os.IsNotExist(err) {
+			return nil, 0, false, nil
+		}
+		if err != nil {
+			d.log.Error("Failed to read file: %v", err)
+			return nil, 0, false, err
+		}
+	}
+	if inTree {
+		expiresAt = it.ExpiresAt
+	}
+	return value, expiresAt, true, nil
+}
+
 // Delete removes a key from the store
 func (d *Driver) Delete(key string) error {
+	return d.DeleteContext(context.Background(), key)
+}
 
-	if key == "" {
-		return fmt.Errorf("key is required")
+// DeleteContext is Delete as part of the trace in ctx, returning ctx's error
+// without deleting anything when it is done before the write lock is taken
+func (d *Driver) DeleteContext(ctx context.Context, key string) (err error) {
+	defer d.ops.done(&d.ops.deletes, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if err := d.deletable(); err != nil {
+		return err
 	}
+	return d.delete(ctx, key, nil)
+}
 
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// delete removes a key, if check, called under the write lock, returns nil
+// or is nil
+func (d *Driver) delete(ctx context.Context, key string, check func() error) error {
+	start := time.Now()
+	t := d.startOp(ctx, "delete", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return err
+		}
+	}
 
-	// First check if the key exists in the B-tree
-	if d.tree.Delete(&item{Key: key}) == nil {
-		d.log.Debug("Key not found in B-tree: %s", key)
-		return fmt.Errorf("key not found")
+	// Find the file and its size while the B-tree still records them
+	filePath := d.keyPath(key)
+	usage, err := d.usageChange(key, -1)
+	if err != nil {
+		return err
+	}
+
+	// A key may be on disk without having been loaded into the B-tree yet
+	removed := d.tree.Delete(&Item{Key: key})
+	if removed != nil {
+		d.indexExpiry(key, removed.(*Item).ExpiresAt, 0)
 	}
 
 	// Remove from cache if present
 	d.cache.Remove(key)
+	d.forgetDirty(key)
+	d.forgetAccess(key)
 
 	// Delete the file
-	filePath := filepath.Join(d.dir, key)
-	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) { // Check if the file exists before trying to delete
+	d.retain(key)
+	ioStart := t.ioStart()
+	err = os.Remove(filePath)
+	t.ioDone(ioStart)
+	if os.IsNotExist(err) && removed == nil {
+		d.logOp(LevelDebug, "delete", key, start, "Key not found: %s", key)
+		return ErrKeyNotFound
+	}
+	if err != nil && !os.IsNotExist(err) {
 		d.log.Error("Failed to delete key: %v", err)
 		return err
 	}
+	d.applyUsage(usage)
+	if removed != nil {
+		d.releaseBlob(removed.(*Item).Hash)
+		d.unindexLabels(removed.(*Item))
+	}
 
-	d.log.Info("Deleted key: %s", key)
-	return nil
+	// An expired key is cleaned up but reported as missing
+	if removed != nil && removed.(*Item).expired(time.Now()) {
+		d.reportExpired(removed.(*Item))
+		d.logOp(LevelDebug, "delete", key, start, "Deleted expired key: %s", key)
+		return ErrKeyNotFound
+	}
+
+	d.record(OpDelete, key, nil, "", 0)
+	d.notify(OpDelete, key, nil, 0)
+	d.logOp(LevelInfo, "delete", key, start, "Deleted key: %s", key)
+	return d.mirrorLocked(OpDelete, key, nil, 0)
 }
 
 // Marshal an interface into a JSON byte array
@@ -200,61 +1233,51 @@ func UnmarshalJson(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
-// Compact cleans up the directory, removing any temporary or corrupt files
-func (d *Driver) Compact() error {
+// SerializeBTree writes the B-tree to filePath. Close does this for the
+// driver's own snapshot, so it is only needed for a copy elsewhere.
+func (d *Driver) SerializeBTree(filePath string) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	// List all files in the directory
-	files, err := os.ReadDir(d.dir)
-	if err != nil {
-		d.log.Error("Failed to list directory for compaction: %v", err)
+	if err := d.serializeLocked(filePath); err != nil {
 		return err
 	}
-
-	// Iterate over all files and perform cleanup
-	for _, file := range files {
-		filePath := filepath.Join(d.dir, file.Name())
-
-		// Check for temporary files and remove them
-		if filepath.Ext(file.Name()) == ".tmp" {
-			if err := os.Remove(filePath); err != nil {
-				d.log.Error("Failed to remove temporary file during compaction: %v", err)
-				continue // Continue with the next file
-			}
-			d.log.Info("Removed temporary file during compaction: %s", file.Name())
-		}
+	if samePath(filePath, d.snapshotPath) {
+		d.snapshotSeq, d.snapshotStale = d.Seq(), false
 	}
-
 	return nil
 }
 
-func (d *Driver) SerializeBTree(filePath string) error {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+// serializeLocked writes the B-tree to filePath with the write lock held
+func (d *Driver) serializeLocked(filePath string) error {
+	d.markInternal(filePath)
 
-	var items []item
+	var items []Item
 	d.tree.Ascend(func(i btree.Item) bool {
-		items = append(items, *(i.(*item)))
+		items = append(items, *(i.(*Item)))
 		return true
 	})
 
-	d.log.Info("Items to serialize: %v", items)   // Log the items to be serialized
+	d.log.Debug("Items to serialize: %v", items)  // Log the items to be serialized
 	d.log.Info("B-tree length: %d", d.tree.Len()) // Log the length of the B-tree
 
-	data, err := json.Marshal(items)
-	if err != nil {
+	var data bytes.Buffer
+	if err := encodeSnapshot(&data, d.codec, items); err != nil {
 		d.log.Error("Error serializing B-tree: %v", err)
 		return err
 	}
 
 	tempFilePath := filePath + ".tmp"
-	if err := os.WriteFile(tempFilePath, data, 0644); err != nil {
+	err := os.WriteFile(tempFilePath, data.Bytes(), 0644)
+	if err == nil {
+		err = d.failpoint(fpSnapshotWritten)
+	}
+	if err != nil {
 		d.log.Error("Error writing serialized data to temp file: %v", err)
 		return err
 	}
 
-	if err := os.Rename(tempFilePath, filePath); err != nil {
+	if err := replaceFile(tempFilePath, filePath); err != nil {
 		d.log.Error("Error renaming temp file to final file: %v", err)
 		return err
 	}
@@ -263,29 +1286,66 @@ func (d *Driver) SerializeBTree(filePath string) error {
 	return nil
 }
 
+// DeserializeBTree replaces the B-tree with the one saved at filePath. Open
+// does this for the driver's own snapshot; the tree loaded from elsewhere is
+// saved there on Close. A missing file is not an error and leaves the tree as
+// it is.
 func (d *Driver) DeserializeBTree(filePath string) error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		d.log.Error("Error reading serialized B-tree file: %v", err)
-		return err
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		d.log.Info("No B-tree snapshot at %s, nothing to load", filePath)
+		return nil
 	}
-
-	var items []item
-	if err := json.Unmarshal(data, &items); err != nil {
-		d.log.Error("Error deserializing B-tree: %v", err)
+	if err := d.deserializeLocked(filePath); err != nil {
 		return err
 	}
+	if samePath(filePath, d.snapshotPath) {
+		d.snapshotSeq, d.snapshotStale = d.Seq(), false
+	} else {
+		d.snapshotStale = true
+	}
 
-	d.log.Info("Items deserialized: %v", items) // Log the items after deserialization
+	// Values may differ from those the revisions were handed out for, so
+	// every key gets a new one, which also makes the snapshot stale
+	_, err := d.renumber(true)
+	return err
+}
 
+// setItems replaces the B-tree with items and rebuilds the indexes kept
+// from it. The caller must hold the write lock.
+func (d *Driver) setItems(items []Item) {
 	d.tree.Clear(false)
 	for _, itm := range items {
 		itmCopy := itm // Create a copy of itm
 		d.tree.ReplaceOrInsert(&itmCopy)
 	}
+	d.indexExpiries()
+	d.rebuildLabels()
+}
+
+// deserializeLocked loads the B-tree from filePath with the write lock held
+func (d *Driver) deserializeLocked(filePath string) error {
+	d.markInternal(filePath)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		d.log.Error("Error reading serialized B-tree file: %v", err)
+		return err
+	}
+
+	items, err := decodeSnapshot(bytes.NewReader(data), d.codec)
+	if err != nil {
+		d.log.Error("Error deserializing B-tree: %v", err)
+		if errors.Is(err, errUnknownCodec) {
+			return err
+		}
+		return fmt.Errorf("%w %s: %w", errCorruptSnapshot, filePath, err)
+	}
+
+	d.log.Debug("Items deserialized: %v", items) // Log the items after deserialization
+	d.setItems(items)
 
 	d.log.Info("Successfully deserialized B-tree from %s", filePath)
 	d.log.Info("B-tree length after deserialization: %d", d.tree.Len()) // Log the length of the B-tree
@@ -1,14 +1,36 @@
 package db
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
 	"math/rand"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
+	"testing/quick"
 	"time"
 
 	"github.com/google/btree"
+	"github.com/jcelliott/lumber"
+	bolt "go.etcd.io/bbolt"
 )
 
 func setupDriver(t *testing.T) (*Driver, string) {
@@ -22,6 +44,7 @@ func setupDriver(t *testing.T) (*Driver, string) {
 		os.RemoveAll(dir) // Clean up
 		t.Fatalf("Failed to create driver: %s", err)
 	}
+	t.Cleanup(func() { driver.Close() })
 
 	return driver, dir
 }
@@ -33,7 +56,7 @@ func TestSerializeAndDeserializeBTree(t *testing.T) {
 	// Fill the tree with some key-value pairs.
 	for i := 0; i < 10; i++ {
 		key := fmt.Sprintf("%c", 'A'+i)
-		driver.tree.ReplaceOrInsert(&item{Key: key, Value: []byte{byte(i)}})
+		driver.tree.ReplaceOrInsert(&Item{Key: key, Value: []byte{byte(i)}})
 	}
 
 	// Serialize the tree to a temporary file
@@ -57,7 +80,7 @@ func TestSerializeAndDeserializeBTree(t *testing.T) {
 
 	// Verify the items are as expected
 	driver.tree.Ascend(func(i btree.Item) bool {
-		it := i.(*item)
+		it := i.(*Item)
 		if it.Value[0] != byte(it.Key[0]-'A') {
 			t.Errorf("Deserialized item does not match original. Got %v, want %v", it, string('A'+it.Value[0]))
 		}
@@ -93,7 +116,7 @@ func TestLargeTreeSerialization(t *testing.T) {
 	// Fill the tree with a larger number of key-value pairs
 	numItems := 1000
 	for i := 0; i < numItems; i++ {
-		driver.tree.ReplaceOrInsert(&item{Key: fmt.Sprintf("%d", i), Value: []byte{byte(i)}})
+		driver.tree.ReplaceOrInsert(&Item{Key: fmt.Sprintf("%d", i), Value: []byte{byte(i)}})
 	}
 
 	// Serialize and then deserialize
@@ -124,7 +147,9 @@ func TestConcurrentSerialization(t *testing.T) {
 			case <-stopCh:
 				return
 			default:
-				driver.tree.ReplaceOrInsert(&item{Key: fmt.Sprintf("%d", rand.Int()), Value: []byte{byte(rand.Intn(256))}})
+				driver.mutex.Lock()
+				driver.tree.ReplaceOrInsert(&Item{Key: fmt.Sprintf("%d", rand.Int()), Value: []byte{byte(rand.Intn(256))}})
+				driver.mutex.Unlock()
 			}
 		}
 	}()
@@ -156,7 +181,7 @@ func TestTreeIntegrityAfterSerialization(t *testing.T) {
 		key := fmt.Sprintf("%d", i)
 		value := byte(i)
 		expected[key] = value
-		driver.tree.ReplaceOrInsert(&item{Key: key, Value: []byte{value}})
+		driver.tree.ReplaceOrInsert(&Item{Key: key, Value: []byte{value}})
 	}
 
 	// Serialize and deserialize
@@ -172,10 +197,4854 @@ func TestTreeIntegrityAfterSerialization(t *testing.T) {
 
 	// Verify the integrity of the tree
 	for k, v := range expected {
-		searchItem := &item{Key: k}
-		found := driver.tree.Get(searchItem).(*item)
+		searchItem := &Item{Key: k}
+		found := driver.tree.Get(searchItem).(*Item)
 		if found == nil || found.Value[0] != v {
 			t.Errorf("item with key %s has incorrect value after deserialization. Got %v, want %v", k, found.Value[0], v)
 		}
 	}
 }
+
+func TestMissingKeyReturnsErrKeyNotFound(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := driver.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(missing) error = %v, want ErrKeyNotFound", err)
+	}
+
+	if err := driver.Delete("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Delete(missing) error = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestUpsertReportsCreated(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	created, err := driver.Upsert("a", []byte("1"))
+	if err != nil || !created {
+		t.Fatalf("Upsert(new key) = %v, %v, want true, nil", created, err)
+	}
+
+	created, err = driver.Upsert("a", []byte("2"))
+	if err != nil || created {
+		t.Errorf("Upsert(existing key) = %v, %v, want false, nil", created, err)
+	}
+
+	// The unchanged fast path is still an update
+	created, err = driver.Upsert("a", []byte("2"))
+	if err != nil || created {
+		t.Errorf("Upsert(unchanged value) = %v, %v, want false, nil", created, err)
+	}
+
+	// A key present on disk but not yet in the tree is not created again
+	if err := os.WriteFile(filepath.Join(dir, "b"), []byte("x"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+	created, err = driver.Upsert("b", []byte("y"))
+	if err != nil || created {
+		t.Errorf("Upsert(key on disk) = %v, %v, want false, nil", created, err)
+	}
+}
+
+func TestPutReaderAndGetReader(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	created, err := driver.PutReader("stream", strings.NewReader("streamed value"))
+	if err != nil || !created {
+		t.Fatalf("PutReader = %v, %v, want true, nil", created, err)
+	}
+	// with the mode Put gives files, not the owner-only one of a temp file
+	info, err := os.Stat(filepath.Join(dir, "stream"))
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0644 {
+		t.Errorf("streamed file mode = %v, want %v", mode, os.FileMode(0644))
+	}
+
+	// The streamed value is not resident, so Get has to load it from disk
+	value, err := driver.Get("stream")
+	if err != nil || string(value) != "streamed value" {
+		t.Errorf("Get(stream) = %q, %v, want %q", value, err, "streamed value")
+	}
+
+	r, err := driver.GetReader("stream")
+	if err != nil {
+		t.Fatalf("GetReader failed: %s", err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "streamed value" || r.Size() != int64(len(data)) {
+		t.Errorf("GetReader read %q (size %d), %v", data, r.Size(), err)
+	}
+
+	// A failing reader leaves the previous value in place
+	_, err = driver.PutReader("stream", io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("PutReader with failing reader error = %v, want io.ErrUnexpectedEOF", err)
+	}
+	if value, _ := driver.Get("stream"); string(value) != "streamed value" {
+		t.Errorf("Get(stream) after failed PutReader = %q, want %q", value, "streamed value")
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("2"))
+	if err := os.WriteFile(filepath.Join(dir, "c"), []byte("3"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	values, err := driver.GetBatch([]string{"a", "c", "missing", "b"})
+	if err != nil {
+		t.Fatalf("GetBatch failed: %s", err)
+	}
+
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	if len(values) != len(want) {
+		t.Errorf("GetBatch returned %d values, want %d", len(values), len(want))
+	}
+	for k, v := range want {
+		if string(values[k]) != v {
+			t.Errorf("GetBatch[%s] = %q, want %q", k, values[k], v)
+		}
+	}
+}
+
+func TestTTLExpiry(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := driver.PutWithTTL("short", []byte("v"), 50*time.Millisecond); err != nil {
+		t.Fatalf("PutWithTTL failed: %s", err)
+	}
+	if ttl, err := driver.TTL("short"); err != nil || ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Errorf("TTL(short) = %s, %v, want within (0, 50ms]", ttl, err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// The value is still cached, but expiry must win over the cache and disk
+	if _, err := driver.Get("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(short) after expiry error = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := driver.TTL("short"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("TTL(short) after expiry error = %v, want ErrKeyNotFound", err)
+	}
+
+	// Writing an expired key creates it again
+	if created, err := driver.Upsert("short", []byte("v")); err != nil || !created {
+		t.Errorf("Upsert(short) after expiry = %v, %v, want true, nil", created, err)
+	}
+	if ttl, _ := driver.TTL("short"); ttl != NoTTL {
+		t.Errorf("TTL(short) after plain Put = %s, want NoTTL", ttl)
+	}
+
+	if err := driver.Expire("missing", time.Second); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expire(missing) error = %v, want ErrKeyNotFound", err)
+	}
+	if err := driver.Expire("short", -time.Second); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("Expire with negative ttl error = %v, want ErrInvalidTTL", err)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("old", []byte("v"))
+	driver.Close()
+
+	driver, err = Open(dir, &Options{DefaultTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to reopen with a default TTL: %s", err)
+	}
+	defer driver.Close()
+
+	driver.Put("plain", []byte("v"))
+	driver.Create("created", []byte("v"))
+	driver.Incr("counter", 1)
+	driver.PutWithTTL("short", []byte("v"), time.Minute)
+	driver.PutWithTTL("kept", []byte("v"), NoTTL)
+	driver.PutBatch([]BatchEntry{{Key: "batched", Value: []byte("v")}})
+
+	tests := []struct {
+		key      string
+		min, max time.Duration
+	}{
+		{"plain", 59 * time.Minute, time.Hour},
+		{"created", 59 * time.Minute, time.Hour},
+		{"counter", 59 * time.Minute, time.Hour},
+		{"batched", 59 * time.Minute, time.Hour},
+		{"short", 59 * time.Second, time.Minute},
+		{"kept", NoTTL, NoTTL},
+		{"old", NoTTL, NoTTL}, // written before the option was set
+	}
+	for _, tt := range tests {
+		if ttl, err := driver.TTL(tt.key); err != nil || ttl < tt.min || ttl > tt.max {
+			t.Errorf("TTL(%s) = %s, %v, want within [%s, %s]", tt.key, ttl, err, tt.min, tt.max)
+		}
+	}
+	if stats := driver.Stats(); stats.Keys != 7 || stats.ExpiringKeys != 5 {
+		t.Errorf("Stats keys, expiring keys = %d, %d, want 7, 5", stats.Keys, stats.ExpiringKeys)
+	}
+
+	// Incrementing an existing counter keeps its expiry, and so none for old
+	driver.Put("old", []byte("1"))
+	driver.Expire("old", 0)
+	driver.Incr("old", 1)
+	if ttl, _ := driver.TTL("old"); ttl != NoTTL {
+		t.Errorf("TTL(old) after Incr = %s, want NoTTL", ttl)
+	}
+
+	if _, err := Open(t.TempDir(), &Options{DefaultTTL: -time.Second}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Open with a negative default TTL error = %v, want ErrInvalidOption", err)
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, &Options{MaxKeys: 3})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("2"))
+
+	if _, err := driver.PutBatch([]BatchEntry{{Key: "c", Value: []byte("3")}, {Key: "d", Value: []byte("4")}}); !errors.Is(err, ErrTooManyKeys) {
+		t.Errorf("PutBatch of 2 new keys with room for 1 = %v, want ErrTooManyKeys", err)
+	}
+	if err := driver.Put("c", []byte("3")); err != nil {
+		t.Fatalf("Put of the last key allowed failed: %s", err)
+	}
+	if err := driver.Put("d", []byte("4")); !errors.Is(err, ErrTooManyKeys) {
+		t.Errorf("Put over the limit = %v, want ErrTooManyKeys", err)
+	}
+	if _, err := driver.PutReader("d", strings.NewReader("4")); !errors.Is(err, ErrTooManyKeys) {
+		t.Errorf("PutReader over the limit = %v, want ErrTooManyKeys", err)
+	}
+	stats, _ := driver.Import(strings.NewReader(`{"key":"d","value":4}`), ImportOverwrite)
+	if stats.Failed != 1 || len(stats.Errors) != 1 || !strings.Contains(stats.Errors[0].Error, ErrTooManyKeys.Error()) {
+		t.Errorf("Import over the limit = %+v, want it to fail", stats)
+	}
+
+	// Existing keys can still be written
+	if err := driver.Put("a", []byte("one")); err != nil {
+		t.Errorf("overwrite at the limit failed: %s", err)
+	}
+	if _, err := driver.PutBatch([]BatchEntry{{Key: "b", Value: []byte("two")}}); err != nil {
+		t.Errorf("batch overwrite at the limit failed: %s", err)
+	}
+
+	// Deletes make room
+	driver.Delete("a")
+	if err := driver.Put("d", []byte("4")); err != nil {
+		t.Errorf("Put after a delete failed: %s", err)
+	}
+	if count, max := driver.KeyCount(); count != 3 || max != 3 {
+		t.Errorf("KeyCount() = %d, %d, want 3, 3", count, max)
+	}
+	driver.Close()
+
+	// The count is rebuilt on reopen
+	driver, err = Open(dir, &Options{MaxKeys: 3})
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	defer driver.Close()
+	if err := driver.Put("e", []byte("5")); !errors.Is(err, ErrTooManyKeys) {
+		t.Errorf("Put over the limit after reopening = %v, want ErrTooManyKeys", err)
+	}
+	if stats := driver.Stats(); stats.MaxKeys != 3 || stats.Index.Items != 3 {
+		t.Errorf("Stats max keys, items = %d, %d, want 3, 3", stats.MaxKeys, stats.Index.Items)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	w := driver.Watch("user:")
+	defer w.Close()
+
+	driver.Put("user:1", []byte("alice"))
+	driver.Put("order:1", []byte("ignored"))
+	driver.Delete("user:1")
+
+	want := []Event{{Op: OpPut, Key: "user:1", Value: []byte("alice")}, {Op: OpDelete, Key: "user:1"}}
+	for _, exp := range want {
+		select {
+		case ev := <-w.Events():
+			if ev.Op != exp.Op || ev.Key != exp.Key || string(ev.Value) != string(exp.Value) {
+				t.Errorf("event = %+v, want %+v", ev, exp)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %+v", exp)
+		}
+	}
+
+	// A watcher that is never drained is closed instead of blocking writers
+	slow := driver.Watch("")
+	for i := 0; i <= watchBuffer; i++ {
+		driver.Put("user:1", []byte(fmt.Sprint(i)))
+	}
+	if err := slow.Err(); !errors.Is(err, ErrWatchOverflow) {
+		t.Errorf("slow watcher Err() = %v, want ErrWatchOverflow", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("existing", []byte("old"))
+
+	input := strings.Join([]string{
+		`{"key":"doc","value":{"a":1}}`,
+		`{"key":"bin","value_base64":"/wA="}`,
+		`not json`,
+		`{"value":1}`,
+		`{"key":"existing","value":"new"}`,
+		`{"summary":{"count":4}}`,
+	}, "\n")
+
+	stats, err := driver.Import(strings.NewReader(input), ImportSkip)
+	if err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	if stats.Imported != 2 || stats.Skipped != 1 || stats.Failed != 2 || len(stats.Errors) != 2 {
+		t.Errorf("Import stats = %+v, want 2 imported, 1 skipped, 2 failed", stats)
+	}
+	if stats.Errors[0].Line != 3 {
+		t.Errorf("first error on line %d, want 3", stats.Errors[0].Line)
+	}
+
+	if v, _ := driver.Get("doc"); string(v) != `{"a":1}` {
+		t.Errorf("Get(doc) = %q", v)
+	}
+	if v, _ := driver.Get("bin"); string(v) != "\xff\x00" {
+		t.Errorf("Get(bin) = %q", v)
+	}
+	if v, _ := driver.Get("existing"); string(v) != "old" {
+		t.Errorf("Get(existing) = %q, want it kept in skip mode", v)
+	}
+
+	if _, err := driver.Import(strings.NewReader(`{"key":"existing","value":"new"}`), ImportOverwrite); err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	if v, _ := driver.Get("existing"); string(v) != `"new"` {
+		t.Errorf("Get(existing) = %q, want it overwritten", v)
+	}
+}
+
+func TestExport(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("user:2", []byte(`{"name":"bob"}`))
+	driver.Put("user:1", []byte("alice"))
+	driver.Put("order:1", []byte("x"))
+	driver.PutWithTTL("user:3", []byte("gone"), time.Nanosecond)
+	if err := driver.SerializeBTree(filepath.Join(dir, "btree.json")); err != nil {
+		t.Fatalf("SerializeBTree failed: %s", err)
+	}
+	os.WriteFile(filepath.Join(dir, "user:4.tmp"), []byte("partial"), 0644)
+
+	var buf strings.Builder
+	count, err := driver.Export(&buf, "user:")
+	if err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	if count != 2 {
+		t.Errorf("Export count = %d, want 2", count)
+	}
+
+	// Every record carries the times of its key, checked by TestKeyTimes
+	times := regexp.MustCompile(`,"created_at":"[^"]+","updated_at":"[^"]+"`)
+	if n := len(times.FindAllString(buf.String(), -1)); n != 2 {
+		t.Errorf("Export output has times for %d records, want 2:\n%s", n, buf.String())
+	}
+	want := `{"key":"user:1","value_base64":"YWxpY2U="}` + "\n" +
+		`{"key":"user:2","value":{"name":"bob"}}` + "\n" +
+		`{"summary":{"count":2}}` + "\n"
+	if got := times.ReplaceAllString(buf.String(), ""); got != want {
+		t.Errorf("Export output:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The whole database survives a round trip, skipping the snapshot file
+	buf.Reset()
+	driver.Export(&buf, "")
+	other, otherDir := setupDriver(t)
+	defer os.RemoveAll(otherDir)
+	stats, err := other.Import(strings.NewReader(buf.String()), ImportOverwrite)
+	if err != nil || stats.Imported != 3 || stats.Failed != 0 {
+		t.Errorf("Import of export = %+v, %v, want 3 imported", stats, err)
+	}
+}
+
+func TestStat(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("a", []byte("hello"))
+	info, err := driver.Stat("a")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if info.Size != 5 || info.ETag != hashValue([]byte("hello")) || info.TTL != NoTTL || !info.Cached {
+		t.Errorf("Stat(a) = %+v", info)
+	}
+
+	// Streamed and unloaded values get the same ETag as buffered ones
+	driver.PutReader("b", strings.NewReader("hello"))
+	os.WriteFile(filepath.Join(dir, "c"), []byte("hello"), 0644)
+	for _, key := range []string{"b", "c"} {
+		if info, err := driver.Stat(key); err != nil || info.ETag != hashValue([]byte("hello")) || info.Cached {
+			t.Errorf("Stat(%s) = %+v, %v", key, info, err)
+		}
+	}
+
+	if _, err := driver.Stat("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Stat(missing) error = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestCount(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	for _, key := range []string{"user:1", "user:2", "user:3", "userx", "order:1"} {
+		driver.Put(key, []byte("v"))
+	}
+	driver.PutWithTTL("user:4", []byte("v"), time.Nanosecond)
+
+	tests := map[string]int{"": 5, "user:": 3, "user": 4, "order:": 1, "zzz": 0}
+	for prefix, want := range tests {
+		if got, err := driver.Count(context.Background(), prefix); err != nil || got != want {
+			t.Errorf("Count(%q) = %d, %v, want %d", prefix, got, err, want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < ctxCheckEvery; i++ {
+		driver.tree.ReplaceOrInsert(&Item{Key: fmt.Sprintf("bulk:%d", i)})
+	}
+	if _, err := driver.Count(ctx, ""); !errors.Is(err, context.Canceled) {
+		t.Errorf("Count with canceled context error = %v, want context.Canceled", err)
+	}
+}
+
+func TestDeleteKeyOnlyOnDisk(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	// Written out of band, so the B-tree has never seen it
+	if err := os.WriteFile(filepath.Join(dir, "disk-only"), []byte("v"), 0644); err != nil {
+		t.Fatalf("Failed to write key file: %s", err)
+	}
+	if err := driver.Delete("disk-only"); err != nil {
+		t.Fatalf("Delete(disk-only) = %v, want nil", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "disk-only")); !os.IsNotExist(err) {
+		t.Errorf("key file still exists after Delete: %v", err)
+	}
+	if _, err := driver.Get("disk-only"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get after Delete = %v, want ErrKeyNotFound", err)
+	}
+	if err := driver.Delete("disk-only"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("second Delete = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestPutWriteFailureKeepsOldValue(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	if err := driver.Put("k", []byte("old")); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+
+	// Root ignores directory permissions, so block the temp file instead
+	if os.Geteuid() == 0 {
+		if err := os.Mkdir(filepath.Join(dir, "k.tmp"), 0755); err != nil {
+			t.Fatalf("Failed to block the temp file: %s", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "k.tmp", "x"), nil, 0644); err != nil {
+			t.Fatalf("Failed to block the temp file: %s", err)
+		}
+	} else {
+		if err := os.Chmod(dir, 0555); err != nil {
+			t.Fatalf("Failed to make the data dir read-only: %s", err)
+		}
+		defer os.Chmod(dir, 0755)
+	}
+
+	if err := driver.Put("k", []byte("new")); err == nil {
+		t.Fatalf("Put that could not be written succeeded")
+	}
+	if got, err := driver.Get("k"); err != nil || string(got) != "old" {
+		t.Errorf("Get after a failed Put = %q, %v, want old", got, err)
+	}
+}
+
+func TestMaxKeyLen(t *testing.T) {
+	// The longest key fits its temp file's name too
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+	longest := strings.Repeat("k", MaxKeyLen)
+	if err := driver.Put(longest, []byte("v")); err != nil {
+		t.Fatalf("Put of a %d byte key failed: %s", MaxKeyLen, err)
+	}
+	if _, err := driver.PutReader(longest, strings.NewReader("v")); err != nil {
+		t.Errorf("PutReader of a %d byte key failed: %s", MaxKeyLen, err)
+	}
+
+	if _, err := Open(t.TempDir(), &Options{MaxKeyLen: MaxKeyLen + 1}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Open with a key length over the limit = %v, want ErrInvalidOption", err)
+	}
+	short, err := Open(t.TempDir(), &Options{MaxKeyLen: 8})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer short.Close()
+	if err := short.Put("12345678", nil); err != nil {
+		t.Errorf("Put of a key at the limit failed: %s", err)
+	}
+	for _, op := range []func(string) error{
+		func(k string) error { return short.Put(k, nil) },
+		func(k string) error { _, err := short.Get(k); return err },
+		func(k string) error { return short.Delete(k) },
+	} {
+		if err := op("123456789"); !errors.Is(err, ErrInvalidKey) || !strings.Contains(err.Error(), "at most 8") {
+			t.Errorf("operation on a key over the limit = %v, want ErrInvalidKey naming the limit", err)
+		}
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	valid := []string{"a", "user:42", "a.b", "ünïcode", strings.Repeat("k", MaxKeyLen)}
+	for _, key := range valid {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("ValidateKey(%q) = %v, want nil", key, err)
+		}
+	}
+
+	invalid := []string{"", ".", "..", ".hidden", "a/b", `a\b`, "a b", "a\x00b", "a\nb", "x.tmp", "LOCK", "lock", "\xff", strings.Repeat("k", MaxKeyLen+1)}
+	for _, key := range invalid {
+		if err := ValidateKey(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("ValidateKey(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	// No operation reaches a file outside the data directory
+	outside := filepath.Join(filepath.Dir(dir), "outside")
+	os.WriteFile(outside, []byte("secret"), 0644)
+	defer os.Remove(outside)
+	traversals := []string{"../escape", "../outside", "..", outside, "/etc/passwd", `..\outside`, "a/../../outside"}
+	for _, key := range traversals {
+		if err := driver.Put(key, []byte("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := driver.PutReader(key, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("PutReader(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := driver.Get(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Get(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := driver.GetReader(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("GetReader(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := driver.Has(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Has(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := driver.Stat(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Stat(%q) = %v, want ErrInvalidKey", key, err)
+		}
+		if err := driver.Delete(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Delete(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if data, err := os.ReadFile(outside); err != nil || string(data) != "secret" {
+		t.Errorf("file outside the data directory = %q, %v, want it untouched", data, err)
+	}
+
+	// Keys with slashes are refused up front, not halfway through a write
+	if err := driver.Put("users/42/profile", []byte("x")); !errors.Is(err, ErrInvalidKey) || !strings.Contains(err.Error(), "'/'") {
+		t.Errorf("Put(users/42/profile) = %v, want ErrInvalidKey naming '/'", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users")); !os.IsNotExist(err) {
+		t.Errorf("Put(users/42/profile) created a directory: %v", err)
+	}
+
+	// Percent-encoding means nothing to the driver: the key is stored as is
+	if err := driver.Put("a%2F..%2Foutside", []byte("x")); err != nil {
+		t.Fatalf("Put(a%%2F..%%2Foutside) failed: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a%2F..%2Foutside")); err != nil {
+		t.Errorf("a%%2F..%%2Foutside not stored inside the data directory: %s", err)
+	}
+}
+
+func TestFileNameEncoding(t *testing.T) {
+	for _, key := range []string{"foo", "foo.json", "a-b_c.1", "Foo", "FOO", "a:b", "nul", "NUL", "com1.txt", "conin$", "trailing.", "naïve", "~tilde"} {
+		name := encodeFileName(key)
+		if got, ok := decodeFileName(name); !ok || got != key {
+			t.Errorf("decodeFileName(%q) = %q, %v, want %q", name, got, ok, key)
+		}
+		if portable := portableName(key); portable != (name == key) {
+			t.Errorf("encodeFileName(%q) = %q, but portableName is %v", key, name, portable)
+		}
+		if name != strings.ToLower(name) || strings.HasSuffix(name, ".") {
+			t.Errorf("encodeFileName(%q) = %q, which is not safe on every filesystem", key, name)
+		}
+	}
+	if encodeFileName("Foo") == encodeFileName("foo") {
+		t.Errorf("Foo and foo share the file name %q", encodeFileName("foo"))
+	}
+
+	// Names that encodeFileName never produces hold no key
+	for _, name := range []string{"Foo", "a:b", "~", "~" + nameEncoding.EncodeToString([]byte("foo")), "~ZZ", "~!"} {
+		if key, ok := decodeFileName(name); ok {
+			t.Errorf("decodeFileName(%q) = %q, want no key", name, key)
+		}
+	}
+
+	dir := t.TempDir()
+	driver, err := Open(dir, &Options{EncodeFileNames: true})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	// Keys need no file name of their own, so binary ones are fine too
+	for _, key := range []string{"foo", "Foo", "user:1", "NUL", "a b/c", "\xff\x00\x01"} {
+		if err := driver.Put(key, []byte(key)); err != nil {
+			t.Fatalf("Put(%q) failed: %s", key, err)
+		}
+	}
+	if err := driver.Put(strings.Repeat("A", MaxKeyLen), nil); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put of a key too long once encoded = %v, want ErrInvalidKey", err)
+	}
+	for _, key := range []string{"", ".hidden", "x.tmp", "lock"} {
+		if err := driver.Put(key, nil); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Put(%q) = %v, want ErrInvalidKey", key, err)
+		}
+	}
+	driver.Close()
+
+	// They survive the snapshot
+	driver, err = Open(dir, &Options{EncodeFileNames: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	if value, err := driver.Get("\xff\x00\x01"); err != nil || string(value) != "\xff\x00\x01" {
+		t.Errorf("Get of the binary key after reopening = %q, %v", value, err)
+	}
+	for _, name := range []string{"foo", encodeFileName("Foo"), encodeFileName("user:1"), encodeFileName("NUL")} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("file %s missing: %s", name, err)
+		}
+	}
+	driver.Close()
+
+	// Keys are read back from the file names when the tree is rebuilt
+	os.RemoveAll(filepath.Join(dir, metaDir))
+	driver, err = Open(dir, &Options{EncodeFileNames: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	defer driver.Close()
+	keys, _ := driver.List(context.Background(), "", "", 0)
+	if want := []string{"Foo", "NUL", "a b/c", "foo", "user:1", "\xff\x00\x01"}; strings.Join(keys, "|") != strings.Join(want, "|") {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+	for _, key := range keys {
+		if value, err := driver.Get(key); err != nil || string(value) != key {
+			t.Errorf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	for _, key := range []string{"user:1", "user:2", "user:3", "userx", "order:1"} {
+		driver.Put(key, []byte("v"))
+	}
+	driver.PutWithTTL("user:4", []byte("v"), time.Nanosecond)
+
+	tests := []struct {
+		prefix, after string
+		limit         int
+		want          string
+	}{
+		{"", "", 0, "order:1 user:1 user:2 user:3 userx"},
+		{"user:", "", 0, "user:1 user:2 user:3"},
+		{"user:", "", 2, "user:1 user:2"},
+		{"user:", "user:2", 2, "user:3"},
+		{"user", "user:3", 0, "userx"},
+		{"user:", "a", 0, "user:1 user:2 user:3"},
+		{"zzz", "", 0, ""},
+	}
+	for _, tt := range tests {
+		keys, err := driver.List(context.Background(), tt.prefix, tt.after, tt.limit)
+		if err != nil {
+			t.Fatalf("List(%q, %q, %d) failed: %s", tt.prefix, tt.after, tt.limit, err)
+		}
+		if got := strings.Join(keys, " "); got != tt.want {
+			t.Errorf("List(%q, %q, %d) = %q, want %q", tt.prefix, tt.after, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestListDesc(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	for _, key := range []string{"user:1", "user:2", "user:3", "userx", "order:1", "~~"} {
+		driver.Put(key, []byte("v"))
+	}
+	driver.PutWithTTL("user:0", []byte("v"), time.Nanosecond)
+
+	tests := []struct {
+		prefix, before string
+		limit          int
+		want           string
+	}{
+		{"", "", 0, "~~ userx user:3 user:2 user:1 order:1"},
+		{"user:", "", 0, "user:3 user:2 user:1"},
+		{"user:", "", 2, "user:3 user:2"},
+		{"user:", "user:2", 0, "user:1"},
+		{"user", "userx", 0, "user:3 user:2 user:1"},
+		{"user:", "zzz", 0, "user:3 user:2 user:1"},
+		{"user:", "a", 0, ""},
+		{"~", "", 0, "~~"},
+	}
+	for _, tt := range tests {
+		keys, err := driver.ListDesc(context.Background(), tt.prefix, tt.before, tt.limit)
+		if err != nil {
+			t.Fatalf("ListDesc(%q, %q, %d) failed: %s", tt.prefix, tt.before, tt.limit, err)
+		}
+		if got := strings.Join(keys, " "); got != tt.want {
+			t.Errorf("ListDesc(%q, %q, %d) = %q, want %q", tt.prefix, tt.before, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("b", []byte("old"))
+
+	created, err := driver.PutBatch([]BatchEntry{
+		{Key: "a", Value: []byte("1")},
+		{Key: "b", Value: []byte("2")},
+		{Key: "c", Value: []byte("3"), TTL: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("PutBatch failed: %s", err)
+	}
+	if fmt.Sprint(created) != "[true false true]" {
+		t.Errorf("created = %v, want [true false true]", created)
+	}
+	for key, want := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		if got, err := driver.Get(key); err != nil || string(got) != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+
+	// Nothing is written when any entry is invalid
+	_, err = driver.PutBatch([]BatchEntry{{Key: "d", Value: []byte("4")}, {Key: "", Value: []byte("5")}})
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("PutBatch with empty key error = %v, want ErrInvalidKey", err)
+	}
+	if ok, _ := driver.Has("d"); ok {
+		t.Errorf("PutBatch wrote d despite an invalid entry")
+	}
+}
+
+func TestIncr(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	if n, err := driver.Incr("counter", 1); err != nil || n != 1 {
+		t.Errorf("Incr new key = %d, %v, want 1", n, err)
+	}
+	if n, err := driver.Incr("counter", 41); err != nil || n != 42 {
+		t.Errorf("Incr = %d, %v, want 42", n, err)
+	}
+	if value, _ := driver.Get("counter"); string(value) != "42" {
+		t.Errorf("stored value = %q, want 42", value)
+	}
+
+	driver.PutWithTTL("ttl", []byte("5"), time.Hour)
+	driver.Incr("ttl", -1)
+	if ttl, err := driver.TTL("ttl"); err != nil || ttl == NoTTL {
+		t.Errorf("Incr dropped the expiry: TTL = %s, %v", ttl, err)
+	}
+
+	driver.Put("text", []byte("abc"))
+	if _, err := driver.Incr("text", 1); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("Incr on text error = %v, want ErrNotInteger", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			driver.Incr("concurrent", 1)
+		}()
+	}
+	wg.Wait()
+	if value, _ := driver.Get("concurrent"); string(value) != "50" {
+		t.Errorf("concurrent Incr = %q, want 50", value)
+	}
+}
+
+func TestListPushPop(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	if n, err := driver.ListPush("queue", []byte(`{"job": 1}`), false); err != nil || n != 1 {
+		t.Errorf("ListPush on a new key = %d, %v, want 1", n, err)
+	}
+	driver.ListPush("queue", []byte(`"two"`), false)
+	if n, _ := driver.ListPush("queue", []byte(`0`), true); n != 3 {
+		t.Errorf("ListPush to the front = %d, want 3", n)
+	}
+	if value, _ := driver.Get("queue"); string(value) != `[0,{"job":1},"two"]` {
+		t.Errorf("stored value = %s, want [0,{\"job\":1},\"two\"]", value)
+	}
+
+	if e, err := driver.ListPop("queue", true); err != nil || string(e) != "0" {
+		t.Errorf("ListPop from the front = %s, %v, want 0", e, err)
+	}
+	if e, err := driver.ListPop("queue", false); err != nil || string(e) != `"two"` {
+		t.Errorf("ListPop from the back = %s, %v, want \"two\"", e, err)
+	}
+	driver.ListPop("queue", false)
+	if _, err := driver.ListPop("queue", false); !errors.Is(err, ErrEmpty) {
+		t.Errorf("ListPop on an empty list = %v, want ErrEmpty", err)
+	}
+	if value, _ := driver.Get("queue"); string(value) != "[]" {
+		t.Errorf("value after popping everything = %s, want []", value)
+	}
+	if _, err := driver.ListPop("missing", false); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("ListPop on a missing key = %v, want ErrKeyNotFound", err)
+	}
+
+	driver.Put("object", []byte(`{"a": 1}`))
+	if _, err := driver.ListPush("object", []byte("1"), false); !errors.Is(err, ErrNotList) {
+		t.Errorf("ListPush on an object = %v, want ErrNotList", err)
+	}
+	driver.Put("null", []byte("null"))
+	if _, err := driver.ListPop("null", false); !errors.Is(err, ErrNotList) {
+		t.Errorf("ListPop on null = %v, want ErrNotList", err)
+	}
+	if _, err := driver.ListPush("queue", []byte("not json"), false); !errors.Is(err, ErrInvalidElement) {
+		t.Errorf("ListPush of text = %v, want ErrInvalidElement", err)
+	}
+
+	driver.PutWithTTL("ttl", []byte("[1]"), time.Hour)
+	driver.ListPush("ttl", []byte("2"), false)
+	if ttl, err := driver.TTL("ttl"); err != nil || ttl == NoTTL {
+		t.Errorf("ListPush dropped the expiry: TTL = %s, %v", ttl, err)
+	}
+
+	// Each pushed element is popped exactly once
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			driver.ListPush("work", []byte(strconv.Itoa(i)), false)
+		}(i)
+	}
+	wg.Wait()
+	popped := make(chan string, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if e, err := driver.ListPop("work", true); err == nil {
+				popped <- string(e)
+			}
+		}()
+	}
+	wg.Wait()
+	close(popped)
+	seen := make(map[string]bool)
+	for e := range popped {
+		seen[e] = true
+	}
+	if len(seen) != 50 {
+		t.Errorf("concurrent pops got %d distinct elements, want 50", len(seen))
+	}
+}
+
+func TestSetOps(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	for _, m := range []string{`"b"`, `{"id": 1}`, `"a"`} {
+		if added, err := driver.SetAdd("members", []byte(m)); err != nil || !added {
+			t.Errorf("SetAdd(%s) = %v, %v, want added", m, added, err)
+		}
+	}
+	if added, err := driver.SetAdd("members", []byte(`{ "id":1 }`)); err != nil || added {
+		t.Errorf("SetAdd of a member already there = %v, %v, want not added", added, err)
+	}
+	if value, _ := driver.Get("members"); string(value) != `["b",{"id":1},"a"]` {
+		t.Errorf("stored set = %s, want the members in the order added", value)
+	}
+	if ok, err := driver.SetContains("members", []byte(`"a"`)); err != nil || !ok {
+		t.Errorf("SetContains(a) = %v, %v, want true", ok, err)
+	}
+	if ok, _ := driver.SetContains("members", []byte(`"c"`)); ok {
+		t.Errorf("SetContains(c) = true, want false")
+	}
+	if ok, err := driver.SetContains("missing", []byte(`"a"`)); err != nil || ok {
+		t.Errorf("SetContains on a missing key = %v, %v, want false", ok, err)
+	}
+
+	if removed, err := driver.SetRemove("members", []byte(`{"id":1}`)); err != nil || !removed {
+		t.Errorf("SetRemove = %v, %v, want removed", removed, err)
+	}
+	if removed, _ := driver.SetRemove("members", []byte(`{"id":1}`)); removed {
+		t.Errorf("SetRemove twice = true, want false")
+	}
+	if removed, err := driver.SetRemove("missing", []byte(`"a"`)); err != nil || removed {
+		t.Errorf("SetRemove on a missing key = %v, %v, want false", removed, err)
+	}
+	if value, _ := driver.Get("members"); string(value) != `["b","a"]` {
+		t.Errorf("set after removing = %s, want [\"b\",\"a\"]", value)
+	}
+
+	// Adding a member already there leaves the value alone
+	rev := func() uint64 {
+		info, _ := driver.Stat("members")
+		return info.Revision
+	}
+	before := rev()
+	driver.SetAdd("members", []byte(`"a"`))
+	driver.SetRemove("members", []byte(`"z"`))
+	if after := rev(); after != before {
+		t.Errorf("revision went from %d to %d without the set changing", before, after)
+	}
+
+	driver.Put("text", []byte("abc"))
+	if _, err := driver.SetAdd("text", []byte("1")); !errors.Is(err, ErrNotList) {
+		t.Errorf("SetAdd on text = %v, want ErrNotList", err)
+	}
+	if _, err := driver.SetContains("members", []byte("not json")); !errors.Is(err, ErrInvalidElement) {
+		t.Errorf("SetContains of text = %v, want ErrInvalidElement", err)
+	}
+
+	// Large sets, built concurrently, lose no member and hold no duplicate
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				driver.SetAdd("large", []byte(strconv.Itoa(i)))
+			}
+		}()
+	}
+	wg.Wait()
+	var large []int
+	if value, _ := driver.Get("large"); json.Unmarshal(value, &large) != nil || len(large) != 1000 {
+		t.Fatalf("large set holds %d members, want 1000", len(large))
+	}
+	for i := 0; i < 1000; i += 2 {
+		driver.SetRemove("large", []byte(strconv.Itoa(i)))
+	}
+	if ok, _ := driver.SetContains("large", []byte("999")); !ok {
+		t.Errorf("SetContains(999) on the large set = false, want true")
+	}
+	if ok, _ := driver.SetContains("large", []byte("998")); ok {
+		t.Errorf("SetContains(998) on the large set = true after removing it")
+	}
+}
+
+func TestFieldOps(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	if created, err := driver.FieldSet("user", "name", []byte(`"Ada"`)); err != nil || !created {
+		t.Errorf("FieldSet on a new key = %v, %v, want created", created, err)
+	}
+	driver.Put("profile", []byte(`{"z": 1, "a": {"nested": true}}`))
+	if created, err := driver.FieldSet("profile", "z", []byte(`2`)); err != nil || created {
+		t.Errorf("FieldSet of an existing field = %v, %v, want not created", created, err)
+	}
+	driver.FieldSet("profile", "m", []byte(`[1, 2]`))
+	if value, _ := driver.Get("profile"); string(value) != `{"z":2,"a":{"nested":true},"m":[1,2]}` {
+		t.Errorf("stored object = %s, want the fields in their order with m last", value)
+	}
+
+	if v, err := driver.FieldGet("profile", "a"); err != nil || string(v) != `{"nested":true}` {
+		t.Errorf("FieldGet = %s, %v, want {\"nested\":true}", v, err)
+	}
+	if _, err := driver.FieldGet("profile", "missing"); !errors.Is(err, ErrFieldNotFound) {
+		t.Errorf("FieldGet of a missing field = %v, want ErrFieldNotFound", err)
+	}
+	if _, err := driver.FieldGet("missing", "a"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("FieldGet on a missing key = %v, want ErrKeyNotFound", err)
+	}
+
+	if err := driver.FieldDelete("profile", "z"); err != nil {
+		t.Errorf("FieldDelete failed: %s", err)
+	}
+	if err := driver.FieldDelete("profile", "z"); !errors.Is(err, ErrFieldNotFound) {
+		t.Errorf("FieldDelete twice = %v, want ErrFieldNotFound", err)
+	}
+	if err := driver.FieldDelete("missing", "z"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("FieldDelete on a missing key = %v, want ErrKeyNotFound", err)
+	}
+
+	// Deleting the last field leaves an empty object, not a missing key
+	driver.FieldDelete("user", "name")
+	if value, err := driver.Get("user"); err != nil || string(value) != "{}" {
+		t.Errorf("value after deleting the last field = %s, %v, want {}", value, err)
+	}
+
+	for _, v := range []string{`[1]`, `"text"`, `null`, `{"a": 1} {}`, `not json`} {
+		driver.Put("other", []byte(v))
+		if _, err := driver.FieldSet("other", "a", []byte("1")); !errors.Is(err, ErrNotObject) {
+			t.Errorf("FieldSet on %s = %v, want ErrNotObject", v, err)
+		}
+		if _, err := driver.FieldGet("other", "a"); !errors.Is(err, ErrNotObject) {
+			t.Errorf("FieldGet on %s = %v, want ErrNotObject", v, err)
+		}
+	}
+	if _, err := driver.FieldSet("user", "a", []byte("not json")); !errors.Is(err, ErrInvalidElement) {
+		t.Errorf("FieldSet of text = %v, want ErrInvalidElement", err)
+	}
+
+	// Concurrent writes to different fields are all kept
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			driver.FieldSet("wide", "f"+strconv.Itoa(i), []byte(strconv.Itoa(i)))
+		}(i)
+	}
+	wg.Wait()
+	var wide map[string]int
+	if value, _ := driver.Get("wide"); json.Unmarshal(value, &wide) != nil || len(wide) != 50 {
+		t.Errorf("concurrent FieldSet kept %d fields, want 50", len(wide))
+	}
+}
+
+func TestChanges(t *testing.T) {
+	dir, err := os.MkdirTemp("", "btree_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	driver, err := Open(dir, &Options{CacheSize: 128, Degree: 2, ChangeLogSize: 3})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+
+	driver.Put("a", []byte("1"))
+	driver.PutReader("b", strings.NewReader("2"))
+	driver.Delete("a")
+
+	changes, _, err := driver.Changes(0, 0)
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("Changes(0) = %v, %v, want 3 changes", changes, err)
+	}
+	if c := changes[1]; c.Seq != 2 || c.Op != OpPut || c.Key != "b" || string(c.Value) != "2" {
+		t.Errorf("streamed put = %+v, want seq 2 with its value read from disk", c)
+	}
+	if c := changes[2]; c.Seq != 3 || c.Op != OpDelete || c.Key != "a" {
+		t.Errorf("delete = %+v, want seq 3", c)
+	}
+
+	// Nothing new yet: the channel closes on the next change
+	changes, wake, err := driver.Changes(3, 0)
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("Changes(3) = %v, %v, want none", changes, err)
+	}
+	driver.Expire("b", time.Hour)
+	select {
+	case <-wake:
+	case <-time.After(time.Second):
+		t.Fatalf("wake channel not closed by a change")
+	}
+
+	// The log keeps three changes, so the first has been dropped
+	if _, _, err := driver.Changes(0, 0); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("Changes(0) after wrap error = %v, want ErrChangesTruncated", err)
+	}
+	if _, _, err := driver.Changes(10, 0); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("Changes past the latest error = %v, want ErrChangesTruncated", err)
+	}
+	changes, _, err = driver.Changes(1, 1)
+	if err != nil || len(changes) != 1 || changes[0].Seq != 2 {
+		t.Errorf("Changes(1, 1) = %v, %v, want change 2", changes, err)
+	}
+	if s := driver.Stats(); s.Seq != 4 {
+		t.Errorf("Stats().Seq = %d, want 4", s.Seq)
+	}
+}
+
+func TestReadOnlyApply(t *testing.T) {
+	primary, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+	replica, replicaDir := setupDriver(t)
+	defer os.RemoveAll(replicaDir)
+	replica.SetReadOnly(true)
+
+	if err := replica.Put("k", []byte("v")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put on a read-only driver error = %v, want ErrReadOnly", err)
+	}
+	if _, err := replica.Import(strings.NewReader(`{"key":"k","value":1}`), ImportOverwrite); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Import on a read-only driver error = %v, want ErrReadOnly", err)
+	}
+
+	primary.PutWithTTL("ttl", []byte("v"), time.Hour)
+	primary.Put("gone", []byte("v"))
+	primary.Delete("gone")
+
+	// A snapshot and the change log may overlap; applying both is harmless
+	var changes []Change
+	seq, err := primary.Snapshot(func(c Change) error {
+		changes = append(changes, c)
+		return nil
+	})
+	if err != nil || seq != 3 || len(changes) != 1 {
+		t.Fatalf("Snapshot = %d, %v, %v, want seq 3 and one key", seq, changes, err)
+	}
+	logged, _, _ := primary.Changes(0, 0)
+	for _, c := range append(changes, logged...) {
+		if err := replica.Apply(c); err != nil {
+			t.Fatalf("Apply(%+v) failed: %s", c, err)
+		}
+	}
+
+	if value, err := replica.Get("ttl"); err != nil || string(value) != "v" {
+		t.Errorf("replica Get = %q, %v, want v", value, err)
+	}
+	if ttl, err := replica.TTL("ttl"); err != nil || ttl == NoTTL {
+		t.Errorf("replica lost the expiry: TTL = %s, %v", ttl, err)
+	}
+	if ok, _ := replica.Has("gone"); ok {
+		t.Errorf("deleted key exists on the replica")
+	}
+}
+
+func TestFollow(t *testing.T) {
+	primary, err := Open(t.TempDir(), &Options{ChangeLogSize: 5})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer primary.Close()
+	primary.Put("before", []byte("1"))
+
+	dir := t.TempDir()
+	target, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create target: %s", err)
+	}
+	target.Put("stale", []byte("x"))
+
+	var mu sync.Mutex
+	var status FollowStatus
+	follow := func(ctx context.Context, target *Driver) chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- Follow(ctx, LocalSource(primary), target, FollowRetry(time.Millisecond), FollowProgress(func(s FollowStatus) {
+				mu.Lock()
+				status = s
+				mu.Unlock()
+			}))
+		}()
+		return done
+	}
+	caughtUp := func(snapshots int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			mu.Lock()
+			s := status
+			mu.Unlock()
+			if s.AppliedSeq == primary.Seq() && s.Snapshots == snapshots && s.LagOps == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("status = %+v, want seq %d after %d snapshots", s, primary.Seq(), snapshots)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The first Follow loads a snapshot, dropping the target's own keys,
+	// then applies changes as they are made
+	ctx, cancel := context.WithCancel(context.Background())
+	done := follow(ctx, target)
+	caughtUp(1)
+	if ok, _ := target.Has("stale"); ok {
+		t.Errorf("key missing at the source survived the snapshot")
+	}
+	primary.Put("after", []byte("2"))
+	primary.Delete("before")
+	caughtUp(1)
+	if v, err := target.Get("after"); err != nil || string(v) != "2" {
+		t.Errorf("target Get(after) = %q, %v, want 2", v, err)
+	}
+	if ok, _ := target.Has("before"); ok {
+		t.Errorf("delete was not applied")
+	}
+	if err := Follow(ctx, LocalSource(primary), target); !errors.Is(err, ErrFollowing) {
+		t.Errorf("second Follow error = %v, want ErrFollowing", err)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Follow error = %v, want context.Canceled", err)
+	}
+
+	// After a restart of the target it carries on from the saved position,
+	// without another snapshot
+	target.Close()
+	primary.Put("later", []byte("3"))
+	if target, err = Open(dir, nil); err != nil {
+		t.Fatalf("Failed to reopen target: %s", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	done = follow(ctx, target)
+	caughtUp(0)
+	if v, err := target.Get("later"); err != nil || string(v) != "3" {
+		t.Errorf("target Get(later) = %q, %v, want 3", v, err)
+	}
+
+	// Falling behind the change log loads a snapshot; closing the target
+	// ends Follow
+	target.Close()
+	<-done
+	for i := 0; i < 10; i++ {
+		primary.Put(fmt.Sprintf("bulk%d", i), []byte("v"))
+	}
+	if target, err = Open(dir, nil); err != nil {
+		t.Fatalf("Failed to reopen target: %s", err)
+	}
+	done = follow(ctx, target)
+	caughtUp(1)
+	if v, err := target.Get("bulk9"); err != nil || string(v) != "v" {
+		t.Errorf("target Get(bulk9) = %q, %v, want v", v, err)
+	}
+	target.Close()
+	if err := <-done; !errors.Is(err, ErrClosed) {
+		t.Errorf("Follow error after Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestOplog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "btree_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := &Options{CacheSize: 128, Degree: 2, OplogSize: 8}
+	driver, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+
+	plain, plainDir := setupDriver(t)
+	defer os.RemoveAll(plainDir)
+	if _, _, err := plain.Oplog(0, 0); !errors.Is(err, ErrOplogDisabled) {
+		t.Errorf("Oplog without a log error = %v, want ErrOplogDisabled", err)
+	}
+
+	driver.Put("a", []byte("1"))
+	driver.PutReader("b", strings.NewReader("2"))
+	driver.Delete("a")
+
+	changes, _, err := driver.Oplog(0, 0)
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("Oplog(0) = %v, %v, want 3 changes", changes, err)
+	}
+	if c := changes[1]; c.Seq != 2 || c.Key != "b" || c.Hash != hashValue([]byte("2")) || c.Value != nil {
+		t.Errorf("logged put = %+v, want seq 2 with the hash and no value", c)
+	}
+	if changes, _, _ := driver.Oplog(1, 1); len(changes) != 1 || changes[0].Seq != 2 {
+		t.Errorf("Oplog(1, 1) = %v, want change 2", changes)
+	}
+
+	// Segments of two changes are dropped once eight newer changes remain
+	for i := 0; i < 20; i++ {
+		driver.Put(fmt.Sprintf("k%d", i), []byte("v"))
+	}
+	if _, _, err := driver.Oplog(0, 0); !errors.Is(err, ErrChangesTruncated) {
+		t.Errorf("Oplog(0) after retention error = %v, want ErrChangesTruncated", err)
+	}
+	changes, _, err = driver.Oplog(15, 0)
+	if err != nil || len(changes) != 8 || changes[7].Seq != 23 {
+		t.Errorf("Oplog(15) = %v, %v, want changes 16 to 23", changes, err)
+	}
+
+	// A line cut short by a crash is dropped, and numbering carries on
+	driver.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, oplogDir, "*.log"))
+	f, _ := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"seq":24,"op":"pu`)
+	f.Close()
+
+	reopened, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	reopened.Put("after", []byte("v"))
+	changes, _, err = reopened.Oplog(22, 0)
+	if err != nil || len(changes) != 2 || changes[1].Seq != 24 || changes[1].Key != "after" {
+		t.Errorf("Oplog(22) after reopening = %v, %v, want changes 23 and 24", changes, err)
+	}
+}
+
+func TestShards(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := os.MkdirTemp("", "btree_test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %s", err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+
+	driver, err := Open(dirs[0], &Options{CacheSize: 128, Degree: 2, ShardDirs: dirs[1:2]})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	for i := 0; i < 50; i++ {
+		driver.Put(fmt.Sprintf("k%d", i), []byte(strconv.Itoa(i)))
+	}
+	driver.PutReader("r", strings.NewReader("streamed"))
+
+	stats := driver.Stats()
+	if len(stats.Shards) != 2 || stats.Shards[0].Files == 0 || stats.Shards[1].Files == 0 {
+		t.Fatalf("Stats().Shards = %+v, want keys in both directories", stats.Shards)
+	}
+	if stats.Shards[0].Files+stats.Shards[1].Files != 51 {
+		t.Errorf("shards hold %d files, want 51", stats.Shards[0].Files+stats.Shards[1].Files)
+	}
+	if got, err := driver.Get("r"); err != nil || string(got) != "streamed" {
+		t.Errorf("Get(r) = %q, %v", got, err)
+	}
+	if err := driver.Delete("k0"); err != nil {
+		t.Errorf("Delete(k0) = %v", err)
+	}
+
+	// Adding a directory leaves keys where they are until a rebalance
+	driver.Close()
+	driver, err = Open(dirs[0], &Options{CacheSize: 128, Degree: 2, ShardDirs: dirs[1:]})
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	for i := 1; i < 50; i++ {
+		if got, err := driver.Get(fmt.Sprintf("k%d", i)); err != nil || string(got) != strconv.Itoa(i) {
+			t.Fatalf("Get(k%d) before rebalance = %q, %v", i, got, err)
+		}
+	}
+
+	var reports []RebalanceProgress
+	p, err := driver.Rebalance(context.Background(), func(p RebalanceProgress) { reports = append(reports, p) })
+	if err != nil || !p.Done || p.Total != 50 || p.Scanned != 50 || p.Moved == 0 {
+		t.Fatalf("Rebalance() = %+v, %v, want 50 keys checked and some moved", p, err)
+	}
+	if len(reports) == 0 || reports[len(reports)-1] != p {
+		t.Errorf("progress reports = %v, want the final result last", reports)
+	}
+	if files := driver.Stats().Shards[2].Files; files != p.Moved {
+		t.Errorf("new shard holds %d files, want the %d moved", files, p.Moved)
+	}
+	for i := 1; i < 50; i++ {
+		if got, err := driver.Get(fmt.Sprintf("k%d", i)); err != nil || string(got) != strconv.Itoa(i) {
+			t.Errorf("Get(k%d) after rebalance = %q, %v", i, got, err)
+		}
+	}
+	if p, _ := driver.Rebalance(context.Background(), nil); p.Moved != 0 {
+		t.Errorf("second Rebalance moved %d keys, want 0", p.Moved)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	prod := map[string]string{"env": "prod", "owner": "team-x"}
+	driver.PutWithLabels("a", []byte("1"), prod)
+	driver.PutWithLabels("b", []byte("2"), map[string]string{"env": "prod", "owner": "team-y"})
+	driver.PutWithLabels("c", []byte("3"), map[string]string{"env": "dev"})
+	driver.Put("d", []byte("4"))
+
+	query := func(selector map[string]string) []string {
+		t.Helper()
+		keys, err := driver.QueryByLabel(selector, 0)
+		if err != nil {
+			t.Fatalf("QueryByLabel(%v) failed: %s", selector, err)
+		}
+		return keys
+	}
+	if keys := query(map[string]string{"env": "prod"}); !slices.Equal(keys, []string{"a", "b"}) {
+		t.Errorf("QueryByLabel(env=prod) = %v, want [a b]", keys)
+	}
+	if keys := query(map[string]string{"env": "prod", "owner": "team-x"}); !slices.Equal(keys, []string{"a"}) {
+		t.Errorf("QueryByLabel(env=prod,owner=team-x) = %v, want [a]", keys)
+	}
+	if keys, _ := driver.QueryByLabel(map[string]string{"env": "prod"}, 1); !slices.Equal(keys, []string{"a"}) {
+		t.Errorf("QueryByLabel with limit 1 = %v, want [a]", keys)
+	}
+	if _, err := driver.QueryByLabel(nil, 0); !errors.Is(err, ErrInvalidLabels) {
+		t.Errorf("QueryByLabel with no labels = %v, want ErrInvalidLabels", err)
+	}
+
+	// Overwrites keep the labels, PutWithLabels replaces them and deletes
+	// drop them
+	driver.Put("a", []byte("one"))
+	if info, _ := driver.Stat("a"); !maps.Equal(info.Labels, prod) {
+		t.Errorf("labels after Put = %v, want %v", info.Labels, prod)
+	}
+	driver.PutWithLabels("c", []byte("3"), map[string]string{"env": "prod"})
+	driver.Delete("b")
+	if keys := query(map[string]string{"env": "prod"}); !slices.Equal(keys, []string{"a", "c"}) {
+		t.Errorf("QueryByLabel(env=prod) after changes = %v, want [a c]", keys)
+	}
+	if keys := query(map[string]string{"env": "dev"}); len(keys) != 0 {
+		t.Errorf("QueryByLabel(env=dev) after relabelling = %v, want none", keys)
+	}
+
+	for _, labels := range []map[string]string{
+		{"": "x"},
+		{"env": "a,b"},
+		{"env": strings.Repeat("x", MaxLabelValueLen+1)},
+		{strings.Repeat("x", MaxLabelNameLen+1): "x"},
+	} {
+		if err := driver.PutWithLabels("e", []byte("5"), labels); !errors.Is(err, ErrInvalidLabels) {
+			t.Errorf("PutWithLabels(%v) = %v, want ErrInvalidLabels", labels, err)
+		}
+	}
+	if ok, _ := driver.Has("e"); ok {
+		t.Errorf("a key with invalid labels was stored")
+	}
+
+	// Labels survive a restart, and travel with Export and Import
+	var buf bytes.Buffer
+	if _, err := driver.Export(&buf, ""); err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	driver.Close()
+	driver, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	if keys := query(map[string]string{"owner": "team-x"}); !slices.Equal(keys, []string{"a"}) {
+		t.Errorf("QueryByLabel(owner=team-x) after reopening = %v, want [a]", keys)
+	}
+	driver.Close()
+
+	driver, err = Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	if _, err := driver.Import(&buf, ImportOverwrite); err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	if keys := query(map[string]string{"env": "prod"}); !slices.Equal(keys, []string{"a", "c"}) {
+		t.Errorf("QueryByLabel(env=prod) after Import = %v, want [a c]", keys)
+	}
+}
+
+func TestSnapshotArchive(t *testing.T) {
+	opts := &Options{SnapshotArchive: []SnapshotRetention{{Every: time.Hour, Keep: 24 * time.Hour}}}
+	driver, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	driver.PutWithLabels("a", []byte("old"), map[string]string{"env": "prod"})
+	driver.Expire("a", time.Hour)
+
+	snap, err := driver.ArchiveSnapshot()
+	if err != nil {
+		t.Fatalf("ArchiveSnapshot failed: %s", err)
+	}
+	if snap.Items != 1 || !strings.HasPrefix(snap.Name, "btree-") {
+		t.Errorf("ArchiveSnapshot = %+v, want 1 key in a btree- file", snap)
+	}
+
+	// Of older snapshots, only the first of each hour of the last day is kept
+	data, err := os.ReadFile(driver.archivePath(snap.Name))
+	if err != nil {
+		t.Fatalf("Failed to read the archived snapshot: %s", err)
+	}
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-3 * time.Hour)
+	name := func(t time.Time) string { return archivePrefix + t.Format(archiveLayout) + archiveSuffix }
+	for _, at := range []time.Time{time.Now().UTC().Add(-48 * time.Hour), hour.Add(time.Minute), hour.Add(10 * time.Minute)} {
+		os.WriteFile(driver.archivePath(name(at)), data, 0644)
+	}
+	if err := driver.pruneArchive(time.Now()); err != nil {
+		t.Fatalf("pruneArchive failed: %s", err)
+	}
+	files, err := driver.Snapshots()
+	if err != nil {
+		t.Fatalf("Snapshots failed: %s", err)
+	}
+	if len(files) != 2 || files[0].Name != snap.Name || files[1].Name != name(hour.Add(time.Minute)) {
+		t.Fatalf("Snapshots after pruning = %+v, want %s and the first of 3h ago", files, snap.Name)
+	}
+	if files[0].Items != 1 || files[0].Size != int64(len(data)) {
+		t.Errorf("Snapshots()[0] = %+v, want 1 key in %d bytes", files[0], len(data))
+	}
+
+	// Restoring brings back the labels and expiry, keeping values and newer keys
+	driver.PutWithLabels("a", []byte("new"), map[string]string{"env": "dev"})
+	driver.Expire("a", 0)
+	driver.Put("b", []byte("b"))
+	if err := driver.RestoreSnapshot(snap.Name); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %s", err)
+	}
+	info, err := driver.Stat("a")
+	if err != nil || info.Labels["env"] != "prod" || info.TTL <= 0 {
+		t.Errorf("Stat(a) after restoring = %+v, %v, want env=prod and a TTL", info, err)
+	}
+	if got, err := driver.Get("a"); err != nil || string(got) != "new" {
+		t.Errorf("Get(a) after restoring = %q, %v, want the value on disk", got, err)
+	}
+	if got, err := driver.Get("b"); err != nil || string(got) != "b" {
+		t.Errorf("Get(b) after restoring = %q, %v", got, err)
+	}
+	if keys, _ := driver.QueryByLabel(map[string]string{"env": "prod"}, 0); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("QueryByLabel(env=prod) after restoring = %v, want [a]", keys)
+	}
+	for _, bad := range []string{name(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)), "../btree.json", "nope"} {
+		if err := driver.RestoreSnapshot(bad); !errors.Is(err, ErrSnapshotNotFound) {
+			t.Errorf("RestoreSnapshot(%q) = %v, want ErrSnapshotNotFound", bad, err)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, &Options{CompactRate: 1000})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	driver.Put("k", []byte("v"))
+	for i := 0; i < compactBatch+6; i++ {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("left%d.tmp", i)), []byte("xy"), 0644)
+	}
+	upload := filepath.Join(dir, "left0.tmp")
+	driver.uploads.Store(upload, struct{}{})
+
+	// Cancelling stops it before the first batch
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := driver.CompactContext(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("CompactContext with a cancelled context = %v, want context.Canceled", err)
+	}
+
+	var reports []CompactProgress
+	start := time.Now()
+	p, err := driver.CompactContext(context.Background(), func(p CompactProgress) { reports = append(reports, p) })
+	if err != nil {
+		t.Fatalf("CompactContext failed: %s", err)
+	}
+	want := CompactProgress{Total: compactBatch + 6, Scanned: compactBatch + 6, Removed: compactBatch + 5, Bytes: 2 * (compactBatch + 5), Done: true}
+	if p != want || len(reports) != 3 || reports[0].Scanned != compactBatch || reports[2] != want {
+		t.Errorf("CompactContext = %+v after %+v, want %+v after a report per batch", p, reports, want)
+	}
+	// 69 files at 1000 a second
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("CompactContext took %s, want the rate limit to slow it down", elapsed)
+	}
+	if _, err := os.Stat(upload); err != nil {
+		t.Errorf("Compact removed an upload in progress: %v", err)
+	}
+	if got, err := driver.Get("k"); err != nil || string(got) != "v" {
+		t.Errorf("Get(k) after compacting = %q, %v", got, err)
+	}
+}
+
+func TestCompactSchedule(t *testing.T) {
+	w, err := ParseCompactWindow("23:30-01:00")
+	if err != nil || *w != (CompactWindow{Start: 23*time.Hour + 30*time.Minute, End: time.Hour}) || w.String() != "23:30-01:00" {
+		t.Fatalf("ParseCompactWindow = %+v, %v", w, err)
+	}
+	if _, err := ParseCompactWindow("2am-4am"); err == nil {
+		t.Errorf("ParseCompactWindow accepted 2am-4am")
+	}
+	day := func(h, m int) time.Time { return time.Date(2024, 3, 10, h, m, 0, 0, time.Local) }
+	for _, c := range []struct {
+		at    time.Time
+		opens time.Time
+		in    bool
+	}{
+		{day(23, 45), day(23, 30), true},
+		{day(0, 30), day(0, 0).AddDate(0, 0, -1).Add(23*time.Hour + 30*time.Minute), true},
+		{day(1, 0), time.Time{}, false},
+		{day(12, 0), time.Time{}, false},
+	} {
+		opens, _, in := w.at(c.at)
+		if in != c.in || (in && !opens.Equal(c.opens)) {
+			t.Errorf("window at %s = %s, %v, want %s, %v", c.at, opens, in, c.opens, c.in)
+		}
+	}
+
+	dir := t.TempDir()
+	window := &CompactWindow{Start: 2 * time.Hour, End: 4 * time.Hour}
+	driver, err := Open(dir, &Options{CompactWindow: window, CompactBytesRate: 1 << 20})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	leftover := func(n int) {
+		for i := 0; i < n; i++ {
+			os.WriteFile(filepath.Join(dir, fmt.Sprintf("left%d.tmp", i)), []byte("xy"), 0644)
+		}
+	}
+
+	// The scheduler compacts once per window, only within it
+	leftover(3)
+	today := time.Now()
+	at := func(h int) time.Time {
+		return time.Date(today.Year(), today.Month(), today.Day(), h, 0, 0, 0, time.Local)
+	}
+	driver.compactIfDue(at(5))
+	if s := driver.CompactionStats(); s.Runs != 0 {
+		t.Errorf("compacted outside the window: %+v", s)
+	}
+	driver.compactIfDue(at(3))
+	driver.compactIfDue(at(3))
+	s := driver.CompactionStats()
+	if s.Runs != 1 || s.FilesReclaimed != 3 || s.BytesReclaimed != 6 || !s.Progress.Done || s.Window != "02:00-04:00" {
+		t.Errorf("CompactionStats after the window = %+v, want a single run removing 3 files", s)
+	}
+
+	// A pause holds a running compaction until resumed, and the scheduler
+	// starts none meanwhile
+	if err := driver.PauseCompaction(); err != nil {
+		t.Fatalf("PauseCompaction failed: %s", err)
+	}
+	leftover(2)
+	done := make(chan error)
+	go func() {
+		_, err := driver.CompactContext(context.Background(), nil)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if s := driver.CompactionStats(); !s.Running || !s.Paused || s.FilesReclaimed != 3 {
+		t.Errorf("CompactionStats while paused = %+v, want it running and paused with nothing more removed", s)
+	}
+	if err := driver.ResumeCompaction(); err != nil {
+		t.Fatalf("ResumeCompaction failed: %s", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("CompactContext after resuming failed: %s", err)
+	}
+	driver.PauseCompaction()
+	driver.Close()
+
+	// What was reclaimed and the pause survive a restart
+	driver, err = Open(dir, &Options{CompactWindow: window})
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	defer driver.Close()
+	s = driver.Stats().Compaction
+	if s.Runs != 2 || s.FilesReclaimed != 5 || s.BytesReclaimed != 10 || !s.Paused || s.Running || s.LastStart.IsZero() {
+		t.Errorf("CompactionStats after reopening = %+v, want 2 runs, 5 files and paused", s)
+	}
+	if _, err := Open(t.TempDir(), &Options{CompactWindow: &CompactWindow{Start: time.Hour, End: time.Hour}}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Open with an empty compaction window: err = %v, want ErrInvalidOption", err)
+	}
+}
+
+func TestStartupReport(t *testing.T) {
+	dir := t.TempDir()
+	opts := &Options{OplogSize: 100}
+	driver, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("2"))
+	driver.Close()
+
+	// A crash leaves a temp file, a torn oplog line and a damaged value
+	os.WriteFile(filepath.Join(dir, "c.tmp"), []byte("partial"), 0644)
+	segments, _ := filepath.Glob(filepath.Join(dir, oplogDir, "*.log"))
+	f, _ := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"seq":3,"op`)
+	f.Close()
+	os.WriteFile(filepath.Join(dir, "a"), []byte("bitrot"), 0644)
+
+	// The default checks leave values unread
+	driver, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	r := driver.StartupReport()
+	if r.Keys != 2 || !r.SnapshotLoaded || r.OplogSeq != 2 || r.OplogTornBytes != 12 || r.TempFilesRemoved != 1 || r.TempBytesRemoved != 7 ||
+		r.Verified || r.CorruptFiles() != 0 || r.Duration <= 0 || r.OpenedAt.IsZero() {
+		t.Errorf("StartupReport = %+v", r)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c.tmp")); !os.IsNotExist(err) {
+		t.Errorf("the leftover temp file is still there: %v", err)
+	}
+	driver.Close()
+
+	// VerifyOnOpen finds the damaged value, and CorruptLimit refuses it
+	opts.VerifyOnOpen, opts.CorruptLimit = true, 1
+	if _, err := Open(dir, opts); !errors.Is(err, ErrTooCorrupt) {
+		t.Fatalf("Open with a corrupt value and a limit of 1: err = %v, want ErrTooCorrupt", err)
+	}
+	opts.CorruptLimit = 2
+	driver, err = Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Open with a corrupt value and a limit of 2 failed: %s", err)
+	}
+	if r := driver.StartupReport(); !r.Verified || len(r.Corrupt) != 1 || r.Corrupt[0].Key != "a" {
+		t.Errorf("StartupReport with VerifyOnOpen = %+v, want a corrupt", r)
+	}
+	driver.Close()
+
+	// A snapshot that cannot be read is quarantined and counted
+	os.WriteFile(filepath.Join(dir, metaDir, snapshotFile), []byte("{not json"), 0644)
+	driver, err = Open(dir, &Options{})
+	if err != nil {
+		t.Fatalf("Open with a corrupt snapshot failed: %s", err)
+	}
+	defer driver.Close()
+	if r := driver.StartupReport(); r.SnapshotLoaded || len(r.Quarantined) != 1 || r.CorruptFiles() != 1 || r.Keys != 2 {
+		t.Errorf("StartupReport with a corrupt snapshot = %+v, want it quarantined and the keys reconciled", r)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, &Options{})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	for _, key := range []string{"foo", "Foo", "user:1"} {
+		driver.Put(key, []byte(key))
+	}
+	driver.Close()
+
+	// A migration cut short leaves its journal, and Open refuses the directory
+	opts := MigrateLayoutOptions{From: LayoutFlat, To: LayoutEncodedV1}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := MigrateLayout(ctx, dir, opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("MigrateLayout with a cancelled context: err = %v, want context.Canceled", err)
+	}
+	if _, err := Open(dir, &Options{EncodeFileNames: true}); !errors.Is(err, ErrMigrationIncomplete) || !strings.Contains(err.Error(), "zephyrusctl migrate-layout --from flat --to encoded-v1 "+dir) {
+		t.Fatalf("Open of a half migrated directory: err = %v, want ErrMigrationIncomplete naming the command", err)
+	}
+	if _, err := MigrateLayout(context.Background(), dir, MigrateLayoutOptions{From: LayoutEncodedV1, To: LayoutFlat}); !errors.Is(err, ErrLayoutMismatch) {
+		t.Errorf("MigrateLayout the other way meanwhile: err = %v, want ErrLayoutMismatch", err)
+	}
+
+	stats, err := MigrateLayout(context.Background(), dir, opts)
+	if err != nil || stats != (LayoutStats{Files: 2, Copied: 2, Removed: 2, Resumed: true}) {
+		t.Fatalf("MigrateLayout = %+v, %v, want 2 files copied and removed", stats, err)
+	}
+	for _, name := range []string{"Foo", "user:1", filepath.Join(metaDir, layoutJournalFile)} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s after the migration: %v, want it removed", name, err)
+		}
+	}
+	if stats, err := MigrateLayout(context.Background(), dir, opts); err != nil || stats.Files != 0 {
+		t.Errorf("MigrateLayout of a migrated directory = %+v, %v, want nothing to do", stats, err)
+	}
+
+	// The recorded layout must match the options
+	if _, err := Open(dir, &Options{}); !errors.Is(err, ErrLayoutMismatch) {
+		t.Errorf("Open without EncodeFileNames: err = %v, want ErrLayoutMismatch", err)
+	}
+	driver, err = Open(dir, &Options{EncodeFileNames: true})
+	if err != nil {
+		t.Fatalf("Open after the migration failed: %s", err)
+	}
+	defer driver.Close()
+	for _, key := range []string{"foo", "Foo", "user:1"} {
+		if value, err := driver.Get(key); err != nil || string(value) != key {
+			t.Errorf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+	if corrupt, err := driver.Verify(context.Background()); err != nil || len(corrupt) != 0 {
+		t.Errorf("Verify after the migration = %v, %v, want nothing corrupt", corrupt, err)
+	}
+}
+
+func TestColdTier(t *testing.T) {
+	hot, cold := t.TempDir(), t.TempDir()
+	opts := &Options{ColdDir: cold, DemoteAfter: 300 * time.Millisecond}
+	driver, err := Open(hot, opts)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("idle", []byte("old value"))
+	driver.PutReader("streamed", strings.NewReader("old stream"))
+	time.Sleep(350 * time.Millisecond)
+	driver.Put("busy", []byte("new"))
+	if _, err := driver.Demote(context.Background()); err != nil {
+		t.Fatalf("Demote failed: %s", err)
+	}
+
+	inDir := func(dir, key string) bool {
+		_, err := os.Stat(filepath.Join(dir, key))
+		return err == nil
+	}
+	for _, key := range []string{"idle", "streamed"} {
+		if !inDir(cold, key) || inDir(hot, key) {
+			t.Errorf("%s is not only in the cold tier after Demote", key)
+		}
+	}
+	if !inDir(hot, "busy") || inDir(cold, "busy") {
+		t.Errorf("busy was demoted")
+	}
+	if got, err := driver.Get("streamed"); err != nil || string(got) != "old stream" {
+		t.Errorf("Get(streamed) from the cold tier = %q, %v", got, err)
+	}
+	tiers := driver.Stats().Tiers
+	if tiers == nil || tiers.Hot.Keys != 1 || tiers.Cold.Keys != 2 || tiers.Cold.Bytes != int64(len("old value")+len("old stream")) || tiers.Demoted != 2 {
+		t.Errorf("Stats().Tiers = %+v, want 1 hot key, 2 cold ones and 2 demoted", tiers)
+	}
+
+	// Writes land hot, and every tier is verified, compacted and exported
+	driver.Put("idle", []byte("rewritten"))
+	if !inDir(hot, "idle") || inDir(cold, "idle") {
+		t.Errorf("rewritten key is not only in the hot tier")
+	}
+	if corrupt, err := driver.Verify(context.Background()); err != nil || len(corrupt) != 0 {
+		t.Errorf("Verify() = %v, %v", corrupt, err)
+	}
+	if err := driver.Compact(); err != nil {
+		t.Errorf("Compact() = %v", err)
+	}
+	var out bytes.Buffer
+	if n, err := driver.Export(&out, ""); err != nil || n != 3 {
+		t.Errorf("Export() = %d, %v, want 3 keys", n, err)
+	}
+	driver.Close()
+
+	// The cold tier is found again on reopening, and reads promote from it
+	driver, err = Open(hot, &Options{ColdDir: cold, PromoteOnRead: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	defer driver.Close()
+	if got, err := driver.Get("streamed"); err != nil || string(got) != "old stream" {
+		t.Errorf("Get(streamed) after reopening = %q, %v", got, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for inDir(cold, "streamed") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !inDir(hot, "streamed") || inDir(cold, "streamed") {
+		t.Errorf("streamed was not promoted after a read")
+	}
+	if tiers := driver.Stats().Tiers; tiers == nil || tiers.Promoted != 1 || tiers.Cold.Keys != 0 {
+		t.Errorf("Stats().Tiers after promoting = %+v", tiers)
+	}
+
+	// Misses are not tracked as accesses
+	if _, err := driver.GetReader("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetReader(missing) = %v, want ErrKeyNotFound", err)
+	}
+	driver.accessMu.Lock()
+	_, tracked := driver.accessed["missing"]
+	driver.accessMu.Unlock()
+	if tracked {
+		t.Errorf("GetReader(missing) recorded an access")
+	}
+}
+
+func TestRestoreToTime(t *testing.T) {
+	dir, err := os.MkdirTemp("", "btree_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	driver, err := Open(dir, &Options{CacheSize: 128, Degree: 2, OplogSize: 100, OplogValues: true})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("1"))
+	snapshot := filepath.Join(dir, ".snapshot.ndjson")
+	f, _ := os.Create(snapshot)
+	enc := json.NewEncoder(f)
+	seq, _ := driver.Snapshot(func(c Change) error { return enc.Encode(c) })
+	enc.Encode(Change{Seq: seq, Time: time.Now()})
+	f.Close()
+
+	driver.PutReader("a", strings.NewReader("2"))
+	driver.Delete("b")
+	driver.Put("c", []byte("1"))
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	driver.Put("a", []byte("3"))
+	driver.Put("d", []byte("1"))
+
+	// Restore from a copy of the log whose last change was cut short
+	wal := t.TempDir()
+	segments, _ := listSegments(filepath.Join(dir, oplogDir))
+	for _, seg := range segments {
+		if err := copyFile(seg.path, filepath.Join(wal, filepath.Base(seg.path))); err != nil {
+			t.Fatalf("Failed to copy the oplog: %s", err)
+		}
+	}
+	last, _ := os.OpenFile(filepath.Join(wal, filepath.Base(segments[len(segments)-1].path)), os.O_WRONLY|os.O_APPEND, 0644)
+	last.WriteString(`{"seq":8,"op":"pu`)
+	last.Close()
+
+	target, targetDir := setupDriver(t)
+	defer os.RemoveAll(targetDir)
+	target.Put("z", []byte("stale"))
+
+	if err := target.RestoreToTime(snapshot, wal, time.Now()); err != nil {
+		t.Fatalf("RestoreToTime(now) error = %v", err)
+	}
+	if got, err := target.Get("d"); err != nil || string(got) != "1" {
+		t.Errorf("Get(d) after restoring to now = %q, %v", got, err)
+	}
+	if err := target.RestoreToTime(snapshot, wal, cutoff); err != nil {
+		t.Fatalf("RestoreToTime() error = %v", err)
+	}
+	want := map[string]string{"a": "2", "c": "1"}
+	for _, key := range []string{"a", "b", "c", "d", "z"} {
+		got, err := target.Get(key)
+		if v, ok := want[key]; ok && (err != nil || string(got) != v) {
+			t.Errorf("Get(%s) after restore = %q, %v, want %q", key, got, err, v)
+		}
+		if _, ok := want[key]; !ok && !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get(%s) after restore = %q, %v, want ErrKeyNotFound", key, got, err)
+		}
+	}
+
+	// Logs kept without values cannot be replayed
+	plain, err := Open(t.TempDir(), &Options{CacheSize: 128, Degree: 2, OplogSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	plain.Put("a", []byte("1"))
+	empty := filepath.Join(plain.dir, ".empty.ndjson")
+	os.WriteFile(empty, []byte(`{"seq":0}`+"\n"), 0644)
+	if err := target.RestoreToTime(empty, filepath.Join(plain.dir, oplogDir), time.Now()); err == nil {
+		t.Error("RestoreToTime from a log without values succeeded")
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})), level)
+	driver, err := Open(t.TempDir(), &Options{Logger: logger, CacheSize: 128, Degree: 2})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+
+	buf.Reset()
+	driver.Put("a", []byte("1"))
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log output %q is not one JSON line: %s", buf.String(), err)
+	}
+	if line["op"] != "put" || line["key"] != "a" || line["duration"] == nil || line["level"] != "INFO" {
+		t.Errorf("Put logged %v, want op, key and duration fields at INFO", line)
+	}
+
+	buf.Reset()
+	driver.Get("missing")
+	if buf.Len() != 0 {
+		t.Errorf("debug message logged at info: %s", buf.String())
+	}
+	if err := driver.SetLogLevel(LevelDebug); err != nil {
+		t.Fatalf("SetLogLevel(debug) error = %v", err)
+	}
+	driver.Get("missing")
+	if !strings.Contains(buf.String(), `"level":"DEBUG","msg":"Get key not found: missing"`) {
+		t.Errorf("after SetLogLevel(debug) logged %q, want the debug message", buf.String())
+	}
+
+	driver.SetLogLevel(LevelError)
+	buf.Reset()
+	driver.Put("b", []byte("1"))
+	if buf.Len() != 0 {
+		t.Errorf("info message logged at error: %s", buf.String())
+	}
+
+	if level, err := ParseLogLevel("WARN"); err != nil || level != LevelWarn {
+		t.Errorf("ParseLogLevel(WARN) = %v, %v", level, err)
+	}
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Error("ParseLogLevel(loud) succeeded")
+	}
+}
+
+func TestSlowOps(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buf, nil)), nil)
+	driver, err := Open(t.TempDir(), &Options{Logger: logger, CacheSize: 128, Degree: 2, SlowOpThreshold: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+
+	driver.Put("fast", []byte("1"))
+	if stats := driver.Stats(); stats.SlowOps != 0 {
+		t.Fatalf("SlowOps after a fast put = %d, want 0", stats.SlowOps)
+	}
+
+	// Hold the lock so the put spends its time waiting for it
+	driver.mutex.Lock()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		driver.mutex.Unlock()
+	}()
+	buf.Reset()
+	driver.Put("slow", []byte("12345"))
+
+	var warning map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["level"] == "WARN" {
+			warning = entry
+		}
+	}
+	if warning == nil {
+		t.Fatalf("no warning logged for a slow put: %s", buf.String())
+	}
+	if warning["op"] != "put" || warning["key"] != "slow" || warning["size"] != float64(5) || warning["slow_phase"] != "lock wait" {
+		t.Errorf("slow put logged %v, want op, key, size and the lock wait phase", warning)
+	}
+	if warning["lock_wait"].(float64) < float64(40*time.Millisecond) {
+		t.Errorf("lock_wait = %v, want at least 40ms", warning["lock_wait"])
+	}
+
+	stats := driver.Stats()
+	if stats.SlowOps != 1 || stats.SlowOpsByOp["put"] != 1 {
+		t.Errorf("Stats() slow ops = %d %v, want 1 put", stats.SlowOps, stats.SlowOpsByOp)
+	}
+}
+
+func TestCacheEvictions(t *testing.T) {
+	driver, err := New(t.TempDir(), nil, 2, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("a", []byte("1234"))
+	driver.Put("b", []byte("5"))
+	driver.Put("c", []byte("6"))
+	driver.Put("c", []byte("78")) // replacing a cached value evicts nothing
+	driver.Delete("b")            // neither does deleting a key
+
+	want := CacheStats{Values: 1, Capacity: 2, Bytes: 2, Evictions: 1, EvictedBytes: 4}
+	if got := driver.CacheStats(); got != want {
+		t.Errorf("CacheStats() = %+v, want %+v", got, want)
+	}
+	if stats := driver.Stats(); stats.CacheEvictions != 1 || stats.CacheEvictedBytes != 4 {
+		t.Errorf("Stats() evictions = %d, %d bytes, want 1, 4", stats.CacheEvictions, stats.CacheEvictedBytes)
+	}
+}
+
+func TestOpStats(t *testing.T) {
+	driver, err := Open(t.TempDir(), &Options{CacheSize: 1})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	driver.Put("a", []byte("123"))
+	driver.Put("b", []byte("45"))
+	driver.Get("b") // cache hit
+	driver.Get("a") // B-tree hit, as b pushed it out of the cache
+	driver.Get("missing")
+	driver.Delete("b")
+	driver.Put("bad key", []byte("x"))
+	driver.PutBatch([]BatchEntry{{Key: "c", Value: []byte("6")}, {Key: "d", Value: []byte("7")}})
+
+	// A key written before the driver was opened is read from disk
+	other, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer other.Close()
+	os.WriteFile(filepath.Join(other.dir, "e"), []byte("8910"), 0644)
+	other.Get("e")
+	if got := other.OpStats(); got.DiskReads != 1 || got.BytesRead != 4 {
+		t.Errorf("OpStats() after reading a file = %+v, want 1 disk read of 4 bytes", got)
+	}
+
+	want := OpStats{
+		Puts: 5, Gets: 3, Deletes: 1,
+		CacheHits: 1, TreeHits: 1,
+		BytesWritten: 7, BytesRead: 5,
+		Errors: map[string]uint64{"not_found": 1, "invalid_key": 1},
+	}
+	if got := driver.StatsAndReset().Ops; !reflect.DeepEqual(got, want) {
+		t.Errorf("StatsAndReset().Ops = %+v, want %+v", got, want)
+	}
+	if got := driver.Stats().Ops; !reflect.DeepEqual(got, OpStats{}) {
+		t.Errorf("Stats().Ops after a reset = %+v, want zeros", got)
+	}
+	if stats := driver.Stats(); stats.Keys != 3 {
+		t.Errorf("Stats().Keys = %d, want 3, as keys are not reset", stats.Keys)
+	}
+}
+
+func TestLoader(t *testing.T) {
+	upstreamErr := errors.New("upstream is down")
+	var calls atomic.Int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context, key string) ([]byte, error) {
+		calls.Add(1)
+		switch key {
+		case "slow":
+			<-release
+		case "missing":
+			return nil, ErrKeyNotFound
+		case "broken":
+			return nil, upstreamErr
+		}
+		return []byte("loaded " + key), nil
+	}
+	driver, err := Open(t.TempDir(), &Options{Loader: loader, LoaderTTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+
+	// Concurrent misses share one call of the loader
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := driver.Get("slow")
+			if err == nil && string(v) != "loaded slow" {
+				err = fmt.Errorf("got %q", v)
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent Get failed: %s", err)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called %d times for concurrent misses, want once", n)
+	}
+
+	// The value is stored with LoaderTTL and served without the loader
+	if v, err := driver.Get("slow"); err != nil || string(v) != "loaded slow" {
+		t.Errorf("Get after loading = %q, %v", v, err)
+	}
+	if ttl, err := driver.TTL("slow"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("TTL of a loaded key = %s, %v, want about an hour", ttl, err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called %d times, want once", n)
+	}
+
+	if _, err := driver.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get of a key the loader lacks error = %v, want ErrKeyNotFound", err)
+	}
+	if ok, _ := driver.Has("missing"); ok {
+		t.Errorf("a miss was stored")
+	}
+	_, err = driver.Get("broken")
+	if !errors.Is(err, ErrLoadFailed) || !errors.Is(err, upstreamErr) {
+		t.Errorf("Get with a failing loader error = %v, want ErrLoadFailed wrapping the loader's error", err)
+	}
+
+	// SkipLoader reports a miss without calling the loader
+	before := calls.Load()
+	if _, err := driver.GetContext(SkipLoader(context.Background()), "other"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetContext with SkipLoader error = %v, want ErrKeyNotFound", err)
+	}
+	if calls.Load() != before {
+		t.Errorf("SkipLoader called the loader")
+	}
+
+	// A driver that takes no writes serves loaded values without storing them
+	driver.SetReadOnly(true)
+	if v, err := driver.Get("replica"); err != nil || string(v) != "loaded replica" {
+		t.Errorf("Get on a read-only driver = %q, %v", v, err)
+	}
+	if ok, _ := driver.Has("replica"); ok {
+		t.Errorf("a read-only driver stored a loaded value")
+	}
+
+	ops := driver.OpStats()
+	if ops.Loads != 2 || ops.Errors["load_failed"] != 1 || ops.Errors["not_found"] != 2 {
+		t.Errorf("OpStats() = %+v, want 2 loads, a failed load and 2 misses", ops)
+	}
+}
+
+// flakyMirror is a Mirror that fails while down is set and blocks while
+// hold is not nil
+type flakyMirror struct {
+	Mirror
+	down atomic.Bool
+	hold chan struct{}
+}
+
+func (m *flakyMirror) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if m.hold != nil {
+		<-m.hold
+	}
+	if m.down.Load() {
+		return errors.New("mirror is down")
+	}
+	return m.Mirror.Put(ctx, key, value, ttl)
+}
+
+func TestMirror(t *testing.T) {
+	secondary, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer secondary.Close()
+	driver, err := Open(t.TempDir(), &Options{Mirror: DriverMirror(secondary)})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+
+	// Writes reach the mirror in the background, in order
+	driver.Put("a", []byte("1"))
+	driver.Put("a", []byte("2"))
+	driver.PutWithTTL("b", []byte("b"), time.Hour)
+	driver.Put("gone", []byte("x"))
+	driver.Delete("gone")
+	driver.PutReader("streamed", strings.NewReader("streamed value"))
+	driver.Expire("a", time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); driver.Stats().Mirror.Pending > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if v, err := secondary.Get("a"); err != nil || string(v) != "2" {
+		t.Errorf("mirror a = %q, %v, want 2", v, err)
+	}
+	if ttl, _ := secondary.TTL("a"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("mirror TTL of a = %s, want up to an hour", ttl)
+	}
+	if ttl, _ := secondary.TTL("b"); ttl <= 0 {
+		t.Errorf("mirror TTL of b = %s, want an expiry", ttl)
+	}
+	if _, err := secondary.Get("gone"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("mirror gone: err = %v, want ErrKeyNotFound", err)
+	}
+	if v, err := secondary.Get("streamed"); err != nil || string(v) != "streamed value" {
+		t.Errorf("mirror streamed = %q, %v", v, err)
+	}
+	if s := driver.Stats().Mirror; s.Forwarded != 7 || s.Failed != 0 || s.Dropped != 0 {
+		t.Errorf("mirror stats = %+v, want 7 forwarded", s)
+	}
+
+	// ResyncMirror copies what differs and removes what is not here
+	secondary.Put("a", []byte("changed"))
+	secondary.Delete("b")
+	secondary.Put("extra", []byte("x"))
+	stats, err := driver.ResyncMirror(context.Background())
+	if err != nil {
+		t.Fatalf("ResyncMirror failed: %s", err)
+	}
+	if stats != (ResyncStats{Checked: 3, Copied: 2, Removed: 1}) {
+		t.Errorf("ResyncMirror = %+v, want 3 checked, 2 copied, 1 removed", stats)
+	}
+	for _, key := range []string{"a", "b", "streamed"} {
+		want, _ := driver.Get(key)
+		if got, err := secondary.Get(key); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("mirror %s after resync = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if _, err := secondary.Get("extra"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("mirror extra after resync: err = %v, want ErrKeyNotFound", err)
+	}
+	driver.Close()
+
+	// A full queue drops writes and counts them
+	flaky := &flakyMirror{Mirror: DriverMirror(secondary), hold: make(chan struct{})}
+	driver, err = Open(t.TempDir(), &Options{Mirror: flaky, MirrorQueue: 1})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		driver.Put("q", []byte(strconv.Itoa(i)))
+	}
+	if s := driver.Stats().Mirror; s.Dropped < 3 || s.Pending+int64(s.Dropped) != 5 {
+		t.Errorf("mirror stats with a full queue = %+v, want at least 3 dropped", s)
+	}
+	close(flaky.hold)
+	driver.Close()
+
+	// In strict mode a write the mirror refuses fails, but stays applied
+	flaky = &flakyMirror{Mirror: DriverMirror(secondary)}
+	driver, err = Open(t.TempDir(), &Options{Mirror: flaky, MirrorSync: true})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	if err := driver.Put("s", []byte("1")); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	if v, _ := secondary.Get("s"); string(v) != "1" {
+		t.Errorf("mirror s = %q right after Put, want 1", v)
+	}
+	flaky.down.Store(true)
+	if err := driver.Put("s", []byte("2")); !errors.Is(err, ErrMirrorFailed) {
+		t.Errorf("Put with the mirror down: err = %v, want ErrMirrorFailed", err)
+	}
+	if v, _ := driver.Get("s"); string(v) != "2" {
+		t.Errorf("s = %q after a failed mirror write, want 2", v)
+	}
+	if s := driver.Stats().Mirror; s.Forwarded != 1 || s.Failed != 1 || s.LastError == "" {
+		t.Errorf("strict mirror stats = %+v, want 1 forwarded and 1 failed", s)
+	}
+	if _, err := Open(t.TempDir(), &Options{Mirror: flaky, MirrorQueue: -1}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Open with a negative mirror queue: err = %v, want ErrInvalidOption", err)
+	}
+}
+
+func TestDiskFull(t *testing.T) {
+	driver, err := Open(t.TempDir(), &Options{MinFreeSpace: 100, SpaceCheckEvery: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("2"))
+
+	var free uint64 = 50
+	driver.diskUsage = func(string) (uint64, uint64, error) { return 1 << 30, free, nil }
+	driver.checkSpace()
+	err = driver.Put("c", []byte("3"))
+	if !errors.Is(err, ErrDiskFull) || !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Put below the free space threshold = %v, want ErrDiskFull", err)
+	}
+	if v, err := driver.Get("a"); err != nil || string(v) != "1" {
+		t.Errorf("Get on a full disk = %q, %v", v, err)
+	}
+	if err := driver.Delete("b"); err != nil {
+		t.Errorf("Delete on a full disk = %v, want it to free space", err)
+	}
+	if reason := driver.Stats().DiskFull; !strings.Contains(reason, "50 bytes free") {
+		t.Errorf("Stats().DiskFull = %q, want the free space", reason)
+	}
+
+	// Writes are taken again once 1 MiB is free, so that the driver does
+	// not flap around the threshold
+	free = 200
+	driver.checkSpace()
+	if err := driver.Put("c", []byte("3")); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Put just over the threshold = %v, want ErrDiskFull", err)
+	}
+	free = 2 << 20
+	driver.checkSpace()
+	if err := driver.Put("c", []byte("3")); err != nil {
+		t.Errorf("Put once space was freed = %v", err)
+	}
+
+	// Running out of space while writing turns the driver read-only whatever
+	// the threshold
+	driver.noteWriteError(&os.PathError{Op: "write", Path: "c.tmp", Err: syscall.ENOSPC})
+	if _, full := driver.DiskFull(); !full {
+		t.Fatalf("DiskFull() after ENOSPC = false")
+	}
+	free = 500 << 10
+	driver.checkSpace()
+	if err := driver.Put("d", []byte("4")); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Put with %d bytes free after ENOSPC = %v, want ErrDiskFull", free, err)
+	}
+	free = 2 << 20
+	driver.checkSpace()
+	if err := driver.Put("d", []byte("4")); err != nil {
+		t.Errorf("Put once 2 MiB were free = %v", err)
+	}
+}
+
+func TestOpenValidatesOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+		opts Options
+		want string // the parameter named in the error
+	}{
+		{"no dir", "", Options{}, "data directory"},
+		{"degree 1", "d", Options{Degree: 1}, "degree"},
+		{"negative degree", "d", Options{Degree: -2}, "degree"},
+		{"negative cache", "d", Options{CacheSize: -1}, "cache size"},
+		{"negative change log", "d", Options{ChangeLogSize: -1}, "change log size"},
+		{"negative oplog size", "d", Options{OplogSize: -1}, "oplog size"},
+		{"negative oplog age", "d", Options{OplogMaxAge: -time.Second}, "oplog max age"},
+		{"negative slow op threshold", "d", Options{SlowOpThreshold: -time.Second}, "slow op threshold"},
+		{"empty shard dir", "d", Options{ShardDirs: []string{""}}, "shard dir"},
+		{"demoting without a cold dir", "d", Options{DemoteAfter: time.Hour}, "cold dir"},
+	}
+
+	base := t.TempDir()
+	for _, tt := range tests {
+		dir := tt.dir
+		if dir != "" {
+			dir = filepath.Join(base, tt.name)
+		}
+		_, err := Open(dir, &tt.opts)
+		if !errors.Is(err, ErrInvalidOption) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Open() error = %v, want ErrInvalidOption naming %s", tt.name, err, tt.want)
+		}
+		if dir != "" {
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Errorf("%s: Open() created the data directory", tt.name)
+			}
+		}
+	}
+
+	// Zero sizes get the defaults
+	driver, err := New(filepath.Join(base, "defaults"), nil, 0, 0)
+	if err != nil {
+		t.Fatalf("New() with zero sizes failed: %s", err)
+	}
+	if got := driver.CacheStats().Capacity; got != DefaultCacheSize {
+		t.Errorf("cache capacity = %d, want %d", got, DefaultCacheSize)
+	}
+	if got := driver.IndexStats().Degree; got != DefaultDegree {
+		t.Errorf("degree = %d, want %d", got, DefaultDegree)
+	}
+}
+
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, metaDir, snapshotFile)
+	driver, err := Open(dir, &Options{OplogSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	w := driver.Watch("")
+	driver.Put("a", []byte("1"))
+	<-w.Events()
+
+	if err := driver.Close(); err != nil {
+		t.Fatalf("Close() failed: %s", err)
+	}
+	if err := driver.Close(); err != nil {
+		t.Errorf("second Close() = %v, want nil", err)
+	}
+
+	// The watcher is ended and the snapshot saved
+	if _, ok := <-w.Events(); ok || !errors.Is(w.Err(), ErrClosed) {
+		t.Errorf("watcher after Close: open %v, Err() = %v, want closed with ErrClosed", ok, w.Err())
+	}
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Errorf("snapshot not saved on Close: %s", err)
+	}
+
+	if err := driver.Put("b", []byte("2")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Put after Close = %v, want ErrClosed", err)
+	}
+	if _, err := driver.Get("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get after Close = %v, want ErrClosed", err)
+	}
+	if err := driver.Delete("a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Delete after Close = %v, want ErrClosed", err)
+	}
+	if err := driver.Apply(Change{Op: OpPut, Key: "c"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Apply after Close = %v, want ErrClosed", err)
+	}
+
+	// A fresh driver picks up where the closed one stopped
+	reopened, err := Open(dir, &Options{OplogSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	defer reopened.Close()
+	if value, err := reopened.Get("a"); err != nil || string(value) != "1" {
+		t.Errorf("Get(a) after reopening = %q, %v", value, err)
+	}
+	if got := reopened.Seq(); got != 1 {
+		t.Errorf("Seq() after reopening = %d, want 1", got)
+	}
+}
+
+func TestSnapshotLifecycle(t *testing.T) {
+	dir := t.TempDir()
+
+	// A snapshot at the old default path is loaded and moved on Close
+	old, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	old.PutWithTTL("a", []byte("1"), time.Hour)
+	if err := old.SerializeBTree(filepath.Join(dir, legacySnapshotFile)); err != nil {
+		t.Fatalf("SerializeBTree failed: %s", err)
+	}
+	old.closed.Store(true) // drop the driver without saving
+	old.dirLock.release()
+	os.RemoveAll(filepath.Join(dir, metaDir)) // as the server left it
+
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Open() with a legacy snapshot failed: %s", err)
+	}
+	if keys, _ := driver.List(context.Background(), "", "", 0); len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("keys = %q, want [a]", keys)
+	}
+	if err := driver.Close(); err != nil {
+		t.Fatalf("Close() failed: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacySnapshotFile)); !os.IsNotExist(err) {
+		t.Errorf("legacy snapshot left after Close: %v", err)
+	}
+
+	// The expiry, held only in the B-tree, survives reopening
+	driver, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	if ttl, err := driver.TTL("a"); err != nil || ttl <= 0 {
+		t.Errorf("TTL(a) after reopening = %s, %v, want the expiry kept", ttl, err)
+	}
+	driver.Close()
+
+	// An explicit path is used as given, and a corrupt snapshot is moved
+	// aside and replaced on Close
+	custom := filepath.Join(t.TempDir(), "tree.json")
+	os.WriteFile(custom, []byte("{"), 0644)
+	driver, err = Open(dir, &Options{SnapshotPath: custom})
+	if err != nil {
+		t.Fatalf("Open() with a corrupt snapshot failed: %s", err)
+	}
+	if aside, _ := filepath.Glob(custom + ".corrupt-*"); len(aside) != 1 {
+		t.Errorf("corrupt snapshots set aside = %q, want one", aside)
+	}
+	driver.Put("b", []byte("2"))
+	driver.Close()
+	if _, err := os.Stat(custom); err != nil {
+		t.Errorf("snapshot not saved at %s: %s", custom, err)
+	}
+
+	// Loading a snapshot that does not exist is not an error
+	if err := driver.DeserializeBTree(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("DeserializeBTree of a missing file = %v, want nil", err)
+	}
+}
+
+func TestLegacySnapshotKey(t *testing.T) {
+	// A key named like the old snapshot, holding something that decodes as
+	// one, is a key once the driver has used the directory
+	snapshot := `[{"Key":"ghost","Value":"eA=="}]`
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	if err := driver.Put(legacySnapshotFile, []byte(snapshot)); err != nil {
+		t.Fatalf("Put(%s) failed: %s", legacySnapshotFile, err)
+	}
+	driver.Close()
+	os.Remove(filepath.Join(dir, metaDir, snapshotFile)) // lost, as after a crash
+
+	for i := 0; i < 2; i++ {
+		driver, err = Open(dir, nil)
+		if err != nil {
+			t.Fatalf("Failed to reopen: %s", err)
+		}
+		if value, err := driver.Get(legacySnapshotFile); err != nil || string(value) != snapshot {
+			t.Errorf("Get(%s) = %q, %v, want the value put", legacySnapshotFile, value, err)
+		}
+		if _, err := driver.Get("ghost"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get(ghost) = %v, want ErrKeyNotFound", err)
+		}
+		driver.Close()
+	}
+
+	// Nor is a file there that cannot be a snapshot taken for one in a
+	// directory the driver never opened
+	for _, value := range []string{`[]`, `[{"Key":"../x"}]`, `[{"Key":"a"},{"Key":"a"}]`, `{"a":1}`} {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, legacySnapshotFile), []byte(value), 0644)
+		driver, err := Open(dir, nil)
+		if err != nil {
+			t.Fatalf("Open() with %s as %s failed: %s", value, legacySnapshotFile, err)
+		}
+		if got, err := driver.Get(legacySnapshotFile); err != nil || string(got) != value {
+			t.Errorf("Get(%s) = %q, %v, want %s", legacySnapshotFile, got, err, value)
+		}
+		if n, _ := driver.Count(context.Background(), ""); n != 1 {
+			t.Errorf("Count = %d, want only %s", n, legacySnapshotFile)
+		}
+		driver.Close()
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("a", []byte("1"))
+	driver.Put("b", []byte("2"))
+	driver.Close()
+
+	// Changed behind the driver's back while it was closed
+	os.Remove(filepath.Join(dir, "a"))
+	os.WriteFile(filepath.Join(dir, "c"), []byte("3"), 0644)
+
+	driver, err = Open(dir, &Options{SkipReconcile: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	if keys, _ := driver.List(context.Background(), "", "", 0); len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("keys with SkipReconcile = %q, want the snapshot's [a b]", keys)
+	}
+	driver.Close()
+
+	driver, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	defer driver.Close()
+	if keys, _ := driver.List(context.Background(), "", "", 0); len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Errorf("keys after reconciling = %q, want [b c]", keys)
+	}
+	if value, err := driver.Get("c"); err != nil || string(value) != "3" {
+		t.Errorf("Get(c) = %q, %v, want 3", value, err)
+	}
+	if stats := driver.Stats(); stats.ReconcileAdded != 1 || stats.ReconcileRemoved != 1 {
+		t.Errorf("reconcile counts = %d added, %d removed, want 1 and 1", stats.ReconcileAdded, stats.ReconcileRemoved)
+	}
+}
+
+func TestSnapshotEvery(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(t.TempDir(), "tree.json")
+	driver, err := Open(dir, &Options{SnapshotPath: snapshot, SnapshotEvery: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+
+	waitFor := func(what string, cond func(Stats) bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond(driver.Stats()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s: %+v", what, driver.Stats())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Nothing changed, so nothing is saved
+	time.Sleep(50 * time.Millisecond)
+	if got := driver.Stats().Snapshots; got != 0 {
+		t.Errorf("Snapshots with no changes = %d, want 0", got)
+	}
+
+	driver.Put("a", []byte("1"))
+	waitFor("a snapshot", func(s Stats) bool { return s.Snapshots == 1 })
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Errorf("snapshot not saved: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := driver.Stats().Snapshots; got != 1 {
+		t.Errorf("Snapshots after an idle spell = %d, want 1", got)
+	}
+
+	// A failed save is counted and retried
+	os.Remove(snapshot)
+	os.Mkdir(snapshot, 0755)
+	driver.Put("b", []byte("2"))
+	waitFor("two failures", func(s Stats) bool { return s.SnapshotFailures >= 2 })
+	os.Remove(snapshot)
+	waitFor("the retry", func(s Stats) bool { return s.Snapshots == 2 })
+
+	if err := driver.Close(); err != nil {
+		t.Fatalf("Close() failed: %s", err)
+	}
+	if _, err := Open(dir, &Options{SnapshotEvery: -time.Second}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Open() with a negative SnapshotEvery = %v, want ErrInvalidOption", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := jitter(time.Minute); d < 54*time.Second || d > 66*time.Second {
+			t.Fatalf("jitter(1m) = %s, want within 10%%", d)
+		}
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, &Options{CacheSize: 2, WriteBack: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	onDisk := func(key string) string {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(dir, key))
+		if err != nil {
+			return "<none>"
+		}
+		return string(data)
+	}
+
+	// Writes stay in memory, and reads see the newest of them
+	driver.Put("a", []byte("1"))
+	driver.Put("a", []byte("2"))
+	if got := onDisk("a"); got != "<none>" {
+		t.Errorf("a on disk before a flush = %q", got)
+	}
+	if value, err := driver.Get("a"); err != nil || string(value) != "2" {
+		t.Errorf("Get(a) = %q, %v, want 2", value, err)
+	}
+	if stats := driver.Stats(); stats.DirtyValues != 1 || stats.Keys != 1 {
+		t.Errorf("stats = %d dirty of %d keys, want 1 of 1", stats.DirtyValues, stats.Keys)
+	}
+
+	// Evicting a held back value writes it
+	driver.Put("b", []byte("3"))
+	driver.Put("c", []byte("4"))
+	if got := onDisk("a"); got != "2" {
+		t.Errorf("a on disk after its eviction = %q, want 2", got)
+	}
+
+	// A deleted key is never written
+	driver.Put("d", []byte("5"))
+	driver.Delete("d")
+	if err := driver.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %s", err)
+	}
+	for key, want := range map[string]string{"b": "3", "c": "4", "d": "<none>"} {
+		if got := onDisk(key); got != want {
+			t.Errorf("%s on disk after Flush = %q, want %q", key, got, want)
+		}
+	}
+
+	// Close writes what is left
+	driver.Put("e", []byte("6"))
+	driver.Close()
+	if got := onDisk("e"); got != "6" {
+		t.Errorf("e on disk after Close = %q, want 6", got)
+	}
+
+	// The flusher writes within the window on its own
+	driver, err = Open(dir, &Options{WriteBack: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	defer driver.Close()
+	driver.Put("f", []byte("7"))
+	deadline := time.Now().Add(2 * time.Second)
+	for onDisk("f") != "7" {
+		if time.Now().After(deadline) {
+			t.Fatalf("f not flushed by the background flusher")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHooks(t *testing.T) {
+	driver, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+
+	// A synchronous hook has run when the write returns, outside the lock
+	var puts []string
+	driver.OnPut(func(key string, value []byte) {
+		current, _ := driver.Get(key)
+		puts = append(puts, key+"="+string(value)+"/"+string(current))
+	})
+	driver.OnPut(func(key string, value []byte) { panic("boom") })
+
+	var mu sync.Mutex
+	var deletes []string
+	driver.OnDelete(func(key string) {
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		deletes = append(deletes, key)
+		mu.Unlock()
+	}, Async())
+
+	driver.Put("a", []byte("1"))
+	driver.PutBatch([]BatchEntry{{Key: "b", Value: []byte("2")}, {Key: "c", Value: []byte("3")}})
+	driver.Put("a", []byte("1")) // unchanged, so no call
+	if got := strings.Join(puts, ","); got != "a=1/1,b=2/2,c=3/3" {
+		t.Errorf("OnPut calls = %s, want a=1/1,b=2/2,c=3/3", got)
+	}
+
+	// Async calls keep their order and Close waits for them
+	driver.Delete("b")
+	driver.Delete("missing")
+	driver.Delete("a")
+	if err := driver.Close(); err != nil {
+		t.Fatalf("Close() failed: %s", err)
+	}
+	if got := strings.Join(deletes, ","); got != "b,a" {
+		t.Errorf("OnDelete calls after Close = %s, want b,a", got)
+	}
+}
+
+// gzipCodec compresses the output of another codec
+type gzipCodec struct{ SnapshotCodec }
+
+func (c gzipCodec) Name() string { return "gzip+" + c.SnapshotCodec.Name() }
+
+func (c gzipCodec) Encode(w io.Writer, items []Item) error {
+	zw := gzip.NewWriter(w)
+	if err := c.SnapshotCodec.Encode(zw, items); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func (c gzipCodec) Decode(r io.Reader) ([]Item, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.SnapshotCodec.Decode(zr)
+}
+
+func TestSnapshotCodecs(t *testing.T) {
+	dir := t.TempDir()
+	snapshot := filepath.Join(dir, metaDir, snapshotFile)
+
+	reopen := func(codec SnapshotCodec) (*Driver, error) {
+		return Open(dir, &Options{SnapshotCodec: codec})
+	}
+
+	for _, codec := range []SnapshotCodec{gzipCodec{GobCodec{}}, GobCodec{}, JSONCodec{}} {
+		driver, err := reopen(codec)
+		if err != nil {
+			t.Fatalf("Open() with %s failed: %s", codec.Name(), err)
+		}
+		driver.PutWithTTL("k", []byte(codec.Name()), time.Hour)
+		driver.Close()
+
+		data, _ := os.ReadFile(snapshot)
+		if want := snapshotMagic + codec.Name() + "\n"; !strings.HasPrefix(string(data), want) {
+			t.Errorf("%s snapshot starts %q, want %q", codec.Name(), data[:min(len(data), 30)], want)
+		}
+
+		// Any driver reads the built-in codecs; only one set up with it
+		// reads a custom codec
+		driver, err = reopen(nil)
+		if _, custom := codec.(gzipCodec); custom {
+			if err == nil || !strings.Contains(err.Error(), "unknown codec") {
+				t.Errorf("Open() of a %s snapshot without its codec = %v, want unknown codec", codec.Name(), err)
+			}
+			driver, err = reopen(codec)
+		}
+		if err != nil {
+			t.Fatalf("reopening after %s failed: %s", codec.Name(), err)
+		}
+		if ttl, err := driver.TTL("k"); err != nil || ttl <= 0 {
+			t.Errorf("TTL(k) after a %s snapshot = %s, %v", codec.Name(), ttl, err)
+		}
+		driver.Close()
+		os.Remove(snapshot)
+	}
+
+	// An empty tree, and a snapshot saved before there were headers
+	driver, _ := reopen(GobCodec{})
+	driver.Put("k", nil)
+	driver.Delete("k")
+	driver.Close()
+	if _, err := os.Stat(snapshot); err != nil {
+		t.Fatalf("empty gob snapshot not saved: %s", err)
+	}
+	if driver, err := reopen(nil); err != nil || driver.IndexStats().Items != 0 {
+		t.Fatalf("reopening an empty gob snapshot = %v", err)
+	} else {
+		driver.Close()
+	}
+	os.WriteFile(filepath.Join(dir, "old"), []byte("old"), 0644)
+	os.WriteFile(snapshot, []byte(fmt.Sprintf(`[{"Key":"old","Value":"b2xk","ExpiresAt":%d}]`, time.Now().Add(time.Hour).UnixNano())), 0644)
+	driver, err := reopen(nil)
+	if err != nil {
+		t.Fatalf("Open() of a headerless snapshot failed: %s", err)
+	}
+	if value, err := driver.Get("old"); err != nil || string(value) != "old" {
+		t.Errorf("Get(old) = %q, %v", value, err)
+	}
+	if ttl, err := driver.TTL("old"); err != nil || ttl <= 0 {
+		t.Errorf("TTL(old) from a headerless snapshot = %s, %v", ttl, err)
+	}
+	driver.Close()
+}
+
+func TestTypedAccessors(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	type profile struct {
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+	}
+	if err := PutAs(driver, "struct", profile{"alice", 30}); err != nil {
+		t.Fatalf("PutAs(struct) failed: %s", err)
+	}
+	if p, err := GetAs[profile](driver, "struct"); err != nil || p != (profile{"alice", 30}) {
+		t.Errorf("GetAs[profile] = %+v, %v", p, err)
+	}
+	if raw, _ := driver.Get("struct"); string(raw) != `{"name":"alice","age":30}` {
+		t.Errorf("stored value = %s", raw)
+	}
+
+	PutAs(driver, "map", map[string]int{"a": 1, "b": 2})
+	if m, err := GetAs[map[string]int](driver, "map"); err != nil || len(m) != 2 || m["b"] != 2 {
+		t.Errorf("GetAs[map] = %v, %v", m, err)
+	}
+	PutAs(driver, "slice", []string{"x", "y"})
+	if s, err := GetAs[[]string](driver, "slice"); err != nil || strings.Join(s, ",") != "x,y" {
+		t.Errorf("GetAs[slice] = %v, %v", s, err)
+	}
+
+	if _, err := GetAs[profile](driver, "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetAs of a missing key = %v, want ErrKeyNotFound", err)
+	}
+	driver.Put("text", []byte("not json"))
+	if _, err := GetAs[profile](driver, "text"); err == nil || !strings.Contains(err.Error(), "text") {
+		t.Errorf("GetAs of a non-JSON value = %v, want an error naming the key", err)
+	}
+	if err := PutAs(driver, "chan", make(chan int)); err == nil {
+		t.Errorf("PutAs of a channel succeeded")
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	user := []byte(`{"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}, "age": {"type": "integer", "minimum": 0}}}`)
+	if err := driver.SetSchema("user:", user); err != nil {
+		t.Fatalf("SetSchema failed: %s", err)
+	}
+	if err := driver.SetSchema("bad:", []byte(`{"type": 5}`)); !errors.Is(err, ErrInvalidSchema) {
+		t.Errorf("SetSchema with an invalid schema = %v, want ErrInvalidSchema", err)
+	}
+	if err := driver.SetSchema("ref:", []byte(`{"$ref": "file:///etc/passwd"}`)); !errors.Is(err, ErrInvalidSchema) {
+		t.Errorf("SetSchema referring to a file = %v, want ErrInvalidSchema", err)
+	}
+
+	if err := driver.Put("user:1", []byte(`{"name": "ada", "age": 36}`)); err != nil {
+		t.Errorf("Put of a matching value failed: %s", err)
+	}
+	if err := driver.Put("other", []byte(`not json`)); err != nil {
+		t.Errorf("Put outside the prefix failed: %s", err)
+	}
+	err = driver.Put("user:2", []byte(`{"name": "bob", "age": -1}`))
+	var schemaErr *SchemaError
+	if !errors.Is(err, ErrSchemaViolation) || !errors.As(err, &schemaErr) {
+		t.Fatalf("Put of a value failing the schema = %v, want a *SchemaError", err)
+	}
+	if len(schemaErr.Violations) != 1 || schemaErr.Violations[0].Path != "/age" || schemaErr.Prefix != "user:" {
+		t.Errorf("violations = %+v for prefix %q, want one at /age", schemaErr.Violations, schemaErr.Prefix)
+	}
+	if _, err := driver.PutBatch([]BatchEntry{{Key: "user:3", Value: []byte(`{"name": "c"}`)}, {Key: "user:4", Value: []byte(`[]`)}}); !errors.Is(err, ErrSchemaViolation) {
+		t.Errorf("PutBatch with a failing value = %v, want ErrSchemaViolation", err)
+	}
+	if ok, _ := driver.Has("user:3"); ok {
+		t.Errorf("PutBatch wrote entries before the failing one")
+	}
+	if err := driver.Create("user:5", []byte(`{}`)); !errors.Is(err, ErrSchemaViolation) {
+		t.Errorf("Create of a value failing the schema = %v, want ErrSchemaViolation", err)
+	}
+	driver.Close()
+
+	// Schemas survive a restart, and can be made advisory
+	driver, err = Open(dir, &Options{SchemaAdvisory: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	defer driver.Close()
+	var compact bytes.Buffer
+	json.Compact(&compact, user)
+	if schemas := driver.Schemas(); len(schemas) != 1 || string(schemas["user:"]) != compact.String() {
+		t.Errorf("Schemas() after reopening = %q", schemas)
+	}
+	if err := driver.Put("user:2", []byte(`{}`)); err != nil {
+		t.Errorf("Put with advisory schemas = %v, want it stored", err)
+	}
+	if err := driver.SetSchema("user:", nil); err != nil || len(driver.Schemas()) != 0 {
+		t.Errorf("removing the schema = %v, leaving %q", err, driver.Schemas())
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	driver, err := Open(t.TempDir(), &Options{MaxValueSize: 4})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+
+	if err := driver.Put("", []byte("v")); !errors.Is(err, ErrEmptyKey) || !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put with an empty key = %v, want ErrEmptyKey and ErrInvalidKey", err)
+	}
+
+	if err := driver.Create("k", []byte("1")); err != nil {
+		t.Fatalf("Create() failed: %s", err)
+	}
+	if err := driver.Create("k", []byte("2")); !errors.Is(err, ErrKeyExists) {
+		t.Errorf("second Create() = %v, want ErrKeyExists", err)
+	}
+	driver.PutWithTTL("gone", []byte("x"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if err := driver.Create("gone", []byte("y")); err != nil {
+		t.Errorf("Create() over an expired key = %v", err)
+	}
+
+	if err := driver.Put("k", []byte("12345")); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Put over MaxValueSize = %v, want ErrValueTooLarge", err)
+	}
+	if _, err := driver.PutBatch([]BatchEntry{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("12345")}}); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("PutBatch over MaxValueSize = %v, want ErrValueTooLarge", err)
+	}
+	if _, err := driver.PutReader("k", strings.NewReader("12345")); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("PutReader over MaxValueSize = %v, want ErrValueTooLarge", err)
+	}
+	if _, err := driver.PutReader("r", strings.NewReader("1234")); err != nil {
+		t.Errorf("PutReader at MaxValueSize = %v", err)
+	}
+	if value, _ := driver.Get("k"); string(value) != "1" {
+		t.Errorf("Get(k) after rejected writes = %q, want 1", value)
+	}
+	if ok, _ := driver.Has("a"); ok {
+		t.Errorf("PutBatch wrote part of a rejected batch")
+	}
+}
+
+// TestOpenInChild opens the directory named by ZEPHYRUS_TEST_OPEN_DIR and
+// exits without closing it. It is run in a child process by TestDirLock.
+func TestOpenInChild(t *testing.T) {
+	dir := os.Getenv("ZEPHYRUS_TEST_OPEN_DIR")
+	if dir == "" {
+		t.Skip("run by TestDirLock")
+	}
+	if _, err := Open(dir, &Options{Logger: lumber.NewBasicLogger(os.Stderr, lumber.WARN)}); err != nil {
+		fmt.Print(err)
+		os.Exit(3)
+	}
+	fmt.Print("opened")
+	os.Exit(0)
+}
+
+func TestDirLock(t *testing.T) {
+	dir := t.TempDir()
+	openInChild := func() string {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestOpenInChild$")
+		cmd.Env = append(os.Environ(), "ZEPHYRUS_TEST_OPEN_DIR="+dir)
+		out, _ := cmd.Output()
+		return string(out)
+	}
+
+	// The child exits holding the lock, which must not keep others out
+	if out := openInChild(); out != "opened" {
+		t.Fatalf("first open in a child = %q, want it opened", out)
+	}
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Open() after the holder exited = %v, want the stale lock taken over", err)
+	}
+
+	want := fmt.Sprintf("database is locked by PID %d", os.Getpid())
+	if out := openInChild(); out != want {
+		t.Errorf("open in a child while locked = %q, want %q", out, want)
+	}
+	if _, err := Open(dir, nil); !errors.Is(err, ErrLocked) {
+		t.Errorf("second Open() in this process = %v, want ErrLocked", err)
+	}
+
+	// The lock file cannot be replaced through a key of its name
+	if err := driver.Put(lockFile, []byte("x")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Put(%s) = %v, want ErrInvalidKey", lockFile, err)
+	}
+	if _, err := driver.PutReader(lockFile, strings.NewReader("x")); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("PutReader(%s) = %v, want ErrInvalidKey", lockFile, err)
+	}
+	if out := openInChild(); out != want {
+		t.Errorf("open in a child after a put to %s = %q, want %q", lockFile, out, want)
+	}
+
+	driver.Close()
+	if out := openInChild(); out != "opened" {
+		t.Errorf("open in a child after Close = %q, want it opened", out)
+	}
+}
+
+func TestIndexStats(t *testing.T) {
+	driver, err := New(t.TempDir(), nil, 1, 4)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("ab", []byte("123"))
+	driver.Put("cd", []byte("45"))
+	driver.PutReader("ef", strings.NewReader("streamed")) // kept on disk only
+
+	stats := driver.IndexStats()
+	want := IndexStats{Items: 3, Degree: 4, ResidentValues: 2, KeyBytes: 6, ValueBytes: 5, CachedBytes: 2}
+	want.ApproxBytes = 6 + 5 + 3*itemOverhead
+	if stats != want {
+		t.Errorf("IndexStats() = %+v, want %+v", stats, want)
+	}
+	if got := driver.Stats().Index; got != want {
+		t.Errorf("Stats().Index = %+v, want %+v", got, want)
+	}
+}
+
+// BenchmarkPutFullCache measures Put when every write evicts a cached value,
+// logging to a file as a server would
+func BenchmarkPutFullCache(b *testing.B) {
+	dir := b.TempDir()
+	logFile, err := os.Create(filepath.Join(b.TempDir(), "bench.log"))
+	if err != nil {
+		b.Fatalf("Failed to create log file: %s", err)
+	}
+	driver, err := New(dir, lumber.NewBasicLogger(logFile, lumber.INFO), 64, 16)
+	if err != nil {
+		b.Fatalf("Failed to create driver: %s", err)
+	}
+	value := bytes.Repeat([]byte("v"), 128)
+	for i := 0; i < 64; i++ {
+		driver.Put("warm"+strconv.Itoa(i), value)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := driver.Put("key"+strconv.Itoa(i%4096), value); err != nil {
+			b.Fatalf("Put failed: %s", err)
+		}
+	}
+}
+
+// BenchmarkSetAdd measures adding a member to sets of growing sizes, each
+// call being linear in the size of the set
+func BenchmarkSetAdd(b *testing.B) {
+	for _, size := range []int{100, 1000, 10000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			driver, err := New(b.TempDir(), lumber.NewBasicLogger(os.Stderr, lumber.WARN), 64, 16)
+			if err != nil {
+				b.Fatalf("Failed to create driver: %s", err)
+			}
+			defer driver.Close()
+			members := make([]int, size)
+			for i := range members {
+				members[i] = i
+			}
+			value, _ := json.Marshal(members)
+			driver.Put("set", value)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				member := []byte(strconv.Itoa(size + i%2))
+				if _, err := driver.SetAdd("set", member); err != nil {
+					b.Fatalf("SetAdd failed: %s", err)
+				}
+				driver.SetRemove("set", member)
+			}
+		})
+	}
+}
+
+func TestRevisions(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	revision := func(key string) uint64 {
+		t.Helper()
+		info, err := driver.Stat(key)
+		if err != nil {
+			t.Fatalf("Stat(%s) failed: %s", key, err)
+		}
+		return info.Revision
+	}
+
+	// Every write moves a key to a higher revision, even back to an old value
+	driver.Put("a", []byte("A"))
+	first := revision("a")
+	driver.Put("a", []byte("B"))
+	driver.Put("a", []byte("A"))
+	if got := revision("a"); got <= first {
+		t.Errorf("revision after A->B->A = %d, want above %d", got, first)
+	}
+
+	// Conditional writes only apply at the revision given
+	current := revision("a")
+	if _, err := driver.PutIfRevision("a", []byte("C"), current-1); !errors.Is(err, ErrRevisionMismatch) {
+		t.Errorf("PutIfRevision at a stale revision error = %v, want ErrRevisionMismatch", err)
+	}
+	next, err := driver.PutIfRevision("a", []byte("C"), current)
+	if err != nil || next <= current {
+		t.Errorf("PutIfRevision at the current revision = %d, %v", next, err)
+	}
+	if _, err := driver.PutIfRevision("b", []byte("new"), 0); err != nil {
+		t.Errorf("PutIfRevision(b, 0) for a missing key failed: %s", err)
+	}
+	if _, err := driver.PutIfRevision("b", []byte("new"), 0); !errors.Is(err, ErrRevisionMismatch) {
+		t.Errorf("PutIfRevision(b, 0) for an existing key error = %v, want ErrRevisionMismatch", err)
+	}
+	if err := driver.DeleteIfRevision("b", revision("b")+1); !errors.Is(err, ErrRevisionMismatch) {
+		t.Errorf("DeleteIfRevision at a wrong revision error = %v, want ErrRevisionMismatch", err)
+	}
+	if err := driver.DeleteIfRevision("b", revision("b")); err != nil {
+		t.Errorf("DeleteIfRevision at the current revision failed: %s", err)
+	}
+
+	// Revisions survive a restart
+	last := revision("a")
+	driver.Close()
+	driver, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	if got := revision("a"); got != last {
+		t.Errorf("revision after a restart = %d, want %d", got, last)
+	}
+	driver.Put("c", []byte("C"))
+	if got := revision("c"); got <= last {
+		t.Errorf("revision of a new key after a restart = %d, want above %d", got, last)
+	}
+
+	// After a crash the snapshot may be behind, so every key moves on
+	last = revision("c")
+	driver.Close()
+	state, _ := json.Marshal(revisionState{Reserved: last})
+	os.WriteFile(filepath.Join(dir, metaDir, revisionFile), state, 0644)
+	driver, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	defer driver.Close()
+	if got := revision("a"); got <= last {
+		t.Errorf("revision after a crash = %d, want above %d", got, last)
+	}
+
+	// Reloading a snapshot never takes a key back either
+	snapshot := filepath.Join(t.TempDir(), "old.json")
+	driver.SerializeBTree(snapshot)
+	last = revision("a")
+	if err := driver.DeserializeBTree(snapshot); err != nil {
+		t.Fatalf("DeserializeBTree failed: %s", err)
+	}
+	if got := revision("a"); got <= last {
+		t.Errorf("revision after reloading a snapshot = %d, want above %d", got, last)
+	}
+}
+
+func TestDeleteIfMatch(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("a", []byte("A"))
+	info, err := driver.Stat("a")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if err := driver.DeleteIfMatch("a", hashValue([]byte("B"))); !errors.Is(err, ErrRevisionMismatch) {
+		t.Errorf("DeleteIfMatch with another ETag error = %v, want ErrRevisionMismatch", err)
+	}
+	if err := driver.DeleteIfMatch("a", info.ETag); err != nil {
+		t.Errorf("DeleteIfMatch with the current ETag failed: %s", err)
+	}
+	if err := driver.DeleteIfMatch("a", info.ETag); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("DeleteIfMatch of a deleted key error = %v, want ErrKeyNotFound", err)
+	}
+
+	// AnyETag only asks for the key to exist
+	if err := driver.DeleteIfMatch("b", AnyETag); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("DeleteIfMatch(b, *) of a missing key error = %v, want ErrKeyNotFound", err)
+	}
+	driver.Put("b", []byte("B"))
+	if err := driver.DeleteIfMatch("b", AnyETag); err != nil {
+		t.Errorf("DeleteIfMatch(b, *) failed: %s", err)
+	}
+
+	// The ETag of a file the B-tree does not know yet is read from disk
+	os.WriteFile(filepath.Join(dir, "c"), []byte("C"), 0644)
+	if err := driver.DeleteIfMatch("c", hashValue([]byte("C"))); err != nil {
+		t.Errorf("DeleteIfMatch of a file added behind the driver's back failed: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "c")); !os.IsNotExist(err) {
+		t.Errorf("file of c still there after DeleteIfMatch: %v", err)
+	}
+}
+
+func TestKeyTimes(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	stat := func(d *Driver, key string) KeyInfo {
+		t.Helper()
+		info, err := d.Stat(key)
+		if err != nil {
+			t.Fatalf("Stat(%s) failed: %s", key, err)
+		}
+		return info
+	}
+
+	before := time.Now()
+	driver.Put("a", []byte("1"))
+	first := stat(driver, "a")
+	if first.CreatedAt.Before(before) || !first.UpdatedAt.Equal(first.CreatedAt) {
+		t.Errorf("times after the first Put = %v, %v", first.CreatedAt, first.UpdatedAt)
+	}
+
+	// Updates keep the creation time
+	time.Sleep(time.Millisecond)
+	driver.PutReader("a", strings.NewReader("2"))
+	second := stat(driver, "a")
+	if !second.CreatedAt.Equal(first.CreatedAt) || !second.UpdatedAt.After(first.UpdatedAt) {
+		t.Errorf("times after an update = %v, %v, want %v and later than %v", second.CreatedAt, second.UpdatedAt, first.CreatedAt, first.UpdatedAt)
+	}
+
+	// Neither file times nor a restart change them
+	os.Chtimes(filepath.Join(dir, "a"), time.Now(), time.Unix(0, 0))
+	driver.Close()
+	driver, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	defer driver.Close()
+	if got := stat(driver, "a"); !got.CreatedAt.Equal(second.CreatedAt) || !got.UpdatedAt.Equal(second.UpdatedAt) {
+		t.Errorf("times after a restart = %v, %v, want %v, %v", got.CreatedAt, got.UpdatedAt, second.CreatedAt, second.UpdatedAt)
+	}
+	if r, err := driver.GetReader("a"); err != nil || !r.ModTime().Equal(second.UpdatedAt) {
+		t.Errorf("GetReader(a).ModTime() = %v, %v, want %v", r.ModTime(), err, second.UpdatedAt)
+	} else {
+		r.Close()
+	}
+
+	// Export and Import carry them over
+	var buf bytes.Buffer
+	if _, err := driver.Export(&buf, ""); err != nil {
+		t.Fatalf("Export failed: %s", err)
+	}
+	other, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer other.Close()
+	if _, err := other.Import(&buf, ImportOverwrite); err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	if got := stat(other, "a"); !got.CreatedAt.Equal(second.CreatedAt) || !got.UpdatedAt.Equal(second.UpdatedAt) {
+		t.Errorf("times after Import = %v, %v, want %v, %v", got.CreatedAt, got.UpdatedAt, second.CreatedAt, second.UpdatedAt)
+	}
+}
+
+func TestExpirySweeper(t *testing.T) {
+	driver, err := Open(t.TempDir(), &Options{SweepEvery: 5 * time.Millisecond, SweepBatch: 2})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	w := driver.Watch("")
+	defer w.Close()
+
+	for i := 0; i < 5; i++ {
+		driver.PutWithTTL(fmt.Sprintf("gone%d", i), []byte("x"), time.Millisecond)
+	}
+	driver.PutWithTTL("kept", []byte("x"), time.Hour)
+	// A key given a longer expiry since is not removed at the old one
+	driver.PutWithTTL("renewed", []byte("x"), time.Millisecond)
+	driver.Expire("renewed", time.Hour)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for driver.Stats().ExpiredSwept < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := driver.Stats().ExpiredSwept; got != 5 {
+		t.Fatalf("ExpiredSwept = %d, want 5", got)
+	}
+	if keys, _ := driver.List(context.Background(), "", "", 0); len(keys) != 2 {
+		t.Errorf("keys left = %q, want kept and renewed", keys)
+	}
+	if entries, _ := os.ReadDir(driver.dir); len(entries) != 4 {
+		t.Errorf("data directory holds %d entries, want the 2 kept keys, the lock and metadata", len(entries))
+	}
+
+	// Every removal reaches watchers as an expiry
+	expiries := 0
+	for expiries < 5 {
+		select {
+		case ev := <-w.Events():
+			if ev.Op == OpExpire {
+				expiries++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("got %d expire events, want 5", expiries)
+		}
+	}
+}
+
+func TestExpireEvents(t *testing.T) {
+	driver, err := Open(t.TempDir(), &Options{OplogSize: 100})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	w := driver.Watch("")
+	defer w.Close()
+	var deleted []string
+	driver.OnDelete(func(key string) { deleted = append(deleted, key) })
+
+	next := func() Event {
+		t.Helper()
+		select {
+		case ev := <-w.Events():
+			return ev
+		case <-time.After(time.Second):
+			t.Fatalf("no event")
+			return Event{}
+		}
+	}
+
+	// A key re-created right after expiring: the expiry comes first, with
+	// the expiry that passed
+	driver.PutWithTTL("k", []byte("old"), time.Millisecond)
+	first := next()
+	time.Sleep(2 * time.Millisecond)
+	if err := driver.Put("k", []byte("new")); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	if ev := next(); ev.Op != OpExpire || ev.Key != "k" || !ev.ExpiresAt.Equal(first.ExpiresAt) || ev.ExpiresAt.IsZero() {
+		t.Errorf("event after expiry = %+v, want an expire at %v", ev, first.ExpiresAt)
+	}
+	if ev := next(); ev.Op != OpPut || string(ev.Value) != "new" || !ev.ExpiresAt.IsZero() {
+		t.Errorf("event after expire = %+v, want the put of new with no expiry", ev)
+	}
+
+	// Deleting an expired key reports the expiry, not a delete
+	driver.PutWithTTL("d", []byte("x"), time.Millisecond)
+	next()
+	time.Sleep(2 * time.Millisecond)
+	if err := driver.Delete("d"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Delete of an expired key error = %v, want ErrKeyNotFound", err)
+	}
+	if ev := next(); ev.Op != OpExpire || ev.Key != "d" {
+		t.Errorf("event after Delete of an expired key = %+v, want an expire", ev)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("OnDelete calls = %q, want one per expired key", deleted)
+	}
+
+	// The change log and the oplog hold the same order
+	want := []Op{OpPut, OpExpire, OpPut, OpPut, OpExpire}
+	changes, _, err := driver.Changes(0, 0)
+	if err != nil {
+		t.Fatalf("Changes failed: %s", err)
+	}
+	logged, _, err := driver.Oplog(0, 0)
+	if err != nil {
+		t.Fatalf("Oplog failed: %s", err)
+	}
+	for _, got := range [][]Change{changes, logged} {
+		if len(got) != len(want) {
+			t.Fatalf("changes = %+v, want ops %v", got, want)
+		}
+		for i, c := range got {
+			if c.Op != want[i] {
+				t.Errorf("change %d op = %s, want %s", i, c.Op, want[i])
+			}
+		}
+		if c := got[1]; c.Key != "k" || c.ExpiresAt != first.ExpiresAt.UnixNano() {
+			t.Errorf("expire change = %+v, want k with the expiry that passed", c)
+		}
+	}
+
+	// A replica applying the changes follows, and replaying an expiry does
+	// not remove the key written since
+	replica, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create replica: %s", err)
+	}
+	defer replica.Close()
+	for _, c := range changes {
+		if err := replica.Apply(c); err != nil {
+			t.Fatalf("Apply(%+v) failed: %s", c, err)
+		}
+	}
+	if err := replica.Apply(changes[1]); err != nil {
+		t.Errorf("Apply of an expire for a missing key error = %v, want nil", err)
+	}
+	if v, err := replica.Get("k"); err != nil || string(v) != "new" {
+		t.Errorf("replica Get(k) = %q, %v, want new", v, err)
+	}
+	if _, err := replica.Get("d"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("replica Get(d) error = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestExpiringWithin(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		driver.Put(fmt.Sprintf("forever%d", i), []byte("x"))
+	}
+	driver.PutWithTTL("c", []byte("x"), 3*time.Minute)
+	driver.PutWithTTL("a", []byte("x"), time.Minute)
+	driver.PutWithTTL("b", []byte("x"), 2*time.Minute)
+	driver.PutWithTTL("later", []byte("x"), 2*time.Hour)
+	driver.PutWithTTL("gone", []byte("x"), time.Millisecond)
+	if n := driver.expiries.Len(); n != 5 {
+		t.Errorf("expiry index holds %d entries, want only the 5 keys with an expiry", n)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	names := func(keys []ExpiringKey) []string {
+		var out []string
+		for _, k := range keys {
+			out = append(out, k.Key)
+		}
+		return out
+	}
+	keys, err := driver.ExpiringWithin(time.Hour, 0)
+	if err != nil {
+		t.Fatalf("ExpiringWithin failed: %s", err)
+	}
+	if got := names(keys); !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("ExpiringWithin(1h) = %q, want a, b and c, soonest first", got)
+	}
+	if ttl := keys[0].TTL; ttl <= 59*time.Second || ttl > time.Minute {
+		t.Errorf("TTL of a = %s, want just under a minute", ttl)
+	}
+	if keys, _ := driver.ExpiringWithin(time.Hour, 2); !slices.Equal(names(keys), []string{"a", "b"}) {
+		t.Errorf("ExpiringWithin(1h, 2) = %q, want a and b", names(keys))
+	}
+
+	// Changing, removing and overwriting expiries, and deleting, move or
+	// drop the keys' entries
+	driver.Expire("a", 10*time.Minute)
+	driver.Expire("b", 0)
+	driver.Put("c", []byte("y"))
+	driver.Expire("later", 30*time.Second)
+	driver.PutWithTTL("forever1", []byte("y"), 5*time.Minute)
+	driver.Delete("forever1")
+	if keys, _ := driver.ExpiringWithin(time.Hour, 0); !slices.Equal(names(keys), []string{"later", "a"}) {
+		t.Errorf("ExpiringWithin after changes = %q, want later then a", names(keys))
+	}
+	if n := driver.expiries.Len(); n != 3 {
+		t.Errorf("expiry index holds %d entries, want 3 for a, later and the expired gone", n)
+	}
+
+	// The index is rebuilt from the snapshot
+	driver.Close()
+	driver, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	defer driver.Close()
+	if keys, _ := driver.ExpiringWithin(time.Hour, 0); !slices.Equal(names(keys), []string{"later", "a"}) {
+		t.Errorf("ExpiringWithin after reopening = %q, want later then a", names(keys))
+	}
+}
+
+func TestLocks(t *testing.T) {
+	driver, err := Open(t.TempDir(), &Options{SweepEvery: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+
+	token, err := driver.AcquireLock("jobs", time.Minute)
+	if err != nil || token == "" {
+		t.Fatalf("AcquireLock = %q, %v, want a token", token, err)
+	}
+	_, err = driver.AcquireLock("jobs", time.Minute)
+	var held *LockHeldError
+	if !errors.As(err, &held) || !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("AcquireLock of a held lock = %v, want a *LockHeldError", err)
+	}
+	if held.Name != "jobs" || held.TTL <= 59*time.Second || held.TTL > time.Minute {
+		t.Errorf("LockHeldError = %+v, want jobs with just under a minute left", held)
+	}
+	if _, err := driver.AcquireLock("other", time.Minute); err != nil {
+		t.Errorf("AcquireLock of another lock failed: %s", err)
+	}
+
+	// Only the holder's token renews and releases the lock
+	if err := driver.RenewLock("jobs", "stale", time.Hour); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("RenewLock with the wrong token = %v, want ErrLockNotHeld", err)
+	}
+	if err := driver.ReleaseLock("jobs", "stale"); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("ReleaseLock with the wrong token = %v, want ErrLockNotHeld", err)
+	}
+	if err := driver.RenewLock("jobs", token, time.Hour); err != nil {
+		t.Errorf("RenewLock failed: %s", err)
+	}
+	if ttl, _ := driver.TTL(LockNamespace + NamespaceSeparator + "jobs"); ttl <= time.Minute {
+		t.Errorf("TTL of the lock key after renewing = %s, want about an hour", ttl)
+	}
+	if err := driver.ReleaseLock("jobs", token); err != nil {
+		t.Errorf("ReleaseLock failed: %s", err)
+	}
+	if err := driver.ReleaseLock("jobs", token); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("ReleaseLock twice = %v, want ErrLockNotHeld", err)
+	}
+
+	// A lock whose lease ran out can be taken, and its old holder cannot
+	// free the new one's
+	old, _ := driver.AcquireLock("jobs", time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	if err := driver.RenewLock("jobs", old, time.Minute); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("RenewLock after the lease ran out = %v, want ErrLockNotHeld", err)
+	}
+	if _, err := driver.AcquireLock("jobs", time.Minute); err != nil {
+		t.Errorf("AcquireLock after the lease ran out failed: %s", err)
+	}
+	if err := driver.ReleaseLock("jobs", old); !errors.Is(err, ErrLockNotHeld) {
+		t.Errorf("ReleaseLock by the old holder = %v, want ErrLockNotHeld", err)
+	}
+
+	// The sweeper removes abandoned locks
+	driver.AcquireLock("abandoned", time.Millisecond)
+	path := driver.keyPath(LockNamespace + NamespaceSeparator + "abandoned")
+	deadline := time.Now().Add(5 * time.Second)
+	for _, err := os.Stat(path); err == nil && time.Now().Before(deadline); _, err = os.Stat(path) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("abandoned lock's file after its lease: %v, want it removed", err)
+	}
+
+	for _, name := range []string{"", "a/b"} {
+		if _, err := driver.AcquireLock(name, time.Minute); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("AcquireLock(%q) = %v, want ErrInvalidKey", name, err)
+		}
+	}
+	if _, err := driver.AcquireLock("x", 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("AcquireLock without a lease = %v, want ErrInvalidTTL", err)
+	}
+}
+
+func TestReservedKeys(t *testing.T) {
+	driver, err := Open(t.TempDir(), &Options{MaxKeys: 1})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	ctx := context.Background()
+	lock := LockNamespace + NamespaceSeparator + "jobs"
+
+	// Locks do not count against MaxKeys
+	if _, err := driver.AcquireLock("jobs", time.Minute); err != nil {
+		t.Fatalf("AcquireLock failed: %s", err)
+	}
+	if err := driver.Put("a", []byte("1")); err != nil {
+		t.Fatalf("Put of the only key allowed failed: %s", err)
+	}
+	if _, err := driver.AcquireLock("other", time.Minute); err != nil {
+		t.Errorf("AcquireLock with the key limit reached failed: %s", err)
+	}
+	if err := driver.Put("b", []byte("2")); !errors.Is(err, ErrTooManyKeys) {
+		t.Errorf("Put over the limit = %v, want ErrTooManyKeys", err)
+	}
+	if count, _ := driver.KeyCount(); count != 1 {
+		t.Errorf("KeyCount = %d, want the lock keys left out", count)
+	}
+
+	// Nor are they listed, counted, batch read or exported
+	if !Reserved(lock) || Reserved("a") || Reserved(LockNamespace) {
+		t.Errorf("Reserved(%s), Reserved(a), Reserved(%s) = %v, %v, %v", lock, LockNamespace, Reserved(lock), Reserved("a"), Reserved(LockNamespace))
+	}
+	if keys, _ := driver.List(ctx, "", "", 0); strings.Join(keys, " ") != "a" {
+		t.Errorf("List = %q, want [a]", keys)
+	}
+	if keys, _ := driver.ListDesc(ctx, LockNamespace, "", 0); len(keys) != 0 {
+		t.Errorf("ListDesc of the lock namespace = %q, want none", keys)
+	}
+	if n, _ := driver.Count(ctx, ""); n != 1 {
+		t.Errorf("Count = %d, want 1", n)
+	}
+	if values, _ := driver.GetBatch([]string{"a", lock}); len(values) != 1 {
+		t.Errorf("GetBatch = %q, want only a", values)
+	}
+	var out bytes.Buffer
+	if n, _ := driver.Export(&out, ""); n != 1 || strings.Contains(out.String(), "token") {
+		t.Errorf("Export = %d %s, want only a", n, out.String())
+	}
+	driver.ReadTxn(func(tx *ReadTxn) error {
+		if keys, _ := tx.List(ctx, "", "", 0); strings.Join(keys, " ") != "a" {
+			t.Errorf("ReadTxn List = %q, want [a]", keys)
+		}
+		return nil
+	})
+
+	// Their changes reach no watcher, change log or replica snapshot
+	watcher := driver.Watch("")
+	defer watcher.Close()
+	token, err := driver.AcquireLock("published", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %s", err)
+	}
+	if err := driver.ReleaseLock("published", token); err != nil {
+		t.Fatalf("ReleaseLock failed: %s", err)
+	}
+	select {
+	case ev := <-watcher.Events():
+		t.Errorf("watcher saw %s of %s", ev.Op, ev.Key)
+	default:
+	}
+	changes, _, _ := driver.Changes(0, 100)
+	for _, c := range changes {
+		if Reserved(c.Key) {
+			t.Errorf("change log holds %s of %s", c.Op, c.Key)
+		}
+	}
+	driver.Snapshot(func(c Change) error {
+		if Reserved(c.Key) {
+			t.Errorf("replica snapshot holds %s", c.Key)
+		}
+		return nil
+	})
+
+	// PutReserved and GetReserved reach only the reserved namespaces
+	record := IdempotencyNamespace + NamespaceSeparator + "r"
+	if err := driver.PutReserved(record, []byte("kept"), time.Minute); err != nil {
+		t.Fatalf("PutReserved failed: %s", err)
+	}
+	if v, err := driver.GetReserved(record); err != nil || string(v) != "kept" {
+		t.Errorf("GetReserved = %q, %v, want kept", v, err)
+	}
+	if err := driver.PutReserved("b", []byte("2"), 0); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("PutReserved of a plain key = %v, want ErrInvalidKey", err)
+	}
+	if _, err := driver.GetReserved("a"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("GetReserved of a plain key = %v, want ErrInvalidKey", err)
+	}
+	select {
+	case ev := <-watcher.Events():
+		t.Errorf("watcher saw %s of %s", ev.Op, ev.Key)
+	default:
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("users:1", []byte("12345"))
+	driver.Put("usersx", []byte("outside the namespace"))
+
+	if err := driver.SetQuota("users", -1, 0); !errors.Is(err, ErrInvalidQuota) {
+		t.Errorf("SetQuota with a negative limit = %v, want ErrInvalidQuota", err)
+	}
+	if err := driver.SetQuota("a:b", 1, 1); !errors.Is(err, ErrInvalidQuota) {
+		t.Errorf("SetQuota for a namespace with the separator = %v, want ErrInvalidQuota", err)
+	}
+	if err := driver.SetQuota("users", 20, 2); err != nil {
+		t.Fatalf("SetQuota failed: %s", err)
+	}
+	want := NamespaceUsage{Quota: Quota{MaxBytes: 20, MaxKeys: 2}, Bytes: 5, Keys: 1}
+	if got := driver.Quotas()["users"]; got != want {
+		t.Errorf("usage counted by SetQuota = %+v, want %+v", got, want)
+	}
+
+	if err := driver.Put("users:2", []byte("0123456789")); err != nil {
+		t.Errorf("Put within the quota failed: %s", err)
+	}
+	err = driver.Put("users:3", []byte("x"))
+	var quotaErr *QuotaError
+	if !errors.Is(err, ErrQuotaExceeded) || !errors.As(err, &quotaErr) {
+		t.Fatalf("Put over the key limit = %v, want a *QuotaError", err)
+	}
+	if quotaErr.Namespace != "users" || quotaErr.Keys != 3 || quotaErr.Bytes != 16 {
+		t.Errorf("QuotaError = %+v, want 3 keys and 16 bytes in users", quotaErr)
+	}
+	if err := driver.Put("users:2", []byte("0123456789abcdef")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("overwrite over the byte limit = %v, want ErrQuotaExceeded", err)
+	}
+	if err := driver.Put("users:2", []byte("abc")); err != nil {
+		t.Errorf("overwrite shrinking the value failed: %s", err)
+	}
+	if _, err := driver.PutReader("users:3", strings.NewReader("far too long to fit")); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("PutReader over the quota = %v, want ErrQuotaExceeded", err)
+	}
+	if _, err := driver.PutBatch([]BatchEntry{{Key: "users:2", Value: []byte("ab")}, {Key: "users:3", Value: []byte("c")}}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("PutBatch over the quota = %v, want ErrQuotaExceeded", err)
+	}
+	if value, _ := driver.Get("users:2"); string(value) != "abc" {
+		t.Errorf("PutBatch wrote %q before failing the quota", value)
+	}
+	if err := driver.Put("other:1", []byte("no quota here")); err != nil {
+		t.Errorf("Put in a namespace without a quota failed: %s", err)
+	}
+
+	if err := driver.Delete("users:1"); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	want = NamespaceUsage{Quota: Quota{MaxBytes: 20, MaxKeys: 2}, Bytes: 3, Keys: 1}
+	if got := driver.Stats().Namespaces["users"]; got != want {
+		t.Errorf("usage in Stats after a delete = %+v, want %+v", got, want)
+	}
+	driver.Close()
+
+	// Quotas survive a restart, with their usage counted again
+	driver, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %s", err)
+	}
+	defer driver.Close()
+	if got := driver.Quotas()["users"]; got != want {
+		t.Errorf("usage after reopening = %+v, want %+v", got, want)
+	}
+	if err := driver.SetQuota("users", 0, 0); err != nil || len(driver.Quotas()) != 0 {
+		t.Errorf("removing the quota = %v, leaving %+v", err, driver.Quotas())
+	}
+	if err := driver.Put("users:9", []byte("no limit any more")); err != nil {
+		t.Errorf("Put after removing the quota failed: %s", err)
+	}
+}
+
+func TestTextIndex(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("ticket:1", []byte(`{"title": "Refund request", "body": "Please refund my order. Refund!"}`))
+	driver.Put("ticket:2", []byte(`{"title": "Login broken", "body": "Cannot log in", "meta": {"agent": "Ada"}}`))
+	driver.Put("plain", []byte(`refund`))
+	if _, err := driver.Search("refund", 0); !errors.Is(err, ErrNoTextIndex) {
+		t.Errorf("Search without an index = %v, want ErrNoTextIndex", err)
+	}
+
+	if err := driver.EnableTextIndex([]string{"title", "body", "meta.agent"}); err != nil {
+		t.Fatalf("EnableTextIndex failed: %s", err)
+	}
+	driver.PutReader("ticket:3", strings.NewReader(`{"title": "Another REFUND", "body": "for Ada"}`))
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"refund", "ticket:1 ticket:3"},
+		{"REFUND order", "ticket:1"},
+		{"ada", "ticket:2 ticket:3"},
+		{"refund ada", "ticket:3"},
+		{"missing", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		keys, err := driver.Search(tt.query, 0)
+		if err != nil {
+			t.Fatalf("Search(%q) failed: %s", tt.query, err)
+		}
+		if got := strings.Join(keys, " "); got != tt.want {
+			t.Errorf("Search(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+	if keys, _ := driver.Search("refund", 1); len(keys) != 1 || keys[0] != "ticket:1" {
+		t.Errorf("Search with limit 1 = %v, want the most frequent match", keys)
+	}
+
+	// Rewrites and deletes drop the old postings
+	driver.Put("ticket:1", []byte(`{"title": "Resolved"}`))
+	driver.Delete("ticket:3")
+	if keys, _ := driver.Search("refund", 0); len(keys) != 0 {
+		t.Errorf("Search after rewriting and deleting = %v, want none", keys)
+	}
+	stats := driver.Stats().TextIndex
+	if stats == nil || stats.Keys != 2 || stats.Terms != 7 || stats.Postings != 7 {
+		t.Errorf("text index stats = %+v, want 2 keys with 7 terms", stats)
+	}
+
+	if err := driver.EnableTextIndex(nil); err != nil || driver.Stats().TextIndex != nil {
+		t.Errorf("turning the index off = %v, leaving %+v", err, driver.Stats().TextIndex)
+	}
+}
+
+func TestNumericIndex(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("item:a", []byte(`{"price": 10}`))
+	driver.Put("item:b", []byte(`{"price": 25.5}`))
+	driver.Put("item:c", []byte(`{"price": "cheap"}`))
+	driver.Put("item:d", []byte(`{"name": "no price"}`))
+	driver.Put("item:e", []byte(`not json`))
+	if _, err := driver.QueryIndexRange("price", 0, 100, 0); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("QueryIndexRange without an index = %v, want ErrNoIndex", err)
+	}
+
+	if err := driver.CreateNumericIndex("price", "price"); err != nil {
+		t.Fatalf("CreateNumericIndex failed: %s", err)
+	}
+	driver.Put("item:f", []byte(`{"price": 25.5}`))
+	driver.PutReader("item:g", strings.NewReader(`{"price": 60}`))
+
+	tests := []struct {
+		min, max float64
+		limit    int
+		want     string
+	}{
+		{10, 50, 0, "item:a item:b item:f"},
+		{25.5, 25.5, 0, "item:b item:f"},
+		{11, 100, 2, "item:b item:f"},
+		{0, 9, 0, ""},
+		{50, 10, 0, ""},
+	}
+	for _, tt := range tests {
+		keys, err := driver.QueryIndexRange("price", tt.min, tt.max, tt.limit)
+		if err != nil {
+			t.Fatalf("QueryIndexRange(%v, %v) failed: %s", tt.min, tt.max, err)
+		}
+		if got := strings.Join(keys, " "); got != tt.want {
+			t.Errorf("QueryIndexRange(%v, %v, %d) = %q, want %q", tt.min, tt.max, tt.limit, got, tt.want)
+		}
+	}
+
+	// Changing the field moves the key; removing it or the key drops it
+	driver.Put("item:a", []byte(`{"price": 70}`))
+	driver.Put("item:b", []byte(`{"price": null}`))
+	driver.Delete("item:f")
+	if keys, _ := driver.QueryIndexRange("price", 0, 1000, 0); strings.Join(keys, " ") != "item:g item:a" {
+		t.Errorf("QueryIndexRange after updates = %v, want item:g item:a", keys)
+	}
+	if stats := driver.Stats().NumericIndexes["price"]; stats.Field != "price" || stats.Keys != 2 {
+		t.Errorf("numeric index stats = %+v, want 2 keys", stats)
+	}
+
+	driver.DropIndex("price")
+	if _, err := driver.QueryIndexRange("price", 0, 100, 0); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("QueryIndexRange after DropIndex = %v, want ErrNoIndex", err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	if !hardLinks {
+		t.Skip("deduplication needs hard links")
+	}
+	dir := t.TempDir()
+	if _, err := Open(dir, &Options{DedupThreshold: -1}); !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Open with a negative dedup threshold = %v, want ErrInvalidOption", err)
+	}
+	driver, err := Open(dir, &Options{DedupThreshold: 8})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+
+	shared := []byte("the same large value")
+	driver.Put("a", shared)
+	driver.Put("b", shared)
+	driver.PutReader("c", bytes.NewReader(shared))
+	driver.Put("small", []byte("tiny"))
+
+	blob := filepath.Join(dir, blobDir, hashValue(shared))
+	fi, err := os.Stat(blob)
+	if err != nil {
+		t.Fatalf("Blob not written: %s", err)
+	}
+	if n := linkCount(fi); n != 4 {
+		t.Errorf("Blob has %d links, want 4", n)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		kfi, err := os.Stat(driver.keyPath(key))
+		if err != nil || !os.SameFile(fi, kfi) {
+			t.Errorf("File of %s is not the blob", key)
+		}
+	}
+	if kfi, _ := os.Stat(driver.keyPath("small")); linkCount(kfi) != 1 {
+		t.Errorf("Value below the threshold was deduplicated")
+	}
+
+	var buf bytes.Buffer
+	if n, err := driver.Export(&buf, ""); err != nil || n != 4 {
+		t.Fatalf("Export = %d, %v, want 4 keys", n, err)
+	}
+	if got := strings.Count(buf.String(), base64.StdEncoding.EncodeToString(shared)); got != 3 {
+		t.Errorf("Export holds the shared value %d times, want 3", got)
+	}
+
+	// The blob goes with the last key holding it
+	driver.Delete("a")
+	driver.Put("b", []byte("another large value"))
+	if _, err := os.Stat(blob); err != nil {
+		t.Errorf("Blob removed while c still holds it: %v", err)
+	}
+	driver.Delete("c")
+	if _, err := os.Stat(blob); !os.IsNotExist(err) {
+		t.Errorf("Blob left after its last key was deleted: %v", err)
+	}
+
+	// Compact removes blobs no key links to
+	orphan := filepath.Join(dir, blobDir, "orphan")
+	os.WriteFile(orphan, []byte("nobody holds this"), 0644)
+	if err := driver.Compact(); err != nil {
+		t.Fatalf("Compact failed: %s", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Compact left an orphan blob: %v", err)
+	}
+
+	// A corrupt blob is reported for every key sharing it
+	driver.Put("x", shared)
+	driver.Put("y", shared)
+	corrupt, err := driver.Verify(context.Background())
+	if err != nil || len(corrupt) != 0 {
+		t.Fatalf("Verify = %v, %v, want nothing corrupt", corrupt, err)
+	}
+	os.WriteFile(blob, []byte("bit rot"), 0644)
+	corrupt, err = driver.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("Verify failed: %s", err)
+	}
+	if len(corrupt) != 2 || corrupt[0].Key != "x" || corrupt[1].Key != "y" || corrupt[0].Blob != hashValue(shared) {
+		t.Errorf("Verify = %+v, want x and y with their blob", corrupt)
+	}
+}
+
+func TestReadTxn(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("order:1", []byte("pending"))
+	driver.PutReader("order:1:item:1", strings.NewReader("2 apples"))
+	driver.PutReader("order:1:item:2", strings.NewReader("1 pear"))
+
+	var done *ReadTxn
+	err := driver.ReadTxn(func(tx *ReadTxn) error {
+		done = tx
+
+		// Writes go ahead while the transaction is open, and it does not
+		// see them
+		driver.Put("order:1", []byte("shipped"))
+		driver.PutReader("order:1:item:1", strings.NewReader("3 apples"))
+		driver.Delete("order:1:item:2")
+		driver.Put("order:1:item:3", []byte("1 plum"))
+
+		want := map[string]string{"order:1": "pending", "order:1:item:1": "2 apples", "order:1:item:2": "1 pear"}
+		for key, v := range want {
+			if got, err := tx.Get(key); err != nil || string(got) != v {
+				t.Errorf("tx.Get(%s) = %q, %v, want %q", key, got, err, v)
+			}
+		}
+		if _, err := tx.Get("order:1:item:3"); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("tx.Get of a key written later = %v, want ErrKeyNotFound", err)
+		}
+
+		keys, err := tx.List(context.Background(), "order:1:", "", 0)
+		if err != nil || strings.Join(keys, " ") != "order:1:item:1 order:1:item:2" {
+			t.Errorf("tx.List = %v, %v", keys, err)
+		}
+		var got []string
+		err = tx.Range(context.Background(), "order:", func(key string, value []byte) bool {
+			got = append(got, key+"="+string(value))
+			return true
+		})
+		if err != nil || strings.Join(got, ",") != "order:1=pending,order:1:item:1=2 apples,order:1:item:2=1 pear" {
+			t.Errorf("tx.Range = %v, %v", got, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadTxn failed: %s", err)
+	}
+
+	if _, err := done.Get("order:1"); !errors.Is(err, ErrTxnDone) {
+		t.Errorf("Get after the transaction = %v, want ErrTxnDone", err)
+	}
+	if len(driver.txns) != 0 {
+		t.Errorf("%d transactions still open", len(driver.txns))
+	}
+	if got, _ := driver.Get("order:1:item:1"); string(got) != "3 apples" {
+		t.Errorf("Get after the transaction = %q, want the later write", got)
+	}
+
+	wantErr := errors.New("callback failed")
+	if err := driver.ReadTxn(func(*ReadTxn) error { return wantErr }); err != wantErr {
+		t.Errorf("ReadTxn = %v, want the callback's error", err)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("u:1", []byte(`{"name": "Ann", "active": true, "address": {"city": "Oslo"}, "tags": ["a", "b"]}`))
+	driver.Put("u:2", []byte(`{"name": null, "score": 1.5}`))
+	driver.Put("u:3", []byte(`[1, 2]`))
+	driver.Put("u:4", []byte("plain text"))
+	driver.Put("v:1", []byte(`{"name": "elsewhere"}`))
+
+	var buf bytes.Buffer
+	stats, err := driver.ExportCSV(&buf, "u:", []string{"name", "address.city", "active", "tags", "score"})
+	if err != nil {
+		t.Fatalf("ExportCSV failed: %s", err)
+	}
+	want := "key,name,address.city,active,tags,score\n" +
+		"u:1,Ann,Oslo,true,\"[\"\"a\"\",\"\"b\"\"]\",\n" +
+		"u:2,,,,,1.5\n"
+	if buf.String() != want {
+		t.Errorf("ExportCSV wrote %q, want %q", buf.String(), want)
+	}
+	if stats != (CSVStats{Rows: 2, Skipped: 2}) {
+		t.Errorf("ExportCSV stats = %+v, want 2 rows and 2 skipped", stats)
+	}
+}
+
+func TestImportBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	bdb, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to create bbolt file: %s", err)
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		users, _ := tx.CreateBucket([]byte("users"))
+		users.Put([]byte("1"), []byte(`{"name": "ann"}`))
+		users.Put([]byte{0xff, 0x00}, []byte("binary key"))
+		archived, _ := users.CreateBucket([]byte("archived"))
+		archived.Put([]byte("2"), []byte("old"))
+		for i := 0; i < 250; i++ {
+			archived.Put([]byte(fmt.Sprintf("bulk%03d", i)), []byte(strconv.Itoa(i)))
+		}
+		other, _ := tx.CreateBucket([]byte("other"))
+		other.Put([]byte("x"), []byte("not imported"))
+		return nil
+	})
+	bdb.Close()
+	if err != nil {
+		t.Fatalf("Failed to fill bbolt file: %s", err)
+	}
+
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+	if _, err := driver.ImportBolt(path, map[string]string{"missing": "m"}); err == nil {
+		t.Errorf("ImportBolt of a missing bucket succeeded")
+	}
+	stats, err := driver.ImportBolt(path, map[string]string{"users": "accounts"})
+	if err != nil {
+		t.Fatalf("ImportBolt failed: %s", err)
+	}
+	if stats.Imported != 253 || stats.Failed != 0 {
+		t.Errorf("ImportBolt = %+v, want 253 imported", stats)
+	}
+
+	binaryKey := "accounts:" + EncodeKeySegment("accounts:", []byte{0xff, 0x00})
+	for key, want := range map[string]string{
+		"accounts:1":                `{"name": "ann"}`,
+		"accounts:archived:2":       "old",
+		"accounts:archived:bulk249": "249",
+		binaryKey:                   "binary key",
+	} {
+		if got, err := driver.Get(key); err != nil || string(got) != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if raw, err := DecodeKeySegment(strings.TrimPrefix(binaryKey, "accounts:")); err != nil || !bytes.Equal(raw, []byte{0xff, 0x00}) {
+		t.Errorf("DecodeKeySegment = %v, %v", raw, err)
+	}
+	if n, _ := driver.Count(context.Background(), "other"); n != 0 {
+		t.Errorf("Bucket not named was imported")
+	}
+}
+
+func TestDeleteIfUnmodifiedSince(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	driver.Put("k", []byte("v"))
+	written := time.Now()
+	if err := driver.DeleteIfUnmodifiedSince("k", written.Add(-time.Hour)); !errors.Is(err, ErrRevisionMismatch) {
+		t.Errorf("Delete of a key written since = %v, want ErrRevisionMismatch", err)
+	}
+	// Only whole seconds count, as HTTP dates carry no more
+	if err := driver.DeleteIfUnmodifiedSince("k", written.Truncate(time.Second)); err != nil {
+		t.Errorf("Delete of a key written within the second = %v", err)
+	}
+	if err := driver.DeleteIfUnmodifiedSince("k", written); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Delete of a deleted key = %v, want ErrKeyNotFound", err)
+	}
+
+	// A key whose write time is not known counts as modified
+	os.WriteFile(filepath.Join(dir, "disk"), []byte("v"), 0644)
+	if err := driver.DeleteIfUnmodifiedSince("disk", time.Now().Add(time.Hour)); !errors.Is(err, ErrRevisionMismatch) {
+		t.Errorf("Delete of a key with no write time = %v, want ErrRevisionMismatch", err)
+	}
+	_, _, err := driver.PutReaderIfUnmodifiedSince(context.Background(), "new", strings.NewReader("v"), 0, time.Now())
+	if !errors.Is(err, ErrRevisionMismatch) {
+		t.Errorf("Put of a missing key = %v, want ErrRevisionMismatch", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	doc := `{"status": "active", "age": 42, "verified": true, "name": "Ann", "tags": ["a", "b"],
+		"address": {"city": "Oslo"}, "nothing": null, "odd key": 1}`
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`json.status == "active" && json.age > 30`, true},
+		{`json.status == "active" && json.age > 50`, false},
+		{`json.age >= 42 && json.age <= 42 && json.age != 41`, true},
+		{`json.age < 1e2 && json.age > -1.5`, true},
+		{`json.name < "Bob" && json.name >= "Ann"`, true},
+		{`json.verified`, true},
+		{`!json.verified || json.age == 42`, true},
+		{`!(json.verified && json.age == 42)`, false},
+		{`json.tags[1] == "b" && json.address.city == "Oslo"`, true},
+		{`json["odd key"] == 1 && json.address["city"] == "Oslo"`, true},
+		{`json.nothing == null && json.missing != null`, false},
+		{`json.missing != "x"`, false},
+		{`!json.missing`, true},
+		{`json.tags[5] == "c" || json.age > "40"`, false},
+		{`json.age == json.age && "x" == "x"`, true},
+		{`json.status == "act\u0069ve"`, true},
+		{`false || true && false`, false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.expr)
+		if err != nil {
+			t.Errorf("ParseFilter(%s) failed: %v", tt.expr, err)
+			continue
+		}
+		if got := f.Match([]byte(doc)); got != tt.want {
+			t.Errorf("%s = %t, want %t", tt.expr, got, tt.want)
+		}
+	}
+
+	if f, _ := ParseFilter(`json == "text"`); f.Match([]byte("text")) || !f.Match([]byte(`"text"`)) {
+		t.Errorf("A value that is not JSON matched, or a JSON string did not")
+	}
+
+	for _, tt := range []struct {
+		expr string
+		pos  int
+	}{
+		{``, 0},
+		{`json.age >`, 10},
+		{`json.age > 30 &&`, 16},
+		{`json.age = 30`, 9},
+		{`status == "active"`, 0},
+		{`json.name == "Ann`, 13},
+		{`(json.age > 1`, 13},
+		{`json.tags[-1] == 1`, 10},
+		{`json. == 1`, 6},
+		{`json.a == 1 json.b`, 12},
+		{`json.a == 1 $`, 12},
+	} {
+		_, err := ParseFilter(tt.expr)
+		var ferr *FilterError
+		if !errors.As(err, &ferr) || !errors.Is(err, ErrInvalidFilter) || ferr.Pos != tt.pos {
+			t.Errorf("ParseFilter(%s) = %v, want an error at position %d", tt.expr, err, tt.pos)
+		}
+	}
+}
+
+func TestListMatching(t *testing.T) {
+	driver, dir := setupDriver(t)
+	defer os.RemoveAll(dir)
+
+	for i := 1; i <= 6; i++ {
+		driver.Put(fmt.Sprintf("u:%d", i), []byte(fmt.Sprintf(`{"n": %d}`, i)))
+	}
+	driver.Put("u:7", []byte("not json"))
+	filter, _ := ParseFilter(`json.n > 2 && json.n != 5`)
+
+	keys, err := driver.ListMatching(context.Background(), "u:", "u:3", 2, filter)
+	if err != nil || strings.Join(keys, " ") != "u:4 u:6" {
+		t.Errorf("ListMatching = %v, %v, want u:4 u:6", keys, err)
+	}
+	keys, err = driver.ListDescMatching(context.Background(), "u:", "", 0, filter)
+	if err != nil || strings.Join(keys, " ") != "u:6 u:4 u:3" {
+		t.Errorf("ListDescMatching = %v, %v, want u:6 u:4 u:3", keys, err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := driver.ExportMatching(&buf, []string{"u:"}, filter); err != nil || n != 3 || strings.Count(buf.String(), "\n") != 4 {
+		t.Errorf("ExportMatching = %d, %v:\n%s", n, err, buf.String())
+	}
+	buf.Reset()
+	stats, err := driver.ExportCSVMatching(&buf, []string{"u:"}, []string{"n"}, filter)
+	if err != nil || buf.String() != "key,n\nu:3,3\nu:4,4\nu:6,6\n" || stats != (CSVStats{Rows: 3}) {
+		t.Errorf("ExportCSVMatching = %+v, %v:\n%s", stats, err, buf.String())
+	}
+}
+
+// errInjected is the I/O error crash tests make a failpoint return
+var errInjected = errors.New("injected failure")
+
+// crashed is panicked with at a failpoint to stop a write as a crash would
+type crashed struct{}
+
+// crash abandons d as if its process had been killed: background work
+// stops, nothing more is saved and the directory lock is dropped, as the
+// kernel would drop it
+func crash(d *Driver) {
+	d.closed.Store(true)
+	d.closeOnce.Do(func() {
+		close(d.stop)
+		d.background.Wait()
+	})
+	if d.oplog != nil && d.oplog.file != nil {
+		d.oplog.file.Close()
+	}
+	d.dirLock.release()
+}
+
+// truncateTail cuts the newest file matching pattern short by n bytes, or
+// to half its size when n is 0, leaving it as a torn write would
+func truncateTail(pattern string, n int64) {
+	paths, _ := filepath.Glob(pattern)
+	if len(paths) == 0 {
+		return
+	}
+	path := paths[len(paths)-1]
+	if fi, err := os.Stat(path); err == nil {
+		if n == 0 {
+			n = fi.Size() / 2
+		}
+		os.Truncate(path, max(fi.Size()-n, 0))
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	const before, after = "old value", "new value"
+	opts := &Options{OplogSize: 1000}
+
+	put := func(d *Driver) error { return d.Put("k", []byte(after)) }
+	putReader := func(d *Driver) error {
+		_, err := d.PutReader("k", strings.NewReader(after))
+		return err
+	}
+	putAndSave := func(d *Driver) error {
+		if err := put(d); err != nil {
+			return err
+		}
+		d.periodicSnapshot()
+		return nil
+	}
+
+	// What a crash leaves half written at each failpoint
+	tears := map[string]func(dir string){
+		fpTempWritten:     func(dir string) { truncateTail(filepath.Join(dir, "*.tmp"), 0) },
+		fpSnapshotWritten: func(dir string) { truncateTail(filepath.Join(dir, metaDir, "*.tmp"), 0) },
+		fpOplogAppended:   func(dir string) { truncateTail(filepath.Join(dir, oplogDir, "*.log"), 3) },
+	}
+
+	tests := []struct {
+		point string
+		name  string
+		op    func(*Driver) error
+		// Whether a failure injected there is reported to the caller, and
+		// so must leave the old value
+		reported bool
+	}{
+		{fpTempWritten, "Put", put, true},
+		{fpBeforeRename, "Put", put, true},
+		{fpBeforeRename, "PutReader", putReader, true},
+		{fpRenamed, "Put", put, false},
+		{fpRenamed, "PutReader", putReader, false},
+		{fpSnapshotWritten, "Put", putAndSave, false},
+		{fpOplogAppended, "Put", put, false},
+		{fpOplogAppended, "PutReader", putReader, false},
+	}
+
+	for _, tt := range tests {
+		for _, crashing := range []bool{false, true} {
+			mode := "error"
+			if crashing {
+				mode = "crash"
+			}
+			t.Run(tt.point+"/"+tt.name+"/"+mode, func(t *testing.T) {
+				dir := t.TempDir()
+				d, err := Open(dir, opts)
+				if err != nil {
+					t.Fatalf("Open failed: %s", err)
+				}
+				d.Put("k", []byte(before))
+				d.Put("other", []byte("untouched"))
+				if err := d.Close(); err != nil {
+					t.Fatalf("Close failed: %s", err)
+				}
+				if d, err = Open(dir, opts); err != nil {
+					t.Fatalf("Reopen failed: %s", err)
+				}
+
+				hit := false
+				d.failHook = func(name string) error {
+					if name != tt.point {
+						return nil
+					}
+					hit = true
+					if crashing {
+						if tear := tears[name]; tear != nil {
+							tear(dir)
+						}
+						panic(crashed{})
+					}
+					return errInjected
+				}
+				func() {
+					defer func() {
+						if r := recover(); r != nil && r != (crashed{}) {
+							panic(r)
+						}
+					}()
+					err = tt.op(d)
+				}()
+				if !hit {
+					t.Fatalf("The failpoint was not reached")
+				}
+
+				if crashing {
+					crash(d)
+				} else {
+					if tt.reported && !errors.Is(err, errInjected) {
+						t.Errorf("error = %v, want the injected one", err)
+					}
+					if got, _ := d.Get("k"); string(got) != before && string(got) != after {
+						t.Errorf("Get(k) after the failure = %q, want the old or new value", got)
+					}
+					d.failHook = nil
+					d.Close()
+				}
+
+				d, err = Open(dir, opts)
+				if err != nil {
+					t.Fatalf("Open after the failure failed: %s", err)
+				}
+				defer d.Close()
+
+				got, err := d.Get("k")
+				switch {
+				case err != nil:
+					t.Errorf("Get(k) after reopening failed: %s", err)
+				case !crashing && tt.reported && string(got) != before:
+					t.Errorf("Get(k) after a failed write = %q, want %q", got, before)
+				case string(got) != before && string(got) != after:
+					t.Errorf("Get(k) after reopening = %q, want %q or %q", got, before, after)
+				}
+				if got, err := d.Get("other"); err != nil || string(got) != "untouched" {
+					t.Errorf("Get(other) after reopening = %q, %v", got, err)
+				}
+				if keys, _ := d.List(context.Background(), "", "", 0); !slices.Equal(keys, []string{"k", "other"}) {
+					t.Errorf("keys after reopening = %q, want k and other", keys)
+				}
+
+				// The log carries on past whatever was cut short
+				if err := d.Put("next", []byte("v")); err != nil {
+					t.Errorf("Put after reopening failed: %s", err)
+				}
+				changes, _, err := d.Oplog(0, 0)
+				if err != nil || len(changes) == 0 || changes[len(changes)-1].Key != "next" {
+					t.Errorf("Oplog after reopening = %v, %v, want it to end with the new put", changes, err)
+				}
+			})
+		}
+	}
+}
+
+// nastyKeys are keys that have broken key handling elsewhere: empty, path
+// segments, separators, NULs, over-long and invalid UTF-8
+var nastyKeys = []string{
+	"", ".", "..", "../escape", "a/b", "/abs", `a\b`, `..\..\secret`, "a\x00b",
+	"\xff\xfe", "key.tmp", ".hidden", "~mzxw6", "nul", "CON.txt", "a b",
+	strings.Repeat("k", MaxKeyLen), strings.Repeat("k", MaxKeyLen+1), "ключ", "user:42",
+}
+
+func FuzzKeyRoundTrip(f *testing.F) {
+	for _, key := range nastyKeys {
+		f.Add(key, []byte("value"))
+	}
+	f.Add("bin", []byte{0, 1, 0xfe, 0xff})
+	f.Add("empty", []byte{})
+
+	root := f.TempDir()
+	dir := filepath.Join(root, "data")
+	driver, err := Open(dir, nil)
+	if err != nil {
+		f.Fatalf("Open failed: %s", err)
+	}
+	f.Cleanup(func() { driver.Close() })
+
+	f.Fuzz(func(t *testing.T, key string, value []byte) {
+		err := driver.Put(key, value)
+		if ValidateKey(key) != nil {
+			if !errors.Is(err, ErrInvalidKey) {
+				t.Fatalf("Put(%q) error = %v, want ErrInvalidKey", key, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Put(%q) failed: %s", key, err)
+		}
+
+		// Nothing is written outside the data directory
+		if entries, _ := os.ReadDir(root); len(entries) != 1 || entries[0].Name() != "data" {
+			t.Fatalf("Put(%q) wrote outside the data directory: %v", key, entries)
+		}
+		if _, err := os.Stat(filepath.Join(dir, driver.fileName(key))); err != nil {
+			t.Fatalf("Put(%q) left no file in the data directory: %s", key, err)
+		}
+
+		got, err := driver.Get(key)
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("Get(%q) = %q, %v, want %q", key, got, err, value)
+		}
+		if err := driver.Delete(key); err != nil {
+			t.Fatalf("Delete(%q) failed: %s", key, err)
+		}
+		if _, err := driver.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get(%q) after Delete error = %v, want ErrKeyNotFound", key, err)
+		}
+	})
+}
+
+func FuzzDecodeSnapshot(f *testing.F) {
+	items := []Item{
+		{Key: "a", Value: []byte("1"), Hash: hashValue([]byte("1")), Rev: 1},
+		{Key: "b", ExpiresAt: time.Now().Add(time.Hour).UnixNano(), Labels: map[string]string{"env": "prod"}, Rev: 2},
+	}
+	for _, codec := range []SnapshotCodec{JSONCodec{}, GobCodec{}} {
+		var buf bytes.Buffer
+		if err := encodeSnapshot(&buf, codec, items); err != nil {
+			f.Fatalf("encodeSnapshot with %s failed: %s", codec.Name(), err)
+		}
+		f.Add(buf.Bytes())
+		f.Add(buf.Bytes()[:buf.Len()/2])
+	}
+	f.Add([]byte(`[{"key":"legacy"}]`))
+	f.Add([]byte(snapshotMagic + "zstd\n"))
+	f.Add([]byte(snapshotMagic))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		items, err := decodeSnapshot(bytes.NewReader(data), JSONCodec{})
+		if err != nil && items != nil {
+			t.Fatalf("decodeSnapshot returned %d items with error %v", len(items), err)
+		}
+	})
+}
+
+func TestCrashAfterSnapshotRereadsValues(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := New(dir, nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	driver.Put("k", []byte("saved in the snapshot"))
+	driver.Close()
+
+	// The value written after the snapshot is on disk but not in it
+	if driver, err = New(dir, nil, 128, 2); err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	driver.Put("k", []byte("written after"))
+	crash(driver)
+
+	driver, err = New(dir, nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to reopen driver after the crash: %s", err)
+	}
+	defer driver.Close()
+	if got, err := driver.Get("k"); err != nil || string(got) != "written after" {
+		t.Errorf("Get after the crash = %q, %v, want the value written after the snapshot", got, err)
+	}
+}
+
+// modelOp is one step of an operation sequence checked against a map by
+// the model tests
+type modelOp struct {
+	Kind  string // "put", "get", "delete", "has", "range", "snapshot", "restart" or "crash"
+	Key   string // the key, or the prefix for range, under the sequence's prefix
+	Value []byte // the value to put
+	Limit int    // the limit for range, 0 for none
+}
+
+func (op modelOp) String() string {
+	switch op.Kind {
+	case "put":
+		return fmt.Sprintf("put %s %q", op.Key, op.Value)
+	case "range":
+		return fmt.Sprintf("range %q limit %d", op.Key, op.Limit)
+	case "snapshot", "restart", "crash":
+		return op.Kind
+	}
+	return op.Kind + " " + op.Key
+}
+
+// modelOps is a random operation sequence for testing/quick. Keys are drawn
+// from a few under each prefix so that operations meet the same keys.
+type modelOps struct {
+	prefix string
+	ops    []modelOp
+}
+
+// modelKinds weights the operations generated, restarts being the rarest
+var modelKinds = []string{
+	"put", "put", "put", "put", "get", "get", "delete", "delete", "has", "range", "range",
+	"snapshot", "restart", "crash",
+}
+
+func genModelOps(r *rand.Rand, size int, prefix string, kinds []string) modelOps {
+	ops := make([]modelOp, r.Intn(size+1))
+	for i := range ops {
+		op := modelOp{Kind: kinds[r.Intn(len(kinds))]}
+		key := fmt.Sprintf("%s%d", []string{"a:", "b:", "a:b:"}[r.Intn(3)], r.Intn(4))
+		op.Key = prefix + key
+		switch op.Kind {
+		case "put":
+			op.Value = make([]byte, r.Intn(16))
+			r.Read(op.Value)
+		case "range":
+			op.Key = prefix + key[:r.Intn(len(key)+1)]
+			op.Limit = r.Intn(4)
+		}
+		ops[i] = op
+	}
+	return modelOps{prefix: prefix, ops: ops}
+}
+
+func (modelOps) Generate(r *rand.Rand, size int) reflect.Value {
+	return reflect.ValueOf(genModelOps(r, size, "", modelKinds))
+}
+
+// modelDriver is a driver on a temp directory that model operations can
+// restart. Restarts take restartMu for writing, so workers running other
+// operations hold it for reading.
+type modelDriver struct {
+	t         testing.TB
+	dir, snap string
+	restartMu sync.RWMutex
+	d         *Driver
+}
+
+func newModelDriver(t testing.TB) *modelDriver {
+	m := &modelDriver{t: t, dir: t.TempDir(), snap: filepath.Join(t.TempDir(), "snapshot")}
+	m.open()
+	t.Cleanup(func() { m.d.Close() })
+	return m
+}
+
+func (m *modelDriver) open() {
+	d, err := New(m.dir, nil, 128, 2)
+	if err != nil {
+		m.t.Fatalf("Failed to open driver: %s", err)
+	}
+	m.d = d
+}
+
+// run applies ops to the driver and to model, returning a description of
+// the first result that differs, with the index of its operation
+func (m *modelDriver) run(ops modelOps, model map[string][]byte) (int, error) {
+	for i, op := range ops.ops {
+		var err error
+		if op.Kind == "snapshot" || op.Kind == "restart" || op.Kind == "crash" {
+			m.restartMu.Lock()
+			err = m.restart(op.Kind)
+			m.restartMu.Unlock()
+		} else {
+			m.restartMu.RLock()
+			err = m.apply(op, model)
+			m.restartMu.RUnlock()
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+
+	// Everything written is still there after a last restart
+	m.restartMu.Lock()
+	defer m.restartMu.Unlock()
+	if err := m.restart("restart"); err != nil {
+		return len(ops.ops), err
+	}
+	for key, want := range model {
+		if got, err := m.d.Get(key); err != nil || !bytes.Equal(got, want) {
+			return len(ops.ops), fmt.Errorf("after the last restart Get(%s) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+	keys, err := m.d.List(context.Background(), ops.prefix, "", 0)
+	if err != nil || len(keys) != len(model) {
+		return len(ops.ops), fmt.Errorf("after the last restart List = %q, %v, want %d keys", keys, err, len(model))
+	}
+	return 0, nil
+}
+
+// restart saves and reloads the B-tree, or reopens the directory after a
+// clean close or a crash
+func (m *modelDriver) restart(kind string) error {
+	switch kind {
+	case "snapshot":
+		if err := m.d.SerializeBTree(m.snap); err != nil {
+			return err
+		}
+		return m.d.DeserializeBTree(m.snap)
+	case "crash":
+		crash(m.d)
+	default:
+		if err := m.d.Close(); err != nil {
+			return err
+		}
+	}
+	m.open()
+	return nil
+}
+
+// apply runs a single operation, checking its result against model
+func (m *modelDriver) apply(op modelOp, model map[string][]byte) error {
+	d := m.d
+	want, ok := model[op.Key]
+	switch op.Kind {
+	case "put":
+		if err := d.Put(op.Key, op.Value); err != nil {
+			return err
+		}
+		model[op.Key] = op.Value
+	case "get":
+		got, err := d.Get(op.Key)
+		if ok && (err != nil || !bytes.Equal(got, want)) || !ok && !errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("Get = %q, %v, want %q, found %t", got, err, want, ok)
+		}
+	case "delete":
+		err := d.Delete(op.Key)
+		if ok && err != nil || !ok && !errors.Is(err, ErrKeyNotFound) {
+			return fmt.Errorf("Delete = %v, found %t", err, ok)
+		}
+		delete(model, op.Key)
+	case "has":
+		if got, err := d.Has(op.Key); err != nil || got != ok {
+			return fmt.Errorf("Has = %t, %v, want %t", got, err, ok)
+		}
+	case "range":
+		var want []string
+		for key := range model {
+			if strings.HasPrefix(key, op.Key) {
+				want = append(want, key)
+			}
+		}
+		slices.Sort(want)
+		if op.Limit > 0 && len(want) > op.Limit {
+			want = want[:op.Limit]
+		}
+		got, err := d.List(context.Background(), op.Key, "", op.Limit)
+		if err != nil || !slices.Equal(got, want) {
+			return fmt.Errorf("List = %q, %v, want %q", got, err, want)
+		}
+	}
+	return nil
+}
+
+// shrinkModelOps returns the shortest sequence found, by dropping runs of
+// operations, that still fails on a fresh driver
+func shrinkModelOps(t *testing.T, ops modelOps) (modelOps, int, error) {
+	fails := func(ops modelOps) (int, error) {
+		var step int
+		var err error
+		// A fresh directory per attempt, removed as soon as it is done with
+		t.Run("shrink", func(t *testing.T) {
+			step, err = newModelDriver(t).run(ops, map[string][]byte{})
+		})
+		return step, err
+	}
+
+	step, err := fails(ops)
+	for n := len(ops.ops) / 2; n > 0; n /= 2 {
+		for i := 0; i+n <= len(ops.ops); {
+			smaller := modelOps{prefix: ops.prefix, ops: slices.Delete(slices.Clone(ops.ops), i, i+n)}
+			if s, e := fails(smaller); e != nil {
+				ops, step, err = smaller, s, e
+				continue
+			}
+			i++
+		}
+	}
+	return ops, step, err
+}
+
+// reportModelFailure fails t with the smallest sequence of ops still failing
+func reportModelFailure(t *testing.T, ops modelOps) {
+	ops, step, err := shrinkModelOps(t, ops)
+	var steps strings.Builder
+	for i, op := range ops.ops {
+		fmt.Fprintf(&steps, "\n\t%d: %s", i, op)
+	}
+	t.Fatalf("Step %d failed: %v\nin the sequence:%s", step, err, steps.String())
+}
+
+func TestDriverModel(t *testing.T) {
+	var failed *modelOps
+	check := func(ops modelOps) bool {
+		var err error
+		t.Run("run", func(t *testing.T) {
+			_, err = newModelDriver(t).run(ops, map[string][]byte{})
+		})
+		if err != nil {
+			failed = &ops
+		}
+		return err == nil
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 50}); err != nil {
+		reportModelFailure(t, *failed)
+	}
+}
+
+func TestDriverModelConcurrent(t *testing.T) {
+	const workers = 4
+	m := newModelDriver(t)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	seqs := make([]modelOps, workers)
+	for i := range seqs {
+		seqs[i] = genModelOps(r, 200, fmt.Sprintf("w%d:", i), modelKinds)
+	}
+
+	// Workers share the driver over keys of their own, so each of their
+	// sequences holds as it does alone
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for i := range seqs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = m.run(seqs[i], map[string][]byte{})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Worker %d failed: %v", i, err)
+			reportModelFailure(t, seqs[i])
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package db_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jcelliott/lumber"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+type user struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+func ExampleGetAs() {
+	dir, err := os.MkdirTemp("", "zephyrus-example")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	driver, err := db.Open(dir, &db.Options{Logger: lumber.NewBasicLogger(os.Stderr, lumber.ERROR)})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer driver.Close()
+
+	if err := db.PutAs(driver, "user:1", user{Name: "alice", Roles: []string{"admin"}}); err != nil {
+		log.Fatal(err)
+	}
+	u, err := db.GetAs[user](driver, "user:1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(u.Name, u.Roles)
+
+	// Output: alice [admin]
+}
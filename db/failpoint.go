@@ -0,0 +1,27 @@
+package db
+
+// Failpoints are the steps of a write at which crash tests inject a failure,
+// through the hook in Driver.failHook. A hook returning an error makes the
+// step fail as a real I/O error would; one panicking stops the write where
+// it is, as a crash would, for the test to reopen the directory.
+const (
+	// fpTempWritten follows writing a value's temp file, before the rename
+	fpTempWritten = "temp-written"
+	// fpBeforeRename comes right before a temp file is renamed into place
+	fpBeforeRename = "before-rename"
+	// fpRenamed follows the rename, before the B-tree is updated
+	fpRenamed = "renamed"
+	// fpSnapshotWritten follows writing the snapshot's temp file, before the
+	// rename
+	fpSnapshotWritten = "snapshot-written"
+	// fpOplogAppended follows appending a line to the operation log
+	fpOplogAppended = "oplog-appended"
+)
+
+// failpoint runs the test hook for a step, if there is one
+func (d *Driver) failpoint(name string) error {
+	if d.failHook == nil {
+		return nil
+	}
+	return d.failHook(name)
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrNotObject is returned by the field operations when the stored value is
+// not a JSON object
+var ErrNotObject = errors.New("value is not a JSON object")
+
+// ErrFieldNotFound is returned by FieldGet and FieldDelete when the object
+// has no such field
+var ErrFieldNotFound = errors.New("field not found")
+
+// objectField is one member of a JSON object, as it was written
+type objectField struct {
+	name  string
+	value json.RawMessage
+}
+
+// object is a JSON object with its fields in the order they were written
+type object []objectField
+
+// parseObject decodes a stored value as a JSON object. Of fields given more
+// than once the last counts, as for encoding/json.
+func parseObject(key string, value []byte) (object, error) {
+	notObject := fmt.Errorf("%w: %s", ErrNotObject, key)
+	dec := json.NewDecoder(bytes.NewReader(value))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, notObject
+	}
+	var obj object
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, notObject
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, notObject
+		}
+		obj = obj.set(tok.(string), v)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, notObject
+	}
+	if _, err := dec.Token(); err == nil {
+		return nil, notObject // more after the object
+	}
+	return obj, nil
+}
+
+// index returns the position of the field name, or -1
+func (o object) index(name string) int {
+	for i, f := range o {
+		if f.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// set replaces the value of the field name, or adds it at the end
+func (o object) set(name string, value json.RawMessage) object {
+	if i := o.index(name); i >= 0 {
+		o[i].value = value
+		return o
+	}
+	return append(o, objectField{name: name, value: value})
+}
+
+// MarshalJSON writes the fields in order
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		if err := json.Compact(&buf, f.value); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// FieldSet sets field of the JSON object stored at key to value, which must
+// be JSON, and reports whether the field is new. The other fields keep
+// their order and a new one goes last. A missing key is created holding an
+// object of just that field, with Options.DefaultTTL; an existing expiry is
+// kept. The read and the write happen under the write lock, so concurrent
+// changes to different fields are never lost. A value that is not a JSON
+// object fails with ErrNotObject.
+func (d *Driver) FieldSet(key, field string, value []byte) (bool, error) {
+	if err := d.checkKey(key); err != nil {
+		return false, err
+	}
+	if !json.Valid(value) {
+		return false, ErrInvalidElement
+	}
+	if err := d.writable(); err != nil {
+		return false, err
+	}
+
+	t := d.startOp(context.Background(), "field_set", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	current, expiresAt, exists, err := d.readLocked(key, t)
+	if err != nil {
+		return false, err
+	}
+	var obj object
+	if exists {
+		if obj, err = parseObject(key, current); err != nil {
+			return false, err
+		}
+	} else {
+		expiresAt, _ = d.writeExpiry(0)
+	}
+
+	created := obj.index(field) < 0
+	if err := d.putObject(key, obj.set(field, value), expiresAt, t); err != nil {
+		return false, err
+	}
+	return created, nil
+}
+
+// FieldGet returns the value of field of the JSON object stored at key. It
+// fails with ErrKeyNotFound when there is no key, ErrFieldNotFound when the
+// object has no such field and ErrNotObject when the value is not one.
+func (d *Driver) FieldGet(key, field string) ([]byte, error) {
+	if err := d.checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	t := d.startOp(context.Background(), "field_get", key)
+	defer d.finishOp(t)
+	d.rlock(t)
+	defer d.mutex.RUnlock()
+
+	current, _, exists, err := d.readLocked(key, t)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	obj, err := parseObject(key, current)
+	if err != nil {
+		return nil, err
+	}
+	i := obj.index(field)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: %s has no field %q", ErrFieldNotFound, key, field)
+	}
+	return obj[i].value, nil
+}
+
+// FieldDelete removes field from the JSON object stored at key, failing as
+// FieldGet does when there is no such key or field. Removing the last field
+// leaves the key holding {}, as the key is only ever removed by Delete.
+func (d *Driver) FieldDelete(key, field string) error {
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	t := d.startOp(context.Background(), "field_delete", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	current, expiresAt, exists, err := d.readLocked(key, t)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrKeyNotFound
+	}
+	obj, err := parseObject(key, current)
+	if err != nil {
+		return err
+	}
+	i := obj.index(field)
+	if i < 0 {
+		return fmt.Errorf("%w: %s has no field %q", ErrFieldNotFound, key, field)
+	}
+	return d.putObject(key, append(obj[:i], obj[i+1:]...), expiresAt, t)
+}
+
+// putObject stores an object as the value of key, checked as a Put would
+// check it. The caller must hold the write lock.
+func (d *Driver) putObject(key string, obj object, expiresAt int64, t *opTimer) error {
+	value, err := obj.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	if err := d.checkSchema(key, value); err != nil {
+		return err
+	}
+	_, err = d.putLocked(key, value, expiresAt, t)
+	return err
+}
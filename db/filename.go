@@ -0,0 +1,123 @@
+package db
+
+import (
+	"encoding/base32"
+	"fmt"
+	"strings"
+)
+
+// encodedPrefix starts the file name of a key encoded by fileName. No key
+// stored under its own name starts with it.
+const encodedPrefix = "~"
+
+// nameEncoding is lower case so that encoded names survive case-insensitive
+// filesystems, which may change the case of what they are given
+var nameEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+// reservedNames are the device names Windows reserves whatever the extension,
+// so that neither NUL nor nul.txt can be created
+var reservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true, "conin$": true, "conout$": true,
+	"com0": true, "com1": true, "com2": true, "com3": true, "com4": true,
+	"com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt0": true, "lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true,
+	"lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// portableName reports whether key is a file name that means the same on
+// every filesystem: lower-case ASCII letters, digits, '-', '_' and '.', not
+// ending in a dot and not a name Windows reserves
+func portableName(key string) bool {
+	if key == "" || strings.HasSuffix(key, ".") {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	base, _, _ := strings.Cut(key, ".")
+	return !reservedNames[base]
+}
+
+// encodeFileName returns the name of the file holding key when file names are
+// encoded. Portable keys keep their own name; any other key is stored as
+// encodedPrefix followed by the key in lower-case base32, so Foo and foo, or
+// a:b and NUL, get files of their own on Windows and macOS too.
+func encodeFileName(key string) string {
+	if portableName(key) {
+		return key
+	}
+	return encodedPrefix + nameEncoding.EncodeToString([]byte(key))
+}
+
+// decodeFileName returns the key held in a file named by encodeFileName, and
+// false for a name encodeFileName would not have produced
+func decodeFileName(name string) (string, bool) {
+	encoded, ok := strings.CutPrefix(name, encodedPrefix)
+	if !ok {
+		return name, portableName(name)
+	}
+	key, err := nameEncoding.DecodeString(encoded)
+	if err != nil || validateEncodedKey(string(key)) != nil || encodeFileName(string(key)) != name {
+		return "", false
+	}
+	return string(key), true
+}
+
+// fileName returns the name of the file holding key in a data directory
+func (d *Driver) fileName(key string) string {
+	if !d.encoded {
+		return key
+	}
+	return encodeFileName(key)
+}
+
+// keyName returns the key held in the file name, and false for a file that
+// holds no key, such as the driver's own files
+func (d *Driver) keyName(name string) (string, bool) {
+	if d.isInternalFile(name) {
+		return "", false
+	}
+	if !d.encoded {
+		return name, true
+	}
+	return decodeFileName(name)
+}
+
+// validateKey is ValidateKey, or the looser rule of validateEncodedKey when
+// file names are encoded
+func (d *Driver) validateKey(key string) error {
+	if d.encoded {
+		return validateEncodedKey(key)
+	}
+	return ValidateKey(key)
+}
+
+// CheckKey reports whether the driver can store key. Without
+// Options.EncodeFileNames a key is its file name and must pass ValidateKey;
+// with it any bytes make a key, binary data and whitespace included, so long
+// as the key is not a dotfile, a .tmp upload or the LOCK file. Keys longer
+// than Options.MaxKeyLen, or whose file name is too long once encoded, are
+// refused either way.
+func (d *Driver) CheckKey(key string) error {
+	return d.checkKey(key)
+}
+
+// checkKey is validateKey, also refusing keys longer than Options.MaxKeyLen
+// and keys whose file name is too long once encoded. The limit applies to
+// the key as given; with Options.EncodeFileNames a key that is not portable
+// takes 1 + 8/5 of its length as a file name, so shorter keys are refused.
+func (d *Driver) checkKey(key string) error {
+	if err := d.validateKey(key); err != nil {
+		return err
+	}
+	if len(key) > d.maxKey {
+		return fmt.Errorf("%w: key is %d bytes, at most %d allowed", ErrInvalidKey, len(key), d.maxKey)
+	}
+	if name := d.fileName(key); len(name) > MaxKeyLen {
+		return fmt.Errorf("%w: key is %d bytes once encoded as a file name, at most %d allowed; encoded names take 1 + 8/5 of the key's length", ErrInvalidKey, len(name), MaxKeyLen)
+	}
+	return nil
+}
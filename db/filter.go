@@ -0,0 +1,445 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidFilter is returned, as a *FilterError, by ParseFilter for an
+// expression that does not parse
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// FilterError tells where a filter expression stopped making sense
+type FilterError struct {
+	Pos int // byte offset in the expression, from 0
+	Msg string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("%v at position %d: %s", ErrInvalidFilter, e.Pos, e.Msg)
+}
+
+// Unwrap makes errors.Is(err, ErrInvalidFilter) hold
+func (e *FilterError) Unwrap() error {
+	return ErrInvalidFilter
+}
+
+// Filter is a parsed filter expression, matched against JSON values by
+// scans. The language is small:
+//
+//	json.status == "active" && (json.age > 30 || !json.verified)
+//
+// json is the value and json.a.b, or json.tags[0], a part of it. These
+// compare with ==, !=, <, <=, > and >= to strings, numbers, true, false,
+// null or other parts of the value, and combine with &&, || and !, which
+// bind in that order from loosest to tightest, and parentheses. == and !=
+// compare values of any type; the ordering operators compare two numbers or
+// two strings and are false otherwise. A comparison with a part that is
+// missing is false, whatever the operator. A part used on its own holds when
+// it is true. Values that are not JSON match nothing.
+type Filter struct {
+	expr string
+	root filterNode
+}
+
+// ParseFilter parses a filter expression, returning a *FilterError saying
+// where it went wrong when it does not parse
+func ParseFilter(expr string) (*Filter, error) {
+	p := &filterParser{expr: expr}
+	p.next()
+	root, err := p.parseOr()
+	if err == nil && p.tok.kind != tokEOF {
+		err = p.errorf("unexpected %s", p.tok)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// String returns the expression the filter was parsed from
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match reports whether a value is JSON that the filter holds for. A nil
+// filter matches every value.
+func (f *Filter) Match(value []byte) bool {
+	if f == nil {
+		return true
+	}
+	var doc interface{}
+	if json.Unmarshal(value, &doc) != nil {
+		return false
+	}
+	return truthy(f.root.eval(doc))
+}
+
+// missing stands for a part of the value that is not there
+type missing struct{}
+
+// filterNode is a node of a parsed filter, evaluating to a JSON value,
+// missing or, for comparisons and logic, a bool
+type filterNode interface {
+	eval(doc interface{}) interface{}
+}
+
+// literal is a constant of the expression
+type literal struct{ v interface{} }
+
+func (n literal) eval(interface{}) interface{} { return n.v }
+
+// path is a part of the value, by object member names and array indexes
+type path []interface{} // string or int
+
+func (n path) eval(doc interface{}) interface{} {
+	v := doc
+	for _, step := range n {
+		switch step := step.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return missing{}
+			}
+			if v, ok = obj[step]; !ok {
+				return missing{}
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || step >= len(arr) {
+				return missing{}
+			}
+			v = arr[step]
+		}
+	}
+	return v
+}
+
+// not negates its operand, which holds only when it is true
+type not struct{ x filterNode }
+
+func (n not) eval(doc interface{}) interface{} { return !truthy(n.x.eval(doc)) }
+
+// logical is && or ||, evaluating its right operand only when needed
+type logical struct {
+	and  bool
+	l, r filterNode
+}
+
+func (n logical) eval(doc interface{}) interface{} {
+	if truthy(n.l.eval(doc)) != n.and {
+		return !n.and
+	}
+	return truthy(n.r.eval(doc))
+}
+
+// comparison is one of the comparison operators
+type comparison struct {
+	op   string
+	l, r filterNode
+}
+
+func (n comparison) eval(doc interface{}) interface{} {
+	l, r := n.l.eval(doc), n.r.eval(doc)
+	if _, ok := l.(missing); ok {
+		return false
+	}
+	if _, ok := r.(missing); ok {
+		return false
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(l, r)
+	case "!=":
+		return !reflect.DeepEqual(l, r)
+	}
+
+	var c int
+	switch l := l.(type) {
+	case float64:
+		r, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case l < r:
+			c = -1
+		case l > r:
+			c = 1
+		}
+	case string:
+		r, ok := r.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(l, r)
+	default:
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// truthy reports whether an evaluated node holds: only true does
+func truthy(v interface{}) bool {
+	b, ok := v.(bool)
+	return ok && b
+}
+
+// Token kinds of the filter language
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp // an operator or parenthesis, in text
+	tokInvalid
+)
+
+type filterToken struct {
+	kind int
+	pos  int
+	text string
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokInvalid:
+		return fmt.Sprintf("character %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// filterParser parses by recursive descent, one token ahead
+type filterParser struct {
+	expr string
+	pos  int // of the next token to scan
+	tok  filterToken
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return &FilterError{Pos: p.tok.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// next scans the token at pos into tok
+func (p *filterParser) next() {
+	for p.pos < len(p.expr) && strings.IndexByte(" \t\r\n", p.expr[p.pos]) >= 0 {
+		p.pos++
+	}
+	start := p.pos
+	rest := p.expr[start:]
+	tok := filterToken{pos: start}
+	switch {
+	case rest == "":
+		tok.kind = tokEOF
+	case rest[0] == '"':
+		tok.kind = tokString
+		end := 1
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		tok.text = rest[:min(end+1, len(rest))]
+	case rest[0] == '-' || rest[0] >= '0' && rest[0] <= '9':
+		tok.kind = tokNumber
+		end := 1
+		for end < len(rest) && strings.IndexByte("0123456789.eE+-", rest[end]) >= 0 {
+			// A sign only follows an exponent
+			if (rest[end] == '+' || rest[end] == '-') && rest[end-1] != 'e' && rest[end-1] != 'E' {
+				break
+			}
+			end++
+		}
+		tok.text = rest[:end]
+	case isIdentByte(rest[0], true):
+		tok.kind = tokIdent
+		end := 1
+		for end < len(rest) && isIdentByte(rest[end], false) {
+			end++
+		}
+		tok.text = rest[:end]
+	default:
+		tok.kind = tokOp
+		for _, op := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", ".", "[", "]"} {
+			if strings.HasPrefix(rest, op) {
+				tok.text = op
+				break
+			}
+		}
+		if tok.text == "" {
+			tok.kind, tok.text = tokInvalid, rest[:1]
+		}
+	}
+	p.pos += len(tok.text)
+	p.tok = tok
+}
+
+// isIdentByte reports whether b can be part of a name, or start one when
+// first is set. Names are ASCII; other member names are given as ["name"].
+func isIdentByte(b byte, first bool) bool {
+	return b == '_' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || !first && '0' <= b && b <= '9'
+}
+
+// is reports whether the current token is the operator op
+func (p *filterParser) is(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.is("||") {
+		p.next()
+		var r filterNode
+		if r, err = p.parseAnd(); err == nil {
+			l = logical{and: false, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	l, err := p.parseNot()
+	for err == nil && p.is("&&") {
+		p.next()
+		var r filterNode
+		if r, err = p.parseNot(); err == nil {
+			l = logical{and: true, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *filterParser) parseNot() (filterNode, error) {
+	if p.is("!") {
+		p.next()
+		x, err := p.parseNot()
+		return not{x}, err
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op := p.tok.text
+	if p.tok.kind != tokOp || !slices.Contains([]string{"==", "!=", "<", "<=", ">", ">="}, op) {
+		return l, nil
+	}
+	p.next()
+	r, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return comparison{op: op, l: l, r: r}, nil
+}
+
+func (p *filterParser) parseOperand() (filterNode, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokString:
+		var s string
+		if len(tok.text) < 2 || tok.text[len(tok.text)-1] != '"' {
+			return nil, p.errorf("unterminated string")
+		}
+		if err := json.Unmarshal([]byte(tok.text), &s); err != nil {
+			return nil, p.errorf("invalid string %s", tok.text)
+		}
+		p.next()
+		return literal{s}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", tok.text)
+		}
+		p.next()
+		return literal{n}, nil
+	case tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		case "json":
+			return p.parsePath()
+		}
+		return nil, &FilterError{Pos: tok.pos, Msg: fmt.Sprintf("unknown name %q, want json, a string, a number, true, false or null", tok.text)}
+	}
+	if p.is("(") {
+		p.next()
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.is(")") {
+			return nil, p.errorf("expected \")\", got %s", p.tok)
+		}
+		p.next()
+		return x, nil
+	}
+	return nil, p.errorf("expected a value, got %s", tok)
+}
+
+// parsePath parses the members and indexes following json
+func (p *filterParser) parsePath() (filterNode, error) {
+	steps := path{}
+	for {
+		switch {
+		case p.is("."):
+			p.next()
+			if p.tok.kind != tokIdent {
+				return nil, p.errorf("expected a member name after \".\", got %s", p.tok)
+			}
+			steps = append(steps, p.tok.text)
+			p.next()
+		case p.is("["):
+			p.next()
+			var step interface{}
+			switch p.tok.kind {
+			case tokString:
+				var s string
+				if json.Unmarshal([]byte(p.tok.text), &s) != nil {
+					return nil, p.errorf("invalid string %s", p.tok.text)
+				}
+				step = s
+			case tokNumber:
+				i, err := strconv.Atoi(p.tok.text)
+				if err != nil || i < 0 {
+					return nil, p.errorf("invalid index %q", p.tok.text)
+				}
+				step = i
+			default:
+				return nil, p.errorf("expected an index or a quoted member name, got %s", p.tok)
+			}
+			p.next()
+			if !p.is("]") {
+				return nil, p.errorf("expected \"]\", got %s", p.tok)
+			}
+			p.next()
+			steps = append(steps, step)
+		default:
+			return steps, nil
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// followFile records how far Follow has applied the changes of its source,
+// in the metadata directory
+const followFile = "follow.json"
+
+// followBatch is how many changes LocalSource reads from the log at a time
+const followBatch = 500
+
+// ErrFollowing is returned by Follow when another Follow is already applying
+// changes to the target
+var ErrFollowing = errors.New("driver is already following a source")
+
+// ChangeSource delivers the changes made to another driver to Follow, in the
+// order they were made. LocalSource reads a driver in the same process and
+// replica.Source the replication feed of a server.
+type ChangeSource interface {
+	// Snapshot calls fn with a put for every key the source holds and
+	// returns the ID of the source's sequence numbers and the sequence
+	// number to stream from. Changes made meanwhile may or may not be
+	// included; streaming from the sequence number gives the same result
+	// either way.
+	Snapshot(ctx context.Context, fn func(Change) error) (id string, seq uint64, err error)
+
+	// Stream calls fn with every change made after the one numbered after,
+	// oldest first, and waits for more until ctx is done or fn fails. A
+	// change without an Op only carries the source's latest sequence
+	// number. It fails with ErrChangesTruncated when those changes are no
+	// longer available, or id no longer names the source's sequence
+	// numbers, so that the follower has to load a snapshot.
+	Stream(ctx context.Context, id string, after uint64, fn func(Change) error) error
+}
+
+// FollowStatus describes how far Follow is behind its source
+type FollowStatus struct {
+	SourceID   string
+	AppliedSeq uint64  // the last change applied
+	SourceSeq  uint64  // the latest change the source has told of
+	LagOps     uint64  // changes made at the source and not applied yet
+	LagSeconds float64 // age of the last change applied, while behind
+	Snapshots  int     // snapshots loaded by this call of Follow
+	LastError  error   // why Follow is about to reconnect, if it is
+}
+
+// FollowOption configures Follow
+type FollowOption func(*follower)
+
+// FollowRetry sets how long Follow waits before reconnecting after the
+// source fails, a second by default
+func FollowRetry(interval time.Duration) FollowOption {
+	return func(f *follower) {
+		f.retry = interval
+	}
+}
+
+// FollowProgress has Follow call fn with its status after every change it
+// applies, every sequence number the source reports and every error. fn is
+// called from the goroutine running Follow, which waits for it.
+func FollowProgress(fn func(FollowStatus)) FollowOption {
+	return func(f *follower) {
+		f.progress = fn
+	}
+}
+
+// followPosition is what the follow file holds
+type followPosition struct {
+	ID  string `json:"id"`
+	Seq uint64 `json:"seq"`
+}
+
+// follower is the state of one call of Follow
+type follower struct {
+	source   ChangeSource
+	target   *Driver
+	retry    time.Duration
+	progress func(FollowStatus)
+
+	status    FollowStatus
+	appliedAt time.Time // when the last change applied was made at the source
+}
+
+// Follow applies the changes of source to target until ctx is done, making
+// target a copy of the source in the same process, without a server. It
+// loads a snapshot first, replacing whatever target holds, then applies each
+// change in order and records the last one applied in target's data
+// directory after it, so that a later Follow of the same source, after a
+// restart too, carries on from there. Changes are applied with Apply, which
+// works on a read-only driver; a change overwrites whatever target holds for
+// its key, so a later change at the source always wins over an earlier one
+// and over local writes. When the source fails, Follow reconnects after
+// FollowRetry, loading a new snapshot when the changes it needs are gone. It
+// returns ctx's error once ctx is done, ErrClosed once target is closed and
+// ErrFollowing while another Follow is applying changes to target.
+func Follow(ctx context.Context, source ChangeSource, target *Driver, opts ...FollowOption) error {
+	if err := target.checkOpen(); err != nil {
+		return err
+	}
+	if !target.following.CompareAndSwap(false, true) {
+		return ErrFollowing
+	}
+	defer target.following.Store(false)
+
+	// Closing target ends Follow
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-target.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	stopped := func() error {
+		select {
+		case <-target.stop:
+			return ErrClosed
+		default:
+			return ctx.Err()
+		}
+	}
+
+	f := &follower{source: source, target: target, retry: time.Second}
+	for _, opt := range opts {
+		opt(f)
+	}
+	pos, err := target.loadFollowPosition()
+	if err != nil {
+		return err
+	}
+	f.status.SourceID, f.status.AppliedSeq, f.status.SourceSeq = pos.ID, pos.Seq, pos.Seq
+
+	for {
+		var err error
+		if f.status.SourceID == "" {
+			err = f.loadSnapshot(ctx)
+		}
+		if err == nil {
+			err = source.Stream(ctx, f.status.SourceID, f.status.AppliedSeq, f.apply)
+			if err == nil {
+				err = errors.New("the source ended the change stream")
+			}
+		}
+		if ctx.Err() != nil {
+			return stopped()
+		}
+
+		f.status.LastError = err
+		f.report()
+		if errors.Is(err, ErrChangesTruncated) {
+			target.log.Warn("Follow: %v, loading a snapshot", err)
+			f.status.SourceID = ""
+			continue
+		}
+		target.log.Warn("Follow: %v, retrying in %s", err, f.retry)
+		select {
+		case <-time.After(f.retry):
+		case <-ctx.Done():
+			return stopped()
+		}
+	}
+}
+
+// loadSnapshot replaces the target's keys with a snapshot of the source
+func (f *follower) loadSnapshot(ctx context.Context) error {
+	keys := make(map[string]bool)
+	id, seq, err := f.source.Snapshot(ctx, func(c Change) error {
+		keys[c.Key] = true
+		return f.target.Apply(c)
+	})
+	if err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+
+	// Remove what the source does not have
+	local, err := f.target.List(ctx, "", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, key := range local {
+		if keys[key] {
+			continue
+		}
+		if err := f.target.Apply(Change{Op: OpDelete, Key: key}); err != nil {
+			return err
+		}
+	}
+
+	if err := f.target.saveFollowPosition(followPosition{ID: id, Seq: seq}); err != nil {
+		return err
+	}
+	f.status.SourceID, f.status.AppliedSeq = id, seq
+	f.status.SourceSeq = max(f.status.SourceSeq, seq)
+	f.status.Snapshots++
+	f.status.LastError = nil
+	f.target.log.Info("Follow: loaded a snapshot of %d keys at seq %d", len(keys), seq)
+	f.report()
+	return nil
+}
+
+// apply applies one change from the stream, or notes the sequence number a
+// heartbeat carries
+func (f *follower) apply(c Change) error {
+	f.status.SourceSeq = max(f.status.SourceSeq, c.Seq)
+	f.status.LastError = nil
+	if c.Op == "" {
+		f.report()
+		return nil
+	}
+
+	after := f.status.AppliedSeq
+	if c.Seq <= after {
+		return nil // applied already
+	}
+	if c.Seq != after+1 {
+		return fmt.Errorf("%w: expected change %d, got %d", ErrChangesTruncated, after+1, c.Seq)
+	}
+	if err := f.target.Apply(c); err != nil {
+		return fmt.Errorf("applying change %d: %w", c.Seq, err)
+	}
+	if err := f.target.saveFollowPosition(followPosition{ID: f.status.SourceID, Seq: c.Seq}); err != nil {
+		return err
+	}
+	f.status.AppliedSeq = c.Seq
+	f.appliedAt = c.Time
+	f.report()
+	return nil
+}
+
+// report passes the status to the FollowProgress callback
+func (f *follower) report() {
+	if f.progress == nil {
+		return
+	}
+	s := f.status
+	if s.SourceSeq > s.AppliedSeq {
+		s.LagOps = s.SourceSeq - s.AppliedSeq
+		if !f.appliedAt.IsZero() {
+			s.LagSeconds = time.Since(f.appliedAt).Seconds()
+		}
+	}
+	f.progress(s)
+}
+
+// loadFollowPosition reads the position saved by the last Follow, which is
+// empty when there was none
+func (d *Driver) loadFollowPosition() (followPosition, error) {
+	var pos followPosition
+	data, err := os.ReadFile(filepath.Join(d.dir, metaDir, followFile))
+	if os.IsNotExist(err) {
+		return pos, nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &pos)
+	}
+	if err != nil {
+		return pos, fmt.Errorf("failed to load the follow position: %w", err)
+	}
+	return pos, nil
+}
+
+// saveFollowPosition records the last change Follow applied
+func (d *Driver) saveFollowPosition(pos followPosition) error {
+	data, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.dir, metaDir, followFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(path, data)
+}
+
+// LocalSource returns a ChangeSource reading the change log of d, which is
+// kept in memory: a follower resumes where it stopped as long as d stays
+// open, and loads a new snapshot once d has been reopened.
+func LocalSource(d *Driver) ChangeSource {
+	return localSource{d}
+}
+
+type localSource struct {
+	d *Driver
+}
+
+func (s localSource) Snapshot(ctx context.Context, fn func(Change) error) (string, uint64, error) {
+	id := s.d.ReplicationID()
+	seq, err := s.d.Snapshot(func(c Change) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(c)
+	})
+	return id, seq, err
+}
+
+func (s localSource) Stream(ctx context.Context, id string, after uint64, fn func(Change) error) error {
+	if id != s.d.ReplicationID() {
+		return fmt.Errorf("%w: the source was reopened", ErrChangesTruncated)
+	}
+	for {
+		changes, wake, err := s.d.Changes(after, followBatch)
+		if err != nil {
+			return err
+		}
+		if err := fn(Change{Seq: s.d.Seq(), Time: time.Now()}); err != nil {
+			return err
+		}
+		for _, c := range changes {
+			if err := fn(c); err != nil {
+				return err
+			}
+			after = c.Seq
+		}
+		if len(changes) > 0 {
+			continue
+		}
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.d.stop:
+			return ErrClosed
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// HookOption configures a hook registered with OnPut or OnDelete
+type HookOption func(*hook)
+
+// Async runs a hook in a goroutine of its own instead of before the write
+// returns. The calls to one async hook are still made one at a time, in the
+// order the writes were applied.
+func Async() HookOption {
+	return func(h *hook) {
+		h.async = true
+	}
+}
+
+// hook is a function registered with OnPut or OnDelete
+type hook struct {
+	op    Op
+	put   func(key string, value []byte)
+	del   func(key string)
+	async bool
+
+	mu      sync.Mutex
+	queue   []Event // calls waiting for the goroutine of an async hook
+	running bool    // the goroutine is draining queue
+}
+
+// hookCall is a call to make to a synchronous hook once the lock is released
+type hookCall struct {
+	h  *hook
+	ev Event
+}
+
+// OnPut registers fn to be called after every successful write of a key,
+// including those applied from a primary. value is nil for values written
+// with PutReader, which are not held in memory. By default fn runs in the
+// writer's goroutine after the driver lock is released, so the write
+// returns once fn does; with Async it runs in the background and Close
+// waits for it. A panic in fn is recovered and logged.
+func (d *Driver) OnPut(fn func(key string, value []byte), opts ...HookOption) {
+	d.addHook(&hook{op: OpPut, put: fn}, opts)
+}
+
+// OnDelete registers fn to be called after every successful delete, and
+// after every key removed because it expired, in the same way as OnPut
+func (d *Driver) OnDelete(fn func(key string), opts ...HookOption) {
+	d.addHook(&hook{op: OpDelete, del: fn}, opts)
+}
+
+func (d *Driver) addHook(h *hook, opts []HookOption) {
+	for _, opt := range opts {
+		opt(h)
+	}
+	d.hookMu.Lock()
+	defer d.hookMu.Unlock()
+	d.hooks = append(d.hooks, h)
+}
+
+// queueHooks queues the hooks for a change. Async hooks are handed to
+// their goroutines now, so that Close, which takes the lock, waits for
+// them; the synchronous ones are made by unlock. The caller must hold the
+// write lock.
+func (d *Driver) queueHooks(op Op, key string, value []byte) {
+	d.hookMu.Lock()
+	hooks := d.hooks
+	d.hookMu.Unlock()
+
+	var ev *Event
+	for _, h := range hooks {
+		if h.op != op && !(h.op == OpDelete && op == OpExpire) {
+			continue
+		}
+		if ev == nil {
+			ev = &Event{Op: op, Key: key, Value: value, Time: time.Now()}
+		}
+		if h.async {
+			d.startHook(h, *ev)
+		} else {
+			d.pendingHooks = append(d.pendingHooks, hookCall{h, *ev})
+		}
+	}
+}
+
+// unlock releases the write lock and then makes the synchronous hook calls
+// queued while it was held, which are this goroutine's own
+func (d *Driver) unlock() {
+	calls := d.pendingHooks
+	d.pendingHooks = nil
+	d.mutex.Unlock()
+
+	for _, c := range calls {
+		d.callHook(c.h, c.ev)
+	}
+}
+
+// startHook queues a call to an async hook, starting its goroutine if it is
+// not running
+func (d *Driver) startHook(h *hook, ev Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queue = append(h.queue, ev)
+	if h.running {
+		return
+	}
+	h.running = true
+	d.hookWG.Add(1)
+	go d.drainHook(h)
+}
+
+// drainHook makes the queued calls to an async hook until none are left
+func (d *Driver) drainHook(h *hook) {
+	defer d.hookWG.Done()
+	for {
+		h.mu.Lock()
+		if len(h.queue) == 0 {
+			h.running = false
+			h.mu.Unlock()
+			return
+		}
+		ev := h.queue[0]
+		h.queue = h.queue[1:]
+		h.mu.Unlock()
+
+		d.callHook(h, ev)
+	}
+}
+
+// callHook calls a hook, logging a panic instead of crashing the writer
+func (d *Driver) callHook(h *hook, ev Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.log.Error("Hook on %s of key %s panicked: %v", ev.Op, ev.Key, r)
+		}
+	}()
+	if ev.Op == OpPut {
+		h.put(ev.Key, ev.Value)
+	} else {
+		h.del(ev.Key)
+	}
+}
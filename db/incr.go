@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// ErrNotInteger is returned by Incr when the stored value is not a base-10
+// 64-bit integer
+var ErrNotInteger = errors.New("value is not an integer")
+
+// Incr adds delta to the integer stored at key and returns the new value. A
+// missing key counts as 0. The read and the write happen under the write
+// lock, so concurrent increments are never lost, and an existing expiry is
+// kept.
+func (d *Driver) Incr(key string, delta int64) (int64, error) {
+	if err := d.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+
+	t := d.startOp(context.Background(), "incr", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	// Missing and expired keys start over from 0, with Options.DefaultTTL
+	value := []byte("0")
+	current, expiresAt, exists, err := d.readLocked(key, t)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		value = current
+	} else {
+		expiresAt, _ = d.writeExpiry(0)
+	}
+
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, fmt.Errorf("%w: increment would overflow", ErrNotInteger)
+	}
+	n += delta
+
+	if _, err := d.putLocked(key, []byte(strconv.FormatInt(n, 10)), expiresAt, t); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxFileName is the longest file name most filesystems allow, in bytes
+const maxFileName = 255
+
+// MaxKeyLen is the longest key accepted, in bytes. Keys are used as file
+// names, which most filesystems limit to 255 bytes, and values are written
+// to a temporary file named after the key with a .tmp suffix first.
+const MaxKeyLen = maxFileName - len(".tmp")
+
+// ErrInvalidKey is returned, wrapped with the specific violation, for keys
+// that cannot be stored
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrEmptyKey is returned, along with ErrInvalidKey, for an empty key
+var ErrEmptyKey = errors.New("key is required")
+
+// ValidateKey reports whether key can be used as a file name in the data
+// directory. Keys must be non-empty UTF-8 of at most MaxKeyLen bytes, without
+// path separators, whitespace or control characters, and must not collide with
+// the driver's own files (dotfiles, .tmp uploads and the LOCK file, in any
+// case for case-insensitive filesystems). A valid key always names
+// a file inside the data directory, never a path out of it; names the
+// operating system reserves, such as NUL on Windows, are refused too. A
+// driver opened with Options.EncodeFileNames accepts more keys, see
+// Driver.CheckKey.
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("%w: %w", ErrInvalidKey, ErrEmptyKey)
+	case len(key) > MaxKeyLen:
+		return fmt.Errorf("%w: key is %d bytes, at most %d allowed", ErrInvalidKey, len(key), MaxKeyLen)
+	case !utf8.ValidString(key):
+		return fmt.Errorf("%w: key is not valid UTF-8", ErrInvalidKey)
+	case strings.HasPrefix(key, "."):
+		return fmt.Errorf("%w: key must not start with '.'", ErrInvalidKey)
+	case strings.HasSuffix(key, ".tmp"):
+		return fmt.Errorf("%w: key must not end with .tmp", ErrInvalidKey)
+	case strings.EqualFold(key, lockFile):
+		return fmt.Errorf("%w: %s is the data directory's lock file", ErrInvalidKey, lockFile)
+	}
+
+	for _, r := range key {
+		switch {
+		case r == '/' || r == '\\':
+			return fmt.Errorf("%w: key must not contain %q; use another separator, such as ':'", ErrInvalidKey, r)
+		case unicode.IsSpace(r):
+			return fmt.Errorf("%w: key must not contain whitespace", ErrInvalidKey)
+		case unicode.IsControl(r):
+			return fmt.Errorf("%w: key must not contain control character %U", ErrInvalidKey, r)
+		}
+	}
+
+	// Catches what the rules above do not on every platform, such as drive
+	// letters and reserved device names on Windows
+	if !filepath.IsLocal(key) {
+		return fmt.Errorf("%w: key is not a plain file name", ErrInvalidKey)
+	}
+	return nil
+}
+
+// validateEncodedKey is the key rule when file names are encoded. The file
+// is named by encodeFileName rather than by the key, so a key may hold any
+// bytes, binary data, whitespace and separators included; it must only be
+// non-empty, at most MaxKeyLen bytes and not get the name of one of the
+// driver's own files.
+func validateEncodedKey(key string) error {
+	switch name := encodeFileName(key); {
+	case key == "":
+		return fmt.Errorf("%w: %w", ErrInvalidKey, ErrEmptyKey)
+	case len(key) > MaxKeyLen:
+		return fmt.Errorf("%w: key is %d bytes, at most %d allowed", ErrInvalidKey, len(key), MaxKeyLen)
+	case strings.HasPrefix(name, "."):
+		return fmt.Errorf("%w: key must not start with '.'", ErrInvalidKey)
+	case strings.HasSuffix(name, ".tmp"):
+		return fmt.Errorf("%w: key must not end with .tmp", ErrInvalidKey)
+	case strings.EqualFold(name, lockFile):
+		return fmt.Errorf("%w: %s is the data directory's lock file", ErrInvalidKey, lockFile)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooManyKeys is returned for writes that would take the number of keys
+// over Options.MaxKeys
+var ErrTooManyKeys = errors.New("too many keys")
+
+// KeyCount returns the number of keys in the index, which Options.MaxKeys
+// limits, and that limit, 0 for none. Expired keys count until the sweep or
+// a read removes them; reserved keys, see Reserved, do not count.
+func (d *Driver) KeyCount() (count, max int) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.tree.Len() - reservedCount(d.tree), d.maxKeys
+}
+
+// checkNewKey returns ErrTooManyKeys when key is not in the index and adding
+// it would take the index over Options.MaxKeys. The caller must hold the
+// write lock.
+func (d *Driver) checkNewKey(key string) error {
+	if d.tree.Has(&Item{Key: key}) {
+		return nil
+	}
+	return d.checkKeyCount(key, 1)
+}
+
+// checkBatchKeys is checkNewKey for every key of a batch at once. The caller
+// must hold the write lock.
+func (d *Driver) checkBatchKeys(entries []BatchEntry) error {
+	if d.maxKeys == 0 {
+		return nil
+	}
+	added := make(map[string]bool)
+	for _, e := range entries {
+		if !Reserved(e.Key) && !d.tree.Has(&Item{Key: e.Key}) {
+			added[e.Key] = true
+		}
+	}
+	for _, e := range entries {
+		if added[e.Key] {
+			return d.checkKeyCount(e.Key, len(added))
+		}
+	}
+	return nil
+}
+
+// checkKeyCount returns ErrTooManyKeys, naming key, when n more keys would
+// take the index over Options.MaxKeys. Replicas store whatever their primary
+// sends, as with quotas, and reserved keys are not counted. The caller must
+// hold the write lock.
+func (d *Driver) checkKeyCount(key string, n int) error {
+	if d.maxKeys == 0 || d.ReadOnly() || Reserved(key) {
+		return nil
+	}
+	// Reserved keys are only counted when the limit may be reached, as that
+	// visits each of them
+	count := d.tree.Len()
+	if count+n > d.maxKeys {
+		count -= reservedCount(d.tree)
+	}
+	if count+n > d.maxKeys {
+		return fmt.Errorf("%w: %s would be key %d, at most %d allowed", ErrTooManyKeys, key, count+n, d.maxKeys)
+	}
+	return nil
+}
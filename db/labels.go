@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// ErrInvalidLabels is returned, wrapped with the specific violation, for
+// labels or selectors breaking the rules of checkLabels
+var ErrInvalidLabels = errors.New("invalid labels")
+
+const (
+	// MaxLabels is how many labels a key may have
+	MaxLabels = 16
+	// MaxLabelNameLen is the longest label name accepted, in bytes
+	MaxLabelNameLen = 63
+	// MaxLabelValueLen is the longest label value accepted, in bytes
+	MaxLabelValueLen = 255
+)
+
+// labelChar reports whether c may appear in a label name or value, which
+// leaves out the '=' and ',' of selectors such as "env=prod,owner=team-x"
+func labelChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return c == '-' || c == '_' || c == '.' || c == '/' || c == ':'
+}
+
+// checkLabel returns ErrInvalidLabels for a name or value that is too long
+// or has characters other than letters, digits and "-_./:"
+func checkLabel(what, s string, maxLen int) error {
+	if len(s) > maxLen {
+		return fmt.Errorf("%w: label %s %q is %d bytes, at most %d allowed", ErrInvalidLabels, what, s, len(s), maxLen)
+	}
+	for i := 0; i < len(s); i++ {
+		if !labelChar(s[i]) {
+			return fmt.Errorf("%w: label %s %q may only hold letters, digits and -_./:", ErrInvalidLabels, what, s)
+		}
+	}
+	return nil
+}
+
+// checkLabels returns ErrInvalidLabels for more than MaxLabels labels or
+// for one with an empty or invalid name or an invalid value. Values may be
+// empty.
+func checkLabels(labels map[string]string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("%w: %d labels, at most %d allowed", ErrInvalidLabels, len(labels), MaxLabels)
+	}
+	for name, value := range labels {
+		if name == "" {
+			return fmt.Errorf("%w: label name is empty", ErrInvalidLabels)
+		}
+		if err := checkLabel("name", name, MaxLabelNameLen); err != nil {
+			return err
+		}
+		if err := checkLabel("value", value, MaxLabelValueLen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelTerm is the label index entry of a name and value
+func labelTerm(name, value string) string {
+	return name + "=" + value
+}
+
+// PutWithLabels stores the value for a key, as Put does, and replaces its
+// labels with labels, nil or empty to remove them. Labels are small
+// name=value pairs that QueryByLabel finds keys by; a Put without labels
+// keeps those the key has. They are saved in the B-tree snapshot, returned by
+// Stat and carried by Export and Import. Labels are checked against
+// MaxLabels, MaxLabelNameLen and MaxLabelValueLen, failing with
+// ErrInvalidLabels.
+func (d *Driver) PutWithLabels(key string, value []byte, labels map[string]string) (err error) {
+	defer d.ops.done(&d.ops.puts, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if err := checkLabels(labels); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	if err := d.checkSchema(key, value); err != nil {
+		return err
+	}
+	expiresAt, err := d.writeExpiry(0)
+	if err != nil {
+		return err
+	}
+
+	t := d.startOp(context.Background(), "put", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	if _, err := d.putLocked(key, value, expiresAt, t); err != nil {
+		return err
+	}
+	d.setLabelsLocked(key, labels)
+	return nil
+}
+
+// setLabelsLocked replaces the labels of a key in the B-tree and the label
+// index. The caller must hold the write lock.
+func (d *Driver) setLabelsLocked(key string, labels map[string]string) {
+	it, ok := d.tree.Get(&Item{Key: key}).(*Item)
+	if !ok || maps.Equal(it.Labels, labels) {
+		return
+	}
+
+	// Items are replaced rather than modified, as clones of the tree may
+	// still be walked by List and Count
+	updated := *it
+	updated.Labels = nil
+	if len(labels) > 0 {
+		updated.Labels = maps.Clone(labels)
+	}
+	d.unindexLabels(it)
+	d.tree.ReplaceOrInsert(&updated)
+	d.indexLabels(&updated)
+	d.snapshotStale = true
+}
+
+// indexLabels adds an item to the label index. The caller must hold the
+// write lock.
+func (d *Driver) indexLabels(it *Item) {
+	if len(it.Labels) == 0 {
+		return
+	}
+	if d.labels == nil {
+		d.labels = make(map[string]map[string]struct{})
+	}
+	for name, value := range it.Labels {
+		term := labelTerm(name, value)
+		keys := d.labels[term]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			d.labels[term] = keys
+		}
+		keys[it.Key] = struct{}{}
+	}
+}
+
+// unindexLabels removes an item from the label index. The caller must hold
+// the write lock.
+func (d *Driver) unindexLabels(it *Item) {
+	for name, value := range it.Labels {
+		term := labelTerm(name, value)
+		delete(d.labels[term], it.Key)
+		if len(d.labels[term]) == 0 {
+			delete(d.labels, term)
+		}
+	}
+}
+
+// rebuildLabels rebuilds the label index from the B-tree. The caller must
+// hold the write lock.
+func (d *Driver) rebuildLabels() {
+	d.labels = nil
+	d.tree.Ascend(func(i btree.Item) bool {
+		d.indexLabels(i.(*Item))
+		return true
+	})
+}
+
+// QueryByLabel returns up to limit keys, in key order, having every label in
+// selector with the value it gives. A limit <= 0 returns every match.
+// Expired keys are left out. An empty selector fails with ErrInvalidLabels,
+// as it would match every key.
+func (d *Driver) QueryByLabel(selector map[string]string, limit int) ([]string, error) {
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("%w: a selector needs at least one label", ErrInvalidLabels)
+	}
+	for name, value := range selector {
+		if err := checkLabels(map[string]string{name: value}); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	// Walk the fewest keys, those with the rarest label of the selector
+	var candidates map[string]struct{}
+	for name, value := range selector {
+		keys := d.labels[labelTerm(name, value)]
+		if candidates == nil || len(keys) < len(candidates) {
+			candidates = keys
+		}
+		if len(keys) == 0 {
+			return []string{}, nil
+		}
+	}
+
+	now := time.Now()
+	matches := []string{}
+	for key := range candidates {
+		it, ok := d.tree.Get(&Item{Key: key}).(*Item)
+		if !ok || it.expired(now) || !hasLabels(it.Labels, selector) {
+			continue
+		}
+		matches = append(matches, key)
+	}
+	sort.Strings(matches)
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// hasLabels reports whether labels holds every label of selector
+func hasLabels(labels, selector map[string]string) bool {
+	for name, value := range selector {
+		if v, ok := labels[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,435 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Layout names how the files in a data directory are named after the keys
+// they hold
+type Layout string
+
+const (
+	// LayoutFlat stores each key in a file of its own name, the layout
+	// without Options.EncodeFileNames
+	LayoutFlat Layout = "flat"
+	// LayoutEncodedV1 stores keys that are not portable file names under
+	// encoded names, the layout of Options.EncodeFileNames
+	LayoutEncodedV1 Layout = "encoded-v1"
+)
+
+const (
+	// layoutFile records the Layout of a data directory migrated by
+	// MigrateLayout, in the metadata directory. Directories without one are
+	// opened with the layout Options.EncodeFileNames gives.
+	layoutFile = "layout.json"
+	// layoutJournalFile records a MigrateLayout that has not finished
+	layoutJournalFile = "layout-migration.json"
+	// layoutJournalEvery is how many files MigrateLayout copies between
+	// saves of its journal
+	layoutJournalEvery = 100
+)
+
+// ErrLayoutMismatch is returned by Open for a data directory whose layout,
+// as MigrateLayout recorded it, is not the one the options give, and by
+// MigrateLayout for a directory not in the layout it is to migrate from
+var ErrLayoutMismatch = errors.New("data directory layout does not match")
+
+// ErrMigrationIncomplete is returned by Open for a data directory that a
+// MigrateLayout interrupted was working on
+var ErrMigrationIncomplete = errors.New("data directory layout migration has not finished")
+
+// ParseLayout returns the Layout named s, as accepted by zephyrusctl
+// migrate-layout
+func ParseLayout(s string) (Layout, error) {
+	switch l := Layout(s); l {
+	case LayoutFlat, LayoutEncodedV1:
+		return l, nil
+	}
+	return "", fmt.Errorf("%w: unknown layout %q, want %s or %s", ErrInvalidOption, s, LayoutFlat, LayoutEncodedV1)
+}
+
+// layoutOf returns the Layout of Options.EncodeFileNames
+func layoutOf(encoded bool) Layout {
+	if encoded {
+		return LayoutEncodedV1
+	}
+	return LayoutFlat
+}
+
+// fileName returns the name of the file holding key in the layout
+func (l Layout) fileName(key string) string {
+	if l == LayoutEncodedV1 {
+		return encodeFileName(key)
+	}
+	return key
+}
+
+// keyName returns the key held in a file named in the layout, and false for
+// a name that holds no key in it
+func (l Layout) keyName(name string) (string, bool) {
+	if l == LayoutEncodedV1 {
+		return decodeFileName(name)
+	}
+	return name, ValidateKey(name) == nil
+}
+
+// MigrateLayoutOptions configures MigrateLayout
+type MigrateLayoutOptions struct {
+	From Layout
+	To   Layout
+
+	// Dirs are the other directories holding keys, Options.ShardDirs and
+	// Options.ColdDir, which are migrated along with the data directory
+	Dirs []string
+
+	// Logger, when set, gets a line per step of the migration
+	Logger Logger
+
+	// Progress, when set, is called every time the journal is saved
+	Progress func(LayoutStats)
+}
+
+// LayoutStats reports how far MigrateLayout got, counting earlier runs
+// continued from the journal
+type LayoutStats struct {
+	Files   int  `json:"files"`   // files to be renamed; portable keys keep their name
+	Copied  int  `json:"copied"`  // files copied to their new name and verified
+	Removed int  `json:"removed"` // old files removed once the layout was recorded
+	Resumed bool `json:"resumed"` // an interrupted migration was continued
+}
+
+// layoutMove is a file to be renamed by MigrateLayout
+type layoutMove struct {
+	Dir  string `json:"dir"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// layoutJournal is the content of layoutJournalFile. Moves is planned before
+// anything is copied, so that a resumed migration does not mistake the files
+// it copied for keys of the old layout.
+type layoutJournal struct {
+	From   Layout       `json:"from"`
+	To     Layout       `json:"to"`
+	Moves  []layoutMove `json:"moves"`
+	Copied int          `json:"copied"` // moves copied and verified
+	Marked bool         `json:"marked"` // the layout was recorded and old files are being removed
+}
+
+// layoutState is the layout recorded in layoutFile
+type layoutState struct {
+	Layout Layout `json:"layout"`
+}
+
+// MigrateLayout renames every key file in the data directory dir, and in
+// opts.Dirs, from the opts.From layout to opts.To, for a database that is
+// not open. Each value is copied to its new name through a temp file and a
+// rename and read back against a checksum; once all are, the new layout is
+// recorded in the metadata directory and only then are the old files
+// removed. A journal there records the progress, so a migration that is
+// interrupted carries on from it when run again with the same layouts, and
+// Open refuses the directory with ErrMigrationIncomplete until it has. The
+// B-tree snapshot keeps working, as it is kept by key. Values stored once
+// by Options.DedupThreshold are copied, so each key gets a file of its own;
+// Compact then removes the blobs left unused.
+func MigrateLayout(ctx context.Context, dir string, opts MigrateLayoutOptions) (LayoutStats, error) {
+	var stats LayoutStats
+	if _, err := ParseLayout(string(opts.From)); err != nil {
+		return stats, err
+	}
+	if _, err := ParseLayout(string(opts.To)); err != nil {
+		return stats, err
+	}
+	if opts.From == opts.To {
+		return stats, fmt.Errorf("%w: the directory is already in the %s layout", ErrInvalidOption, opts.To)
+	}
+	dir = filepath.Clean(dir)
+	if _, err := os.Stat(dir); err != nil {
+		return stats, err
+	}
+	logf := func(format string, args ...interface{}) {
+		if opts.Logger != nil {
+			opts.Logger.Info(format, args...)
+		}
+	}
+
+	// Keep a driver, or another migration, off the directory meanwhile
+	lock, err := lockDir(dir)
+	if err != nil {
+		return stats, err
+	}
+	defer lock.release()
+
+	journal, err := loadLayoutJournal(dir)
+	if err != nil {
+		return stats, err
+	}
+	if journal != nil {
+		if journal.From != opts.From || journal.To != opts.To {
+			return stats, fmt.Errorf("%w: %s is being migrated from the %s to the %s layout; finish that first", ErrLayoutMismatch, dir, journal.From, journal.To)
+		}
+		stats.Resumed = true
+		logf("Resuming the migration of %s to the %s layout, %d of %d files copied", dir, opts.To, journal.Copied, len(journal.Moves))
+	} else {
+		layout, err := loadLayout(dir)
+		if err != nil {
+			return stats, err
+		}
+		if layout == opts.To {
+			logf("%s is already in the %s layout", dir, opts.To)
+			return stats, nil
+		}
+		if layout != "" && layout != opts.From {
+			return stats, fmt.Errorf("%w: %s is in the %s layout, not %s", ErrLayoutMismatch, dir, layout, opts.From)
+		}
+		moves, err := planLayout(dir, opts)
+		if err != nil {
+			return stats, err
+		}
+		journal = &layoutJournal{From: opts.From, To: opts.To, Moves: moves}
+		if err := saveLayoutJournal(dir, journal); err != nil {
+			return stats, err
+		}
+		logf("Migrating %d files of %s from the %s to the %s layout", len(moves), dir, opts.From, opts.To)
+	}
+	stats.Files, stats.Copied = len(journal.Moves), journal.Copied
+
+	progress := func() error {
+		if err := saveLayoutJournal(dir, journal); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+		return nil
+	}
+
+	for !journal.Marked && journal.Copied < len(journal.Moves) {
+		if err := ctx.Err(); err != nil {
+			progress()
+			return stats, err
+		}
+		m := journal.Moves[journal.Copied]
+		if err := copyVerified(filepath.Join(m.Dir, m.From), filepath.Join(m.Dir, m.To)); err != nil {
+			progress()
+			return stats, err
+		}
+		journal.Copied++
+		stats.Copied = journal.Copied
+		if journal.Copied%layoutJournalEvery == 0 {
+			if err := progress(); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	// Every value is in place under its new name: record the layout, then
+	// remove the old files
+	if !journal.Marked {
+		if err := saveLayout(dir, opts.To); err != nil {
+			return stats, err
+		}
+		journal.Marked = true
+		if err := progress(); err != nil {
+			return stats, err
+		}
+	}
+	for _, m := range journal.Moves {
+		if err := os.Remove(filepath.Join(m.Dir, m.From)); err != nil && !os.IsNotExist(err) {
+			return stats, fmt.Errorf("failed to remove %s: %w", filepath.Join(m.Dir, m.From), err)
+		}
+		stats.Removed++
+	}
+	if err := os.Remove(filepath.Join(dir, metaDir, layoutJournalFile)); err != nil {
+		return stats, err
+	}
+	if opts.Progress != nil {
+		opts.Progress(stats)
+	}
+	logf("Migrated %s to the %s layout: %d files renamed", dir, opts.To, stats.Files)
+	return stats, nil
+}
+
+// planLayout lists the key files whose name differs between the layouts,
+// failing for a name the old layout could not have produced and for keys
+// whose new name is taken
+func planLayout(dir string, opts MigrateLayoutOptions) ([]layoutMove, error) {
+	var moves []layoutMove
+	dirs := []string{dir}
+	for _, other := range opts.Dirs {
+		if other = filepath.Clean(other); !slices.Contains(dirs, other) {
+			dirs = append(dirs, other)
+		}
+	}
+	for _, from := range dirs {
+		entries, err := os.ReadDir(from)
+		if err != nil {
+			return nil, err
+		}
+		names := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			names[entry.Name()] = true
+		}
+		var planned []layoutMove
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || isLayoutInternal(name) || (from == dir && name == legacySnapshotFile) {
+				continue
+			}
+			key, ok := opts.From.keyName(name)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s is not a key file of the %s layout", ErrLayoutMismatch, filepath.Join(from, name), opts.From)
+			}
+			if opts.To == LayoutFlat {
+				if err := ValidateKey(key); err != nil {
+					return nil, fmt.Errorf("%w; %q has no file name of its own in the %s layout", err, key, opts.To)
+				}
+			}
+			to := opts.To.fileName(key)
+			if to == name {
+				continue
+			}
+			if len(to) > MaxKeyLen {
+				return nil, fmt.Errorf("%w: %s is %d bytes once named in the %s layout, at most %d allowed", ErrInvalidKey, key, len(to), opts.To, MaxKeyLen)
+			}
+			if names[to] {
+				return nil, fmt.Errorf("%w: %s would be renamed to %s, which is taken", ErrLayoutMismatch, filepath.Join(from, name), to)
+			}
+			planned = append(planned, layoutMove{Dir: from, From: name, To: to})
+		}
+		moves = append(moves, planned...)
+	}
+	return moves, nil
+}
+
+// isLayoutInternal reports whether a file in a data directory is not a key
+// file, as isInternalFile does without the driver's snapshot paths
+func isLayoutInternal(name string) bool {
+	return name[0] == '.' || filepath.Ext(name) == ".tmp" || name == lockFile
+}
+
+// copyVerified copies the file at from to to through a temp file and a
+// rename, and reads it back to check that it holds what from does
+func copyVerified(from, to string) error {
+	value, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := replaceWith(to, value); err != nil {
+		return err
+	}
+	written, err := os.ReadFile(to)
+	if err != nil {
+		return err
+	}
+	if hashValue(written) != hashValue(value) {
+		return fmt.Errorf("checksum of %s does not match %s after copying it", to, from)
+	}
+	return nil
+}
+
+// replaceWith writes data to path through a temp file and a rename, so that
+// path holds either its old content or data
+func replaceWith(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	if err := replaceFile(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+// loadLayout returns the layout recorded in dir, or "" when none is
+func loadLayout(dir string) (Layout, error) {
+	var state layoutState
+	data, err := os.ReadFile(filepath.Join(dir, metaDir, layoutFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to load the data directory layout: %w", err)
+	}
+	return state.Layout, nil
+}
+
+// saveLayout records the layout of dir
+func saveLayout(dir string, layout Layout) error {
+	data, err := json.Marshal(layoutState{Layout: layout})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, metaDir, layoutFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return replaceWith(path, data)
+}
+
+// loadLayoutJournal returns the journal of an unfinished migration of dir,
+// or nil when there is none
+func loadLayoutJournal(dir string) (*layoutJournal, error) {
+	data, err := os.ReadFile(filepath.Join(dir, metaDir, layoutJournalFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	var journal layoutJournal
+	if err == nil {
+		err = json.Unmarshal(data, &journal)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the layout migration journal: %w", err)
+	}
+	return &journal, nil
+}
+
+// saveLayoutJournal records the progress of a migration of dir
+func saveLayoutJournal(dir string, journal *layoutJournal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, metaDir, layoutJournalFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return replaceWith(path, data)
+}
+
+// checkLayout refuses a data directory that MigrateLayout has not finished
+// with, pointing at the command that finishes it, or whose recorded layout
+// is not the one of Options.EncodeFileNames
+func checkLayout(dir string, encoded bool) error {
+	journal, err := loadLayoutJournal(dir)
+	if err != nil {
+		return err
+	}
+	if journal != nil {
+		return fmt.Errorf("%w: %s is half migrated from the %s to the %s layout; finish with: zephyrusctl migrate-layout --from %s --to %s %s",
+			ErrMigrationIncomplete, dir, journal.From, journal.To, journal.From, journal.To, dir)
+	}
+	layout, err := loadLayout(dir)
+	if err != nil {
+		return err
+	}
+	if want := layoutOf(encoded); layout != "" && layout != want {
+		hint := "with EncodeFileNames set"
+		if layout == LayoutFlat {
+			hint = "without EncodeFileNames"
+		}
+		return fmt.Errorf("%w: %s is in the %s layout, open it %s", ErrLayoutMismatch, dir, layout, hint)
+	}
+	return nil
+}
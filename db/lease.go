@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LockNamespace is the namespace the locks taken with AcquireLock are kept
+// in, one key per lock name holding the owner's token and expiring with the
+// lease. It is reserved, see Reserved, so the tokens are not listed or
+// exported; writing its keys directly bypasses the token checks.
+const LockNamespace = "_lock"
+
+// ErrLockHeld is returned, as a *LockHeldError, by AcquireLock while another
+// owner holds the lock
+var ErrLockHeld = errors.New("lock is held")
+
+// ErrLockNotHeld is returned by RenewLock and ReleaseLock when the lock is
+// not held with the token given, because it expired, was released or was
+// taken by someone else since
+var ErrLockNotHeld = errors.New("lock is not held with this token")
+
+// LockHeldError tells how long the lock that could not be taken is held for
+type LockHeldError struct {
+	Name string
+	TTL  time.Duration // NoTTL for a lock key written without an expiry
+}
+
+func (e *LockHeldError) Error() string {
+	if e.TTL == NoTTL {
+		return fmt.Sprintf("%v: %s does not expire", ErrLockHeld, e.Name)
+	}
+	return fmt.Sprintf("%v: %s expires in %s", ErrLockHeld, e.Name, e.TTL.Round(time.Millisecond))
+}
+
+// Unwrap makes errors.Is(err, ErrLockHeld) hold
+func (e *LockHeldError) Unwrap() error {
+	return ErrLockHeld
+}
+
+// lockRecord is the value of a lock's key
+type lockRecord struct {
+	Token string `json:"token"`
+}
+
+// lockKey returns the key holding the lock name
+func lockKey(name string) string {
+	return LockNamespace + NamespaceSeparator + name
+}
+
+// checkLockName returns ErrInvalidKey for a lock name that does not make a
+// valid key
+func (d *Driver) checkLockName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: %w", ErrInvalidKey, ErrEmptyKey)
+	}
+	return d.checkKey(lockKey(name))
+}
+
+// checkLease returns ErrInvalidTTL for a lease that is not positive
+func checkLease(ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("%w: a lock needs a lease, got %s", ErrInvalidTTL, ttl)
+	}
+	return nil
+}
+
+// AcquireLock takes the lock name for ttl and returns the token that renews
+// and releases it. It does not wait: while the lock is held it fails at once
+// with a *LockHeldError saying how long the holder has left. A lock whose
+// lease ran out is free to take, and the sweeper of Options.SweepEvery
+// removes those nobody takes again.
+func (d *Driver) AcquireLock(name string, ttl time.Duration) (_ string, err error) {
+	defer d.ops.done(&d.ops.puts, 1, &err)
+	if err := d.checkLockName(name); err != nil {
+		return "", err
+	}
+	if err := checkLease(ttl); err != nil {
+		return "", err
+	}
+	if err := d.writable(); err != nil {
+		return "", err
+	}
+
+	key := lockKey(name)
+	t := d.startOp(context.Background(), "acquire_lock", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	if _, left, err := d.lockHolder(key); err != nil {
+		return "", err
+	} else if left != 0 {
+		return "", &LockHeldError{Name: name, TTL: left}
+	}
+
+	var b [16]byte
+	rand.Read(b[:])
+	token := hex.EncodeToString(b[:])
+	value, _ := json.Marshal(lockRecord{Token: token})
+	expiresAt, _ := expiryFor(ttl)
+	if _, err := d.putLocked(key, value, expiresAt, t); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RenewLock extends the lease of a lock held with token to ttl from now,
+// failing with ErrLockNotHeld when it is not held with it
+func (d *Driver) RenewLock(name, token string, ttl time.Duration) (err error) {
+	defer d.ops.done(&d.ops.puts, 1, &err)
+	if err := d.checkLockName(name); err != nil {
+		return err
+	}
+	if err := checkLease(ttl); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+
+	key := lockKey(name)
+	t := d.startOp(context.Background(), "renew_lock", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	if err := d.checkLockToken(key, token); err != nil {
+		return err
+	}
+	value, _ := json.Marshal(lockRecord{Token: token})
+	expiresAt, _ := expiryFor(ttl)
+	_, err = d.putLocked(key, value, expiresAt, t)
+	return err
+}
+
+// ReleaseLock frees a lock held with token, failing with ErrLockNotHeld when
+// it is not held with it, so that a holder whose lease ran out cannot free
+// the lock of the one who took it next
+func (d *Driver) ReleaseLock(name, token string) (err error) {
+	defer d.ops.done(&d.ops.deletes, 1, &err)
+	if err := d.checkLockName(name); err != nil {
+		return err
+	}
+	if err := d.deletable(); err != nil {
+		return err
+	}
+	key := lockKey(name)
+	return d.delete(context.Background(), key, func() error { return d.checkLockToken(key, token) })
+}
+
+// checkLockToken returns ErrLockNotHeld unless the lock at key is held with
+// token. The caller must hold the write lock.
+func (d *Driver) checkLockToken(key, token string) error {
+	holder, left, err := d.lockHolder(key)
+	if err != nil {
+		return err
+	}
+	if left == 0 || token == "" || holder != token {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// lockHolder returns the token of the lock at key and how long it is held
+// for, NoTTL when its key has no expiry and 0 when it is free. A key there
+// that is not a lock record is held by nobody's token. The caller must hold
+// the write lock.
+func (d *Driver) lockHolder(key string) (string, time.Duration, error) {
+	value, expiresAt, exists, err := d.readLocked(key, nil)
+	if err != nil || !exists {
+		return "", 0, err
+	}
+
+	left := NoTTL
+	if expiresAt != 0 {
+		if left = time.Duration(expiresAt - time.Now().UnixNano()); left <= 0 {
+			return "", 0, nil // ran out since it was read
+		}
+	}
+	var rec lockRecord
+	json.Unmarshal(value, &rec)
+	return rec.Token, left, nil
+}
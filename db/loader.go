@@ -0,0 +1,80 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrLoadFailed is returned by Get, wrapping the loader's error, when
+// Options.Loader fails to fetch a missing key
+var ErrLoadFailed = errors.New("loader failed")
+
+// skipLoaderKey marks a context made by SkipLoader
+type skipLoaderKey struct{}
+
+// SkipLoader returns a context with which GetContext reports a missing key
+// as missing instead of calling Options.Loader
+func SkipLoader(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipLoaderKey{}, true)
+}
+
+// load fetches a missing key with the loader, sharing one call among all
+// the callers waiting for the same key. A caller whose ctx is done stops
+// waiting without cancelling the load for the others.
+func (d *Driver) load(ctx context.Context, key string) ([]byte, error) {
+	ch := d.loads.DoChan(key, func() (any, error) {
+		return d.loadAndStore(context.WithoutCancel(ctx), key)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]byte), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// loadAndStore calls the loader and stores what it returns with
+// Options.LoaderTTL, unless the key was written meanwhile, in which case
+// that value wins. A driver that takes no writes, such as a replica, returns
+// the value without storing it.
+func (d *Driver) loadAndStore(ctx context.Context, key string) ([]byte, error) {
+	value, err := d.loader(ctx, key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrLoadFailed, key, err)
+	}
+	d.ops.loads.Add(1)
+	if value == nil {
+		value = []byte{}
+	}
+	if d.writable() != nil {
+		return value, nil
+	}
+
+	t := d.startOp(ctx, "load", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	current, _, exists, err := d.readLocked(key, t)
+	if err != nil || exists {
+		return current, err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return nil, err
+	}
+	if err := d.checkSchema(key, value); err != nil {
+		return nil, err
+	}
+	expiresAt, _ := d.writeExpiry(d.loaderTTL)
+	if _, err := d.putLocked(key, value, expiresAt, t); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
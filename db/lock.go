@@ -0,0 +1,38 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lockFile is the file in the data directory that Open locks, naming the
+// process holding it
+const lockFile = "LOCK"
+
+// ErrLocked is returned by Open when the data directory is in use by another
+// process
+var ErrLocked = errors.New("database is locked")
+
+// lockedBy returns ErrLocked naming the PID found in the lock file at path
+func lockedBy(path string) error {
+	if pid := lockPID(path); pid != 0 {
+		return fmt.Errorf("%w by PID %d", ErrLocked, pid)
+	}
+	return ErrLocked
+}
+
+// lockPID returns the PID written to the lock file at path, or 0
+func lockPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,62 @@
+//go:build !unix
+
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// dirLock is a lock file created exclusively in the data directory, holding
+// the PID of the process that created it
+type dirLock struct {
+	path string
+}
+
+// lockDir locks dir for this process, failing with ErrLocked while another
+// running process holds the lock. A lock left behind by a process that is no
+// longer running is taken over.
+func lockDir(dir string) (*dirLock, error) {
+	path := filepath.Join(dir, lockFile)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &dirLock{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if pid := lockPID(path); pid != 0 && processAlive(pid) {
+			return nil, lockedBy(path)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// release removes the lock file
+func (l *dirLock) release() error {
+	return os.Remove(l.path)
+}
+
+// processAlive reports whether a process with the given PID is running.
+// FindProcess fails for processes that do not exist.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
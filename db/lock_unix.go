@@ -0,0 +1,52 @@
+//go:build unix
+
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// dirLock is an flock on the data directory's lock file. The kernel drops it
+// when the process exits, so a lock left by a crashed process is never in
+// the way.
+type dirLock struct {
+	f *os.File
+}
+
+// lockDir locks dir for this process, failing with ErrLocked while another
+// process holds the lock
+func lockDir(dir string) (*dirLock, error) {
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, lockedBy(path)
+		}
+		return nil, err
+	}
+
+	// Name this process for whoever finds the directory locked
+	if err := f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &dirLock{f: f}, nil
+}
+
+// release unlocks the directory. The lock file is left in place, since
+// removing it could let two processes lock different files.
+func (l *dirLock) release() error {
+	l.f.Truncate(0)
+	return l.f.Close()
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+// LogLevel is the least severe message a logger writes
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLogLevel parses "debug", "info", "warn" or "error"
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// ErrLogLevelUnsupported is returned by SetLogLevel when the driver's Logger
+// has no way to change its level
+var ErrLogLevelUnsupported = errors.New("the logger does not support changing the level")
+
+// FieldLogger is a Logger that also takes key/value fields. When the driver's
+// Logger is one, operations on keys are logged with "op", "key" and
+// "duration" fields.
+type FieldLogger interface {
+	Logger
+	LogFields(level LogLevel, msg string, args ...any)
+}
+
+// levelSetter is implemented by loggers whose level can change at runtime,
+// such as SlogLogger
+type levelSetter interface {
+	SetLevel(LogLevel)
+}
+
+// lumberLeveler is implemented by the lumber loggers
+type lumberLeveler interface {
+	Level(int)
+}
+
+// SetLogLevel changes the level of the driver's Logger while it runs. It
+// works with SlogLogger and the lumber loggers, and returns
+// ErrLogLevelUnsupported for others.
+func (d *Driver) SetLogLevel(level LogLevel) error {
+	if level < LevelDebug || level > LevelError {
+		return fmt.Errorf("invalid log level %d", level)
+	}
+	switch l := d.log.(type) {
+	case levelSetter:
+		l.SetLevel(level)
+	case lumberLeveler:
+		l.Level(lumber.DEBUG + int(level))
+	default:
+		return ErrLogLevelUnsupported
+	}
+	d.log.Info("Log level set to %s", level)
+	return nil
+}
+
+// logOp logs an operation on a key that started at start. Operations served
+// from memory pass a zero start and are logged without a duration.
+func (d *Driver) logOp(level LogLevel, op, key string, start time.Time, format string, args ...interface{}) {
+	if fl, ok := d.log.(FieldLogger); ok {
+		fields := []any{"op", op, "key", key}
+		if !start.IsZero() {
+			fields = append(fields, "duration", time.Since(start))
+		}
+		fl.LogFields(level, fmt.Sprintf(format, args...), fields...)
+		return
+	}
+	switch level {
+	case LevelDebug:
+		d.log.Debug(format, args...)
+	case LevelInfo:
+		d.log.Info(format, args...)
+	case LevelWarn:
+		d.log.Warn(format, args...)
+	default:
+		d.log.Error(format, args...)
+	}
+}
+
+// levelFatal is where Fatal messages go in slog, which has no such level
+const levelFatal = slog.LevelError + 4
+
+// SlogLogger adapts a *slog.Logger to Logger. Messages below its level are
+// dropped before they reach the slog handler, so a handler that should let
+// SetLogLevel lower the level must itself allow the lower levels, for
+// example by sharing the same *slog.LevelVar.
+type SlogLogger struct {
+	logger *slog.Logger
+	level  *slog.LevelVar
+}
+
+// NewSlogLogger returns a Logger writing to logger at the given level. When
+// level is nil it starts at info.
+func NewSlogLogger(logger *slog.Logger, level *slog.LevelVar) *SlogLogger {
+	if level == nil {
+		level = new(slog.LevelVar)
+	}
+	return &SlogLogger{logger: logger, level: level}
+}
+
+// slogLevels maps a LogLevel to the slog one
+var slogLevels = []slog.Level{slog.LevelDebug, slog.LevelInfo, slog.LevelWarn, slog.LevelError}
+
+// SetLevel changes the least severe message written
+func (s *SlogLogger) SetLevel(level LogLevel) {
+	s.level.Set(slogLevels[level])
+}
+
+func (s *SlogLogger) log(level slog.Level, msg string, args ...any) {
+	if level < s.level.Level() {
+		return
+	}
+	s.logger.Log(context.Background(), level, msg, args...)
+}
+
+// LogFields logs msg with key/value fields, as slog.Logger.Log does
+func (s *SlogLogger) LogFields(level LogLevel, msg string, args ...any) {
+	s.log(slogLevels[level], msg, args...)
+}
+
+func (s *SlogLogger) Fatal(format string, v ...interface{}) {
+	s.log(levelFatal, fmt.Sprintf(format, v...))
+}
+
+func (s *SlogLogger) Error(format string, v ...interface{}) {
+	s.log(slog.LevelError, fmt.Sprintf(format, v...))
+}
+
+func (s *SlogLogger) Warn(format string, v ...interface{}) {
+	s.log(slog.LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (s *SlogLogger) Info(format string, v ...interface{}) {
+	s.log(slog.LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (s *SlogLogger) Debug(format string, v ...interface{}) {
+	s.log(slog.LevelDebug, fmt.Sprintf(format, v...))
+}
+
+// Logger returns the logger the driver writes to, for callers that want
+// their messages alongside the driver's
+func (d *Driver) Logger() Logger {
+	return d.log
+}
@@ -0,0 +1,322 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrMirrorFailed is returned, wrapping the mirror's error, by the writes
+// Options.MirrorSync could not forward. The write itself was applied.
+var ErrMirrorFailed = errors.New("mirror failed")
+
+// Mirror is a second store that Options.Mirror copies every write to, such
+// as another Driver (see DriverMirror) or a remote server (see
+// client.NewMirror)
+type Mirror interface {
+	// Put stores value at key for ttl, NoTTL for no expiry
+	Put(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes key, returning nil when it is not there
+	Delete(ctx context.Context, key string) error
+	// Keys returns every key the mirror holds
+	Keys(ctx context.Context) ([]string, error)
+	// ETag returns the content hash of the value at key, as Stat reports
+	// it, or "" when there is no such key
+	ETag(ctx context.Context, key string) (string, error)
+}
+
+// MirrorStats tells how far Options.Mirror is behind
+type MirrorStats struct {
+	Pending   int64  `json:"pending"`   // writes queued or being forwarded
+	Forwarded uint64 `json:"forwarded"` // writes the mirror took
+	Failed    uint64 `json:"failed"`    // writes the mirror still refused after the retries
+	Dropped   uint64 `json:"dropped"`   // writes not queued because the queue was full
+	LastError string `json:"last_error,omitempty"`
+}
+
+// ResyncStats tells what ResyncMirror did
+type ResyncStats struct {
+	Checked int // keys compared
+	Copied  int // keys put on the mirror because they differed or were missing there
+	Removed int // keys deleted from the mirror because they are not here
+}
+
+const (
+	// defaultMirrorQueue is the queue bound of Options.MirrorQueue 0
+	defaultMirrorQueue = 10000
+	// The attempts at forwarding a queued write and the pause before the
+	// first retry, doubled for each one after
+	mirrorAttempts = 5
+	mirrorBackoff  = 100 * time.Millisecond
+)
+
+// mirrorOp is a write waiting to be forwarded
+type mirrorOp struct {
+	op        Op
+	key       string
+	value     []byte // nil for a streamed value, read back when forwarded
+	expiresAt int64
+}
+
+// mirror forwards writes to Options.Mirror and counts how that goes
+type mirror struct {
+	to    Mirror
+	sync  bool
+	queue chan mirrorOp // nil with sync
+
+	pending                    atomic.Int64
+	forwarded, failed, dropped atomic.Uint64
+	errMu                      sync.Mutex
+	lastErr                    string
+}
+
+// fail counts a write the mirror refused
+func (m *mirror) fail(err error) {
+	m.failed.Add(1)
+	m.errMu.Lock()
+	m.lastErr = err.Error()
+	m.errMu.Unlock()
+}
+
+// mirrorStats returns the counters of Options.Mirror, or nil without one
+func (d *Driver) mirrorStats() *MirrorStats {
+	m := d.mirror
+	if m == nil {
+		return nil
+	}
+	m.errMu.Lock()
+	defer m.errMu.Unlock()
+	return &MirrorStats{
+		Pending:   m.pending.Load(),
+		Forwarded: m.forwarded.Load(),
+		Failed:    m.failed.Load(),
+		Dropped:   m.dropped.Load(),
+		LastError: m.lastErr,
+	}
+}
+
+// mirrorLocked hands a write that has just been applied to the mirror: with
+// Options.MirrorSync it is forwarded now, failing with ErrMirrorFailed when
+// the mirror refuses it, and otherwise it is queued. OpExpire is forwarded
+// as a delete, and reserved keys are not forwarded. The caller must hold the write lock, so that the mirror sees
+// the writes in the order they were applied.
+func (d *Driver) mirrorLocked(op Op, key string, value []byte, expiresAt int64) error {
+	m := d.mirror
+	if m == nil || Reserved(key) {
+		return nil
+	}
+	if !m.sync {
+		m.pending.Add(1)
+		select {
+		case m.queue <- mirrorOp{op: op, key: key, value: value, expiresAt: expiresAt}:
+		default:
+			m.pending.Add(-1)
+			m.dropped.Add(1)
+			d.log.Warn("Mirror queue is full, dropped the write of %s", key)
+		}
+		return nil
+	}
+
+	if op == OpPut && value == nil {
+		var err error
+		if value, _, _, err = d.readLocked(key, nil); err != nil {
+			return err
+		}
+	}
+	if err := d.forward(context.Background(), mirrorOp{op: op, key: key, value: value, expiresAt: expiresAt}); err != nil {
+		m.fail(err)
+		d.log.Error("Failed to mirror %s: %v", key, err)
+		return fmt.Errorf("%w: %s: %w", ErrMirrorFailed, key, err)
+	}
+	m.forwarded.Add(1)
+	return nil
+}
+
+// forward applies one write to the mirror. A put whose expiry has passed
+// meanwhile is forwarded as a delete.
+func (d *Driver) forward(ctx context.Context, w mirrorOp) error {
+	if w.op != OpPut {
+		return d.mirror.to.Delete(ctx, w.key)
+	}
+	ttl := NoTTL
+	if w.expiresAt != 0 {
+		if ttl = time.Until(time.Unix(0, w.expiresAt)); ttl <= 0 {
+			return d.mirror.to.Delete(ctx, w.key)
+		}
+	}
+	return d.mirror.to.Put(ctx, w.key, w.value, ttl)
+}
+
+// mirrorLoop forwards the queued writes until Close, retrying each with
+// backoff before counting it as failed. Once closing it tries what is
+// still queued once each.
+func (d *Driver) mirrorLoop() {
+	defer d.background.Done()
+	for {
+		select {
+		case w := <-d.mirror.queue:
+			d.forwardQueued(w, mirrorAttempts)
+		case <-d.stop:
+			for {
+				select {
+				case w := <-d.mirror.queue:
+					d.forwardQueued(w, 1)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// forwardQueued forwards a queued write in up to attempts tries. A streamed
+// value is read back first; when the key is gone by then, a later write in
+// the queue removes it from the mirror.
+func (d *Driver) forwardQueued(w mirrorOp, attempts int) {
+	m := d.mirror
+	defer m.pending.Add(-1)
+
+	if w.op == OpPut && w.value == nil {
+		d.mutex.RLock()
+		value, _, exists, err := d.readLocked(w.key, nil)
+		d.mutex.RUnlock()
+		if err != nil {
+			m.fail(err)
+			return
+		}
+		if !exists {
+			return
+		}
+		w.value = value
+	}
+
+	backoff := mirrorBackoff
+	for i := 1; ; i++ {
+		err := d.forward(context.Background(), w)
+		if err == nil {
+			m.forwarded.Add(1)
+			return
+		}
+		if i >= attempts {
+			m.fail(err)
+			d.log.Error("Failed to mirror %s after %d attempts: %v", w.key, i, err)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-d.stop:
+			attempts = i + 1 // closing: one last try
+		}
+	}
+}
+
+// ResyncMirror brings Options.Mirror back in line with this driver after
+// writes were dropped or failed to reach it: it puts every key whose ETag
+// differs on the mirror, or that the mirror lacks, and deletes the keys the
+// mirror has that are not here. Writes made meanwhile are forwarded as
+// usual, so running it while writes go on is safe. It fails with
+// ErrInvalidOption without a mirror.
+func (d *Driver) ResyncMirror(ctx context.Context) (ResyncStats, error) {
+	var stats ResyncStats
+	if d.mirror == nil {
+		return stats, fmt.Errorf("%w: no mirror is configured", ErrInvalidOption)
+	}
+	if err := d.checkOpen(); err != nil {
+		return stats, err
+	}
+	to := d.mirror.to
+
+	keys, err := d.List(ctx, "", "", 0)
+	if err != nil {
+		return stats, err
+	}
+	theirs, err := to.Keys(ctx)
+	if err != nil {
+		return stats, err
+	}
+	sort.Strings(theirs)
+
+	for _, key := range keys {
+		stats.Checked++
+		info, err := d.Stat(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue // deleted since it was listed
+		}
+		if err != nil {
+			return stats, err
+		}
+		etag, err := to.ETag(ctx, key)
+		if err != nil {
+			return stats, err
+		}
+		if etag == info.ETag {
+			continue
+		}
+		value, err := d.GetContext(SkipLoader(ctx), key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		if err := to.Put(ctx, key, value, info.TTL); err != nil {
+			return stats, err
+		}
+		stats.Copied++
+	}
+
+	for _, key := range theirs {
+		if i := sort.SearchStrings(keys, key); i < len(keys) && keys[i] == key {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if err := to.Delete(ctx, key); err != nil {
+			return stats, err
+		}
+		stats.Removed++
+	}
+	d.log.Info("Resynced the mirror: %d keys checked, %d copied, %d removed", stats.Checked, stats.Copied, stats.Removed)
+	return stats, nil
+}
+
+// driverMirror is the Mirror of DriverMirror
+type driverMirror struct {
+	d *Driver
+}
+
+// DriverMirror returns a Mirror writing to d, such as a driver opened on a
+// directory on another disk
+func DriverMirror(d *Driver) Mirror {
+	return driverMirror{d: d}
+}
+
+func (m driverMirror) Put(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := m.d.putWithTTL(ctx, key, value, ttl)
+	return err
+}
+
+func (m driverMirror) Delete(ctx context.Context, key string) error {
+	if err := m.d.DeleteContext(ctx, key); err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (m driverMirror) Keys(ctx context.Context) ([]string, error) {
+	return m.d.List(ctx, "", "", 0)
+}
+
+func (m driverMirror) ETag(ctx context.Context, key string) (string, error) {
+	info, err := m.d.Stat(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return "", nil
+	}
+	return info.ETag, err
+}
@@ -0,0 +1,333 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Record is one line of the NDJSON format used by Import and Export. JSON
+// values are carried inline in Value; anything else is base64 encoded in
+// ValueBase64. A key that is not valid UTF-8, which only a driver with
+// Options.EncodeFileNames stores, is base64 encoded in key_base64 and Key
+// left empty. Export includes the times the key was created and last
+// written, when they are known, and its labels, and Import keeps them.
+type Record struct {
+	Key         string          `json:"key"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	ValueBase64 []byte          `json:"value_base64,omitempty"`
+	CreatedAt   *time.Time      `json:"created_at,omitempty"`
+	UpdatedAt   *time.Time      `json:"updated_at,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NewRecord builds the record for a key and value
+func NewRecord(key string, value []byte) Record {
+	if json.Valid(value) {
+		return Record{Key: key, Value: json.RawMessage(value)}
+	}
+	return Record{Key: key, ValueBase64: value}
+}
+
+// Bytes returns the stored value the record carries
+func (r *Record) Bytes() []byte {
+	if r.Value != nil {
+		return r.Value
+	}
+	if r.ValueBase64 == nil {
+		return []byte{}
+	}
+	return r.ValueBase64
+}
+
+// ImportMode controls what Import does with keys that already exist
+type ImportMode int
+
+const (
+	ImportOverwrite ImportMode = iota // replace existing values
+	ImportSkip                        // keep existing values
+)
+
+// maxImportErrors caps how many per-record errors ImportStats keeps
+const maxImportErrors = 10
+
+// ImportError describes a record that could not be imported
+type ImportError struct {
+	Line  int    `json:"line"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+// ImportStats summarizes an Import
+type ImportStats struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Failed   int           `json:"failed"`
+	Errors   []ImportError `json:"errors"`
+}
+
+func (s *ImportStats) fail(line int, key string, err error) {
+	s.Failed++
+	if len(s.Errors) < maxImportErrors {
+		s.Errors = append(s.Errors, ImportError{Line: line, Key: key, Error: err.Error()})
+	}
+}
+
+// Import reads NDJSON records from r and stores them one at a time as they
+// arrive, so the input is never buffered as a whole. Malformed records are
+// counted and skipped; the returned error is only set when reading r fails.
+// Summary lines written by Export are ignored.
+func (d *Driver) Import(r io.Reader, mode ImportMode) (ImportStats, error) {
+	return d.ImportChecked(r, mode, nil)
+}
+
+// ImportChecked is Import failing the records whose key check, unless nil,
+// returns an error for, as when the caller may only write some keys
+func (d *Driver) ImportChecked(r io.Reader, mode ImportMode, check func(key string) error) (ImportStats, error) {
+	stats := ImportStats{Errors: []ImportError{}}
+	if err := d.writable(); err != nil {
+		return stats, err
+	}
+	reader := bufio.NewReader(r)
+
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return stats, err
+		}
+
+		if data = bytes.TrimSpace(data); len(data) > 0 {
+			d.importRecord(data, line, mode, check, &stats)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	d.log.Info("Imported %d records (%d skipped, %d failed)", stats.Imported, stats.Skipped, stats.Failed)
+	return stats, nil
+}
+
+func (d *Driver) importRecord(data []byte, line int, mode ImportMode, check func(string) error, stats *ImportStats) {
+	var summary struct {
+		Summary json.RawMessage `json:"summary"`
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		stats.fail(line, "", fmt.Errorf("invalid record: %v", err))
+		return
+	}
+	if summary.Summary != nil {
+		return
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		stats.fail(line, "", fmt.Errorf("invalid record: %v", err))
+		return
+	}
+	if err := d.checkKey(rec.Key); err != nil {
+		stats.fail(line, rec.Key, err)
+		return
+	}
+	if check != nil {
+		if err := check(rec.Key); err != nil {
+			stats.fail(line, rec.Key, err)
+			return
+		}
+	}
+
+	if err := d.importValue(&rec, mode == ImportSkip); err != nil {
+		if errors.Is(err, ErrKeyExists) {
+			stats.Skipped++
+			return
+		}
+		stats.fail(line, rec.Key, err)
+		return
+	}
+	stats.Imported++
+}
+
+// importValue stores a record as Put does, or as Create does with
+// skipExisting, then gives the key the times and labels the record carries
+func (d *Driver) importValue(rec *Record, skipExisting bool) error {
+	key, value := rec.Key, rec.Bytes()
+	if err := checkLabels(rec.Labels); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	if err := d.checkSchema(key, value); err != nil {
+		return err
+	}
+
+	t := d.startOp(context.Background(), "put", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	if skipExisting {
+		exists, err := d.existsLocked(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("%w: %s", ErrKeyExists, key)
+		}
+	}
+	expiresAt, _ := d.writeExpiry(0)
+	if _, err := d.putLocked(key, value, expiresAt, t); err != nil {
+		return err
+	}
+	if rec.Labels != nil {
+		d.setLabelsLocked(key, rec.Labels)
+	}
+	if rec.CreatedAt == nil && rec.UpdatedAt == nil {
+		return nil
+	}
+
+	// Items are replaced rather than modified, as clones of the tree may
+	// still be walked by List and Count
+	item := *d.tree.Get(&Item{Key: key}).(*Item)
+	if rec.CreatedAt != nil {
+		item.CreatedAt = rec.CreatedAt.UnixNano()
+	}
+	if rec.UpdatedAt != nil {
+		item.UpdatedAt = rec.UpdatedAt.UnixNano()
+	}
+	d.tree.ReplaceOrInsert(&item)
+	return nil
+}
+
+// ExportSummary is the trailing line written by Export. A download that does
+// not end with it was truncated.
+type ExportSummary struct {
+	Count int `json:"count"`
+}
+
+// Export writes every key starting with prefix to w as NDJSON records in key
+// order, followed by a {"summary": {"count": N}} line. Values are read one at
+// a time, so the dataset is never held in memory, and reads bypass the cache
+// so an export does not evict the working set. Temp files and snapshots in
+// the data directory, and reserved keys, are skipped.
+func (d *Driver) Export(w io.Writer, prefix string) (int, error) {
+	return d.ExportPrefixes(w, []string{prefix})
+}
+
+// ExportPrefixes is Export of the keys starting with any of prefixes, which
+// exports nothing when there are none
+func (d *Driver) ExportPrefixes(w io.Writer, prefixes []string) (int, error) {
+	return d.ExportMatching(w, prefixes, nil)
+}
+
+// ExportMatching is ExportPrefixes of only the keys whose values filter
+// matches, or every key when filter is nil. Values that do not match are
+// read but never encoded, and are not counted in the summary.
+func (d *Driver) ExportMatching(w io.Writer, prefixes []string, filter *Filter) (int, error) {
+	names, err := d.keyFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	count := 0
+	for _, name := range names {
+		if !hasAnyPrefix(name, prefixes) || Reserved(name) {
+			continue
+		}
+
+		value, ok, err := d.readUncached(name)
+		if err != nil {
+			return count, err
+		}
+		if !ok || !filter.Match(value) {
+			// Deleted or expired since the directory was listed, or left out
+			continue
+		}
+
+		rec := NewRecord(name, value)
+		d.recordMeta(&rec)
+		if err := enc.Encode(rec); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	if err := enc.Encode(map[string]ExportSummary{"summary": {Count: count}}); err != nil {
+		return count, err
+	}
+
+	d.log.Info("Exported %d keys with prefix %q", count, strings.Join(prefixes, " "))
+	return count, nil
+}
+
+// hasAnyPrefix reports whether key starts with one of prefixes
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordMeta sets when the key of rec was created and last written, leaving
+// nil the times that are not known, and its labels
+func (d *Driver) recordMeta(rec *Record) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	it, ok := d.tree.Get(&Item{Key: rec.Key}).(*Item)
+	if !ok {
+		return
+	}
+	if it.CreatedAt != 0 {
+		t := time.Unix(0, it.CreatedAt).UTC()
+		rec.CreatedAt = &t
+	}
+	if it.UpdatedAt != 0 {
+		t := time.Unix(0, it.UpdatedAt).UTC()
+		rec.UpdatedAt = &t
+	}
+	rec.Labels = it.Labels
+}
+
+// readUncached reads a value from memory or disk without adding it to the
+// cache. It returns false when the key does not exist or has expired.
+func (d *Driver) readUncached(key string) ([]byte, bool, error) {
+	d.mutex.RLock()
+	if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok {
+		if it.expired(time.Now()) {
+			d.mutex.RUnlock()
+			return nil, false, nil
+		}
+		if it.Value != nil {
+			d.mutex.RUnlock()
+			return it.Value, true, nil
+		}
+	}
+	filePath := d.keyPath(key)
+	d.mutex.RUnlock()
+
+	// Files are replaced by rename, so reading without the lock sees either
+	// the old or the new value in full
+	value, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		d.log.Error("Failed to read file: %v", err)
+		return nil, false, err
+	}
+	return value, true, nil
+}
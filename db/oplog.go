@@ -0,0 +1,310 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// oplogDir is the directory in the data directory holding the operation log.
+// Being a dotfile, it is never taken for a key.
+const oplogDir = ".oplog"
+
+// maxSegmentSize is how many changes an oplog segment holds at most.
+// Retention drops whole segments, so a log may hold up to one segment more
+// than its configured size.
+const maxSegmentSize = 1000
+
+// ErrOplogDisabled is returned by Oplog when the driver keeps no operation log
+var ErrOplogDisabled = errors.New("operation log is disabled")
+
+// errBadChecksum is returned for an oplog line whose checksum does not match,
+// which is how a write cut short by a crash shows up
+var errBadChecksum = errors.New("oplog checksum mismatch")
+
+// crcField ends every oplog line, holding a CRC-32 of the line before it
+const crcField = `,"crc":`
+
+// encodeOplogLine encodes a change as one line of a segment
+func encodeOplogLine(c Change) ([]byte, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	sum := crc32.ChecksumIEEE(data)
+	return fmt.Appendf(data[:len(data)-1], "%s%d}\n", crcField, sum), nil
+}
+
+// decodeOplogLine decodes a line written by encodeOplogLine, without its
+// newline, checking it against its checksum
+func decodeOplogLine(line []byte) (Change, error) {
+	var c Change
+	i := bytes.LastIndex(line, []byte(crcField))
+	if i < 0 || !bytes.HasSuffix(line, []byte("}")) {
+		return c, errBadChecksum
+	}
+	sum, err := strconv.ParseUint(string(line[i+len(crcField):len(line)-1]), 10, 32)
+	if err != nil || crc32.ChecksumIEEE(append(line[:i:i], '}')) != uint32(sum) {
+		return c, errBadChecksum
+	}
+	err = json.Unmarshal(line, &c)
+	return c, err
+}
+
+// segment is one file of the operation log, named after its first sequence
+// number
+type segment struct {
+	first uint64
+	path  string
+}
+
+// oplog is a bounded log of changes on disk, split into segments so that old
+// changes can be dropped by removing files. Entries carry the content hash of
+// a put rather than its value.
+type oplog struct {
+	dir         string
+	maxEntries  int
+	maxAge      time.Duration
+	segmentSize int
+	keepValues  bool
+
+	segments []segment // oldest first
+	file     *os.File  // the newest segment, open for appending
+	count    int       // changes in the newest segment
+	torn     int64     // bytes of a change cut short by a crash, dropped on open
+
+	failpoint func(name string) error // the driver's, see failpoint.go
+}
+
+// openOplog opens the log in dir, creating it if needed, and returns the
+// sequence number of the last change it holds
+func openOplog(dir string, maxEntries int, maxAge time.Duration) (*oplog, uint64, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, 0, err
+	}
+
+	l := &oplog{dir: dir, maxEntries: maxEntries, maxAge: maxAge, segmentSize: maxSegmentSize}
+	if maxEntries > 0 && maxEntries < 4*maxSegmentSize {
+		l.segmentSize = max(maxEntries/4, 1)
+	}
+
+	var err error
+	if l.segments, err = listSegments(dir); err != nil {
+		return nil, 0, err
+	}
+
+	if len(l.segments) == 0 {
+		return l, 0, nil
+	}
+
+	// Find the last complete change, dropping a line cut short by a crash
+	newest := l.segments[len(l.segments)-1]
+	file, err := os.OpenFile(newest.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	var last uint64
+	var size int64
+	count := 0
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		c, err := decodeOplogLine(line[:len(line)-1])
+		if err != nil {
+			break
+		}
+		last, size = c.Seq, size+int64(len(line))
+		count++
+	}
+	if fi, err := file.Stat(); err == nil {
+		l.torn = fi.Size() - size
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if count == 0 {
+		last = newest.first - 1
+	}
+
+	l.file, l.count = file, count
+	l.applyRetention(last)
+	return l, last, nil
+}
+
+// listSegments returns the segments of the log in dir, oldest first
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, ".log"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		segments = append(segments, segment{first: first, path: filepath.Join(dir, name)})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+// append writes a change to the newest segment, starting a new one when it
+// is full. Retention is applied whenever a segment is started.
+func (l *oplog) append(c Change) error {
+	if l.file == nil || l.count >= l.segmentSize {
+		if l.file != nil {
+			l.file.Close()
+			l.file = nil
+		}
+		path := filepath.Join(l.dir, fmt.Sprintf("%020d.log", c.Seq))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0644)
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, segment{first: c.Seq, path: path})
+		l.file, l.count = file, 0
+		l.applyRetention(c.Seq)
+	}
+
+	if !l.keepValues {
+		c.Value = nil
+	}
+	line, err := encodeOplogLine(c)
+	if err != nil {
+		return err
+	}
+	// One write per line, so readers never see two changes interleaved
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	if l.failpoint != nil {
+		if err := l.failpoint(fpOplogAppended); err != nil {
+			return err
+		}
+	}
+	l.count++
+	return nil
+}
+
+// close syncs the newest segment to disk and closes it
+func (l *oplog) close() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Sync()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	return err
+}
+
+// applyRetention removes the oldest segments while the rest still hold
+// maxEntries changes, or while they are older than maxAge. The newest
+// segment is always kept.
+func (l *oplog) applyRetention(last uint64) {
+	for len(l.segments) > 1 {
+		oldest, next := l.segments[0], l.segments[1]
+		drop := l.maxEntries > 0 && last-next.first+1 >= uint64(l.maxEntries)
+		if !drop && l.maxAge > 0 {
+			if info, err := os.Stat(oldest.path); err == nil && time.Since(info.ModTime()) > l.maxAge {
+				drop = true
+			}
+		}
+		if !drop {
+			return
+		}
+		os.Remove(oldest.path)
+		l.segments = l.segments[1:]
+	}
+}
+
+// oldest returns the sequence number of the oldest change in the log
+func (l *oplog) oldest(last uint64) uint64 {
+	if len(l.segments) == 0 {
+		return last + 1
+	}
+	return l.segments[0].first
+}
+
+// Oplog returns up to limit changes from the operation log made after the
+// change numbered since, or all of them when limit is 0. Puts carry the
+// content hash of the new value but not the value. When there are none yet,
+// the returned channel is closed as soon as the next change is recorded.
+// ErrChangesTruncated is returned when changes after since have already been
+// dropped by retention, and the consumer has to start over from a snapshot.
+func (d *Driver) Oplog(since uint64, limit int) ([]Change, <-chan struct{}, error) {
+	d.logMu.Lock()
+	l := d.oplog
+	if l == nil {
+		d.logMu.Unlock()
+		return nil, nil, ErrOplogDisabled
+	}
+	last := d.changes.seq
+	if since > last || since+1 < l.oldest(last) {
+		d.logMu.Unlock()
+		return nil, nil, ErrChangesTruncated
+	}
+	segments := append([]segment(nil), l.segments...)
+	wake := d.changes.wake
+	d.logMu.Unlock()
+
+	// Start from the last segment holding changes up to since+1
+	start := sort.Search(len(segments), func(i int) bool { return segments[i].first > since+1 }) - 1
+	if start < 0 {
+		start = 0
+	}
+
+	var changes []Change
+	for _, seg := range segments[start:] {
+		data, err := os.ReadFile(seg.path)
+		if os.IsNotExist(err) {
+			// Removed by retention while we were reading
+			return nil, nil, ErrChangesTruncated
+		}
+		if err != nil {
+			d.log.Error("Failed to read oplog segment: %v", err)
+			return nil, nil, err
+		}
+
+		for len(data) > 0 {
+			line, rest, complete := bytes.Cut(data, []byte("\n"))
+			if !complete {
+				break // still being written
+			}
+			data = rest
+
+			c, err := decodeOplogLine(line)
+			if err != nil {
+				return nil, nil, fmt.Errorf("corrupt oplog segment %s: %w", filepath.Base(seg.path), err)
+			}
+			c.Value = nil
+			if c.Seq <= since {
+				continue
+			}
+			if c.Seq > last {
+				return changes, wake, nil
+			}
+			changes = append(changes, c)
+			if limit > 0 && len(changes) == limit {
+				return changes, wake, nil
+			}
+		}
+	}
+	return changes, wake, nil
+}
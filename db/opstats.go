@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// OpStats counts the operations the driver has served, since it was opened
+// or since the last StatsAndReset
+type OpStats struct {
+	Puts    uint64 `json:"puts"` // keys written, by Put, PutBatch, PutReader and their variants
+	Gets    uint64 `json:"gets"` // keys read, by Get, GetBatch and GetReader
+	Deletes uint64 `json:"deletes"`
+
+	// Where values were read from: the LRU cache, the B-tree or the disk,
+	// or Options.Loader for keys found in none of them. Reads made by Incr
+	// are counted too; keys found nowhere are counted as "not_found" errors.
+	CacheHits uint64 `json:"cache_hits"`
+	TreeHits  uint64 `json:"tree_hits"`
+	DiskReads uint64 `json:"disk_reads"`
+	Loads     uint64 `json:"loads"`
+
+	BytesWritten uint64 `json:"bytes_written"` // size of the values written
+	BytesRead    uint64 `json:"bytes_read"`    // size of the values read
+
+	// Failed operations by error, such as "not_found" or "quota_exceeded";
+	// errors that are not one of the package's are counted as "other"
+	Errors map[string]uint64 `json:"errors,omitempty"`
+}
+
+// OpStats returns the operation counters alone, which unlike Stats is cheap
+func (d *Driver) OpStats() OpStats {
+	return d.ops.snapshot(false)
+}
+
+// errorKinds names the errors OpStats.Errors tells apart
+var errorKinds = [...]struct {
+	name string
+	err  error
+}{
+	{"not_found", ErrKeyNotFound},
+	{"key_exists", ErrKeyExists},
+	{"invalid_key", ErrInvalidKey},
+	{"invalid_key", ErrEmptyKey},
+	{"invalid_ttl", ErrInvalidTTL},
+	{"value_too_large", ErrValueTooLarge},
+	{"revision_mismatch", ErrRevisionMismatch},
+	{"schema_violation", ErrSchemaViolation},
+	{"quota_exceeded", ErrQuotaExceeded},
+	{"too_many_keys", ErrTooManyKeys},
+	{"invalid_labels", ErrInvalidLabels},
+	{"read_only", ErrReadOnly},
+	{"closed", ErrClosed},
+	{"load_failed", ErrLoadFailed},
+	{"mirror_failed", ErrMirrorFailed},
+	{"timeout", context.DeadlineExceeded},
+}
+
+// opCounters holds the counters behind OpStats, updated without the driver
+// lock
+type opCounters struct {
+	puts, gets, deletes            atomic.Uint64
+	cacheHits, treeHits, diskReads atomic.Uint64
+	loads                          atomic.Uint64
+	bytesWritten, bytesRead        atomic.Uint64
+
+	errors [len(errorKinds) + 1]atomic.Uint64 // by index in errorKinds, then "other"
+}
+
+// done counts n operations on counter and, when *err is set once the
+// operation returns, its error. It is meant to be deferred with a pointer to
+// the named error result.
+func (c *opCounters) done(counter *atomic.Uint64, n int, err *error) {
+	counter.Add(uint64(n))
+	if *err == nil {
+		return
+	}
+	for i, kind := range errorKinds {
+		if errors.Is(*err, kind.err) {
+			c.errors[i].Add(1)
+			return
+		}
+	}
+	c.errors[len(errorKinds)].Add(1)
+}
+
+// readDisk counts a value of size bytes read from the disk
+func (c *opCounters) readDisk(size int64) {
+	c.diskReads.Add(1)
+	c.bytesRead.Add(uint64(size))
+}
+
+// snapshot returns the counters, setting them to zero when reset is true
+func (c *opCounters) snapshot(reset bool) OpStats {
+	load := func(v *atomic.Uint64) uint64 {
+		if reset {
+			return v.Swap(0)
+		}
+		return v.Load()
+	}
+	stats := OpStats{
+		Puts:         load(&c.puts),
+		Gets:         load(&c.gets),
+		Deletes:      load(&c.deletes),
+		CacheHits:    load(&c.cacheHits),
+		TreeHits:     load(&c.treeHits),
+		DiskReads:    load(&c.diskReads),
+		Loads:        load(&c.loads),
+		BytesWritten: load(&c.bytesWritten),
+		BytesRead:    load(&c.bytesRead),
+	}
+	for i := range c.errors {
+		n := load(&c.errors[i])
+		if n == 0 {
+			continue
+		}
+		name := "other"
+		if i < len(errorKinds) {
+			name = errorKinds[i].name
+		}
+		if stats.Errors == nil {
+			stats.Errors = make(map[string]uint64)
+		}
+		stats.Errors[name] += n
+	}
+	return stats
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrNotList is returned by the list and set operations when the stored
+// value is not a JSON array
+var ErrNotList = errors.New("value is not a JSON array")
+
+// ErrEmpty is returned by ListPop when the array is empty
+var ErrEmpty = errors.New("list is empty")
+
+// ErrInvalidElement is returned by ListPush, the set operations and
+// FieldSet for an element, member or field value that is not JSON
+var ErrInvalidElement = errors.New("element is not JSON")
+
+// parseList decodes a stored value as a JSON array, keeping its elements as
+// they were written
+func parseList(key string, value []byte) ([]json.RawMessage, error) {
+	var list []json.RawMessage
+	if trimmed := bytes.TrimSpace(value); len(trimmed) == 0 || trimmed[0] != '[' || json.Unmarshal(trimmed, &list) != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotList, key)
+	}
+	return list, nil
+}
+
+// ListPush adds element, which must be JSON, to the end of the JSON array
+// stored at key, or to its start with front, and returns the array's new
+// length. A missing key is created holding just element, with
+// Options.DefaultTTL; an existing expiry is kept. The read and the write
+// happen under the write lock, so concurrent pushes and pops are never
+// lost. A value that is not a JSON array fails with ErrNotList.
+func (d *Driver) ListPush(key string, element []byte, front bool) (int, error) {
+	if err := d.checkKey(key); err != nil {
+		return 0, err
+	}
+	if !json.Valid(element) {
+		return 0, ErrInvalidElement
+	}
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+
+	t := d.startOp(context.Background(), "list_push", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	current, expiresAt, exists, err := d.readLocked(key, t)
+	if err != nil {
+		return 0, err
+	}
+	var list []json.RawMessage
+	if exists {
+		if list, err = parseList(key, current); err != nil {
+			return 0, err
+		}
+	} else {
+		expiresAt, _ = d.writeExpiry(0)
+	}
+
+	if front {
+		list = append([]json.RawMessage{element}, list...)
+	} else {
+		list = append(list, element)
+	}
+	if err := d.putList(key, list, expiresAt, t); err != nil {
+		return 0, err
+	}
+	return len(list), nil
+}
+
+// ListPop removes and returns the last element of the JSON array stored at
+// key, or its first with front, under the write lock, so that each element
+// is handed to one caller only. It fails with ErrKeyNotFound when there is
+// no key, ErrEmpty when the array is empty and ErrNotList when the value is
+// not one. The key is kept, holding [], once its last element is popped.
+func (d *Driver) ListPop(key string, front bool) ([]byte, error) {
+	if err := d.checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := d.writable(); err != nil {
+		return nil, err
+	}
+
+	t := d.startOp(context.Background(), "list_pop", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	current, expiresAt, exists, err := d.readLocked(key, t)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+	list, err := parseList(key, current)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrEmpty, key)
+	}
+
+	var element json.RawMessage
+	if front {
+		element, list = list[0], list[1:]
+	} else {
+		element, list = list[len(list)-1], list[:len(list)-1]
+	}
+	if err := d.putList(key, list, expiresAt, t); err != nil {
+		return nil, err
+	}
+	return element, nil
+}
+
+// putList stores a list as the value of key, checked as a Put would check
+// it. The caller must hold the write lock.
+func (d *Driver) putList(key string, list []json.RawMessage, expiresAt int64, t *opTimer) error {
+	if list == nil {
+		list = []json.RawMessage{}
+	}
+	value, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	if err := d.checkSchema(key, value); err != nil {
+		return err
+	}
+	_, err = d.putLocked(key, value, expiresAt, t)
+	return err
+}
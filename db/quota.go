@@ -0,0 +1,337 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NamespaceSeparator ends the namespace at the start of a key: the namespace
+// of users:42 is users. Keys without one are in the "" namespace.
+const NamespaceSeparator = ":"
+
+// quotaFile holds the quotas set with SetQuota, in the metadata directory
+const quotaFile = "quotas.json"
+
+// ErrQuotaExceeded is returned, as a *QuotaError, for a write that would
+// take a namespace over its quota
+var ErrQuotaExceeded = errors.New("namespace quota exceeded")
+
+// ErrInvalidQuota is returned by SetQuota for negative limits or a namespace
+// holding the separator
+var ErrInvalidQuota = errors.New("invalid quota")
+
+// Quota limits what a namespace may store. A limit of 0 is no limit.
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxKeys  int   `json:"max_keys"`
+}
+
+// NamespaceUsage is what a namespace with a quota stores on disk, expired
+// keys included until they are removed, and its quota
+type NamespaceUsage struct {
+	Quota
+	Bytes int64 `json:"bytes"`
+	Keys  int   `json:"keys"`
+}
+
+// QuotaError describes a write refused by the quota of Namespace. Bytes and
+// Keys are what the namespace would have held after it.
+type QuotaError struct {
+	Key       string `json:"key"`
+	Namespace string `json:"namespace"`
+	NamespaceUsage
+}
+
+func (e *QuotaError) Error() string {
+	if e.MaxKeys > 0 && e.Keys > e.MaxKeys {
+		return fmt.Sprintf("%v: %s would hold %d keys, at most %d allowed", ErrQuotaExceeded, e.Namespace, e.Keys, e.MaxKeys)
+	}
+	return fmt.Sprintf("%v: %s would hold %d bytes, at most %d allowed", ErrQuotaExceeded, e.Namespace, e.Bytes, e.MaxBytes)
+}
+
+// Unwrap makes errors.Is(err, ErrQuotaExceeded) hold
+func (e *QuotaError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+// namespaceOf returns the namespace of a key
+func namespaceOf(key string) string {
+	ns, _, found := strings.Cut(key, NamespaceSeparator)
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+// usageChange is how a write changes the usage of a namespace with a quota
+type usageChange struct {
+	ns    string
+	bytes int64
+	keys  int
+}
+
+// SetQuota limits the bytes and keys stored in a namespace, the keys
+// starting with namespace and NamespaceSeparator. Writes that would go over
+// either fail with a *QuotaError; writes that do not add to the usage, such
+// as deletes, never do. Setting both limits to 0 removes the quota. A
+// namespace's usage is counted when its quota is set, then kept up to date
+// with every write. Quotas are kept in the data directory and survive
+// restarts.
+func (d *Driver) SetQuota(namespace string, maxBytes int64, maxKeys int) error {
+	if maxBytes < 0 || maxKeys < 0 {
+		return fmt.Errorf("%w: limits must not be negative", ErrInvalidQuota)
+	}
+	if strings.Contains(namespace, NamespaceSeparator) {
+		return fmt.Errorf("%w: namespace %q holds the separator %q", ErrInvalidQuota, namespace, NamespaceSeparator)
+	}
+
+	// The write lock keeps the usage counted from changing under the scan
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	d.quotaMu.Lock()
+	old, had := d.quotas[namespace]
+	d.quotaMu.Unlock()
+
+	var updated *NamespaceUsage
+	switch {
+	case maxBytes == 0 && maxKeys == 0:
+	case had:
+		updated = &NamespaceUsage{Quota: Quota{maxBytes, maxKeys}, Bytes: old.Bytes, Keys: old.Keys}
+	default:
+		usage, err := d.scanUsage([]string{namespace})
+		if err != nil {
+			return err
+		}
+		updated = usage[namespace]
+		updated.Quota = Quota{maxBytes, maxKeys}
+	}
+
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	if updated == nil {
+		delete(d.quotas, namespace)
+	} else {
+		d.quotas[namespace] = updated
+	}
+	if err := d.saveQuotas(); err != nil {
+		if had {
+			d.quotas[namespace] = old
+		} else {
+			delete(d.quotas, namespace)
+		}
+		return err
+	}
+	if updated == nil {
+		d.log.Info("Removed the quota of namespace %q", namespace)
+	} else {
+		d.log.Info("Set the quota of namespace %q to %d bytes and %d keys, %d bytes and %d keys used", namespace, maxBytes, maxKeys, updated.Bytes, updated.Keys)
+	}
+	return nil
+}
+
+// Quotas returns the usage of every namespace with a quota
+func (d *Driver) Quotas() map[string]NamespaceUsage {
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	quotas := make(map[string]NamespaceUsage, len(d.quotas))
+	for ns, u := range d.quotas {
+		quotas[ns] = *u
+	}
+	return quotas
+}
+
+// saveQuotas writes the quotas to the metadata directory. The caller must
+// hold quotaMu.
+func (d *Driver) saveQuotas() error {
+	quotas := make(map[string]Quota, len(d.quotas))
+	for ns, u := range d.quotas {
+		quotas[ns] = u.Quota
+	}
+	data, err := json.Marshal(quotas)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.dir, metaDir, quotaFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(path, data)
+}
+
+// loadQuotas loads the quotas saved by SetQuota and counts the usage of
+// their namespaces. The caller must hold the write lock.
+func (d *Driver) loadQuotas() error {
+	d.quotas = make(map[string]*NamespaceUsage)
+	data, err := os.ReadFile(filepath.Join(d.dir, metaDir, quotaFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var quotas map[string]Quota
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return fmt.Errorf("failed to load the quotas: %w", err)
+	}
+	namespaces := make([]string, 0, len(quotas))
+	for ns := range quotas {
+		namespaces = append(namespaces, ns)
+	}
+	usage, err := d.scanUsage(namespaces)
+	if err != nil {
+		return fmt.Errorf("failed to count the usage of namespaces with quotas: %w", err)
+	}
+	for ns, q := range quotas {
+		usage[ns].Quota = q
+	}
+	d.quotas = usage
+	return nil
+}
+
+// scanUsage counts the keys and bytes stored in each namespace. The caller
+// must hold the write lock.
+func (d *Driver) scanUsage(namespaces []string) (map[string]*NamespaceUsage, error) {
+	usage := make(map[string]*NamespaceUsage, len(namespaces))
+	for _, ns := range namespaces {
+		usage[ns] = &NamespaceUsage{}
+	}
+	keys, err := d.keyFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		u, ok := usage[namespaceOf(key)]
+		if !ok {
+			continue
+		}
+		size, exists, err := d.storedSize(key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			u.Bytes += size
+			u.Keys++
+		}
+	}
+	return usage, nil
+}
+
+// storedSize returns the size of the value stored for a key, expired or
+// not, and whether there is one. The caller must hold the mutex.
+func (d *Driver) storedSize(key string) (int64, bool, error) {
+	if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok && it.Value != nil {
+		return int64(len(it.Value)), true, nil
+	}
+	fi, err := os.Stat(d.keyPath(key))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		d.log.Error("Failed to stat file: %v", err)
+		return 0, false, err
+	}
+	return fi.Size(), true, nil
+}
+
+// usageChange returns how storing size bytes for a key changes the usage of
+// its namespace, or with size below 0 how removing the key does. It is nil
+// when the namespace has no quota. The caller must hold the write lock.
+func (d *Driver) usageChange(key string, size int64) (*usageChange, error) {
+	ns := namespaceOf(key)
+	d.quotaMu.Lock()
+	_, tracked := d.quotas[ns]
+	d.quotaMu.Unlock()
+	if !tracked {
+		return nil, nil
+	}
+
+	old, exists, err := d.storedSize(key)
+	if err != nil {
+		return nil, err
+	}
+	ch := &usageChange{ns: ns}
+	switch {
+	case size < 0 && exists:
+		ch.bytes, ch.keys = -old, -1
+	case size >= 0 && exists:
+		ch.bytes = size - old
+	case size >= 0:
+		ch.bytes, ch.keys = size, 1
+	}
+	return ch, nil
+}
+
+// checkQuota returns a *QuotaError when a change takes its namespace over
+// its quota. Changes that do not add to the usage always pass, and replicas
+// store whatever their primary sends.
+func (d *Driver) checkQuota(key string, ch *usageChange) error {
+	if ch == nil || (ch.bytes <= 0 && ch.keys <= 0) || d.ReadOnly() {
+		return nil
+	}
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	u, ok := d.quotas[ch.ns]
+	if !ok {
+		return nil
+	}
+	after := NamespaceUsage{Quota: u.Quota, Bytes: u.Bytes + ch.bytes, Keys: u.Keys + ch.keys}
+	if (u.MaxBytes > 0 && ch.bytes > 0 && after.Bytes > u.MaxBytes) || (u.MaxKeys > 0 && ch.keys > 0 && after.Keys > u.MaxKeys) {
+		return &QuotaError{Key: key, Namespace: ch.ns, NamespaceUsage: after}
+	}
+	return nil
+}
+
+// checkBatchQuota checks that the writes of a batch, taken in order, keep
+// every namespace within its quota. The caller must hold the write lock.
+func (d *Driver) checkBatchQuota(entries []BatchEntry) error {
+	sizes := make(map[string]int64) // keys written earlier in the batch
+	totals := make(map[string]*usageChange)
+	for _, e := range entries {
+		size := int64(len(e.Value))
+		ch, err := d.usageChange(e.Key, size)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			continue
+		}
+		if prev, ok := sizes[e.Key]; ok {
+			ch.bytes, ch.keys = size-prev, 0
+		}
+		sizes[e.Key] = size
+
+		total, ok := totals[ch.ns]
+		if !ok {
+			total = &usageChange{ns: ch.ns}
+			totals[ch.ns] = total
+		}
+		total.bytes += ch.bytes
+		total.keys += ch.keys
+		if err := d.checkQuota(e.Key, total); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyUsage counts a change made to a namespace with a quota
+func (d *Driver) applyUsage(ch *usageChange) {
+	if ch == nil {
+		return
+	}
+	d.quotaMu.Lock()
+	defer d.quotaMu.Unlock()
+	if u, ok := d.quotas[ch.ns]; ok {
+		u.Bytes += ch.bytes
+		u.Keys += ch.keys
+	}
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// ErrNoIndex is returned by QueryIndexRange for an index that was not
+// created
+var ErrNoIndex = errors.New("no such index")
+
+// rangeIndex orders keys by the number in one JSON field of their values
+type rangeIndex struct {
+	field   []string           // path into the JSON values, split at dots
+	entries *btree.BTree       // of *rangeEntry
+	byKey   map[string]float64 // the number each key is indexed under
+}
+
+// rangeEntry is a key in a numeric index
+type rangeEntry struct {
+	num float64
+	key string
+}
+
+// Less orders entries by number, then key
+func (e *rangeEntry) Less(than btree.Item) bool {
+	o := than.(*rangeEntry)
+	if e.num != o.num {
+		return e.num < o.num
+	}
+	return e.key < o.key
+}
+
+// NumericIndexStats describes an index created with CreateNumericIndex
+type NumericIndexStats struct {
+	Field string `json:"field"`
+	Keys  int    `json:"keys"` // keys whose field holds a number
+}
+
+// fieldValue returns the member of a JSON object at path, nil when it is
+// missing
+func fieldValue(doc map[string]interface{}, path []string) interface{} {
+	var v interface{} = doc
+	for _, name := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = obj[name]
+	}
+	return v
+}
+
+// parseDoc decodes a value as a JSON object, returning nil for anything else
+func parseDoc(value []byte) map[string]interface{} {
+	var doc map[string]interface{}
+	if json.Unmarshal(value, &doc) != nil {
+		return nil
+	}
+	return doc
+}
+
+// scanDocs calls fn with every unexpired key whose value is a JSON object.
+// The caller must hold the write lock.
+func (d *Driver) scanDocs(fn func(key string, doc map[string]interface{})) error {
+	keys, err := d.keyFiles()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, key := range keys {
+		var value []byte
+		it, ok := d.tree.Get(&Item{Key: key}).(*Item)
+		switch {
+		case ok && it.expired(now):
+			continue
+		case ok && it.Value != nil:
+			value = it.Value
+		default:
+			if value, err = os.ReadFile(d.keyPath(key)); err != nil {
+				d.log.Error("Failed to read file: %v", err)
+				return err
+			}
+		}
+		if doc := parseDoc(value); doc != nil {
+			fn(key, doc)
+		}
+	}
+	return nil
+}
+
+// CreateNumericIndex indexes keys by the number in a field of their JSON
+// values, so that QueryIndexRange can find those within a range. The field
+// names a member of the top-level object, or a nested one as in
+// "item.price"; keys whose field is missing or not a number are left out.
+// Like the text index, it is built from the values stored, kept up to date
+// by every write, delete and expiry, and held in memory only. Creating an
+// index under a name already used replaces it.
+func (d *Driver) CreateNumericIndex(name, field string) error {
+	if field == "" {
+		return fmt.Errorf("index %q needs a field", name)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	idx := &rangeIndex{field: strings.Split(field, "."), entries: btree.New(d.degree), byKey: make(map[string]float64)}
+	err := d.scanDocs(func(key string, doc map[string]interface{}) {
+		idx.add(key, doc)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.indexMu.Lock()
+	if d.numeric == nil {
+		d.numeric = make(map[string]*rangeIndex)
+	}
+	d.numeric[name] = idx
+	d.indexMu.Unlock()
+	d.log.Info("Built numeric index %s over %s: %d keys in %s", name, field, len(idx.byKey), time.Since(start))
+	return nil
+}
+
+// DropIndex removes an index created with CreateNumericIndex
+func (d *Driver) DropIndex(name string) {
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+	delete(d.numeric, name)
+}
+
+// add indexes a key by its field, when that holds a number
+func (idx *rangeIndex) add(key string, doc map[string]interface{}) {
+	num, ok := fieldValue(doc, idx.field).(float64)
+	if !ok {
+		return
+	}
+	idx.entries.ReplaceOrInsert(&rangeEntry{num: num, key: key})
+	idx.byKey[key] = num
+}
+
+// remove drops a key from the index
+func (idx *rangeIndex) remove(key string) {
+	if num, ok := idx.byKey[key]; ok {
+		idx.entries.Delete(&rangeEntry{num: num, key: key})
+		delete(idx.byKey, key)
+	}
+}
+
+// QueryIndexRange returns up to limit keys whose indexed field is between
+// min and max inclusive, in order of the number and then of key, so keys
+// sharing a number are all returned together. A limit <= 0 returns every
+// match. It fails with ErrNoIndex for an index that was not created.
+func (d *Driver) QueryIndexRange(name string, min, max float64, limit int) ([]string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	d.indexMu.RLock()
+	idx, ok := d.numeric[name]
+	if !ok {
+		d.indexMu.RUnlock()
+		return nil, fmt.Errorf("%w: %s", ErrNoIndex, name)
+	}
+	// Writers take the index lock under the driver lock, so it is released
+	// before unexpired takes the driver lock
+	var matches []string
+	if min <= max {
+		idx.entries.AscendGreaterOrEqual(&rangeEntry{num: min}, func(i btree.Item) bool {
+			e := i.(*rangeEntry)
+			if e.num > max {
+				return false
+			}
+			matches = append(matches, e.key)
+			return true
+		})
+	}
+	d.indexMu.RUnlock()
+
+	return d.unexpired(matches, limit), nil
+}
+
+// unexpired returns up to limit of keys, in order, leaving out those that
+// have expired, which keep their index entries until they are removed
+func (d *Driver) unexpired(keys []string, limit int) []string {
+	now := time.Now()
+	kept := []string{}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for _, key := range keys {
+		if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok && it.expired(now) {
+			continue
+		}
+		kept = append(kept, key)
+		if limit > 0 && len(kept) == limit {
+			break
+		}
+	}
+	return kept
+}
+
+// reindex brings the text and numeric indexes up to date with a change. A
+// nil value for a put, as written by PutReader, is read back from disk. The
+// caller must hold the write lock.
+func (d *Driver) reindex(op Op, key string, value []byte) {
+	d.indexMu.Lock()
+	defer d.indexMu.Unlock()
+	if d.text == nil && len(d.numeric) == 0 {
+		return
+	}
+	if d.text != nil {
+		d.text.remove(key)
+	}
+	for _, idx := range d.numeric {
+		idx.remove(key)
+	}
+	if op != OpPut {
+		return
+	}
+
+	if value == nil {
+		var err error
+		if value, err = os.ReadFile(d.keyPath(key)); err != nil {
+			d.log.Error("Failed to read %s for indexing: %v", key, err)
+			return
+		}
+	}
+	doc := parseDoc(value)
+	if doc == nil {
+		return
+	}
+	if d.text != nil {
+		d.text.add(key, doc)
+	}
+	for _, idx := range d.numeric {
+		idx.add(key, doc)
+	}
+}
+
+// numericIndexStats describes the numeric indexes, nil when there are none
+func (d *Driver) numericIndexStats() map[string]NumericIndexStats {
+	d.indexMu.RLock()
+	defer d.indexMu.RUnlock()
+	if len(d.numeric) == 0 {
+		return nil
+	}
+	stats := make(map[string]NumericIndexStats, len(d.numeric))
+	for name, idx := range d.numeric {
+		stats[name] = NumericIndexStats{Field: strings.Join(idx.field, "."), Keys: len(idx.byKey)}
+	}
+	return stats
+}
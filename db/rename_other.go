@@ -0,0 +1,11 @@
+//go:build !windows
+
+package db
+
+import "os"
+
+// replaceFile renames src over dst, which is atomic on this platform even
+// while dst is open
+func replaceFile(src, dst string) error {
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package db
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// replaceAttempts bounds how long replaceFile waits for dst to be closed
+	replaceAttempts = 10
+
+	// errSharingViolation is ERROR_SHARING_VIOLATION, which syscall lacks
+	errSharingViolation syscall.Errno = 32
+)
+
+// replaceFile renames src over dst. Windows refuses to replace a file while
+// another handle has it open, as a reader streaming the old value may for a
+// moment, so the rename is retried with a growing pause before giving up.
+func replaceFile(src, dst string) error {
+	var err error
+	for i := 1; i <= replaceAttempts; i++ {
+		if err = os.Rename(src, dst); err == nil || !inUse(err) {
+			return err
+		}
+		time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+	}
+	return err
+}
+
+// inUse reports whether err is Windows refusing to touch an open file
+func inUse(err error) bool {
+	return errors.Is(err, syscall.ERROR_ACCESS_DENIED) || errors.Is(err, errSharingViolation)
+}
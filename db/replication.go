@@ -0,0 +1,261 @@
+package db
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// defaultChangeLogSize is how many changes are kept for replicas to catch up
+// on when Options.ChangeLogSize is not set
+const defaultChangeLogSize = 10000
+
+// ErrReadOnly is returned by writes to a driver following a primary
+var ErrReadOnly = errors.New("read-only replica")
+
+// ErrChangesTruncated is returned by Changes when the requested changes are
+// no longer in the change log, or were never written by this process. The
+// replica has to start over from a snapshot.
+var ErrChangesTruncated = errors.New("changes are no longer in the change log")
+
+// Change is one write in the change log. Every Put, Delete and Expire is
+// given the next sequence number, as is every key removed because it
+// expired, an OpExpire. Puts carry the value, its content hash and the
+// absolute expiry the key was left with; an OpExpire carries the expiry that
+// passed. The operation log keeps only the hash.
+type Change struct {
+	Seq       uint64    `json:"seq"`
+	Op        Op        `json:"op,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Value     []byte    `json:"value,omitempty"`
+	Hash      string    `json:"hash,omitempty"`       // content hash of the new value
+	ExpiresAt int64     `json:"expires_at,omitempty"` // unix nanoseconds, 0 for no expiry
+	Time      time.Time `json:"time"`
+}
+
+// changeLog is a ring of the most recent changes
+type changeLog struct {
+	id      string // identifies this process's sequence numbers
+	entries []Change
+	head    int    // index of the oldest change
+	n       int    // number of changes held
+	seq     uint64 // last sequence number handed out
+	wake    chan struct{}
+}
+
+func newChangeLog(size int) changeLog {
+	if size <= 0 {
+		size = defaultChangeLogSize
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return changeLog{
+		id:      hex.EncodeToString(id),
+		entries: make([]Change, size),
+		wake:    make(chan struct{}),
+	}
+}
+
+// record appends a change to the log and wakes the feeds waiting for it.
+// Changes to reserved keys are not logged. It is called with the driver lock
+// held so sequence numbers follow the order changes were applied.
+func (d *Driver) record(op Op, key string, value []byte, hash string, expiresAt int64) {
+	if Reserved(key) {
+		// Not published, see Reserved, but the snapshot still holds it
+		d.snapshotStale = true
+		return
+	}
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+
+	l := &d.changes
+	l.seq++
+	change := Change{
+		Seq:       l.seq,
+		Op:        op,
+		Key:       key,
+		Value:     value,
+		Hash:      hash,
+		ExpiresAt: expiresAt,
+		Time:      time.Now(),
+	}
+	if d.oplog != nil {
+		logged := change
+		if op == OpPut && value == nil && d.oplog.keepValues {
+			// Streamed values are not held in memory, so read back what was
+			// just written
+			var err error
+			if logged.Value, err = os.ReadFile(d.keyPath(key)); err != nil {
+				d.log.Error("Failed to read %s for the oplog: %v", key, err)
+			}
+		}
+		// The change has been applied already, so a failure to log it is
+		// reported rather than undoing the write
+		if err := d.oplog.append(logged); err != nil {
+			d.log.Error("Failed to append to the oplog: %v", err)
+		}
+	}
+
+	l.entries[(l.head+l.n)%len(l.entries)] = change
+	if l.n < len(l.entries) {
+		l.n++
+	} else {
+		l.head = (l.head + 1) % len(l.entries)
+	}
+
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+// ReplicationID identifies the sequence numbers handed out by this driver.
+// It changes every time the driver is opened, so a replica can tell that a
+// sequence number it saw belongs to an earlier run.
+func (d *Driver) ReplicationID() string {
+	return d.changes.id
+}
+
+// Seq returns the sequence number of the latest change
+func (d *Driver) Seq() uint64 {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	return d.changes.seq
+}
+
+// Changes returns up to limit changes made after the change numbered after,
+// or all of them when limit is 0. When there are none yet, the returned
+// channel is closed as soon as the next change is recorded.
+//
+// Values that are not held in memory, such as those written with PutReader,
+// are read from the store as they are now. A key deleted since is reported as
+// a delete, which the later changes in the log agree with.
+func (d *Driver) Changes(after uint64, limit int) ([]Change, <-chan struct{}, error) {
+	d.logMu.Lock()
+	l := &d.changes
+	oldest := l.seq - uint64(l.n) + 1
+	if after > l.seq || after+1 < oldest {
+		d.logMu.Unlock()
+		return nil, nil, ErrChangesTruncated
+	}
+
+	count := int(l.seq - after)
+	if limit > 0 && count > limit {
+		count = limit
+	}
+	start := l.n - int(l.seq-after)
+	changes := make([]Change, count)
+	for i := range changes {
+		changes[i] = l.entries[(l.head+start+i)%len(l.entries)]
+	}
+	wake := l.wake
+	d.logMu.Unlock()
+
+	for i, c := range changes {
+		if c.Op != OpPut || c.Value != nil {
+			continue
+		}
+		value, ok, err := d.readUncached(c.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			changes[i] = Change{Seq: c.Seq, Op: OpDelete, Key: c.Key, Time: c.Time}
+			continue
+		}
+		changes[i].Value = value
+	}
+	return changes, wake, nil
+}
+
+// Snapshot calls fn with a put for every key in the store but the reserved
+// ones and returns the sequence number a replica loading the snapshot should
+// follow the change log from. Changes made while the snapshot is taken may or may not be included;
+// replaying them from the returned sequence number gives the same result
+// either way.
+func (d *Driver) Snapshot(fn func(Change) error) (uint64, error) {
+	seq := d.Seq()
+	now := time.Now()
+
+	names, err := d.keyFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, name := range names {
+		if Reserved(name) {
+			continue
+		}
+		value, ok, err := d.readUncached(name)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+
+		var expiresAt int64
+		d.mutex.RLock()
+		if it, ok := d.tree.Get(&Item{Key: name}).(*Item); ok {
+			expiresAt = it.ExpiresAt
+		}
+		d.mutex.RUnlock()
+
+		if err := fn(Change{Seq: seq, Op: OpPut, Key: name, Value: value, ExpiresAt: expiresAt, Time: now}); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// Apply replays a change read from a primary. It is allowed on a read-only
+// driver, and deleting a key that does not exist is not an error, so a
+// change can be applied more than once.
+func (d *Driver) Apply(c Change) error {
+	if err := d.checkKey(c.Key); err != nil {
+		return err
+	}
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	switch c.Op {
+	case OpPut:
+		t := d.startOp(context.Background(), "apply", c.Key)
+		defer d.finishOp(t)
+		d.lock(t)
+		defer d.unlock()
+		_, err := d.putLocked(c.Key, c.Value, c.ExpiresAt, t)
+		return err
+	case OpDelete:
+		if err := d.delete(context.Background(), c.Key, nil); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		return nil
+	case OpExpire:
+		t := d.startOp(context.Background(), "apply", c.Key)
+		defer d.finishOp(t)
+		d.lock(t)
+		defer d.unlock()
+		// Only the value that expired goes: the replica's sweeper may have
+		// removed it already, and a replayed expiry must not remove the key
+		// written since
+		if it, ok := d.tree.Get(&Item{Key: c.Key}).(*Item); ok && it.ExpiresAt == c.ExpiresAt {
+			return d.expireLocked(it)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown change op %q", c.Op)
+}
+
+// SetReadOnly makes every write other than Apply fail with ErrReadOnly
+func (d *Driver) SetReadOnly(readOnly bool) {
+	d.readOnly.Store(readOnly)
+}
+
+// ReadOnly reports whether the driver only accepts changes through Apply
+func (d *Driver) ReadOnly() bool {
+	return d.readOnly.Load()
+}
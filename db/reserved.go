@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// IdempotencyNamespace is the namespace the API keeps the responses to
+// requests sent with an Idempotency-Key in
+const IdempotencyNamespace = "_idempotency"
+
+// reservedNamespaces hold the records the driver and the API keep as keys,
+// so that they expire like any other, but that are not data: the locks of
+// AcquireLock and the responses of IdempotencyNamespace
+var reservedNamespaces = []string{LockNamespace, IdempotencyNamespace}
+
+// Reserved reports whether key is in a reserved namespace. Such keys are
+// left out of List, Count, GetBatch, Export and read transactions, do not
+// count against Options.MaxKeys, and their changes reach no watcher, hook,
+// search index, mirror, change feed or oplog. They are meant to be read and
+// written only through the operations that keep them, as their values may
+// hold secrets such as lock tokens.
+func Reserved(key string) bool {
+	for _, ns := range reservedNamespaces {
+		if strings.HasPrefix(key, ns+NamespaceSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedCount returns the number of keys in tree, expired or not, that
+// are in a reserved namespace. It visits only those keys.
+func reservedCount(tree *btree.BTree) int {
+	n := 0
+	for _, ns := range reservedNamespaces {
+		prefix := ns + NamespaceSeparator
+		tree.AscendGreaterOrEqual(&Item{Key: prefix}, func(i btree.Item) bool {
+			if !strings.HasPrefix(i.(*Item).Key, prefix) {
+				return false
+			}
+			n++
+			return true
+		})
+	}
+	return n
+}
+
+// PutReserved stores value under key, which must be in a reserved namespace,
+// expiring after ttl. It is how packages built on the Driver keep their
+// records there, such as the API's responses in IdempotencyNamespace, which
+// the public write paths of the API refuse; schemas do not apply to them.
+func (d *Driver) PutReserved(key string, value []byte, ttl time.Duration) (err error) {
+	defer d.ops.done(&d.ops.puts, 1, &err)
+	if err := d.checkReserved(key); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return err
+	}
+	expiresAt, err := d.writeExpiry(ttl)
+	if err != nil {
+		return err
+	}
+
+	t := d.startOp(context.Background(), "put", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	_, err = d.putLocked(key, value, expiresAt, t)
+	return err
+}
+
+// GetReserved returns the value of key, which must be in a reserved
+// namespace, kept by PutReserved. Options.Loader is not consulted.
+func (d *Driver) GetReserved(key string) (_ []byte, err error) {
+	defer d.ops.done(&d.ops.gets, 1, &err)
+	if err := d.checkReserved(key); err != nil {
+		return nil, err
+	}
+	return d.get(context.Background(), key)
+}
+
+// checkReserved is checkKey for a key that must be in a reserved namespace
+func (d *Driver) checkReserved(key string) error {
+	if !Reserved(key) {
+		return fmt.Errorf("%w: %s is not in a reserved namespace", ErrInvalidKey, key)
+	}
+	return d.checkKey(key)
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RestoreToTime puts the data directory back the way it was at t. It loads
+// the snapshot at snapshotPath, an NDJSON file as served at
+// /replication/snapshot, and replays the changes in the operation log at
+// walPath made after the snapshot up to and including t. The log must have
+// been kept with OplogValues and must reach back to the snapshot; a change
+// cut short at the end of it is dropped. Both are checked before anything is
+// written.
+func (d *Driver) RestoreToTime(snapshotPath, walPath string, t time.Time) error {
+	if d.oplog != nil && samePath(d.oplog.dir, walPath) {
+		return errors.New("restore from a copy of the operation log, not the one this driver writes to")
+	}
+
+	seq, err := readSnapshot(snapshotPath, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := replayOplog(walPath, seq, t, nil); err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool)
+	if _, err := readSnapshot(snapshotPath, func(c Change) error {
+		keys[c.Key] = true
+		return d.Apply(c)
+	}); err != nil {
+		return err
+	}
+
+	// Remove what the snapshot does not have
+	names, err := d.keyFiles()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !keys[name] {
+			if err := d.Apply(Change{Op: OpDelete, Key: name}); err != nil {
+				return err
+			}
+		}
+	}
+
+	n, err := replayOplog(walPath, seq, t, d.Apply)
+	if err != nil {
+		return err
+	}
+	d.log.Info("Restored %d keys from the snapshot at change %d and replayed %d changes up to %s", len(keys), seq, n, t.Format(time.RFC3339))
+	return nil
+}
+
+// readSnapshot calls fn, if not nil, with every put in an NDJSON snapshot and
+// returns the sequence number on its final line
+func readSnapshot(path string, fn func(Change) error) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	for {
+		var c Change
+		if err := dec.Decode(&c); err != nil {
+			if err == io.EOF {
+				return 0, fmt.Errorf("snapshot %s is incomplete", path)
+			}
+			return 0, fmt.Errorf("reading snapshot %s: %w", path, err)
+		}
+		if c.Op == "" {
+			return c.Seq, nil
+		}
+		if fn != nil {
+			if err := fn(c); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// replayOplog calls fn, if not nil, with the changes in the operation log in
+// dir that follow change after, in order, stopping at the first made later
+// than until. It returns how many changes there were. A missing change is an
+// error, except for a trailing one cut short by a crash.
+func replayOplog(dir string, after uint64, until time.Time, fn func(Change) error) (int, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(segments) == 0 {
+		return 0, nil
+	}
+	if segments[0].first > after+1 {
+		return 0, fmt.Errorf("the operation log starts at change %d, after the snapshot's change %d", segments[0].first, after)
+	}
+
+	// Start from the last segment holding changes up to after+1
+	start := sort.Search(len(segments), func(i int) bool { return segments[i].first > after+1 }) - 1
+
+	next, n := after+1, 0
+	for i, seg := range segments[start:] {
+		data, err := os.ReadFile(seg.path)
+		if err != nil {
+			return n, err
+		}
+		newest := start+i == len(segments)-1
+
+		for len(data) > 0 {
+			line, rest, complete := bytes.Cut(data, []byte("\n"))
+			data = rest
+			c, err := decodeOplogLine(line)
+			if !complete && err == nil {
+				err = errBadChecksum
+			}
+			if err != nil {
+				if newest && len(data) == 0 {
+					break
+				}
+				return n, fmt.Errorf("corrupt oplog segment %s: %w", filepath.Base(seg.path), err)
+			}
+
+			if c.Seq < next {
+				continue
+			}
+			if c.Seq > next {
+				return n, fmt.Errorf("change %d is missing from the operation log", next)
+			}
+			if c.Time.After(until) {
+				return n, nil
+			}
+			if c.Op == OpPut && c.Value == nil && c.Hash != hashValue(nil) {
+				return n, fmt.Errorf("change %d has no value; the operation log must be kept with values to restore from it", c.Seq)
+			}
+			if fn != nil {
+				if err := fn(c); err != nil {
+					return n, fmt.Errorf("replaying change %d: %w", c.Seq, err)
+				}
+			}
+			next++
+			n++
+		}
+	}
+	return n, nil
+}
+
+// samePath reports whether two paths name the same file or directory
+func samePath(a, b string) bool {
+	a, errA := filepath.Abs(a)
+	b, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && a == b
+}
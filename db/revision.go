@@ -0,0 +1,341 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// revisionFile records how far revisions have been handed out, in the
+// metadata directory
+const revisionFile = "revision"
+
+// revisionBlock is how many revisions are reserved at a time, so that the
+// revision file is written once a block rather than on every write
+const revisionBlock = 1024
+
+// AnyRevision makes PutReaderIfRevision store the value whatever the
+// revision of the key
+const AnyRevision uint64 = math.MaxUint64
+
+// ErrRevisionMismatch is returned by conditional writes when the key is not
+// at the revision given
+var ErrRevisionMismatch = errors.New("revision does not match")
+
+// revisionState is what the revision file holds
+type revisionState struct {
+	Reserved uint64 `json:"reserved"` // no revision above this was handed out
+	Clean    bool   `json:"clean"`    // Close saved every revision in the snapshot
+}
+
+// loadRevisions carries the revision counter on from the last run and gives
+// a revision to every key loaded without one. After a crash the snapshot may
+// predate the last writes, so every key is given a new revision rather than
+// risk one going backwards, and values written since are read from disk
+// again. The caller must hold the write lock.
+func (d *Driver) loadRevisions() error {
+	var state revisionState
+	data, err := os.ReadFile(filepath.Join(d.dir, metaDir, revisionFile))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to load the revision counter: %w", err)
+	}
+
+	d.startup.CleanShutdown = state.Clean || os.IsNotExist(err)
+	if !state.Clean {
+		d.forgetStaleValues()
+	}
+
+	d.rev = state.Reserved
+	d.tree.Ascend(func(i btree.Item) bool {
+		d.rev = max(d.rev, i.(*Item).Rev)
+		return true
+	})
+	d.revReserved = d.rev
+	given, err := d.renumber(!state.Clean)
+	if err != nil {
+		return err
+	}
+	if given > 0 && state.Reserved > 0 && !state.Clean {
+		d.log.Warn("The database was not closed cleanly, so all %d keys were given new revisions", given)
+	} else if given > 0 {
+		d.log.Info("Gave revisions to %d keys", given)
+	}
+
+	// Mark the run as unclean until Close says otherwise
+	if err := d.saveRevisions(d.rev, false); err != nil {
+		return fmt.Errorf("failed to save the revision counter: %w", err)
+	}
+	return nil
+}
+
+// renumber gives a new revision to every key, or with all false only to the
+// keys without one, and returns how many it gave. The caller must hold the
+// write lock.
+func (d *Driver) renumber(all bool) (int, error) {
+	var stale []Item
+	d.tree.Ascend(func(i btree.Item) bool {
+		if it := i.(*Item); all || it.Rev == 0 {
+			stale = append(stale, *it)
+		}
+		return true
+	})
+
+	// Items are replaced rather than modified, as clones of the tree may
+	// still be walked by List and Count
+	for i := range stale {
+		rev, err := d.nextRev()
+		if err != nil {
+			return 0, err
+		}
+		stale[i].Rev = rev
+		d.tree.ReplaceOrInsert(&stale[i])
+	}
+	if len(stale) > 0 {
+		d.snapshotStale = true
+	}
+	return len(stale), nil
+}
+
+// nextRev hands out the next revision, reserving a new block first when the
+// last one is used up. The caller must hold the write lock.
+func (d *Driver) nextRev() (uint64, error) {
+	if d.rev == d.revReserved {
+		if err := d.saveRevisions(d.rev+revisionBlock, false); err != nil {
+			d.log.Error("Failed to reserve revisions: %v", err)
+			return 0, err
+		}
+		d.revReserved = d.rev + revisionBlock
+	}
+	d.rev++
+	return d.rev, nil
+}
+
+// saveRevisions writes the revision file
+func (d *Driver) saveRevisions(reserved uint64, clean bool) error {
+	data, err := json.Marshal(revisionState{Reserved: reserved, Clean: clean})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.dir, metaDir, revisionFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(path, data)
+}
+
+// revisionLocked returns the revision of a key, 0 when it does not exist. A
+// key on disk that the B-tree does not know yet, as with
+// Options.SkipReconcile, is given one. The caller must hold the write lock.
+func (d *Driver) revisionLocked(key string) (uint64, error) {
+	if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok {
+		if it.expired(time.Now()) {
+			return 0, nil
+		}
+		return it.Rev, nil
+	}
+
+	dir := d.shardFor(key)
+	if _, err := os.Stat(filepath.Join(dir, d.fileName(key))); err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		d.log.Error("Failed to stat file: %v", err)
+		return 0, err
+	}
+	rev, err := d.nextRev()
+	if err != nil {
+		return 0, err
+	}
+	d.tree.ReplaceOrInsert(&Item{Key: key, Dir: dir, Rev: rev})
+	return rev, nil
+}
+
+// checkRevision returns ErrRevisionMismatch unless the key is at revision
+// want, 0 meaning it must not exist. The caller must hold the write lock.
+func (d *Driver) checkRevision(key string, want uint64) error {
+	if want == AnyRevision {
+		return nil
+	}
+	have, err := d.revisionLocked(key)
+	if err != nil {
+		return err
+	}
+	if have != want {
+		return fmt.Errorf("%w: %s is at revision %d, not %d", ErrRevisionMismatch, key, have, want)
+	}
+	return nil
+}
+
+// PutIfRevision stores the value for a key only if the key is at revision
+// rev, or does not exist when rev is 0, failing with ErrRevisionMismatch
+// otherwise. It returns the revision the key is left at.
+func (d *Driver) PutIfRevision(key string, value []byte, rev uint64) (_ uint64, err error) {
+	defer d.ops.done(&d.ops.puts, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return 0, err
+	}
+	if err := d.writable(); err != nil {
+		return 0, err
+	}
+	if err := d.checkSize(key, int64(len(value))); err != nil {
+		return 0, err
+	}
+	if err := d.checkSchema(key, value); err != nil {
+		return 0, err
+	}
+
+	t := d.startOp(context.Background(), "put", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	if err := d.checkRevision(key, rev); err != nil {
+		return 0, err
+	}
+	expiresAt, _ := d.writeExpiry(0)
+	if _, err := d.putLocked(key, value, expiresAt, t); err != nil {
+		return 0, err
+	}
+	return d.tree.Get(&Item{Key: key}).(*Item).Rev, nil
+}
+
+// DeleteIfRevision removes a key only if it is at revision rev, failing with
+// ErrRevisionMismatch otherwise
+func (d *Driver) DeleteIfRevision(key string, rev uint64) error {
+	return d.DeleteIfRevisionContext(context.Background(), key, rev)
+}
+
+// DeleteIfRevisionContext is DeleteIfRevision bounded by ctx, as
+// DeleteContext is
+func (d *Driver) DeleteIfRevisionContext(ctx context.Context, key string, rev uint64) (err error) {
+	defer d.ops.done(&d.ops.deletes, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if err := d.deletable(); err != nil {
+		return err
+	}
+	return d.delete(ctx, key, func() error { return d.checkRevision(key, rev) })
+}
+
+// AnyETag makes DeleteIfMatch remove the key whatever its value, as long as
+// it exists
+const AnyETag = "*"
+
+// DeleteIfMatch removes a key only if its value still has the ETag given,
+// the content hash reported by Stat and GetReader, failing with
+// ErrRevisionMismatch otherwise. With AnyETag it removes the key if it
+// exists. Either way it fails with ErrKeyNotFound when there is no key.
+func (d *Driver) DeleteIfMatch(key, etag string) error {
+	return d.DeleteIfMatchContext(context.Background(), key, etag)
+}
+
+// DeleteIfMatchContext is DeleteIfMatch bounded by ctx, as DeleteContext is
+func (d *Driver) DeleteIfMatchContext(ctx context.Context, key, etag string) (err error) {
+	defer d.ops.done(&d.ops.deletes, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if err := d.deletable(); err != nil {
+		return err
+	}
+	return d.delete(ctx, key, func() error { return d.checkETag(key, etag) })
+}
+
+// checkETag returns ErrKeyNotFound when the key does not exist and
+// ErrRevisionMismatch when its value's ETag is not etag, which AnyETag
+// always is. A hash not known yet is computed from the file. The caller
+// must hold the write lock.
+func (d *Driver) checkETag(key, etag string) error {
+	rev, err := d.revisionLocked(key)
+	if err != nil {
+		return err
+	}
+	if rev == 0 {
+		return ErrKeyNotFound
+	}
+	if etag == AnyETag {
+		return nil
+	}
+
+	it := d.tree.Get(&Item{Key: key}).(*Item)
+	hash := it.Hash
+	if hash == "" && it.Value != nil {
+		hash = hashValue(it.Value)
+	} else if hash == "" {
+		if hash, err = hashFile(d.keyPath(key)); err != nil {
+			d.log.Error("Failed to hash file: %v", err)
+			return err
+		}
+	}
+	if hash != etag {
+		return fmt.Errorf("%w: %s has ETag %q, not %q", ErrRevisionMismatch, key, hash, etag)
+	}
+	return nil
+}
+
+// DeleteIfUnmodifiedSince removes a key only if it was last written no later
+// than since, to the second, as HTTP's If-Unmodified-Since asks, failing
+// with ErrRevisionMismatch otherwise. A key whose write time is not known,
+// as for one found on disk but not in the snapshot, counts as modified. It
+// fails with ErrKeyNotFound when there is no key.
+func (d *Driver) DeleteIfUnmodifiedSince(key string, since time.Time) error {
+	return d.DeleteIfUnmodifiedSinceContext(context.Background(), key, since)
+}
+
+// DeleteIfUnmodifiedSinceContext is DeleteIfUnmodifiedSince bounded by ctx,
+// as DeleteContext is
+func (d *Driver) DeleteIfUnmodifiedSinceContext(ctx context.Context, key string, since time.Time) (err error) {
+	defer d.ops.done(&d.ops.deletes, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if err := d.deletable(); err != nil {
+		return err
+	}
+	return d.delete(ctx, key, func() error { return d.checkUnmodifiedSince(key, since) })
+}
+
+// checkUnmodifiedSince returns ErrKeyNotFound when the key does not exist
+// and ErrRevisionMismatch when it was written after since, comparing whole
+// seconds as HTTP dates have no finer precision, or at a time not known.
+// The caller must hold the write lock.
+func (d *Driver) checkUnmodifiedSince(key string, since time.Time) error {
+	rev, err := d.revisionLocked(key)
+	if err != nil {
+		return err
+	}
+	if rev == 0 {
+		return ErrKeyNotFound
+	}
+
+	it := d.tree.Get(&Item{Key: key}).(*Item)
+	if it.UpdatedAt == 0 {
+		return fmt.Errorf("%w: %s has no known write time", ErrRevisionMismatch, key)
+	}
+	updated := unixTime(it.UpdatedAt).Truncate(time.Second)
+	if updated.After(since) {
+		return fmt.Errorf("%w: %s was written at %s, after %s", ErrRevisionMismatch, key,
+			updated.UTC().Format(time.RFC3339), since.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// mustExist turns the ErrKeyNotFound of a write's precondition into
+// ErrRevisionMismatch, for writes that would otherwise create the key
+func mustExist(err error) error {
+	if errors.Is(err, ErrKeyNotFound) {
+		return fmt.Errorf("%w: the key does not exist", ErrRevisionMismatch)
+	}
+	return err
+}
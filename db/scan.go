@@ -0,0 +1,218 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// ctxCheckEvery is how many items a scan visits between context checks
+const ctxCheckEvery = 1024
+
+// snapshotTree returns a lazy copy-on-write clone of the B-tree, so long scans
+// can walk it without holding the driver lock
+func (d *Driver) snapshotTree() *btree.BTree {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.tree.Clone()
+}
+
+// ascendPrefix calls fn for every unexpired item whose key starts with prefix,
+// in key order, until fn returns false. Because keys are ordered, only the
+// matching range of the tree is visited. It stops early with the context's
+// error when ctx is done.
+func ascendPrefix(ctx context.Context, tree *btree.BTree, prefix string, fn func(*Item) bool) error {
+	return ascendPrefixFrom(ctx, tree, prefix, prefix, fn)
+}
+
+// ascendPrefixFrom is ascendPrefix starting at the first key >= start, which
+// must not sort before prefix
+func ascendPrefixFrom(ctx context.Context, tree *btree.BTree, prefix, start string, fn func(*Item) bool) error {
+	return ascendPrefixAt(ctx, tree, prefix, start, time.Now(), fn)
+}
+
+// ascendPrefixAt is ascendPrefixFrom leaving out the items expired at now
+// rather than at the current time
+func ascendPrefixAt(ctx context.Context, tree *btree.BTree, prefix, start string, now time.Time, fn func(*Item) bool) error {
+	visited := 0
+	var err error
+	tree.AscendGreaterOrEqual(&Item{Key: start}, func(i btree.Item) bool {
+		if visited++; visited%ctxCheckEvery == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		it := i.(*Item)
+		if !strings.HasPrefix(it.Key, prefix) {
+			return false
+		}
+		if it.expired(now) {
+			return true
+		}
+		return fn(it)
+	})
+	return err
+}
+
+// descendPrefixBefore calls fn for every unexpired item whose key starts
+// with prefix and sorts before the key before, or every one when before is
+// empty, in reverse key order until fn returns false. It stops early with
+// the context's error when ctx is done.
+func descendPrefixBefore(ctx context.Context, tree *btree.BTree, prefix, before string, fn func(*Item) bool) error {
+	// Every key below upper that does not sort before prefix starts with it
+	upper := prefixEnd(prefix)
+	if before != "" && (upper == "" || before < upper) {
+		upper = before
+	}
+
+	now := time.Now()
+	visited := 0
+	var err error
+	visit := func(i btree.Item) bool {
+		if visited++; visited%ctxCheckEvery == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		it := i.(*Item)
+		if it.Key == upper {
+			return true
+		}
+		if !strings.HasPrefix(it.Key, prefix) {
+			return false
+		}
+		if it.expired(now) {
+			return true
+		}
+		return fn(it)
+	}
+	if upper == "" {
+		tree.Descend(visit)
+	} else {
+		tree.DescendLessOrEqual(&Item{Key: upper}, visit)
+	}
+	return err
+}
+
+// prefixEnd returns the first key after every key starting with prefix, or
+// "" when there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Count returns the number of indexed keys starting with prefix, or every key
+// when prefix is empty, leaving out reserved keys. It walks a clone of the
+// index, so writers are not blocked, and returns ctx's error if ctx is done
+// before the count finishes.
+func (d *Driver) Count(ctx context.Context, prefix string) (int, error) {
+	count := 0
+	err := ascendPrefix(ctx, d.snapshotTree(), prefix, func(it *Item) bool {
+		if !Reserved(it.Key) {
+			count++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// List returns up to limit indexed keys starting with prefix, in key order,
+// beginning after the key after (or from the start of the prefix when after
+// is empty). A limit <= 0 returns every matching key. Like Count it leaves
+// out reserved keys, walks a clone of the index and returns ctx's error if
+// ctx is done first.
+func (d *Driver) List(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	return d.ListMatching(ctx, prefix, after, limit, nil)
+}
+
+// ListMatching is List of only the keys whose values filter matches, or
+// every key when filter is nil. Values are read as the keys are visited,
+// bypassing the cache as Export does, until limit keys have matched.
+func (d *Driver) ListMatching(ctx context.Context, prefix, after string, limit int, filter *Filter) ([]string, error) {
+	start := prefix
+	if after > start {
+		start = after
+	}
+
+	keys := []string{}
+	var err error
+	scanErr := ascendPrefixFrom(ctx, d.snapshotTree(), prefix, start, func(it *Item) bool {
+		if it.Key == after || Reserved(it.Key) {
+			return true
+		}
+		var ok bool
+		if ok, err = d.Matches(it.Key, filter); err != nil {
+			return false
+		}
+		if ok {
+			keys = append(keys, it.Key)
+		}
+		return limit <= 0 || len(keys) < limit
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ListDesc is List in reverse key order: it returns up to limit keys starting
+// with prefix, beginning with the last key before the key before (or the
+// last key of the prefix when before is empty)
+func (d *Driver) ListDesc(ctx context.Context, prefix, before string, limit int) ([]string, error) {
+	return d.ListDescMatching(ctx, prefix, before, limit, nil)
+}
+
+// ListDescMatching is ListDesc of only the keys whose values filter
+// matches, as ListMatching is List
+func (d *Driver) ListDescMatching(ctx context.Context, prefix, before string, limit int, filter *Filter) ([]string, error) {
+	keys := []string{}
+	var err error
+	scanErr := descendPrefixBefore(ctx, d.snapshotTree(), prefix, before, func(it *Item) bool {
+		if Reserved(it.Key) {
+			return true
+		}
+		var ok bool
+		if ok, err = d.Matches(it.Key, filter); err != nil {
+			return false
+		}
+		if ok {
+			keys = append(keys, it.Key)
+		}
+		return limit <= 0 || len(keys) < limit
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Matches reports whether filter matches the value of a key, reading it
+// without adding it to the cache. It is always true for a nil filter, and
+// false for a key that does not exist.
+func (d *Driver) Matches(key string, filter *Filter) (bool, error) {
+	if filter == nil {
+		return true, nil
+	}
+	value, ok, err := d.readUncached(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return filter.Match(value), nil
+}
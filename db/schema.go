@@ -0,0 +1,235 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaFile holds the schemas set with SetSchema, in the metadata directory
+const schemaFile = "schemas.json"
+
+// ErrSchemaViolation is returned, as a *SchemaError, for a value that does
+// not match the JSON Schema set for its key
+var ErrSchemaViolation = errors.New("value does not match the schema")
+
+// ErrInvalidSchema is returned by SetSchema for a schema that does not
+// compile
+var ErrInvalidSchema = errors.New("invalid JSON Schema")
+
+// SchemaViolation is one way a value fails its schema
+type SchemaViolation struct {
+	Path    string `json:"path"` // JSON Pointer to the failing part of the value, empty for all of it
+	Message string `json:"message"`
+}
+
+// SchemaError lists why a value was refused by the schema set for Prefix
+type SchemaError struct {
+	Key        string
+	Prefix     string
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	msg := fmt.Sprintf("%v: %s", ErrSchemaViolation, e.Key)
+	if len(e.Violations) > 0 {
+		v := e.Violations[0]
+		msg += fmt.Sprintf(": at %q: %s", v.Path, v.Message)
+	}
+	return msg
+}
+
+// Unwrap makes errors.Is(err, ErrSchemaViolation) hold
+func (e *SchemaError) Unwrap() error {
+	return ErrSchemaViolation
+}
+
+// keySchema is a JSON Schema set with SetSchema
+type keySchema struct {
+	raw      json.RawMessage
+	compiled *jsonschema.Schema
+}
+
+// compileSchema compiles a JSON Schema. Schemas may only refer to
+// themselves, so that setting one never reads files or the network.
+func compileSchema(raw []byte) (*keySchema, error) {
+	const url = "mem:///schema.json"
+	c := jsonschema.NewCompiler()
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("schemas cannot refer to %s", s)
+	}
+	if err := c.AddResource(url, bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+	compiled, err := c.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+	return &keySchema{raw: append(json.RawMessage(nil), raw...), compiled: compiled}, nil
+}
+
+// SetSchema makes Put, Create, PutBatch and PutReader check the values of
+// keys starting with prefix against a JSON Schema. Values failing it are
+// refused with a *SchemaError, or only logged with Options.SchemaAdvisory.
+// Where prefixes overlap, the longest applies. Values already stored are not
+// checked, and neither are those applied from a primary. A nil
+// schema removes the one set for prefix. Schemas are kept in the data
+// directory and survive restarts.
+func (d *Driver) SetSchema(prefix string, schema []byte) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+	var compiled *keySchema
+	if schema != nil {
+		var err error
+		if compiled, err = compileSchema(schema); err != nil {
+			return err
+		}
+	}
+
+	d.schemaMu.Lock()
+	defer d.schemaMu.Unlock()
+	old, had := d.schemas[prefix]
+	if compiled == nil {
+		delete(d.schemas, prefix)
+	} else {
+		d.schemas[prefix] = compiled
+	}
+	if err := d.saveSchemas(); err != nil {
+		if had {
+			d.schemas[prefix] = old
+		} else {
+			delete(d.schemas, prefix)
+		}
+		return err
+	}
+	if compiled == nil {
+		d.log.Info("Removed the schema for keys starting with %q", prefix)
+	} else {
+		d.log.Info("Set the schema for keys starting with %q", prefix)
+	}
+	return nil
+}
+
+// Schemas returns the schemas set with SetSchema by prefix
+func (d *Driver) Schemas() map[string][]byte {
+	d.schemaMu.RLock()
+	defer d.schemaMu.RUnlock()
+	schemas := make(map[string][]byte, len(d.schemas))
+	for prefix, s := range d.schemas {
+		schemas[prefix] = s.raw
+	}
+	return schemas
+}
+
+// saveSchemas writes the schemas to the metadata directory. The caller must
+// hold schemaMu.
+func (d *Driver) saveSchemas() error {
+	raw := make(map[string]json.RawMessage, len(d.schemas))
+	for prefix, s := range d.schemas {
+		raw[prefix] = s.raw
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.dir, metaDir, schemaFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(path, data)
+}
+
+// loadSchemas loads the schemas saved by SetSchema
+func (d *Driver) loadSchemas() error {
+	d.schemas = make(map[string]*keySchema)
+	data, err := os.ReadFile(filepath.Join(d.dir, metaDir, schemaFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to load the schemas: %w", err)
+	}
+	for prefix, r := range raw {
+		s, err := compileSchema(r)
+		if err != nil {
+			return fmt.Errorf("failed to load the schema for %q: %w", prefix, err)
+		}
+		d.schemas[prefix] = s
+	}
+	return nil
+}
+
+// schemaFor returns the schema for a key and the prefix it was set for, or
+// nil when there is none
+func (d *Driver) schemaFor(key string) (string, *keySchema) {
+	d.schemaMu.RLock()
+	defer d.schemaMu.RUnlock()
+	var prefix string
+	var s *keySchema
+	for p, candidate := range d.schemas {
+		if strings.HasPrefix(key, p) && (s == nil || len(p) > len(prefix)) {
+			prefix, s = p, candidate
+		}
+	}
+	return prefix, s
+}
+
+// checkSchema checks a value against the schema for its key, if any
+func (d *Driver) checkSchema(key string, value []byte) error {
+	prefix, s := d.schemaFor(key)
+	if s == nil {
+		return nil
+	}
+
+	var violations []SchemaViolation
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		violations = []SchemaViolation{{Message: "value is not JSON: " + err.Error()}}
+	} else if dec.More() {
+		violations = []SchemaViolation{{Message: "value holds more than one JSON document"}}
+	} else if err := s.compiled.Validate(doc); err != nil {
+		var verr *jsonschema.ValidationError
+		if !errors.As(err, &verr) {
+			return err
+		}
+		violations = leafViolations(verr, nil)
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	err := &SchemaError{Key: key, Prefix: prefix, Violations: violations}
+	if d.schemaAdvisory {
+		d.log.Warn("Storing %s anyway, schemas are advisory: %v", key, err)
+		return nil
+	}
+	return err
+}
+
+// leafViolations flattens a validation error into the failures at its
+// leaves, which name the keywords that failed rather than the schemas
+// holding them
+func leafViolations(err *jsonschema.ValidationError, into []SchemaViolation) []SchemaViolation {
+	if len(err.Causes) == 0 {
+		return append(into, SchemaViolation{Path: err.InstanceLocation, Message: err.Message})
+	}
+	for _, cause := range err.Causes {
+		into = leafViolations(cause, into)
+	}
+	return into
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+)
+
+// The set operations keep a set as a JSON array of distinct members, in the
+// order they were added, so that the stored value diffs well. Members are
+// compared by their compact JSON text: 1 and 1.0, or objects with their
+// members in another order, are different members.
+//
+// Each call decodes the array once, scans it once and, only when the set
+// changes, writes it back once, so a call costs time linear in the size of
+// the value, never quadratic; adding n members one at a time writes O(n²)
+// bytes in all. Keep sets of many thousands of members in several keys, or
+// batch their changes into a single Put, when that matters.
+
+// setIndex returns the position of member, in compact form, in list, or -1
+func setIndex(list []json.RawMessage, member []byte) int {
+	var compact bytes.Buffer
+	for i, m := range list {
+		compact.Reset()
+		if json.Compact(&compact, m) == nil && bytes.Equal(compact.Bytes(), member) {
+			return i
+		}
+	}
+	return -1
+}
+
+// compactMember returns member in compact form, or ErrInvalidElement when
+// it is not JSON
+func compactMember(member []byte) ([]byte, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, member); err != nil {
+		return nil, ErrInvalidElement
+	}
+	return compact.Bytes(), nil
+}
+
+// SetAdd adds member, which must be JSON, to the set stored at key as a
+// JSON array, after the members already there, and reports whether it was
+// not there yet. A missing key is created holding just member, with
+// Options.DefaultTTL; an existing expiry is kept, and a set that already
+// holds member is not written at all. A value that is not a JSON array
+// fails with ErrNotList.
+func (d *Driver) SetAdd(key string, member []byte) (bool, error) {
+	if err := d.checkKey(key); err != nil {
+		return false, err
+	}
+	member, err := compactMember(member)
+	if err != nil {
+		return false, err
+	}
+	if err := d.writable(); err != nil {
+		return false, err
+	}
+
+	t := d.startOp(context.Background(), "set_add", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	current, expiresAt, exists, err := d.readLocked(key, t)
+	if err != nil {
+		return false, err
+	}
+	var list []json.RawMessage
+	if exists {
+		if list, err = parseList(key, current); err != nil {
+			return false, err
+		}
+		if setIndex(list, member) >= 0 {
+			return false, nil
+		}
+	} else {
+		expiresAt, _ = d.writeExpiry(0)
+	}
+
+	if err := d.putList(key, append(list, member), expiresAt, t); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetRemove removes member from the set stored at key, keeping the order of
+// the others, and reports whether it was there. A missing key holds no
+// members; the key is kept, holding [], once its last member goes.
+func (d *Driver) SetRemove(key string, member []byte) (bool, error) {
+	if err := d.checkKey(key); err != nil {
+		return false, err
+	}
+	member, err := compactMember(member)
+	if err != nil {
+		return false, err
+	}
+	if err := d.writable(); err != nil {
+		return false, err
+	}
+
+	t := d.startOp(context.Background(), "set_remove", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.unlock()
+
+	current, expiresAt, exists, err := d.readLocked(key, t)
+	if err != nil || !exists {
+		return false, err
+	}
+	list, err := parseList(key, current)
+	if err != nil {
+		return false, err
+	}
+	i := setIndex(list, member)
+	if i < 0 {
+		return false, nil
+	}
+	if err := d.putList(key, append(list[:i], list[i+1:]...), expiresAt, t); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetContains reports whether the set stored at key holds member. A missing
+// key holds no members.
+func (d *Driver) SetContains(key string, member []byte) (bool, error) {
+	if err := d.checkKey(key); err != nil {
+		return false, err
+	}
+	member, err := compactMember(member)
+	if err != nil {
+		return false, err
+	}
+	if err := d.checkOpen(); err != nil {
+		return false, err
+	}
+
+	t := d.startOp(context.Background(), "set_contains", key)
+	defer d.finishOp(t)
+	d.rlock(t)
+	defer d.mutex.RUnlock()
+
+	current, _, exists, err := d.readLocked(key, t)
+	if err != nil || !exists {
+		return false, err
+	}
+	list, err := parseList(key, current)
+	if err != nil {
+		return false, err
+	}
+	return setIndex(list, member) >= 0, nil
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ringReplicas is how many points each shard gets on the hash ring. More
+// points spread keys more evenly.
+const ringReplicas = 128
+
+// rebalanceReportEvery is how many keys Rebalance checks between progress
+// reports
+const rebalanceReportEvery = 100
+
+type ringPoint struct {
+	hash  uint64
+	shard string
+}
+
+// hashRing places keys on shards by consistent hashing, so adding a shard
+// only moves the keys that now belong to it
+type hashRing struct {
+	points []ringPoint
+}
+
+// hash64 hashes a key or ring point. FNV alone leaves similar strings close
+// together on the ring, so its result is mixed with the splitmix64 finalizer.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func newHashRing(shards []string) *hashRing {
+	r := &hashRing{}
+	for _, shard := range shards {
+		for i := 0; i < ringReplicas; i++ {
+			r.points = append(r.points, ringPoint{hash: hash64(shard + "#" + strconv.Itoa(i)), shard: shard})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i].hash < r.points[j].hash })
+	return r
+}
+
+// owner returns the shard a key belongs on
+func (r *hashRing) owner(key string) string {
+	h := hash64(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// isShard reports whether dir holds keys, as a shard or the cold tier
+func (d *Driver) isShard(dir string) bool {
+	for _, shard := range d.dirs {
+		if shard == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// shardFor returns the directory holding a key: the one the B-tree records,
+// else the first directory that has the file, starting with the shard the
+// ring places it on and ending with the cold tier, else that shard for a
+// new key. Keys can sit on other shards than the ring says until Rebalance
+// has moved them. The caller must hold the mutex.
+func (d *Driver) shardFor(key string) string {
+	if len(d.dirs) == 1 {
+		return d.dir
+	}
+	if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok && d.isShard(it.Dir) {
+		return it.Dir
+	}
+
+	owner := d.ring.owner(key)
+	name := d.fileName(key)
+	if _, err := os.Stat(filepath.Join(owner, name)); err == nil {
+		return owner
+	}
+	for _, shard := range d.dirs {
+		if shard == owner {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(shard, name)); err == nil {
+			return shard
+		}
+	}
+	return owner
+}
+
+// keyPath returns the file holding a key. The caller must hold the mutex.
+func (d *Driver) keyPath(key string) string {
+	return filepath.Join(d.shardFor(key), d.fileName(key))
+}
+
+// keyFiles returns the keys held in files in every shard, in key order,
+// including those whose values write-back mode has not written yet
+func (d *Driver) keyFiles() ([]string, error) {
+	seen := make(map[string]bool)
+	held := d.dirtyKeys()
+	var names []string
+	for _, key := range held {
+		seen[key] = true
+		names = append(names, key)
+	}
+	for _, shard := range d.dirs {
+		entries, err := os.ReadDir(shard)
+		if err != nil {
+			d.log.Error("Failed to list directory %s: %v", shard, err)
+			return nil, err
+		}
+		for _, entry := range entries {
+			name, ok := d.keyName(entry.Name())
+			if entry.IsDir() || !ok || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	// Encoded names do not sort like the keys they hold, and held back keys
+	// are listed ahead of the files
+	if len(d.dirs) > 1 || d.encoded || len(held) > 0 {
+		sort.Strings(names)
+	}
+	return names, nil
+}
+
+// ShardStats describes one data directory
+type ShardStats struct {
+	Dir       string `json:"dir"`
+	Cold      bool   `json:"cold,omitempty"` // the cold tier, see Options.ColdDir
+	Files     int    `json:"files"`          // key files in the directory
+	Bytes     int64  `json:"bytes"`          // size of the key files
+	DiskTotal uint64 `json:"disk_total"`     // bytes on the filesystem holding it
+	DiskFree  uint64 `json:"disk_free"`      // bytes available to the server
+}
+
+// shardStats counts the files in every directory holding keys and reports
+// its disk usage
+func (d *Driver) shardStats() []ShardStats {
+	stats := make([]ShardStats, len(d.dirs))
+	for i, shard := range d.dirs {
+		stats[i].Dir, stats[i].Cold = shard, shard == d.cold
+		if entries, err := os.ReadDir(shard); err == nil {
+			for _, entry := range entries {
+				if entry.IsDir() || d.isInternalFile(entry.Name()) {
+					continue
+				}
+				stats[i].Files++
+				if info, err := entry.Info(); err == nil {
+					stats[i].Bytes += info.Size()
+				}
+			}
+		}
+		stats[i].DiskTotal, stats[i].DiskFree, _ = diskUsage(shard)
+	}
+	return stats
+}
+
+// RebalanceProgress reports how far a Rebalance has got
+type RebalanceProgress struct {
+	Total   int  `json:"total"`   // key files found when the rebalance started
+	Scanned int  `json:"scanned"` // key files checked so far
+	Moved   int  `json:"moved"`   // key files moved to the shard they belong on
+	Done    bool `json:"done"`
+}
+
+// Rebalance moves every key to the shard the hash ring places it on, which
+// is needed after adding a data directory. It can run while the driver
+// serves requests: each key is moved under the write lock, so readers see it
+// in either place but never in both or neither. progress, if not nil, is
+// called every few keys and once more when done. A cancelled ctx stops the
+// rebalance between keys; running it again picks up where it stopped.
+func (d *Driver) Rebalance(ctx context.Context, progress func(RebalanceProgress)) (RebalanceProgress, error) {
+	names, err := d.keyFiles()
+	if err != nil {
+		return RebalanceProgress{}, err
+	}
+
+	p := RebalanceProgress{Total: len(names)}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		moved, err := d.moveToOwner(name)
+		if err != nil {
+			return p, err
+		}
+		p.Scanned++
+		if moved {
+			p.Moved++
+		}
+		if progress != nil && p.Scanned%rebalanceReportEvery == 0 {
+			progress(p)
+		}
+	}
+
+	p.Done = true
+	if progress != nil {
+		progress(p)
+	}
+	d.log.Info("Rebalanced %d of %d keys", p.Moved, p.Total)
+	return p, nil
+}
+
+// moveToOwner moves a key to the shard it belongs on and reports whether it
+// had to move. Keys in the cold tier stay there.
+func (d *Driver) moveToOwner(key string) (bool, error) {
+	if len(d.shards) == 1 {
+		return false, nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	from := d.shardFor(key)
+	to := d.ring.owner(key)
+	if from == to || from == d.cold {
+		return false, nil
+	}
+	return d.moveLocked(key, from, to)
+}
+
+// moveLocked moves the file of a key from one directory to another and
+// records where it now is, reporting false if the key was deleted. The
+// caller must hold the write lock.
+func (d *Driver) moveLocked(key, from, to string) (bool, error) {
+	if err := d.flushKey(key); err != nil {
+		return false, err
+	}
+
+	name := d.fileName(key)
+	src, dst := filepath.Join(from, name), filepath.Join(to, name)
+	if err := os.Rename(src, dst); err != nil {
+		if os.IsNotExist(err) {
+			// Deleted since the shards were listed
+			return false, nil
+		}
+		// Shards on different disks need a copy
+		if !errors.Is(err, syscall.EXDEV) {
+			d.log.Error("Failed to move %s to %s: %v", key, to, err)
+			return false, err
+		}
+		if err := copyFile(src, dst); err != nil {
+			d.log.Error("Failed to copy %s to %s: %v", key, to, err)
+			return false, err
+		}
+		if err := os.Remove(src); err != nil {
+			d.log.Error("Failed to remove moved key %s: %v", key, err)
+			return false, err
+		}
+	}
+
+	if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok {
+		moved := *it
+		moved.Dir = to
+		d.tree.ReplaceOrInsert(&moved)
+		d.snapshotStale = true
+	}
+	return true, nil
+}
+
+// copyFile copies src to dst through a temp file, so dst never holds part of
+// the value
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tempPath := dst + ".tmp"
+	out, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tempPath)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	os.Chtimes(tempPath, time.Now(), info.ModTime())
+	return replaceFile(tempPath, dst)
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// opTimer times the phases of one operation, so that a slow one can be
+// logged with where its time went and a traced one gets a span for each
+// phase. Driver methods take a nil *opTimer when neither slow operation
+// logging nor tracing is on, and every method below accepts one.
+type opTimer struct {
+	op       string
+	key      string // empty for operations on several keys
+	size     int64  // bytes read or written
+	start    time.Time
+	lockWait time.Duration
+	io       time.Duration
+
+	span   trace.Span      // nil when the operation is not traced
+	tracer trace.Tracer    // starts the spans of its phases
+	ctx    context.Context // holds span, for its children
+	ioSpan trace.Span      // the disk I/O under way
+}
+
+// startOp starts timing an operation, returning nil when slow operations are
+// not logged and the operation is not traced. It is traced when the driver
+// has a tracer and ctx carries the span of the caller.
+func (d *Driver) startOp(ctx context.Context, op, key string) *opTimer {
+	traced := d.tracer != nil && trace.SpanContextFromContext(ctx).IsValid()
+	if d.slowOp <= 0 && !traced {
+		return nil
+	}
+	t := &opTimer{op: op, key: key, start: time.Now()}
+	if traced {
+		t.tracer = d.tracer
+		t.ctx, t.span = d.tracer.Start(ctx, "db."+op, trace.WithAttributes(keyAttr(key)))
+	}
+	return t
+}
+
+// lock takes the write lock, counting the wait against t
+func (d *Driver) lock(t *opTimer) {
+	if t == nil {
+		d.mutex.Lock()
+		return
+	}
+	start := time.Now()
+	span := t.child("db.lock", lockAttr("write"))
+	d.mutex.Lock()
+	endSpan(span)
+	t.lockWait += time.Since(start)
+}
+
+// rlock takes the read lock, counting the wait against t
+func (d *Driver) rlock(t *opTimer) {
+	if t == nil {
+		d.mutex.RLock()
+		return
+	}
+	start := time.Now()
+	span := t.child("db.lock", lockAttr("read"))
+	d.mutex.RLock()
+	endSpan(span)
+	t.lockWait += time.Since(start)
+}
+
+// ioStart marks the start of disk I/O, to be passed to ioDone
+func (t *opTimer) ioStart() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	t.ioSpan = t.child("db.io")
+	return time.Now()
+}
+
+// ioDone counts the disk I/O since start against t
+func (t *opTimer) ioDone(start time.Time) {
+	if t != nil {
+		t.io += time.Since(start)
+		endSpan(t.ioSpan)
+		t.ioSpan = nil
+	}
+}
+
+// addSize records bytes read or written
+func (t *opTimer) addSize(n int64) {
+	if t != nil {
+		t.size += n
+	}
+}
+
+// finishOp ends the operation's span, and logs a warning and counts the
+// operation when it took at least the slow operation threshold. It is
+// deferred, after the locks are released.
+func (d *Driver) finishOp(t *opTimer) {
+	if t == nil {
+		return
+	}
+	elapsed := time.Since(t.start)
+	if t.span != nil {
+		t.span.SetAttributes(sizeAttr(t.size))
+		t.span.End()
+	}
+	if d.slowOp <= 0 || elapsed < d.slowOp {
+		return
+	}
+
+	phase := "disk I/O"
+	if t.lockWait > t.io {
+		phase = "lock wait"
+	}
+
+	d.slowMu.Lock()
+	d.slowOps[t.op]++
+	d.slowMu.Unlock()
+
+	if fl, ok := d.log.(FieldLogger); ok {
+		fl.LogFields(LevelWarn, "Slow operation", "op", t.op, "key", t.key, "size", t.size,
+			"duration", elapsed, "lock_wait", t.lockWait, "io", t.io, "slow_phase", phase)
+		return
+	}
+	subject := t.op
+	if t.key != "" {
+		subject += " of key " + t.key
+	}
+	d.log.Warn("Slow %s (%d bytes) took %s, mostly %s: lock wait %s, disk I/O %s",
+		subject, t.size, elapsed, phase, t.lockWait, t.io)
+}
+
+// slowOpCounts returns how many slow operations of each kind were logged
+func (d *Driver) slowOpCounts() (uint64, map[string]uint64) {
+	d.slowMu.Lock()
+	defer d.slowMu.Unlock()
+
+	var total uint64
+	byOp := make(map[string]uint64, len(d.slowOps))
+	for op, n := range d.slowOps {
+		byOp[op] = n
+		total += n
+	}
+	return total, byOp
+}
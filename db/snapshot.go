@@ -0,0 +1,346 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/btree"
+)
+
+const (
+	// metaDir holds driver state in the data directory, next to the keys
+	metaDir      = ".zephyrus"
+	snapshotFile = "btree.json"
+
+	// legacySnapshotFile is where the server saved the B-tree before the
+	// driver managed its snapshot
+	legacySnapshotFile = "btree.json"
+)
+
+// errCorruptSnapshot is returned for a snapshot file that exists but cannot
+// be decoded
+var errCorruptSnapshot = errors.New("corrupt B-tree snapshot")
+
+// loadSnapshot sets where Close saves the B-tree, path or the default when
+// path is empty, and loads the B-tree saved there. No snapshot means a first
+// run and leaves the tree empty.
+func (d *Driver) loadSnapshot(path string) error {
+	if path == "" {
+		path = filepath.Join(d.dir, metaDir, snapshotFile)
+		// Only a data directory the driver never opened, without a metadata
+		// directory at all, can hold a snapshot at the old default path;
+		// anywhere else that file is a key
+		_, err := os.Stat(filepath.Dir(path))
+		legacy := os.IsNotExist(err)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if legacy {
+			return d.loadLegacySnapshot(path)
+		}
+	}
+	d.snapshotPath, d.snapshotSeq = path, d.Seq()
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		d.log.Info("No B-tree snapshot at %s, starting empty", path)
+		return nil
+	}
+	err := d.deserializeLocked(path)
+	if errors.Is(err, errCorruptSnapshot) {
+		return d.setAsideSnapshot(path, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load the B-tree snapshot: %w", err)
+	}
+	d.noteSnapshot(path)
+	return nil
+}
+
+// setAsideSnapshot renames a snapshot that could not be decoded out of the
+// way so that the driver starts with an empty tree, which the next save
+// replaces, rather than failing every Open until someone removes it
+func (d *Driver) setAsideSnapshot(path string, cause error) error {
+	aside := fmt.Sprintf("%s.corrupt-%s", path, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.Rename(path, aside); err != nil {
+		return fmt.Errorf("failed to move the corrupt B-tree snapshot aside: %w", err)
+	}
+	d.markInternal(aside)
+	d.startup.Quarantined = append(d.startup.Quarantined, aside)
+	d.tree.Clear(false)
+	d.expiries.Clear(false)
+	d.snapshotStale = true
+	d.log.Warn("Moved the B-tree snapshot to %s and started empty: %v", aside, cause)
+	return nil
+}
+
+// loadLegacySnapshot loads a snapshot left at the old default path, to be
+// saved at path by Close. The file is only taken for a snapshot when it
+// decodes to items that could be one, see checkLegacyItems; otherwise it is
+// a key of that name and stays as it is.
+func (d *Driver) loadLegacySnapshot(path string) error {
+	d.snapshotPath, d.snapshotSeq = path, d.Seq()
+
+	legacy := filepath.Join(d.dir, legacySnapshotFile)
+	data, err := os.ReadFile(legacy)
+	if err != nil {
+		d.log.Info("No B-tree snapshot at %s, starting empty", path)
+		return nil
+	}
+	items, err := decodeSnapshot(bytes.NewReader(data), d.codec)
+	if err == nil {
+		err = d.checkLegacyItems(items)
+	}
+	if err != nil {
+		d.log.Warn("Leaving %s in place, it is not a B-tree snapshot: %v", legacy, err)
+		return nil
+	}
+	d.markInternal(legacy)
+	d.setItems(items)
+	d.log.Info("Loaded the B-tree from %s; it moves to %s on Close", legacy, path)
+	d.noteSnapshot(legacy)
+	d.snapshotStale = true
+	d.legacySnapshot = legacy
+	return nil
+}
+
+// checkLegacyItems returns an error unless items could be a saved B-tree:
+// at least one item, each for a distinct key the driver can store other
+// than the snapshot's own name, and with no negative times. A key whose
+// value merely decodes as a list of items is then not mistaken for a
+// snapshot and removed.
+func (d *Driver) checkLegacyItems(items []Item) error {
+	if len(items) == 0 {
+		return errors.New("no items")
+	}
+	seen := make(map[string]bool, len(items))
+	for _, it := range items {
+		switch {
+		case d.checkKey(it.Key) != nil || it.Key == legacySnapshotFile:
+			return fmt.Errorf("item with invalid key %q", it.Key)
+		case seen[it.Key]:
+			return fmt.Errorf("key %q appears twice", it.Key)
+		case it.ExpiresAt < 0 || it.CreatedAt < 0 || it.UpdatedAt < 0:
+			return fmt.Errorf("item %q has a negative time", it.Key)
+		}
+		seen[it.Key] = true
+	}
+	return nil
+}
+
+// ReadMetaFile returns a file that a package built on the Driver, such as
+// webhook, keeps in the metadata directory next to the Driver's own, and
+// nil when there is none
+func (d *Driver) ReadMetaFile(name string) ([]byte, error) {
+	if err := checkMetaName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(d.dir, metaDir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// WriteMetaFile replaces a file in the metadata directory, see
+// ReadMetaFile. Either the old or the new contents survive a crash.
+func (d *Driver) WriteMetaFile(name string, data []byte) error {
+	if err := checkMetaName(name); err != nil {
+		return err
+	}
+	path := filepath.Join(d.dir, metaDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return d.writeFile(path, data)
+}
+
+// checkMetaName refuses names of metadata files that are paths or are the
+// Driver's own
+func checkMetaName(name string) error {
+	switch name {
+	case "", ".", "..", snapshotFile, quotaFile, schemaFile, revisionFile, archiveDir:
+		return fmt.Errorf("invalid metadata file name %q", name)
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid metadata file name %q", name)
+	}
+	return nil
+}
+
+// snapshotDirty reports whether the B-tree changed since it was last saved or
+// loaded. The caller must hold the mutex.
+func (d *Driver) snapshotDirty() bool {
+	return d.snapshotStale || d.Seq() != d.snapshotSeq
+}
+
+// saveSnapshot saves the B-tree to the driver's snapshot. The caller must
+// hold the write lock.
+func (d *Driver) saveSnapshot() error {
+	if err := d.serializeLocked(d.snapshotPath); err != nil {
+		return err
+	}
+	d.snapshotSeq, d.snapshotStale = d.Seq(), false
+
+	if d.legacySnapshot != "" {
+		if err := os.Remove(d.legacySnapshot); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		d.legacySnapshot = ""
+	}
+	return nil
+}
+
+// snapshotLoop saves the snapshot every interval, give or take a tenth so
+// that servers started together do not all write at once, until Close.
+// Saves run under the write lock, so they never overlap one another or the
+// one made by Close. A failed save is counted and tried again on the next
+// tick.
+func (d *Driver) snapshotLoop(every time.Duration) {
+	defer d.background.Done()
+
+	timer := time.NewTimer(jitter(every))
+	defer timer.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-timer.C:
+		}
+		d.periodicSnapshot()
+		timer.Reset(jitter(every))
+	}
+}
+
+// periodicSnapshot saves the snapshot if anything changed since the last one
+func (d *Driver) periodicSnapshot() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.closed.Load() || !d.snapshotDirty() {
+		return
+	}
+	if err := d.saveSnapshot(); err != nil {
+		d.snapshotFails.Add(1)
+		d.log.Error("Failed to save the B-tree snapshot, retrying on the next tick: %v", err)
+		return
+	}
+	d.snapshots.Add(1)
+}
+
+// jitter returns d moved by up to a tenth either way
+func jitter(d time.Duration) time.Duration {
+	spread := int64(d / 5)
+	if spread <= 0 {
+		return d
+	}
+	return d - d/10 + time.Duration(rand.Int63n(spread+1))
+}
+
+// forgetStaleValues drops the values and content hashes the snapshot holds
+// for keys whose files were written after it was saved, as they are when a
+// run ends without Close, so that they are read from disk when next asked
+// for. The caller must hold the write lock.
+func (d *Driver) forgetStaleValues() {
+	path := d.snapshotPath
+	if d.legacySnapshot != "" {
+		path = d.legacySnapshot
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	saved := fi.ModTime()
+
+	var stale []*Item
+	d.tree.Ascend(func(i btree.Item) bool {
+		it := i.(*Item)
+		if it.Value == nil && it.Hash == "" {
+			return true
+		}
+		// A file written within the snapshot's clock tick may be newer too
+		if fi, err := os.Stat(d.keyPath(it.Key)); err == nil && !fi.ModTime().Before(saved) {
+			stale = append(stale, it)
+		}
+		return true
+	})
+	for _, it := range stale {
+		fixed := *it
+		fixed.Value, fixed.Hash = nil, ""
+		d.tree.ReplaceOrInsert(&fixed)
+	}
+	if len(stale) > 0 {
+		d.snapshotStale = true
+		d.log.Warn("Dropped the snapshot's values of %d keys written after it was saved", len(stale))
+	}
+}
+
+// reconcile brings the B-tree loaded from the snapshot in line with the data
+// directories, which may have changed while the driver was closed: keys whose
+// files are gone are dropped, and files the tree does not know are added,
+// with their values read when first asked for. The caller must hold the
+// write lock.
+func (d *Driver) reconcile() error {
+	files := make(map[string]string) // key to the shard holding its file
+	for _, shard := range d.dirs {
+		entries, err := os.ReadDir(shard)
+		if err != nil {
+			return fmt.Errorf("failed to list directory %s: %w", shard, err)
+		}
+		for _, entry := range entries {
+			name, ok := d.keyName(entry.Name())
+			if entry.IsDir() || !ok || d.validateKey(name) != nil {
+				continue
+			}
+			if _, seen := files[name]; !seen {
+				files[name] = shard
+			}
+		}
+	}
+
+	// A key moved between directories after the snapshot was saved is
+	// recorded where its file is now
+	var gone, moved []*Item
+	d.tree.Ascend(func(i btree.Item) bool {
+		it := i.(*Item)
+		if shard, ok := files[it.Key]; !ok {
+			gone = append(gone, it)
+		} else if it.Dir != "" && it.Dir != shard {
+			moved = append(moved, it)
+		}
+		return true
+	})
+	for _, it := range gone {
+		d.tree.Delete(it)
+		d.indexExpiry(it.Key, it.ExpiresAt, 0)
+		d.unindexLabels(it)
+	}
+	for _, it := range moved {
+		fixed := *it
+		fixed.Dir = files[it.Key]
+		d.tree.ReplaceOrInsert(&fixed)
+	}
+
+	added := 0
+	for name, shard := range files {
+		if d.tree.Get(&Item{Key: name}) == nil {
+			d.tree.ReplaceOrInsert(&Item{Key: name, Dir: shard})
+			added++
+		}
+	}
+
+	d.reconcileAdded, d.reconcileRemoved = added, len(gone)
+	if len(moved) > 0 {
+		d.snapshotStale = true
+	}
+	if added > 0 || len(gone) > 0 {
+		d.snapshotStale = true
+		d.log.Info("Reconciled the B-tree with the data directories: added %d keys found on disk, dropped %d whose files are gone", added, len(gone))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrTooCorrupt is returned by Open when the startup checks find at least
+// Options.CorruptLimit corrupt files
+var ErrTooCorrupt = errors.New("too many corrupt files")
+
+// StartupReport sums up what Open found and did, as logged once it is done
+// and returned by Driver.StartupReport
+type StartupReport struct {
+	OpenedAt time.Time
+	Duration time.Duration // how long Open took
+
+	Keys int // keys in the index once loaded and reconciled
+
+	// CleanShutdown tells whether the last run was closed, or there was
+	// none; after a crash the values written since the snapshot are read
+	// from disk again
+	CleanShutdown bool
+
+	// SnapshotAge is how old the B-tree snapshot loaded was, 0 when none was
+	SnapshotLoaded bool
+	SnapshotAge    time.Duration
+
+	// Keys reconciled with the data directories, see Stats.ReconcileAdded
+	ReconcileAdded   int
+	ReconcileRemoved int
+
+	// OplogSeq is the sequence number the operation log carries on from,
+	// and OplogTornBytes the size of a change cut short by a crash that was
+	// dropped from its end
+	OplogSeq       uint64
+	OplogTornBytes int64
+
+	// Temp files left by interrupted writes, removed
+	TempFilesRemoved int
+	TempBytesRemoved int64
+
+	// Quarantined lists the files moved aside because they could not be
+	// read, such as a corrupt B-tree snapshot
+	Quarantined []string
+
+	// Verified tells whether Options.VerifyOnOpen read back every value,
+	// and Corrupt lists those that did not match their content hash
+	Verified bool
+	Corrupt  []CorruptValue
+}
+
+// CorruptFiles counts the corrupt files found: the values failing
+// verification and the files quarantined
+func (r StartupReport) CorruptFiles() int {
+	return len(r.Corrupt) + len(r.Quarantined)
+}
+
+// StartupReport returns the report of the checks Open ran
+func (d *Driver) StartupReport() StartupReport {
+	return d.startup
+}
+
+// noteSnapshot records the age of the snapshot at path, just loaded
+func (d *Driver) noteSnapshot(path string) {
+	d.startup.SnapshotLoaded = true
+	if fi, err := os.Stat(path); err == nil {
+		d.startup.SnapshotAge = time.Since(fi.ModTime())
+	}
+}
+
+// removeTempFiles removes the temp files that writes interrupted by a crash
+// left in the data directories and their blob directories. Nothing else
+// writes to them while Open runs.
+func (d *Driver) removeTempFiles() error {
+	for _, dir := range d.dirs {
+		candidates, err := d.compactCandidates(dir)
+		if err != nil {
+			return err
+		}
+		for _, c := range candidates {
+			if filepath.Ext(c.path) != ".tmp" {
+				continue
+			}
+			fi, err := os.Lstat(c.path)
+			if err != nil {
+				continue
+			}
+			if err := os.Remove(c.path); err != nil {
+				d.log.Warn("Failed to remove leftover temp file %s: %v", c.path, err)
+				continue
+			}
+			d.startup.TempFilesRemoved++
+			d.startup.TempBytesRemoved += fi.Size()
+		}
+	}
+	return nil
+}
+
+// checkStartup finishes the startup report once the index is loaded:
+// removing temp files, verifying values with Options.VerifyOnOpen, and
+// failing with ErrTooCorrupt when Options.CorruptLimit is reached. It logs
+// the report.
+func (d *Driver) checkStartup(opts *Options, start time.Time) error {
+	r := &d.startup
+	if err := d.removeTempFiles(); err != nil {
+		return err
+	}
+	if opts.VerifyOnOpen {
+		corrupt, err := d.Verify(context.Background())
+		if err != nil {
+			return err
+		}
+		r.Verified, r.Corrupt = true, corrupt
+	}
+	r.Keys = d.tree.Len()
+	r.ReconcileAdded, r.ReconcileRemoved = d.reconcileAdded, d.reconcileRemoved
+	r.OplogSeq = d.changes.seq
+	if d.oplog != nil {
+		r.OplogTornBytes = d.oplog.torn
+	}
+	r.OpenedAt = time.Now()
+	r.Duration = r.OpenedAt.Sub(start)
+
+	shutdown := "after a crash"
+	if r.CleanShutdown {
+		shutdown = "after a clean shutdown"
+	}
+	snapshot := "no snapshot"
+	if r.SnapshotLoaded {
+		snapshot = fmt.Sprintf("snapshot %s old", r.SnapshotAge.Round(time.Second))
+	}
+	verified := "not verified"
+	if r.Verified {
+		verified = "verified"
+	}
+	summary := fmt.Sprintf("Startup %s: %d keys, %s, reconciled +%d -%d, oplog at %d (%d torn bytes dropped), %d temp files removed, %d corrupt files, %s, in %s",
+		shutdown, r.Keys, snapshot, r.ReconcileAdded, r.ReconcileRemoved, r.OplogSeq, r.OplogTornBytes, r.TempFilesRemoved, r.CorruptFiles(), verified, r.Duration.Round(time.Millisecond))
+	if r.CorruptFiles() > 0 {
+		d.log.Warn("%s", summary)
+		for _, c := range r.Corrupt {
+			d.log.Warn("Corrupt value of %s: %s", c.Key, c.Error)
+		}
+	} else {
+		d.log.Info("%s", summary)
+	}
+
+	if opts.CorruptLimit > 0 && r.CorruptFiles() >= opts.CorruptLimit {
+		// Nothing was written, so leave the directory as clean as it was
+		// found, for the next Open to check the same values
+		d.saveRevisions(d.rev, r.CleanShutdown)
+		return fmt.Errorf("%w: found %d, the limit is %d", ErrTooCorrupt, r.CorruptFiles(), opts.CorruptLimit)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// hashValue returns the content hash of a value, used as its ETag
+func hashValue(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:16])
+}
+
+// hasher computes hashValue incrementally for streamed values
+type hasher struct {
+	hash.Hash
+}
+
+func newHasher() *hasher {
+	return &hasher{Hash: sha256.New()}
+}
+
+func (h *hasher) sum() string {
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// KeyInfo describes a stored value without carrying the value itself
+type KeyInfo struct {
+	Key         string
+	Size        int64
+	ModTime     time.Time // of the file, which backups and restores may change
+	CreatedAt   time.Time // when the key was created, zero when not known
+	UpdatedAt   time.Time // when the value was last written, zero when not known
+	ETag        string
+	Revision    uint64        // changes on every write, see Driver.PutIfRevision
+	TTL         time.Duration // NoTTL for keys that do not expire
+	Cached      bool          // whether the value is in the LRU cache
+	ContentType string        // empty until content types are stored
+
+	Labels map[string]string // nil for a key without labels, see PutWithLabels
+}
+
+// Stat returns metadata about a key. The content hash is recorded when a
+// value is written, so Stat only has to read the value for keys that exist on
+// disk but have never been written or loaded by this driver.
+func (d *Driver) Stat(key string) (KeyInfo, error) {
+	if err := d.checkKey(key); err != nil {
+		return KeyInfo{}, err
+	}
+
+	d.mutex.RLock()
+	dir := d.shardFor(key)
+	filePath := filepath.Join(dir, d.fileName(key))
+	info, known, err := d.statLocked(key, filePath)
+	d.mutex.RUnlock()
+	if err != nil || known {
+		return info, err
+	}
+
+	// Hash the file outside the lock, then remember the hash for next time
+	hash, err := hashFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return KeyInfo{}, ErrKeyNotFound
+		}
+		d.log.Error("Failed to hash file: %v", err)
+		return KeyInfo{}, err
+	}
+	info.ETag = hash
+
+	d.mutex.Lock()
+	if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok {
+		info.Revision = it.Rev
+	} else if info.Revision, err = d.nextRev(); err == nil {
+		d.tree.ReplaceOrInsert(&Item{Key: key, Hash: hash, Dir: dir, Rev: info.Revision})
+	}
+	d.mutex.Unlock()
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	return info, nil
+}
+
+// statLocked fills in what is known about a key while the read lock is held.
+// known is false when the content hash still has to be computed.
+func (d *Driver) statLocked(key, filePath string) (KeyInfo, bool, error) {
+	info := KeyInfo{Key: key, TTL: NoTTL, Cached: d.cache.Contains(key)}
+
+	it, inTree := d.tree.Get(&Item{Key: key}).(*Item)
+	now := time.Now()
+	if inTree {
+		if it.expired(now) {
+			return KeyInfo{}, false, ErrKeyNotFound
+		}
+		if it.ExpiresAt != 0 {
+			info.TTL = time.Duration(it.ExpiresAt - now.UnixNano())
+		}
+		info.ETag = it.Hash
+		info.Revision = it.Rev
+		info.CreatedAt, info.UpdatedAt = unixTime(it.CreatedAt), unixTime(it.UpdatedAt)
+		info.Labels = maps.Clone(it.Labels)
+	}
+
+	fi, err := os.Stat(filePath)
+	switch {
+	case err == nil:
+		info.Size = fi.Size()
+		info.ModTime = fi.ModTime()
+	case os.IsNotExist(err) && inTree && it.Value != nil:
+		// Only the in-memory copy is left
+		info.Size = int64(len(it.Value))
+	case os.IsNotExist(err):
+		return KeyInfo{}, false, ErrKeyNotFound
+	default:
+		d.log.Error("Failed to stat file: %v", err)
+		return KeyInfo{}, false, err
+	}
+
+	if info.ETag == "" && inTree && it.Value != nil {
+		info.ETag = hashValue(it.Value)
+	}
+	return info, info.ETag != "", nil
+}
+
+// unixTime converts unix nanoseconds to a time, 0 to the zero time
+func unixTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// stamp sets the times of an item written now, which replaces existing
+// when replaced is true and then keeps its labels. A key that existed on disk before the B-tree
+// knew it, created false with nothing replaced, keeps its creation time
+// unknown.
+func (i *Item) stamp(existing *Item, replaced, created bool) {
+	i.UpdatedAt = time.Now().UnixNano()
+	switch {
+	case replaced:
+		i.CreatedAt = existing.CreatedAt
+		i.Labels = existing.Labels
+	case created:
+		i.CreatedAt = i.UpdatedAt
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newHasher()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return h.sum(), nil
+}
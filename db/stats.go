@@ -0,0 +1,166 @@
+package db
+
+import (
+	"context"
+
+	"github.com/google/btree"
+)
+
+// Stats is a snapshot of the driver's counters
+type Stats struct {
+	Keys          int `json:"keys"` // unexpired keys in the index
+	CachedValues  int `json:"cached_values"`
+	CacheCapacity int `json:"cache_capacity"`
+	Watchers      int `json:"watchers"`
+
+	ExpiringKeys int `json:"expiring_keys"` // unexpired keys with an expiry, see Options.DefaultTTL
+
+	MaxKeys int `json:"max_keys,omitempty"` // Options.MaxKeys, checked against Index.Items
+
+	// Values evicted from the cache to make room for others
+	CacheEvictions    uint64 `json:"cache_evictions"`
+	CacheEvictedBytes uint64 `json:"cache_evicted_bytes"`
+
+	Seq uint64 `json:"seq"` // sequence number of the latest change
+
+	DirtyValues int `json:"dirty_values"` // values Options.WriteBack has not written to disk yet
+
+	// Snapshots saved by Options.SnapshotEvery, and attempts that failed
+	Snapshots        uint64 `json:"snapshots"`
+	SnapshotFailures uint64 `json:"snapshot_failures"`
+
+	// Keys Open added to the loaded B-tree because their files were on
+	// disk, and keys it dropped because theirs were gone
+	ReconcileAdded   int `json:"reconcile_added"`
+	ReconcileRemoved int `json:"reconcile_removed"`
+
+	ExpiredSwept uint64 `json:"expired_swept"` // expired keys removed by Options.SweepEvery
+
+	Compaction CompactionStats `json:"compaction"`
+
+	DiskFull string `json:"disk_full,omitempty"` // why writes are refused for lack of space, see Options.MinFreeSpace
+
+	Namespaces map[string]NamespaceUsage `json:"namespaces,omitempty"` // usage of namespaces with a quota, see SetQuota
+	TextIndex  *TextIndexStats           `json:"text_index,omitempty"` // nil without EnableTextIndex
+
+	NumericIndexes map[string]NumericIndexStats `json:"numeric_indexes,omitempty"` // by name, see CreateNumericIndex
+
+	Shards []ShardStats `json:"shards"`
+	Tiers  *TierStats   `json:"tiers,omitempty"`  // nil without Options.ColdDir
+	Mirror *MirrorStats `json:"mirror,omitempty"` // nil without Options.Mirror
+	Index  IndexStats   `json:"index"`
+
+	// Operations that took at least Options.SlowOpThreshold, in total and
+	// by operation
+	SlowOps     uint64            `json:"slow_ops"`
+	SlowOpsByOp map[string]uint64 `json:"slow_ops_by_op"`
+
+	Ops OpStats `json:"ops"`
+}
+
+// Stats returns the driver's current counters. Counting keys walks a clone
+// of the index, so it does not block writers; counting files lists every
+// data directory.
+func (d *Driver) Stats() Stats {
+	return d.stats(false)
+}
+
+// StatsAndReset is Stats that also sets the operation counters in Stats.Ops
+// back to zero, so that each call reports the operations since the last,
+// as collectors working with deltas want. The other counters are left as
+// they are.
+func (d *Driver) StatsAndReset() Stats {
+	return d.stats(true)
+}
+
+func (d *Driver) stats(reset bool) Stats {
+	var keys, expiring int
+	ascendPrefix(context.Background(), d.snapshotTree(), "", func(it *Item) bool {
+		keys++
+		if it.ExpiresAt != 0 {
+			expiring++
+		}
+		return true
+	})
+
+	d.watchMu.Lock()
+	watchers := len(d.watchers)
+	d.watchMu.Unlock()
+
+	slowOps, slowOpsByOp := d.slowOpCounts()
+	cache := d.CacheStats()
+	diskFull, _ := d.DiskFull()
+	shards := d.shardStats()
+
+	return Stats{
+		Keys:              keys,
+		ExpiringKeys:      expiring,
+		MaxKeys:           d.maxKeys,
+		CachedValues:      cache.Values,
+		CacheCapacity:     cache.Capacity,
+		Watchers:          watchers,
+		CacheEvictions:    cache.Evictions,
+		CacheEvictedBytes: cache.EvictedBytes,
+		Seq:               d.Seq(),
+		DirtyValues:       len(d.dirtyKeys()),
+		Snapshots:         d.snapshots.Load(),
+		SnapshotFailures:  d.snapshotFails.Load(),
+		ReconcileAdded:    d.reconcileAdded,
+		ReconcileRemoved:  d.reconcileRemoved,
+		ExpiredSwept:      d.expiredSwept.Load(),
+		Compaction:        d.CompactionStats(),
+		DiskFull:          diskFull,
+		Namespaces:        d.Quotas(),
+		TextIndex:         d.textIndexStats(),
+		NumericIndexes:    d.numericIndexStats(),
+		Shards:            shards,
+		Tiers:             d.tierStats(shards),
+		Mirror:            d.mirrorStats(),
+		Index:             d.IndexStats(),
+		SlowOps:           slowOps,
+		SlowOpsByOp:       slowOpsByOp,
+		Ops:               d.ops.snapshot(reset),
+	}
+}
+
+// IndexStats describes the in-memory B-tree
+type IndexStats struct {
+	Items  int `json:"items"` // keys in the tree, including expired ones not yet swept
+	Degree int `json:"degree"`
+
+	// Values held in the tree itself rather than only on disk. The tree
+	// keeps every value written with Put until the key is deleted.
+	ResidentValues int   `json:"resident_values"`
+	KeyBytes       int64 `json:"key_bytes"`
+	ValueBytes     int64 `json:"value_bytes"`
+
+	// ApproxBytes estimates the memory the tree holds: keys, values and a
+	// fixed overhead for each item
+	ApproxBytes int64 `json:"approx_bytes"`
+
+	// CachedBytes is the size of the values in the LRU cache, which may
+	// share memory with the tree's
+	CachedBytes int64 `json:"cached_bytes"`
+}
+
+// itemOverhead approximates the memory of an item apart from its key and
+// value: the struct, its content hash and its slot in a tree node
+const itemOverhead = 160
+
+// IndexStats returns the size of the in-memory index. It walks a clone of
+// the tree, so it does not block writers.
+func (d *Driver) IndexStats() IndexStats {
+	stats := IndexStats{Degree: d.degree, CachedBytes: d.CacheStats().Bytes}
+	d.snapshotTree().Ascend(func(i btree.Item) bool {
+		it := i.(*Item)
+		stats.Items++
+		stats.KeyBytes += int64(len(it.Key))
+		if it.Value != nil {
+			stats.ResidentValues++
+			stats.ValueBytes += int64(len(it.Value))
+		}
+		return true
+	})
+	stats.ApproxBytes = stats.KeyBytes + stats.ValueBytes + int64(stats.Items)*itemOverhead
+	return stats
+}
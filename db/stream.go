@@ -0,0 +1,383 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ValueReader streams a stored value. Callers must Close it when done.
+type ValueReader interface {
+	io.ReadSeekCloser
+	Size() int64
+	ModTime() time.Time // when the value was last written, zero when not known
+	ETag() string       // empty when the content hash is not known yet
+	Revision() uint64   // 0 when the key has none yet, as for a file the B-tree does not know
+}
+
+type fileValue struct {
+	*os.File
+	info    os.FileInfo
+	hash    string
+	rev     uint64
+	updated time.Time // the file's modification time when not recorded
+}
+
+func (f *fileValue) Size() int64        { return f.info.Size() }
+func (f *fileValue) ModTime() time.Time { return f.updated }
+func (f *fileValue) ETag() string       { return f.hash }
+func (f *fileValue) Revision() uint64   { return f.rev }
+
+type memValue struct {
+	*bytes.Reader
+	size    int64
+	hash    string
+	rev     uint64
+	updated time.Time
+}
+
+func (m *memValue) Size() int64        { return m.size }
+func (m *memValue) ModTime() time.Time { return m.updated }
+func (m *memValue) ETag() string       { return m.hash }
+func (m *memValue) Revision() uint64   { return m.rev }
+func (m *memValue) Close() error       { return nil }
+
+// GetReader returns a reader for the value of a key without loading the whole
+// value into memory. Values already held by the cache or the B-tree are served
+// from memory; everything else is read from disk.
+func (d *Driver) GetReader(key string) (ValueReader, error) {
+	return d.GetReaderContext(context.Background(), key)
+}
+
+// GetReaderContext is GetReader as part of the trace in ctx, returning
+// ctx's error when it is done before the value is opened. Reading the value
+// once it is returned does not watch ctx. A missing key is fetched with
+// Options.Loader as GetContext does.
+func (d *Driver) GetReaderContext(ctx context.Context, key string) (_ ValueReader, err error) {
+	defer d.ops.done(&d.ops.gets, 1, &err)
+	r, err := d.getReader(ctx, key)
+	if !errors.Is(err, ErrKeyNotFound) || d.loader == nil || ctx.Value(skipLoaderKey{}) != nil {
+		return r, err
+	}
+	value, err := d.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	// Read the stored value back for its revision, unless it was not stored
+	if r, err := d.getReader(ctx, key); !errors.Is(err, ErrKeyNotFound) {
+		return r, err
+	}
+	return &memValue{Reader: bytes.NewReader(value), size: int64(len(value)), hash: hashValue(value)}, nil
+}
+
+// getReader opens the value of key from memory or the disk
+func (d *Driver) getReader(ctx context.Context, key string) (ValueReader, error) {
+	start := time.Now()
+	if err := d.checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	t := d.startOp(ctx, "get", key)
+	defer d.finishOp(t)
+	d.rlock(t)
+	defer d.mutex.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	value, ok, err := d.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	var hash string
+	var rev uint64
+	var updated time.Time
+	if it, inTree := d.tree.Get(&Item{Key: key}).(*Item); inTree {
+		hash, rev, updated = it.Hash, it.Rev, unixTime(it.UpdatedAt)
+	}
+	if ok {
+		d.touch(key)
+		if hash == "" {
+			hash = hashValue(value)
+		}
+		t.addSize(int64(len(value)))
+		d.ops.bytesRead.Add(uint64(len(value)))
+		return &memValue{Reader: bytes.NewReader(value), size: int64(len(value)), hash: hash, rev: rev, updated: updated}, nil
+	}
+
+	// The file stays readable after the lock is released, even if a later Put
+	// renames a new version over it
+	ioStart := t.ioStart()
+	defer t.ioDone(ioStart)
+	f, err := os.Open(d.keyPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			d.logOp(LevelDebug, "get", key, start, "Get key not found: %s", key)
+			return nil, ErrKeyNotFound
+		}
+		d.log.Error("Failed to open file: %v", err)
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		d.log.Error("Failed to stat file: %v", err)
+		return nil, err
+	}
+	d.touch(key)
+	t.addSize(info.Size())
+	d.ops.readDisk(info.Size())
+	if updated.IsZero() {
+		updated = info.ModTime()
+	}
+
+	d.logOp(LevelInfo, "get", key, start, "Get key (stream): %s", key)
+	return &fileValue{File: f, info: info, hash: hash, rev: rev, updated: updated}, nil
+}
+
+// ctxReader fails reads once ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// PutReader stores the contents of r as the value for a key and reports
+// whether the key was created. The value is streamed to a temp file without
+// holding the driver lock, so only the final rename blocks other callers. If
+// reading r fails the previous value is left untouched and the read error is
+// returned wrapped.
+func (d *Driver) PutReader(key string, r io.Reader) (bool, error) {
+	return d.PutReaderWithTTL(key, r, 0)
+}
+
+// PutReaderWithTTL is PutReader for a key that expires after ttl. As with
+// PutWithTTL, a ttl of 0 gives it Options.DefaultTTL and NoTTL no expiry.
+func (d *Driver) PutReaderWithTTL(key string, r io.Reader, ttl time.Duration) (bool, error) {
+	return d.PutReaderContext(context.Background(), key, r, ttl)
+}
+
+// PutReaderContext is PutReaderWithTTL as part of the trace in ctx. When
+// ctx is done before the value is committed, streaming stops and its error
+// is returned with the previous value left untouched; once the value is
+// committed the write succeeds however late it is.
+func (d *Driver) PutReaderContext(ctx context.Context, key string, r io.Reader, ttl time.Duration) (bool, error) {
+	created, _, err := d.PutReaderIfRevision(ctx, key, r, ttl, AnyRevision)
+	return created, err
+}
+
+// PutReaderIfRevision is PutReaderContext storing the value only if the key
+// is at revision rev, as PutIfRevision does, or whatever its revision with
+// AnyRevision. It also returns the revision the key is left at. The revision
+// is checked once the value has streamed in.
+func (d *Driver) PutReaderIfRevision(ctx context.Context, key string, r io.Reader, ttl time.Duration, rev uint64) (bool, uint64, error) {
+	return d.putReader(ctx, key, r, ttl, func() error { return d.checkRevision(key, rev) })
+}
+
+// PutReaderIfMatch is PutReaderIfRevision storing the value only if the key
+// exists and its value has the ETag given, as DeleteIfMatch checks, failing
+// with ErrRevisionMismatch otherwise. With AnyETag it only has to exist.
+func (d *Driver) PutReaderIfMatch(ctx context.Context, key string, r io.Reader, ttl time.Duration, etag string) (bool, uint64, error) {
+	return d.putReader(ctx, key, r, ttl, func() error { return mustExist(d.checkETag(key, etag)) })
+}
+
+// PutReaderIfUnmodifiedSince is PutReaderIfRevision storing the value only
+// if the key exists and was last written no later than since, as
+// DeleteIfUnmodifiedSince checks, failing with ErrRevisionMismatch
+// otherwise
+func (d *Driver) PutReaderIfUnmodifiedSince(ctx context.Context, key string, r io.Reader, ttl time.Duration, since time.Time) (bool, uint64, error) {
+	return d.putReader(ctx, key, r, ttl, func() error { return mustExist(d.checkUnmodifiedSince(key, since)) })
+}
+
+// putReader streams the value of a key in, storing it if check, called
+// under the write lock once the value is in, returns nil
+func (d *Driver) putReader(ctx context.Context, key string, r io.Reader, ttl time.Duration, check func() error) (_ bool, _ uint64, err error) {
+	start := time.Now()
+	defer d.ops.done(&d.ops.puts, 1, &err)
+	if err := d.checkKey(key); err != nil {
+		return false, 0, err
+	}
+	if err := d.writable(); err != nil {
+		return false, 0, err
+	}
+	expiresAt, err := d.writeExpiry(ttl)
+	if err != nil {
+		return false, 0, err
+	}
+
+	// Pick the shard up front, since the temp file has to be on its disk
+	d.mutex.RLock()
+	dir, _ := d.writeDir(key)
+	d.mutex.RUnlock()
+	filePath := filepath.Join(dir, d.fileName(key))
+
+	// The temp file is not named after the key, whose file name may already
+	// be as long as the file system allows
+	temp, err := os.CreateTemp(dir, "upload.*.tmp")
+	if err != nil {
+		d.log.Error("Failed to create temp file: %v", err)
+		return false, 0, err
+	}
+	tempPath := temp.Name()
+
+	// CreateTemp makes the file readable by its owner only; values get the
+	// mode Put writes them with
+	if err := temp.Chmod(0644); err != nil {
+		temp.Close()
+		os.Remove(tempPath)
+		d.log.Error("Failed to set the mode of temp file: %v", err)
+		return false, 0, err
+	}
+
+	// Keep Compact from removing the temp file while it is being written
+	d.uploads.Store(tempPath, struct{}{})
+	defer d.uploads.Delete(tempPath)
+
+	// Hash the value on its way to disk so Stat never has to read it back
+	hash := newHasher()
+	r = &ctxReader{ctx: ctx, r: r}
+	if d.maxValue > 0 {
+		// Read one byte past the limit to tell a value at it from a larger one
+		r = io.LimitReader(r, d.maxValue+1)
+	}
+	size, err := io.Copy(io.MultiWriter(temp, hash), r)
+	if err == nil {
+		err = d.checkSize(key, size)
+	}
+	if err != nil {
+		temp.Close()
+		os.Remove(tempPath)
+		d.noteWriteError(err)
+		if errors.Is(err, ErrValueTooLarge) || ctx.Err() != nil {
+			return false, 0, err
+		}
+		return false, 0, fmt.Errorf("failed to write value for %s: %w", key, err)
+	}
+
+	// Only committing the value is timed, since streaming it in is paced by
+	// the caller
+	t := d.startOp(ctx, "put", key)
+	defer d.finishOp(t)
+	t.addSize(size)
+
+	ioStart := t.ioStart()
+	err = temp.Close()
+	t.ioDone(ioStart)
+	if err != nil {
+		os.Remove(tempPath)
+		d.log.Error("Failed to close temp file: %v", err)
+		return false, 0, d.noteWriteError(err)
+	}
+
+	// A value under a schema has to be read back to be checked
+	if _, s := d.schemaFor(key); s != nil {
+		value, err := os.ReadFile(tempPath)
+		if err == nil {
+			err = d.checkSchema(key, value)
+		}
+		if err != nil {
+			os.Remove(tempPath)
+			return false, 0, err
+		}
+	}
+
+	d.lock(t)
+	defer d.unlock()
+	if err := d.checkOpen(); err != nil {
+		os.Remove(tempPath)
+		return false, 0, err
+	}
+	// The last chance to give up, as the lock may have taken long to get
+	if err := ctx.Err(); err != nil {
+		os.Remove(tempPath)
+		return false, 0, err
+	}
+	if err := check(); err != nil {
+		os.Remove(tempPath)
+		return false, 0, err
+	}
+	usage, err := d.usageChange(key, size)
+	if err == nil {
+		err = d.checkQuota(key, usage)
+	}
+	if err == nil {
+		err = d.checkNewKey(key)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return false, 0, err
+	}
+
+	ioStart = t.ioStart()
+	existing, ok := d.tree.Get(&Item{Key: key}).(*Item)
+	expired := ok && existing.expired(time.Now())
+	created := !ok || expired
+	current := d.keyPath(key)
+	if created && !expired {
+		if _, err := os.Stat(current); err == nil {
+			created = false
+		}
+	}
+
+	newRev, err := d.nextRev()
+	if err != nil {
+		os.Remove(tempPath)
+		return false, 0, err
+	}
+	sum := hash.sum()
+	d.retain(key)
+	if err := d.placeValue(tempPath, filePath, sum, size); err != nil {
+		os.Remove(tempPath)
+		d.log.Error("Failed to rename temp file: %v", err)
+		return false, 0, err
+	}
+	if err := d.failpoint(fpRenamed); err != nil {
+		return false, 0, err
+	}
+	d.ops.bytesWritten.Add(uint64(size))
+	d.forgetDirty(key)
+
+	// The key may have been in the cold tier, or a Rebalance may have moved
+	// it while the value streamed in
+	if current != filePath {
+		os.Remove(current)
+	}
+	t.ioDone(ioStart)
+
+	// The value is not kept in memory; Get will load it from disk on demand
+	d.cache.Remove(key)
+	item := &Item{Key: key, ExpiresAt: expiresAt, Hash: sum, Dir: dir, Rev: newRev}
+	item.stamp(existing, ok && !expired, created)
+	d.tree.ReplaceOrInsert(item)
+	if expired {
+		d.unindexLabels(existing)
+	}
+	d.indexExpiry(key, expiryOf(existing), expiresAt)
+	d.applyUsage(usage)
+	if ok && existing.Hash != sum {
+		d.releaseBlob(existing.Hash)
+	}
+
+	if expired {
+		d.reportExpired(existing)
+	}
+	d.record(OpPut, key, nil, sum, expiresAt)
+	d.notify(OpPut, key, nil, expiresAt)
+	d.logOp(LevelInfo, "put", key, start, "Put key (stream): %s", key)
+	return created, newRev, d.mirrorLocked(OpPut, key, nil, expiresAt)
+}
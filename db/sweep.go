@@ -0,0 +1,212 @@
+package db
+
+import (
+	"os"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// defaultSweepBatch is how many expired keys a sweep removes at a time when
+// Options.SweepBatch is not set
+const defaultSweepBatch = 100
+
+// expiryEntry indexes a key by when it expires. Only keys with an expiry
+// have one, and it is moved or dropped whenever the key's expiry changes or
+// the key goes.
+type expiryEntry struct {
+	at  int64 // unix nanoseconds
+	key string
+}
+
+// Less orders entries by expiry, then key
+func (e *expiryEntry) Less(than btree.Item) bool {
+	o := than.(*expiryEntry)
+	if e.at != o.at {
+		return e.at < o.at
+	}
+	return e.key < o.key
+}
+
+// indexExpiry records that a key which expired at was, 0 for never or a key
+// that did not exist, now expires at expiresAt, 0 for never. The caller must
+// hold the write lock.
+func (d *Driver) indexExpiry(key string, was, expiresAt int64) {
+	if was == expiresAt {
+		return
+	}
+	if was != 0 {
+		d.expiries.Delete(&expiryEntry{at: was, key: key})
+	}
+	if expiresAt != 0 {
+		d.expiries.ReplaceOrInsert(&expiryEntry{at: expiresAt, key: key})
+	}
+}
+
+// expiryOf returns when an item expires, 0 for a nil item
+func expiryOf(it *Item) int64 {
+	if it == nil {
+		return 0
+	}
+	return it.ExpiresAt
+}
+
+// indexExpiries rebuilds the expiry index from the B-tree. The caller must
+// hold the write lock.
+func (d *Driver) indexExpiries() {
+	d.expiries.Clear(false)
+	d.tree.Ascend(func(i btree.Item) bool {
+		it := i.(*Item)
+		d.indexExpiry(it.Key, 0, it.ExpiresAt)
+		return true
+	})
+}
+
+// ExpiringKey is a key reported by ExpiringWithin and how long it has left
+type ExpiringKey struct {
+	Key string
+	TTL time.Duration
+}
+
+// ExpiringWithin returns up to limit keys that expire within d from now,
+// soonest first, with their remaining time-to-live. Keys already expired
+// but not yet swept are left out, as are keys without an expiry, which cost
+// nothing here as only keys with one are indexed. A limit of 0 or less
+// returns them all.
+func (d *Driver) ExpiringWithin(within time.Duration, limit int) ([]ExpiringKey, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	now := time.Now().UnixNano()
+	until := now + int64(within)
+	keys := []ExpiringKey{}
+	d.expiries.AscendGreaterOrEqual(&expiryEntry{at: now + 1}, func(i btree.Item) bool {
+		e := i.(*expiryEntry)
+		if e.at > until || (limit > 0 && len(keys) == limit) {
+			return false
+		}
+		keys = append(keys, ExpiringKey{Key: e.key, TTL: time.Duration(e.at - now)})
+		return true
+	})
+	return keys, nil
+}
+
+// sweepLoop removes expired keys every interval until Close
+func (d *Driver) sweepLoop(every time.Duration, batch, rate int) {
+	defer d.background.Done()
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		d.sweep(batch, rate)
+	}
+}
+
+// sweep removes every key that has expired, batch keys under the write lock
+// at a time, and at most rate keys a second when rate is above 0
+func (d *Driver) sweep(batch, rate int) {
+	for {
+		removed, more := d.sweepBatch(batch)
+		if !more {
+			return
+		}
+		if rate <= 0 {
+			continue
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-time.After(time.Duration(removed) * time.Second / time.Duration(rate)):
+		}
+	}
+}
+
+// sweepBatch removes up to batch expired keys, with delete events for their
+// watchers, and reports whether more may be due. Replicas leave expired
+// keys to the deletes their primary sends and only drop the entries.
+func (d *Driver) sweepBatch(batch int) (int, bool) {
+	d.mutex.Lock()
+	defer d.unlock()
+	if d.closed.Load() {
+		return 0, false
+	}
+
+	now := time.Now().UnixNano()
+	var due []*expiryEntry
+	d.expiries.Ascend(func(i btree.Item) bool {
+		e := i.(*expiryEntry)
+		if e.at > now || len(due) == batch {
+			return false
+		}
+		due = append(due, e)
+		return true
+	})
+
+	removed, failed := 0, 0
+	for _, e := range due {
+		d.expiries.Delete(e)
+		if d.ReadOnly() {
+			continue
+		}
+		it, ok := d.tree.Get(&Item{Key: e.key}).(*Item)
+		if !ok || it.ExpiresAt != e.at {
+			continue // deleted or given another expiry since
+		}
+		if err := d.expireLocked(it); err != nil {
+			d.log.Error("Failed to remove expired key %s, retrying on the next sweep: %v", e.key, err)
+			d.expiries.ReplaceOrInsert(e)
+			failed++
+			continue
+		}
+		removed++
+	}
+
+	d.expiredSwept.Add(uint64(removed))
+	if removed > 0 {
+		d.log.Debug("Swept %d expired keys", removed)
+	}
+	return removed, len(due) == batch && failed < len(due)
+}
+
+// expireLocked removes an expired key and tells watchers and replicas it
+// expired. The caller must hold the write lock.
+func (d *Driver) expireLocked(it *Item) error {
+	usage, err := d.usageChange(it.Key, -1)
+	if err != nil {
+		return err
+	}
+	d.retain(it.Key)
+	if err := os.Remove(d.keyPath(it.Key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	d.tree.Delete(it)
+	d.indexExpiry(it.Key, it.ExpiresAt, 0)
+	d.unindexLabels(it)
+	d.cache.Remove(it.Key)
+	d.forgetDirty(it.Key)
+	d.applyUsage(usage)
+	d.releaseBlob(it.Hash)
+
+	d.reportExpired(it)
+	d.logOp(LevelDebug, "expire", it.Key, time.Time{}, "Removed expired key: %s", it.Key)
+	return nil
+}
+
+// reportExpired records an OpExpire for an expired item that was just
+// removed, or replaced by a write, carrying the expiry that passed, and tells
+// watchers and the mirror, which is only logged when it fails. It is called before any change that re-creates the key, so the
+// expiry is always seen first. The caller must hold the write lock.
+func (d *Driver) reportExpired(it *Item) {
+	d.record(OpExpire, it.Key, nil, "", it.ExpiresAt)
+	d.notify(OpExpire, it.Key, nil, it.ExpiresAt)
+	d.mirrorLocked(OpExpire, it.Key, nil, it.ExpiresAt)
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrNoTextIndex is returned by Search when EnableTextIndex has not been
+// called
+var ErrNoTextIndex = errors.New("no text index")
+
+// textIndex maps the words of chosen JSON string fields to the keys holding
+// them
+type textIndex struct {
+	fields   [][]string                // paths into the JSON values, split at dots
+	postings map[string]map[string]int // term to key to occurrences
+	terms    map[string][]string       // key to its terms, to remove its postings
+	postingN int                       // entries across postings
+}
+
+// TextIndexStats describes the text index
+type TextIndexStats struct {
+	Fields   []string `json:"fields"`
+	Keys     int      `json:"keys"`     // keys with at least one term
+	Terms    int      `json:"terms"`    // distinct terms
+	Postings int      `json:"postings"` // term and key pairs
+}
+
+// tokenize lowercases text and splits it into words of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// EnableTextIndex indexes the words in the given fields of JSON values, so
+// that Search can find the keys holding them. A field names a string member
+// of the top-level object, or a nested one as in "author.name"; values that
+// are not JSON objects, and fields that are missing or not strings, are left
+// out. The index is built from the values stored and then kept up to date
+// by every write, delete and expiry. It is held in memory only, so call
+// EnableTextIndex again after each Open. No fields turns the index off.
+func (d *Driver) EnableTextIndex(fields []string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		d.indexMu.Lock()
+		d.text = nil
+		d.indexMu.Unlock()
+		d.log.Info("Turned the text index off")
+		return nil
+	}
+
+	start := time.Now()
+	idx := &textIndex{postings: make(map[string]map[string]int), terms: make(map[string][]string)}
+	for _, f := range fields {
+		idx.fields = append(idx.fields, strings.Split(f, "."))
+	}
+	err := d.scanDocs(func(key string, doc map[string]interface{}) {
+		idx.add(key, doc)
+	})
+	if err != nil {
+		return err
+	}
+
+	d.indexMu.Lock()
+	d.text = idx
+	d.indexMu.Unlock()
+	d.log.Info("Built the text index over %s: %d terms in %d keys in %s", strings.Join(fields, ", "), len(idx.postings), len(idx.terms), time.Since(start))
+	return nil
+}
+
+// add indexes the words of a JSON object, which must not be indexed already
+func (idx *textIndex) add(key string, doc map[string]interface{}) {
+	counts := make(map[string]int)
+	for _, path := range idx.fields {
+		if s, ok := fieldValue(doc, path).(string); ok {
+			for _, term := range tokenize(s) {
+				counts[term]++
+			}
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+
+	terms := make([]string, 0, len(counts))
+	for term, n := range counts {
+		keys, ok := idx.postings[term]
+		if !ok {
+			keys = make(map[string]int)
+			idx.postings[term] = keys
+		}
+		keys[key] = n
+		terms = append(terms, term)
+	}
+	idx.terms[key] = terms
+	idx.postingN += len(terms)
+}
+
+// remove drops a key's postings
+func (idx *textIndex) remove(key string) {
+	for _, term := range idx.terms[key] {
+		delete(idx.postings[term], key)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	idx.postingN -= len(idx.terms[key])
+	delete(idx.terms, key)
+}
+
+// Search returns up to limit keys whose indexed fields hold every word of
+// query, those where the words occur most often first and ties in key
+// order. Words are matched whole and regardless of case. A limit <= 0
+// returns every match. It fails with ErrNoTextIndex unless EnableTextIndex
+// was called.
+func (d *Driver) Search(query string, limit int) ([]string, error) {
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+	terms := tokenize(query)
+
+	type match struct {
+		key   string
+		score int
+	}
+	var matches []match
+	d.indexMu.RLock()
+	if d.text == nil {
+		d.indexMu.RUnlock()
+		return nil, ErrNoTextIndex
+	}
+	if len(terms) > 0 {
+		// Start from the term with the fewest keys and narrow down
+		sort.Slice(terms, func(i, j int) bool { return len(d.text.postings[terms[i]]) < len(d.text.postings[terms[j]]) })
+		for key, n := range d.text.postings[terms[0]] {
+			score := n
+			for _, term := range terms[1:] {
+				m, ok := d.text.postings[term][key]
+				if !ok {
+					score = 0
+					break
+				}
+				score += m
+			}
+			if score > 0 {
+				matches = append(matches, match{key, score})
+			}
+		}
+	}
+	d.indexMu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].key < matches[j].key
+	})
+
+	keys := make([]string, len(matches))
+	for i, m := range matches {
+		keys[i] = m.key
+	}
+	return d.unexpired(keys, limit), nil
+}
+
+// textIndexStats describes the text index, nil when there is none
+func (d *Driver) textIndexStats() *TextIndexStats {
+	d.indexMu.RLock()
+	defer d.indexMu.RUnlock()
+	if d.text == nil {
+		return nil
+	}
+	stats := &TextIndexStats{Keys: len(d.text.terms), Terms: len(d.text.postings), Postings: d.text.postingN}
+	for _, path := range d.text.fields {
+		stats.Fields = append(stats.Fields, strings.Join(path, "."))
+	}
+	return stats
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// promotionQueue is how many keys read from the cold tier may wait to be
+// promoted; reads past that are not queued, and promote on a later read
+const promotionQueue = 256
+
+// demoteInterval returns how often keys are checked for demotion: a tenth of
+// Options.DemoteAfter, but at least every minute
+func demoteInterval(after time.Duration) time.Duration {
+	every := after / 10
+	if every > time.Minute {
+		every = time.Minute
+	}
+	if every < time.Millisecond {
+		every = time.Millisecond
+	}
+	return every
+}
+
+// TierStats describes the hot and cold tiers of Options.ColdDir
+type TierStats struct {
+	Hot      TierUsage `json:"hot"`
+	Cold     TierUsage `json:"cold"`
+	Demoted  uint64    `json:"demoted"`  // keys moved to the cold tier
+	Promoted uint64    `json:"promoted"` // keys moved back when read
+}
+
+// TierUsage is what one tier holds
+type TierUsage struct {
+	Keys  int   `json:"keys"`  // key files
+	Bytes int64 `json:"bytes"` // size of the key files
+}
+
+// tierStats sums the directories of each tier, nil without a cold tier
+func (d *Driver) tierStats(shards []ShardStats) *TierStats {
+	if d.cold == "" {
+		return nil
+	}
+	stats := &TierStats{Demoted: d.demoted.Load(), Promoted: d.promoted.Load()}
+	for _, shard := range shards {
+		tier := &stats.Hot
+		if shard.Cold {
+			tier = &stats.Cold
+		}
+		tier.Keys += shard.Files
+		tier.Bytes += shard.Bytes
+	}
+	return stats
+}
+
+// writeDir returns the directory a write of key goes to: the one holding
+// it, unless that is the cold tier, since writes land hot. stale is then
+// the file in the cold tier to remove once the write is done. The caller
+// must hold the mutex.
+func (d *Driver) writeDir(key string) (dir, stale string) {
+	dir = d.shardFor(key)
+	if d.cold == "" || dir != d.cold {
+		return dir, ""
+	}
+	d.forgetAccess(key)
+	return d.ring.owner(key), filepath.Join(dir, d.fileName(key))
+}
+
+// removeStale removes the file a write moved a key out of the cold tier
+// from, as returned by writeDir
+func (d *Driver) removeStale(stale string) {
+	if stale == "" {
+		return
+	}
+	if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+		d.log.Error("Failed to remove the cold copy of a rewritten key: %v", err)
+	}
+}
+
+// touch records that a key was read, for demotion, and queues it for
+// promotion when it is in the cold tier. The caller must hold the mutex.
+func (d *Driver) touch(key string) {
+	if d.cold == "" {
+		return
+	}
+	d.accessMu.Lock()
+	d.accessed[key] = time.Now().UnixNano()
+	d.accessMu.Unlock()
+
+	if d.promotions == nil {
+		return
+	}
+	if it, ok := d.tree.Get(&Item{Key: key}).(*Item); ok && it.Dir == d.cold {
+		select {
+		case d.promotions <- key:
+		default:
+		}
+	}
+}
+
+// forgetAccess drops the last read of a key deleted or moved out of the
+// cold tier
+func (d *Driver) forgetAccess(key string) {
+	if d.cold == "" {
+		return
+	}
+	d.accessMu.Lock()
+	delete(d.accessed, key)
+	d.accessMu.Unlock()
+}
+
+// lastUsed returns when an item was last read or written, or when the
+// driver was opened if later, since reads before that are not known
+func (d *Driver) lastUsed(it *Item) int64 {
+	used := max(it.UpdatedAt, d.opened)
+	d.accessMu.Lock()
+	defer d.accessMu.Unlock()
+	return max(used, d.accessed[it.Key])
+}
+
+// Demote moves the keys not read or written for Options.DemoteAfter to
+// Options.ColdDir and returns how many it moved. It runs in the
+// background every tenth of DemoteAfter, at least every minute; each key is
+// moved under the write lock, so readers find it in one place or the other.
+func (d *Driver) Demote(ctx context.Context) (int, error) {
+	if d.cold == "" || d.demoteAfter == 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-d.demoteAfter).UnixNano()
+
+	// Reads older than the cutoff no longer matter
+	d.accessMu.Lock()
+	for key, at := range d.accessed {
+		if at < cutoff {
+			delete(d.accessed, key)
+		}
+	}
+	d.accessMu.Unlock()
+
+	var idle []string
+	now := time.Now()
+	d.snapshotTree().Ascend(func(i btree.Item) bool {
+		it := i.(*Item)
+		if it.Dir != d.cold && !it.expired(now) && d.lastUsed(it) < cutoff {
+			idle = append(idle, it.Key)
+		}
+		return true
+	})
+
+	moved := 0
+	for _, key := range idle {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+		ok, err := d.demote(key, cutoff)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+	if moved > 0 {
+		d.log.Info("Moved %d keys unused for %s to the cold tier", moved, d.demoteAfter)
+	}
+	return moved, nil
+}
+
+// demote moves a key to the cold tier if it is still in the hot one and has
+// not been used since cutoff
+func (d *Driver) demote(key string, cutoff int64) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkOpen(); err != nil {
+		return false, err
+	}
+	it, ok := d.tree.Get(&Item{Key: key}).(*Item)
+	if !ok || it.Dir == d.cold || d.lastUsed(it) >= cutoff {
+		return false, nil
+	}
+	moved, err := d.moveLocked(key, d.shardFor(key), d.cold)
+	if moved {
+		d.demoted.Add(1)
+	}
+	return moved, err
+}
+
+// promote moves a key read from the cold tier back to the shard the ring
+// places it on
+func (d *Driver) promote(key string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.checkOpen() != nil {
+		return
+	}
+	it, ok := d.tree.Get(&Item{Key: key}).(*Item)
+	if !ok || it.Dir != d.cold {
+		return
+	}
+	moved, err := d.moveLocked(key, d.cold, d.ring.owner(key))
+	if err != nil {
+		d.log.Error("Failed to promote %s from the cold tier: %v", key, err)
+		return
+	}
+	if moved {
+		d.promoted.Add(1)
+	}
+}
+
+// demoteLoop demotes idle keys every interval until Close
+func (d *Driver) demoteLoop(every time.Duration) {
+	defer d.background.Done()
+
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		if _, err := d.Demote(context.Background()); err != nil && !d.closed.Load() {
+			d.log.Error("Failed to demote keys to the cold tier: %v", err)
+		}
+	}
+}
+
+// promoteLoop promotes the keys read from the cold tier until Close
+func (d *Driver) promoteLoop() {
+	defer d.background.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case key := <-d.promotions:
+			d.promote(key)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans the driver creates
+const tracerName = "github.com/toblrne/ZephyrusDBv2/db"
+
+func keyAttr(key string) attribute.KeyValue {
+	return attribute.String("zephyrus.key", key)
+}
+
+func sizeAttr(size int64) attribute.KeyValue {
+	return attribute.Int64("zephyrus.size", size)
+}
+
+// lockAttr tells a wait for the read lock from one for the write lock
+func lockAttr(mode string) attribute.KeyValue {
+	return attribute.String("zephyrus.lock", mode)
+}
+
+// child starts a span for one phase of a traced operation, returning nil when
+// t is not traced
+func (t *opTimer) child(name string, attrs ...attribute.KeyValue) trace.Span {
+	if t.span == nil {
+		return nil
+	}
+	_, span := t.tracer.Start(t.ctx, name, trace.WithAttributes(attrs...))
+	return span
+}
+
+// endSpan ends span unless it is nil
+func endSpan(span trace.Span) {
+	if span != nil {
+		span.End()
+	}
+}
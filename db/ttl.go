@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// NoTTL is reported by TTL for keys that never expire. Given as the TTL of a
+// write, it stores the key without an expiry even with Options.DefaultTTL.
+const NoTTL time.Duration = -1
+
+// ErrInvalidTTL is returned for negative time-to-live values
+var ErrInvalidTTL = errors.New("ttl must not be negative")
+
+// expiryFor converts a ttl into an absolute expiry in unix nanoseconds, 0
+// for a ttl of 0 or NoTTL
+func expiryFor(ttl time.Duration) (int64, error) {
+	if ttl < 0 && ttl != NoTTL {
+		return 0, ErrInvalidTTL
+	}
+	if ttl <= 0 {
+		return 0, nil
+	}
+	return time.Now().Add(ttl).UnixNano(), nil
+}
+
+// writeExpiry is expiryFor for a write, where a ttl of 0 stands for
+// Options.DefaultTTL
+func (d *Driver) writeExpiry(ttl time.Duration) (int64, error) {
+	if ttl == 0 {
+		ttl = d.defaultTTL
+	}
+	return expiryFor(ttl)
+}
+
+// expired reports whether the item carries an expiry that has passed
+func (i *Item) expired(now time.Time) bool {
+	return i.ExpiresAt != 0 && now.UnixNano() >= i.ExpiresAt
+}
+
+// Expire sets or changes the time-to-live of an existing key. A ttl of 0
+// removes the expiry so the key is kept until deleted.
+func (d *Driver) Expire(key string, ttl time.Duration) error {
+	start := time.Now()
+	if err := d.checkKey(key); err != nil {
+		return err
+	}
+	if err := d.writable(); err != nil {
+		return err
+	}
+	expiresAt, err := expiryFor(ttl)
+	if err != nil {
+		return err
+	}
+
+	t := d.startOp(context.Background(), "expire", key)
+	defer d.finishOp(t)
+	d.lock(t)
+	defer d.mutex.Unlock()
+
+	existing, ok := d.tree.Get(&Item{Key: key}).(*Item)
+	if ok && existing.expired(time.Now()) {
+		return ErrKeyNotFound
+	}
+
+	// Keys that were never loaded get a non-resident entry to carry the expiry
+	updated := &Item{Key: key, ExpiresAt: expiresAt}
+	if ok {
+		updated.Value = existing.Value
+		updated.Hash = existing.Hash
+		updated.Dir = existing.Dir
+		updated.CreatedAt, updated.UpdatedAt = existing.CreatedAt, existing.UpdatedAt
+		updated.Labels = existing.Labels
+	} else {
+		ioStart := t.ioStart()
+		_, err := os.Stat(d.keyPath(key))
+		t.ioDone(ioStart)
+		if os.IsNotExist(err) {
+			return ErrKeyNotFound
+		}
+		if err != nil {
+			d.log.Error("Failed to stat file: %v", err)
+			return err
+		}
+	}
+
+	if updated.Rev, err = d.nextRev(); err != nil {
+		return err
+	}
+
+	// Items are replaced rather than modified so readers never see a partial update
+	d.tree.ReplaceOrInsert(updated)
+	d.indexExpiry(key, expiryOf(existing), expiresAt)
+	d.record(OpPut, key, updated.Value, updated.Hash, expiresAt)
+	d.logOp(LevelInfo, "expire", key, start, "Set TTL of key %s to %s", key, ttl)
+	return d.mirrorLocked(OpPut, key, updated.Value, expiresAt)
+}
+
+// TTL returns the remaining time-to-live of a key, or NoTTL when the key does
+// not expire
+func (d *Driver) TTL(key string) (time.Duration, error) {
+	if err := d.checkKey(key); err != nil {
+		return 0, err
+	}
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if existing, ok := d.tree.Get(&Item{Key: key}).(*Item); ok {
+		now := time.Now()
+		if existing.expired(now) {
+			return 0, ErrKeyNotFound
+		}
+		if existing.ExpiresAt == 0 {
+			return NoTTL, nil
+		}
+		return time.Duration(existing.ExpiresAt - now.UnixNano()), nil
+	}
+
+	if _, err := os.Stat(d.keyPath(key)); err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrKeyNotFound
+		}
+		d.log.Error("Failed to stat file: %v", err)
+		return 0, err
+	}
+	return NoTTL, nil
+}
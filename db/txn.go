@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/google/btree"
+)
+
+// ErrTxnDone is returned by the methods of a ReadTxn used after the callback
+// it was passed to returned
+var ErrTxnDone = errors.New("read transaction is done")
+
+// ReadTxn reads the store as it was when the transaction started, however
+// it is written to meanwhile. It is only valid inside the callback passed to
+// Driver.ReadTxn and must not be used by several goroutines at once.
+type ReadTxn struct {
+	d    *Driver
+	tree *btree.BTree // clone of the B-tree taken when the transaction started
+	at   time.Time    // keys expired at this time are left out
+
+	// retained holds the values of keys that were not resident in tree and
+	// whose files writers have since replaced or removed, nil for keys that
+	// had no file. It is guarded by the driver's mutex.
+	retained map[string][]byte
+}
+
+// ReadTxn calls fn with a transaction whose reads all see the store at the
+// same point in time, so related keys can be read consistently while writes
+// continue. The transaction works on a copy-on-write clone of the index, so
+// writers are not held up while fn runs; values that only live on disk and
+// are overwritten or deleted before fn reads them are kept aside for it. The
+// clone and those values are released as soon as fn returns. ReadTxn
+// returns fn's error.
+func (d *Driver) ReadTxn(fn func(tx *ReadTxn) error) error {
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+
+	// The clone is registered under the write lock, so no write can slip in
+	// between it being taken and writers knowing to keep values for it
+	tx := &ReadTxn{d: d, retained: make(map[string][]byte)}
+	d.mutex.Lock()
+	tx.tree, tx.at = d.tree.Clone(), time.Now()
+	d.txnMu.Lock()
+	d.txns[tx] = struct{}{}
+	d.txnMu.Unlock()
+	d.mutex.Unlock()
+
+	defer func() {
+		d.txnMu.Lock()
+		delete(d.txns, tx)
+		d.txnMu.Unlock()
+		d.mutex.Lock()
+		tx.tree, tx.retained = nil, nil
+		d.mutex.Unlock()
+	}()
+	return fn(tx)
+}
+
+// retain keeps the file of key for the open transactions whose clone holds
+// it without its value, before a writer replaces or removes the file. The
+// caller must hold the write lock.
+func (d *Driver) retain(key string) {
+	d.txnMu.Lock()
+	defer d.txnMu.Unlock()
+
+	var value []byte
+	loaded := false
+	for tx := range d.txns {
+		it, ok := tx.tree.Get(&Item{Key: key}).(*Item)
+		if !ok || it.Value != nil || it.expired(tx.at) {
+			continue
+		}
+		if _, done := tx.retained[key]; done {
+			continue
+		}
+		if !loaded {
+			var err error
+			if value, err = os.ReadFile(d.keyPath(key)); err != nil && !os.IsNotExist(err) {
+				d.log.Error("Failed to keep %s for a read transaction: %v", key, err)
+			}
+			loaded = true
+		}
+		tx.retained[key] = value
+	}
+}
+
+// Get returns the value key had when the transaction started
+func (tx *ReadTxn) Get(key string) ([]byte, error) {
+	if err := tx.d.checkKey(key); err != nil {
+		return nil, err
+	}
+	if tx.tree == nil {
+		return nil, ErrTxnDone
+	}
+	it, ok := tx.tree.Get(&Item{Key: key}).(*Item)
+	if !ok || it.expired(tx.at) {
+		return nil, ErrKeyNotFound
+	}
+	if it.Value != nil {
+		return it.Value, nil
+	}
+	return tx.load(key)
+}
+
+// load reads the value of a key that was not resident in the clone, from
+// the values kept aside for the transaction or else from its file, which
+// no writer has touched since the transaction started
+func (tx *ReadTxn) load(key string) ([]byte, error) {
+	d := tx.d
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if err := d.checkOpen(); err != nil {
+		return nil, err
+	}
+	if value, ok := tx.retained[key]; ok {
+		if value == nil {
+			return nil, ErrKeyNotFound
+		}
+		return value, nil
+	}
+	value, err := os.ReadFile(d.keyPath(key))
+	if os.IsNotExist(err) {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		d.log.Error("Failed to read file: %v", err)
+		return nil, err
+	}
+	return value, nil
+}
+
+// List is Driver.List as of the start of the transaction
+func (tx *ReadTxn) List(ctx context.Context, prefix, after string, limit int) ([]string, error) {
+	if tx.tree == nil {
+		return nil, ErrTxnDone
+	}
+	start := prefix
+	if after > start {
+		start = after
+	}
+
+	keys := []string{}
+	err := ascendPrefixAt(ctx, tx.tree, prefix, start, tx.at, func(it *Item) bool {
+		if it.Key == after || Reserved(it.Key) {
+			return true
+		}
+		keys = append(keys, it.Key)
+		return limit <= 0 || len(keys) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Range calls fn with every key starting with prefix and its value, in key
+// order and as of the start of the transaction, until fn returns false. It
+// returns ctx's error if ctx is done first, or the error of a value that
+// cannot be read.
+func (tx *ReadTxn) Range(ctx context.Context, prefix string, fn func(key string, value []byte) bool) error {
+	if tx.tree == nil {
+		return ErrTxnDone
+	}
+	var readErr error
+	err := ascendPrefixAt(ctx, tx.tree, prefix, prefix, tx.at, func(it *Item) bool {
+		if Reserved(it.Key) {
+			return true
+		}
+		value := it.Value
+		if value == nil {
+			if value, readErr = tx.load(it.Key); readErr != nil {
+				return false
+			}
+		}
+		return fn(it.Key, value)
+	})
+	if err != nil {
+		return err
+	}
+	return readErr
+}
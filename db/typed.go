@@ -0,0 +1,27 @@
+package db
+
+import "fmt"
+
+// GetAs reads the value of key and decodes it from JSON into a T. A missing
+// key returns ErrKeyNotFound; a value that is not JSON for a T returns an
+// error naming the key.
+func GetAs[T any](d *Driver, key string) (T, error) {
+	var v T
+	data, err := d.Get(key)
+	if err != nil {
+		return v, err
+	}
+	if err := UnmarshalJson(data, &v); err != nil {
+		return v, fmt.Errorf("decoding the value of %s: %w", key, err)
+	}
+	return v, nil
+}
+
+// PutAs encodes v as JSON and stores it as the value of key
+func PutAs[T any](d *Driver, key string, v T) error {
+	data, err := MarshalJson(v)
+	if err != nil {
+		return fmt.Errorf("encoding the value of %s: %w", key, err)
+	}
+	return d.Put(key, data)
+}
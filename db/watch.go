@@ -0,0 +1,131 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Op identifies the kind of change carried by an Event
+type Op string
+
+const (
+	OpPut    Op = "put"
+	OpDelete Op = "delete"
+	OpExpire Op = "expire" // a key removed because its expiry passed
+)
+
+// watchBuffer is how many events a watcher may fall behind before it is closed
+const watchBuffer = 256
+
+// ErrWatchOverflow is reported by Watcher.Err when the watcher fell too far
+// behind and was closed so it could not stall writers
+var ErrWatchOverflow = errors.New("watcher fell behind and was closed")
+
+// Event describes a change to a key. Value holds the new value of a put when
+// it is in memory; values written with PutReader are not included.
+// ExpiresAt is the new expiry of a put and, for an expire, the expiry that
+// passed; it is zero for none.
+type Event struct {
+	Op        Op
+	Key       string
+	Value     []byte
+	ExpiresAt time.Time
+	Time      time.Time
+}
+
+// Watcher receives the events for keys matching a prefix
+type Watcher struct {
+	prefix string
+	events chan Event
+	driver *Driver
+	once   sync.Once
+	err    error
+}
+
+// Events returns the channel events are delivered on. It is closed when the
+// watcher is closed.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err reports why the watcher was closed by the driver, if it was
+func (w *Watcher) Err() error {
+	w.driver.watchMu.Lock()
+	defer w.driver.watchMu.Unlock()
+	return w.err
+}
+
+// Close unsubscribes the watcher. It is safe to call more than once.
+func (w *Watcher) Close() {
+	w.driver.watchMu.Lock()
+	defer w.driver.watchMu.Unlock()
+	w.closeLocked(nil)
+}
+
+func (w *Watcher) closeLocked(err error) {
+	w.once.Do(func() {
+		w.err = err
+		delete(w.driver.watchers, w)
+		close(w.events)
+	})
+}
+
+// Watch subscribes to Put and Delete events for keys starting with prefix,
+// and to an OpExpire for each such key removed because it expired. An
+// expired key is removed by the sweeper, or by the next Delete or write of
+// it, never by a Get. An empty prefix matches every key. Events are
+// delivered in the order the operations were applied, so an expiry comes
+// before the put that re-creates the key. A watcher that stops draining its channel is
+// closed with ErrWatchOverflow rather than blocking writers.
+func (d *Driver) Watch(prefix string) *Watcher {
+	w := &Watcher{
+		prefix: prefix,
+		events: make(chan Event, watchBuffer),
+		driver: d,
+	}
+
+	d.watchMu.Lock()
+	defer d.watchMu.Unlock()
+	if d.watchers == nil {
+		d.watchers = make(map[*Watcher]struct{})
+	}
+	d.watchers[w] = struct{}{}
+
+	return w
+}
+
+// notify delivers an event to every matching watcher, queues the hooks and
+// updates the text and numeric indexes, for any key but a reserved one. It is called while the driver lock is held so
+// events for a key are seen in the order applied.
+func (d *Driver) notify(op Op, key string, value []byte, expiresAt int64) {
+	if Reserved(key) {
+		return
+	}
+	d.reindex(op, key, value)
+	d.queueHooks(op, key, value)
+
+	d.watchMu.Lock()
+	defer d.watchMu.Unlock()
+
+	if len(d.watchers) == 0 {
+		return
+	}
+
+	ev := Event{Op: op, Key: key, Value: value, Time: time.Now()}
+	if expiresAt != 0 {
+		ev.ExpiresAt = unixTime(expiresAt)
+	}
+	for w := range d.watchers {
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			d.log.Warn("Closing watcher on prefix %q: %v", w.prefix, ErrWatchOverflow)
+			w.closeLocked(ErrWatchOverflow)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// dirtyValue is a value written in write-back mode that is not on disk yet
+type dirtyValue struct {
+	value []byte
+	since time.Time // when the key was first written since its last flush
+}
+
+// markDirty holds a value back to be written by the flusher. The caller must
+// hold the write lock.
+func (d *Driver) markDirty(key string, value []byte) {
+	d.dirtyMu.Lock()
+	defer d.dirtyMu.Unlock()
+	since := time.Now()
+	if old, ok := d.dirty[key]; ok {
+		since = old.since
+	}
+	d.dirty[key] = dirtyValue{value: value, since: since}
+}
+
+// forgetDirty drops a value held back for a key whose file is being removed
+// or replaced directly. The caller must hold the write lock.
+func (d *Driver) forgetDirty(key string) {
+	d.dirtyMu.Lock()
+	defer d.dirtyMu.Unlock()
+	delete(d.dirty, key)
+}
+
+// isDirty reports whether a value is held back for a key
+func (d *Driver) isDirty(key string) bool {
+	d.dirtyMu.Lock()
+	defer d.dirtyMu.Unlock()
+	_, ok := d.dirty[key]
+	return ok
+}
+
+// dirtyKeys returns the keys with values held back, the longest held first
+func (d *Driver) dirtyKeys() []string {
+	d.dirtyMu.Lock()
+	defer d.dirtyMu.Unlock()
+	keys := make([]string, 0, len(d.dirty))
+	for key := range d.dirty {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return d.dirty[keys[i]].since.Before(d.dirty[keys[j]].since)
+	})
+	return keys
+}
+
+// flushKey writes the value held back for a key, if there is one. A value
+// that fails to write stays held back for the next flush. The caller must
+// hold the mutex, so that no write or delete of the key runs meanwhile; the
+// read lock is enough.
+func (d *Driver) flushKey(key string) error {
+	d.dirtyMu.Lock()
+	dv, ok := d.dirty[key]
+	delete(d.dirty, key)
+	d.dirtyMu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if err := d.writeValue(d.keyPath(key), dv.value); err != nil {
+		d.dirtyMu.Lock()
+		if _, newer := d.dirty[key]; !newer {
+			d.dirty[key] = dv
+		}
+		d.dirtyMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Flush writes every value held back by Options.WriteBack to disk, the
+// longest held first. It returns at once when write-back is off.
+func (d *Driver) Flush() error {
+	if d.writeBack == 0 {
+		return nil
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := d.checkOpen(); err != nil {
+		return err
+	}
+	return d.flushLocked()
+}
+
+// flushLocked flushes every held back value with the write lock held
+func (d *Driver) flushLocked() error {
+	var errs []error
+	for _, key := range d.dirtyKeys() {
+		if err := d.flushKey(key); err != nil {
+			errs = append(errs, fmt.Errorf("flushing %s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flushLoop writes held back values to disk twice every window, so none is
+// held much longer than that, until Close. Each key is written under the
+// write lock on its own, so writers are not held up for a whole flush.
+func (d *Driver) flushLoop(window time.Duration) {
+	defer d.background.Done()
+
+	ticker := time.NewTicker(max(window/2, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, key := range d.dirtyKeys() {
+			d.mutex.Lock()
+			err := d.flushKey(key)
+			d.mutex.Unlock()
+			if err != nil {
+				d.log.Error("Failed to flush %s, retrying on the next tick: %v", key, err)
+			}
+		}
+	}
+}
+
+// evicted is called by the cache for the value it drops to make room. A
+// value still held back is written out first, as the cache is then no
+// longer holding it.
+func (d *Driver) evicted(key string) {
+	if err := d.flushKey(key); err != nil {
+		d.log.Error("Failed to flush %s on eviction, retrying on the next tick: %v", key, err)
+	}
+}
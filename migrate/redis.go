@@ -0,0 +1,343 @@
+// Package migrate copies datasets from other stores into ZephyrusDB
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// defaultBatchSize is how many keys are scanned and written at a time when
+// RedisOptions.BatchSize is 0
+const defaultBatchSize = 100
+
+// Target is where a migration writes. The entries of one call are written
+// together where the target can, and a failed call stops the migration.
+type Target interface {
+	PutBatch(ctx context.Context, entries []db.BatchEntry) error
+}
+
+// driverTarget writes straight to a Driver
+type driverTarget struct {
+	d *db.Driver
+}
+
+// DriverTarget returns a Target writing to a driver through PutBatch
+func DriverTarget(d *db.Driver) Target {
+	return driverTarget{d}
+}
+
+func (t driverTarget) PutBatch(ctx context.Context, entries []db.BatchEntry) error {
+	_, err := t.d.PutBatch(entries)
+	return err
+}
+
+// RedisOptions configures FromRedis
+type RedisOptions struct {
+	// Source is the server to read from, as redis://[user:password@]host:port[/db],
+	// or rediss:// for TLS
+	Source string
+
+	// Pattern selects the keys to copy, as for SCAN MATCH; every key when
+	// empty
+	Pattern string
+
+	// Structures also copies hashes, lists, sets and sorted sets, as a JSON
+	// object, an array, a sorted array and an array of {"member", "score"}
+	// objects. Without it only strings are copied and other keys skipped.
+	Structures bool
+
+	// Rate caps the keys copied per second, 0 for no cap
+	Rate int
+
+	// BatchSize is how many keys are scanned and written at a time, 100
+	// when 0
+	BatchSize int
+
+	// ResumeFile, when set, records how far the migration got after every
+	// batch, and a migration started with the same file, source and pattern
+	// carries on from there
+	ResumeFile string
+
+	// Progress, when set, is called after every batch
+	Progress func(RedisStats)
+}
+
+// RedisStats reports how far a migration from Redis got, counting earlier
+// runs continued from the resume file
+type RedisStats struct {
+	Scanned int  `json:"scanned"`
+	Copied  int  `json:"copied"`
+	Skipped int  `json:"skipped"` // keys of other types, or not valid ZephyrusDB keys
+	Done    bool `json:"done"`
+}
+
+// redisResume is the content of the resume file
+type redisResume struct {
+	Source  string `json:"source"`
+	Pattern string `json:"pattern"`
+	Cursor  string `json:"cursor"`
+	RedisStats
+}
+
+// FromRedis copies the keys matching opts.Pattern from a Redis server to
+// target, walking them with SCAN so the server is never blocked for long.
+// Keys keep their TTLs. Keys that change while the migration runs may be
+// copied as they were at any point during it, as SCAN gives no snapshot;
+// run it again, or stop writes to Redis first, for an exact copy.
+func FromRedis(ctx context.Context, target Target, opts RedisOptions) (RedisStats, error) {
+	if opts.Pattern == "" {
+		opts.Pattern = "*"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.Rate < 0 {
+		return RedisStats{}, fmt.Errorf("rate must not be negative, got %d", opts.Rate)
+	}
+	if opts.Rate > 0 && opts.BatchSize > opts.Rate {
+		// Keep each batch within one second's worth of keys
+		opts.BatchSize = opts.Rate
+	}
+
+	state, err := loadResume(opts)
+	if err != nil {
+		return RedisStats{}, err
+	}
+	if state.Done {
+		return state.RedisStats, nil
+	}
+
+	conn, err := dialRedis(ctx, opts.Source)
+	if err != nil {
+		return state.RedisStats, err
+	}
+	defer conn.Close()
+
+	start, copiedBefore := time.Now(), state.Copied
+	for {
+		if err := ctx.Err(); err != nil {
+			return state.RedisStats, err
+		}
+		reply, err := conn.do("SCAN", state.Cursor, "MATCH", opts.Pattern, "COUNT", strconv.Itoa(opts.BatchSize))
+		if err != nil {
+			return state.RedisStats, fmt.Errorf("SCAN failed: %w", err)
+		}
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return state.RedisStats, fmt.Errorf("unexpected SCAN reply %v", reply)
+		}
+		next, _ := replyString(page[0])
+		keys, err := replyStrings(page[1])
+		if err != nil {
+			return state.RedisStats, err
+		}
+
+		var entries []db.BatchEntry
+		for _, key := range keys {
+			state.Scanned++
+			entry, ok, err := readRedisKey(conn, key, opts.Structures)
+			if err != nil {
+				return state.RedisStats, err
+			}
+			if !ok {
+				state.Skipped++
+				continue
+			}
+			if entry != nil {
+				entries = append(entries, *entry)
+			}
+		}
+		if len(entries) > 0 {
+			if err := target.PutBatch(ctx, entries); err != nil {
+				return state.RedisStats, err
+			}
+			state.Copied += len(entries)
+		}
+
+		state.Cursor, state.Done = next, next == "0"
+		if err := saveResume(opts.ResumeFile, state); err != nil {
+			return state.RedisStats, err
+		}
+		if opts.Progress != nil {
+			opts.Progress(state.RedisStats)
+		}
+		if state.Done {
+			return state.RedisStats, nil
+		}
+
+		if opts.Rate > 0 {
+			due := time.Duration(state.Copied-copiedBefore) * time.Second / time.Duration(opts.Rate)
+			if wait := due - time.Since(start); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return state.RedisStats, ctx.Err()
+				}
+			}
+		}
+	}
+}
+
+// readRedisKey reads a key's value and TTL. It returns false for keys that
+// are skipped, and a nil entry for keys that vanished since the scan.
+func readRedisKey(conn *redisConn, key string, structures bool) (*db.BatchEntry, bool, error) {
+	if db.ValidateKey(key) != nil {
+		return nil, false, nil
+	}
+
+	var value []byte
+	reply, err := conn.do("GET", key)
+	var rerr redisError
+	switch {
+	case errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "WRONGTYPE"):
+		if !structures {
+			return nil, false, nil
+		}
+		if value, err = readRedisStructure(conn, key); err != nil || value == nil {
+			return nil, false, err
+		}
+	case err != nil:
+		return nil, false, fmt.Errorf("GET %s failed: %w", key, err)
+	case reply == nil:
+		return nil, true, nil
+	default:
+		value, _ = reply.([]byte)
+	}
+
+	reply, err = conn.do("TTL", key)
+	if err != nil {
+		return nil, false, fmt.Errorf("TTL %s failed: %w", key, err)
+	}
+	ttl, _ := reply.(int64)
+	entry := &db.BatchEntry{Key: key, Value: value}
+	switch {
+	case ttl == -2:
+		// Expired or deleted since it was read
+		return nil, true, nil
+	case ttl > 0:
+		entry.TTL = time.Duration(ttl) * time.Second
+	}
+	return entry, true, nil
+}
+
+// readRedisStructure reads a hash, list, set or sorted set as JSON. It
+// returns nil for other types, and for keys that vanished since GET.
+func readRedisStructure(conn *redisConn, key string) ([]byte, error) {
+	reply, err := conn.do("TYPE", key)
+	if err != nil {
+		return nil, fmt.Errorf("TYPE %s failed: %w", key, err)
+	}
+	typ, _ := replyString(reply)
+
+	var v interface{}
+	switch typ {
+	case "hash":
+		reply, err = conn.do("HGETALL", key)
+		var pairs []string
+		if err == nil {
+			pairs, err = replyStrings(reply)
+		}
+		fields := make(map[string]string, len(pairs)/2)
+		for i := 0; i+1 < len(pairs); i += 2 {
+			fields[pairs[i]] = pairs[i+1]
+		}
+		v = fields
+	case "list":
+		reply, err = conn.do("LRANGE", key, "0", "-1")
+		if err == nil {
+			v, err = replyStrings(reply)
+		}
+	case "set":
+		reply, err = conn.do("SMEMBERS", key)
+		var members []string
+		if err == nil {
+			members, err = replyStrings(reply)
+		}
+		sort.Strings(members)
+		v = members
+	case "zset":
+		reply, err = conn.do("ZRANGE", key, "0", "-1", "WITHSCORES")
+		var pairs []string
+		if err == nil {
+			pairs, err = replyStrings(reply)
+		}
+		type scored struct {
+			Member string  `json:"member"`
+			Score  float64 `json:"score"`
+		}
+		members := make([]scored, 0, len(pairs)/2)
+		for i := 0; i+1 < len(pairs) && err == nil; i += 2 {
+			var score float64
+			score, err = strconv.ParseFloat(pairs[i+1], 64)
+			members = append(members, scored{pairs[i], score})
+		}
+		v = members
+	default:
+		// "none" for a key deleted meanwhile, or a type such as a stream
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s %s: %w", typ, key, err)
+	}
+	return json.Marshal(v)
+}
+
+// loadResume returns where to start, from the resume file when there is one
+func loadResume(opts RedisOptions) (redisResume, error) {
+	state := redisResume{Source: redactSource(opts.Source), Pattern: opts.Pattern, Cursor: "0"}
+	if opts.ResumeFile == "" {
+		return state, nil
+	}
+	data, err := os.ReadFile(opts.ResumeFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	var saved redisResume
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return state, fmt.Errorf("invalid resume file %s: %w", opts.ResumeFile, err)
+	}
+	if saved.Source != state.Source || saved.Pattern != state.Pattern {
+		return state, fmt.Errorf("resume file %s is for %s matching %q; remove it to start over", opts.ResumeFile, saved.Source, saved.Pattern)
+	}
+	return saved, nil
+}
+
+// redactSource returns the source URL without its password, to be kept in
+// the resume file
+func redactSource(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return source
+	}
+	return u.Redacted()
+}
+
+// saveResume records the state in the resume file, if there is one
+func saveResume(path string, state redisResume) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
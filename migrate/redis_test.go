@@ -0,0 +1,102 @@
+package migrate
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"github.com/toblrne/ZephyrusDBv2/resp"
+)
+
+// openDriver opens a driver on a temporary directory
+func openDriver(t *testing.T) *db.Driver {
+	t.Helper()
+	driver, err := db.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	return driver
+}
+
+func TestFromRedis(t *testing.T) {
+	// The Redis protocol server stands in for Redis
+	source := openDriver(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	server := resp.NewServer(source)
+	go server.Serve(lis)
+	defer server.Close()
+
+	for i := 0; i < 25; i++ {
+		source.Put("app:"+string(rune('a'+i)), []byte{byte('a' + i)})
+	}
+	source.PutWithTTL("app:session", []byte("s"), time.Hour)
+	source.Put("other:x", []byte("left behind"))
+
+	target := openDriver(t)
+	resume := filepath.Join(t.TempDir(), "resume.json")
+	opts := RedisOptions{
+		Source:     "redis://" + lis.Addr().String(),
+		Pattern:    "app:*",
+		BatchSize:  10,
+		ResumeFile: resume,
+	}
+	batches := 0
+	opts.Progress = func(RedisStats) { batches++ }
+
+	stats, err := FromRedis(context.Background(), DriverTarget(target), opts)
+	if err != nil {
+		t.Fatalf("FromRedis failed: %s", err)
+	}
+	if stats != (RedisStats{Scanned: 26, Copied: 26, Done: true}) {
+		t.Errorf("FromRedis = %+v, want 26 keys copied", stats)
+	}
+	if batches < 3 {
+		t.Errorf("Progress called %d times, want once per batch", batches)
+	}
+	if v, err := target.Get("app:c"); err != nil || string(v) != "c" {
+		t.Errorf("Get(app:c) = %q, %v", v, err)
+	}
+	if _, err := target.Get("other:x"); err != db.ErrKeyNotFound {
+		t.Errorf("Key outside the pattern was copied: %v", err)
+	}
+	if ttl, err := target.TTL("app:session"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("TTL(app:session) = %s, %v, want about an hour", ttl, err)
+	}
+
+	// A finished migration is not run again with the same resume file, and
+	// a resume file is not used for another pattern
+	target.Delete("app:c")
+	if stats, err := FromRedis(context.Background(), DriverTarget(target), opts); err != nil || !stats.Done {
+		t.Errorf("FromRedis after it finished = %+v, %v", stats, err)
+	}
+	if _, err := target.Get("app:c"); err != db.ErrKeyNotFound {
+		t.Errorf("Finished migration ran again")
+	}
+	opts.Pattern = "other:*"
+	if _, err := FromRedis(context.Background(), DriverTarget(target), opts); err == nil {
+		t.Errorf("FromRedis with another pattern's resume file succeeded")
+	}
+	os.Remove(resume)
+
+	// Throttling spreads the keys over time
+	opts.Rate, opts.ResumeFile = 10, ""
+	start := time.Now()
+	if stats, err := FromRedis(context.Background(), DriverTarget(target), opts); err != nil || stats.Copied != 1 {
+		t.Fatalf("FromRedis = %+v, %v, want the one key copied", stats, err)
+	}
+	opts.Pattern = "app:*"
+	if _, err := FromRedis(context.Background(), DriverTarget(target), opts); err != nil {
+		t.Fatalf("FromRedis failed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("26 keys at 10 per second took %s", elapsed)
+	}
+}
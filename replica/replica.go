@@ -0,0 +1,236 @@
+// Package replica keeps a read-only copy of a primary server's data by
+// following its change feed.
+package replica
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// Status describes how far a replica is behind its primary
+type Status struct {
+	Primary       string    `json:"primary"`
+	Connected     bool      `json:"connected"`
+	ReplicationID string    `json:"replication_id,omitempty"`
+	AppliedSeq    uint64    `json:"applied_seq"`
+	PrimarySeq    uint64    `json:"primary_seq"`
+	LagOps        uint64    `json:"lag_ops"`
+	LagSeconds    float64   `json:"lag_seconds"`
+	Snapshots     int       `json:"snapshots"` // snapshots loaded since starting
+	LastError     string    `json:"last_error,omitempty"`
+	LastContact   time.Time `json:"last_contact,omitempty"`
+}
+
+// Replica applies the changes made on a primary to a local Driver
+type Replica struct {
+	driver  *db.Driver
+	primary *url.URL
+
+	// APIKey is sent to the primary when it requires one; the read role is
+	// enough
+	APIKey string
+	// RetryInterval is how long to wait before reconnecting after an error
+	RetryInterval time.Duration
+	// IdleTimeout drops a feed that has sent nothing, not even a heartbeat,
+	// for this long
+	IdleTimeout time.Duration
+	// HTTPClient is used for requests to the primary
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	id        string
+	applied   uint64
+	appliedAt time.Time // when the last applied change was made on the primary
+	head      uint64
+	connected bool
+	snapshots int
+	lastErr   error
+	contact   time.Time
+}
+
+// New returns a Replica following the server at primary, e.g.
+// "http://primary:8080". The driver is made read-only right away, so that
+// nothing but the primary's changes can be written to it.
+func New(driver *db.Driver, primary string) (*Replica, error) {
+	u, err := parsePrimary(primary)
+	if err != nil {
+		return nil, err
+	}
+
+	driver.SetReadOnly(true)
+	return &Replica{
+		driver:        driver,
+		primary:       u,
+		RetryInterval: time.Second,
+		IdleTimeout:   time.Minute,
+		HTTPClient:    &http.Client{},
+	}, nil
+}
+
+// Status reports the replica's progress
+func (r *Replica) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := Status{
+		Primary:       r.primary.String(),
+		Connected:     r.connected,
+		ReplicationID: r.id,
+		AppliedSeq:    r.applied,
+		PrimarySeq:    r.head,
+		Snapshots:     r.snapshots,
+		LastContact:   r.contact,
+	}
+	if r.head > r.applied {
+		s.LagOps = r.head - r.applied
+		if !r.appliedAt.IsZero() {
+			s.LagSeconds = time.Since(r.appliedAt).Seconds()
+		}
+	}
+	if r.lastErr != nil {
+		s.LastError = r.lastErr.Error()
+	}
+	return s
+}
+
+// Run follows the primary until ctx is cancelled. It loads a snapshot when
+// it has none or has fallen too far behind, then applies changes from the
+// feed, reconnecting from the last applied change after an error.
+func (r *Replica) Run(ctx context.Context) error {
+	for {
+		r.mu.Lock()
+		needSnapshot := r.id == ""
+		r.mu.Unlock()
+
+		var err error
+		if needSnapshot {
+			err = r.loadSnapshot(ctx)
+		}
+		if err == nil {
+			err = r.follow(ctx)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		r.mu.Lock()
+		r.connected = false
+		r.lastErr = err
+		if errors.Is(err, errResync) {
+			r.id = ""
+		}
+		r.mu.Unlock()
+
+		if errors.Is(err, errResync) {
+			r.driver.Logger().Warn("[REPLICA] %v, loading a snapshot", err)
+			continue
+		}
+		r.driver.Logger().Warn("[REPLICA] %v, retrying in %s", err, r.RetryInterval)
+		select {
+		case <-time.After(r.RetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// source returns a Source reading the primary with the replica's settings
+func (r *Replica) source() *Source {
+	return &Source{
+		primary:     r.primary,
+		APIKey:      r.APIKey,
+		IdleTimeout: r.IdleTimeout,
+		HTTPClient:  r.HTTPClient,
+		contact: func() {
+			r.mu.Lock()
+			r.contact = time.Now()
+			r.mu.Unlock()
+		},
+	}
+}
+
+// loadSnapshot replaces the local data with a snapshot of the primary
+func (r *Replica) loadSnapshot(ctx context.Context) error {
+	keys := make(map[string]bool)
+	id, seq, err := r.source().Snapshot(ctx, func(change db.Change) error {
+		keys[change.Key] = true
+		return r.driver.Apply(change)
+	})
+	if err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+
+	// Remove what the primary no longer has
+	local, err := r.driver.List(ctx, "", "", 0)
+	if err != nil {
+		return err
+	}
+	for _, key := range local {
+		if !keys[key] {
+			if err := r.driver.Apply(db.Change{Op: db.OpDelete, Key: key}); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.id = id
+	r.applied = seq
+	r.appliedAt = time.Now()
+	if seq > r.head {
+		r.head = seq
+	}
+	r.snapshots++
+	r.mu.Unlock()
+
+	r.driver.Logger().Info("[REPLICA] Loaded a snapshot of %d keys at seq %d", len(keys), seq)
+	return nil
+}
+
+// follow applies changes from the feed until it ends
+func (r *Replica) follow(ctx context.Context) error {
+	r.mu.Lock()
+	id, after := r.id, r.applied
+	r.mu.Unlock()
+
+	return r.source().Stream(ctx, id, after, func(change db.Change) error {
+		if change.Op == "" {
+			// A heartbeat with the primary's latest sequence number, the
+			// first as soon as the feed is open
+			r.mu.Lock()
+			r.connected = true
+			r.lastErr = nil
+			if change.Seq > r.head {
+				r.head = change.Seq
+			}
+			r.mu.Unlock()
+			return nil
+		}
+		if change.Seq <= after {
+			return nil
+		}
+		if change.Seq != after+1 {
+			return fmt.Errorf("%w: expected change %d, got %d", errResync, after+1, change.Seq)
+		}
+		if err := r.driver.Apply(change); err != nil {
+			return fmt.Errorf("applying change %d: %w", change.Seq, err)
+		}
+		after = change.Seq
+
+		r.mu.Lock()
+		r.applied = change.Seq
+		r.appliedAt = change.Time
+		if change.Seq > r.head {
+			r.head = change.Seq
+		}
+		r.mu.Unlock()
+		return nil
+	})
+}
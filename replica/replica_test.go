@@ -0,0 +1,188 @@
+package replica
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+func openDriver(t *testing.T, opts *db.Options) *db.Driver {
+	dir, err := os.MkdirTemp("", "replica_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	driver, err := db.Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	return driver
+}
+
+// waitFor polls until cond holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	primary := openDriver(t, &db.Options{CacheSize: 128, Degree: 2, ChangeLogSize: 5})
+	handler := api.NewHandler(primary)
+	handler.Heartbeat = 50 * time.Millisecond
+	server := httptest.NewServer(api.InitRouter(handler))
+	defer server.Close()
+	defer handler.Shutdown()
+
+	primary.Put("before", []byte("1"))
+	primary.PutWithTTL("ttl", []byte("2"), time.Hour)
+
+	local := openDriver(t, &db.Options{CacheSize: 128, Degree: 2})
+	local.Put("stale", []byte("x"))
+	rep, err := New(local, server.URL)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	rep.RetryInterval = 10 * time.Millisecond
+	if err := local.Put("k", []byte("v")); !errors.Is(err, db.ErrReadOnly) {
+		t.Errorf("Put on the replica error = %v, want ErrReadOnly", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- rep.Run(ctx) }()
+
+	// The first snapshot copies existing keys and drops the replica's own
+	waitFor(t, "the snapshot", func() bool { return rep.Status().Connected })
+	if value, err := local.Get("before"); err != nil || string(value) != "1" {
+		t.Errorf("replica Get(before) = %q, %v, want 1", value, err)
+	}
+	if ttl, err := local.TTL("ttl"); err != nil || ttl == db.NoTTL {
+		t.Errorf("replica TTL(ttl) = %s, %v, want an expiry", ttl, err)
+	}
+	if ok, _ := local.Has("stale"); ok {
+		t.Errorf("key missing on the primary survived the snapshot")
+	}
+
+	// Later writes arrive through the feed
+	primary.Put("after", []byte("3"))
+	primary.Delete("before")
+	waitFor(t, "the feed", func() bool { return rep.Status().AppliedSeq == primary.Seq() })
+	if value, err := local.Get("after"); err != nil || string(value) != "3" {
+		t.Errorf("replica Get(after) = %q, %v, want 3", value, err)
+	}
+	if ok, _ := local.Has("before"); ok {
+		t.Errorf("delete was not replicated")
+	}
+	if s := rep.Status(); s.LagOps != 0 || s.Snapshots != 1 {
+		t.Errorf("Status = %+v, want no lag after one snapshot", s)
+	}
+
+	// A replica that falls further behind than the change log reaches
+	// loads a new snapshot when it reconnects
+	cancel()
+	<-done
+	for i := 0; i < 10; i++ {
+		primary.Put("bulk"+strconv.Itoa(i), []byte("v"))
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go func() { done <- rep.Run(ctx) }()
+
+	waitFor(t, "the resync", func() bool {
+		s := rep.Status()
+		return s.Snapshots == 2 && s.AppliedSeq == primary.Seq()
+	})
+	if value, err := local.Get("bulk9"); err != nil || string(value) != "v" {
+		t.Errorf("replica Get(bulk9) = %q, %v, want v", value, err)
+	}
+}
+
+func TestSourceFollow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	primary := openDriver(t, &db.Options{CacheSize: 128, Degree: 2})
+	handler := api.NewHandler(primary)
+	handler.Heartbeat = 50 * time.Millisecond
+	server := httptest.NewServer(api.InitRouter(handler))
+	defer server.Close()
+	defer handler.Shutdown()
+
+	if _, err := NewSource("ftp://primary"); err == nil {
+		t.Errorf("NewSource with an ftp URL succeeded")
+	}
+	source, err := NewSource(server.URL)
+	if err != nil {
+		t.Fatalf("NewSource failed: %s", err)
+	}
+	primary.Put("before", []byte("1"))
+
+	dir := t.TempDir()
+	local, err := db.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	statuses := make(chan db.FollowStatus, 1000)
+	run := func(ctx context.Context, local *db.Driver) chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- db.Follow(ctx, source, local, db.FollowRetry(10*time.Millisecond), db.FollowProgress(func(s db.FollowStatus) {
+				select {
+				case statuses <- s:
+				default:
+				}
+			}))
+		}()
+		return done
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := run(ctx, local)
+	primary.Put("after", []byte("2"))
+	waitFor(t, "the feed", func() bool { ok, _ := local.Has("after"); return ok })
+	cancel()
+	<-done
+	local.Close()
+
+	// A restarted follower resumes from the saved position, applying what
+	// it missed without a snapshot
+	primary.Delete("before")
+	if local, err = db.Open(dir, nil); err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	defer local.Close()
+	for len(statuses) > 0 {
+		<-statuses
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	done = run(ctx, local)
+	waitFor(t, "the resumed feed", func() bool { ok, _ := local.Has("before"); return !ok })
+	for len(statuses) > 0 {
+		if s := <-statuses; s.Snapshots != 0 {
+			t.Fatalf("status after restart = %+v, want no snapshot", s)
+		}
+	}
+	if value, err := local.Get("after"); err != nil || string(value) != "2" {
+		t.Errorf("follower Get(after) = %q, %v, want 2", value, err)
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Follow error = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,187 @@
+package replica
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// errResync is returned when the primary can no longer serve the changes the
+// replica needs, so it has to load a snapshot
+var errResync = fmt.Errorf("primary requires a resync: %w", db.ErrChangesTruncated)
+
+// errSnapshotDone ends reading a snapshot at its final line
+var errSnapshotDone = errors.New("snapshot complete")
+
+// Source is a db.ChangeSource reading the snapshot and the change feed of a
+// primary server, for db.Follow to keep an embedded copy of it without
+// running a server
+type Source struct {
+	primary *url.URL
+
+	// APIKey is sent to the primary when it requires one; the read role is
+	// enough
+	APIKey string
+	// IdleTimeout drops a feed that has sent nothing, not even a heartbeat,
+	// for this long
+	IdleTimeout time.Duration
+	// HTTPClient is used for requests to the primary
+	HTTPClient *http.Client
+
+	contact func() // called whenever the primary sends something
+}
+
+// NewSource returns a Source reading the server at primary, e.g.
+// "http://primary:8080"
+func NewSource(primary string) (*Source, error) {
+	u, err := parsePrimary(primary)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{primary: u, IdleTimeout: time.Minute, HTTPClient: &http.Client{}}, nil
+}
+
+// parsePrimary checks the URL of a primary server
+func parsePrimary(primary string) (*url.URL, error) {
+	u, err := url.Parse(primary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid primary URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid primary URL %q: scheme must be http or https", primary)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// Snapshot reads /replication/snapshot, calling fn with a put for every key,
+// and returns the primary's replication ID and the sequence number to follow
+// the feed from
+func (s *Source) Snapshot(ctx context.Context, fn func(db.Change) error) (string, uint64, error) {
+	resp, cancel, err := s.get(ctx, "/replication/snapshot", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	id := resp.Header.Get(api.ReplicationIDHeader)
+	if id == "" {
+		return "", 0, fmt.Errorf("snapshot response has no %s header", api.ReplicationIDHeader)
+	}
+
+	var end db.Change
+	err = s.readChanges(resp.Body, cancel, func(change db.Change) error {
+		if change.Op == "" {
+			end = change
+			return errSnapshotDone
+		}
+		return fn(change)
+	})
+	if err == io.EOF {
+		return "", 0, fmt.Errorf("snapshot was cut short")
+	}
+	if err != errSnapshotDone {
+		return "", 0, err
+	}
+	return id, end.Seq, nil
+}
+
+// Stream reads /replication/feed from change after on, calling fn with each
+// change and heartbeat until the feed ends. The first call of fn is a
+// heartbeat with the primary's latest sequence number, as soon as the feed
+// is open. A primary whose replication ID is no longer id, or which has
+// dropped the changes, makes it fail with db.ErrChangesTruncated.
+func (s *Source) Stream(ctx context.Context, id string, after uint64, fn func(db.Change) error) error {
+	query := url.Values{"after": {strconv.FormatUint(after, 10)}, "id": {id}}
+	resp, cancel, err := s.get(ctx, "/replication/feed", query)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	head, _ := strconv.ParseUint(resp.Header.Get(api.ReplicationSeqHeader), 10, 64)
+	if err := fn(db.Change{Seq: head, Time: time.Now()}); err != nil {
+		return err
+	}
+	err = s.readChanges(resp.Body, cancel, fn)
+	if err == io.EOF {
+		return fmt.Errorf("primary closed the change feed")
+	}
+	return err
+}
+
+// get starts a request to the primary. The returned cancel func must be
+// called once the body has been read.
+func (s *Source) get(ctx context.Context, path string, query url.Values) (*http.Response, context.CancelFunc, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	u := *s.primary
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	}
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		cancel()
+		return nil, nil, errResync
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		cancel()
+		return nil, nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, cancel, nil
+}
+
+// readChanges decodes the NDJSON body of a feed or snapshot, calling fn for
+// each line. The request is cancelled when nothing arrives for IdleTimeout,
+// which catches a primary that went away without closing the connection.
+func (s *Source) readChanges(body io.Reader, cancel context.CancelFunc, fn func(db.Change) error) error {
+	idle := time.AfterFunc(s.IdleTimeout, cancel)
+	defer idle.Stop()
+
+	dec := json.NewDecoder(bufio.NewReader(body))
+	for {
+		var change db.Change
+		if err := dec.Decode(&change); err != nil {
+			if !idle.Stop() {
+				return fmt.Errorf("no data from the primary for %s", s.IdleTimeout)
+			}
+			return err
+		}
+		idle.Reset(s.IdleTimeout)
+
+		if s.contact != nil {
+			s.contact()
+		}
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+}
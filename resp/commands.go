@@ -0,0 +1,354 @@
+package resp
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+const (
+	// scanCount is the default number of keys SCAN visits per call
+	scanCount = 10
+	// maxCursors bounds the SCAN cursors a connection keeps for scans that
+	// were abandoned before completing
+	maxCursors = 1024
+)
+
+// command describes a supported command
+type command struct {
+	arity int // exact argument count including the name, or -n for at least n
+	role  api.Role
+	run   func(s *Server, sess *session, w writer, args [][]byte)
+
+	// firstKey and lastKey are the positions of the key arguments, as in
+	// Redis' command table: 0 for a command without keys, and lastKey -1
+	// for every argument from firstKey on
+	firstKey, lastKey int
+}
+
+var commands = map[string]command{
+	"PING":   {-1, 0, cmdPing, 0, 0},
+	"QUIT":   {1, 0, nil, 0, 0},
+	"AUTH":   {-2, 0, cmdAuth, 0, 0},
+	"GET":    {2, api.RoleRead, cmdGet, 1, 1},
+	"SET":    {-3, api.RoleWrite, cmdSet, 1, 1},
+	"DEL":    {-2, api.RoleWrite, cmdDel, 1, -1},
+	"EXISTS": {-2, api.RoleRead, cmdExists, 1, -1},
+	"KEYS":   {2, api.RoleRead, cmdKeys, 0, 0},
+	"SCAN":   {-2, api.RoleRead, cmdScan, 0, 0},
+	"TTL":    {2, api.RoleRead, cmdTTL, 1, 1},
+	"EXPIRE": {3, api.RoleWrite, cmdExpire, 1, 1},
+	"INCR":   {2, api.RoleWrite, cmdIncr, 1, 1},
+}
+
+// keys returns the key arguments of a call to the command
+func (c command) keys(args [][]byte) [][]byte {
+	if c.firstKey == 0 {
+		return nil
+	}
+	if c.lastKey < 0 {
+		return args[c.firstKey:]
+	}
+	return args[c.firstKey : c.lastKey+1]
+}
+
+// dispatch runs one command and reports whether the client asked to quit
+func (s *Server) dispatch(sess *session, w writer, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	cmd, ok := commands[name]
+	if !ok {
+		w.error("unknown command '" + string(args[0]) + "'")
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.error("wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return false
+	}
+	if name == "QUIT" {
+		w.simple("OK")
+		return true
+	}
+	if sess.role < cmd.role {
+		if sess.role == 0 {
+			w.error("NOAUTH Authentication required.")
+		} else {
+			w.error("NOPERM this API key does not have the " + cmd.role.String() + " role")
+		}
+		return false
+	}
+	// Reserved keys hold lock tokens and stored responses, which only the
+	// operations that keep them may read or write
+	for _, key := range cmd.keys(args) {
+		if db.Reserved(string(key)) {
+			w.error("key is in a reserved namespace")
+			return false
+		}
+	}
+
+	cmd.run(s, sess, w, args)
+	return false
+}
+
+// driverError writes the reply for an error returned by the Driver
+func driverError(w writer, err error) {
+	switch {
+	case errors.Is(err, db.ErrInvalidKey), errors.Is(err, db.ErrInvalidTTL), errors.Is(err, db.ErrValueTooLarge), errors.Is(err, db.ErrSchemaViolation):
+		w.error(err.Error())
+	case errors.Is(err, db.ErrQuotaExceeded), errors.Is(err, db.ErrTooManyKeys):
+		w.error(err.Error())
+	case errors.Is(err, db.ErrNotInteger):
+		w.error("value is not an integer or out of range")
+	case errors.Is(err, db.ErrDiskFull):
+		w.error("READONLY " + err.Error())
+	case errors.Is(err, db.ErrReadOnly):
+		w.error("READONLY You can't write against a read only replica.")
+	default:
+		w.error("internal error")
+	}
+}
+
+func cmdPing(s *Server, sess *session, w writer, args [][]byte) {
+	if len(args) > 1 {
+		w.bulk(args[1])
+		return
+	}
+	w.simple("PONG")
+}
+
+// cmdAuth accepts "AUTH key" and "AUTH username key"; the username is ignored
+func cmdAuth(s *Server, sess *session, w writer, args [][]byte) {
+	if len(args) > 3 {
+		w.error("syntax error")
+		return
+	}
+	if !s.Auth.Enabled() {
+		w.error("ERR AUTH called without any API keys configured")
+		return
+	}
+	role, ok := s.Auth.Role(string(args[len(args)-1]))
+	if !ok {
+		w.error("WRONGPASS invalid API key")
+		return
+	}
+	sess.role = role
+	w.simple("OK")
+}
+
+func cmdGet(s *Server, sess *session, w writer, args [][]byte) {
+	value, err := s.driver.Get(string(args[1]))
+	if errors.Is(err, db.ErrKeyNotFound) {
+		w.null()
+		return
+	}
+	if err != nil {
+		driverError(w, err)
+		return
+	}
+	w.bulk(value)
+}
+
+// cmdSet supports SET key value [EX seconds | PX milliseconds]
+func cmdSet(s *Server, sess *session, w writer, args [][]byte) {
+	var ttl time.Duration
+	for i := 3; i < len(args); i += 2 {
+		opt := strings.ToUpper(string(args[i]))
+		if (opt != "EX" && opt != "PX") || i+1 >= len(args) || ttl != 0 {
+			w.error("syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil || n <= 0 {
+			w.error("invalid expire time in 'set' command")
+			return
+		}
+		unit := time.Second
+		if opt == "PX" {
+			unit = time.Millisecond
+		}
+		if n > math.MaxInt64/int64(unit) {
+			w.error("invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(n) * unit
+	}
+
+	if _, err := s.driver.PutWithTTL(string(args[1]), args[2], ttl); err != nil {
+		driverError(w, err)
+		return
+	}
+	w.simple("OK")
+}
+
+func cmdDel(s *Server, sess *session, w writer, args [][]byte) {
+	var deleted int64
+	for _, key := range args[1:] {
+		err := s.driver.Delete(string(key))
+		if errors.Is(err, db.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			driverError(w, err)
+			return
+		}
+		deleted++
+	}
+	w.integer(deleted)
+}
+
+// cmdExists counts the given keys that exist, counting repeats each time
+func cmdExists(s *Server, sess *session, w writer, args [][]byte) {
+	var count int64
+	for _, key := range args[1:] {
+		ok, err := s.driver.Has(string(key))
+		if err != nil {
+			driverError(w, err)
+			return
+		}
+		if ok {
+			count++
+		}
+	}
+	w.integer(count)
+}
+
+func cmdKeys(s *Server, sess *session, w writer, args [][]byte) {
+	pattern := string(args[1])
+	keys, err := s.driver.List(context.Background(), literalPrefix(pattern), "", 0)
+	if err != nil {
+		driverError(w, err)
+		return
+	}
+
+	matched := keys[:0]
+	for _, key := range keys {
+		if globMatch(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	w.bulkStrings(matched)
+}
+
+// cmdScan supports SCAN cursor [MATCH pattern] [COUNT count]. Cursors are
+// numbers standing for the last key returned on this connection; 0 starts a
+// new scan and is returned when the scan is complete.
+func cmdScan(s *Server, sess *session, w writer, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		w.error("invalid cursor")
+		return
+	}
+	after, ok := sess.cursors[cursor]
+	if cursor != 0 && !ok {
+		w.error("invalid cursor")
+		return
+	}
+	delete(sess.cursors, cursor)
+
+	pattern, count := "*", scanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.error("syntax error")
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			n, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || n < 1 {
+				w.error("syntax error")
+				return
+			}
+			count = n
+		default:
+			w.error("syntax error")
+			return
+		}
+	}
+
+	// Like Redis, COUNT bounds the keys visited, so a page may come back
+	// with fewer matches or none at all
+	keys, err := s.driver.List(context.Background(), literalPrefix(pattern), after, count)
+	if err != nil {
+		driverError(w, err)
+		return
+	}
+
+	next := uint64(0)
+	if len(keys) == count {
+		if len(sess.cursors) >= maxCursors {
+			sess.cursors = make(map[uint64]string)
+		}
+		sess.next++
+		next = sess.next
+		sess.cursors[next] = keys[len(keys)-1]
+	}
+
+	matched := keys[:0]
+	for _, key := range keys {
+		if globMatch(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+
+	w.arrayLen(2)
+	w.bulk([]byte(strconv.FormatUint(next, 10)))
+	w.bulkStrings(matched)
+}
+
+// cmdTTL replies with the remaining seconds, -1 for keys without an expiry
+// and -2 for missing keys
+func cmdTTL(s *Server, sess *session, w writer, args [][]byte) {
+	ttl, err := s.driver.TTL(string(args[1]))
+	switch {
+	case errors.Is(err, db.ErrKeyNotFound):
+		w.integer(-2)
+	case err != nil:
+		driverError(w, err)
+	case ttl == db.NoTTL:
+		w.integer(-1)
+	default:
+		w.integer(int64(math.Ceil(ttl.Seconds())))
+	}
+}
+
+// cmdExpire sets a key's expiry in seconds. As in Redis, a time of zero or
+// less deletes the key.
+func cmdExpire(s *Server, sess *session, w writer, args [][]byte) {
+	key := string(args[1])
+	seconds, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil || seconds > math.MaxInt64/int64(time.Second) {
+		w.error("value is not an integer or out of range")
+		return
+	}
+
+	if seconds <= 0 {
+		err = s.driver.Delete(key)
+	} else {
+		err = s.driver.Expire(key, time.Duration(seconds)*time.Second)
+	}
+	if errors.Is(err, db.ErrKeyNotFound) {
+		w.integer(0)
+		return
+	}
+	if err != nil {
+		driverError(w, err)
+		return
+	}
+	w.integer(1)
+}
+
+func cmdIncr(s *Server, sess *session, w writer, args [][]byte) {
+	n, err := s.driver.Incr(string(args[1]), 1)
+	if err != nil {
+		driverError(w, err)
+		return
+	}
+	w.integer(n)
+}
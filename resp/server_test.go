@@ -0,0 +1,230 @@
+package resp
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+func setupServer(t *testing.T, auth *api.Auth) (net.Conn, *db.Driver) {
+	dir, err := os.MkdirTemp("", "resp_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	driver, err := db.New(dir, nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	server := NewServer(driver)
+	server.Auth = auth
+	go server.Serve(lis)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn, driver
+}
+
+// encode builds a RESP array command, as sent by redis-cli
+func encode(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	return b.String()
+}
+
+// readReply reads one reply and renders it on a single line
+func readReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read reply: %s", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return "(nil)"
+		}
+		body, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read bulk: %s", err)
+		}
+		return strings.TrimSuffix(body, "\r\n")
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			items[i] = readReply(t, r)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return line
+}
+
+func TestCommands(t *testing.T) {
+	conn, driver := setupServer(t, nil)
+	r := bufio.NewReader(conn)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"SET", "foo", "bar"}, "+OK"},
+		{[]string{"GET", "foo"}, "bar"},
+		{[]string{"get", "missing"}, "(nil)"},
+		{[]string{"EXISTS", "foo", "missing", "foo"}, ":2"},
+		{[]string{"INCR", "n"}, ":1"},
+		{[]string{"INCR", "n"}, ":2"},
+		{[]string{"INCR", "foo"}, "-ERR value is not an integer or out of range"},
+		{[]string{"TTL", "foo"}, ":-1"},
+		{[]string{"TTL", "missing"}, ":-2"},
+		{[]string{"EXPIRE", "foo", "100"}, ":1"},
+		{[]string{"TTL", "foo"}, ":100"},
+		{[]string{"EXPIRE", "missing", "100"}, ":0"},
+		{[]string{"SET", "user:1", "a", "EX", "60"}, "+OK"},
+		{[]string{"SET", "user:2", "b"}, "+OK"},
+		{[]string{"KEYS", "user:*"}, "[user:1 user:2]"},
+		{[]string{"KEYS", "*o*"}, "[foo]"},
+		{[]string{"DEL", "user:1", "user:2", "missing"}, ":2"},
+		{[]string{"SET", "a/b", "x"}, "-ERR invalid key: key must not contain '/'; use another separator, such as ':'"},
+		{[]string{"SET", "foo"}, "-ERR wrong number of arguments for 'set' command"},
+		{[]string{"HSET", "h", "f", "v"}, "-ERR unknown command 'HSET'"},
+		{[]string{"GET", "_lock:jobs"}, "-ERR key is in a reserved namespace"},
+		{[]string{"SET", "_idempotency:x", "forged"}, "-ERR key is in a reserved namespace"},
+		{[]string{"DEL", "foo", "_lock:jobs"}, "-ERR key is in a reserved namespace"},
+	}
+	for _, tt := range tests {
+		conn.Write([]byte(encode(tt.args...)))
+		if got := readReply(t, r); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+
+	if value, err := driver.Get("n"); err != nil || string(value) != "2" {
+		t.Errorf("driver.Get(n) = %q, %v, want 2", value, err)
+	}
+}
+
+func TestPipelineAndInline(t *testing.T) {
+	conn, _ := setupServer(t, nil)
+	r := bufio.NewReader(conn)
+
+	// Several commands in one write, with an inline command mixed in
+	conn.Write([]byte(encode("SET", "k", "v") + "GET k\r\n" + encode("INCR", "c") + encode("INCR", "c")))
+	for _, want := range []string{"+OK", "v", ":1", ":2"} {
+		if got := readReply(t, r); got != want {
+			t.Errorf("pipelined reply = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	conn, driver := setupServer(t, nil)
+	r := bufio.NewReader(conn)
+
+	for i := 0; i < 25; i++ {
+		driver.Put("key:"+strconv.Itoa(i), []byte("v"))
+	}
+	driver.Put("other", []byte("v"))
+
+	seen := map[string]bool{}
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 10 {
+			t.Fatalf("SCAN did not finish")
+		}
+		conn.Write([]byte(encode("SCAN", cursor, "MATCH", "key:*", "COUNT", "10")))
+		reply := readReply(t, r)
+		fields := strings.Fields(strings.Trim(reply, "[]"))
+		cursor = fields[0]
+		for _, key := range fields[1:] {
+			seen[key] = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 25 || seen["other"] {
+		t.Errorf("SCAN returned %d keys, want 25 without other", len(seen))
+	}
+
+	conn.Write([]byte(encode("SCAN", "999")))
+	if got := readReply(t, r); got != "-ERR invalid cursor" {
+		t.Errorf("SCAN unknown cursor = %q", got)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	auth := api.NewAuth(map[string]api.Role{"reader": api.RoleRead, "writer": api.RoleWrite})
+	conn, _ := setupServer(t, auth)
+	r := bufio.NewReader(conn)
+
+	steps := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "k"}, "-NOAUTH Authentication required."},
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS invalid API key"},
+		{[]string{"AUTH", "reader"}, "+OK"},
+		{[]string{"GET", "k"}, "(nil)"},
+		{[]string{"SET", "k", "v"}, "-NOPERM this API key does not have the write role"},
+		{[]string{"AUTH", "default", "writer"}, "+OK"},
+		{[]string{"SET", "k", "v"}, "+OK"},
+	}
+	for _, s := range steps {
+		conn.Write([]byte(encode(s.args...)))
+		if got := readReply(t, r); got != s.want {
+			t.Errorf("%v = %q, want %q", s.args, got, s.want)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*/*", "a/b", true},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+	if got := literalPrefix(`user\*:*`); got != "user*:" {
+		t.Errorf("literalPrefix = %q, want user*:", got)
+	}
+}
@@ -0,0 +1,274 @@
+// Package rpc serves the key-value store over gRPC. The messages and service
+// stubs are generated from zephyrus.proto.
+package rpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative zephyrus.proto
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Service implements the Zephyrus gRPC service on top of a Driver
+type Service struct {
+	UnimplementedZephyrusServer
+
+	driver       *db.Driver
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+func NewService(driver *db.Driver) *Service {
+	return &Service{
+		driver:   driver,
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Shutdown ends Watch streams so that grpc.Server.GracefulStop does not wait
+// on them
+func (s *Service) Shutdown() {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+}
+
+// NewServer returns a gRPC server for the service with logging and, when auth
+// is enabled, API key checks using the same roles as the HTTP API
+func NewServer(svc *Service, auth *api.Auth) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(svc.logUnary, authUnary(auth)),
+		grpc.ChainStreamInterceptor(svc.logStream, authStream(auth)),
+	)
+	RegisterZephyrusServer(server, svc)
+	return server
+}
+
+// ttlFromSeconds converts a ttl_seconds field, where -1 is no expiry
+func ttlFromSeconds(seconds int64) time.Duration {
+	if seconds == -1 {
+		return db.NoTTL
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// checkReserved returns InvalidArgument for a key in a reserved namespace,
+// whose lock tokens and stored responses only the operations that keep them
+// may read or write
+func checkReserved(key string) error {
+	if db.Reserved(key) {
+		return status.Error(codes.InvalidArgument, "key is in a reserved namespace")
+	}
+	return nil
+}
+
+func (s *Service) Put(ctx context.Context, req *PutRequest) (*PutResponse, error) {
+	if err := checkReserved(req.Key); err != nil {
+		return nil, err
+	}
+	created, err := s.driver.PutWithTTL(req.Key, req.Value, ttlFromSeconds(req.TtlSeconds))
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &PutResponse{Created: created}, nil
+}
+
+func (s *Service) Get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	if err := checkReserved(req.Key); err != nil {
+		return nil, err
+	}
+	value, err := s.driver.Get(req.Key)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &GetResponse{Value: value}, nil
+}
+
+func (s *Service) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if err := checkReserved(req.Key); err != nil {
+		return nil, err
+	}
+	if err := s.driver.Delete(req.Key); err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &DeleteResponse{}, nil
+}
+
+func (s *Service) BatchPut(ctx context.Context, req *BatchPutRequest) (*BatchPutResponse, error) {
+	entries := make([]db.BatchEntry, len(req.Entries))
+	for i, e := range req.Entries {
+		if err := checkReserved(e.Key); err != nil {
+			return nil, err
+		}
+		entries[i] = db.BatchEntry{Key: e.Key, Value: e.Value, TTL: ttlFromSeconds(e.TtlSeconds)}
+	}
+	created, err := s.driver.PutBatch(entries)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+	return &BatchPutResponse{Created: created}, nil
+}
+
+func (s *Service) List(req *ListRequest, stream Zephyrus_ListServer) error {
+	if req.Limit < 0 {
+		return status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	keys, err := s.driver.List(stream.Context(), req.Prefix, req.After, int(req.Limit))
+	if err != nil {
+		return s.toStatus(err)
+	}
+	for _, key := range keys {
+		if err := stream.Send(&ListResponse{Key: key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Service) Watch(req *WatchRequest, stream Zephyrus_WatchServer) error {
+	watcher := s.driver.Watch(req.Prefix)
+	defer watcher.Close()
+
+	for {
+		select {
+		case ev, ok := <-watcher.Events():
+			if !ok {
+				return status.Error(codes.ResourceExhausted, watcher.Err().Error())
+			}
+			if db.Reserved(ev.Key) {
+				continue
+			}
+			msg := &WatchEvent{Key: ev.Key, TimeUnixNano: ev.Time.UnixNano()}
+			switch ev.Op {
+			case db.OpPut:
+				msg.Op = WatchEvent_OP_PUT
+				if req.IncludeValues {
+					msg.Value = ev.Value
+				}
+			case db.OpDelete, db.OpExpire:
+				// The protocol has no op of its own for an expiry yet
+				msg.Op = WatchEvent_OP_DELETE
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-s.shutdown:
+			return status.Error(codes.Unavailable, "server shutting down")
+		}
+	}
+}
+
+// toStatus maps Driver errors to gRPC status codes. Unexpected errors are
+// logged to the driver's logger rather than returned, since they may name
+// files on the server.
+func (s *Service) toStatus(err error) error {
+	switch {
+	case errors.Is(err, db.ErrKeyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, db.ErrInvalidKey), errors.Is(err, db.ErrInvalidTTL), errors.Is(err, db.ErrValueTooLarge), errors.Is(err, db.ErrSchemaViolation):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, db.ErrKeyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, db.ErrQuotaExceeded), errors.Is(err, db.ErrTooManyKeys):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, db.ErrDiskFull):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, db.ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, db.ErrClosed):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	}
+	s.driver.Logger().Error("[GRPC] internal error: %v", err)
+	return status.Error(codes.Internal, "internal error")
+}
+
+// methodRoles is the role each method requires, matching the HTTP routes
+var methodRoles = map[string]api.Role{
+	Zephyrus_Put_FullMethodName:      api.RoleWrite,
+	Zephyrus_Get_FullMethodName:      api.RoleRead,
+	Zephyrus_Delete_FullMethodName:   api.RoleWrite,
+	Zephyrus_BatchPut_FullMethodName: api.RoleWrite,
+	Zephyrus_List_FullMethodName:     api.RoleRead,
+	Zephyrus_Watch_FullMethodName:    api.RoleRead,
+}
+
+// authorize checks the API key sent as "authorization: Bearer <key>" or
+// "x-api-key" metadata against the role the method requires
+func authorize(ctx context.Context, auth *api.Auth, method string) error {
+	if !auth.Enabled() {
+		return nil
+	}
+
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("x-api-key"); len(v) > 0 {
+			token = v[0]
+		}
+		if v := md.Get("authorization"); len(v) > 0 {
+			if bearer, ok := strings.CutPrefix(v[0], "Bearer "); ok {
+				token = bearer
+			}
+		}
+	}
+
+	got, ok := auth.Role(token)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "a valid API key is required")
+	}
+	want, known := methodRoles[method]
+	if !known {
+		want = api.RoleAdmin
+	}
+	if got < want {
+		return status.Errorf(codes.PermissionDenied, "%s role required", want)
+	}
+	return nil
+}
+
+func authUnary(auth *api.Auth) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authorize(ctx, auth, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func authStream(auth *api.Auth) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authorize(ss.Context(), auth, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// logUnary logs each call to the driver's logger in the same shape as gin's
+// request log
+func (s *Service) logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	s.driver.Logger().Info("[GRPC] %v | %13v | %s", status.Code(err), time.Since(start), info.FullMethod)
+	return resp, err
+}
+
+func (s *Service) logStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	s.driver.Logger().Info("[GRPC] %v | %13v | %s", status.Code(err), time.Since(start), info.FullMethod)
+	return err
+}
@@ -0,0 +1,216 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func setupClient(t *testing.T, auth *api.Auth) (ZephyrusClient, *db.Driver) {
+	dir, err := os.MkdirTemp("", "rpc_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	driver, err := db.New(dir, nil, 128, 2)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	t.Cleanup(func() { driver.Close() })
+	return serve(t, driver, auth), driver
+}
+
+// serve runs the service for driver over an in-memory listener
+func serve(t *testing.T, driver *db.Driver, auth *api.Auth) ZephyrusClient {
+	lis := bufconn.Listen(1 << 20)
+	svc := NewService(driver)
+	server := NewServer(svc, auth)
+	go server.Serve(lis)
+	t.Cleanup(func() {
+		svc.Shutdown()
+		server.Stop()
+	})
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return NewZephyrusClient(conn)
+}
+
+func TestService(t *testing.T) {
+	client, driver := setupClient(t, nil)
+	ctx := context.Background()
+
+	put, err := client.Put(ctx, &PutRequest{Key: "a", Value: []byte("1")})
+	if err != nil || !put.Created {
+		t.Fatalf("Put = %v, %v, want created", put, err)
+	}
+
+	// Both protocols share the driver
+	if value, err := driver.Get("a"); err != nil || string(value) != "1" {
+		t.Errorf("driver.Get(a) = %q, %v, want 1", value, err)
+	}
+	driver.Put("b", []byte("2"))
+	get, err := client.Get(ctx, &GetRequest{Key: "b"})
+	if err != nil || string(get.Value) != "2" {
+		t.Errorf("Get(b) = %v, %v, want 2", get, err)
+	}
+
+	batch, err := client.BatchPut(ctx, &BatchPutRequest{Entries: []*PutRequest{
+		{Key: "b", Value: []byte("20")},
+		{Key: "c", Value: []byte("3")},
+	}})
+	if err != nil || len(batch.Created) != 2 || batch.Created[0] || !batch.Created[1] {
+		t.Errorf("BatchPut = %v, %v, want [false true]", batch, err)
+	}
+
+	stream, err := client.List(ctx, &ListRequest{After: "a"})
+	if err != nil {
+		t.Fatalf("List failed: %s", err)
+	}
+	var keys []string
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("List Recv failed: %s", err)
+		}
+		keys = append(keys, resp.Key)
+	}
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Errorf("List after a = %v, want [b c]", keys)
+	}
+
+	if _, err := client.Delete(ctx, &DeleteRequest{Key: "a"}); err != nil {
+		t.Errorf("Delete failed: %s", err)
+	}
+	if _, err := client.Get(ctx, &GetRequest{Key: "a"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get deleted key code = %v, want NotFound", status.Code(err))
+	}
+	if _, err := client.Put(ctx, &PutRequest{Key: "../x"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Put invalid key code = %v, want InvalidArgument", status.Code(err))
+	}
+
+	// Lock tokens can be neither read nor forged
+	token, err := driver.AcquireLock("jobs", time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireLock failed: %s", err)
+	}
+	lock := db.LockNamespace + db.NamespaceSeparator + "jobs"
+	if get, err := client.Get(ctx, &GetRequest{Key: lock}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Get of a lock key = %v, %v, want InvalidArgument", get, err)
+	}
+	if _, err := client.Put(ctx, &PutRequest{Key: lock, Value: []byte(`{"token":"mine"}`)}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Put of a lock key code = %v, want InvalidArgument", status.Code(err))
+	}
+	if err := driver.ReleaseLock("jobs", token); err != nil {
+		t.Errorf("ReleaseLock after the refused writes = %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	client, driver := setupClient(t, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &WatchRequest{Prefix: "user:", IncludeValues: true})
+	if err != nil {
+		t.Fatalf("Watch failed: %s", err)
+	}
+
+	// The watcher is registered once the server handler runs; keep writing
+	// until the first event arrives
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				driver.Put("other", []byte("x"))
+				driver.Put("user:1", []byte("v"))
+			}
+		}
+	}()
+	ev, err := stream.Recv()
+	close(done)
+	if err != nil {
+		t.Fatalf("Recv failed: %s", err)
+	}
+	if ev.Op != WatchEvent_OP_PUT || ev.Key != "user:1" || string(ev.Value) != "v" {
+		t.Errorf("event = %v, want put user:1 v", ev)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	auth := api.NewAuth(map[string]api.Role{"reader": api.RoleRead, "writer": api.RoleWrite})
+	client, _ := setupClient(t, auth)
+
+	withKey := func(key string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+key)
+	}
+
+	if _, err := client.Get(context.Background(), &GetRequest{Key: "a"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Get without key code = %v, want Unauthenticated", status.Code(err))
+	}
+	if _, err := client.Put(withKey("reader"), &PutRequest{Key: "a"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Put with read key code = %v, want PermissionDenied", status.Code(err))
+	}
+	if _, err := client.Put(withKey("writer"), &PutRequest{Key: "a"}); err != nil {
+		t.Errorf("Put with write key failed: %s", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "reader")
+	if _, err := client.Get(ctx, &GetRequest{Key: "a"}); err != nil {
+		t.Errorf("Get with read key failed: %s", err)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var logs bytes.Buffer
+	logger := db.NewSlogLogger(slog.New(slog.NewTextHandler(&logs, nil)), nil)
+	driver, err := db.Open(t.TempDir(), &db.Options{Logger: logger})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	client := serve(t, driver, nil)
+
+	// Calls are logged to the driver's logger, at the level it is set to
+	logs.Reset()
+	client.Get(context.Background(), &GetRequest{Key: "a"})
+	if !strings.Contains(logs.String(), "[GRPC] NotFound") || !strings.Contains(logs.String(), "/Get") {
+		t.Errorf("logs = %q, want the Get call", logs.String())
+	}
+	if err := driver.SetLogLevel(db.LevelWarn); err != nil {
+		t.Fatalf("SetLogLevel failed: %s", err)
+	}
+	logs.Reset()
+	client.Get(context.Background(), &GetRequest{Key: "a"})
+	if logs.Len() != 0 {
+		t.Errorf("logs at warn level = %q, want none", logs.String())
+	}
+}
@@ -0,0 +1,363 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: zephyrus.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Zephyrus_Put_FullMethodName      = "/zephyrus.v1.Zephyrus/Put"
+	Zephyrus_Get_FullMethodName      = "/zephyrus.v1.Zephyrus/Get"
+	Zephyrus_Delete_FullMethodName   = "/zephyrus.v1.Zephyrus/Delete"
+	Zephyrus_BatchPut_FullMethodName = "/zephyrus.v1.Zephyrus/BatchPut"
+	Zephyrus_List_FullMethodName     = "/zephyrus.v1.Zephyrus/List"
+	Zephyrus_Watch_FullMethodName    = "/zephyrus.v1.Zephyrus/Watch"
+)
+
+// ZephyrusClient is the client API for Zephyrus service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ZephyrusClient interface {
+	// Put stores a value, reporting whether the key was created
+	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
+	// Get returns the value of a key, or NOT_FOUND
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// Delete removes a key, or returns NOT_FOUND
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// BatchPut stores several values while taking the write lock once
+	BatchPut(ctx context.Context, in *BatchPutRequest, opts ...grpc.CallOption) (*BatchPutResponse, error)
+	// List streams the keys starting with a prefix in key order
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Zephyrus_ListClient, error)
+	// Watch streams changes to keys starting with a prefix until the client
+	// cancels or the server shuts down
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Zephyrus_WatchClient, error)
+}
+
+type zephyrusClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewZephyrusClient(cc grpc.ClientConnInterface) ZephyrusClient {
+	return &zephyrusClient{cc}
+}
+
+func (c *zephyrusClient) Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error) {
+	out := new(PutResponse)
+	err := c.cc.Invoke(ctx, Zephyrus_Put_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *zephyrusClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, Zephyrus_Get_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *zephyrusClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, Zephyrus_Delete_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *zephyrusClient) BatchPut(ctx context.Context, in *BatchPutRequest, opts ...grpc.CallOption) (*BatchPutResponse, error) {
+	out := new(BatchPutResponse)
+	err := c.cc.Invoke(ctx, Zephyrus_BatchPut_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *zephyrusClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (Zephyrus_ListClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Zephyrus_ServiceDesc.Streams[0], Zephyrus_List_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &zephyrusListClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Zephyrus_ListClient interface {
+	Recv() (*ListResponse, error)
+	grpc.ClientStream
+}
+
+type zephyrusListClient struct {
+	grpc.ClientStream
+}
+
+func (x *zephyrusListClient) Recv() (*ListResponse, error) {
+	m := new(ListResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *zephyrusClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Zephyrus_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Zephyrus_ServiceDesc.Streams[1], Zephyrus_Watch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &zephyrusWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Zephyrus_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type zephyrusWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *zephyrusWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ZephyrusServer is the server API for Zephyrus service.
+// All implementations must embed UnimplementedZephyrusServer
+// for forward compatibility
+type ZephyrusServer interface {
+	// Put stores a value, reporting whether the key was created
+	Put(context.Context, *PutRequest) (*PutResponse, error)
+	// Get returns the value of a key, or NOT_FOUND
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// Delete removes a key, or returns NOT_FOUND
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// BatchPut stores several values while taking the write lock once
+	BatchPut(context.Context, *BatchPutRequest) (*BatchPutResponse, error)
+	// List streams the keys starting with a prefix in key order
+	List(*ListRequest, Zephyrus_ListServer) error
+	// Watch streams changes to keys starting with a prefix until the client
+	// cancels or the server shuts down
+	Watch(*WatchRequest, Zephyrus_WatchServer) error
+	mustEmbedUnimplementedZephyrusServer()
+}
+
+// UnimplementedZephyrusServer must be embedded to have forward compatible implementations.
+type UnimplementedZephyrusServer struct {
+}
+
+func (UnimplementedZephyrusServer) Put(context.Context, *PutRequest) (*PutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Put not implemented")
+}
+func (UnimplementedZephyrusServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedZephyrusServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedZephyrusServer) BatchPut(context.Context, *BatchPutRequest) (*BatchPutResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchPut not implemented")
+}
+func (UnimplementedZephyrusServer) List(*ListRequest, Zephyrus_ListServer) error {
+	return status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedZephyrusServer) Watch(*WatchRequest, Zephyrus_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedZephyrusServer) mustEmbedUnimplementedZephyrusServer() {}
+
+// UnsafeZephyrusServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ZephyrusServer will
+// result in compilation errors.
+type UnsafeZephyrusServer interface {
+	mustEmbedUnimplementedZephyrusServer()
+}
+
+func RegisterZephyrusServer(s grpc.ServiceRegistrar, srv ZephyrusServer) {
+	s.RegisterService(&Zephyrus_ServiceDesc, srv)
+}
+
+func _Zephyrus_Put_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ZephyrusServer).Put(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Zephyrus_Put_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ZephyrusServer).Put(ctx, req.(*PutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Zephyrus_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ZephyrusServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Zephyrus_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ZephyrusServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Zephyrus_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ZephyrusServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Zephyrus_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ZephyrusServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Zephyrus_BatchPut_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchPutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ZephyrusServer).BatchPut(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Zephyrus_BatchPut_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ZephyrusServer).BatchPut(ctx, req.(*BatchPutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Zephyrus_List_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ZephyrusServer).List(m, &zephyrusListServer{stream})
+}
+
+type Zephyrus_ListServer interface {
+	Send(*ListResponse) error
+	grpc.ServerStream
+}
+
+type zephyrusListServer struct {
+	grpc.ServerStream
+}
+
+func (x *zephyrusListServer) Send(m *ListResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Zephyrus_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ZephyrusServer).Watch(m, &zephyrusWatchServer{stream})
+}
+
+type Zephyrus_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type zephyrusWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *zephyrusWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Zephyrus_ServiceDesc is the grpc.ServiceDesc for Zephyrus service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Zephyrus_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "zephyrus.v1.Zephyrus",
+	HandlerType: (*ZephyrusServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Put",
+			Handler:    _Zephyrus_Put_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _Zephyrus_Get_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _Zephyrus_Delete_Handler,
+		},
+		{
+			MethodName: "BatchPut",
+			Handler:    _Zephyrus_BatchPut_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "List",
+			Handler:       _Zephyrus_List_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _Zephyrus_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "zephyrus.proto",
+}
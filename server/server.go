@@ -0,0 +1,336 @@
+// Package server runs ZephyrusDB: it opens the Driver a config.Config
+// describes and serves it over HTTP and, when configured, gRPC and the
+// Redis protocol, until shut down.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/api"
+	"github.com/toblrne/ZephyrusDBv2/config"
+	"github.com/toblrne/ZephyrusDBv2/db"
+	"github.com/toblrne/ZephyrusDBv2/replica"
+	"github.com/toblrne/ZephyrusDBv2/resp"
+	"github.com/toblrne/ZephyrusDBv2/rpc"
+	"github.com/toblrne/ZephyrusDBv2/webhook"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+)
+
+// Server is a Driver and the servers in front of it. New opens the Driver,
+// Start listens and serves, and Shutdown stops serving and closes the
+// Driver, saving its snapshot.
+type Server struct {
+	cfg     *config.Config
+	driver  *db.Driver
+	handler *api.Handler
+	log     db.Logger
+	tracer  *sdktrace.TracerProvider // nil when not tracing
+
+	httpServer  *http.Server
+	httpLis     net.Listener
+	grpcService *rpc.Service
+	grpcServer  *grpc.Server // nil without a gRPC address
+	respServer  *resp.Server // nil without a RESP address
+
+	// Background work: the API key file watcher, the webhook workers and the
+	// replica, stopped by cancel before the Driver is closed
+	cancel context.CancelFunc
+	rep    *replica.Replica // nil on a primary
+
+	group   *errgroup.Group
+	stopped context.Context // done once a server or the replica failed
+}
+
+// New opens the Driver cfg describes and sets up the servers, without
+// listening yet. A Server that fails to Start must still be Shut down.
+func New(cfg *config.Config) (*Server, error) {
+	s := &Server{cfg: cfg}
+
+	// Export traces when the standard OpenTelemetry variables ask for it
+	opts := cfg.DBOptions()
+	tracer, err := cfg.TracerProvider(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up tracing: %w", err)
+	}
+	if tracer != nil {
+		s.tracer = tracer
+		opts.TracerProvider = tracer
+	}
+
+	s.driver, err = db.Open(cfg.DataDir, opts)
+	if err != nil {
+		s.shutdownTracer(context.Background())
+		return nil, fmt.Errorf("failed to initialize db: %w", err)
+	}
+	s.log = s.driver.Logger()
+	if err := s.setup(opts); err != nil {
+		s.driver.Close()
+		s.shutdownTracer(context.Background())
+		return nil, err
+	}
+	return s, nil
+}
+
+// setup creates the handler and the servers over the open Driver
+func (s *Server) setup(opts *db.Options) error {
+	cfg := s.cfg
+	if fields := config.SplitList(cfg.TextIndexFields); len(fields) > 0 {
+		if err := s.driver.EnableTextIndex(fields); err != nil {
+			return fmt.Errorf("failed to build the text index: %w", err)
+		}
+	}
+
+	handler := api.NewHandler(s.driver)
+	handler.MaxWatchers = cfg.MaxWatchers
+	handler.ReadTimeout = cfg.ReadTimeout
+	handler.WriteTimeout = cfg.WriteTimeout
+	handler.IdempotencyWindow = cfg.Idempotency
+	handler.CacheControl = cfg.CachePolicy()
+	hooks, err := webhook.New(s.driver, cfg.WebhookQueue)
+	if err != nil {
+		return err
+	}
+	hooks.Workers = cfg.WebhookWorkers
+	handler.Webhooks = hooks
+	auth, err := cfg.Auth()
+	if err != nil {
+		return fmt.Errorf("failed to load the API keys: %w", err)
+	}
+	handler.Auth = auth
+	handler.TracerProvider = opts.TracerProvider
+	if cfg.CursorSecret != "" {
+		handler.CursorSecret = []byte(cfg.CursorSecret)
+	}
+	s.handler = handler
+
+	// A replica serves reads and takes its writes from the primary's change feed
+	if cfg.ReplicaOf != "" {
+		rep, err := replica.New(s.driver, cfg.ReplicaOf)
+		if err != nil {
+			return fmt.Errorf("failed to set up replication: %w", err)
+		}
+		rep.APIKey = cfg.ReplicaAPIKey
+		handler.Replication = func() interface{} { return rep.Status() }
+		s.rep = rep
+	}
+
+	s.httpServer = &http.Server{Addr: cfg.Addr, Handler: api.InitRouter(handler)}
+	// Close watch streams and WebSockets when shutting down, since Shutdown
+	// does not wait for hijacked connections and would wait out streams
+	s.httpServer.RegisterOnShutdown(handler.Shutdown)
+
+	s.grpcService = rpc.NewService(s.driver)
+	if cfg.GRPCAddr != "" {
+		s.grpcServer = rpc.NewServer(s.grpcService, auth)
+	}
+	if cfg.RESPAddr != "" {
+		s.respServer = resp.NewServer(s.driver)
+		s.respServer.Auth = auth
+	}
+	return nil
+}
+
+// Driver returns the Driver the Server serves
+func (s *Server) Driver() *db.Driver {
+	return s.driver
+}
+
+// Handler returns the HTTP API handler, to be adjusted before Start
+func (s *Server) Handler() *api.Handler {
+	return s.handler
+}
+
+// Addr returns the address the HTTP server listens on, which tells the port
+// picked for an address such as ":0". It is nil before Start.
+func (s *Server) Addr() net.Addr {
+	if s.httpLis == nil {
+		return nil
+	}
+	return s.httpLis.Addr()
+}
+
+// Start listens on every configured address and serves in the background.
+// Every address is listened on before any is served, so that a busy one is
+// reported before the Server takes requests.
+func (s *Server) Start() error {
+	cfg := s.cfg
+	var grpcLis, respLis net.Listener
+	lis, err := config.Listen(cfg.Addr, cfg.SocketMode)
+	if err != nil {
+		return fmt.Errorf("server failed to listen: %w", err)
+	}
+	if s.grpcServer != nil {
+		if grpcLis, err = config.Listen(cfg.GRPCAddr, cfg.SocketMode); err != nil {
+			lis.Close()
+			return fmt.Errorf("gRPC server failed to listen: %w", err)
+		}
+	}
+	if s.respServer != nil {
+		if respLis, err = config.Listen(cfg.RESPAddr, cfg.SocketMode); err != nil {
+			lis.Close()
+			if grpcLis != nil {
+				grpcLis.Close()
+			}
+			return fmt.Errorf("RESP server failed to listen: %w", err)
+		}
+	}
+	s.httpLis = lis
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.group, s.stopped = errgroup.WithContext(ctx)
+
+	// Shutdown closes the listeners, which also removes Unix socket files
+	s.group.Go(func() error {
+		s.log.Info("Server starting on %s", cfg.Addr)
+		if err := s.httpServer.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("server failed: %w", err)
+		}
+		return nil
+	})
+	if grpcLis != nil {
+		s.group.Go(func() error {
+			s.log.Info("gRPC server starting on %s", cfg.GRPCAddr)
+			if err := s.grpcServer.Serve(grpcLis); err != nil {
+				return fmt.Errorf("gRPC server failed: %w", err)
+			}
+			return nil
+		})
+	}
+	if respLis != nil {
+		s.group.Go(func() error {
+			s.log.Info("RESP server starting on %s", cfg.RESPAddr)
+			if err := s.respServer.Serve(respLis); !errors.Is(err, resp.ErrServerClosed) {
+				return fmt.Errorf("RESP server failed: %w", err)
+			}
+			return nil
+		})
+	}
+
+	// Pick up edits to the key file every few seconds
+	if cfg.APIKeyFile != "" {
+		go s.handler.Auth.WatchFile(ctx, 5*time.Second, s.log)
+	}
+	s.group.Go(func() error {
+		s.handler.Webhooks.Run(ctx)
+		return nil
+	})
+	if s.rep != nil {
+		s.group.Go(func() error {
+			s.log.Info("Replicating from %s", cfg.ReplicaOf)
+			s.rep.Run(ctx)
+			return nil
+		})
+	}
+	return nil
+}
+
+// Done is closed once a server fails, after which the Server should be
+// Shut down. It is nil before Start.
+func (s *Server) Done() <-chan struct{} {
+	if s.stopped == nil {
+		return nil
+	}
+	return s.stopped.Done()
+}
+
+// Shutdown stops the servers, letting requests in flight finish until ctx
+// is done, then stops replication and closes the Driver, which saves its
+// snapshot. It returns the error a server failed with, if any, along with
+// those of shutting down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+	if s.group != nil {
+		// Doesn't block if no connections, but will otherwise wait until
+		// the deadline
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("server forced to shutdown: %w", err))
+		}
+
+		// Stop gRPC within the same deadline, cutting off calls still running
+		if s.grpcServer != nil {
+			s.grpcService.Shutdown()
+			stopped := make(chan struct{})
+			go func() {
+				s.grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				s.grpcServer.Stop()
+				errs = append(errs, fmt.Errorf("gRPC server forced to shutdown"))
+			}
+		}
+		if s.respServer != nil {
+			s.respServer.Close()
+		}
+
+		// Stop applying changes before the B-tree is written out
+		s.cancel()
+		if err := s.group.Wait(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Close saves the B-tree snapshot Open loaded
+	if err := s.driver.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close the database: %w", err))
+	} else {
+		s.log.Info("Database closed")
+	}
+	if err := s.shutdownTracer(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// shutdownTracer flushes the spans still buffered
+func (s *Server) shutdownTracer(ctx context.Context) error {
+	if s.tracer == nil {
+		return nil
+	}
+	if err := s.tracer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to flush traces: %w", err)
+	}
+	return nil
+}
+
+// Run serves cfg until SIGINT or SIGTERM, then shuts down within
+// cfg.ShutdownTimeout
+func Run(cfg *config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return RunContext(ctx, cfg)
+}
+
+// RunContext serves cfg until ctx is done or a server fails, then shuts
+// down within cfg.ShutdownTimeout
+func RunContext(ctx context.Context, cfg *config.Config) error {
+	s, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	if err := s.Start(); err != nil {
+		return errors.Join(err, s.Shutdown(context.Background()))
+	}
+
+	select {
+	case <-ctx.Done():
+		s.log.Info("Received shutdown signal")
+	case <-s.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/client"
+	"github.com/toblrne/ZephyrusDBv2/config"
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	cfg := config.Default()
+	cfg.DataDir = t.TempDir()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.GRPCAddr = "127.0.0.1:0"
+	cfg.RESPAddr = "127.0.0.1:0"
+	cfg.LogLevel = "error"
+	return cfg
+}
+
+func TestServer(t *testing.T) {
+	cfg := testConfig(t)
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	if err := s.Start(); err != nil {
+		s.Shutdown(context.Background())
+		t.Fatalf("Start failed: %s", err)
+	}
+
+	ctx := context.Background()
+	c, err := client.New("http://" + s.Addr().String())
+	if err != nil {
+		t.Fatalf("client.New failed: %s", err)
+	}
+	if err := c.Put(ctx, "user:1", []byte(`{"name":"ada"}`)); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+	if value, err := c.Get(ctx, "user:1"); err != nil || string(value) != `{"name":"ada"}` {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+	if _, err := c.Get(ctx, "user:2"); !errors.Is(err, client.ErrKeyNotFound) {
+		t.Errorf("Get of a missing key = %v, want ErrKeyNotFound", err)
+	}
+
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+	if _, err := c.Get(ctx, "user:1"); err == nil {
+		t.Errorf("Get after Shutdown succeeded")
+	}
+
+	// The write outlives the server
+	driver, err := db.Open(cfg.DataDir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen the data directory: %s", err)
+	}
+	defer driver.Close()
+	if value, err := driver.Get("user:1"); err != nil || string(value) != `{"name":"ada"}` {
+		t.Errorf("Get after reopening = %q, %v", value, err)
+	}
+}
+
+func TestServerAddressInUse(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer busy.Close()
+
+	cfg := testConfig(t)
+	cfg.RESPAddr = busy.Addr().String()
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	if err := s.Start(); err == nil {
+		t.Errorf("Start with a busy RESP address succeeded")
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown after a failed Start = %v", err)
+	}
+
+	// RunContext reports the failure, leaving the data directory unlocked
+	if err := RunContext(context.Background(), cfg); err == nil {
+		t.Errorf("RunContext with a busy RESP address succeeded")
+	}
+	cfg.RESPAddr = ""
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := RunContext(ctx, cfg); err != nil {
+		t.Errorf("RunContext until cancelled = %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+// Package webhook sends signed HTTP callbacks for the changes made to a
+// Driver's keys, for receivers that cannot keep a watch stream open.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// metaFile holds the registered webhooks in the Driver's metadata directory
+const metaFile = "webhooks.json"
+
+// Headers of every delivery. SignatureHeader holds "sha256=" and the hex
+// HMAC-SHA256 of the body, keyed with the webhook's secret.
+const (
+	SignatureHeader = "X-Zephyrus-Signature"
+	EventHeader     = "X-Zephyrus-Event"
+	DeliveryHeader  = "X-Zephyrus-Delivery"
+)
+
+// ErrNotFound is returned for a webhook ID that is not registered
+var ErrNotFound = errors.New("no such webhook")
+
+// ErrInvalid is returned, wrapped with the reason, for a webhook that cannot
+// be registered
+var ErrInvalid = errors.New("invalid webhook")
+
+// Webhook is a URL notified of the changes to the keys starting with one of
+// Prefixes, or to every key without any
+type Webhook struct {
+	ID       string   `json:"id"`
+	URL      string   `json:"url"`
+	Prefixes []string `json:"prefixes,omitempty"`
+	Secret   string   `json:"secret,omitempty"` // signs the deliveries, see SignatureHeader
+}
+
+// matches reports whether a change to key is sent to the webhook. Reserved
+// keys, whose values may be secrets, never are.
+func (w *Webhook) matches(key string) bool {
+	if db.Reserved(key) {
+		return false
+	}
+	if len(w.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range w.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats counts the deliveries to one webhook since the Dispatcher started
+type Stats struct {
+	Delivered    uint64    `json:"delivered"`
+	Retries      uint64    `json:"retries"`       // failed attempts that were tried again
+	DeadLettered uint64    `json:"dead_lettered"` // notifications given up on after MaxAttempts
+	Dropped      uint64    `json:"dropped"`       // notifications not queued, the queue being full
+	LastStatus   int       `json:"last_status,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastDelivery time.Time `json:"last_delivery,omitempty"`
+}
+
+// Info is a registered webhook, without its secret, and its Stats
+type Info struct {
+	Webhook
+	Stats Stats `json:"stats"`
+}
+
+// Notification is the JSON body of a delivery
+type Notification struct {
+	ID      string    `json:"id"` // the same for every attempt, see DeliveryHeader
+	Webhook string    `json:"webhook"`
+	Op      db.Op     `json:"op"`
+	Key     string    `json:"key"`
+	Time    time.Time `json:"time"`
+}
+
+// delivery is a notification waiting for a worker
+type delivery struct {
+	hook *registered
+	body Notification
+}
+
+// registered is a webhook and what was sent to it
+type registered struct {
+	Webhook
+	mu    sync.Mutex
+	stats Stats
+}
+
+// Dispatcher notifies the registered webhooks of every put and delete,
+// including expiries and changes applied from a primary. Writes only queue
+// notifications; a pool of workers started by Run delivers them, so a slow
+// receiver never holds up a write. Deliveries are POSTs that count as done
+// on a 2xx status and are tried again otherwise, up to MaxAttempts times
+// with a backoff doubling from Backoff to MaxBackoff. Notifications still
+// queued when Run returns are lost, and receivers may see one more than
+// once or out of order.
+type Dispatcher struct {
+	driver *db.Driver
+
+	// Workers is how many deliveries are made at once
+	Workers int
+	// MaxAttempts is how many times a delivery is tried before it is
+	// dead-lettered
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled for each one after
+	// up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// HTTPClient makes the deliveries; its Timeout bounds each attempt
+	HTTPClient *http.Client
+
+	mu    sync.Mutex
+	hooks map[string]*registered // by ID
+	queue chan delivery
+}
+
+// New returns a Dispatcher for driver, with the webhooks saved by Register,
+// queueing up to queueSize notifications for its workers. It must be
+// created once per Driver, as it stays hooked into its writes.
+func New(driver *db.Driver, queueSize int) (*Dispatcher, error) {
+	d := &Dispatcher{
+		driver:      driver,
+		Workers:     4,
+		MaxAttempts: 5,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute,
+		HTTPClient:  &http.Client{Timeout: 10 * time.Second},
+		hooks:       make(map[string]*registered),
+		queue:       make(chan delivery, queueSize),
+	}
+	data, err := driver.ReadMetaFile(metaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the webhooks: %w", err)
+	}
+	if data != nil {
+		var saved []Webhook
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, fmt.Errorf("failed to load the webhooks: %w", err)
+		}
+		for _, w := range saved {
+			d.hooks[w.ID] = &registered{Webhook: w}
+		}
+	}
+
+	driver.OnPut(func(key string, _ []byte) { d.enqueue(db.OpPut, key) })
+	driver.OnDelete(func(key string) { d.enqueue(db.OpDelete, key) })
+	return d, nil
+}
+
+// Register adds a webhook, giving it an ID and, when it has none, a secret,
+// and saves it with the Driver's metadata. It returns the webhook as
+// registered, the only time its secret is returned.
+func (d *Dispatcher) Register(w Webhook) (Webhook, error) {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("%w: url %q must be an http or https URL", ErrInvalid, w.URL)
+	}
+	if w.ID, err = randomHex(8); err != nil {
+		return Webhook{}, err
+	}
+	if w.Secret == "" {
+		if w.Secret, err = randomHex(16); err != nil {
+			return Webhook{}, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hooks[w.ID] = &registered{Webhook: w}
+	if err := d.save(); err != nil {
+		delete(d.hooks, w.ID)
+		return Webhook{}, err
+	}
+	return w, nil
+}
+
+// Remove unregisters a webhook, failing with ErrNotFound for an unknown ID.
+// Deliveries already queued for it are still made.
+func (d *Dispatcher) Remove(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h, ok := d.hooks[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	delete(d.hooks, id)
+	if err := d.save(); err != nil {
+		d.hooks[id] = h
+		return err
+	}
+	return nil
+}
+
+// List returns the registered webhooks, without their secrets, and their
+// delivery stats, ordered by ID
+func (d *Dispatcher) List() []Info {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	infos := make([]Info, 0, len(d.hooks))
+	for _, h := range d.hooks {
+		info := Info{Webhook: h.Webhook}
+		info.Secret = ""
+		h.mu.Lock()
+		info.Stats = h.stats
+		h.mu.Unlock()
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// save writes the webhooks to the metadata directory. The caller must hold
+// mu.
+func (d *Dispatcher) save() error {
+	saved := make([]Webhook, 0, len(d.hooks))
+	for _, h := range d.hooks {
+		saved = append(saved, h.Webhook)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := d.driver.WriteMetaFile(metaFile, data); err != nil {
+		return fmt.Errorf("failed to save the webhooks: %w", err)
+	}
+	return nil
+}
+
+// enqueue queues a notification of a change for every webhook it matches,
+// counting it as dropped for those it does not fit in the queue for. It is
+// called by the writer and must not block.
+func (d *Dispatcher) enqueue(op db.Op, key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now().UTC()
+	for _, h := range d.hooks {
+		if !h.matches(key) {
+			continue
+		}
+		id, err := randomHex(8)
+		if err != nil {
+			continue
+		}
+		select {
+		case d.queue <- delivery{hook: h, body: Notification{ID: id, Webhook: h.ID, Op: op, Key: key, Time: now}}:
+		default:
+			h.mu.Lock()
+			h.stats.Dropped++
+			h.mu.Unlock()
+		}
+	}
+}
+
+// Run delivers the queued notifications with Workers workers until ctx is
+// cancelled, abandoning the retries then under way
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < max(d.Workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case dl := <-d.queue:
+					d.deliver(ctx, dl)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// deliver makes the attempts at one delivery, backing off between them
+func (d *Dispatcher) deliver(ctx context.Context, dl delivery) {
+	body, err := json.Marshal(dl.body)
+	if err != nil {
+		return
+	}
+	backoff := d.Backoff
+	for attempt := 1; ; attempt++ {
+		status, err := d.post(ctx, dl, body)
+		h := dl.hook
+		h.mu.Lock()
+		h.stats.LastStatus = status
+		h.stats.LastDelivery = time.Now()
+		h.stats.LastError = ""
+		if err != nil {
+			h.stats.LastError = err.Error()
+		}
+		switch {
+		case err == nil:
+			h.stats.Delivered++
+		case attempt >= d.MaxAttempts:
+			h.stats.DeadLettered++
+			d.driver.Logger().Error("[WEBHOOK] Giving up on delivery %s to %s after %d attempts: %v", dl.body.ID, h.URL, attempt, err)
+		default:
+			h.stats.Retries++
+		}
+		h.mu.Unlock()
+		if err == nil || attempt >= d.MaxAttempts {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, d.MaxBackoff)
+	}
+}
+
+// post makes one attempt at a delivery, returning the status it got, 0 when
+// there was no response
+func (d *Dispatcher) post(ctx context.Context, dl delivery, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dl.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(dl.body.Op))
+	req.Header.Set(DeliveryHeader, dl.body.ID)
+	req.Header.Set(SignatureHeader, Sign(dl.hook.Secret, body))
+
+	resp, err := d.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the SignatureHeader of a delivery body, for receivers to
+// compare, with hmac.Equal, against the one they got
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// randomHex returns n random bytes in hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,172 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toblrne/ZephyrusDBv2/db"
+)
+
+// receiver records the notifications it gets, failing the first fail
+// attempts
+type receiver struct {
+	mu       sync.Mutex
+	fail     int
+	attempts int
+	got      []Notification
+	bad      int // deliveries with a wrong signature
+}
+
+func (r *receiver) handler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.attempts++
+		if req.Header.Get(SignatureHeader) != Sign(secret, body) {
+			r.bad++
+		}
+		if r.attempts <= r.fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var n Notification
+		json.Unmarshal(body, &n)
+		r.got = append(r.got, n)
+	})
+}
+
+func (r *receiver) received() []Notification {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Notification(nil), r.got...)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	dir := t.TempDir()
+	driver, err := db.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	d, err := New(driver, 16)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	d.Backoff, d.MaxAttempts = time.Millisecond, 2
+
+	rec := &receiver{fail: 1}
+	srv := httptest.NewServer(rec.handler("s3cret"))
+	defer srv.Close()
+	w, err := d.Register(Webhook{URL: srv.URL, Prefixes: []string{"users:"}, Secret: "s3cret"})
+	if err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+	if _, err := d.Register(Webhook{URL: "ftp://example.com"}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Register of an ftp URL = %v, want ErrInvalid", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+
+	driver.Put("users:1", []byte("ada"))
+	driver.Put("orders:1", []byte("book"))
+	driver.Delete("users:1")
+
+	// The first attempt fails and is retried
+	waitFor(t, "two notifications", func() bool { return len(rec.received()) == 2 })
+	got := rec.received()
+	ops := map[db.Op]bool{got[0].Op: true, got[1].Op: true}
+	if !ops[db.OpPut] || !ops[db.OpDelete] || got[0].Key != "users:1" || got[0].Webhook != w.ID {
+		t.Errorf("notifications = %+v, want a put and a delete of users:1", got)
+	}
+	rec.mu.Lock()
+	if rec.bad != 0 {
+		t.Errorf("%d deliveries had a wrong signature", rec.bad)
+	}
+	rec.mu.Unlock()
+	if stats := d.List()[0].Stats; stats.Delivered != 2 || stats.Retries != 1 || stats.LastStatus != http.StatusOK {
+		t.Errorf("stats = %+v, want 2 delivered after 1 retry", stats)
+	}
+	if d.List()[0].Secret != "" {
+		t.Errorf("List returned the secret")
+	}
+
+	// A receiver that keeps failing is given up on
+	rec.mu.Lock()
+	rec.fail = 1 << 30
+	rec.mu.Unlock()
+	driver.Put("users:2", []byte("bob"))
+	waitFor(t, "a dead letter", func() bool { return d.List()[0].Stats.DeadLettered == 1 })
+
+	cancel()
+	<-done
+	driver.Close()
+
+	// Webhooks are kept with the data
+	driver, err = db.Open(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen driver: %s", err)
+	}
+	defer driver.Close()
+	d, err = New(driver, 16)
+	if err != nil {
+		t.Fatalf("New after reopening failed: %s", err)
+	}
+	if list := d.List(); len(list) != 1 || list[0].ID != w.ID || list[0].URL != srv.URL {
+		t.Fatalf("webhooks after reopening = %+v, want %s", list, w.ID)
+	}
+	if err := d.Remove(w.ID); err != nil {
+		t.Errorf("Remove failed: %s", err)
+	}
+	if err := d.Remove(w.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Remove of a removed webhook = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	driver, err := db.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	defer driver.Close()
+	d, err := New(driver, 1)
+	if err != nil {
+		t.Fatalf("New failed: %s", err)
+	}
+	if _, err := d.Register(Webhook{URL: "http://127.0.0.1:1/hook"}); err != nil {
+		t.Fatalf("Register failed: %s", err)
+	}
+
+	// Without workers, writes go through and notifications past the queue
+	// are counted as dropped
+	for _, key := range []string{"a", "b", "c"} {
+		if err := driver.Put(key, []byte("v")); err != nil {
+			t.Fatalf("Put failed: %s", err)
+		}
+	}
+	if stats := d.List()[0].Stats; stats.Dropped != 2 {
+		t.Errorf("dropped = %d, want 2", stats.Dropped)
+	}
+}